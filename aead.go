@@ -22,6 +22,7 @@
 package crypto11
 
 import (
+	"bytes"
 	"crypto/cipher"
 	"errors"
 	"fmt"
@@ -44,6 +45,20 @@ const (
 
 var errBadGCMNonceSize = errors.New("nonce slice too small to hold IV")
 
+var errGCMIVReplaced = errors.New("token did not use the supplied IV")
+
+// checkGCMIVEcho checks the IV the token wrote back into CK_GCM_PARAMS, echoed, against the nonce passed to Seal.
+// Only the nonce itself is accepted: a token that replaced it would leave the caller unable to open the ciphertext.
+func checkGCMIVEcho(nonce, echoed []byte) error {
+	if len(echoed) != len(nonce) {
+		return errBadGCMNonceSize
+	}
+	if !bytes.Equal(echoed, nonce) {
+		return errGCMIVReplaced
+	}
+	return nil
+}
+
 type genericAead struct {
 	key *SecretKey
 
@@ -51,6 +66,10 @@ type genericAead struct {
 
 	nonceSize int
 
+	// multiPart is set if the mechanism supports multi-part operations, so that inputs longer than the maximum
+	// single-call size can be passed to the token in pieces.
+	multiPart bool
+
 	// Note - if the GCMParams result is non-nil, the caller must call Free() on the params when
 	// finished.
 	makeMech func(nonce []byte, additionalData []byte, encrypt bool) ([]*pkcs11.Mechanism, *pkcs11.GCMParams, error)
@@ -61,9 +80,13 @@ type genericAead struct {
 //
 // This depends on the HSM supporting the CKM_*_GCM mechanism. If it is not supported
 // then you must use cipher.NewGCM; it will be slow.
+//
+// A *KeyUsageError is returned if the key is not a GCM-capable type, or has neither CKA_ENCRYPT nor CKA_DECRYPT.
+// GCM is single-part, so Open fails and Seal panics with an error wrapping ErrInputTooLarge if the input exceeds
+// Config.MaxSingleCallSize.
 func (key *SecretKey) NewGCM() (cipher.AEAD, error) {
-	if key.Cipher.GCMMech == 0 {
-		return nil, fmt.Errorf("GCM not implemented for key type %#x", key.Cipher.GenParams[0].KeyType)
+	if err := key.checkCipherUsage("GCM", key.Cipher.GCMMech, true, true); err != nil {
+		return nil, err
 	}
 
 	g := genericAead{
@@ -91,6 +114,10 @@ func (key *SecretKey) NewGCM() (cipher.AEAD, error) {
 // Despite the cipher.AEAD return type, there is no support for additional data and no authentication.
 // This method exists to provide a convenient way to do bulk (possibly padded) CBC encryption.
 // Think carefully before passing the cipher.AEAD to any consumer that expects authentication.
+//
+// Inputs longer than Config.MaxSingleCallSize are passed to the token in pieces.
+//
+// A *KeyUsageError is returned if the key does not support CBC, or has neither CKA_ENCRYPT nor CKA_DECRYPT.
 func (key *SecretKey) NewCBC(paddingMode PaddingMode) (cipher.AEAD, error) {
 
 	var pkcsMech uint
@@ -104,10 +131,15 @@ func (key *SecretKey) NewCBC(paddingMode PaddingMode) (cipher.AEAD, error) {
 		return nil, errors.New("unrecognized padding mode")
 	}
 
+	if err := key.checkCipherUsage("CBC", pkcsMech, true, true); err != nil {
+		return nil, err
+	}
+
 	g := genericAead{
 		key:       key,
 		overhead:  0,
 		nonceSize: key.BlockSize(),
+		multiPart: true,
 		makeMech: func(nonce []byte, additionalData []byte, encrypt bool) ([]*pkcs11.Mechanism, *pkcs11.GCMParams, error) {
 			if len(additionalData) > 0 {
 				return nil, nil, errors.New("additional data not supported for CBC mode")
@@ -128,10 +160,27 @@ func (g genericAead) Overhead() int {
 	return g.overhead
 }
 
+// checkCallSize returns the piece size for an input of n bytes, or zero if it can be passed to the token in one call.
+// An error wrapping ErrInputTooLarge is returned if the input is too large and the mechanism is single-part.
+func (g genericAead) checkCallSize(n int) (int, error) {
+	limit := g.key.context.maxSingleCallSize()
+	if limit == 0 || n <= limit {
+		return 0, nil
+	}
+	if !g.multiPart {
+		return 0, withMessagef(ErrInputTooLarge, "%d byte input, limit %d bytes", n, limit)
+	}
+	return callChunkSize(limit, g.key.Cipher.BlockSize), nil
+}
+
 func (g genericAead) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	chunk, err := g.checkCallSize(len(plaintext))
+	if err != nil {
+		panic(err)
+	}
 
 	var result []byte
-	if err := g.key.context.withSession(func(session *pkcs11Session) (err error) {
+	if err := g.key.withSession(func(session *pkcs11Session) (err error) {
 		mech, params, err := g.makeMech(nonce, additionalData, true)
 
 		if err != nil {
@@ -139,19 +188,30 @@ func (g genericAead) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
 		}
 		defer params.Free()
 
-		if err = session.ctx.EncryptInit(session.handle, mech, g.key.handle); err != nil {
+		if err = session.encryptInit(mech, g.key.handle); err != nil {
 			err = fmt.Errorf("C_EncryptInit: %v", err)
 			return
 		}
-		if result, err = session.ctx.Encrypt(session.handle, plaintext); err != nil {
+		if chunk > 0 {
+			if result, err = session.encryptParts(plaintext, chunk); err != nil {
+				err = fmt.Errorf("C_EncryptUpdate: %v", err)
+				return
+			}
+		} else if result, err = session.encrypt(plaintext); err != nil {
 			err = fmt.Errorf("C_Encrypt: %v", err)
 			return
 		}
+		if g.overhead > 0 {
+			// Only GCM has an overhead, its tag.
+			err = g.key.context.checkOutputLength("GCM ciphertext", "the plaintext length plus the tag length",
+				len(plaintext)+g.overhead, result)
+			if err != nil {
+				return
+			}
+		}
 
 		if g.key.context.cfg.UseGCMIVFromHSM && g.key.context.cfg.GCMIVFromHSMControl.SupplyIvForHSMGCMEncrypt {
-			if len(nonce) != len(params.IV()) {
-				return errBadGCMNonceSize
-			}
+			return checkGCMIVEcho(nonce, params.IV())
 		}
 
 		return
@@ -164,19 +224,29 @@ func (g genericAead) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
 }
 
 func (g genericAead) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	chunk, err := g.checkCallSize(len(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+
 	var result []byte
-	if err := g.key.context.withSession(func(session *pkcs11Session) (err error) {
+	if err := g.key.withSession(func(session *pkcs11Session) (err error) {
 		mech, params, err := g.makeMech(nonce, additionalData, false)
 		if err != nil {
 			return
 		}
 		defer params.Free()
 
-		if err = session.ctx.DecryptInit(session.handle, mech, g.key.handle); err != nil {
+		if err = session.decryptInit(mech, g.key.handle); err != nil {
 			err = fmt.Errorf("C_DecryptInit: %v", err)
 			return
 		}
-		if result, err = session.ctx.Decrypt(session.handle, ciphertext); err != nil {
+		if chunk > 0 {
+			if result, err = session.decryptParts(ciphertext, chunk); err != nil {
+				err = fmt.Errorf("C_DecryptUpdate: %v", err)
+				return
+			}
+		} else if result, err = session.decrypt(mech[0].Mechanism, ciphertext); err != nil {
 			err = fmt.Errorf("C_Decrypt: %v", err)
 			return
 		}
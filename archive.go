@@ -0,0 +1,399 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Archived keys follow a convention that other tools can rely on. Archiving a key replaces the CKA_LABEL of its
+// objects (both halves of a key pair) with ArchivedLabelPrefix followed by 16 lowercase hexadecimal digits, unique
+// to the archival. A CKO_DATA object, the tombstone, records the archival: its CKA_APPLICATION is
+// ArchiveApplication, its CKA_LABEL is the archived label, and its CKA_VALUE is an ArchiveRecord encoded as JSON.
+// Unarchiving restores the labels from the tombstone and destroys it.
+const (
+	// ArchivedLabelPrefix begins the CKA_LABEL of every archived key object.
+	ArchivedLabelPrefix = "crypto11-archived:"
+
+	// ArchiveApplication is the CKA_APPLICATION of the tombstones of archived keys.
+	ArchiveApplication = "crypto11 archive"
+)
+
+// ErrKeyArchived is returned when an archived key is used to sign, decrypt or derive, or is archived again.
+var ErrKeyArchived = errors.New("key is archived")
+
+// ArchiveRecord is the content of a tombstone, see ArchivedLabelPrefix.
+type ArchiveRecord struct {
+	// Label is the CKA_LABEL of the key, or of the private half of a key pair, before it was archived.
+	Label []byte `json:"label"`
+
+	// PublicLabel is the CKA_LABEL of the public half of a key pair before it was archived. It is nil for secret
+	// keys and for key pairs without a public key object.
+	PublicLabel []byte `json:"publicLabel"`
+
+	// ArchivedAt is when the key was archived, by the clock used for validity checks (see Config.UseTokenClock).
+	ArchivedAt time.Time `json:"archivedAt"`
+
+	// Reason is the reason given to Archive.
+	Reason string `json:"reason,omitempty"`
+}
+
+// archiveTarget is the token objects behind a key passed to Archive or Unarchive.
+type archiveTarget struct {
+	object *pkcs11Object
+
+	// handle is the handle of object, read once so that a concurrent repin cannot change it, see
+	// pkcs11PrivateKey.objectHandles.
+	handle pkcs11.ObjectHandle
+
+	// pubHandle is the public half of a key pair, or zero.
+	pubHandle pkcs11.ObjectHandle
+
+	// pin is the key pair's keyPin, if it has one.
+	pin *keyPin
+}
+
+// isArchivedLabel returns true if label follows the convention for archived keys.
+func isArchivedLabel(label []byte) bool {
+	return bytes.HasPrefix(label, []byte(ArchivedLabelPrefix))
+}
+
+// checkArchived returns an error wrapping ErrKeyArchived if the key is known to be archived.
+func (o *pkcs11Object) checkArchived(operation string) error {
+	if o.archived.Get() {
+		return withMessagef(ErrKeyArchived, "cannot use key for %s", operation)
+	}
+	return nil
+}
+
+// Archived returns true if the key was archived when it was found, or has been archived since through this
+// object. key may be a key pair returned by this package or a *SecretKey.
+func Archived(key interface{}) bool {
+	target, err := archiveTargetOf(key)
+	return err == nil && target.object.archived.Get()
+}
+
+// archiveTargetOf returns the objects behind key.
+func archiveTargetOf(key interface{}) (*archiveTarget, error) {
+	switch k := key.(type) {
+	case *pkcs11PrivateKeyRSA, *pkcs11PrivateKeyECDSA, *pkcs11PrivateKeyDSA:
+		priv := tokenKeyOf(k.(Signer))
+		handle, pubHandle := priv.objectHandles()
+		return &archiveTarget{object: &priv.pkcs11Object, handle: handle, pubHandle: pubHandle, pin: priv.pin}, nil
+	case *SecretKey:
+		return &archiveTarget{object: &k.pkcs11Object, handle: k.handle}, nil
+	default:
+		return nil, fmt.Errorf("cannot archive object of type %T", key)
+	}
+}
+
+// setLabel sets the CKA_LABEL of the target's objects, and of its keyPin so that it can be re-resolved after
+// Resume. The public half is only relabelled if publicLabel is non-nil.
+func (t *archiveTarget) setLabel(session *pkcs11Session, label, publicLabel []byte) error {
+	err := session.ctx.SetAttributeValue(session.handle, t.handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != nil {
+		return withMessage(err, "failed to relabel key")
+	}
+	if t.pubHandle != 0 && publicLabel != nil {
+		err = session.ctx.SetAttributeValue(session.handle, t.pubHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, publicLabel),
+		})
+		if err != nil {
+			return withMessage(err, "failed to relabel public key")
+		}
+	}
+	if t.pin != nil {
+		t.pin.mutex.Lock()
+		t.pin.label = label
+		t.pin.mutex.Unlock()
+	}
+	return nil
+}
+
+// readLabel returns the CKA_LABEL of handle, or an empty label if it has none.
+func readLabel(session *pkcs11Session, handle pkcs11.ObjectHandle) ([]byte, error) {
+	attributes, err := session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if attributes[0].Value == nil {
+		return []byte{}, nil
+	}
+	return attributes[0].Value, nil
+}
+
+// Archive moves key, a key pair returned by this package or a *SecretKey, into the archived state described at
+// ArchivedLabelPrefix. Archived keys are left out of Find results unless IncludeArchived is requested, and refuse to
+// sign, decrypt or derive with ErrKeyArchived. Public key objects of archived key pairs are relabelled too, but can
+// still be found by CKA_ID with FindPublicKey and used to verify and encrypt.
+//
+// Other objects loaded before the key was archived, in this or another process, are not told of the archival and
+// remain usable until they are found again. Keys whose CKA_LABEL cannot be modified cannot be archived.
+func (c *Context) Archive(key interface{}, reason string) error {
+	if c.closed.Get() {
+		return errClosed
+	}
+	target, err := archiveTargetOf(key)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err = io.ReadFull(c.randReader(), suffix); err != nil {
+		return withMessage(err, "generating archived label")
+	}
+	archivedLabel := []byte(ArchivedLabelPrefix + hex.EncodeToString(suffix))
+
+	err = c.withSession(func(session *pkcs11Session) (err error) {
+		record := ArchiveRecord{ArchivedAt: c.referenceTime(), Reason: reason}
+		if record.Label, err = readLabel(session, target.handle); err != nil {
+			return err
+		}
+		if isArchivedLabel(record.Label) {
+			return withMessage(ErrKeyArchived, "cannot archive key")
+		}
+		var publicLabel []byte
+		if target.pubHandle != 0 {
+			if record.PublicLabel, err = readLabel(session, target.pubHandle); err != nil {
+				return err
+			}
+			publicLabel = archivedLabel
+		}
+
+		value, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		tombstone, err := session.ctx.CreateObject(session.handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, archivedLabel),
+			pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, ArchiveApplication),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, value),
+		})
+		if err != nil {
+			return withMessage(err, "failed to create archive tombstone")
+		}
+
+		if err = target.setLabel(session, archivedLabel, publicLabel); err != nil {
+			// Put back whichever labels were changed, and remove the tombstone.
+			_ = target.setLabel(session, record.Label, record.PublicLabel)
+			_ = session.ctx.DestroyObject(session.handle, tombstone)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return withMessage(err, "failed to archive key")
+	}
+
+	target.object.archived.Set(true)
+	return nil
+}
+
+// Unarchive restores a key archived with Archive, or archived by another process following the same convention. key
+// must have been found with IncludeArchived, or be the object passed to Archive.
+func (c *Context) Unarchive(key interface{}) error {
+	if c.closed.Get() {
+		return errClosed
+	}
+	target, err := archiveTargetOf(key)
+	if err != nil {
+		return err
+	}
+
+	err = c.withSession(func(session *pkcs11Session) error {
+		label, err := readLabel(session, target.handle)
+		if err != nil {
+			return err
+		}
+		if !isArchivedLabel(label) {
+			return errors.New("key is not archived")
+		}
+		tombstone, record, err := findTombstone(session, label)
+		if err != nil {
+			return err
+		}
+
+		publicLabel := record.PublicLabel
+		if publicLabel == nil {
+			publicLabel = record.Label
+		}
+		if err = target.setLabel(session, record.Label, publicLabel); err != nil {
+			return err
+		}
+		return withMessage(session.ctx.DestroyObject(session.handle, tombstone), "failed to destroy archive tombstone")
+	})
+	if err != nil {
+		return withMessage(err, "failed to unarchive key")
+	}
+
+	target.object.archived.Set(false)
+	return nil
+}
+
+// DestroyArchived destroys the keys that have been archived for at least olderThan, together with their
+// tombstones, and returns the number of keys destroyed. Objects with an archived label but no tombstone are left
+// alone, since their archival time is unknown.
+func (c *Context) DestroyArchived(olderThan time.Duration) (destroyed int, err error) {
+	if c.closed.Get() {
+		return 0, errClosed
+	}
+	if c.cfg.PublicOnly {
+		return 0, ErrLoginRequired
+	}
+
+	now := c.referenceTime()
+	err = c.withSession(func(session *pkcs11Session) error {
+		tombstones, err := findKeysWithAttributes(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+			pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, ArchiveApplication),
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, tombstone := range tombstones {
+			label, record, err := readTombstone(session, tombstone)
+			if err != nil {
+				return err
+			}
+			if now.Sub(record.ArchivedAt) < olderThan {
+				continue
+			}
+
+			for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_SECRET_KEY} {
+				handles, err := findKeys(session, nil, label, uintPtr(class), nil)
+				if err != nil {
+					return err
+				}
+				for _, handle := range handles {
+					if err = session.ctx.DestroyObject(session.handle, handle); err != nil {
+						return withMessagef(err, "failed to destroy archived key %q", label)
+					}
+				}
+			}
+			if err = session.ctx.DestroyObject(session.handle, tombstone); err != nil {
+				return withMessagef(err, "failed to destroy tombstone of archived key %q", label)
+			}
+			destroyed++
+		}
+		return nil
+	})
+	return destroyed, err
+}
+
+// findTombstone returns the tombstone of the key with the archived label, and its record.
+func findTombstone(session *pkcs11Session, label []byte) (pkcs11.ObjectHandle, *ArchiveRecord, error) {
+	handles, err := findKeysWithAttributes(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, ArchiveApplication),
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(handles) != 1 {
+		return 0, nil, fmt.Errorf("found %d archive tombstones for %q", len(handles), label)
+	}
+	_, record, err := readTombstone(session, handles[0])
+	return handles[0], record, err
+}
+
+// readTombstone returns the archived label and record held by a tombstone.
+func readTombstone(session *pkcs11Session, handle pkcs11.ObjectHandle) ([]byte, *ArchiveRecord, error) {
+	attributes, err := session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	record := &ArchiveRecord{}
+	if err = json.Unmarshal(attributes[1].Value, record); err != nil {
+		return nil, nil, withMessagef(err, "malformed archive tombstone %q", attributes[0].Value)
+	}
+	return attributes[0].Value, record, nil
+}
+
+// archivedLabels returns the labels of the archived keys whose CKA_LABEL was label.
+func archivedLabels(session *pkcs11Session, label []byte) ([][]byte, error) {
+	tombstones, err := findKeysWithAttributes(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, ArchiveApplication),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var labels [][]byte
+	for _, tombstone := range tombstones {
+		archivedLabel, record, err := readTombstone(session, tombstone)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(record.Label, label) {
+			labels = append(labels, archivedLabel)
+		}
+	}
+	return labels, nil
+}
+
+// archiveTemplates returns the templates for finding keys matching attributes. If attributes has a CKA_LABEL and
+// includeArchived is true, a template is added for each archived key that had that label, matching its archived
+// label instead.
+func (c *Context) archiveTemplates(attributes AttributeSet, includeArchived bool) ([]AttributeSet, error) {
+	templates := []AttributeSet{attributes}
+	label, ok := attributes[CkaLabel]
+	if !includeArchived || !ok {
+		return templates, nil
+	}
+
+	err := c.withSession(func(session *pkcs11Session) error {
+		labels, err := archivedLabels(session, label.Value)
+		if err != nil {
+			return err
+		}
+		for _, archivedLabel := range labels {
+			template := attributes.Copy()
+			if err = template.Set(CkaLabel, archivedLabel); err != nil {
+				return err
+			}
+			templates = append(templates, template)
+		}
+		return nil
+	})
+	return templates, err
+}
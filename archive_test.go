@@ -0,0 +1,131 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveRecordEncoding(t *testing.T) {
+	record := ArchiveRecord{Label: []byte("key"), PublicLabel: []byte{}, ArchivedAt: time.Unix(1700000000, 0).UTC(),
+		Reason: "rotation"}
+	value, err := json.Marshal(&record)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"label":"a2V5","publicLabel":"","archivedAt":"2023-11-14T22:13:20Z","reason":"rotation"}`,
+		string(value))
+
+	var decoded ArchiveRecord
+	require.NoError(t, json.Unmarshal(value, &decoded))
+	assert.Equal(t, record, decoded)
+
+	assert.True(t, isArchivedLabel([]byte(ArchivedLabelPrefix+"0123456789abcdef")))
+	assert.False(t, isArchivedLabel([]byte("key")))
+	assert.False(t, Archived(&PublicKey{}))
+}
+
+func TestArchiveKeyPair(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id, label := randomBytes(), randomBytes()
+		key, err := ctx.GenerateECDSAKeyPairWithLabel(id, label, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		digest := sha256.Sum256([]byte("archived"))
+		require.NoError(t, ctx.Archive(key, "rotation"))
+		assert.True(t, Archived(key))
+		_, err = key.Sign(nil, digest[:], crypto.SHA256)
+		assert.True(t, errors.Is(err, ErrKeyArchived), "%v", err)
+
+		// Archived key pairs are only found on request, by their original label.
+		found, err := ctx.FindKeyPair(nil, label)
+		require.NoError(t, err)
+		assert.Nil(t, found)
+		found, err = ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		assert.Nil(t, found)
+
+		found, err = ctx.FindKeyPairWithOptions(nil, label, &FindKeyPairOptions{IncludeArchived: true})
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.True(t, Archived(found))
+		_, err = found.Sign(nil, digest[:], crypto.SHA256)
+		assert.True(t, errors.Is(err, ErrKeyArchived), "%v", err)
+		assert.True(t, errors.Is(ctx.Archive(found, "again"), ErrKeyArchived))
+
+		require.NoError(t, ctx.Unarchive(found))
+		assert.False(t, Archived(found))
+		_, err = found.Sign(nil, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+
+		found, err = ctx.FindKeyPair(nil, label)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Error(t, ctx.Unarchive(found))
+	})
+}
+
+func TestArchiveSecretKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id, label := randomBytes(), randomBytes()
+		key, err := ctx.GenerateSecretKeyWithLabel(id, label, 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		require.NoError(t, ctx.Archive(key, ""))
+		_, err = key.NewGCM()
+		assert.True(t, errors.Is(err, ErrKeyArchived), "%v", err)
+
+		found, err := ctx.FindKey(nil, label)
+		require.NoError(t, err)
+		assert.Nil(t, found)
+
+		attributes := NewAttributeSet()
+		require.NoError(t, attributes.Set(CkaLabel, label))
+		keys, err := ctx.FindKeysWithOptions(attributes, &FindKeyOptions{IncludeArchived: true})
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		assert.True(t, Archived(keys[0]))
+
+		// A key archived just now is not old enough to be destroyed.
+		_, err = ctx.DestroyArchived(time.Hour)
+		require.NoError(t, err)
+		keys, err = ctx.FindKeysWithOptions(attributes, &FindKeyOptions{IncludeArchived: true})
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+
+		destroyed, err := ctx.DestroyArchived(0)
+		require.NoError(t, err)
+		assert.True(t, destroyed >= 1)
+		keys, err = ctx.FindKeysWithOptions(attributes, &FindKeyOptions{IncludeArchived: true})
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+}
@@ -163,6 +163,9 @@ func NewAttribute(attributeType AttributeType, value interface{}) (a *Attribute,
 
 // CopyAttribute returns a deep copy of the given Attribute.
 func CopyAttribute(a *Attribute) *Attribute {
+	if a == nil {
+		return nil
+	}
 	var value []byte
 	if a.Value != nil && len(a.Value) > 0 {
 		value = append([]byte(nil), a.Value...)
@@ -0,0 +1,418 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/miekg/pkcs11"
+)
+
+// BackupFormatVersion is the version of the wrapped-key backup format written by ExportWrappedKey.
+// ImportWrappedKey accepts this version and earlier ones.
+const BackupFormatVersion = 1
+
+// backupMagic starts every wrapped-key backup blob.
+var backupMagic = []byte("C11W")
+
+const (
+	// backupAuthenticated is set in the flags byte of a backup blob that ends with an HMAC.
+	backupAuthenticated = 1 << iota
+)
+
+// backupMACLength is the length of the CKM_SHA256_HMAC that authenticates a backup blob.
+const backupMACLength = 32
+
+// ErrUnsupportedBackupVersion is returned by ImportWrappedKey for a backup blob written by a newer version of
+// crypto11.
+var ErrUnsupportedBackupVersion = errors.New("unsupported backup format version")
+
+// ErrBackupUnauthenticated is returned by ImportWrappedKey for a backup blob without integrity protection, unless
+// BackupOptions.AllowUnauthenticated is set.
+var ErrBackupUnauthenticated = errors.New("backup blob is not integrity protected")
+
+// ErrBackupTampered is returned by ImportWrappedKey if the integrity check of a backup blob fails, because the blob
+// was altered or the wrong integrity key was used.
+var ErrBackupTampered = errors.New("backup blob failed its integrity check")
+
+// BackupOptions control ExportWrappedKey and ImportWrappedKey.
+type BackupOptions struct {
+	// IntegrityKeyLabel is the CKA_LABEL of a secret key on the token, usable with CKM_SHA256_HMAC, that
+	// authenticates the backup blob. ExportWrappedKey writes an unauthenticated blob if it is nil.
+	IntegrityKeyLabel []byte
+
+	// AllowUnauthenticated makes ImportWrappedKey accept blobs without integrity protection, for instance while
+	// migrating backups taken before an integrity key was provisioned.
+	AllowUnauthenticated bool
+
+	// WrapMechanisms lists the wrapping mechanisms ExportWrappedKey may use, in order of preference. If nil,
+	// DefaultCloneWrapMechanisms is used.
+	WrapMechanisms []uint
+}
+
+// backupAttributes are recorded in a backup blob and restored by ImportWrappedKey.
+var backupAttributes = cloneSecretKeyAttributes
+
+// ExportWrappedKey wraps key with the secret key labelled wrappingKeyLabel and returns a backup blob holding the
+// wrapped key, the wrapping mechanism and key's attributes. If opts.IntegrityKeyLabel is set, the blob ends with an
+// HMAC over everything else, computed on the token, so that ImportWrappedKey detects any alteration.
+//
+// The format starts with a magic number and BackupFormatVersion, and records attributes in a canonical order, so the
+// same key and options always produce the same metadata.
+func (c *Context) ExportWrappedKey(key *SecretKey, wrappingKeyLabel []byte, opts *BackupOptions) ([]byte, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+	mechanisms := opts.WrapMechanisms
+	if mechanisms == nil {
+		mechanisms = DefaultCloneWrapMechanisms
+	}
+
+	wrappingKey, err := c.findBackupKey(wrappingKeyLabel, "wrapping")
+	if err != nil {
+		return nil, err
+	}
+
+	attributes, err := c.getAttributes(key.handle, backupAttributes)
+	if err != nil {
+		return nil, withMessage(err, "reading key attributes")
+	}
+
+	wrappingType, err := c.getAttributes(wrappingKey.handle, []AttributeType{CkaKeyType})
+	if err != nil {
+		return nil, withMessage(err, "reading wrapping key type")
+	}
+	mech, err := negotiateWrapMechanism(c, c, mechanisms, bytesToUlong(wrappingType[CkaKeyType].Value), true)
+	if err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+	if mech == pkcs11.CKM_AES_CBC_PAD || mech == pkcs11.CKM_DES3_CBC_PAD {
+		if iv, err = c.cloneIV(wrappingKey.Cipher.BlockSize); err != nil {
+			return nil, withMessage(err, "generating IV")
+		}
+	}
+
+	var wrapped []byte
+	err = c.withSession(func(session *pkcs11Session) (err error) {
+		wrapped, err = session.ctx.WrapKey(session.handle, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, iv)},
+			wrappingKey.handle, key.handle)
+		return err
+	})
+	if err != nil {
+		return nil, withMessage(err, "wrapping key")
+	}
+
+	var flags byte
+	if opts.IntegrityKeyLabel != nil {
+		flags |= backupAuthenticated
+	}
+	blob := encodeBackup(flags, mech, iv, attributes, wrapped)
+
+	if opts.IntegrityKeyLabel != nil {
+		mac, err := c.backupMAC(opts.IntegrityKeyLabel, blob)
+		if err != nil {
+			return nil, err
+		}
+		blob = append(blob, mac...)
+	}
+	return blob, nil
+}
+
+// ImportWrappedKey unwraps a backup blob made by ExportWrappedKey with the secret key labelled wrappingKeyLabel,
+// creating a token object with the attributes recorded in the blob.
+//
+// Authenticated blobs are checked with the key labelled opts.IntegrityKeyLabel before anything is unwrapped, and an
+// altered blob fails with ErrBackupTampered. Blobs without integrity protection are refused with
+// ErrBackupUnauthenticated unless opts.AllowUnauthenticated is set. Blobs written in a newer format are refused with
+// ErrUnsupportedBackupVersion.
+func (c *Context) ImportWrappedKey(blob []byte, wrappingKeyLabel []byte, opts *BackupOptions) (*SecretKey, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+
+	backup, err := decodeBackup(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if backup.flags&backupAuthenticated == 0 {
+		if !opts.AllowUnauthenticated {
+			return nil, ErrBackupUnauthenticated
+		}
+	} else {
+		if opts.IntegrityKeyLabel == nil {
+			return nil, errors.New("backup blob is integrity protected, but no integrity key label was given")
+		}
+		mac, err := c.backupMAC(opts.IntegrityKeyLabel, backup.authenticated)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(mac, backup.mac) {
+			return nil, ErrBackupTampered
+		}
+	}
+
+	class, ok := backup.attributes[CkaClass]
+	if !ok || bytesToUlong(class.Value) != pkcs11.CKO_SECRET_KEY {
+		return nil, errors.New("backup blob does not hold a secret key")
+	}
+	keyType, ok := backup.attributes[CkaKeyType]
+	if !ok {
+		return nil, errors.New("backup blob does not record the key type")
+	}
+	cipher, ok := Ciphers[int(bytesToUlong(keyType.Value))]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type: %X", bytesToUlong(keyType.Value))
+	}
+
+	wrappingKey, err := c.findBackupKey(wrappingKeyLabel, "wrapping")
+	if err != nil {
+		return nil, err
+	}
+
+	template := backup.attributes.Copy()
+	if err = template.Set(CkaToken, true); err != nil {
+		return nil, err
+	}
+
+	var handle pkcs11.ObjectHandle
+	err = c.withSession(func(session *pkcs11Session) (err error) {
+		handle, err = session.ctx.UnwrapKey(session.handle,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(backup.mechanism, backup.iv)}, wrappingKey.handle,
+			backup.wrapped, template.ToSlice())
+		return err
+	})
+	if err != nil {
+		return nil, withMessage(err, "unwrapping key")
+	}
+
+	return newSecretKey(c, handle, cipher), nil
+}
+
+// findBackupKey finds the secret key with the given label, used for the given purpose.
+func (c *Context) findBackupKey(label []byte, purpose string) (*SecretKey, error) {
+	if err := notNilBytes(label, purpose+" key label"); err != nil {
+		return nil, err
+	}
+	key, err := c.FindKey(nil, label)
+	if err != nil {
+		return nil, withMessagef(err, "finding %s key", purpose)
+	}
+	if key == nil {
+		return nil, c.notFoundError("%s key %q not found", purpose, label)
+	}
+	return key, nil
+}
+
+// backupMAC computes the CKM_SHA256_HMAC of data with the integrity key labelled label.
+func (c *Context) backupMAC(label []byte, data []byte) (mac []byte, err error) {
+	key, err := c.findBackupKey(label, "integrity")
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.withSession(func(session *pkcs11Session) error {
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256_HMAC, nil)}
+		if err := session.signInit(mech, key.handle); err != nil {
+			return err
+		}
+		mac, err = session.sign(pkcs11.CKM_SHA256_HMAC, data)
+		return err
+	})
+	if err != nil {
+		return nil, withMessage(err, "computing backup HMAC")
+	}
+	if len(mac) != backupMACLength {
+		return nil, fmt.Errorf("backup HMAC has length %d, expected %d", len(mac), backupMACLength)
+	}
+	return mac, nil
+}
+
+// backupBlob is a decoded backup blob.
+type backupBlob struct {
+	flags      byte
+	mechanism  uint
+	iv         []byte
+	attributes AttributeSet
+	wrapped    []byte
+
+	// authenticated is the part of the blob covered by mac.
+	authenticated []byte
+	mac           []byte
+}
+
+// encodeBackup encodes everything in a backup blob except the HMAC. The layout, with integers big-endian, is:
+//
+//	magic "C11W" | version (1 byte) | flags (1 byte) | mechanism (8 bytes) | IV length (4 bytes) | IV |
+//	attribute count (4 bytes) | attributes, each type (8 bytes) | length (4 bytes) | value |
+//	wrapped key length (4 bytes) | wrapped key
+//
+// Attributes are in ascending order of type. Authenticated blobs are followed by a 32-byte HMAC.
+func encodeBackup(flags byte, mechanism uint, iv []byte, attributes AttributeSet, wrapped []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(backupMagic)
+	buf.WriteByte(BackupFormatVersion)
+	buf.WriteByte(flags)
+	writeUint64(&buf, uint64(mechanism))
+	writeBackupBytes(&buf, iv)
+
+	types := make([]AttributeType, 0, len(attributes))
+	for t := range attributes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	writeUint32(&buf, uint32(len(types)))
+	for _, t := range types {
+		writeUint64(&buf, uint64(t))
+		writeBackupBytes(&buf, attributes[t].Value)
+	}
+
+	writeBackupBytes(&buf, wrapped)
+	return buf.Bytes()
+}
+
+// decodeBackup parses a backup blob. It rejects anything encodeBackup cannot have produced, so that every valid blob
+// has a single encoding.
+func decodeBackup(blob []byte) (*backupBlob, error) {
+	if len(blob) < len(backupMagic)+2 || !bytes.Equal(blob[:len(backupMagic)], backupMagic) {
+		return nil, errors.New("not a crypto11 backup blob")
+	}
+
+	version := blob[len(backupMagic)]
+	if version == 0 || version > BackupFormatVersion {
+		return nil, withMessagef(ErrUnsupportedBackupVersion,
+			"version %d, this version of crypto11 supports up to version %d", version, BackupFormatVersion)
+	}
+
+	backup := &backupBlob{flags: blob[len(backupMagic)+1], attributes: NewAttributeSet()}
+	if backup.flags&^backupAuthenticated != 0 {
+		return nil, fmt.Errorf("unknown backup flags %#x", backup.flags)
+	}
+
+	body := blob
+	if backup.flags&backupAuthenticated != 0 {
+		if len(blob) < len(backupMagic)+2+backupMACLength {
+			return nil, errors.New("backup blob is truncated")
+		}
+		body = blob[:len(blob)-backupMACLength]
+		backup.mac = blob[len(body):]
+	}
+	backup.authenticated = body
+
+	r := backupReader{data: body[len(backupMagic)+2:]}
+	backup.mechanism = uint(r.uint64())
+	backup.iv = r.bytes()
+
+	count := r.uint32()
+	previous := int64(-1)
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		t := r.uint64()
+		value := r.bytes()
+		if int64(t) <= previous {
+			return nil, errors.New("backup blob attributes are not in canonical order")
+		}
+		previous = int64(t)
+		backup.attributes[AttributeType(t)] = pkcs11.NewAttribute(uint(t), value)
+	}
+
+	backup.wrapped = r.bytes()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) != 0 {
+		return nil, errors.New("unexpected data at end of backup blob")
+	}
+	return backup, nil
+}
+
+// backupReader reads the fields of a backup blob. After the first error, reads return zero values and err is set.
+type backupReader struct {
+	data []byte
+	err  error
+}
+
+func (r *backupReader) next(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.data)) < n {
+		r.err = errors.New("backup blob is truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *backupReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *backupReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *backupReader) bytes() []byte {
+	n := r.uint32()
+	b := r.next(uint64(n))
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func writeUint32(buf *bytes.Buffer, n uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	buf.Write(b[:])
+}
+
+func writeUint64(buf *bytes.Buffer, n uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	buf.Write(b[:])
+}
+
+func writeBackupBytes(buf *bytes.Buffer, b []byte) {
+	writeUint32(buf, uint32(len(b)))
+	buf.Write(b)
+}
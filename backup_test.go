@@ -0,0 +1,182 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testBackupAttributes(t *testing.T) AttributeSet {
+	attributes, err := NewAttributeSetWithIDAndLabel([]byte("id"), []byte("label"))
+	require.NoError(t, err)
+	require.NoError(t, attributes.Set(CkaClass, pkcs11.CKO_SECRET_KEY))
+	require.NoError(t, attributes.Set(CkaKeyType, pkcs11.CKK_AES))
+	require.NoError(t, attributes.Set(CkaEncrypt, true))
+	return attributes
+}
+
+func TestBackupEncoding(t *testing.T) {
+	attributes := testBackupAttributes(t)
+	blob := encodeBackup(backupAuthenticated, pkcs11.CKM_AES_CBC_PAD, []byte("0123456789abcdef"), attributes,
+		[]byte("wrapped"))
+
+	// The encoding does not depend on map iteration order.
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, blob, encodeBackup(backupAuthenticated, pkcs11.CKM_AES_CBC_PAD, []byte("0123456789abcdef"),
+			attributes.Copy(), []byte("wrapped")))
+	}
+
+	mac := make([]byte, backupMACLength)
+	backup, err := decodeBackup(append(blob, mac...))
+	require.NoError(t, err)
+	assert.Equal(t, byte(backupAuthenticated), backup.flags)
+	assert.Equal(t, uint(pkcs11.CKM_AES_CBC_PAD), backup.mechanism)
+	assert.Equal(t, []byte("0123456789abcdef"), backup.iv)
+	assert.Equal(t, []byte("wrapped"), backup.wrapped)
+	assert.Equal(t, blob, backup.authenticated)
+	assert.Equal(t, mac, backup.mac)
+	require.Len(t, backup.attributes, len(attributes))
+	for k, v := range attributes {
+		assert.Equal(t, v.Value, backup.attributes[k].Value)
+	}
+
+	unauthenticated := encodeBackup(0, pkcs11.CKM_AES_KEY_WRAP, nil, attributes, []byte("wrapped"))
+	backup, err = decodeBackup(unauthenticated)
+	require.NoError(t, err)
+	assert.Nil(t, backup.iv)
+	assert.Nil(t, backup.mac)
+}
+
+func TestBackupDecodingRejectsMalformedBlobs(t *testing.T) {
+	blob := encodeBackup(0, pkcs11.CKM_AES_KEY_WRAP, nil, testBackupAttributes(t), []byte("wrapped"))
+
+	future := append([]byte{}, blob...)
+	future[len(backupMagic)] = BackupFormatVersion + 1
+	_, err := decodeBackup(future)
+	assert.True(t, errors.Is(err, ErrUnsupportedBackupVersion), "%v", err)
+
+	flags := append([]byte{}, blob...)
+	flags[len(backupMagic)+1] = 0x80
+	_, err = decodeBackup(flags)
+	assert.Error(t, err)
+
+	for i := 0; i < len(blob); i++ {
+		_, err = decodeBackup(blob[:i])
+		assert.Error(t, err, "truncated to %d bytes", i)
+	}
+
+	// Authenticated blobs too short to hold both the header and the HMAC.
+	authenticated := append(encodeBackup(backupAuthenticated, pkcs11.CKM_AES_KEY_WRAP, nil, testBackupAttributes(t),
+		[]byte("wrapped")), make([]byte, backupMACLength)...)
+	for i := 0; i < len(authenticated); i++ {
+		_, err = decodeBackup(authenticated[:i])
+		assert.Error(t, err, "truncated to %d bytes", i)
+	}
+	for i := 0; i <= backupMACLength; i++ {
+		header := append(append([]byte{}, backupMagic...), BackupFormatVersion, backupAuthenticated)
+		_, err = decodeBackup(append(header, make([]byte, i)...))
+		assert.Error(t, err, "header and %d bytes", i)
+	}
+
+	_, err = decodeBackup(append(blob, 0))
+	assert.Error(t, err)
+
+	_, err = decodeBackup([]byte("not a backup"))
+	assert.Error(t, err)
+
+	// Two attributes of the same type, which encodeBackup never writes.
+	var duplicate []byte
+	duplicate = append(duplicate, blob[:len(backupMagic)+2+8+4]...)
+	duplicate = append(duplicate, 0, 0, 0, 2)
+	attribute := []byte{0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 1, 'x'}
+	duplicate = append(duplicate, attribute...)
+	duplicate = append(duplicate, attribute...)
+	duplicate = append(duplicate, 0, 0, 0, 0)
+	_, err = decodeBackup(duplicate)
+	assert.Error(t, err)
+}
+
+func TestExportImportWrappedKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_AES_KEY_WRAP_PAD)
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_SHA256_HMAC)
+
+		wrappingKey, wrappingLabel := generateTransportKey(t, ctx)
+		defer func() { _ = wrappingKey.Delete() }()
+
+		integrityLabel := randomBytes()
+		integrityKey, err := ctx.GenerateSecretKeyWithLabel(randomBytes(), integrityLabel, 256, CipherHMACSHA256)
+		require.NoError(t, err)
+		defer func() { _ = integrityKey.Delete() }()
+
+		template, id := extractableTemplate(t)
+		key, err := ctx.GenerateSecretKeyWithAttributes(template, 128, CipherAES)
+		require.NoError(t, err)
+
+		opts := &BackupOptions{IntegrityKeyLabel: integrityLabel}
+		blob, err := ctx.ExportWrappedKey(key, wrappingLabel, opts)
+		require.NoError(t, err)
+		unauthenticated, err := ctx.ExportWrappedKey(key, wrappingLabel, nil)
+		require.NoError(t, err)
+
+		plaintext := make([]byte, 16)
+		ciphertext := make([]byte, 16)
+		key.Encrypt(ciphertext, plaintext)
+		require.NoError(t, key.Delete())
+
+		// Any altered byte is detected before unwrapping.
+		for i := range blob {
+			tampered := append([]byte{}, blob...)
+			tampered[i] ^= 1
+			_, err = ctx.ImportWrappedKey(tampered, wrappingLabel, opts)
+			assert.Error(t, err, "byte %d", i)
+		}
+
+		_, err = ctx.ImportWrappedKey(unauthenticated, wrappingLabel, opts)
+		assert.True(t, errors.Is(err, ErrBackupUnauthenticated), "%v", err)
+
+		_, err = ctx.ImportWrappedKey(blob, wrappingLabel, nil)
+		assert.Error(t, err)
+
+		restored, err := ctx.ImportWrappedKey(blob, wrappingLabel, opts)
+		require.NoError(t, err)
+		defer func() { _ = restored.Delete() }()
+
+		decrypted := make([]byte, 16)
+		restored.Decrypt(decrypted, ciphertext)
+		assert.Equal(t, plaintext, decrypted)
+
+		attributes, err := ctx.GetAttributes(restored, []AttributeType{CkaId, CkaLabel})
+		require.NoError(t, err)
+		assert.Equal(t, id, attributes[CkaId].Value)
+		assert.Equal(t, template[CkaLabel].Value, attributes[CkaLabel].Value)
+
+		migrated, err := ctx.ImportWrappedKey(unauthenticated, wrappingLabel, &BackupOptions{AllowUnauthenticated: true})
+		require.NoError(t, err)
+		_ = migrated.Delete()
+	})
+}
@@ -42,12 +42,12 @@ func (key *SecretKey) BlockSize() int {
 // For more efficient operation, see NewCBCDecrypterCloser, NewCBCDecrypter or NewCBC.
 func (key *SecretKey) Decrypt(dst, src []byte) {
 	var result []byte
-	if err := key.context.withSession(func(session *pkcs11Session) (err error) {
+	if err := key.withSession(func(session *pkcs11Session) (err error) {
 		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(key.Cipher.ECBMech, nil)}
-		if err = session.ctx.DecryptInit(session.handle, mech, key.handle); err != nil {
+		if err = session.decryptInit(mech, key.handle); err != nil {
 			return
 		}
-		if result, err = session.ctx.Decrypt(session.handle, src[:key.Cipher.BlockSize]); err != nil {
+		if result, err = session.decrypt(key.Cipher.ECBMech, src[:key.Cipher.BlockSize]); err != nil {
 			return
 		}
 		if len(result) != key.Cipher.BlockSize {
@@ -70,12 +70,12 @@ func (key *SecretKey) Decrypt(dst, src []byte) {
 // For more efficient operation, see NewCBCEncrypterCloser, NewCBCEncrypter or NewCBC.
 func (key *SecretKey) Encrypt(dst, src []byte) {
 	var result []byte
-	if err := key.context.withSession(func(session *pkcs11Session) (err error) {
+	if err := key.withSession(func(session *pkcs11Session) (err error) {
 		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(key.Cipher.ECBMech, nil)}
-		if err = session.ctx.EncryptInit(session.handle, mech, key.handle); err != nil {
+		if err = session.encryptInit(mech, key.handle); err != nil {
 			return
 		}
-		if result, err = session.ctx.Encrypt(session.handle, src[:key.Cipher.BlockSize]); err != nil {
+		if result, err = session.encrypt(src[:key.Cipher.BlockSize]); err != nil {
 			return
 		}
 		if len(result) != key.Cipher.BlockSize {
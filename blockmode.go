@@ -55,6 +55,8 @@ const (
 // If this is a problem for your application then use NewCBCEncrypterCloser instead.
 //
 // If that is not possible then adding calls to runtime.GC() may help.
+//
+// A *KeyUsageError is returned if the key does not support CBC or lacks CKA_ENCRYPT.
 func (key *SecretKey) NewCBCEncrypter(iv []byte) (cipher.BlockMode, error) {
 	return key.newBlockModeCloser(key.Cipher.CBCMech, modeEncrypt, iv, true)
 }
@@ -66,6 +68,8 @@ func (key *SecretKey) NewCBCEncrypter(iv []byte) (cipher.BlockMode, error) {
 // If this is a problem for your application then use NewCBCDecrypterCloser instead.
 //
 // If that is not possible then adding calls to runtime.GC() may help.
+//
+// A *KeyUsageError is returned if the key does not support CBC or lacks CKA_DECRYPT.
 func (key *SecretKey) NewCBCDecrypter(iv []byte) (cipher.BlockMode, error) {
 	return key.newBlockModeCloser(key.Cipher.CBCMech, modeDecrypt, iv, true)
 }
@@ -75,6 +79,8 @@ func (key *SecretKey) NewCBCDecrypter(iv []byte) (cipher.BlockMode, error) {
 //
 // Use of NewCBCEncrypterCloser rather than NewCBCEncrypter represents a commitment to call the Close() method
 // of the returned BlockModeCloser.
+//
+// A *KeyUsageError is returned if the key does not support CBC or lacks CKA_ENCRYPT.
 func (key *SecretKey) NewCBCEncrypterCloser(iv []byte) (BlockModeCloser, error) {
 	return key.newBlockModeCloser(key.Cipher.CBCMech, modeEncrypt, iv, false)
 }
@@ -84,6 +90,8 @@ func (key *SecretKey) NewCBCEncrypterCloser(iv []byte) (BlockModeCloser, error)
 //
 // Use of NewCBCDecrypterCloser rather than NewCBCEncrypter represents a commitment to call the Close() method
 // of the returned BlockModeCloser.
+//
+// A *KeyUsageError is returned if the key does not support CBC or lacks CKA_DECRYPT.
 func (key *SecretKey) NewCBCDecrypterCloser(iv []byte) (BlockModeCloser, error) {
 	return key.newBlockModeCloser(key.Cipher.CBCMech, modeDecrypt, iv, false)
 }
@@ -99,14 +107,32 @@ type blockModeCloser struct {
 	// modeDecrypt or modeEncrypt
 	mode int
 
-	// Cleanup function
-	cleanup func()
+	// chunk is the largest input passed to one update call, or zero for no limit. See Config.MaxSingleCallSize.
+	chunk int
+
+	// Cleanup function, which returns the session to the pool. err is the error that finished the operation, if any.
+	cleanup func(err error)
 }
 
 // newBlockModeCloser creates a new blockModeCloser for the chosen mechanism and mode.
 func (key *SecretKey) newBlockModeCloser(mech uint, mode int, iv []byte, setFinalizer bool) (*blockModeCloser, error) {
+	var err error
+	switch mode {
+	case modeDecrypt:
+		err = key.checkCipherUsage("CBC decryption", mech, false, true)
+	case modeEncrypt:
+		err = key.checkCipherUsage("CBC encryption", mech, true, false)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	session, err := key.context.getSession()
+	var chunk int
+	if limit := key.context.maxSingleCallSize(); limit > 0 {
+		chunk = callChunkSize(limit, key.Cipher.BlockSize)
+	}
+
+	session, err := key.getSession()
 	if err != nil {
 		return nil, err
 	}
@@ -115,22 +141,23 @@ func (key *SecretKey) newBlockModeCloser(mech uint, mode int, iv []byte, setFina
 		session:   session,
 		blockSize: key.Cipher.BlockSize,
 		mode:      mode,
-		cleanup: func() {
-			key.context.pool.Put(session)
+		chunk:     chunk,
+		cleanup: func(err error) {
+			key.context.putSession(session, err)
 		},
 	}
 	mechDescription := []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, iv)}
 
 	switch mode {
 	case modeDecrypt:
-		err = session.ctx.DecryptInit(session.handle, mechDescription, key.handle)
+		err = session.decryptInit(mechDescription, key.handle)
 	case modeEncrypt:
-		err = session.ctx.EncryptInit(bmc.session.handle, mechDescription, key.handle)
+		err = session.encryptInit(mechDescription, key.handle)
 	default:
 		panic("unexpected mode")
 	}
 	if err != nil {
-		bmc.cleanup()
+		bmc.cleanup(err)
 		return nil, err
 	}
 	if setFinalizer {
@@ -155,24 +182,34 @@ func (bmc *blockModeCloser) CryptBlocks(dst, src []byte) {
 	if len(src)%bmc.blockSize != 0 {
 		panic("input is not a whole number of blocks")
 	}
-	var result []byte
-	var err error
-	switch bmc.mode {
-	case modeDecrypt:
-		result, err = bmc.session.ctx.DecryptUpdate(bmc.session.handle, src)
-	case modeEncrypt:
-		result, err = bmc.session.ctx.EncryptUpdate(bmc.session.handle, src)
-	}
-	if err != nil {
+	if err := checkSession(bmc.session); err != nil {
 		panic(err)
 	}
-	// PKCS#11 2.40 s5.2 says that the operation must produce as much output
-	// as possible, so we should never have less than we submitted for CBC.
-	// This could be different for other modes but we don't implement any yet.
-	if len(result) != len(src) {
-		panic("nontrivial result from *Final operation")
+	for done := 0; done < len(src); {
+		n := len(src) - done
+		if bmc.chunk > 0 && n > bmc.chunk {
+			n = bmc.chunk
+		}
+		var result []byte
+		var err error
+		switch bmc.mode {
+		case modeDecrypt:
+			result, err = bmc.session.decryptUpdate(src[done : done+n])
+		case modeEncrypt:
+			result, err = bmc.session.encryptUpdate(src[done : done+n])
+		}
+		if err != nil {
+			panic(err)
+		}
+		// PKCS#11 2.40 s5.2 says that the operation must produce as much output
+		// as possible, so we should never have less than we submitted for CBC.
+		// This could be different for other modes but we don't implement any yet.
+		if len(result) != n {
+			panic("nontrivial result from *Final operation")
+		}
+		copy(dst[done:done+n], result)
+		done += n
 	}
-	copy(dst[:len(result)], result)
 	runtime.KeepAlive(bmc)
 }
 
@@ -180,16 +217,19 @@ func (bmc *blockModeCloser) Close() {
 	if bmc.session == nil {
 		return
 	}
+	if err := checkSession(bmc.session); err != nil {
+		panic(err)
+	}
 	var result []byte
 	var err error
 	switch bmc.mode {
 	case modeDecrypt:
-		result, err = bmc.session.ctx.DecryptFinal(bmc.session.handle)
+		result, err = bmc.session.decryptFinal()
 	case modeEncrypt:
-		result, err = bmc.session.ctx.EncryptFinal(bmc.session.handle)
+		result, err = bmc.session.encryptFinal()
 	}
 	bmc.session = nil
-	bmc.cleanup()
+	bmc.cleanup(err)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,122 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var brainpoolCurves = []elliptic.Curve{BrainpoolP256r1(), BrainpoolP384r1(), BrainpoolP512r1()}
+
+func TestBrainpoolArithmetic(t *testing.T) {
+	for _, curve := range brainpoolCurves {
+		params := curve.Params()
+		require.True(t, curve.IsOnCurve(params.Gx, params.Gy), params.Name)
+
+		x2, y2 := curve.Double(params.Gx, params.Gy)
+		assert.True(t, curve.IsOnCurve(x2, y2), params.Name)
+		x3, y3 := curve.Add(x2, y2, params.Gx, params.Gy)
+		x, y := curve.ScalarBaseMult([]byte{3})
+		assert.Equal(t, x3, x, params.Name)
+		assert.Equal(t, y3, y, params.Name)
+
+		// (N-1)G is -G, and NG is the point at infinity.
+		x, y = curve.ScalarBaseMult(new(big.Int).Sub(params.N, big.NewInt(1)).Bytes())
+		assert.Equal(t, params.Gx, x, params.Name)
+		assert.Equal(t, new(big.Int).Sub(params.P, params.Gy), y, params.Name)
+		x, y = curve.ScalarBaseMult(params.N.Bytes())
+		assert.Zero(t, x.Sign(), params.Name)
+		assert.Zero(t, y.Sign(), params.Name)
+	}
+}
+
+func TestBrainpoolEncoding(t *testing.T) {
+	for _, curve := range brainpoolCurves {
+		name := curve.Params().Name
+		params, err := marshalEcParams(curve)
+		require.NoError(t, err, name)
+		unmarshalled, err := unmarshalEcParams(params)
+		require.NoError(t, err, name)
+		assert.True(t, unmarshalled == curve, name)
+
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		require.NoError(t, err, name)
+		x, y, err := unmarshalEcPoint(mustMarshal(elliptic.Marshal(curve, priv.X, priv.Y)), curve)
+		require.NoError(t, err, name)
+		assert.Equal(t, priv.X, x, name)
+		assert.Equal(t, priv.Y, y, name)
+
+		_, err = PublicKeyFingerprint(&priv.PublicKey)
+		assert.NoError(t, err, name)
+
+		digest := sha256.Sum256(randomBytes())
+		sig, err := priv.Sign(rand.Reader, digest[:], crypto.SHA256)
+		require.NoError(t, err, name)
+		assert.NoError(t, verifyInSoftware(&priv.PublicKey, digest[:], sig, crypto.SHA256), name)
+	}
+}
+
+func TestHardBrainpool(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		for _, curve := range brainpoolCurves {
+			t.Run(curve.Params().Name, func(t *testing.T) {
+				if err := ctx.checkECCurve(curve); err != nil {
+					t.Skipf("token does not support the curve: %v", err)
+				}
+
+				id := randomBytes()
+				key, err := ctx.GenerateECDSAKeyPair(id, curve)
+				if isPKCS11Error(err, pkcs11.CKR_CURVE_NOT_SUPPORTED, pkcs11.CKR_DOMAIN_PARAMS_INVALID,
+					pkcs11.CKR_ATTRIBUTE_VALUE_INVALID) {
+					t.Skipf("token rejected the curve: %v", err)
+				}
+				require.NoError(t, err)
+				defer func() { _ = key.Delete() }()
+
+				pub, ok := key.Public().(*ecdsa.PublicKey)
+				require.True(t, ok, "%T", key.Public())
+				assert.True(t, pub.Curve == curve)
+
+				digest := sha256.Sum256(randomBytes())
+				sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+				require.NoError(t, err)
+				require.NoError(t, VerifySignature(key, digest[:], sig, crypto.SHA256))
+				require.NoError(t, verifyInSoftware(pub, digest[:], sig, crypto.SHA256))
+
+				found, err := ctx.FindKeyPair(id, nil)
+				require.NoError(t, err)
+				require.IsType(t, &pkcs11PrivateKeyECDSA{}, found)
+				assert.Equal(t, pub, found.Public())
+			})
+		}
+	})
+}
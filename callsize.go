@@ -0,0 +1,176 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// maxCallSizeProbe is the largest input tried when probing the maximum single-call size. A token that accepts it
+// is treated as having no limit.
+const maxCallSizeProbe = 1 << 20
+
+// ErrInputTooLarge is returned, wrapped with the sizes involved, when the input to a single-part operation such as
+// GCM exceeds the maximum single-call size, see Config.MaxSingleCallSize.
+var ErrInputTooLarge = errors.New("input exceeds the maximum single-call size for the token")
+
+// callSizeLimit records the probed maximum single-call size, see Config.ProbeMaxSingleCallSize.
+type callSizeLimit struct {
+	once sync.Once
+	size int
+}
+
+// maxSingleCallSize returns the largest input to pass to one C_Encrypt, C_Decrypt, C_EncryptUpdate or
+// C_DecryptUpdate call for symmetric operations, or zero if there is no limit. The token is probed the first time
+// if Config.ProbeMaxSingleCallSize is set, so this must not be called while holding a session.
+func (c *Context) maxSingleCallSize() int {
+	if c.cfg.MaxSingleCallSize > 0 {
+		return c.cfg.MaxSingleCallSize
+	}
+	if !c.cfg.ProbeMaxSingleCallSize {
+		return 0
+	}
+
+	c.callSize.once.Do(func() {
+		_ = c.withSession(func(session *pkcs11Session) error {
+			c.callSize.size = probeMaxSingleCallSize(session)
+			return nil
+		})
+	})
+	return c.callSize.size
+}
+
+// probeMaxSingleCallSize encrypts ever larger inputs with AES-CBC and a session key, and returns the largest size,
+// in whole blocks, the token accepts before failing with CKR_DATA_LEN_RANGE. Zero is returned if the token accepts
+// maxCallSizeProbe bytes, or if the probe cannot be run.
+func probeMaxSingleCallSize(session *pkcs11Session) int {
+	key, err := session.ctx.GenerateKey(session.handle,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 16),
+		})
+	if err != nil {
+		return 0
+	}
+	session.trackObject(key, "single-call size probe key")
+	defer func() { _ = session.destroyObject(key) }()
+
+	// accepts reports whether the token encrypts size bytes in one call. Other failures end the probe.
+	var failed error
+	accepts := func(size int) bool {
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_CBC, make([]byte, 16))}
+		if failed = session.encryptInit(mech, key); failed != nil {
+			return false
+		}
+		if _, failed = session.encrypt(make([]byte, size)); failed != nil {
+			if isPKCS11Error(failed, pkcs11.CKR_DATA_LEN_RANGE) {
+				failed = nil
+			}
+			return false
+		}
+		return true
+	}
+
+	// Double the size until the token refuses it, then search between the last accepted and first refused sizes.
+	good, bad := 0, 0
+	for size := 16; size <= maxCallSizeProbe; size *= 2 {
+		if !accepts(size) {
+			bad = size
+			break
+		}
+		good = size
+	}
+	if bad == 0 || failed != nil {
+		return 0
+	}
+
+	for bad-good > 16 {
+		mid := (good + bad) / 2 &^ 15
+		if accepts(mid) {
+			good = mid
+		} else if failed != nil {
+			return good
+		} else {
+			bad = mid
+		}
+	}
+	return good
+}
+
+// callChunkSize returns the size of the pieces to split inputs into for a limit of limit bytes, which is a whole
+// number of blocks of blockSize bytes, and at least one block.
+func callChunkSize(limit, blockSize int) int {
+	if blockSize <= 1 {
+		return limit
+	}
+	if chunk := limit - limit%blockSize; chunk > 0 {
+		return chunk
+	}
+	return blockSize
+}
+
+// encryptParts continues an encryption started with C_EncryptInit, passing input to the token in pieces of at most
+// chunk bytes and finishing the operation.
+func (s *pkcs11Session) encryptParts(input []byte, chunk int) ([]byte, error) {
+	var output []byte
+	for len(input) > 0 {
+		n := min(chunk, len(input))
+		result, err := s.encryptUpdate(input[:n])
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, result...)
+		input = input[n:]
+	}
+	result, err := s.encryptFinal()
+	if err != nil {
+		return nil, err
+	}
+	return append(output, result...), nil
+}
+
+// decryptParts continues a decryption started with C_DecryptInit, passing input to the token in pieces of at most
+// chunk bytes and finishing the operation.
+func (s *pkcs11Session) decryptParts(input []byte, chunk int) ([]byte, error) {
+	var output []byte
+	for len(input) > 0 {
+		n := min(chunk, len(input))
+		result, err := s.decryptUpdate(input[:n])
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, result...)
+		input = input[n:]
+	}
+	result, err := s.decryptFinal()
+	if err != nil {
+		return nil, err
+	}
+	return append(output, result...), nil
+}
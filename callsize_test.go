@@ -0,0 +1,138 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallChunkSize(t *testing.T) {
+	assert.Equal(t, 4096, callChunkSize(4096, 16))
+	assert.Equal(t, 4080, callChunkSize(4095, 16))
+	assert.Equal(t, 16, callChunkSize(10, 16))
+	assert.Equal(t, 10, callChunkSize(10, 1))
+}
+
+func TestMaxSingleCallSizeConfig(t *testing.T) {
+	assert.Equal(t, 0, (&Context{cfg: &Config{}}).maxSingleCallSize())
+	assert.Equal(t, 4096, (&Context{cfg: &Config{MaxSingleCallSize: 4096, ProbeMaxSingleCallSize: true}}).
+		maxSingleCallSize())
+	assert.Error(t, (&Config{TokenLabel: "t", Pin: "p", MaxSingleCallSize: -1}).Validate())
+}
+
+func TestMaxSingleCallSize(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.MaxSingleCallSize = 64
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	caps, err := ctx.Capabilities()
+	require.NoError(t, err)
+	assert.Equal(t, 64, caps.MaxSingleCallSize)
+
+	value := randomBytes()
+	key, err := ctx.ImportSecretKey(randomBytes(), value, CipherAES)
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	block, err := aes.NewCipher(value)
+	require.NoError(t, err)
+	iv := make([]byte, 16)
+	plaintext := make([]byte, 1000)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+	expected := make([]byte, len(plaintext)-len(plaintext)%16)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(expected, plaintext[:len(expected)])
+
+	t.Run("BlockMode", func(t *testing.T) {
+		enc, err := key.NewCBCEncrypterCloser(iv)
+		require.NoError(t, err)
+		ciphertext := make([]byte, len(expected))
+		enc.CryptBlocks(ciphertext, plaintext[:len(expected)])
+		enc.Close()
+		assert.Equal(t, expected, ciphertext)
+
+		dec, err := key.NewCBCDecrypterCloser(iv)
+		require.NoError(t, err)
+		decrypted := make([]byte, len(ciphertext))
+		dec.CryptBlocks(decrypted, ciphertext)
+		dec.Close()
+		assert.Equal(t, plaintext[:len(expected)], decrypted)
+	})
+
+	t.Run("CBC", func(t *testing.T) {
+		aead, err := key.NewCBC(PaddingPKCS)
+		require.NoError(t, err)
+		sealed := aead.Seal(nil, iv, plaintext, nil)
+		assert.Equal(t, expected, sealed[:len(expected)])
+
+		opened, err := aead.Open(nil, iv, sealed, nil)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, opened)
+	})
+
+	t.Run("GCM", func(t *testing.T) {
+		skipIfMechUnsupported(t, ctx, CipherAES.GCMMech)
+		aead, err := key.NewGCM()
+		require.NoError(t, err)
+		nonce := make([]byte, aead.NonceSize())
+
+		sealed := aead.Seal(nil, nonce, plaintext[:32], nil)
+		opened, err := aead.Open(nil, nonce, sealed, nil)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext[:32], opened)
+
+		_, err = aead.Open(nil, nonce, plaintext, nil)
+		assert.True(t, errors.Is(err, ErrInputTooLarge), "unexpected error: %v", err)
+
+		defer func() {
+			err, _ := recover().(error)
+			assert.True(t, errors.Is(err, ErrInputTooLarge), "unexpected panic: %v", err)
+		}()
+		aead.Seal(nil, nonce, plaintext, nil)
+	})
+}
+
+func TestProbeMaxSingleCallSize(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.ProbeMaxSingleCallSize = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	caps, err := ctx.Capabilities()
+	require.NoError(t, err)
+	assert.True(t, caps.MaxSingleCallSize == 0 || caps.MaxSingleCallSize%16 == 0)
+	assert.Equal(t, caps.MaxSingleCallSize, ctx.maxSingleCallSize())
+}
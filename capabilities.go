@@ -0,0 +1,306 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"sort"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS#11 3.0 mechanisms not defined by github.com/miekg/pkcs11.
+const (
+	ckmECEdwardsKeyPairGen    = 0x00001055
+	ckmECMontgomeryKeyPairGen = 0x00001056
+	ckmEdDSA                  = 0x00001057
+)
+
+// GCMIVSource describes who chooses the IV for AES-GCM encryption on a token.
+type GCMIVSource string
+
+const (
+	// GCMIVUnknown means the IV behaviour could not be determined, for instance because GCM is not supported.
+	GCMIVUnknown GCMIVSource = ""
+
+	// GCMIVCaller means the token uses the IV supplied by the caller.
+	GCMIVCaller GCMIVSource = "caller"
+
+	// GCMIVToken means the token generates its own IV, see Config.UseGCMIVFromHSM.
+	GCMIVToken GCMIVSource = "token"
+)
+
+// Capabilities describes which crypto11 features work on a token. It is returned by Context.Capabilities.
+type Capabilities struct {
+	// SupportsPSS is true if the token can make RSA-PSS signatures.
+	SupportsPSS bool `json:"supportsPSS"`
+
+	// SupportsOAEPSHA256 is true if the token can decrypt RSA-OAEP with SHA-256, as verified by a probe.
+	SupportsOAEPSHA256 bool `json:"supportsOAEPSHA256"`
+
+	// SupportsGCM is true if the token can encrypt with AES-GCM, as verified by a probe.
+	SupportsGCM bool `json:"supportsGCM"`
+
+	// GCMIVSource reports who chose the IV in the GCM probe.
+	GCMIVSource GCMIVSource `json:"gcmIVSource"`
+
+	// SupportsEdwards is true if the token can generate Edwards curve key pairs and make EdDSA signatures.
+	SupportsEdwards bool `json:"supportsEdwards"`
+
+	// SupportsHKDF is true if the token supports CKM_HKDF_DERIVE, see SecretKey.DeriveHKDF.
+	SupportsHKDF bool `json:"supportsHKDF"`
+
+	// MaxRSABits is the largest RSA key the token reports it can generate, or zero if it cannot generate RSA keys.
+	MaxRSABits int `json:"maxRSABits"`
+
+	// MaxSingleCallSize is the largest input symmetric operations pass to one C_Encrypt or C_Decrypt call, or zero
+	// if there is no limit. It is Config.MaxSingleCallSize, or the probed limit if Config.ProbeMaxSingleCallSize is
+	// set. Size buffers for GCM so that their contents do not exceed it.
+	MaxSingleCallSize int `json:"maxSingleCallSize"`
+
+	// Curves lists the names of the elliptic curves for which the token generated a key pair, in sorted order.
+	Curves []string `json:"curves"`
+
+	// WriteProtected is true if the token is write protected.
+	WriteProtected bool `json:"writeProtected"`
+
+	// LoginRequired is true if the token requires login for cryptographic functions.
+	LoginRequired bool `json:"loginRequired"`
+
+	// SupportsOperationState is true if the token can save the state of a digest operation with
+	// C_GetOperationState.
+	SupportsOperationState bool `json:"supportsOperationState"`
+
+	// MessageInterfaces is true if the library implements PKCS#11 3.0 or later, which defines the message-based
+	// encryption and signing functions. github.com/miekg/pkcs11 cannot call those functions, so this is derived from
+	// the library version rather than a probe.
+	MessageInterfaces bool `json:"messageInterfaces"`
+
+	// PKCS1v15DecryptionDisallowed is true if Config.DisallowPKCS1v15Decryption is set, so that RSA keys refuse
+	// PKCS#1 v1.5 decryption unless overridden by Context.WithPKCS1v15Decryption. PKCS#1 v1.5 signatures are not
+	// affected.
+	PKCS1v15DecryptionDisallowed bool `json:"pkcs1v15DecryptionDisallowed"`
+}
+
+// Capabilities probes the token to find out which crypto11 features work on it. Where the mechanism list is not
+// reliable, short-lived session keys are generated and used to test the feature. Nothing is stored on the token.
+//
+// A probe that fails reports the feature as unsupported; an error is only returned if the token cannot be queried
+// at all.
+func (c *Context) Capabilities() (*Capabilities, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	tokenInfo, err := c.ctx.GetTokenInfo(c.slot)
+	if err != nil {
+		return nil, withMessage(err, "failed to read token info")
+	}
+
+	info, err := c.ctx.GetInfo()
+	if err != nil {
+		return nil, withMessage(err, "failed to read library info")
+	}
+
+	caps := &Capabilities{
+		SupportsPSS:       c.mechanismHasFlag(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.CKF_SIGN),
+		SupportsHKDF:      c.mechanismHasFlag(CKM_HKDF_DERIVE, pkcs11.CKF_DERIVE),
+		WriteProtected:    tokenInfo.Flags&pkcs11.CKF_WRITE_PROTECTED != 0,
+		LoginRequired:     tokenInfo.Flags&pkcs11.CKF_LOGIN_REQUIRED != 0,
+		MessageInterfaces: info.CryptokiVersion.Major >= 3,
+		Curves:            []string{},
+
+		PKCS1v15DecryptionDisallowed: c.cfg.DisallowPKCS1v15Decryption,
+	}
+
+	caps.SupportsEdwards = c.mechanismHasFlag(ckmECEdwardsKeyPairGen, pkcs11.CKF_GENERATE_KEY_PAIR) &&
+		c.mechanismHasFlag(ckmEdDSA, pkcs11.CKF_SIGN)
+
+	if rsaInfo, err := c.ctx.GetMechanismInfo(c.slot, []*pkcs11.Mechanism{
+		pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}); err == nil {
+		caps.MaxRSABits = int(rsaInfo.MaxKeySize)
+	}
+
+	// Probing takes a session of its own.
+	caps.MaxSingleCallSize = c.maxSingleCallSize()
+
+	err = c.withSession(func(session *pkcs11Session) error {
+		caps.SupportsOperationState = probeOperationState(session)
+		caps.SupportsGCM, caps.GCMIVSource = probeGCM(session)
+		if caps.MaxRSABits > 0 && c.mechanismHasFlag(pkcs11.CKM_RSA_PKCS_OAEP, pkcs11.CKF_DECRYPT) {
+			caps.SupportsOAEPSHA256 = probeOAEPSHA256(session, min(caps.MaxRSABits, 2048), c.randReader())
+		}
+		if c.mechanismHasFlag(pkcs11.CKM_EC_KEY_PAIR_GEN, pkcs11.CKF_GENERATE_KEY_PAIR) {
+			caps.Curves = probeCurves(session)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return caps, nil
+}
+
+// probeOperationState tries to save the state of a SHA-256 digest operation.
+func probeOperationState(session *pkcs11Session) bool {
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256, nil)}
+	if err := session.digestInit(mech); err != nil {
+		return false
+	}
+	// Finishing the digest ends the operation, whatever the outcome of the probe
+	defer func() { _, _ = session.digestFinal() }()
+
+	state, err := session.ctx.GetOperationState(session.handle)
+	return err == nil && len(state) > 0
+}
+
+// probeGCM encrypts with a session AES key to find out whether GCM works and who chooses the IV.
+func probeGCM(session *pkcs11Session) (bool, GCMIVSource) {
+	key, err := session.ctx.GenerateKey(session.handle,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+		})
+	if err != nil {
+		return false, GCMIVUnknown
+	}
+	session.trackObject(key, "GCM probe key")
+	defer func() { _ = session.destroyObject(key) }()
+
+	// Supply an all-zero IV. A token that picks its own IV either overwrites it or rejects it.
+	supplied := make([]byte, DefaultGCMIVLength)
+	if iv, err := gcmProbeEncrypt(session, key, supplied); err == nil {
+		if bytes.Equal(iv, supplied) {
+			return true, GCMIVCaller
+		}
+		return true, GCMIVToken
+	}
+
+	if _, err := gcmProbeEncrypt(session, key, nil); err == nil {
+		return true, GCMIVToken
+	}
+
+	return false, GCMIVUnknown
+}
+
+// gcmProbeEncrypt encrypts a probe with AES-GCM and returns the IV that was used.
+func gcmProbeEncrypt(session *pkcs11Session, key pkcs11.ObjectHandle, iv []byte) ([]byte, error) {
+	params := pkcs11.NewGCMParams(iv, nil, 16*8)
+	defer params.Free()
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}
+	if err := session.encryptInit(mech, key); err != nil {
+		return nil, err
+	}
+	if _, err := session.encrypt([]byte("probe")); err != nil {
+		return nil, err
+	}
+	return params.IV(), nil
+}
+
+// probeOAEPSHA256 generates a session RSA key pair and checks it can decrypt RSA-OAEP with SHA-256.
+func probeOAEPSHA256(session *pkcs11Session, bits int, random io.Reader) bool {
+	pubHandle, privHandle, err := session.ctx.GenerateKeyPair(session.handle,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+		})
+	if err != nil {
+		return false
+	}
+	session.trackObject(privHandle, "OAEP probe private key")
+	session.trackObject(pubHandle, "OAEP probe public key")
+	defer func() {
+		_ = session.destroyObject(privHandle)
+		_ = session.destroyObject(pubHandle)
+	}()
+
+	pub, err := exportRSAPublicKey(session, pubHandle)
+	if err != nil {
+		return false
+	}
+
+	probe := []byte("probe")
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), random, pub.(*rsa.PublicKey), probe, nil)
+	if err != nil {
+		return false
+	}
+
+	key := &pkcs11PrivateKeyRSA{pkcs11PrivateKey: pkcs11PrivateKey{pkcs11Object: pkcs11Object{handle: privHandle}}}
+	plaintext, err := decryptOAEP(session, key, ciphertext, &rsa.OAEPOptions{Hash: crypto.SHA256})
+	return err == nil && bytes.Equal(plaintext, probe)
+}
+
+// probeCurves returns the names of the well-known curves for which the token can generate a session key pair.
+func probeCurves(session *pkcs11Session) []string {
+	curves := []string{}
+
+	for name, ci := range wellKnownCurves {
+		if probeCurve(session, ci.oid) {
+			curves = append(curves, name)
+		}
+	}
+
+	sort.Strings(curves)
+	return curves
+}
+
+// probeCurve generates a session key pair on the curve with the given CKA_ECDSA_PARAMS, destroying it again.
+func probeCurve(session *pkcs11Session, oid []byte) bool {
+	pubHandle, privHandle, err := session.ctx.GenerateKeyPair(session.handle,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, oid),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		})
+	if err != nil {
+		return false
+	}
+	session.trackObject(privHandle, "curve probe private key")
+	session.trackObject(pubHandle, "curve probe public key")
+	defer func() {
+		_ = session.destroyObject(privHandle)
+		_ = session.destroyObject(pubHandle)
+	}()
+	return true
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilities(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		before, err := ctx.Inventory()
+		require.NoError(t, err)
+
+		caps, err := ctx.Capabilities()
+		require.NoError(t, err)
+
+		assert.Equal(t, ctx.mechanismHasFlag(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.CKF_SIGN), caps.SupportsPSS)
+		assert.True(t, caps.MaxRSABits >= rsaSize)
+		assert.Contains(t, caps.Curves, "P-256")
+
+		if caps.SupportsGCM {
+			assert.NotEqual(t, GCMIVUnknown, caps.GCMIVSource)
+		} else {
+			assert.Equal(t, GCMIVUnknown, caps.GCMIVSource)
+		}
+
+		// Probing must not leave objects behind
+		after, err := ctx.Inventory()
+		require.NoError(t, err)
+		diff := after.Diff(before)
+		assert.Empty(t, diff.Added)
+		assert.Empty(t, diff.Removed)
+
+		data, err := json.Marshal(caps)
+		require.NoError(t, err)
+
+		var fields map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &fields))
+		for _, name := range []string{"supportsPSS", "supportsOAEPSHA256", "supportsGCM", "gcmIVSource",
+			"supportsEdwards", "supportsHKDF", "maxRSABits", "curves", "writeProtected", "loginRequired",
+			"supportsOperationState", "messageInterfaces", "pkcs1v15DecryptionDisallowed"} {
+			assert.Contains(t, fields, name)
+		}
+	})
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// CertificateBindingStatus reports whether a certificate and a key pair belong together.
+type CertificateBindingStatus int
+
+const (
+	// BindingOK means the certificate holds the public key of the key pair and is currently valid.
+	BindingOK CertificateBindingStatus = iota
+
+	// BindingKeyMismatch means the certificate holds a different public key.
+	BindingKeyMismatch
+
+	// BindingExpired means the certificate holds the public key of the key pair but its NotAfter has passed.
+	BindingExpired
+
+	// BindingNotYetValid means the certificate holds the public key of the key pair but its NotBefore has not
+	// been reached.
+	BindingNotYetValid
+
+	// BindingMissingCertificate means the certificate was not found.
+	BindingMissingCertificate
+
+	// BindingMissingKey means the key pair was not found.
+	BindingMissingKey
+
+	// BindingUnreadable means the certificate or key pair was found but could not be read, for instance because
+	// the certificate does not parse.
+	BindingUnreadable
+)
+
+// CertificateBindingError is returned by VerifyCertificateKeyBinding when the certificate does not bind the key
+// pair. It wraps ErrKeyMismatch if Status is BindingKeyMismatch.
+type CertificateBindingError struct {
+	// Status says what is wrong. It is never BindingOK.
+	Status CertificateBindingStatus
+
+	// CertificateLabel and KeyLabel are the labels passed to VerifyCertificateKeyBinding.
+	CertificateLabel, KeyLabel []byte
+
+	// Time is the reference time the certificate was checked against, for BindingExpired and
+	// BindingNotYetValid. See Config.UseTokenClock.
+	Time time.Time
+
+	// NotBefore and NotAfter are the validity period of the certificate, if it was found.
+	NotBefore, NotAfter time.Time
+}
+
+func (e *CertificateBindingError) Error() string {
+	switch e.Status {
+	case BindingKeyMismatch:
+		return fmt.Sprintf("certificate '%s' does not hold the public key of key pair '%s'", e.CertificateLabel,
+			e.KeyLabel)
+	case BindingExpired:
+		return fmt.Sprintf("certificate '%s' expired at %s (reference time %s)", e.CertificateLabel,
+			e.NotAfter.Format(time.RFC3339), e.Time.Format(time.RFC3339))
+	case BindingNotYetValid:
+		return fmt.Sprintf("certificate '%s' is not valid until %s (reference time %s)", e.CertificateLabel,
+			e.NotBefore.Format(time.RFC3339), e.Time.Format(time.RFC3339))
+	case BindingMissingCertificate:
+		return fmt.Sprintf("certificate '%s' not found", e.CertificateLabel)
+	case BindingMissingKey:
+		return fmt.Sprintf("key pair '%s' not found", e.KeyLabel)
+	default:
+		return fmt.Sprintf("certificate '%s' and key pair '%s': %v", e.CertificateLabel, e.KeyLabel, e.Status)
+	}
+}
+
+// Unwrap returns ErrKeyMismatch for BindingKeyMismatch, and nil otherwise.
+func (e *CertificateBindingError) Unwrap() error {
+	if e.Status == BindingKeyMismatch {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// VerifyCertificateKeyBinding checks that the certificate labelled certLabel holds the public key of the key pair
+// labelled keyLabel, and that it is valid at the reference time (the token clock if Config.UseTokenClock is set).
+// It returns nil if so, a *CertificateBindingError describing the problem if not, and any other error if the
+// objects could not be read.
+func (c *Context) VerifyCertificateKeyBinding(certLabel, keyLabel []byte) error {
+	if certLabel == nil || keyLabel == nil {
+		return errors.New("certLabel and keyLabel must be non-nil")
+	}
+
+	bindingErr := &CertificateBindingError{CertificateLabel: certLabel, KeyLabel: keyLabel}
+
+	certificate, err := c.FindCertificate(nil, certLabel, nil)
+	if err != nil {
+		return err
+	}
+	if certificate == nil {
+		bindingErr.Status = BindingMissingCertificate
+		return bindingErr
+	}
+	bindingErr.NotBefore, bindingErr.NotAfter = certificate.NotBefore, certificate.NotAfter
+
+	key, err := c.FindKeyPair(nil, keyLabel)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		bindingErr.Status = BindingMissingKey
+		return bindingErr
+	}
+
+	bindingErr.Time = c.referenceTime()
+	bindingErr.Status = certificateBindingStatus(certificate, key.Public(), bindingErr.Time)
+	if bindingErr.Status == BindingOK {
+		return nil
+	}
+	return bindingErr
+}
+
+// certificateBindingStatus returns BindingOK, BindingKeyMismatch, BindingExpired or BindingNotYetValid for
+// certificate and the public key of a key pair at time now.
+func certificateBindingStatus(certificate *x509.Certificate, pub crypto.PublicKey, now time.Time) CertificateBindingStatus {
+	switch {
+	case !equalPublicKeys(certificate.PublicKey, pub):
+		return BindingKeyMismatch
+	case now.Before(certificate.NotBefore):
+		return BindingNotYetValid
+	case now.After(certificate.NotAfter):
+		return BindingExpired
+	default:
+		return BindingOK
+	}
+}
+
+// equalPublicKeys compares public keys with their Equal method, which the standard library key types have from Go
+// 1.15, and with publicKeysEqual for keys without one, such as DSA keys.
+func equalPublicKeys(a, b crypto.PublicKey) bool {
+	if e, ok := a.(interface{ Equal(crypto.PublicKey) bool }); ok {
+		return e.Equal(b)
+	}
+	return publicKeysEqual(a, b)
+}
+
+// CertificateBinding is the binding status of a certificate in an Inventory and the key pair with the same CKA_ID.
+type CertificateBinding struct {
+	// ID is the CKA_ID of the certificate.
+	ID []byte
+
+	// CertificateHandle and CertificateLabel identify the certificate.
+	CertificateHandle pkcs11.ObjectHandle
+	CertificateLabel  []byte
+
+	// KeyHandle and KeyLabel identify the private key checked against the certificate, if there is one. If several
+	// private keys have the ID, a key whose public key the certificate holds is preferred.
+	KeyHandle pkcs11.ObjectHandle `json:",omitempty"`
+	KeyLabel  []byte
+
+	// Status is the binding status at the time of the snapshot.
+	Status CertificateBindingStatus
+}
+
+// inventoryBindings returns the binding status of each certificate among objects that has a CKA_ID. Private keys
+// without a certificate are not reported, since key pairs need not have one.
+func (c *Context) inventoryBindings(objects []InventoryObject, now time.Time) ([]CertificateBinding, error) {
+	var bindings []CertificateBinding
+
+	err := c.withSession(func(session *pkcs11Session) error {
+		for _, object := range objects {
+			id := object.Attributes[CkaId]
+			if !object.hasClass(pkcs11.CKO_CERTIFICATE) || len(id) == 0 {
+				continue
+			}
+
+			binding := CertificateBinding{
+				ID:                id,
+				CertificateHandle: object.Handle,
+				CertificateLabel:  object.Attributes[CkaLabel],
+				Status:            BindingMissingKey,
+			}
+			certificate, certErr := readCertificate(session, object.Handle)
+
+			for _, key := range objects {
+				if !key.hasClass(pkcs11.CKO_PRIVATE_KEY) || !bytes.Equal(key.Attributes[CkaId], id) {
+					continue
+				}
+
+				status := BindingUnreadable
+				if certErr == nil {
+					handle := key.Handle
+					if signer, _, err := c.makeKeyPair(session, &handle); err == nil {
+						status = certificateBindingStatus(certificate, signer.Public(), now)
+					}
+				}
+
+				// Report the first key found, unless a later one has the public key the certificate holds.
+				matched := status != BindingKeyMismatch && status != BindingUnreadable
+				if binding.Status == BindingMissingKey || matched {
+					binding.KeyHandle, binding.KeyLabel, binding.Status = key.Handle, key.Attributes[CkaLabel], status
+				}
+				if matched {
+					break
+				}
+			}
+
+			bindings = append(bindings, binding)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// readCertificate reads and parses the CKA_VALUE of a certificate object.
+func readCertificate(session *pkcs11Session, handle pkcs11.ObjectHandle) (*x509.Certificate, error) {
+	attributes, err := session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(attributes[0].Value)
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// certificateWithValidity returns a self-signed certificate for key, valid from notBefore to notAfter.
+func certificateWithValidity(t *testing.T, key crypto.Signer, notBefore, notAfter time.Time) *x509.Certificate {
+	// Tokens may refuse certificates with the same issuer and serial number, so each gets a random serial.
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "binding"},
+		SerialNumber: serial,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return certificate
+}
+
+func TestCertificateBindingStatus(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	now := time.Now()
+	certificate := certificateWithValidity(t, key, now.Add(-time.Hour), now.Add(time.Hour))
+
+	assert.Equal(t, BindingOK, certificateBindingStatus(certificate, key.Public(), now))
+	assert.Equal(t, BindingKeyMismatch, certificateBindingStatus(certificate, other.Public(), now))
+	assert.Equal(t, BindingExpired, certificateBindingStatus(certificate, key.Public(), now.Add(2*time.Hour)))
+	assert.Equal(t, BindingNotYetValid, certificateBindingStatus(certificate, key.Public(), now.Add(-2*time.Hour)))
+
+	// A key mismatch is reported in preference to the validity period.
+	assert.Equal(t, BindingKeyMismatch, certificateBindingStatus(certificate, other.Public(), now.Add(2*time.Hour)))
+}
+
+func TestCertificateBindingError(t *testing.T) {
+	err := &CertificateBindingError{Status: BindingKeyMismatch, CertificateLabel: []byte("tls-2024"),
+		KeyLabel: []byte("tls-2023")}
+	assert.Equal(t, "certificate 'tls-2024' does not hold the public key of key pair 'tls-2023'", err.Error())
+	assert.True(t, errors.Is(err, ErrKeyMismatch))
+
+	expiry := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = &CertificateBindingError{Status: BindingExpired, CertificateLabel: []byte("tls-2024"), NotAfter: expiry,
+		Time: expiry.Add(time.Hour)}
+	assert.Equal(t, "certificate 'tls-2024' expired at 2024-01-02T03:04:05Z (reference time 2024-01-02T04:04:05Z)",
+		err.Error())
+	assert.False(t, errors.Is(err, ErrKeyMismatch))
+
+	err = &CertificateBindingError{Status: BindingMissingKey, KeyLabel: []byte("tls-2023")}
+	assert.Equal(t, "key pair 'tls-2023' not found", err.Error())
+}
+
+func TestVerifyCertificateKeyBinding(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		keyLabel, otherLabel := randomBytes(), randomBytes()
+		key, err := ctx.GenerateECDSAKeyPairWithLabel(randomBytes(), keyLabel, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		other, err := ctx.GenerateECDSAKeyPairWithLabel(randomBytes(), otherLabel, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = other.Delete() }()
+
+		now := time.Now()
+		certificates := map[string]*x509.Certificate{
+			"valid":   certificateWithValidity(t, key, now.Add(-time.Hour), now.Add(time.Hour)),
+			"expired": certificateWithValidity(t, key, now.Add(-2*time.Hour), now.Add(-time.Hour)),
+			"future":  certificateWithValidity(t, key, now.Add(time.Hour), now.Add(2*time.Hour)),
+		}
+		labels := map[string][]byte{}
+		for name, certificate := range certificates {
+			id := randomBytes()
+			labels[name] = randomBytes()
+			require.NoError(t, ctx.ImportCertificateWithLabel(id, labels[name], certificate))
+			defer func() { _ = ctx.DeleteCertificate(id, nil, nil) }()
+		}
+
+		require.NoError(t, ctx.VerifyCertificateKeyBinding(labels["valid"], keyLabel))
+
+		status := func(err error) CertificateBindingStatus {
+			var bindingErr *CertificateBindingError
+			require.True(t, errors.As(err, &bindingErr), "%v", err)
+			return bindingErr.Status
+		}
+		assert.Equal(t, BindingKeyMismatch, status(ctx.VerifyCertificateKeyBinding(labels["valid"], otherLabel)))
+		assert.Equal(t, BindingExpired, status(ctx.VerifyCertificateKeyBinding(labels["expired"], keyLabel)))
+		assert.Equal(t, BindingNotYetValid, status(ctx.VerifyCertificateKeyBinding(labels["future"], keyLabel)))
+		assert.Equal(t, BindingMissingCertificate, status(ctx.VerifyCertificateKeyBinding(randomBytes(), keyLabel)))
+		assert.Equal(t, BindingMissingKey, status(ctx.VerifyCertificateKeyBinding(labels["valid"], randomBytes())))
+
+		assert.Error(t, ctx.VerifyCertificateKeyBinding(nil, keyLabel))
+	})
+}
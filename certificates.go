@@ -22,13 +22,17 @@
 package crypto11
 
 import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/asn1"
+	"errors"
 	"math/big"
 
 	"github.com/miekg/pkcs11"
-	"github.com/pkg/errors"
 )
 
 // FindCertificate retrieves a previously imported certificate. Any combination of id, label
@@ -41,7 +45,7 @@ func findCertificate(session *pkcs11Session, id []byte, label []byte, serial *bi
 	}
 
 	if rawCertificate != nil {
-		cert, err = x509.ParseCertificate(rawCertificate)
+		cert, err = parseCertificateValue(rawCertificate)
 		if err != nil {
 			return nil, err
 		}
@@ -50,6 +54,14 @@ func findCertificate(session *pkcs11Session, id []byte, label []byte, serial *bi
 	return cert, err
 }
 
+// parseCertificateValue parses the CKA_VALUE of a certificate object, which must be exactly one DER certificate.
+func parseCertificateValue(value []byte) (*x509.Certificate, error) {
+	if len(value) == 0 {
+		return nil, errors.New("certificate has an empty CKA_VALUE")
+	}
+	return x509.ParseCertificate(value)
+}
+
 func findRawCertificate(session *pkcs11Session, id []byte, label []byte, serial *big.Int) (rawCertificate []byte, err error) {
 	if id == nil && label == nil && serial == nil {
 		return nil, errors.New("id, label and serial cannot all be nil")
@@ -66,7 +78,7 @@ func findRawCertificate(session *pkcs11Session, id []byte, label []byte, serial
 	if serial != nil {
 		derSerial, err := asn1.Marshal(serial)
 		if err != nil {
-			return nil, errors.WithMessage(err, "failed to encode serial")
+			return nil, withMessage(err, "failed to encode serial")
 		}
 
 		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_SERIAL_NUMBER, derSerial))
@@ -74,17 +86,7 @@ func findRawCertificate(session *pkcs11Session, id []byte, label []byte, serial
 
 	template = append(template, pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE))
 
-	if err = session.ctx.FindObjectsInit(session.handle, template); err != nil {
-		return nil, err
-	}
-	defer func() {
-		finalErr := session.ctx.FindObjectsFinal(session.handle)
-		if err == nil {
-			err = finalErr
-		}
-	}()
-
-	handles, _, err := session.ctx.FindObjects(session.handle, 1)
+	handles, err := findKeysWithAttributes(session, template)
 	if err != nil {
 		return nil, err
 	}
@@ -106,7 +108,8 @@ func findRawCertificate(session *pkcs11Session, id []byte, label []byte, serial
 }
 
 // FindCertificate retrieves a previously imported certificate. Any combination of id, label
-// and serial can be provided. An error is return if all are nil.
+// and serial can be provided. An error is return if all are nil. An empty, non-nil id or label
+// only matches certificates whose attribute is present and empty.
 func (c *Context) FindCertificate(id []byte, label []byte, serial *big.Int) (*x509.Certificate, error) {
 
 	if c.closed.Get() {
@@ -122,11 +125,78 @@ func (c *Context) FindCertificate(id []byte, label []byte, serial *big.Int) (*x5
 	return cert, err
 }
 
+// FindKeyPairForCertificate retrieves the key pair whose public key matches the given certificate, or nil if it
+// cannot be found.
+//
+// Keys provisioned by other PKCS#11 stacks (such as the OpenSSL engine or Java SunPKCS11) commonly use the
+// certificate's subject key identifier as CKA_ID, so that is tried first. If no key pair is found that way, every key
+// pair on the token is compared against the certificate's public key.
+func (c *Context) FindKeyPairForCertificate(certificate *x509.Certificate) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if certificate == nil {
+		return nil, errors.New("certificate cannot be nil")
+	}
+
+	if len(certificate.SubjectKeyId) > 0 {
+		keys, err := c.FindKeyPairs(certificate.SubjectKeyId, nil)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return nil, err
+		}
+		if k := findMatchingSigner(keys, certificate.PublicKey); k != nil {
+			return k, nil
+		}
+	}
+
+	keys, err := c.FindAllKeyPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	return findMatchingSigner(keys, certificate.PublicKey), nil
+}
+
+// findMatchingSigner returns the first signer whose public key equals pub, or nil if there is none.
+func findMatchingSigner(signers []Signer, pub crypto.PublicKey) Signer {
+	for _, s := range signers {
+		if publicKeysEqual(s.Public(), pub) {
+			return s
+		}
+	}
+	return nil
+}
+
+// publicKeysEqual reports whether a and b are the same public key. Only the key types supported by this package are
+// compared, any other type is never equal.
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	switch ka := a.(type) {
+	case *rsa.PublicKey:
+		kb, ok := b.(*rsa.PublicKey)
+		return ok && ka.E == kb.E && ka.N.Cmp(kb.N) == 0
+	case *ecdsa.PublicKey:
+		kb, ok := b.(*ecdsa.PublicKey)
+		return ok && ka.Curve == kb.Curve && ka.X.Cmp(kb.X) == 0 && ka.Y.Cmp(kb.Y) == 0
+	case *dsa.PublicKey:
+		kb, ok := b.(*dsa.PublicKey)
+		return ok && ka.Y.Cmp(kb.Y) == 0 && ka.P.Cmp(kb.P) == 0 && ka.Q.Cmp(kb.Q) == 0 && ka.G.Cmp(kb.G) == 0
+	default:
+		return false
+	}
+}
+
+// FindAllPairedCertificates returns every certificate on the token that has a matching private key, as a
+// tls.Certificate whose PrivateKey is the token's Signer. Archived key pairs are skipped.
 func (c *Context) FindAllPairedCertificates() (certificates []tls.Certificate, err error) {
 	if c.closed.Get() {
 		return nil, errClosed
 	}
 
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
 	err = c.withSession(func(session *pkcs11Session) error {
 		// Add the private key class to the template to find the private half
 		privAttributes := AttributeSet{}
@@ -152,7 +222,7 @@ func (c *Context) FindAllPairedCertificates() (certificates []tls.Certificate, e
 				return err
 			}
 
-			if certificate == nil {
+			if certificate == nil || Archived(privateKey) {
 				continue
 			}
 
@@ -222,6 +292,19 @@ func (c *Context) ImportCertificateWithAttributes(template AttributeSet, certifi
 		return errClosed
 	}
 
+	if err := addCertificateAttributes(template, certificate); err != nil {
+		return err
+	}
+
+	return c.withSession(func(session *pkcs11Session) error {
+		_, err := session.ctx.CreateObject(session.handle, template.ToSlice())
+		return err
+	})
+}
+
+// addCertificateAttributes adds the attributes of certificate to template, and defaults for any other required
+// attributes that are not present.
+func addCertificateAttributes(template AttributeSet, certificate *x509.Certificate) error {
 	if certificate == nil {
 		return errors.New("certificate cannot be nil")
 	}
@@ -241,13 +324,7 @@ func (c *Context) ImportCertificateWithAttributes(template AttributeSet, certifi
 		pkcs11.NewAttribute(pkcs11.CKA_SERIAL_NUMBER, serial),
 		pkcs11.NewAttribute(pkcs11.CKA_VALUE, certificate.Raw),
 	})
-
-	err = c.withSession(func(session *pkcs11Session) error {
-		_, err = session.ctx.CreateObject(session.handle, template.ToSlice())
-		return err
-	})
-
-	return err
+	return nil
 }
 
 // DeleteCertificate destroys a previously imported certificate. it will return
@@ -277,18 +354,10 @@ func (c *Context) DeleteCertificate(id []byte, label []byte, serial *big.Int) er
 	}
 
 	err := c.withSession(func(session *pkcs11Session) error {
-		err := session.ctx.FindObjectsInit(session.handle, template)
-		if err != nil {
-			return err
-		}
-		handles, _, err := session.ctx.FindObjects(session.handle, 1)
-		finalErr := session.ctx.FindObjectsFinal(session.handle)
+		handles, err := findKeysWithAttributes(session, template)
 		if err != nil {
 			return err
 		}
-		if finalErr != nil {
-			return finalErr
-		}
 		if len(handles) == 0 {
 			return nil
 		}
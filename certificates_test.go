@@ -22,6 +22,7 @@
 package crypto11
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -31,6 +32,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/miekg/pkcs11"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -235,3 +237,221 @@ func generateRandomCert(t *testing.T) *x509.Certificate {
 
 	return cert
 }
+
+func TestFindKeyPairForCertificate(t *testing.T) {
+	skipTest(t, skipTestCert)
+
+	withContext(t, func(ctx *Context) {
+		// Mimic the conventions of the OpenSSL engine and pkcs11-tool: CKA_ID is the certificate SKI and labels
+		// contain spaces.
+		ski := randomBytes()[:20]
+
+		key, err := ctx.GenerateRSAKeyPairWithLabel(ski, []byte("OpenSSL RSA key"), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		cert := generateCertForSigner(t, key, ski)
+		err = ctx.ImportCertificateWithLabel(ski, []byte("OpenSSL RSA cert"), cert)
+		require.NoError(t, err)
+		defer func() { _ = ctx.DeleteCertificate(ski, nil, nil) }()
+
+		found, err := ctx.FindKeyPairForCertificate(cert)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		testRsaSigning(t, found, false)
+
+		// A certificate for a key that isn't on the token must not match anything
+		found, err = ctx.FindKeyPairForCertificate(generateRandomCert(t))
+		require.NoError(t, err)
+		require.Nil(t, found)
+	})
+}
+
+func TestFindKeyPairWithoutPublicObject(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		ski := randomBytes()[:20]
+
+		key, err := ctx.GenerateRSAKeyPairWithLabel(ski, []byte("key without public object"), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		// Remove the public object, as some stacks never create one
+		rsaKey := key.(*pkcs11PrivateKeyRSA)
+		err = ctx.withSession(func(session *pkcs11Session) error {
+			return session.ctx.DestroyObject(session.handle, rsaKey.pubKeyHandle)
+		})
+		require.NoError(t, err)
+		rsaKey.pubKeyHandle = 0
+
+		found, err := ctx.FindKeyPair(ski, nil)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.True(t, publicKeysEqual(key.Public(), found.Public()))
+		testRsaSigning(t, found, false)
+	})
+}
+
+// pkcs11ToolFixture describes a key pair provisioned the way pkcs11-tool --keypairgen does it: CKA_ID is 20 bytes,
+// as it is when taken from a certificate SKI, the label contains spaces and the private key template leaves usage
+// attributes to the token.
+type pkcs11ToolFixture struct {
+	name      string
+	mechanism uint
+	public    []*pkcs11.Attribute
+
+	// withoutPublicObject destroys the public key object, as some stacks never create one
+	withoutPublicObject bool
+
+	// withCertificate imports a certificate for the key pair under the same CKA_ID
+	withCertificate bool
+}
+
+func TestPkcs11ToolFixtures(t *testing.T) {
+	rsaPublic := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, rsaSize),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+	}
+	ecPublic := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, wellKnownCurves["P-256"].oid),
+	}
+
+	fixtures := []pkcs11ToolFixture{
+		{name: "RSA key", mechanism: pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, public: rsaPublic},
+		{name: "RSA key with cert", mechanism: pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, public: rsaPublic, withCertificate: true},
+		{name: "RSA key without pubkey", mechanism: pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, public: rsaPublic,
+			withoutPublicObject: true},
+		{name: "EC key", mechanism: pkcs11.CKM_EC_KEY_PAIR_GEN, public: ecPublic},
+		{name: "EC key with cert and without pubkey", mechanism: pkcs11.CKM_EC_KEY_PAIR_GEN, public: ecPublic,
+			withoutPublicObject: true, withCertificate: true},
+	}
+
+	withContext(t, func(ctx *Context) {
+		for _, fixture := range fixtures {
+			t.Run(fixture.name, func(t *testing.T) {
+				if fixture.withCertificate {
+					skipTest(t, skipTestCert)
+				}
+				testPkcs11ToolFixture(t, ctx, fixture)
+			})
+		}
+	})
+}
+
+func testPkcs11ToolFixture(t *testing.T, ctx *Context, fixture pkcs11ToolFixture) {
+	id := randomBytes()[:20]
+	label := []byte("pkcs11-tool " + fixture.name)
+
+	public := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}, fixture.public...)
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	var pubHandle, privHandle pkcs11.ObjectHandle
+	err := ctx.withSession(func(session *pkcs11Session) (err error) {
+		pubHandle, privHandle, err = session.ctx.GenerateKeyPair(session.handle,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(fixture.mechanism, nil)}, public, private)
+		return err
+	})
+	require.NoError(t, err)
+	defer func() {
+		_ = ctx.withSession(func(session *pkcs11Session) error {
+			if !fixture.withoutPublicObject {
+				_ = session.ctx.DestroyObject(session.handle, pubHandle)
+			}
+			return session.ctx.DestroyObject(session.handle, privHandle)
+		})
+	}()
+
+	var cert *x509.Certificate
+	if fixture.withCertificate {
+		// The certificate is issued while the public key object still exists, as a CA would have done
+		generated, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		require.NotNil(t, generated)
+
+		cert = generateCertForSigner(t, generated, id)
+		err = ctx.ImportCertificateWithLabel(id, label, cert)
+		require.NoError(t, err)
+		defer func() { _ = ctx.DeleteCertificate(id, nil, nil) }()
+	}
+
+	if fixture.withoutPublicObject {
+		err = ctx.withSession(func(session *pkcs11Session) error {
+			return session.ctx.DestroyObject(session.handle, pubHandle)
+		})
+		require.NoError(t, err)
+	}
+
+	found, err := ctx.FindKeyPair(id, nil)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+
+	if cert != nil {
+		byCert, err := ctx.FindKeyPairForCertificate(cert)
+		require.NoError(t, err)
+		require.NotNil(t, byCert)
+		assert.True(t, publicKeysEqual(found.Public(), byCert.Public()))
+	}
+
+	var key *pkcs11PrivateKey
+	switch k := found.(type) {
+	case *pkcs11PrivateKeyRSA:
+		key = &k.pkcs11PrivateKey
+		testRsaSigning(t, found, false)
+	case *pkcs11PrivateKeyECDSA:
+		key = &k.pkcs11PrivateKey
+		testEcdsaSigning(t, found, crypto.SHA256, "P-256", "SHA-256")
+	default:
+		t.Fatalf("unexpected key type %T", found)
+	}
+
+	// The token signed, so whatever it chose for CKA_SIGN must read as permitting it
+	usage, err := ctx.usageAttributes(key, []AttributeType{CkaSign})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1}, usage[CkaSign].Value)
+}
+
+// generateCertForSigner creates a self-signed certificate for key, with the given subject key identifier.
+func generateCertForSigner(t *testing.T, key crypto.Signer, ski []byte) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, big.NewInt(20000))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: "Interop",
+		},
+		SerialNumber: serial,
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		SubjectKeyId: ski,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(certBytes)
+	require.NoError(t, err)
+
+	return cert
+}
+
+func TestPublicKeysEqual(t *testing.T) {
+	k1, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	k2, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	copied := k1.PublicKey
+	assert.True(t, publicKeysEqual(&k1.PublicKey, &copied))
+	assert.False(t, publicKeysEqual(&k1.PublicKey, &k2.PublicKey))
+	assert.False(t, publicKeysEqual(&k1.PublicKey, nil))
+	assert.False(t, publicKeysEqual(nil, nil))
+}
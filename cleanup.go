@@ -0,0 +1,202 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// cleanupStackDepth is the number of stack frames recorded for each session checkout when Config.DebugStrictCleanup
+// is set.
+const cleanupStackDepth = 16
+
+// CleanupError is returned by Context.Close when Config.DebugStrictCleanup is set and the Context did not release
+// everything it acquired.
+type CleanupError struct {
+	// Sessions describes the pool sessions that were still checked out, each with the stack that checked it out.
+	// Close does not wait for them, but closes them and finishes tearing down the Context; a session returned to the
+	// pool afterwards is dropped.
+	Sessions []string
+
+	// Objects describes the session objects created by crypto11 that were neither destroyed nor preserved, and so
+	// were reaped when their session was returned to the pool or discarded with it.
+	Objects []string
+}
+
+func (e *CleanupError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "context not cleaned up: %d session(s) still checked out, %d session object(s) leaked",
+		len(e.Sessions), len(e.Objects))
+	for _, s := range e.Sessions {
+		b.WriteString("\n\nsession ")
+		b.WriteString(s)
+	}
+	for _, o := range e.Objects {
+		b.WriteString("\n\nobject ")
+		b.WriteString(o)
+	}
+	return b.String()
+}
+
+// cleanupTracker records the sessions checked out of a Context's pool and the session objects it leaked, for
+// Config.DebugStrictCleanup. A nil *cleanupTracker records nothing.
+type cleanupTracker struct {
+	mutex sync.Mutex
+
+	// sessions maps checked out sessions to the stack that checked them out.
+	sessions map[pkcs11.SessionHandle]string
+
+	// objects describes the leaked session objects, in the order they were found.
+	objects []string
+
+	// abandoned is set once Close has closed the sessions still checked out, see abandon.
+	abandoned bool
+}
+
+// newCleanupTracker returns a tracker if enabled is true, and nil otherwise.
+func newCleanupTracker(enabled bool) *cleanupTracker {
+	if !enabled {
+		return nil
+	}
+	return &cleanupTracker{sessions: map[pkcs11.SessionHandle]string{}}
+}
+
+// checkedOut records that s has been taken from the pool by the caller of the function that called checkedOut.
+func (t *cleanupTracker) checkedOut(s *pkcs11Session) {
+	if t == nil {
+		return
+	}
+
+	pcs := make([]uintptr, cleanupStackDepth)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d checked out at:", s.handle)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "\n\t%s (%s:%d)", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sessions[s.handle] = b.String()
+}
+
+// returned records that s has been given back to the pool, or discarded.
+func (t *cleanupTracker) returned(s *pkcs11Session) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.sessions, s.handle)
+}
+
+// leakedObject records that a tracked session object was reaped or discarded with its session.
+func (t *cleanupTracker) leakedObject(handle pkcs11.ObjectHandle, description, fate string) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.objects = append(t.objects, fmt.Sprintf("%d (%s) %s", handle, description, fate))
+}
+
+// abandon records that Close will not wait for the sessions still checked out, and returns their handles so that
+// they can be closed. Sessions returned to the pool afterwards are dropped, see isAbandoned.
+func (t *cleanupTracker) abandon() []pkcs11.SessionHandle {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.abandoned = true
+	handles := make([]pkcs11.SessionHandle, 0, len(t.sessions))
+	for handle := range t.sessions {
+		handles = append(handles, handle)
+	}
+	return handles
+}
+
+// isAbandoned returns true if Close has finished without waiting for the sessions checked out, so a returned session
+// must not be used.
+func (t *cleanupTracker) isAbandoned() bool {
+	if t == nil {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.abandoned
+}
+
+// outstandingSessions returns a description of each session still checked out, ordered by handle.
+func (t *cleanupTracker) outstandingSessions() []string {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	handles := make([]pkcs11.SessionHandle, 0, len(t.sessions))
+	for handle := range t.sessions {
+		handles = append(handles, handle)
+	}
+	sort.Slice(handles, func(i, j int) bool { return handles[i] < handles[j] })
+
+	var result []string
+	for _, handle := range handles {
+		result = append(result, t.sessions[handle])
+	}
+	return result
+}
+
+// report returns a *CleanupError describing what was not cleaned up, or nil if everything was. sessions is the
+// result of outstandingSessions.
+func (t *cleanupTracker) report(sessions []string) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	objects := append([]string(nil), t.objects...)
+	t.mutex.Unlock()
+
+	if len(sessions) == 0 && len(objects) == 0 {
+		return nil
+	}
+	return &CleanupError{Sessions: sessions, Objects: objects}
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanupTrackerDisabled(t *testing.T) {
+	var tracker *cleanupTracker
+	session := &pkcs11Session{handle: 1}
+	tracker.checkedOut(session)
+	tracker.leakedObject(2, "key", "reaped")
+	assert.Empty(t, tracker.outstandingSessions())
+	assert.NoError(t, tracker.report(nil))
+}
+
+func TestCleanupTracker(t *testing.T) {
+	tracker := newCleanupTracker(true)
+	first := &pkcs11Session{handle: 2}
+	second := &pkcs11Session{handle: 1}
+
+	tracker.checkedOut(first)
+	tracker.checkedOut(second)
+	tracker.returned(first)
+	tracker.leakedObject(7, "wrapping key", "discarded with its session")
+
+	sessions := tracker.outstandingSessions()
+	require.Len(t, sessions, 1)
+	assert.Contains(t, sessions[0], "1 checked out at:")
+
+	var cleanupErr *CleanupError
+	require.True(t, errors.As(tracker.report(sessions), &cleanupErr))
+	assert.Equal(t, []string{"7 (wrapping key) discarded with its session"}, cleanupErr.Objects)
+	assert.Contains(t, cleanupErr.Error(), "1 session(s) still checked out, 1 session object(s) leaked")
+
+	tracker.returned(second)
+	assert.Empty(t, tracker.outstandingSessions())
+}
+
+func TestDebugStrictCleanup(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.DebugStrictCleanup = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+
+	// A session that is never returned is reported, without Close waiting for it
+	session, err := ctx.getSession()
+	require.NoError(t, err)
+	handle := generateSessionKey(t, session)
+	session.trackObject(handle, "test key")
+
+	var cleanupErr *CleanupError
+	require.True(t, errors.As(ctx.Close(), &cleanupErr))
+	require.Len(t, cleanupErr.Sessions, 1)
+	assert.Contains(t, cleanupErr.Sessions[0], "TestDebugStrictCleanup")
+	assert.Empty(t, cleanupErr.Objects)
+
+	// Close still finished the teardown, and a session returned afterwards is dropped
+	refCountMutex.Lock()
+	assert.Zero(t, refCount[config.Path])
+	refCountMutex.Unlock()
+	require.NoError(t, ctx.putSession(session, nil))
+
+	// Returning a session reaps its object, which is reported by Close
+	ctx, err = Configure(config)
+	require.NoError(t, err)
+	session, err = ctx.getSession()
+	require.NoError(t, err)
+	handle = generateSessionKey(t, session)
+	session.trackObject(handle, "test key")
+	require.NoError(t, ctx.putSession(session, nil))
+
+	require.True(t, errors.As(ctx.Close(), &cleanupErr))
+	assert.Empty(t, cleanupErr.Sessions)
+	require.Len(t, cleanupErr.Objects, 1)
+	assert.Contains(t, cleanupErr.Objects[0], "(test key) reaped when its session was returned to the pool")
+}
@@ -0,0 +1,471 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DefaultCloneWrapMechanisms lists the wrapping mechanisms considered by CloneKey, strongest first.
+var DefaultCloneWrapMechanisms = []uint{
+	pkcs11.CKM_AES_KEY_WRAP_PAD,
+	pkcs11.CKM_AES_KEY_WRAP,
+	pkcs11.CKM_AES_CBC_PAD,
+	pkcs11.CKM_DES3_CBC_PAD,
+}
+
+// wrapMechanismKeyTypes maps each supported wrapping mechanism to the transport key type it requires.
+var wrapMechanismKeyTypes = map[uint]uint{
+	pkcs11.CKM_AES_KEY_WRAP_PAD: pkcs11.CKK_AES,
+	pkcs11.CKM_AES_KEY_WRAP:     pkcs11.CKK_AES,
+	pkcs11.CKM_AES_CBC_PAD:      pkcs11.CKK_AES,
+	pkcs11.CKM_DES3_CBC_PAD:     pkcs11.CKK_DES3,
+}
+
+// cloneSecretKeyAttributes are copied from a source secret key to its clone.
+var cloneSecretKeyAttributes = []AttributeType{
+	CkaClass, CkaKeyType, CkaId, CkaLabel, CkaPrivate, CkaSensitive, CkaExtractable,
+	CkaEncrypt, CkaDecrypt, CkaSign, CkaVerify, CkaWrap, CkaUnwrap, CkaDerive,
+}
+
+// clonePrivateKeyAttributes are copied from a source private key to its clone.
+var clonePrivateKeyAttributes = []AttributeType{
+	CkaClass, CkaKeyType, CkaId, CkaLabel, CkaPrivate, CkaSensitive, CkaExtractable,
+	CkaSign, CkaDecrypt, CkaUnwrap, CkaDerive,
+}
+
+// cloneProbe is the data signed or encrypted to verify a cloned key.
+var cloneProbe = []byte("crypto11 key clone verification probe")
+
+// errCloneNotVerifiable is returned when a cloned key has no usage that CloneKey can exercise.
+var errCloneNotVerifiable = errors.New("key permits no operation that can be used to verify the clone")
+
+// CloneKeyOptions controls the behaviour of CloneKey.
+type CloneKeyOptions struct {
+	// WrapMechanisms lists the wrapping mechanisms to consider, strongest first. If nil,
+	// DefaultCloneWrapMechanisms is used.
+	WrapMechanisms []uint
+}
+
+// CloneKey copies the key with CKA_ID keyID from the token of src to the token of dst. The key is wrapped on src
+// and unwrapped on dst using a transport key, which must exist on both tokens with CKA_LABEL transportKeyLabel and
+// the same value. The key may be a secret key or the private half of a key pair. The private half of a key pair is
+// copied by wrapping, and a public key object with the same CKA_ID and CKA_LABEL is created on dst from the source
+// public key, so that FindKeyPair can find the clone.
+//
+// The clone keeps the label, ID, usage flags and sensitivity of the source key. The wrapping mechanism is the first
+// entry of opts.WrapMechanisms (or DefaultCloneWrapMechanisms if opts is nil) that the transport key permits, src
+// can wrap with and dst can unwrap with.
+//
+// After unwrapping, the clone is verified by signing (or encrypting) a probe on dst and checking the result against
+// the source key. CloneKey never deletes anything: if verification fails the clone is left on dst and an error is
+// returned. Errors indicate whether the source or the destination token failed.
+func CloneKey(src *Context, dst *Context, keyID []byte, transportKeyLabel []byte, opts *CloneKeyOptions) error {
+	if src.closed.Get() || dst.closed.Get() {
+		return errClosed
+	}
+
+	if len(keyID) == 0 {
+		return errors.New("key ID must be specified")
+	}
+
+	if opts == nil {
+		opts = &CloneKeyOptions{}
+	}
+	mechanisms := opts.WrapMechanisms
+	if mechanisms == nil {
+		mechanisms = DefaultCloneWrapMechanisms
+	}
+
+	srcKey, err := src.findCloneSource(keyID)
+	if err != nil {
+		return withMessage(err, "source token")
+	}
+
+	srcTransport, err := src.FindKey(nil, transportKeyLabel)
+	if err != nil {
+		return withMessage(err, "source token: finding transport key")
+	}
+	if srcTransport == nil {
+		return withMessage(src.notFoundError("transport key %q not found", transportKeyLabel), "source token")
+	}
+
+	dstTransport, err := dst.FindKey(nil, transportKeyLabel)
+	if err != nil {
+		return withMessage(err, "destination token: finding transport key")
+	}
+	if dstTransport == nil {
+		return withMessage(dst.notFoundError("transport key %q not found", transportKeyLabel),
+			"destination token")
+	}
+
+	template, err := src.getAttributes(srcKey.handle, srcKey.attributeTypes())
+	if err != nil {
+		return withMessage(err, "source token: reading key attributes")
+	}
+	if err = template.Set(CkaToken, true); err != nil {
+		return err
+	}
+
+	transportType, err := src.getAttributes(srcTransport.handle, []AttributeType{CkaKeyType})
+	if err != nil {
+		return withMessage(err, "source token: reading transport key type")
+	}
+
+	mech, err := negotiateWrapMechanism(src, dst, mechanisms, bytesToUlong(transportType[CkaKeyType].Value),
+		srcKey.secret != nil)
+	if err != nil {
+		return err
+	}
+
+	var iv []byte
+	if mech == pkcs11.CKM_AES_CBC_PAD || mech == pkcs11.CKM_DES3_CBC_PAD {
+		if iv, err = src.cloneIV(srcTransport.Cipher.BlockSize); err != nil {
+			return withMessage(err, "source token: generating IV")
+		}
+	}
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, iv)}
+
+	var wrapped []byte
+	err = src.withSession(func(session *pkcs11Session) error {
+		wrapped, err = session.ctx.WrapKey(session.handle, mechanism, srcTransport.handle, srcKey.handle)
+		return err
+	})
+	if err != nil {
+		return withMessage(err, "source token: wrapping key")
+	}
+
+	var handle pkcs11.ObjectHandle
+	err = dst.withSession(func(session *pkcs11Session) error {
+		handle, err = session.ctx.UnwrapKey(session.handle, mechanism, dstTransport.handle, wrapped,
+			template.ToSlice())
+		return err
+	})
+	if err != nil {
+		return withMessage(err, "destination token: unwrapping key")
+	}
+
+	if srcKey.pub != nil {
+		if err = dst.createClonePublicKey(srcKey.pub, template); err != nil {
+			return withMessage(err, "destination token: creating public key")
+		}
+	}
+
+	return srcKey.verifyClone(dst, handle, template)
+}
+
+// createClonePublicKey creates a token public key object for pub, with the ID and label of the cloned private key
+// and the usages that match the private key's.
+func (c *Context) createClonePublicKey(pub crypto.PublicKey, private AttributeSet) error {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, attributeIsTrue(private, CkaSign)),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, attributeIsTrue(private, CkaDecrypt)),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, attributeIsTrue(private, CkaUnwrap)),
+	}
+	for _, t := range []AttributeType{CkaId, CkaLabel} {
+		if a, ok := private[t]; ok {
+			template = append(template, pkcs11.NewAttribute(a.Type, a.Value))
+		}
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		template = append(template,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, pub.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(pub.E)).Bytes()))
+
+	case *ecdsa.PublicKey:
+		params, err := marshalEcParams(pub.Curve)
+		if err != nil {
+			return err
+		}
+		point, err := asn1.Marshal(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+		if err != nil {
+			return err
+		}
+		template = append(template,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point))
+
+	case *dsa.PublicKey:
+		template = append(template,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_DSA),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME, pub.P.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_SUBPRIME, pub.Q.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_BASE, pub.G.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, pub.Y.Bytes()))
+
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	return c.withSession(func(session *pkcs11Session) error {
+		_, err := session.ctx.CreateObject(session.handle, template)
+		return err
+	})
+}
+
+// cloneSource describes the key being copied by CloneKey. Exactly one of secret and pub is set.
+type cloneSource struct {
+	handle pkcs11.ObjectHandle
+	secret *SecretKey
+	pub    crypto.PublicKey
+}
+
+// findCloneSource finds the secret key or private key with the given CKA_ID.
+func (c *Context) findCloneSource(keyID []byte) (*cloneSource, error) {
+	secret, err := c.FindKey(keyID, nil)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return nil, withMessage(err, "finding secret key")
+	}
+	if secret != nil {
+		return &cloneSource{handle: secret.handle, secret: secret}, nil
+	}
+
+	signer, err := c.FindKeyPair(keyID, nil)
+	if err != nil {
+		return nil, withMessage(err, "finding key pair")
+	}
+
+	switch k := signer.(type) {
+	case *pkcs11PrivateKeyDSA:
+		return &cloneSource{handle: k.handle, pub: k.Public()}, nil
+	case *pkcs11PrivateKeyRSA:
+		return &cloneSource{handle: k.handle, pub: k.Public()}, nil
+	case *pkcs11PrivateKeyECDSA:
+		return &cloneSource{handle: k.handle, pub: k.Public()}, nil
+	case nil:
+		return nil, c.notFoundError("no key with ID %x", keyID)
+	default:
+		return nil, fmt.Errorf("unsupported key pair type %T", signer)
+	}
+}
+
+func (s *cloneSource) attributeTypes() []AttributeType {
+	if s.secret != nil {
+		return cloneSecretKeyAttributes
+	}
+	return clonePrivateKeyAttributes
+}
+
+// negotiateWrapMechanism returns the first of mechanisms that suits the transport key type, can wrap on src and can
+// unwrap on dst. Unpadded mechanisms are only considered for secret keys, as encoded private keys need not be a
+// multiple of the block size.
+func negotiateWrapMechanism(src, dst *Context, mechanisms []uint, transportKeyType uint, secret bool) (uint, error) {
+	for _, mech := range mechanisms {
+		if keyType, ok := wrapMechanismKeyTypes[mech]; !ok || keyType != transportKeyType {
+			continue
+		}
+		if mech == pkcs11.CKM_AES_KEY_WRAP && !secret {
+			continue
+		}
+		if src.mechanismHasFlag(mech, pkcs11.CKF_WRAP) && dst.mechanismHasFlag(mech, pkcs11.CKF_UNWRAP) {
+			return mech, nil
+		}
+	}
+	return 0, fmt.Errorf("no wrapping mechanism is supported by both tokens for transport key type %X",
+		transportKeyType)
+}
+
+// mechanismHasFlag returns true if the token supports mech with the given CKF_... flag.
+func (c *Context) mechanismHasFlag(mech uint, flag uint) bool {
+	info, err := c.ctx.GetMechanismInfo(c.slot, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)})
+	if err != nil {
+		return false
+	}
+	return info.Flags&flag != 0
+}
+
+func (c *Context) cloneIV(size int) ([]byte, error) {
+	reader, err := c.nonceReader()
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, size)
+	if _, err = io.ReadFull(reader, iv); err != nil {
+		return nil, err
+	}
+	return iv, nil
+}
+
+// verifyClone checks that the key with the given handle on dst matches the source key.
+func (s *cloneSource) verifyClone(dst *Context, handle pkcs11.ObjectHandle, attributes AttributeSet) error {
+	if s.secret != nil {
+		return s.verifySecretClone(dst, handle, attributes)
+	}
+
+	digest := sha256.Sum256(cloneProbe)
+
+	if !attributeIsTrue(attributes, CkaSign) {
+		pub, ok := s.pub.(*rsa.PublicKey)
+		if !ok || !attributeIsTrue(attributes, CkaDecrypt) {
+			return withMessage(errCloneNotVerifiable, "destination token")
+		}
+
+		ciphertext, err := rsa.EncryptPKCS1v15(dst.randReader(), pub, cloneProbe)
+		if err != nil {
+			return err
+		}
+		// The probe decrypts a ciphertext made here, so Config.DisallowPKCS1v15Decryption does not apply to it.
+		allowed := true
+		clone := &pkcs11PrivateKeyRSA{pkcs11PrivateKey: probeKey(dst, handle, pub), pkcs1v15Decryption: &allowed}
+		plaintext, err := clone.Decrypt(nil, ciphertext, nil)
+		if err != nil {
+			return withMessage(err, "destination token: decrypting probe")
+		}
+		if !bytes.Equal(plaintext, cloneProbe) {
+			return errors.New("destination token: cloned key does not match source key")
+		}
+		return nil
+	}
+
+	var verified bool
+	switch pub := s.pub.(type) {
+	case *rsa.PublicKey:
+		clone := &pkcs11PrivateKeyRSA{pkcs11PrivateKey: probeKey(dst, handle, pub)}
+		sig, err := clone.Sign(nil, digest[:], crypto.SHA256)
+		if err != nil {
+			return withMessage(err, "destination token: signing probe")
+		}
+		verified = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+
+	case *ecdsa.PublicKey:
+		sigDER, err := dst.dsaGeneric(handle, pkcs11.CKM_ECDSA, digest[:])
+		if err != nil {
+			return withMessage(err, "destination token: signing probe")
+		}
+		var sig dsaSignature
+		if err = sig.unmarshalDER(sigDER); err != nil {
+			return withMessage(err, "destination token")
+		}
+		verified = ecdsa.Verify(pub, digest[:], sig.R, sig.S)
+
+	case *dsa.PublicKey:
+		hash := digest[:min(len(digest), (pub.Q.BitLen()+7)/8)]
+		sigDER, err := dst.dsaGeneric(handle, pkcs11.CKM_DSA, hash)
+		if err != nil {
+			return withMessage(err, "destination token: signing probe")
+		}
+		var sig dsaSignature
+		if err = sig.unmarshalDER(sigDER); err != nil {
+			return withMessage(err, "destination token")
+		}
+		verified = dsa.Verify(pub, hash, sig.R, sig.S)
+
+	default:
+		return fmt.Errorf("unsupported public key type %T", s.pub)
+	}
+
+	if !verified {
+		return errors.New("destination token: probe signature does not verify against source public key")
+	}
+	return nil
+}
+
+// probeKey returns the cloned private key with the given handle on dst, for signing or decrypting a probe.
+func probeKey(dst *Context, handle pkcs11.ObjectHandle, pub crypto.PublicKey) pkcs11PrivateKey {
+	return pkcs11PrivateKey{pkcs11Object: pkcs11Object{handle: handle, context: dst}, pubKey: pub,
+		signatureLength: signatureLengthOf(pub)}
+}
+
+// verifySecretClone checks a cloned secret key by encrypting or MACing the same probe with both keys.
+func (s *cloneSource) verifySecretClone(dst *Context, handle pkcs11.ObjectHandle, attributes AttributeSet) error {
+	var mech *pkcs11.Mechanism
+	var encrypt bool
+
+	switch {
+	case attributeIsTrue(attributes, CkaEncrypt) && s.secret.Cipher.Encrypt && s.secret.Cipher.CBCMech != 0:
+		mech = pkcs11.NewMechanism(s.secret.Cipher.CBCMech, make([]byte, s.secret.Cipher.BlockSize))
+		encrypt = true
+	case attributeIsTrue(attributes, CkaSign) && s.secret.Cipher.MAC:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_SHA256_HMAC, nil)
+	default:
+		return withMessage(errCloneNotVerifiable, "destination token")
+	}
+
+	// CBC needs whole blocks
+	probe := cloneProbe
+	if encrypt {
+		probe = make([]byte, s.secret.Cipher.BlockSize)
+		copy(probe, cloneProbe)
+	}
+
+	expected, err := secretKeyProbe(s.secret.context, s.handle, mech, encrypt, probe)
+	if err != nil {
+		return withMessage(err, "source token: computing probe")
+	}
+
+	actual, err := secretKeyProbe(dst, handle, mech, encrypt, probe)
+	if err != nil {
+		return withMessage(err, "destination token: computing probe")
+	}
+
+	if !bytes.Equal(expected, actual) {
+		return errors.New("destination token: cloned key does not match source key")
+	}
+	return nil
+}
+
+// secretKeyProbe encrypts or signs data with a secret key in a single operation.
+func secretKeyProbe(c *Context, handle pkcs11.ObjectHandle, mech *pkcs11.Mechanism, encrypt bool,
+	data []byte) (result []byte, err error) {
+
+	err = c.withSession(func(session *pkcs11Session) error {
+		if encrypt {
+			if err = session.encryptInit([]*pkcs11.Mechanism{mech}, handle); err != nil {
+				return err
+			}
+			result, err = session.encrypt(data)
+			return err
+		}
+
+		if err = session.signInit([]*pkcs11.Mechanism{mech}, handle); err != nil {
+			return err
+		}
+		result, err = session.sign(mech.Mechanism, data)
+		return err
+	})
+	return result, err
+}
+
+// attributeIsTrue returns true if the set contains the boolean attribute t with a true value.
+func attributeIsTrue(attributes AttributeSet, t AttributeType) bool {
+	a, ok := attributes[t]
+	return ok && len(a.Value) > 0 && a.Value[0] != 0
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// generateTransportKey creates an AES key that can wrap and unwrap other keys.
+func generateTransportKey(t *testing.T, ctx *Context) (*SecretKey, []byte) {
+	label := randomBytes()
+	template, err := NewAttributeSetWithIDAndLabel(randomBytes(), label)
+	require.NoError(t, err)
+	require.NoError(t, template.Set(CkaWrap, true))
+	require.NoError(t, template.Set(CkaUnwrap, true))
+
+	key, err := ctx.GenerateSecretKeyWithAttributes(template, 256, CipherAES)
+	require.NoError(t, err)
+	return key, label
+}
+
+// extractableTemplate returns a template for a new extractable key with a random CKA_ID.
+func extractableTemplate(t *testing.T) (AttributeSet, []byte) {
+	id := randomBytes()
+	template, err := NewAttributeSetWithIDAndLabel(id, randomBytes())
+	require.NoError(t, err)
+	require.NoError(t, template.Set(CkaExtractable, true))
+	return template, id
+}
+
+func TestCloneSecretKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_AES_KEY_WRAP_PAD)
+
+		transport, transportLabel := generateTransportKey(t, ctx)
+		defer func() { _ = transport.Delete() }()
+
+		template, id := extractableTemplate(t)
+		key, err := ctx.GenerateSecretKeyWithAttributes(template, 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		// Clone onto the same token; the clone shares the ID and label of the source
+		require.NoError(t, CloneKey(ctx, ctx, id, transportLabel, nil))
+
+		keys, err := ctx.FindKeys(id, nil)
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		for _, k := range keys {
+			if k.handle != key.handle {
+				defer func(k *SecretKey) { _ = k.Delete() }(k)
+			}
+		}
+	})
+}
+
+func TestCloneKeyPair(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_AES_KEY_WRAP_PAD)
+
+		transport, transportLabel := generateTransportKey(t, ctx)
+		defer func() { _ = transport.Delete() }()
+
+		private, id := extractableTemplate(t)
+		public, err := NewAttributeSetWithIDAndLabel(id, private[CkaLabel].Value)
+		require.NoError(t, err)
+
+		key, err := ctx.GenerateECDSAKeyPairWithAttributes(public, private, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		// Clone through a second Context on the same token, so that the clone is found by the destination
+		dst, err := ConfigureFromFile("config")
+		require.NoError(t, err)
+		defer func() { require.NoError(t, dst.Close()) }()
+
+		require.NoError(t, CloneKey(ctx, dst, id, transportLabel, nil))
+
+		// Once the source key pair is gone, FindKeyPair on the destination returns the clone with its public half
+		require.NoError(t, key.Delete())
+		clone, err := dst.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		require.NotNil(t, clone)
+		defer func() { _ = clone.Delete() }()
+		require.Equal(t, key.Public(), clone.Public())
+		require.NotZero(t, clone.(*pkcs11PrivateKeyECDSA).pubKeyHandle)
+	})
+}
+
+func TestCloneKeyErrors(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		err := CloneKey(ctx, ctx, randomBytes(), randomBytes(), nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "source token")
+
+		transport, transportLabel := generateTransportKey(t, ctx)
+		defer func() { _ = transport.Delete() }()
+
+		template, id := extractableTemplate(t)
+		key, err := ctx.GenerateSecretKeyWithAttributes(template, 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		// An AES transport key cannot be used with DES3 wrapping
+		err = CloneKey(ctx, ctx, id, transportLabel, &CloneKeyOptions{
+			WrapMechanisms: []uint{pkcs11.CKM_DES3_CBC_PAD},
+		})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "no wrapping mechanism")
+	})
+}
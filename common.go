@@ -24,11 +24,11 @@ package crypto11
 import (
 	"C"
 	"encoding/asn1"
+	"errors"
 	"math/big"
 	"unsafe"
 
 	"github.com/miekg/pkcs11"
-	"github.com/pkg/errors"
 )
 
 func ulongToBytes(n uint) []byte {
@@ -88,13 +88,25 @@ func (sig *dsaSignature) unmarshalBytes(sigBytes []byte) error {
 // Populate a dsaSignature from DER encoding
 func (sig *dsaSignature) unmarshalDER(sigDER []byte) error {
 	if rest, err := asn1.Unmarshal(sigDER, sig); err != nil {
-		return errors.WithMessage(err, "DSA signature contains invalid ASN.1 data")
+		return withMessage(err, "DSA signature contains invalid ASN.1 data")
 	} else if len(rest) > 0 {
 		return errors.New("unexpected data found after DSA signature")
 	}
 	return nil
 }
 
+// Return the raw encoding of a dsaSignature, with R and S each padded to size bytes
+func (sig *dsaSignature) marshalBytes(size int) ([]byte, error) {
+	r, s := sig.R.Bytes(), sig.S.Bytes()
+	if sig.R.Sign() < 0 || sig.S.Sign() < 0 || len(r) > size || len(s) > size {
+		return nil, errors.New("DSA signature is too large for key")
+	}
+	sigBytes := make([]byte, 2*size)
+	copy(sigBytes[size-len(r):size], r)
+	copy(sigBytes[2*size-len(s):], s)
+	return sigBytes, nil
+}
+
 // Return the DER encoding of a dsaSignature
 func (sig *dsaSignature) marshalDER() ([]byte, error) {
 	return asn1.Marshal(*sig)
@@ -104,22 +116,46 @@ func (sig *dsaSignature) marshalDER() ([]byte, error) {
 func (c *Context) dsaGeneric(key pkcs11.ObjectHandle, mechanism uint, digest []byte) ([]byte, error) {
 	var err error
 	var sigBytes []byte
-	var sig dsaSignature
-	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}
 	err = c.withSession(func(session *pkcs11Session) error {
-		if err = c.ctx.SignInit(session.handle, mech, key); err != nil {
-			return err
-		}
-		sigBytes, err = c.ctx.Sign(session.handle, digest)
+		sigBytes, err = dsaSignBytes(session, key, mechanism, digest)
 		return err
 	})
 	if err != nil {
 		return nil, err
 	}
-	err = sig.unmarshalBytes(sigBytes)
+	return dsaSignatureDER(sigBytes)
+}
+
+// dsaSign is dsaGeneric for a key pair, which is re-resolved first if it is stale. See Config.RepinKeysAfterResume.
+func (k *pkcs11PrivateKey) dsaSign(mechanism uint, digest []byte) ([]byte, error) {
+	var err error
+	var sigBytes []byte
+	err = k.withSession(func(session *pkcs11Session) error {
+		if sigBytes, err = dsaSignBytes(session, k.handle, mechanism, digest); err != nil {
+			return err
+		}
+		return k.checkSignatureLength(sigBytes)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return dsaSignatureDER(sigBytes)
+}
 
+// dsaSignBytes computes a *DSA signature in session, in the raw form returned by the token.
+func dsaSignBytes(session *pkcs11Session, key pkcs11.ObjectHandle, mechanism uint, digest []byte) ([]byte, error) {
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}
+	if err := session.signInit(mech, key); err != nil {
+		return nil, err
+	}
+	return session.sign(mechanism, digest)
+}
+
+// dsaSignatureDER converts a *DSA signature from the raw form returned by the token to DER form.
+func dsaSignatureDER(sigBytes []byte) ([]byte, error) {
+	var sig dsaSignature
+	if err := sig.unmarshalBytes(sigBytes); err != nil {
+		return nil, err
+	}
 	return sig.marshalDER()
 }
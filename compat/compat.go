@@ -0,0 +1,513 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package compat provides the package-level API of crypto11 v1 on top of crypto11.Context, so that programs
+// written against v1 can be migrated a call site at a time.
+//
+// Configure or ConfigureFromFile opens a default Context, which the functions without a slot argument use. The
+// ...OnSlot functions open, on first use, a further Context for the given slot with the same library, PIN and
+// settings. Code that has moved to the instance-based API can share the default Context via DefaultContext, or
+// register its own with SetDefaultContext.
+//
+// Behaviour differs from v1 in the following ways:
+//
+//   - Configure and ConfigureFromFile return a nil *pkcs11.Ctx. Callers that used the raw PKCS#11 handle must
+//     migrate to crypto11.Context.
+//   - FindKeyPair and FindKey return ErrKeyNotFound, as v1 did, where crypto11.Context returns a nil key and a nil
+//     error.
+//   - At least one of id and label must be non-nil. A nil id or label is ignored; an empty, non-nil one only
+//     matches keys whose attribute is present and empty.
+//   - Errors from the token wrap pkcs11.Error, so use errors.As rather than a type assertion to examine them.
+//   - PKCS11Config.IdleTimeout is ignored, as crypto11.Context does not close idle sessions.
+//
+// Deprecated: this package exists to ease migration and will not gain new features. Use crypto11.Context.
+package compat
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+)
+
+// ErrNotConfigured is returned by functions that need the default Context if Configure has not been called.
+var ErrNotConfigured = errors.New("crypto11 compat: PKCS#11 not yet configured")
+
+// ErrKeyNotFound is returned by FindKeyPair, FindKey and their ...OnSlot variants if there is no matching key.
+var ErrKeyNotFound = errors.New("crypto11 compat: could not find PKCS#11 key")
+
+// ErrTokenNotFound is returned by Configure if the requested token cannot be found.
+var ErrTokenNotFound = crypto11.ErrTokenNotFound
+
+// PKCS11Config holds the v1 configuration. Supply it to Configure, or use ConfigureFromFile.
+//
+// Deprecated: use crypto11.Config.
+type PKCS11Config struct {
+	// Full path to PKCS#11 library.
+	Path string
+
+	// Token serial number.
+	TokenSerial string
+
+	// Token label.
+	TokenLabel string
+
+	// User PIN (password).
+	Pin string
+
+	// Maximum number of concurrent sessions to open.
+	MaxSessions int
+
+	// IdleTimeout is ignored.
+	IdleTimeout time.Duration
+
+	// Maximum time to wait for a session from the sessions pool. Zero means wait indefinitely.
+	PoolWaitTimeout time.Duration
+}
+
+// SymmetricCipher is crypto11.SymmetricCipher.
+type SymmetricCipher = crypto11.SymmetricCipher
+
+// The symmetric ciphers supported by v1.
+var (
+	CipherAES        = crypto11.CipherAES
+	CipherDES3       = crypto11.CipherDES3
+	CipherHMACSHA1   = crypto11.CipherHMACSHA1
+	CipherHMACSHA224 = crypto11.CipherHMACSHA224
+	CipherHMACSHA256 = crypto11.CipherHMACSHA256
+	CipherHMACSHA384 = crypto11.CipherHMACSHA384
+	CipherHMACSHA512 = crypto11.CipherHMACSHA512
+)
+
+// PKCS11PrivateKeyRSA is an RSA key pair on the token.
+//
+// Deprecated: use crypto11.SignerDecrypter.
+type PKCS11PrivateKeyRSA struct {
+	crypto11.SignerDecrypter
+}
+
+// PKCS11PrivateKeyECDSA is an ECDSA key pair on the token.
+//
+// Deprecated: use crypto11.Signer.
+type PKCS11PrivateKeyECDSA struct {
+	crypto11.Signer
+}
+
+// PKCS11PrivateKeyDSA is a DSA key pair on the token.
+//
+// Deprecated: use crypto11.Signer.
+type PKCS11PrivateKeyDSA struct {
+	crypto11.Signer
+}
+
+// PKCS11SecretKey is a symmetric key on the token.
+//
+// Deprecated: use crypto11.SecretKey.
+type PKCS11SecretKey struct {
+	*crypto11.SecretKey
+}
+
+// state holds the Contexts used by the package-level functions.
+var state struct {
+	sync.Mutex
+
+	// config is used to open Contexts for other slots. It is nil if the default Context was registered with
+	// SetDefaultContext without a configuration.
+	config *crypto11.Config
+
+	defaultContext *crypto11.Context
+	slots          map[uint]*crypto11.Context
+}
+
+// Configure opens the default Context from a v1 configuration, closing any Contexts opened previously. The returned
+// *pkcs11.Ctx is always nil.
+//
+// Deprecated: use crypto11.Configure.
+func Configure(config *PKCS11Config) (*pkcs11.Ctx, error) {
+	if config == nil {
+		return nil, errors.New("config cannot be nil")
+	}
+
+	return nil, configure(&crypto11.Config{
+		Path:            config.Path,
+		TokenSerial:     config.TokenSerial,
+		TokenLabel:      config.TokenLabel,
+		Pin:             config.Pin,
+		MaxSessions:     config.MaxSessions,
+		PoolWaitTimeout: config.PoolWaitTimeout,
+	})
+}
+
+// ConfigureFromFile opens the default Context from a JSON configuration file, closing any Contexts opened
+// previously. The file may contain any crypto11.Config field, so v1 files can be read unchanged. The returned
+// *pkcs11.Ctx is always nil.
+//
+// Deprecated: use crypto11.ConfigureFromFile.
+func ConfigureFromFile(configLocation string) (*pkcs11.Ctx, error) {
+	file, err := os.Open(configLocation)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config file: %s: %w", configLocation, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	config := &crypto11.Config{}
+	if err = json.NewDecoder(file).Decode(config); err != nil {
+		return nil, fmt.Errorf("could not decode config file: %w", err)
+	}
+
+	return nil, configure(config)
+}
+
+func configure(config *crypto11.Config) error {
+	ctx, err := crypto11.Configure(config)
+	if err != nil {
+		return err
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	closeErr := closeAll()
+	state.config = config
+	state.defaultContext = ctx
+	return closeErr
+}
+
+// SetDefaultContext registers ctx as the default Context, closing any Contexts opened previously. config is used
+// to open Contexts for the ...OnSlot functions, which fail if it is nil. The Context is closed by Close.
+func SetDefaultContext(ctx *crypto11.Context, config *crypto11.Config) error {
+	if ctx == nil {
+		return errors.New("context cannot be nil")
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	err := closeAll()
+	state.config = config
+	state.defaultContext = ctx
+	return err
+}
+
+// DefaultContext returns the default Context, so that code moving to the instance-based API can share it.
+func DefaultContext() (*crypto11.Context, error) {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.defaultContext == nil {
+		return nil, ErrNotConfigured
+	}
+	return state.defaultContext, nil
+}
+
+// Close closes every Context held by the package, including one registered with SetDefaultContext.
+//
+// Deprecated: use crypto11.Context.Close.
+func Close() error {
+	state.Lock()
+	defer state.Unlock()
+
+	return closeAll()
+}
+
+// closeAll closes the Contexts held by the package and forgets them, returning the first error. state must be
+// locked.
+func closeAll() error {
+	var err error
+	if state.defaultContext != nil {
+		err = state.defaultContext.Close()
+	}
+	for _, ctx := range state.slots {
+		if closeErr := ctx.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	state.config = nil
+	state.defaultContext = nil
+	state.slots = nil
+	return err
+}
+
+// slotContext returns the Context for slot, opening it if necessary.
+func slotContext(slot uint) (*crypto11.Context, error) {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.defaultContext == nil {
+		return nil, ErrNotConfigured
+	}
+	if ctx, ok := state.slots[slot]; ok {
+		return ctx, nil
+	}
+	if state.config == nil {
+		return nil, errors.New("no configuration registered for opening other slots")
+	}
+
+	config := *state.config
+	slotNumber := int(slot)
+	config.TokenSerial = ""
+	config.TokenLabel = ""
+	config.SlotNumber = &slotNumber
+
+	ctx, err := crypto11.Configure(&config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open slot %d: %w", slot, err)
+	}
+
+	if state.slots == nil {
+		state.slots = map[uint]*crypto11.Context{}
+	}
+	state.slots[slot] = ctx
+	return ctx, nil
+}
+
+// GenerateRSAKeyPair creates an RSA key pair on the default token, with the same random value for CKA_ID and
+// CKA_LABEL.
+//
+// Deprecated: use crypto11.Context.GenerateRSAKeyPairWithLabel.
+func GenerateRSAKeyPair(bits int) (*PKCS11PrivateKeyRSA, error) {
+	ctx, err := DefaultContext()
+	if err != nil {
+		return nil, err
+	}
+	id, err := ctx.GenerateID()
+	if err != nil {
+		return nil, err
+	}
+	return generateRSAKeyPair(ctx, id, id, bits)
+}
+
+// GenerateRSAKeyPairOnSlot creates an RSA key pair on the token in the given slot.
+//
+// Deprecated: use crypto11.Context.GenerateRSAKeyPairWithLabel.
+func GenerateRSAKeyPairOnSlot(slot uint, id []byte, label []byte, bits int) (*PKCS11PrivateKeyRSA, error) {
+	ctx, err := slotContext(slot)
+	if err != nil {
+		return nil, err
+	}
+	return generateRSAKeyPair(ctx, id, label, bits)
+}
+
+func generateRSAKeyPair(ctx *crypto11.Context, id, label []byte, bits int) (*PKCS11PrivateKeyRSA, error) {
+	key, err := ctx.GenerateRSAKeyPairWithLabel(id, label, bits)
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11PrivateKeyRSA{key}, nil
+}
+
+// GenerateECDSAKeyPair creates an ECDSA key pair on the default token, with the same random value for CKA_ID and
+// CKA_LABEL.
+//
+// Deprecated: use crypto11.Context.GenerateECDSAKeyPairWithLabel.
+func GenerateECDSAKeyPair(c elliptic.Curve) (*PKCS11PrivateKeyECDSA, error) {
+	ctx, err := DefaultContext()
+	if err != nil {
+		return nil, err
+	}
+	id, err := ctx.GenerateID()
+	if err != nil {
+		return nil, err
+	}
+	return generateECDSAKeyPair(ctx, id, id, c)
+}
+
+// GenerateECDSAKeyPairOnSlot creates an ECDSA key pair on the token in the given slot.
+//
+// Deprecated: use crypto11.Context.GenerateECDSAKeyPairWithLabel.
+func GenerateECDSAKeyPairOnSlot(slot uint, id []byte, label []byte, c elliptic.Curve) (*PKCS11PrivateKeyECDSA, error) {
+	ctx, err := slotContext(slot)
+	if err != nil {
+		return nil, err
+	}
+	return generateECDSAKeyPair(ctx, id, label, c)
+}
+
+func generateECDSAKeyPair(ctx *crypto11.Context, id, label []byte, c elliptic.Curve) (*PKCS11PrivateKeyECDSA, error) {
+	key, err := ctx.GenerateECDSAKeyPairWithLabel(id, label, c)
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11PrivateKeyECDSA{key}, nil
+}
+
+// GenerateDSAKeyPair creates a DSA key pair on the default token, with the same random value for CKA_ID and
+// CKA_LABEL.
+//
+// Deprecated: use crypto11.Context.GenerateDSAKeyPairWithLabel.
+func GenerateDSAKeyPair(params *dsa.Parameters) (*PKCS11PrivateKeyDSA, error) {
+	ctx, err := DefaultContext()
+	if err != nil {
+		return nil, err
+	}
+	id, err := ctx.GenerateID()
+	if err != nil {
+		return nil, err
+	}
+	return generateDSAKeyPair(ctx, id, id, params)
+}
+
+// GenerateDSAKeyPairOnSlot creates a DSA key pair on the token in the given slot.
+//
+// Deprecated: use crypto11.Context.GenerateDSAKeyPairWithLabel.
+func GenerateDSAKeyPairOnSlot(slot uint, id []byte, label []byte, params *dsa.Parameters) (*PKCS11PrivateKeyDSA, error) {
+	ctx, err := slotContext(slot)
+	if err != nil {
+		return nil, err
+	}
+	return generateDSAKeyPair(ctx, id, label, params)
+}
+
+func generateDSAKeyPair(ctx *crypto11.Context, id, label []byte, params *dsa.Parameters) (*PKCS11PrivateKeyDSA, error) {
+	key, err := ctx.GenerateDSAKeyPairWithLabel(id, label, params)
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11PrivateKeyDSA{key}, nil
+}
+
+// FindKeyPair retrieves a key pair from the default token. The result is a *PKCS11PrivateKeyRSA,
+// *PKCS11PrivateKeyECDSA or *PKCS11PrivateKeyDSA. ErrKeyNotFound is returned if there is no matching key pair.
+//
+// Deprecated: use crypto11.Context.FindKeyPair.
+func FindKeyPair(id []byte, label []byte) (crypto.PrivateKey, error) {
+	ctx, err := DefaultContext()
+	if err != nil {
+		return nil, err
+	}
+	return findKeyPair(ctx, id, label)
+}
+
+// FindKeyPairOnSlot retrieves a key pair from the token in the given slot, as FindKeyPair does.
+//
+// Deprecated: use crypto11.Context.FindKeyPair.
+func FindKeyPairOnSlot(slot uint, id []byte, label []byte) (crypto.PrivateKey, error) {
+	ctx, err := slotContext(slot)
+	if err != nil {
+		return nil, err
+	}
+	return findKeyPair(ctx, id, label)
+}
+
+func findKeyPair(ctx *crypto11.Context, id, label []byte) (crypto.PrivateKey, error) {
+	key, err := ctx.FindKeyPair(id, label)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		if decrypter, ok := key.(crypto11.SignerDecrypter); ok {
+			return &PKCS11PrivateKeyRSA{decrypter}, nil
+		}
+	case *ecdsa.PublicKey:
+		return &PKCS11PrivateKeyECDSA{key}, nil
+	case *dsa.PublicKey:
+		return &PKCS11PrivateKeyDSA{key}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", key.Public())
+}
+
+// GenerateSecretKey creates a symmetric key on the default token, with the same random value for CKA_ID and
+// CKA_LABEL.
+//
+// Deprecated: use crypto11.Context.GenerateSecretKeyWithLabel.
+func GenerateSecretKey(bits int, cipher *SymmetricCipher) (*PKCS11SecretKey, error) {
+	ctx, err := DefaultContext()
+	if err != nil {
+		return nil, err
+	}
+	id, err := ctx.GenerateID()
+	if err != nil {
+		return nil, err
+	}
+	return generateSecretKey(ctx, id, id, bits, cipher)
+}
+
+// GenerateSecretKeyOnSlot creates a symmetric key on the token in the given slot.
+//
+// Deprecated: use crypto11.Context.GenerateSecretKeyWithLabel.
+func GenerateSecretKeyOnSlot(slot uint, id []byte, label []byte, bits int,
+	cipher *SymmetricCipher) (*PKCS11SecretKey, error) {
+
+	ctx, err := slotContext(slot)
+	if err != nil {
+		return nil, err
+	}
+	return generateSecretKey(ctx, id, label, bits, cipher)
+}
+
+func generateSecretKey(ctx *crypto11.Context, id, label []byte, bits int,
+	cipher *SymmetricCipher) (*PKCS11SecretKey, error) {
+
+	key, err := ctx.GenerateSecretKeyWithLabel(id, label, bits, cipher)
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11SecretKey{key}, nil
+}
+
+// FindKey retrieves a symmetric key from the default token. ErrKeyNotFound is returned if there is no matching key.
+//
+// Deprecated: use crypto11.Context.FindKey.
+func FindKey(id []byte, label []byte) (*PKCS11SecretKey, error) {
+	ctx, err := DefaultContext()
+	if err != nil {
+		return nil, err
+	}
+	return findKey(ctx, id, label)
+}
+
+// FindKeyOnSlot retrieves a symmetric key from the token in the given slot, as FindKey does.
+//
+// Deprecated: use crypto11.Context.FindKey.
+func FindKeyOnSlot(slot uint, id []byte, label []byte) (*PKCS11SecretKey, error) {
+	ctx, err := slotContext(slot)
+	if err != nil {
+		return nil, err
+	}
+	return findKey(ctx, id, label)
+}
+
+func findKey(ctx *crypto11.Context, id, label []byte) (*PKCS11SecretKey, error) {
+	key, err := ctx.FindKey(id, label)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrKeyNotFound
+	}
+	return &PKCS11SecretKey{key}, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package compat
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The v1 signatures are preserved, so existing call sites compile against this package unchanged.
+var (
+	_ func(*PKCS11Config) (*pkcs11.Ctx, error)                                    = Configure
+	_ func(uint, []byte, []byte, int) (*PKCS11PrivateKeyRSA, error)               = GenerateRSAKeyPairOnSlot
+	_ func(uint, []byte, []byte, elliptic.Curve) (*PKCS11PrivateKeyECDSA, error)  = GenerateECDSAKeyPairOnSlot
+	_ func(uint, []byte, []byte) (crypto.PrivateKey, error)                       = FindKeyPairOnSlot
+	_ func(uint, []byte, []byte, int, *SymmetricCipher) (*PKCS11SecretKey, error) = GenerateSecretKeyOnSlot
+	_ func(uint, []byte, []byte) (*PKCS11SecretKey, error)                        = FindKeyOnSlot
+	_ crypto.Decrypter                                                            = &PKCS11PrivateKeyRSA{}
+	_ crypto.Signer                                                               = &PKCS11PrivateKeyECDSA{}
+)
+
+func TestNotConfigured(t *testing.T) {
+	require.NoError(t, Close())
+
+	_, err := FindKeyPair(nil, []byte("label"))
+	assert.Equal(t, ErrNotConfigured, err)
+
+	_, err = GenerateSecretKeyOnSlot(0, []byte("id"), nil, 128, CipherAES)
+	assert.Equal(t, ErrNotConfigured, err)
+
+	_, err = DefaultContext()
+	assert.Equal(t, ErrNotConfigured, err)
+}
+
+// TestV1Usage exercises the shim the way a v1 program uses the package.
+func TestV1Usage(t *testing.T) {
+	_, err := ConfigureFromFile("../config")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, Close()) }()
+
+	key, err := GenerateRSAKeyPair(2048)
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	// v1 programs recover the key by label and type-assert the result
+	ctx, err := DefaultContext()
+	require.NoError(t, err)
+	label, err := ctx.GetAttribute(key.SignerDecrypter, crypto11.CkaLabel)
+	require.NoError(t, err)
+	found, err := FindKeyPair(nil, label.Value)
+	require.NoError(t, err)
+	rsaKey, ok := found.(*PKCS11PrivateKeyRSA)
+	require.True(t, ok)
+
+	digest := sha256.Sum256([]byte("v1"))
+	sig, err := rsaKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	assert.NoError(t, rsa.VerifyPKCS1v15(rsaKey.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+	_, err = FindKeyPair(nil, []byte("no such key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	secret, err := GenerateSecretKey(128, CipherAES)
+	require.NoError(t, err)
+	defer func() { _ = secret.Delete() }()
+	assert.Equal(t, CipherAES.BlockSize, secret.BlockSize())
+
+	_, err = FindKey(nil, []byte("no such key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
@@ -0,0 +1,194 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ConfigFieldError describes a Config field with an invalid value in JSON.
+type ConfigFieldError struct {
+	// Field is the name of the Config field.
+	Field string
+
+	// Value is the offending JSON value.
+	Value string
+
+	// Example is an example of a valid value.
+	Example string
+}
+
+func (e *ConfigFieldError) Error() string {
+	return fmt.Sprintf("config field %s: invalid value %s, expected a value such as %s", e.Field, e.Value, e.Example)
+}
+
+// UnmarshalJSON decodes a Config from JSON. Numeric and duration fields can be given either natively or as strings,
+// so "MaxSessions": "1024" is the same as "MaxSessions": 1024, and "PoolWaitTimeout": "10s" is the same as
+// "PoolWaitTimeout": 10000000000. An invalid value is reported as a *ConfigFieldError.
+func (config *Config) UnmarshalJSON(data []byte) error {
+	type plainConfig Config
+	raw := struct {
+		*plainConfig
+
+		SlotNumber           json.RawMessage
+		MaxSessions          json.RawMessage
+		UserType             json.RawMessage
+		PoolWaitTimeout      json.RawMessage
+		GCMIVLength          json.RawMessage
+		SaturationSmoothing  json.RawMessage
+		SaturationThreshold  json.RawMessage
+		FindObjectsBatchSize json.RawMessage
+		MaxSingleCallSize    json.RawMessage
+		GeneratedIDLength    json.RawMessage
+	}{plainConfig: (*plainConfig)(config)}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	if isJSONNull(raw.SlotNumber) {
+		config.SlotNumber = nil
+	} else if raw.SlotNumber != nil {
+		slot, err := unmarshalConfigInt("SlotNumber", raw.SlotNumber)
+		if err != nil {
+			return err
+		}
+		config.SlotNumber = &slot
+	}
+
+	for _, field := range []struct {
+		name  string
+		value json.RawMessage
+		dst   *int
+	}{
+		{"MaxSessions", raw.MaxSessions, &config.MaxSessions},
+		{"UserType", raw.UserType, &config.UserType},
+		{"GCMIVLength", raw.GCMIVLength, &config.GCMIVLength},
+		{"FindObjectsBatchSize", raw.FindObjectsBatchSize, &config.FindObjectsBatchSize},
+		{"MaxSingleCallSize", raw.MaxSingleCallSize, &config.MaxSingleCallSize},
+		{"GeneratedIDLength", raw.GeneratedIDLength, &config.GeneratedIDLength},
+	} {
+		if field.value == nil {
+			continue
+		}
+		n, err := unmarshalConfigInt(field.name, field.value)
+		if err != nil {
+			return err
+		}
+		*field.dst = n
+	}
+
+	for _, field := range []struct {
+		name  string
+		value json.RawMessage
+		dst   *float64
+	}{
+		{"SaturationSmoothing", raw.SaturationSmoothing, &config.SaturationSmoothing},
+		{"SaturationThreshold", raw.SaturationThreshold, &config.SaturationThreshold},
+	} {
+		if field.value == nil {
+			continue
+		}
+		f, err := unmarshalConfigFloat(field.name, field.value)
+		if err != nil {
+			return err
+		}
+		*field.dst = f
+	}
+
+	if raw.PoolWaitTimeout != nil {
+		d, err := unmarshalConfigDuration("PoolWaitTimeout", raw.PoolWaitTimeout)
+		if err != nil {
+			return err
+		}
+		config.PoolWaitTimeout = d
+	}
+
+	return nil
+}
+
+// isJSONNull returns true if value is the JSON null literal.
+func isJSONNull(value json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(value), []byte("null"))
+}
+
+// configScalar returns the text of a JSON number, or the contents of a JSON string. ok is false for any other kind of
+// value.
+func configScalar(value json.RawMessage) (text string, ok bool) {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s, true
+	}
+	var n json.Number
+	if err := json.Unmarshal(value, &n); err == nil {
+		return n.String(), true
+	}
+	return "", false
+}
+
+// unmarshalConfigInt decodes an integer given as a JSON number or string.
+func unmarshalConfigInt(field string, value json.RawMessage) (int, error) {
+	if isJSONNull(value) {
+		return 0, nil
+	}
+	if text, ok := configScalar(value); ok {
+		if n, err := strconv.Atoi(text); err == nil {
+			return n, nil
+		}
+	}
+	return 0, &ConfigFieldError{Field: field, Value: string(value), Example: `1024 or "1024"`}
+}
+
+// unmarshalConfigFloat decodes a number given as a JSON number or string.
+func unmarshalConfigFloat(field string, value json.RawMessage) (float64, error) {
+	if isJSONNull(value) {
+		return 0, nil
+	}
+	if text, ok := configScalar(value); ok {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, nil
+		}
+	}
+	return 0, &ConfigFieldError{Field: field, Value: string(value), Example: `0.5 or "0.5"`}
+}
+
+// unmarshalConfigDuration decodes a duration given as a JSON number of nanoseconds, as encoding/json produces for
+// time.Duration, or as a string accepted by time.ParseDuration. A string holding a plain integer is also taken as
+// nanoseconds.
+func unmarshalConfigDuration(field string, value json.RawMessage) (time.Duration, error) {
+	if isJSONNull(value) {
+		return 0, nil
+	}
+	if text, ok := configScalar(value); ok {
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return time.Duration(n), nil
+		}
+		if d, err := time.ParseDuration(text); err == nil {
+			return d, nil
+		}
+	}
+	return 0, &ConfigFieldError{Field: field, Value: string(value), Example: `"10s" or 10000000000 (nanoseconds)`}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigUnmarshalNativeAndStringForms(t *testing.T) {
+	for _, data := range []string{
+		`{"TokenLabel": "t", "SlotNumber": 3, "MaxSessions": 1024, "PoolWaitTimeout": 10000000000,
+		  "SaturationThreshold": 0.5, "FindObjectsBatchSize": 50, "MaxSingleCallSize": 4096,
+		  "GeneratedIDLength": 32}`,
+		`{"TokenLabel": "t", "SlotNumber": "3", "MaxSessions": "1024", "PoolWaitTimeout": "10s",
+		  "SaturationThreshold": "0.5", "FindObjectsBatchSize": "50", "MaxSingleCallSize": "4096",
+		  "GeneratedIDLength": "32"}`,
+	} {
+		var config Config
+		require.NoError(t, json.Unmarshal([]byte(data), &config), data)
+
+		assert.Equal(t, "t", config.TokenLabel)
+		require.NotNil(t, config.SlotNumber)
+		assert.Equal(t, 3, *config.SlotNumber)
+		assert.Equal(t, 1024, config.MaxSessions)
+		assert.Equal(t, 10*time.Second, config.PoolWaitTimeout)
+		assert.Equal(t, 0.5, config.SaturationThreshold)
+		assert.Equal(t, 50, config.FindObjectsBatchSize)
+		assert.Equal(t, 4096, config.MaxSingleCallSize)
+		assert.Equal(t, 32, config.GeneratedIDLength)
+	}
+}
+
+func TestConfigUnmarshalRoundTrip(t *testing.T) {
+	slot := 2
+	config := Config{
+		Path:                "/lib/p11.so",
+		SlotNumber:          &slot,
+		Pin:                 "1234",
+		MaxSessions:         16,
+		PoolWaitTimeout:     1500 * time.Millisecond,
+		MechanismProfiles:   []MechanismProfile{{Name: "p", Mechanism: 0x8000, Operation: MechanismSign}},
+		SaturationSmoothing: 0.25,
+	}
+	data, err := json.Marshal(&config)
+	require.NoError(t, err)
+
+	var decoded Config
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, config, decoded)
+
+	require.NoError(t, json.Unmarshal([]byte(`{"SlotNumber": null}`), &decoded))
+	assert.Nil(t, decoded.SlotNumber)
+}
+
+func TestConfigUnmarshalInvalidValues(t *testing.T) {
+	for field, value := range map[string]string{
+		"MaxSessions":         `"lots"`,
+		"SlotNumber":          `1.5`,
+		"PoolWaitTimeout":     `"ten seconds"`,
+		"SaturationThreshold": `true`,
+		"UserType":            `{}`,
+	} {
+		var config Config
+		err := json.Unmarshal([]byte(`{"`+field+`": `+value+`}`), &config)
+
+		var fieldErr *ConfigFieldError
+		require.True(t, errors.As(err, &fieldErr), "%s: %v", field, err)
+		assert.Equal(t, field, fieldErr.Field)
+		assert.Equal(t, value, fieldErr.Value)
+		assert.NotEmpty(t, fieldErr.Example)
+		assert.Contains(t, err.Error(), field)
+		assert.Contains(t, err.Error(), value)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	slot := 1
+	valid := Config{TokenLabel: "t", Pin: "1234"}
+	assert.NoError(t, valid.Validate())
+	assert.Equal(t, Config{TokenLabel: "t", Pin: "1234"}, valid, "Validate must not apply defaults")
+
+	for name, config := range map[string]Config{
+		"no token":          {},
+		"two tokens":        {TokenLabel: "t", SlotNumber: &slot},
+		"vendor profile":    {TokenLabel: "t", VendorProfile: "no such vendor"},
+		"public only":       {TokenLabel: "t", PublicOnly: true, Pin: "1234"},
+		"smoothing":         {TokenLabel: "t", SaturationSmoothing: 1},
+		"one session":       {TokenLabel: "t", MaxSessions: 1},
+		"negative batch":    {TokenLabel: "t", FindObjectsBatchSize: -1},
+		"mechanism profile": {TokenLabel: "t", MechanismProfiles: []MechanismProfile{{}}},
+		"session setup":     {TokenLabel: "t", SessionSetupReplacesLogin: true},
+	} {
+		assert.Error(t, config.Validate(), name)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// counterApplication is the CKA_APPLICATION value of data objects holding counters.
+const counterApplication = "crypto11 counter"
+
+// counterMutex serialises counter updates within this process.
+var counterMutex sync.Mutex
+
+// Counter is a monotonically increasing sequence number stored on the token in a CKO_DATA object.
+//
+// Increments made through Counters in the same process (including through different Contexts) are serialised.
+// PKCS#11 has no primitive for locking an object against other processes, so two processes incrementing the
+// same counter at the same time may both obtain the same value. Applications sharing a counter between processes
+// must coordinate access themselves.
+type Counter struct {
+	context *Context
+	label   []byte
+}
+
+// Counter returns the counter stored in the data object with the given label. If there is no such object, one is
+// created with a value of zero.
+func (c *Context) Counter(label []byte) (*Counter, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
+	if len(label) == 0 {
+		return nil, errors.New("counter label must be specified")
+	}
+
+	counterMutex.Lock()
+	defer counterMutex.Unlock()
+
+	err := c.withSession(func(session *pkcs11Session) error {
+		handle, err := findCounter(session, label)
+		if err != nil || handle != nil {
+			return err
+		}
+
+		_, err = session.ctx.CreateObject(session.handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_MODIFIABLE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, counterApplication),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, make([]byte, 8)),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, withMessage(err, "failed to find or create counter")
+	}
+
+	return &Counter{context: c, label: label}, nil
+}
+
+// Next increments the counter and returns its new value.
+//
+// The new value is written to the token before it is returned. If the process fails after the write, the value is
+// lost rather than reused: the sequence may have gaps, but values obtained within one process (through any number of
+// Contexts) are unique. Uniqueness does not hold across processes; see Counter.
+func (ctr *Counter) Next() (next uint64, err error) {
+	if ctr.context.closed.Get() {
+		return 0, errClosed
+	}
+
+	counterMutex.Lock()
+	defer counterMutex.Unlock()
+
+	err = ctr.context.withSession(func(session *pkcs11Session) error {
+		handle, err := findCounter(session, ctr.label)
+		if err != nil {
+			return err
+		}
+		if handle == nil {
+			return ctr.context.notFoundError("counter %q not found", ctr.label)
+		}
+
+		attributes, err := session.ctx.GetAttributeValue(session.handle, *handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err != nil {
+			return err
+		}
+
+		value := attributes[0].Value
+		if len(value) != 8 {
+			return fmt.Errorf("counter %q has invalid length %d", ctr.label, len(value))
+		}
+
+		current := binary.BigEndian.Uint64(value)
+		if current == math.MaxUint64 {
+			return fmt.Errorf("counter %q is exhausted", ctr.label)
+		}
+		next = current + 1
+
+		binary.BigEndian.PutUint64(value, next)
+		return session.ctx.SetAttributeValue(session.handle, *handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, value),
+		})
+	})
+	if err != nil {
+		return 0, withMessage(err, "failed to increment counter")
+	}
+
+	return next, nil
+}
+
+// findCounter returns the data object holding the counter with the given label, or nil if it does not exist.
+func findCounter(session *pkcs11Session, label []byte) (*pkcs11.ObjectHandle, error) {
+	handles, err := findKeysWithAttributes(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, counterApplication),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(handles) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &handles[0], nil
+	default:
+		return nil, fmt.Errorf("found %d counters with label %q", len(handles), label)
+	}
+}
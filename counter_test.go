@@ -0,0 +1,121 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func deleteCounter(t *testing.T, ctx *Context, label []byte) {
+	err := ctx.withSession(func(session *pkcs11Session) error {
+		handle, err := findCounter(session, label)
+		if err != nil || handle == nil {
+			return err
+		}
+		return session.ctx.DestroyObject(session.handle, *handle)
+	})
+	require.NoError(t, err)
+}
+
+func TestCounter(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		label := randomBytes()
+		defer deleteCounter(t, ctx, label)
+
+		counter, err := ctx.Counter(label)
+		require.NoError(t, err)
+
+		for i := uint64(1); i <= 3; i++ {
+			next, err := counter.Next()
+			require.NoError(t, err)
+			require.Equal(t, i, next)
+		}
+
+		// A second handle on the same counter continues the sequence
+		again, err := ctx.Counter(label)
+		require.NoError(t, err)
+		next, err := again.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), next)
+	})
+}
+
+func TestCounterConcurrent(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		label := randomBytes()
+		defer deleteCounter(t, ctx, label)
+
+		counter, err := ctx.Counter(label)
+		require.NoError(t, err)
+
+		const goroutines, increments = 4, 10
+		values := make(chan uint64, goroutines*increments)
+
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < increments; i++ {
+					next, err := counter.Next()
+					require.NoError(t, err)
+					values <- next
+				}
+			}()
+		}
+		wg.Wait()
+		close(values)
+
+		seen := map[uint64]bool{}
+		for v := range values {
+			require.False(t, seen[v], "duplicate counter value %d", v)
+			seen[v] = true
+		}
+		require.Len(t, seen, goroutines*increments)
+	})
+}
+
+func TestCounterInvalidValue(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		label := randomBytes()
+		defer deleteCounter(t, ctx, label)
+
+		counter, err := ctx.Counter(label)
+		require.NoError(t, err)
+
+		err = ctx.withSession(func(session *pkcs11Session) error {
+			handle, err := findCounter(session, label)
+			require.NoError(t, err)
+			return session.ctx.SetAttributeValue(session.handle, *handle, []*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte{1}),
+			})
+		})
+		require.NoError(t, err)
+
+		_, err = counter.Next()
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build go1.15
+// +build go1.15
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/x509"
+	"errors"
+)
+
+// SignCRL creates a CRL from template, issued by issuer and signed with key, and returns its DER encoding, as
+// x509.CreateRevocationList. If template.SignatureAlgorithm is zero, the algorithm is chosen as by
+// X509SignatureAlgorithm; otherwise it is checked against the key pair and token. template is not modified.
+//
+// crypto/x509 does not encode DSA signatures, so DSA keys cannot sign CRLs.
+func (c *Context) SignCRL(template *x509.RevocationList, issuer *x509.Certificate, key crypto.Signer) ([]byte,
+	error) {
+
+	if template == nil || issuer == nil {
+		return nil, errors.New("template and issuer must be non-nil")
+	}
+	if _, ok := key.Public().(*dsa.PublicKey); ok {
+		return nil, errors.New("crypto/x509 cannot sign CRLs with DSA keys")
+	}
+
+	scheme, err := c.x509SignatureScheme(key, template.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	crl := *template
+	crl.SignatureAlgorithm = scheme.algorithm
+	der, err := x509.CreateRevocationList(c.randReader(), &crl, issuer, key)
+	return der, withMessage(err, "signing CRL")
+}
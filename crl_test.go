@@ -0,0 +1,114 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build go1.21
+// +build go1.21
+
+package crypto11
+
+import (
+	"crypto/dsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignCRL(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		rsaKey, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = rsaKey.Delete() }()
+
+		ecKey, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P384())
+		require.NoError(t, err)
+		defer func() { _ = ecKey.Delete() }()
+
+		now := time.Now().UTC().Truncate(time.Second)
+		template := &x509.RevocationList{
+			Number:     big.NewInt(7),
+			ThisUpdate: now,
+			NextUpdate: now.Add(time.Hour),
+			RevokedCertificateEntries: []x509.RevocationListEntry{
+				{SerialNumber: big.NewInt(42), RevocationTime: now.Add(-time.Minute)},
+			},
+		}
+
+		for name, test := range map[string]struct {
+			key      Signer
+			expected x509.SignatureAlgorithm
+		}{
+			"RSA":   {rsaKey, x509.SHA256WithRSA},
+			"ECDSA": {ecKey, x509.ECDSAWithSHA384},
+		} {
+			t.Run(name, func(t *testing.T) {
+				issuer := selfSignedCertificate(t, test.key, test.expected)
+
+				der, err := ctx.SignCRL(template, issuer, test.key)
+				require.NoError(t, err)
+				assert.Equal(t, x509.UnknownSignatureAlgorithm, template.SignatureAlgorithm)
+
+				crl, err := x509.ParseRevocationList(der)
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, crl.SignatureAlgorithm)
+				require.NoError(t, crl.CheckSignatureFrom(issuer))
+				require.Len(t, crl.RevokedCertificateEntries, 1)
+				assert.Equal(t, int64(42), crl.RevokedCertificateEntries[0].SerialNumber.Int64())
+				assert.Equal(t, int64(7), crl.Number.Int64())
+			})
+		}
+
+		t.Run("RequestedAlgorithm", func(t *testing.T) {
+			issuer := selfSignedCertificate(t, ecKey, x509.ECDSAWithSHA384)
+			requested := *template
+			requested.SignatureAlgorithm = x509.ECDSAWithSHA256
+
+			der, err := ctx.SignCRL(&requested, issuer, ecKey)
+			require.NoError(t, err)
+			crl, err := x509.ParseRevocationList(der)
+			require.NoError(t, err)
+			assert.Equal(t, x509.ECDSAWithSHA256, crl.SignatureAlgorithm)
+			require.NoError(t, crl.CheckSignatureFrom(issuer))
+
+			requested.SignatureAlgorithm = x509.SHA256WithRSA
+			_, err = ctx.SignCRL(&requested, issuer, ecKey)
+			assert.True(t, errors.Is(err, errNoSignatureAlgorithm), "%v", err)
+		})
+	})
+}
+
+func TestSignCRLRejectsDSA(t *testing.T) {
+	skipTest(t, skipTestDSA)
+
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateDSAKeyPair(randomBytes(), dsaSizes[dsa.L2048N256])
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		_, err = ctx.SignCRL(&x509.RevocationList{Number: big.NewInt(1)}, &x509.Certificate{}, key)
+		assert.Error(t, err)
+	})
+}
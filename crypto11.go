@@ -67,18 +67,23 @@
 // Behaviour of the pool can be tweaked via Config fields:
 //
 // - PoolWaitTimeout controls how long an operation can block waiting on a
-// session from the pool. A zero value means there is no limit. Timeouts
-// occur if the pool is fully used and additional operations are requested.
+// session from the pool. A zero value means there is no limit, and a negative
+// value (see PoolNoWait) means operations fail immediately if no session is free.
+// ErrPoolExhausted is returned if the pool is fully used and additional
+// operations are requested.
 //
 // - MaxSessions sets an upper bound on the number of sessions. If this value is zero,
 // a default maximum is used (see DefaultMaxSessions). In every case the maximum
 // supported sessions as reported by the token is obeyed.
 //
-// Limitations
+// The sessions can be partitioned between workloads with WithPool, which
+// sets aside some of them in a named SessionPool. Keys found through a
+// SessionPool only use its sessions.
 //
-// The PKCS1v15DecryptOptions SessionKeyLen field is not implemented
-// and an error is returned if it is nonzero.
-// The reason for this is that it is not possible for crypto11 to guarantee the constant-time behavior in the specification.
+// # Limitations
+//
+// The PKCS1v15DecryptOptions SessionKeyLen field is supported, but crypto11 cannot guarantee the constant-time
+// behavior in the specification, since the token decides how long it takes to reject bad padding.
 // See https://github.com/thalesignite/crypto11/issues/5 for further discussion.
 //
 // Symmetric crypto support via cipher.Block is very slow.
@@ -89,7 +94,10 @@ package crypto11
 
 import (
 	"crypto"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"os"
@@ -98,7 +106,6 @@ import (
 	"time"
 
 	"github.com/miekg/pkcs11"
-	"github.com/pkg/errors"
 	"github.com/thales-e-security/pool"
 )
 
@@ -110,13 +117,17 @@ const (
 	// DefaultGCMIVLength controls the expected length of IVs generated by the token
 	DefaultGCMIVLength = 16
 
+	// DefaultFindObjectsBatchSize is the maximum number of handles requested by each call to C_FindObjects, unless
+	// otherwise specified in the Config object.
+	DefaultFindObjectsBatchSize = 20
+
 	// Thales vendor constant for CKU_CRYPTO_USER
 	CryptoUser      = 0x80000001
 	DefaultUserType = 1 // 1 -> CKU_USER
 )
 
-// errTokenNotFound represents the failure to find the requested PKCS#11 token
-var errTokenNotFound = errors.New("could not find PKCS#11 token")
+// ErrTokenNotFound is returned by Configure if the requested PKCS#11 token cannot be found.
+var ErrTokenNotFound = errors.New("could not find PKCS#11 token")
 
 // errClosed is returned if a Context is used after a call to Close.
 var errClosed = errors.New("cannot used closed Context")
@@ -129,12 +140,19 @@ type pkcs11Object struct {
 	// The PKCS#11 context. This is used  to find a session handle that can
 	// access this object.
 	context *Context
+
+	// archived is set if the key is known to be archived, see Archive.
+	archived pool.AtomicBool
+
+	// sessionPool is the pool whose sessions are used for operations on the object, see SessionPool. It is nil if
+	// the Context's own pool is used.
+	sessionPool *SessionPool
 }
 
 func (o *pkcs11Object) Delete() error {
-	return o.context.withSession(func(session *pkcs11Session) error {
+	return o.withSession(func(session *pkcs11Session) error {
 		err := session.ctx.DestroyObject(session.handle, o.handle)
-		return errors.WithMessage(err, "failed to destroy key")
+		return withMessage(err, "failed to destroy key")
 	})
 }
 
@@ -146,20 +164,51 @@ type pkcs11PrivateKey struct {
 	pubKeyHandle pkcs11.ObjectHandle
 
 	// pubKey is an exported copy of the public key. We pre-export the key material because crypto.Signer.Public
-	// doesn't allow us to return errors.
+	// doesn't allow us to return errors. It is nil if the public key was released, see Config.ReleasePublicKeys.
 	pubKey crypto.PublicKey
+
+	// pubKeyExport re-reads the public key from pubKeyHandle. It is only set if the public key was released.
+	pubKeyExport exportPublicKeyFunc
+
+	// signatureLength is the length of the key pair's signatures, see checkSignatureLength. It is recorded when the
+	// key pair is loaded, so that it is known even if the public key is released. It is nil for other key types.
+	signatureLength *signatureLength
+
+	// retained is 1 while pubKey is counted in Context.PublicKeyStats, see keepPublicKey. Accessed with sync/atomic.
+	retained int32
+
+	// mechanismProfile replaces the mechanism of one operation, see FindKeyPairWithMechanismProfile.
+	mechanismProfile *mechanismProfile
+
+	// pin records the identity of the key pair, so that it can be re-resolved after Resume. It is nil unless
+	// Config.RepinKeysAfterResume is set.
+	pin *keyPin
+
+	// usage restricts the operations of a key pair made by GenerateRSAKeyPairWithOptions. It is nil for other key
+	// pairs.
+	usage *keyPairUsage
 }
 
 // Delete implements Signer.Delete.
 func (k *pkcs11PrivateKey) Delete() error {
-	err := k.pkcs11Object.Delete()
+	err := k.withSession(func(session *pkcs11Session) error {
+		err := session.ctx.DestroyObject(session.handle, k.handle)
+		return withMessage(err, "failed to destroy key")
+	})
 	if err != nil {
 		return err
 	}
+	k.stopCountingPublicKey()
+
+	_, pubHandle := k.objectHandles()
+	if pubHandle == 0 {
+		// The key pair was loaded without a public key object (CK_INVALID_HANDLE), so there is nothing more to delete.
+		return nil
+	}
 
-	return k.context.withSession(func(session *pkcs11Session) error {
-		err := session.ctx.DestroyObject(session.handle, k.pubKeyHandle)
-		return errors.WithMessage(err, "failed to destroy public key")
+	return k.pkcs11Object.withSession(func(session *pkcs11Session) error {
+		err := session.ctx.DestroyObject(session.handle, pubHandle)
+		return withMessage(err, "failed to destroy public key")
 	})
 }
 
@@ -169,6 +218,11 @@ func (k *pkcs11PrivateKey) Delete() error {
 // All functions, except Close, are safe to call from multiple goroutines.
 type Context struct {
 	// Atomic fields must be at top (according to the package owners)
+
+	// handleEpoch is incremented by Resume, marking the handles of loaded key pairs stale. See
+	// Config.RepinKeysAfterResume.
+	handleEpoch uint64
+
 	closed pool.AtomicBool
 
 	ctx *pkcs11.Ctx
@@ -181,6 +235,70 @@ type Context struct {
 	// persistentSession is a session held open so we can be confident handles and login status
 	// persist for the duration of this context
 	persistentSession pkcs11.SessionHandle
+
+	// events delivers session lifecycle events to Config.SessionEventFunc. It is nil if no function was configured.
+	events *sessionEvents
+
+	// warnings delivers key warnings to Config.KeyWarningFunc. It is nil if no function was configured.
+	warnings *keyWarnings
+
+	// timings collects PKCS#11 call durations. It is nil unless Config.CollectCallTimings is set.
+	timings *callTimings
+
+	// errorCounters counts the errors returned by operations, by class. See ErrorCounters.
+	errorCounters *errorCounters
+
+	// profile describes vendor-specific behaviour of the token, see Config.VendorProfile.
+	profile vendorProfile
+
+	// publicKeys tracks public keys retained by loaded key pairs.
+	publicKeys *publicKeyAccounting
+
+	// cleanup tracks checked out sessions and leaked session objects, if Config.DebugStrictCleanup is set.
+	cleanup *cleanupTracker
+
+	// suspension tracks checked out sessions and the suspended state, see Suspend.
+	suspension suspension
+
+	// saturation tracks the proportion of pool sessions in use, see Saturation.
+	saturation *saturation
+
+	// sessionPools holds the pools made by WithPool, whose sessions are taken from pool.
+	sessionPools sessionPools
+
+	// mechanismProfiles holds the validated Config.MechanismProfiles, by name.
+	mechanismProfiles map[string]*mechanismProfile
+
+	// pss records whether PSS signatures are encoded in software, see Config.SoftwarePSSEncoding.
+	pss pssSupport
+
+	// locking is the locking the library was initialized with, see Config.Locking.
+	locking LockingMode
+
+	// callSize records the probed maximum single-call size, see Config.ProbeMaxSingleCallSize.
+	callSize callSizeLimit
+
+	// fieldKeyMutex serializes the generation of field keys, see SealField.
+	fieldKeyMutex sync.Mutex
+
+	// mechanismFlags caches the CKF_ flags the token reports for each mechanism, see tokenSupports.
+	mechanismFlags sync.Map
+
+	// effective records the configuration decisions made by Configure, see EffectiveConfig.
+	effective EffectiveConfig
+
+	// sessionLogin logs in the sessions opened by the pool, for tokens that do not share login state between
+	// sessions.
+	sessionLogin sessionLogin
+
+	// pinLock guards cfg.Pin, which ChangePIN replaces while sessions may be logging in.
+	pinLock sync.RWMutex
+
+	// findObjectsLimit is copied to the sessions opened by the pool, see pkcs11Session.findObjectsLimit.
+	findObjectsLimit int
+
+	// expvar records where the Context is published, if Config.PublishExpvar is set.
+	expvar *expvarEntry
 }
 
 // Signer is a PKCS#11 key that implements crypto.Signer.
@@ -199,6 +317,106 @@ type SignerDecrypter interface {
 	Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) (plaintext []byte, err error)
 }
 
+// MessageSigner is implemented by RSA and ECDSA key pairs, which can hash a message on the token as part of signing
+// it. It has the same method set as crypto.MessageSigner in Go 1.25 and later.
+type MessageSigner interface {
+	Signer
+
+	// SignMessage hashes message and signs the result on the token.
+	SignMessage(rand io.Reader, message []byte, opts crypto.SignerOpts) (signature []byte, err error)
+}
+
+// BatchSigner is implemented by RSA and ECDSA key pairs, which can sign many digests with a single session from the
+// pool.
+type BatchSigner interface {
+	Signer
+
+	// SignBatch signs each of digests as Sign does, returning the signatures in the same order.
+	SignBatch(digests [][]byte, opts crypto.SignerOpts) (signatures [][]byte, err error)
+}
+
+// DSASigner is implemented by DSA key pairs, which can describe their domain parameters.
+type DSASigner interface {
+	Signer
+
+	// ParameterFingerprint returns the DSAParameterFingerprint of the domain parameters of the key pair.
+	ParameterFingerprint() ([]byte, error)
+
+	// QBits returns the bit length of the subgroup order Q, which limits the digest length used by Sign.
+	QBits() int
+}
+
+// KeyAgreer is implemented by X25519 key pairs, which agree shared secrets with CKM_ECDH1_DERIVE. They are returned
+// by FindKeyPair like other key pairs, but their Sign method always fails.
+type KeyAgreer interface {
+	Signer
+
+	// Derive returns the shared secret agreed with the peer public key.
+	Derive(peerPublicKey []byte) ([]byte, error)
+
+	// DeriveKey leaves the shared secret agreed with the peer public key on the token, as a secret key object.
+	DeriveKey(peerPublicKey []byte, template AttributeSet, cipher *SymmetricCipher) (*SecretKey, error)
+}
+
+// PurposeReporter is implemented by RSA, ECDSA and DSA key pairs, which can report the usage attributes of their
+// private key.
+type PurposeReporter interface {
+	Signer
+
+	// Purpose returns the purposes the private key permits.
+	Purpose() (KeyPurpose, error)
+}
+
+// OperationReporter is implemented by RSA, ECDSA and DSA key pairs, which can report the operations they support.
+type OperationReporter interface {
+	Signer
+
+	// SupportedOperations reports which signing, decryption, key agreement and unwrapping operations the key pair can
+	// perform.
+	SupportedOperations() (*KeyOperations, error)
+}
+
+// StreamingSigner is implemented by RSA and ECDSA key pairs, which can sign a message too large to hold in memory,
+// hashing it on the token as it is written.
+type StreamingSigner interface {
+	MessageSigner
+
+	// NewStreamSigner starts signing a message that will be written to the returned StreamSigner.
+	NewStreamSigner(opts crypto.SignerOpts) (*StreamSigner, error)
+}
+
+// Encrypter is implemented by RSA key pairs and by PublicKey, which encrypt on the token with the public key object.
+// opts takes the same values as for SignerDecrypter.Decrypt.
+type Encrypter interface {
+	// Public returns the public key, which may be nil for a PublicKey whose value the token does not allow to be
+	// read.
+	Public() crypto.PublicKey
+
+	// Encrypt encrypts plaintext with the public key.
+	Encrypt(plaintext []byte, opts crypto.DecrypterOpts) (ciphertext []byte, err error)
+}
+
+// RSAVerifier is implemented by RSA key pairs, which verify signatures on the token with the public key object.
+// Invalid signatures are reported with errors wrapping ErrSignatureInvalid.
+type RSAVerifier interface {
+	Signer
+
+	// VerifyPKCS1v15 checks a PKCS#1 v1.5 signature over digest.
+	VerifyPKCS1v15(hash crypto.Hash, digest, signature []byte) error
+
+	// VerifyPSS checks an RSA-PSS signature over digest.
+	VerifyPSS(hash crypto.Hash, digest, signature []byte, opts *rsa.PSSOptions) error
+}
+
+// ECDSAVerifier is implemented by ECDSA key pairs, which verify signatures on the token with the public key object.
+// Invalid signatures are reported with errors wrapping ErrSignatureInvalid.
+type ECDSAVerifier interface {
+	Signer
+
+	// VerifyECDSA checks a DER-encoded ECDSA signature over digest.
+	VerifyECDSA(digest, signature []byte) error
+}
+
 // findToken finds a token given exactly one of serial, label or slotNumber
 func (c *Context) findToken(slots []uint, serial, label string, slotNumber *int) (uint, *pkcs11.TokenInfo, error) {
 	for _, slot := range slots {
@@ -216,7 +434,7 @@ func (c *Context) findToken(slots []uint, serial, label string, slotNumber *int)
 		}
 
 	}
-	return 0, nil, errTokenNotFound
+	return 0, nil, ErrTokenNotFound
 }
 
 // Config holds PKCS#11 configuration information.
@@ -238,7 +456,7 @@ type Config struct {
 	// SlotNumber identifies a token to use by the slot containing it.
 	SlotNumber *int
 
-	// User PIN (password).
+	// User PIN (password). ChangePIN and RotatePINAcrossContexts replace it once the token accepts a new PIN.
 	Pin string
 
 	// Maximum number of concurrent sessions to open. If zero, DefaultMaxSessions is used.
@@ -248,12 +466,22 @@ type Config struct {
 	// User type identifies the user type logging in. If zero, DefaultUserType is used.
 	UserType int
 
-	// Maximum time to wait for a session from the sessions pool. Zero means wait indefinitely.
+	// Maximum time to wait for a session from the sessions pool. Zero means wait indefinitely. A negative value,
+	// such as PoolNoWait, means fail immediately with ErrPoolExhausted if no session is free.
 	PoolWaitTimeout time.Duration
 
 	// LoginNotSupported should be set to true for tokens that do not support logging in.
 	LoginNotSupported bool
 
+	// PublicOnly configures a Context that never logs in, for services that only use public objects. Pin must be
+	// empty. Certificates and public keys without CKA_PRIVATE can be found, and public keys used for verification and
+	// encryption with FindPublicKey. Operations on private or secret keys fail with ErrLoginRequired.
+	PublicOnly bool
+
+	// AllowEmptyPin permits logging in with an empty Pin. Without it, an empty Pin is an error for tokens that
+	// report CKF_LOGIN_REQUIRED, and login is skipped for any other token.
+	AllowEmptyPin bool
+
 	// UseGCMIVFromHSM should be set to true for tokens such as CloudHSM, which ignore the supplied IV for
 	// GCM mode and generate their own. In this case, the token will write the IV used into the CK_GCM_PARAMS.
 	// If UseGCMIVFromHSM is true, we will copy this IV and overwrite the 'nonce' slice passed to Seal and Open. It
@@ -265,6 +493,189 @@ type Config struct {
 	GCMIVLength int
 
 	GCMIVFromHSMControl GCMIVFromHSMConfig
+
+	// SessionEventFunc, if non-nil, is called for session lifecycle events such as session creation, failure to
+	// create a session and login. The function is called from a separate goroutine and never blocks PKCS#11
+	// operations; if it cannot keep up, events are dropped and counted by Context.DroppedEvents.
+	SessionEventFunc SessionEventFunc `json:"-"`
+
+	// KeyWarningFunc, if non-nil, is called for the warnings listed under KeyWarningType, such as a key pair
+	// generated with weaker usage restrictions than a careful caller would want. Each warning identifies the
+	// affected key. The function is called as SessionEventFunc is.
+	KeyWarningFunc KeyWarningFunc `json:"-"`
+
+	// VendorProfile selects vendor-specific handling of the token. Leave empty for standard PKCS#11 behaviour, or set
+	// to VendorUtimaco for Utimaco tokens that use key groups. Key group authorization is performed by the normal
+	// login, so the group credential is supplied with Pin, and the vendor-defined user type of the group with
+	// UserType, which the profile passes to C_Login unchanged. When nothing matches, the Find functions then return
+	// an error wrapping ErrKeyNotFound that hints at key group authorization. VendorZeroizeDataObjects and
+	// VendorAssuredDestroy select how ShredObject erases objects.
+	VendorProfile string
+
+	// ForbidSoftwareFallback prevents crypto11 from performing any cryptographic computation on secret-dependent
+	// data outside the token. Operations that would do so return an error wrapping ErrSoftwareFallbackForbidden.
+	// Public-key operations, such as signature verification, are not affected.
+	ForbidSoftwareFallback bool
+
+	// CollectCallTimings enables collection of histograms of PKCS#11 call durations, which can be retrieved with
+	// Context.CallTimings.
+	CollectCallTimings bool
+
+	// ResetErrorCountersOnRead makes Context.ErrorCounters reset the counters it returns, so that each call reports
+	// the errors since the previous call. By default the counters are monotonic.
+	ResetErrorCountersOnRead bool
+
+	// PublishExpvar publishes the pool statistics, error counters, call timings and saturation of the Context with
+	// package expvar, as an entry of the expvar.Map called ExpvarName whose key is the serial number of the token.
+	// The values are computed when the variable is read, and reading it never resets the error counters. Close removes
+	// the entry.
+	PublishExpvar bool
+
+	// ExpvarName is the name of the expvar.Map used by PublishExpvar, DefaultExpvarName if empty. Configure fails if
+	// another kind of variable has the name.
+	ExpvarName string
+
+	// ReleasePublicKeys stops key pairs from keeping a copy of their public key once they have been loaded. Public
+	// then reads the public key from the token on every call, trading latency for memory, and returns nil if the
+	// token cannot be read. ECDSA signing also reads it, to check the digest length. Key pairs whose public key was
+	// not read from a public key object, but taken from a certificate or the private key or completed with an assumed
+	// exponent, always keep their copy. See also Context.PublicKeyStats.
+	ReleasePublicKeys bool
+
+	// RejectLongECDSADigests makes ECDSA signing fail with ErrECDSADigestTooLong when the digest is longer than the
+	// curve order, which usually means the hash does not suit the key. By default such digests are truncated, see
+	// the Sign method of ECDSA keys.
+	RejectLongECDSADigests bool
+
+	// SkipOutputLengthChecks turns off the checks made on the length of signatures, RSA and GCM ciphertexts and MACs
+	// returned by the token. By default, output whose length differs from the one the operation defines fails with a
+	// *MalformedTokenOutputError, so that a truncated result from a faulty module is reported where it happens. The
+	// checks only compare lengths, so their cost is negligible.
+	SkipOutputLengthChecks bool
+
+	// StrictRSAPublicExponent makes loading an RSA key pair fail if CKA_PUBLIC_EXPONENT can be read from neither its
+	// public key object nor its private key object. By default the key pair is loaded with the exponent assumed to be
+	// 65537, which almost every RSA key uses, and an RSAExponentAssumed warning is raised, see KeyWarningFunc. A wrong
+	// assumption makes the public key unusable in software, but does not affect operations performed on the token.
+	StrictRSAPublicExponent bool
+
+	// DisallowPKCS1v15Decryption makes the Decrypt method of RSA keys fail with a *PolicyError for PKCS#1 v1.5
+	// ciphertexts, which are exposed to Bleichenbacher's attack, while OAEP, raw decryption and PKCS#1 v1.5
+	// signatures keep working. KeyOperations.DecryptPKCS1v15 and Capabilities report the restriction. Use
+	// Context.WithPKCS1v15Decryption to override it for one key.
+	DisallowPKCS1v15Decryption bool
+
+	// SoftwarePSSEncoding lets RSA keys make PSS signatures on tokens that do not list CKM_RSA_PKCS_PSS in their
+	// mechanism list. The EMSA-PSS encoding, which depends only on the digest, a random salt and the modulus size,
+	// is computed in software and signed on the token with raw RSA (CKM_RSA_X_509), which the token must support.
+	SoftwarePSSEncoding bool
+
+	// MaxSingleCallSize is the largest input passed to one C_Encrypt, C_Decrypt, C_EncryptUpdate or C_DecryptUpdate
+	// call by symmetric operations, for tokens which reject larger inputs with CKR_DATA_LEN_RANGE. CBC inputs over
+	// the limit are passed to the token in pieces; GCM, which is single-part, fails with ErrInputTooLarge. SignMessage
+	// and StreamSigner also pass messages over the limit in pieces, with C_SignUpdate. Zero means no limit, unless
+	// ProbeMaxSingleCallSize is set.
+	MaxSingleCallSize int
+
+	// ProbeMaxSingleCallSize detects MaxSingleCallSize, if it is not set, by encrypting ever larger inputs with a
+	// session key before the first symmetric operation. See also Capabilities.
+	ProbeMaxSingleCallSize bool
+
+	// FailWhileSuspended makes operations attempted while the Context is suspended fail with ErrSuspended, instead of
+	// waiting for Resume. See Context.Suspend.
+	FailWhileSuspended bool
+
+	// RepinKeysAfterResume makes key pairs loaded before Context.Resume find their objects again when next used,
+	// in case the token was replaced while the Context was suspended. Each key pair is looked up by the CKA_ID and
+	// CKA_LABEL it had when loaded, and fails with ErrKeyMismatch unless exactly one such key pair is found and its
+	// public key has the same fingerprint. Secret keys are not re-resolved.
+	RepinKeysAfterResume bool
+
+	// SaturationSmoothing smooths the value returned by Context.Saturation with an exponential moving average,
+	// updated whenever a session is taken from or returned to the pool. It is the weight given to the previous
+	// value, from 0 (no smoothing) up to but excluding 1.
+	SaturationSmoothing float64
+
+	// SaturationThreshold is the saturation level at which OnSaturation is called, between 0 and 1.
+	SaturationThreshold float64
+
+	// OnSaturation, if non-nil, is called with the current level when Context.Saturation rises to or above
+	// SaturationThreshold, and again when it falls back below. It is called synchronously by the goroutine taking or
+	// returning the session, so it must be quick and must not use the Context.
+	OnSaturation SaturationFunc `json:"-"`
+
+	// FindObjectsBatchSize is the maximum number of handles requested by each call to C_FindObjects. If zero,
+	// DefaultFindObjectsBatchSize is used. Some tokens hold an internal lock for the duration of C_FindObjects, so a
+	// smaller batch shortens the stalls that large searches cause for concurrent operations.
+	FindObjectsBatchSize int
+
+	// ReleaseSessionDuringScans makes FindKeyPairsWithAttributes, FindAllKeyPairs and Inventory return their session
+	// to the pool after every FindObjectsBatchSize objects, rather than holding it for the whole scan. PKCS#11 scopes
+	// a search to the session that started it, so the search itself still completes on one session; only the
+	// subsequent per-object work, which takes most of the time, is split up. Key pairs destroyed part-way through a
+	// scan are skipped, and objects destroyed part-way through an Inventory are recorded with no readable attributes.
+	ReleaseSessionDuringScans bool
+
+	// MechanismProfiles defines named mechanisms, such as vendor-defined signing mechanisms, that key pairs can be
+	// made to use with Context.FindKeyPairWithMechanismProfile. Profiles are validated by Configure.
+	MechanismProfiles []MechanismProfile
+
+	// Rand, if non-nil, is the source of all randomness that crypto11 generates itself rather than obtaining from
+	// the token: generated CKA_ID values, padding for capability and clone probes, and the signing requests and serial
+	// numbers made by ProvisionIdentity. If nil, crypto/rand is used. Randomness used by the token itself, such as
+	// key generation, is unaffected.
+	Rand io.Reader `json:"-"`
+
+	// GeneratedIDLength is the length in bytes of the CKA_ID values crypto11 generates, see Context.GenerateID.
+	// Zero means 16 bytes. Values below 8 are rejected, since collisions would become likely on large tokens.
+	GeneratedIDLength int
+
+	// UseRandForTokenNonces makes crypto11 read Rand, rather than the token random number generator, for random
+	// values that are not key material, such as the IVs used to wrap keys in CloneKey. It has no effect if Rand is
+	// nil.
+	UseRandForTokenNonces bool
+
+	// UseTokenClock makes crypto11 use the token clock (see Context.TokenTime), rather than the host clock, as the
+	// current time for validity-sensitive operations: the validity period of bootstrap certificates created by
+	// ProvisionIdentity and the time recorded in an Inventory. The host clock is used if the token has no usable
+	// clock.
+	UseTokenClock bool
+
+	// InitArgs, if non-empty, is passed to C_Initialize in the pReserved field of CK_C_INITIALIZE_ARGS. Some
+	// libraries need it; NSS softoken (libsoftokn3), for example, takes its configuration from it:
+	//
+	//	configdir='sql:/etc/pki/nssdb' certPrefix='' keyPrefix='' secmod='secmod.db'
+	//
+	// As with a plain C_Initialize, only the first Context using a library initializes it. InitArgs is not
+	// supported on Windows.
+	InitArgs string
+
+	// Locking selects the locking requested when C_Initialize is called; by default the library is told to use
+	// operating system locking (CKF_OS_LOCKING_OK). Only the first Context using a library initializes it, and
+	// Configure fails with a *LockingConflictError if a later Config asks for different locking. Context.LibraryInfo
+	// reports the locking in use.
+	Locking LockingMode
+
+	// SessionSetup, if non-nil, is called for every session crypto11 opens, after C_OpenSession and the standard
+	// login, so that a vendor-specific authentication exchange can be completed before the session is used. It is
+	// called for the long-term session, for the sessions of the pool, including those opened to replace sessions
+	// that failed, and for the sessions opened by Resume. If it returns an error, the session is closed and the error
+	// is treated as a failed login: Configure or Resume fails if it was setting up the long-term session, and
+	// otherwise the operation that needed the new session fails. It may be called concurrently, and must not use the
+	// Context.
+	SessionSetup SessionSetupFunc `json:"-"`
+
+	// SessionSetupReplacesLogin makes SessionSetup log sessions in itself, instead of the standard C_Login with Pin,
+	// which is then never called. SessionSetup must be set.
+	SessionSetupReplacesLogin bool
+
+	// DebugStrictCleanup makes Close check that the Context released everything it acquired: every session taken
+	// from the pool was returned, and every session object crypto11 created for its own use was destroyed or
+	// preserved rather than reaped. Otherwise Close fails with a *CleanupError, after finishing the teardown. If
+	// sessions are still checked out, Close closes them rather than waiting for them, so Close must only be called
+	// once all operations have finished. This option is intended for test suites; it records a stack trace for every
+	// session checkout.
+	DebugStrictCleanup bool
 }
 
 type GCMIVFromHSMConfig struct {
@@ -281,8 +692,13 @@ type GCMIVFromHSMConfig struct {
 var refCount = map[string]int{}
 var refCountMutex = sync.Mutex{}
 
-// Configure creates a new Context based on the supplied PKCS#11 configuration.
-func Configure(config *Config) (*Context, error) {
+// Validate checks config for the errors Configure would report without accessing a PKCS#11 library, for
+// instance to check configuration files in CI. Validate does not modify config.
+func (config *Config) Validate() error {
+	if config == nil {
+		return errors.New("config is nil")
+	}
+
 	// Have we been given exactly one way to select a token?
 	var fields []string
 	if config.SlotNumber != nil {
@@ -295,30 +711,117 @@ func Configure(config *Config) (*Context, error) {
 		fields = append(fields, "token serial number")
 	}
 	if len(fields) == 0 {
-		return nil, fmt.Errorf("config must specify exactly one way to select a token: none given")
+		return fmt.Errorf("config must specify exactly one way to select a token: none given")
 	} else if len(fields) > 1 {
-		return nil, fmt.Errorf("config must specify exactly one way to select a token: %v given", strings.Join(fields, ", "))
+		return fmt.Errorf("config must specify exactly one way to select a token: %v given", strings.Join(fields, ", "))
 	}
 
-	if config.MaxSessions == 0 {
-		config.MaxSessions = DefaultMaxSessions
+	if _, err := lookupVendorProfile(config.VendorProfile); err != nil {
+		return err
 	}
+
+	if _, err := newMechanismProfiles(config.MechanismProfiles); err != nil {
+		return err
+	}
+
+	if config.PublicOnly && (config.Pin != "" || config.AllowEmptyPin) {
+		return errors.New("PublicOnly cannot be combined with Pin or AllowEmptyPin")
+	}
+
+	if config.SaturationSmoothing < 0 || config.SaturationSmoothing >= 1 {
+		return errors.New("SaturationSmoothing must be at least 0 and less than 1")
+	}
+	if config.SaturationThreshold < 0 || config.SaturationThreshold > 1 {
+		return errors.New("SaturationThreshold must be between 0 and 1")
+	}
+	if config.OnSaturation != nil && config.SaturationThreshold == 0 {
+		return errors.New("SaturationThreshold must be set when OnSaturation is used")
+	}
+
 	if config.MaxSessions == 1 {
-		return nil, errors.New("MaxSessions must be larger than 1")
+		return errors.New("MaxSessions must be larger than 1")
+	}
+
+	if config.Locking < LockingOS || config.Locking > LockingNone {
+		return fmt.Errorf("invalid Locking value %v", config.Locking)
+	}
+
+	if config.MaxSingleCallSize < 0 {
+		return errors.New("MaxSingleCallSize cannot be negative")
+	}
+	if config.FindObjectsBatchSize < 0 {
+		return errors.New("FindObjectsBatchSize cannot be negative")
+	}
+	if config.SessionSetupReplacesLogin && config.SessionSetup == nil {
+		return errors.New("SessionSetupReplacesLogin requires SessionSetup")
+	}
+	if config.GeneratedIDLength != 0 && config.GeneratedIDLength < minGeneratedIDLength {
+		return fmt.Errorf("GeneratedIDLength must be at least %d", minGeneratedIDLength)
+	}
+
+	return nil
+}
+
+// Configure creates a new Context based on the supplied PKCS#11 configuration.
+func Configure(config *Config) (*Context, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	profile, err := lookupVendorProfile(config.VendorProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	mechanismProfiles, err := newMechanismProfiles(config.MechanismProfiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var effective EffectiveConfig
+
+	if config.MaxSessions == 0 {
+		config.MaxSessions = DefaultMaxSessions
+		effective.Defaulted = append(effective.Defaulted, "MaxSessions")
 	}
 
 	if config.UserType == 0 {
 		config.UserType = DefaultUserType
+		effective.Defaulted = append(effective.Defaulted, "UserType")
 	}
 
 	if config.GCMIVLength == 0 {
 		config.GCMIVLength = DefaultGCMIVLength
+		effective.Defaulted = append(effective.Defaulted, "GCMIVLength")
 	}
 
+	if config.FindObjectsBatchSize == 0 {
+		config.FindObjectsBatchSize = DefaultFindObjectsBatchSize
+		effective.Defaulted = append(effective.Defaulted, "FindObjectsBatchSize")
+	}
+
+	var published *expvar.Map
+	if config.PublishExpvar {
+		if config.ExpvarName == "" {
+			config.ExpvarName = DefaultExpvarName
+			effective.Defaulted = append(effective.Defaulted, "ExpvarName")
+		}
+		if published, err = publishedExpvarMap(config.ExpvarName); err != nil {
+			return nil, err
+		}
+	}
+
+	effective.recordConfig(config)
+
 	instance := &Context{
-		cfg: config,
-		ctx: pkcs11.New(config.Path),
+		cfg:     config,
+		ctx:     pkcs11.New(config.Path),
+		profile: profile,
+
+		mechanismProfiles: mechanismProfiles,
+		effective:         effective,
 	}
+	instance.sessionLogin.login = instance.login
 
 	if instance.ctx == nil {
 		return nil, errors.New("could not open PKCS#11")
@@ -329,18 +832,24 @@ func Configure(config *Config) (*Context, error) {
 	defer refCountMutex.Unlock()
 	numExistingContexts := refCount[config.Path]
 
-	// Only Initialize if we are the first Context using the library
+	// Only Initialize if we are the first Context using the library, with whatever locking it asks for. Later
+	// Contexts must want the same locking.
 	if numExistingContexts == 0 {
-		if err := instance.ctx.Initialize(); err != nil {
+		if err := instance.initializeLibrary(); err != nil {
 			instance.ctx.Destroy()
-			return nil, errors.WithMessage(err, "failed to initialize PKCS#11 library")
+			return nil, withMessage(err, "failed to initialize PKCS#11 library")
 		}
+		instance.effective.LibraryInitialized = true
+	} else if negotiated := libraryLocking[config.Path]; negotiated != config.Locking {
+		instance.ctx.Destroy()
+		return nil, &LockingConflictError{Path: config.Path, Negotiated: negotiated, Requested: config.Locking}
 	}
+	instance.locking = config.Locking
 	slots, err := instance.ctx.GetSlotList(true)
 	if err != nil {
 		_ = instance.ctx.Finalize()
 		instance.ctx.Destroy()
-		return nil, errors.WithMessage(err, "failed to list PKCS#11 slots")
+		return nil, withMessage(err, "failed to list PKCS#11 slots")
 	}
 
 	instance.slot, instance.token, err = instance.findToken(slots, config.TokenSerial, config.TokenLabel, config.SlotNumber)
@@ -349,50 +858,150 @@ func Configure(config *Config) (*Context, error) {
 		instance.ctx.Destroy()
 		return nil, err
 	}
+	instance.effective.recordToken(config, instance.slot, instance.token)
 
-	// Create the session pool.
-	maxSessions := instance.cfg.MaxSessions
-	tokenMaxSessions := instance.token.MaxRwSessionCount
-	if tokenMaxSessions != pkcs11.CK_EFFECTIVELY_INFINITE && tokenMaxSessions != pkcs11.CK_UNAVAILABLE_INFORMATION {
-		maxSessions = min(maxSessions, castDown(tokenMaxSessions))
+	login, err := shouldLogin(config, instance.token)
+	if err != nil {
+		_ = instance.ctx.Finalize()
+		instance.ctx.Destroy()
+		return nil, err
+	}
+	instance.effective.recordLogin(config, login)
+
+	instance.timings = newCallTimings(config.CollectCallTimings)
+	instance.errorCounters = newErrorCounters(config)
+	instance.publicKeys = &publicKeyAccounting{}
+	instance.cleanup = newCleanupTracker(config.DebugStrictCleanup)
+	instance.saturation = newSaturation(config)
+	instance.events = newSessionEvents(config.SessionEventFunc)
+	if instance.events != nil {
+		instance.events.slot = instance.slot
+	}
+	instance.warnings = newKeyWarnings(config.KeyWarningFunc)
+	if instance.warnings != nil {
+		instance.warnings.slot = instance.slot
 	}
 
-	// We will use one session to keep state alive, so the pool gets maxSessions - 1
-	instance.pool = pool.NewResourcePool(instance.resourcePoolFactoryFunc, maxSessions-1, maxSessions-1, 0, 0)
+	instance.pool = instance.newSessionPool()
 
-	// Create a long-term session and log it in (if supported). This session won't be used by callers, instead it is
-	// used to keep a connection alive to the token to ensure object handles and the log in status remain accessible.
-	instance.persistentSession, err = instance.ctx.OpenSession(instance.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
-	if err != nil {
+	if err = instance.openPersistentSession(login); err != nil {
+		instance.events.close()
+		instance.warnings.close()
 		_ = instance.ctx.Finalize()
 		instance.ctx.Destroy()
-		return nil, errors.WithMessagef(err, "failed to create long term session")
+		return nil, err
+	}
+
+	// Increment the reference count
+	refCount[config.Path] = numExistingContexts + 1
+	libraryLocking[config.Path] = config.Locking
+
+	if published != nil {
+		instance.publishExpvar(published)
 	}
 
-	if !config.LoginNotSupported {
+	return instance, nil
+}
+
+// newSessionPool creates the session pool, sized according to the configuration and the token limits.
+func (c *Context) newSessionPool() *pool.ResourcePool {
+	maxSessions := c.cfg.MaxSessions
+	tokenMaxSessions := c.token.MaxRwSessionCount
+	if tokenMaxSessions != pkcs11.CK_EFFECTIVELY_INFINITE && tokenMaxSessions != pkcs11.CK_UNAVAILABLE_INFORMATION {
+		maxSessions = min(maxSessions, castDown(tokenMaxSessions))
+	}
+	c.effective.MaxSessions = maxSessions
+	c.effective.MaxSessionsLimitedByToken = maxSessions < c.cfg.MaxSessions
+	c.effective.SessionFlags = sessionFlagNames(sessionFlags)
+
+	// We will use one session to keep state alive, so the pool gets maxSessions - 1, less the sessions given to the
+	// pools made by WithPool. It keeps at least one session even if the token limit has since fallen.
+	c.saturation.setCapacity(maxSessions - 1)
+	capacity := maxSessions - 1 - c.sessionPools.reservedSessions()
+	if capacity < 1 {
+		capacity = 1
+	}
+	return pool.NewResourcePool(c.resourcePoolFactoryFunc, capacity, capacity, 0, 0)
+}
+
+// openPersistentSession creates a long-term session and logs it in (if login is true). This session won't be used by
+// callers, instead it is used to keep a connection alive to the token to ensure object handles and the log in status
+// remain accessible.
+func (c *Context) openPersistentSession(login bool) (err error) {
+	c.persistentSession, err = c.ctx.OpenSession(c.slot, sessionFlags)
+	if err != nil {
+		return withMessagef(err, "failed to create long term session")
+	}
+
+	c.sessionLogin.reset(login)
+	if login {
 		// Try to log in our persistent session. This may fail with CKR_USER_ALREADY_LOGGED_IN if another instance
 		// already exists.
-		if instance.cfg.UserType == 1 {
-			err = instance.ctx.Login(instance.persistentSession, pkcs11.CKU_USER, instance.cfg.Pin)
-		} else {
-			err = instance.ctx.Login(instance.persistentSession, CryptoUser, instance.cfg.Pin)
-		}
+		start := time.Now()
+		err = c.login(c.persistentSession)
+		c.events.raise(LoginPerformed, time.Since(start), err)
 		if err != nil {
 
 			pErr, isP11Error := err.(pkcs11.Error)
 
 			if !isP11Error || pErr != pkcs11.CKR_USER_ALREADY_LOGGED_IN {
-				_ = instance.ctx.Finalize()
-				instance.ctx.Destroy()
-				return nil, errors.WithMessagef(err, "failed to log into long term session")
+				return c.loginError(err)
 			}
 		}
 	}
 
-	// Increment the reference count
-	refCount[config.Path] = numExistingContexts + 1
+	return withMessage(c.setupSession(c.persistentSession), "failed to set up long term session")
+}
 
-	return instance, nil
+// shouldLogin decides whether Configure must log into the token, based on the configured PIN and whether the token
+// requires login. An error is returned if the token requires login but no PIN was given.
+func shouldLogin(config *Config, tokenInfo *pkcs11.TokenInfo) (bool, error) {
+	if config.LoginNotSupported || config.PublicOnly || config.SessionSetupReplacesLogin {
+		return false, nil
+	}
+
+	if config.Pin != "" || config.AllowEmptyPin {
+		return true, nil
+	}
+
+	if tokenInfo.Flags&pkcs11.CKF_LOGIN_REQUIRED != 0 {
+		return false, fmt.Errorf("token %q requires login but no PIN was configured: set Pin, "+
+			"or set AllowEmptyPin if the token uses an empty PIN, or set LoginNotSupported to skip login",
+			tokenInfo.Label)
+	}
+
+	return false, nil
+}
+
+// loginError adds context to a failed C_Login, identifying the token and reporting how close the user PIN is to
+// being locked. The token information is re-read, as tokens typically update the PIN flags after a failed attempt.
+func (c *Context) loginError(err error) error {
+	tokenInfo := *c.token
+	if latest, infoErr := c.ctx.GetTokenInfo(c.slot); infoErr == nil {
+		tokenInfo = latest
+	}
+
+	msg := fmt.Sprintf("failed to log into long term session (token label %q, serial %q)",
+		tokenInfo.Label, tokenInfo.SerialNumber)
+	if status := pinStatus(tokenInfo.Flags); status != "" {
+		msg += ": " + status
+	}
+	return withMessage(err, msg)
+}
+
+// pinStatus describes the user PIN retry state reported in the token flags, or returns an empty string if the
+// token reports nothing of interest.
+func pinStatus(flags uint) string {
+	switch {
+	case flags&pkcs11.CKF_USER_PIN_LOCKED != 0:
+		return "user PIN is locked"
+	case flags&pkcs11.CKF_USER_PIN_FINAL_TRY != 0:
+		return "one PIN attempt remains before the user PIN is locked"
+	case flags&pkcs11.CKF_USER_PIN_COUNT_LOW != 0:
+		return "an incorrect user PIN has been entered at least once since the last successful login"
+	default:
+		return ""
+	}
 }
 
 func min(a, b int) int {
@@ -432,7 +1041,7 @@ func ConfigureFromFile(configLocation string) (*Context, error) {
 func loadConfigFromFile(configLocation string) (*Config, error) {
 	file, err := os.Open(configLocation)
 	if err != nil {
-		return nil, errors.WithMessagef(err, "could not open config file: %s", configLocation)
+		return nil, withMessagef(err, "could not open config file: %s", configLocation)
 	}
 	defer func() {
 		closeErr := file.Close()
@@ -444,7 +1053,7 @@ func loadConfigFromFile(configLocation string) (*Config, error) {
 	configDecoder := json.NewDecoder(file)
 	config := &Config{}
 	err = configDecoder.Decode(config)
-	return config, errors.WithMessage(err, "could decode config file:")
+	return config, withMessage(err, "could decode config file:")
 }
 
 // Close releases resources used by the Context and unloads the PKCS #11 library if there are no other
@@ -456,14 +1065,32 @@ func (c *Context) Close() error {
 	defer refCountMutex.Unlock()
 
 	c.closed.Set(true)
+	c.unpublishExpvar()
 
-	// Block until all resources returned to pool
-	c.pool.Close()
+	// Release operations waiting for a suspended Context, they will find it closed
+	c.suspension.end()
+
+	// In strict mode, report sessions that were never returned rather than waiting for them forever. They are closed
+	// and the rest of the teardown goes ahead.
+	leaked := c.cleanup.outstandingSessions()
+	if len(leaked) > 0 {
+		for _, handle := range c.cleanup.abandon() {
+			_ = c.ctx.CloseSession(handle)
+		}
+	} else {
+		// Block until all resources returned to pool
+		c.pool.Close()
+		c.sessionPools.close()
+	}
 
 	// Close our long-term session. We ignore any returned error,
 	// since we plan to kill our collection to the library anyway.
 	_ = c.ctx.CloseSession(c.persistentSession)
 
+	// Deliver any outstanding session events and key warnings
+	c.events.close()
+	c.warnings.close()
+
 	count, found := refCount[c.cfg.Path]
 	if !found || count == 0 {
 		// We have somehow lost track of reference counts, this is very bad
@@ -474,6 +1101,7 @@ func (c *Context) Close() error {
 
 	// If we were the last Context, finalize the library
 	if count == 1 {
+		delete(libraryLocking, c.cfg.Path)
 		err := c.ctx.Finalize()
 		if err != nil {
 			return err
@@ -481,5 +1109,5 @@ func (c *Context) Close() error {
 	}
 
 	c.ctx.Destroy()
-	return nil
+	return c.cleanup.report(leaked)
 }
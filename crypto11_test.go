@@ -23,6 +23,7 @@ package crypto11
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -223,7 +224,7 @@ func TestSelectByNonExistingSlot(t *testing.T) {
 
 	// Look up slot number for label
 	_, err = Configure(config)
-	require.Equal(t, errTokenNotFound, err)
+	require.True(t, errors.Is(err, ErrTokenNotFound))
 }
 
 func TestAccessSameLibraryTwice(t *testing.T) {
@@ -297,3 +298,66 @@ func randomBytes() []byte {
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
+
+func TestPinStatus(t *testing.T) {
+	assert.Equal(t, "", pinStatus(pkcs11.CKF_LOGIN_REQUIRED|pkcs11.CKF_USER_PIN_INITIALIZED))
+	assert.Contains(t, pinStatus(pkcs11.CKF_USER_PIN_COUNT_LOW), "incorrect user PIN")
+	assert.Contains(t, pinStatus(pkcs11.CKF_USER_PIN_COUNT_LOW|pkcs11.CKF_USER_PIN_FINAL_TRY), "one PIN attempt remains")
+	assert.Contains(t, pinStatus(pkcs11.CKF_USER_PIN_FINAL_TRY|pkcs11.CKF_USER_PIN_LOCKED), "locked")
+}
+
+func TestBadPinFailsConfigure(t *testing.T) {
+	cfg, err := getConfig("config")
+	require.NoError(t, err)
+	cfg.Pin = cfg.Pin + "-wrong"
+
+	_, err = Configure(cfg)
+	require.Error(t, err)
+
+	assert.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)))
+	assert.Contains(t, err.Error(), "token label")
+}
+
+func TestShouldLogin(t *testing.T) {
+	loginRequired := &pkcs11.TokenInfo{Label: "token", Flags: pkcs11.CKF_LOGIN_REQUIRED}
+	loginOptional := &pkcs11.TokenInfo{Label: "token"}
+
+	tests := []struct {
+		config *Config
+		token  *pkcs11.TokenInfo
+		login  bool
+		err    bool
+	}{
+		{config: &Config{Pin: "password"}, token: loginRequired, login: true},
+		{config: &Config{Pin: "password"}, token: loginOptional, login: true},
+		{config: &Config{}, token: loginRequired, err: true},
+		{config: &Config{}, token: loginOptional, login: false},
+		{config: &Config{AllowEmptyPin: true}, token: loginRequired, login: true},
+		{config: &Config{AllowEmptyPin: true}, token: loginOptional, login: true},
+		{config: &Config{LoginNotSupported: true}, token: loginRequired, login: false},
+		{config: &Config{LoginNotSupported: true, Pin: "password"}, token: loginRequired, login: false},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			login, err := shouldLogin(test.config, test.token)
+			if test.err {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "set Pin")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.login, login)
+		})
+	}
+}
+
+func TestEmptyPinFailsConfigure(t *testing.T) {
+	cfg, err := getConfig("config")
+	require.NoError(t, err)
+	cfg.Pin = ""
+
+	// SoftHSM tokens require login
+	_, err = Configure(cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no PIN was configured")
+}
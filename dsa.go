@@ -22,21 +22,132 @@
 package crypto11
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/dsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"math/big"
 
-	"github.com/pkg/errors"
-
 	pkcs11 "github.com/miekg/pkcs11"
 )
 
+// errMalformedDSAPublicKey is returned when a DSA public key has inconsistent parameters.
+var errMalformedDSAPublicKey = errors.New("malformed DSA public key")
+
+// ErrDSADigestInvalid is returned by DSA signing when the digest cannot be signed with the key's subgroup order Q.
+var ErrDSADigestInvalid = errors.New("digest cannot be signed with the DSA key")
+
 // pkcs11PrivateKeyDSA contains a reference to a loaded PKCS#11 DSA private key object.
 type pkcs11PrivateKeyDSA struct {
 	pkcs11PrivateKey
 }
 
+// DSAParameterFingerprint returns the SHA-256 digest of the domain parameters P, Q and G. Each is encoded as its
+// minimal big-endian magnitude preceded by its length as a four-byte big-endian integer. Keys generated from the same
+// parameters have the same fingerprint, so it can be compared with a fingerprint published for a parameter set.
+func DSAParameterFingerprint(params *dsa.Parameters) ([]byte, error) {
+	if params == nil || params.P == nil || params.Q == nil || params.G == nil {
+		return nil, errMalformedDSAPublicKey
+	}
+	digester := sha256.New()
+	for _, n := range []*big.Int{params.P, params.Q, params.G} {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(n.Bytes())))
+		digester.Write(length[:])
+		digester.Write(n.Bytes())
+	}
+	return digester.Sum(nil), nil
+}
+
+// dsaPublicKey returns the public key of the key pair, or errMalformedDSAPublicKey if it cannot be read.
+func (signer *pkcs11PrivateKeyDSA) dsaPublicKey() (*dsa.PublicKey, error) {
+	pub, ok := signer.Public().(*dsa.PublicKey)
+	if !ok || pub.P == nil || pub.Q == nil || pub.G == nil {
+		return nil, errMalformedDSAPublicKey
+	}
+	return pub, nil
+}
+
+// ParameterFingerprint returns the DSAParameterFingerprint of the key pair's domain parameters.
+func (signer *pkcs11PrivateKeyDSA) ParameterFingerprint() ([]byte, error) {
+	pub, err := signer.dsaPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return DSAParameterFingerprint(&pub.Parameters)
+}
+
+// QBits returns the bit length N of the subgroup order Q, or zero if the public key cannot be read. Sign uses at
+// most the leftmost N bits of a digest.
+func (signer *pkcs11PrivateKeyDSA) QBits() int {
+	pub, err := signer.dsaPublicKey()
+	if err != nil {
+		return 0
+	}
+	return pub.Q.BitLen()
+}
+
+// truncateDSADigest returns the leftmost qBits bits of digest, as FIPS 186-4 s4.6 requires: a digest from a hash
+// with an output longer than N is truncated to N bits, and a shorter one is used as is. Truncation to a whole number
+// of bytes is only consistent with verification if N is a multiple of 8, so other keys reject long digests.
+func truncateDSADigest(qBits int, digest []byte) ([]byte, error) {
+	if len(digest) == 0 {
+		return nil, withMessage(ErrDSADigestInvalid, "digest is empty")
+	}
+	if len(digest)*8 <= qBits {
+		return digest, nil
+	}
+	if qBits%8 != 0 {
+		return nil, withMessagef(ErrDSADigestInvalid, "cannot truncate %d-byte digest for %d-bit subgroup order",
+			len(digest), qBits)
+	}
+	return digest[:qBits/8], nil
+}
+
+// FindDSAKeysByParameters retrieves all DSA key pairs with the domain parameters params, or a nil slice if there
+// are none, for instance to rotate every key using a parameter set that is being retired. Key pairs are compared by
+// DSAParameterFingerprint, since tokens differ in how they match big integers in search templates. Archived key
+// pairs are not returned.
+func (c *Context) FindDSAKeysByParameters(params *dsa.Parameters) ([]Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	want, err := DSAParameterFingerprint(params)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := NewAttributeSet()
+	if err = attributes.Set(CkaKeyType, pkcs11.CKK_DSA); err != nil {
+		return nil, err
+	}
+	candidates, err := c.FindKeyPairsWithAttributes(attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Signer
+	for _, candidate := range candidates {
+		key, ok := candidate.(*pkcs11PrivateKeyDSA)
+		if !ok {
+			continue
+		}
+		fingerprint, err := key.ParameterFingerprint()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(fingerprint, want) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
 // Export the public key corresponding to a private DSA key.
 func exportDSAPublicKey(session *pkcs11Session, pubHandle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
 	template := []*pkcs11.Attribute{
@@ -49,11 +160,26 @@ func exportDSAPublicKey(session *pkcs11Session, pubHandle pkcs11.ObjectHandle) (
 	if err != nil {
 		return nil, err
 	}
+	pub, err := parseDSAPublicKey(exported[0].Value, exported[1].Value, exported[2].Value, exported[3].Value)
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// parseDSAPublicKey converts CKA_PRIME, CKA_SUBPRIME, CKA_BASE and CKA_VALUE values into a public key.
+func parseDSAPublicKey(prime, subprime, base, value []byte) (*dsa.PublicKey, error) {
 	var p, q, g, y big.Int
-	p.SetBytes(exported[0].Value)
-	q.SetBytes(exported[1].Value)
-	g.SetBytes(exported[2].Value)
-	y.SetBytes(exported[3].Value)
+	p.SetBytes(prime)
+	q.SetBytes(subprime)
+	g.SetBytes(base)
+	y.SetBytes(value)
+	one := big.NewInt(1)
+	// q must be smaller than p, and g and y must be elements of the group mod p, other than 0 and 1
+	if q.Cmp(one) <= 0 || q.Cmp(&p) >= 0 || g.Cmp(one) <= 0 || g.Cmp(&p) >= 0 || y.Cmp(one) <= 0 ||
+		y.Cmp(&p) >= 0 {
+		return nil, errMalformedDSAPublicKey
+	}
 	result := dsa.PublicKey{
 		Parameters: dsa.Parameters{
 			P: &p,
@@ -67,7 +193,7 @@ func exportDSAPublicKey(session *pkcs11Session, pubHandle pkcs11.ObjectHandle) (
 
 func notNilBytes(obj []byte, name string) error {
 	if obj == nil {
-		return errors.Errorf("%s cannot be nil", name)
+		return fmt.Errorf("%s cannot be nil", name)
 	}
 	return nil
 }
@@ -114,6 +240,10 @@ func (c *Context) GenerateDSAKeyPairWithAttributes(public, private AttributeSet,
 		return nil, errClosed
 	}
 
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
 	var k Signer
 	err := c.withSession(func(session *pkcs11Session) error {
 		p := params.P.Bytes()
@@ -148,15 +278,17 @@ func (c *Context) GenerateDSAKeyPairWithAttributes(public, private AttributeSet,
 		if err != nil {
 			return err
 		}
-		k = &pkcs11PrivateKeyDSA{
+		key := &pkcs11PrivateKeyDSA{
 			pkcs11PrivateKey: pkcs11PrivateKey{
 				pkcs11Object: pkcs11Object{
 					handle:  privHandle,
 					context: c,
 				},
 				pubKeyHandle: pubHandle,
-				pubKey:       pub,
 			}}
+		c.retainPublicKey(&key.pkcs11PrivateKey, pub)
+		c.pinKey(session, &key.pkcs11PrivateKey, pub)
+		k = key
 		return nil
 
 	})
@@ -169,7 +301,24 @@ func (c *Context) GenerateDSAKeyPairWithAttributes(public, private AttributeSet,
 //
 // PKCS#11 expects to pick its own random data for signatures, so the rand argument is ignored.
 //
+// A digest longer than the subgroup order Q, such as a SHA-512 digest for a key with a 256-bit Q, is truncated to
+// its leftmost QBits bits, as FIPS 186-4 requires. An empty digest, or a long digest for a Q that is not a whole
+// number of bytes, is rejected with ErrDSADigestInvalid.
+//
 // The return value is a DER-encoded byteblock.
 func (signer *pkcs11PrivateKeyDSA) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error) {
-	return signer.context.dsaGeneric(signer.handle, pkcs11.CKM_DSA, digest)
+	if err = signer.checkArchived("signing"); err != nil {
+		return nil, err
+	}
+	if profile := signer.profileFor(MechanismSign); profile != nil {
+		return signer.signWithProfile(profile, digest)
+	}
+	pub, err := signer.dsaPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if digest, err = truncateDSADigest(pub.Q.BitLen(), digest); err != nil {
+		return nil, err
+	}
+	return signer.dsaSign(pkcs11.CKM_DSA, digest)
 }
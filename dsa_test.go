@@ -27,7 +27,8 @@ import (
 	"crypto/rand"
 	_ "crypto/sha1"
 	_ "crypto/sha256"
-	_ "crypto/sha512"
+	"crypto/sha512"
+	"errors"
 	"io"
 	"math/big"
 	"testing"
@@ -202,3 +203,99 @@ func TestDsaRequiredArgs(t *testing.T) {
 	_, err = ctx.GenerateDSAKeyPairWithLabel(val, nil, dsaSizes[dsa.L2048N224])
 	require.Error(t, err)
 }
+
+func TestDSAParameterFingerprint(t *testing.T) {
+	fingerprints := map[string]bool{}
+	for pSize, params := range dsaSizes {
+		fingerprint, err := DSAParameterFingerprint(params)
+		require.NoError(t, err)
+		require.Len(t, fingerprint, 32)
+
+		copied := dsaParameters(params.P.String(), params.Q.String(), params.G.String())
+		again, err := DSAParameterFingerprint(copied)
+		require.NoError(t, err)
+		require.Equal(t, fingerprint, again, parameterSizeToString(pSize))
+
+		fingerprints[string(fingerprint)] = true
+	}
+	require.Len(t, fingerprints, len(dsaSizes))
+
+	_, err := DSAParameterFingerprint(&dsa.Parameters{P: big.NewInt(23), Q: big.NewInt(11)})
+	require.Equal(t, errMalformedDSAPublicKey, err)
+	_, err = DSAParameterFingerprint(nil)
+	require.Equal(t, errMalformedDSAPublicKey, err)
+}
+
+func TestTruncateDSADigest(t *testing.T) {
+	digest := make([]byte, 64)
+	for i := range digest {
+		digest[i] = byte(i)
+	}
+
+	truncated, err := truncateDSADigest(224, digest)
+	require.NoError(t, err)
+	require.Equal(t, digest[:28], truncated)
+
+	truncated, err = truncateDSADigest(256, digest[:20])
+	require.NoError(t, err)
+	require.Equal(t, digest[:20], truncated)
+
+	_, err = truncateDSADigest(255, digest)
+	require.True(t, errors.Is(err, ErrDSADigestInvalid))
+
+	_, err = truncateDSADigest(256, nil)
+	require.True(t, errors.Is(err, ErrDSADigestInvalid))
+}
+
+func TestFindDSAKeysByParameters(t *testing.T) {
+	skipTest(t, skipTestDSA)
+
+	withContext(t, func(ctx *Context) {
+		params := dsaSizes[dsa.L2048N224]
+		other := dsaSizes[dsa.L2048N256]
+
+		var want []string
+		for _, p := range []*dsa.Parameters{params, params, other} {
+			id := randomBytes()
+			key, err := ctx.GenerateDSAKeyPairWithLabel(id, randomBytes(), p)
+			require.NoError(t, err)
+			defer func(k Signer) { _ = k.Delete() }(key)
+			if p == params {
+				want = append(want, string(id))
+			}
+		}
+
+		keys, err := ctx.FindDSAKeysByParameters(params)
+		require.NoError(t, err)
+
+		fingerprint, err := DSAParameterFingerprint(params)
+		require.NoError(t, err)
+
+		var found []string
+		for _, key := range keys {
+			dsaKey, ok := key.(DSASigner)
+			require.True(t, ok)
+			require.Equal(t, 224, dsaKey.QBits())
+
+			keyFingerprint, err := dsaKey.ParameterFingerprint()
+			require.NoError(t, err)
+			require.Equal(t, fingerprint, keyFingerprint)
+
+			id, err := ctx.GetAttribute(key, CkaId)
+			require.NoError(t, err)
+			found = append(found, string(id.Value))
+		}
+		for _, id := range want {
+			require.Contains(t, found, id)
+		}
+
+		// A SHA-512 digest is truncated to the leftmost 224 bits.
+		digest := sha512.Sum512([]byte("sign me with DSA"))
+		sigDER, err := keys[0].Sign(rand.Reader, digest[:], crypto.SHA512)
+		require.NoError(t, err)
+
+		var sig dsaSignature
+		require.NoError(t, sig.unmarshalDER(sigDER))
+		require.True(t, dsa.Verify(keys[0].Public().(*dsa.PublicKey), digest[:28], sig.R, sig.S))
+	})
+}
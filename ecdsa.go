@@ -27,11 +27,14 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/asn1"
+	"errors"
+	"fmt"
 	"io"
 	"math/big"
+	"sort"
+	"strings"
 
 	"github.com/miekg/pkcs11"
-	"github.com/pkg/errors"
 )
 
 // errUnsupportedEllipticCurve is returned when an elliptic curve
@@ -40,6 +43,10 @@ import (
 // implementation will be different.
 var errUnsupportedEllipticCurve = errors.New("unsupported elliptic curve")
 
+// ErrECDSADigestTooLong is returned by ECDSA signing when Config.RejectLongECDSADigests is set and the digest is
+// longer than the order of the curve.
+var ErrECDSADigestTooLong = errors.New("digest is longer than the ECDSA curve order")
+
 // pkcs11PrivateKeyECDSA contains a reference to a loaded PKCS#11 ECDSA private key object.
 type pkcs11PrivateKeyECDSA struct {
 	pkcs11PrivateKey
@@ -93,6 +100,24 @@ var wellKnownCurves = map[string]curveInfo{
 		elliptic.P521(),
 	},
 
+	// crypto/elliptic has no secp256k1 or Brainpool curves, so crypto11 provides them, see weierstrassCurve.
+	"secp256k1": {
+		mustMarshal(secp256k1.oid),
+		secp256k1,
+	},
+	"brainpoolP256r1": {
+		mustMarshal(brainpoolP256r1.oid),
+		brainpoolP256r1,
+	},
+	"brainpoolP384r1": {
+		mustMarshal(brainpoolP384r1.oid),
+		brainpoolP384r1,
+	},
+	"brainpoolP512r1": {
+		mustMarshal(brainpoolP512r1.oid),
+		brainpoolP512r1,
+	},
+
 	"K-163": {
 		mustMarshal(asn1.ObjectIdentifier{1, 3, 132, 0, 1}),
 		nil,
@@ -136,11 +161,97 @@ var wellKnownCurves = map[string]curveInfo{
 	},
 }
 
+// usableCurves returns the well-known curves that crypto11 can both generate and load, sorted by name.
+func usableCurves() []elliptic.Curve {
+	var curves []elliptic.Curve
+	for _, ci := range wellKnownCurves {
+		if ci.curve != nil {
+			curves = append(curves, ci.curve)
+		}
+	}
+	sort.Slice(curves, func(i, j int) bool { return curves[i].Params().Name < curves[j].Params().Name })
+	return curves
+}
+
+// checkECCurve returns an error, naming the curve and the curves the token supports, if curve is not one that
+// crypto11 can load or is outside what the token reports for CKM_EC_KEY_PAIR_GEN. If the token does not report
+// mechanism information, only crypto11's own support is checked. Curves with explicit parameters are only checked
+// against the mechanism information, see checkExplicitCurveInfo.
+func (c *Context) checkECCurve(curve elliptic.Curve) error {
+	var info *pkcs11.MechanismInfo
+	if mi, err := c.ctx.GetMechanismInfo(c.slot,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)}); err == nil {
+		info = &mi
+	}
+	return checkECCurveInfo(curve, info)
+}
+
+// checkECCurveInfo implements checkECCurve, with info holding the token's mechanism information if available.
+func checkECCurveInfo(curve elliptic.Curve, info *pkcs11.MechanismInfo) error {
+	if w, ok := curve.(*weierstrassCurve); ok && w.explicit != nil {
+		return checkExplicitCurveInfo(w, info)
+	}
+
+	var supported []string
+	found := false
+	for _, usable := range usableCurves() {
+		if !curveFitsMechanism(usable, info) {
+			continue
+		}
+		supported = append(supported, usable.Params().Name)
+		if curve != nil && sameCurve(curve, usable) {
+			found = true
+		}
+	}
+	if found {
+		return nil
+	}
+
+	name := "<nil>"
+	if curve != nil {
+		name = curve.Params().Name
+	}
+	list := "none"
+	if len(supported) > 0 {
+		list = strings.Join(supported, ", ")
+	}
+	return fmt.Errorf("%w %q (supported curves: %s)", errUnsupportedEllipticCurve, name, list)
+}
+
+// curveFitsMechanism returns true if a token with the given CKM_EC_KEY_PAIR_GEN mechanism information can generate a
+// key on curve using a named curve OID. A nil info, or a bound or flag the token does not report, is not checked.
+func curveFitsMechanism(curve elliptic.Curve, info *pkcs11.MechanismInfo) bool {
+	if info == nil {
+		return true
+	}
+	bits := uint(curve.Params().BitSize)
+	if (info.MinKeySize > 0 && bits < info.MinKeySize) || (info.MaxKeySize > 0 && bits > info.MaxKeySize) {
+		return false
+	}
+	// Every usable curve is a named prime curve.
+	if info.Flags&(pkcs11.CKF_EC_F_P|pkcs11.CKF_EC_F_2M) != 0 && info.Flags&pkcs11.CKF_EC_F_P == 0 {
+		return false
+	}
+	if info.Flags&(pkcs11.CKF_EC_ECPARAMETERS|pkcs11.CKF_EC_NAMEDCURVE) != 0 && info.Flags&pkcs11.CKF_EC_NAMEDCURVE == 0 {
+		return false
+	}
+	return true
+}
+
+// sameCurve returns true if a is the well-known curve b, rather than a custom curve that happens to share its name.
+func sameCurve(a, b elliptic.Curve) bool {
+	pa, pb := a.Params(), b.Params()
+	return pa.Name == pb.Name && pa.P.Cmp(pb.P) == 0 && pa.N.Cmp(pb.N) == 0 && pa.B.Cmp(pb.B) == 0 &&
+		pa.Gx.Cmp(pb.Gx) == 0 && pa.Gy.Cmp(pb.Gy) == 0
+}
+
 func marshalEcParams(c elliptic.Curve) ([]byte, error) {
+	if w, ok := c.(*weierstrassCurve); ok && w.explicit != nil {
+		return w.explicit, nil
+	}
 	if ci, ok := wellKnownCurves[c.Params().Name]; ok {
 		return ci.oid, nil
 	}
-	// TODO use ANSI X9.62 ECParameters representation instead
 	return nil, errUnsupportedEllipticCurve
 }
 
@@ -154,15 +265,65 @@ func unmarshalEcParams(b []byte) (elliptic.Curve, error) {
 			return nil, errUnsupportedEllipticCurve
 		}
 	}
-	// TODO try ANSI X9.62 ECParameters representation
+	// Otherwise it may be an ANSI X9.62 ECParameters, a SEQUENCE
+	if len(b) > 0 && b[0] == asn1.TagSequence|0x20 {
+		return unmarshalExplicitEcParams(b)
+	}
+	// PKCS#11 v3.0 also lets the curve be named with a PrintableString
+	if len(b) > 0 && b[0] == asn1.TagPrintableString {
+		return unmarshalEcCurveName(b)
+	}
+	return nil, errUnsupportedEllipticCurve
+}
+
+// ecCurveNameAliases maps the names other PKCS#11 stacks give curves in CKA_EC_PARAMS to keys of wellKnownCurves.
+var ecCurveNameAliases = map[string]string{
+	"prime192v1": "P-192",
+	"secp192r1":  "P-192",
+	"secp224r1":  "P-224",
+	"prime256v1": "P-256",
+	"secp256r1":  "P-256",
+	"secp384r1":  "P-384",
+	"secp521r1":  "P-521",
+}
+
+// unmarshalEcCurveName parses CKA_EC_PARAMS holding a curveName, the PrintableString choice of the PKCS#11 v3.0
+// Parameters CHOICE. Curves are looked up by the names in wellKnownCurves and ecCurveNameAliases.
+func unmarshalEcCurveName(b []byte) (elliptic.Curve, error) {
+	var name string
+	extra, err := asn1.UnmarshalWithParams(b, &name, "printable")
+	if err != nil || len(extra) > 0 {
+		return nil, errUnsupportedEllipticCurve
+	}
+	if alias, ok := ecCurveNameAliases[name]; ok {
+		name = alias
+	}
+	if ci, ok := wellKnownCurves[name]; ok && ci.curve != nil {
+		return ci.curve, nil
+	}
 	return nil, errUnsupportedEllipticCurve
 }
 
 func unmarshalEcPoint(b []byte, c elliptic.Curve) (*big.Int, *big.Int, error) {
+	if c == nil {
+		return nil, nil, errUnsupportedEllipticCurve
+	}
+
+	x, y, err := unmarshalDEREcPoint(b, c)
+	if err != nil && len(b) == 1+2*((c.Params().BitSize+7)/8) {
+		// Some tokens return the raw uncompressed point rather than a DER-encoded OCTET STRING
+		if rawX, rawY := elliptic.Unmarshal(c, b); rawX != nil {
+			return rawX, rawY, nil
+		}
+	}
+	return x, y, err
+}
+
+func unmarshalDEREcPoint(b []byte, c elliptic.Curve) (*big.Int, *big.Int, error) {
 	var pointBytes []byte
 	extra, err := asn1.Unmarshal(b, &pointBytes)
 	if err != nil {
-		return nil, nil, errors.WithMessage(err, "elliptic curve point is invalid ASN.1")
+		return nil, nil, withMessage(err, "elliptic curve point is invalid ASN.1")
 	}
 
 	if len(extra) > 0 {
@@ -199,8 +360,8 @@ func exportECDSAPublicKey(session *pkcs11Session, pubHandle pkcs11.ObjectHandle)
 }
 
 // GenerateECDSAKeyPair creates a ECDSA key pair on the token using curve c. The id parameter is used to
-// set CKA_ID and must be non-nil. Only a limited set of named elliptic curves are supported. The
-// underlying PKCS#11 implementation may impose further restrictions.
+// set CKA_ID and must be non-nil. Only a limited set of named elliptic curves are supported, as well as curves made by
+// NewExplicitCurve or ParseECParams. The underlying PKCS#11 implementation may impose further restrictions.
 func (c *Context) GenerateECDSAKeyPair(id []byte, curve elliptic.Curve) (Signer, error) {
 	if c.closed.Get() {
 		return nil, errClosed
@@ -237,11 +398,22 @@ func (c *Context) GenerateECDSAKeyPairWithLabel(id, label []byte, curve elliptic
 // GenerateECDSAKeyPairWithAttributes generates an ECDSA key pair on the token. After this function returns, public and
 // private will contain the attributes applied to the key pair. If required attributes are missing, they will be set to
 // a default value.
+//
+// An error is returned, without attempting generation, if crypto11 cannot load keys on curve or the token's
+// CKM_EC_KEY_PAIR_GEN mechanism information rules it out. The error names the curves the token does support.
 func (c *Context) GenerateECDSAKeyPairWithAttributes(public, private AttributeSet, curve elliptic.Curve) (Signer, error) {
 	if c.closed.Get() {
 		return nil, errClosed
 	}
 
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
+	if err := c.checkECCurve(curve); err != nil {
+		return nil, err
+	}
+
 	var k Signer
 	err := c.withSession(func(session *pkcs11Session) error {
 
@@ -276,15 +448,17 @@ func (c *Context) GenerateECDSAKeyPairWithAttributes(public, private AttributeSe
 		if err != nil {
 			return err
 		}
-		k = &pkcs11PrivateKeyECDSA{
+		key := &pkcs11PrivateKeyECDSA{
 			pkcs11PrivateKey: pkcs11PrivateKey{
 				pkcs11Object: pkcs11Object{
 					handle:  privHandle,
 					context: c,
 				},
 				pubKeyHandle: pubHandle,
-				pubKey:       pub,
 			}}
+		c.retainPublicKey(&key.pkcs11PrivateKey, pub)
+		c.pinKey(session, &key.pkcs11PrivateKey, pub)
+		k = key
 		return nil
 	})
 	return k, err
@@ -297,6 +471,41 @@ func (c *Context) GenerateECDSAKeyPairWithAttributes(public, private AttributeSe
 // PKCS#11 expects to pick its own random data where necessary for signatures, so the rand argument is ignored.
 //
 // The return value is a DER-encoded byteblock.
+//
+// A digest longer than the curve order, such as a SHA-512 digest for a P-256 key, is truncated to its leftmost
+// bytes before it is passed to the token, as ECDSA verification does (FIPS 186-4 s6.4). Tokens differ in how they
+// treat over-long input, so this keeps signatures consistent. If Config.RejectLongECDSADigests is set, such digests
+// are rejected with ErrECDSADigestTooLong instead.
 func (signer *pkcs11PrivateKeyECDSA) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	return signer.context.dsaGeneric(signer.handle, pkcs11.CKM_ECDSA, digest)
+	if err := signer.checkArchived("signing"); err != nil {
+		return nil, err
+	}
+	if profile := signer.profileFor(MechanismSign); profile != nil {
+		return signer.signWithProfile(profile, digest)
+	}
+	if pub, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		var err error
+		if digest, err = truncateECDSADigest(pub.Curve, digest, signer.context.cfg.RejectLongECDSADigests); err != nil {
+			return nil, err
+		}
+	}
+	return signer.dsaSign(pkcs11.CKM_ECDSA, digest)
+}
+
+// truncateECDSADigest returns the leftmost bytes of digest that fit in the order of curve. If reject is true, a
+// digest that is too long is an error instead. Truncation to a whole number of bytes is only consistent with
+// verification for curves whose order is a whole number of bytes long, so other curves reject long digests.
+func truncateECDSADigest(curve elliptic.Curve, digest []byte, reject bool) ([]byte, error) {
+	orderBits := curve.Params().N.BitLen()
+	if len(digest)*8 <= orderBits {
+		return digest, nil
+	}
+	if reject {
+		return nil, withMessagef(ErrECDSADigestTooLong, "%d-byte digest for %d-bit curve", len(digest),
+			orderBits)
+	}
+	if orderBits%8 != 0 {
+		return nil, withMessagef(ErrECDSADigestTooLong, "cannot truncate digest for %d-bit curve", orderBits)
+	}
+	return digest[:orderBits/8], nil
 }
@@ -27,8 +27,10 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	_ "crypto/sha1"
-	_ "crypto/sha256"
-	_ "crypto/sha512"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"errors"
 	"testing"
 
 	"github.com/miekg/pkcs11"
@@ -150,3 +152,166 @@ func TestEcdsaRequiredArgs(t *testing.T) {
 	_, err = ctx.GenerateECDSAKeyPairWithLabel(val, nil, elliptic.P224())
 	require.Error(t, err)
 }
+
+func TestUnmarshalEcPoint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	raw := elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+	der, err := asn1.Marshal(raw)
+	require.NoError(t, err)
+
+	// Both the standard DER encoding and the raw point returned by some tokens are accepted
+	for _, encoded := range [][]byte{der, raw} {
+		x, y, err := unmarshalEcPoint(encoded, elliptic.P256())
+		require.NoError(t, err)
+		assert.Equal(t, key.X, x)
+		assert.Equal(t, key.Y, y)
+	}
+
+	_, _, err = unmarshalEcPoint(der[:len(der)-1], elliptic.P256())
+	assert.Error(t, err)
+
+	_, _, err = unmarshalEcPoint(der, nil)
+	assert.Error(t, err)
+}
+
+func TestUnmarshalEcCurveName(t *testing.T) {
+	for name, curve := range map[string]elliptic.Curve{
+		"prime256v1": elliptic.P256(),
+		"secp256r1":  elliptic.P256(),
+		"P-384":      elliptic.P384(),
+		"secp521r1":  elliptic.P521(),
+		"secp224r1":  elliptic.P224(),
+	} {
+		params, err := asn1.MarshalWithParams(name, "printable")
+		require.NoError(t, err)
+
+		loaded, err := unmarshalEcParams(params)
+		require.NoError(t, err, name)
+		assert.Equal(t, curve, loaded, name)
+	}
+
+	// Names of curves crypto11 cannot load, and unknown names, are rejected
+	for _, name := range []string{"prime192v1", "K-163", "sect163k1"} {
+		params, err := asn1.MarshalWithParams(name, "printable")
+		require.NoError(t, err)
+
+		_, err = unmarshalEcParams(params)
+		assert.Equal(t, errUnsupportedEllipticCurve, err, name)
+	}
+
+	_, err := unmarshalEcParams([]byte{asn1.TagPrintableString, 0x05, 'P', '-'})
+	assert.Equal(t, errUnsupportedEllipticCurve, err)
+}
+
+func TestTruncateECDSADigest(t *testing.T) {
+	digest := make([]byte, 64)
+	for i := range digest {
+		digest[i] = byte(i)
+	}
+
+	truncated, err := truncateECDSADigest(elliptic.P256(), digest, false)
+	require.NoError(t, err)
+	assert.Equal(t, digest[:32], truncated)
+
+	truncated, err = truncateECDSADigest(elliptic.P256(), digest[:32], true)
+	require.NoError(t, err)
+	assert.Equal(t, digest[:32], truncated)
+
+	_, err = truncateECDSADigest(elliptic.P256(), digest, true)
+	assert.True(t, errors.Is(err, ErrECDSADigestTooLong))
+
+	// SHA-512 fits in P-521, but nothing longer can be truncated to a whole number of bytes.
+	truncated, err = truncateECDSADigest(elliptic.P521(), digest, false)
+	require.NoError(t, err)
+	assert.Equal(t, digest, truncated)
+
+	_, err = truncateECDSADigest(elliptic.P521(), make([]byte, 80), false)
+	assert.True(t, errors.Is(err, ErrECDSADigestTooLong))
+}
+
+// TestECDSALongDigest checks that signatures over digests longer than the curve order verify in software, whatever
+// the token does with over-long input.
+func TestECDSALongDigest(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		for _, curve := range []elliptic.Curve{elliptic.P224(), elliptic.P256(), elliptic.P384()} {
+			key, err := ctx.GenerateECDSAKeyPair(randomBytes(), curve)
+			require.NoError(t, err)
+			defer func() { _ = key.Delete() }()
+
+			pub := key.Public().(*ecdsa.PublicKey)
+			digest := sha512.Sum512([]byte("long digest"))
+
+			sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA512)
+			require.NoError(t, err)
+
+			var parsed dsaSignature
+			require.NoError(t, parsed.unmarshalDER(sig))
+			assert.True(t, ecdsa.Verify(pub, digest[:], parsed.R, parsed.S), curve.Params().Name)
+		}
+	})
+}
+
+func TestECDSARejectLongDigest(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.RejectLongECDSADigests = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	long := sha512.Sum512([]byte("long digest"))
+	_, err = key.Sign(rand.Reader, long[:], crypto.SHA512)
+	assert.True(t, errors.Is(err, ErrECDSADigestTooLong))
+
+	short := sha256.Sum256([]byte("short digest"))
+	_, err = key.Sign(rand.Reader, short[:], crypto.SHA256)
+	assert.NoError(t, err)
+}
+
+func TestCheckECCurveInfo(t *testing.T) {
+	custom := *elliptic.P256().Params()
+	custom.Name = "custom"
+	impostor := *elliptic.P256().Params()
+	impostor.Name = "P-384"
+
+	for _, curve := range curves {
+		assert.NoError(t, checkECCurveInfo(curve, nil))
+	}
+
+	for _, curve := range []elliptic.Curve{nil, &custom, &impostor} {
+		err := checkECCurveInfo(curve, nil)
+		assert.True(t, errors.Is(err, errUnsupportedEllipticCurve))
+		assert.Contains(t, err.Error(), "supported curves: P-224, P-256, P-384, P-521, brainpoolP256r1, brainpoolP384r1, "+
+			"brainpoolP512r1, secp256k1")
+	}
+
+	err := checkECCurveInfo(elliptic.P224(), &pkcs11.MechanismInfo{MinKeySize: 256, MaxKeySize: 384})
+	assert.True(t, errors.Is(err, errUnsupportedEllipticCurve))
+	assert.Contains(t, err.Error(), `"P-224" (supported curves: P-256, P-384, brainpoolP256r1, brainpoolP384r1, secp256k1)`)
+	assert.NoError(t, checkECCurveInfo(elliptic.P384(), &pkcs11.MechanismInfo{MinKeySize: 256, MaxKeySize: 384}))
+
+	err = checkECCurveInfo(elliptic.P256(), &pkcs11.MechanismInfo{Flags: pkcs11.CKF_EC_F_2M})
+	assert.Contains(t, err.Error(), "supported curves: none")
+	err = checkECCurveInfo(elliptic.P256(), &pkcs11.MechanismInfo{Flags: pkcs11.CKF_EC_ECPARAMETERS})
+	assert.Contains(t, err.Error(), "supported curves: none")
+	assert.NoError(t, checkECCurveInfo(elliptic.P256(),
+		&pkcs11.MechanismInfo{Flags: pkcs11.CKF_EC_F_P | pkcs11.CKF_EC_NAMEDCURVE}))
+}
+
+func TestGenerateECDSAKeyPairUnsupportedCurve(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		custom := *elliptic.P256().Params()
+		custom.Name = "custom"
+
+		_, err := ctx.GenerateECDSAKeyPair(randomBytes(), &custom)
+		assert.True(t, errors.Is(err, errUnsupportedEllipticCurve))
+		assert.Contains(t, err.Error(), `"custom"`)
+	})
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"errors"
+	"math/big"
+)
+
+// ErrInvalidECDSASignature is returned when an ECDSA signature cannot be parsed, or its components are out of range
+// for the curve.
+var ErrInvalidECDSASignature = errors.New("invalid ECDSA signature")
+
+// ECDSASignatureEncoding identifies how an ECDSA signature is encoded.
+type ECDSASignatureEncoding int
+
+const (
+	// ECDSASignatureAuto detects the encoding. A signature that is valid DER is treated as DER, otherwise a
+	// signature whose length is twice the curve size is treated as raw.
+	ECDSASignatureAuto ECDSASignatureEncoding = iota
+
+	// ECDSASignatureDER is the ASN.1 DER encoding of SEQUENCE { r INTEGER, s INTEGER }, as returned by the Sign
+	// methods of key pairs and used by X.509 and TLS.
+	ECDSASignatureDER
+
+	// ECDSASignatureRaw is r||s, each left-padded to the curve size in bytes, as used by PKCS#11, JOSE and COSE.
+	ECDSASignatureRaw
+)
+
+// ECDSASignatureOptions controls how ECDSA signatures are parsed. It implements crypto.SignerOpts, so that it can be
+// passed to PublicKey.Verify to select the signature encoding.
+type ECDSASignatureOptions struct {
+	// Encoding is the expected signature encoding. The zero value detects the encoding.
+	Encoding ECDSASignatureEncoding
+
+	// Lenient accepts DER signatures with non-minimal lengths or integers padded with redundant leading zeros.
+	// Such encodings are malleable, since one signature can be encoded in many ways, so they are rejected unless
+	// Lenient is set. Negative or out of range components are rejected regardless.
+	Lenient bool
+}
+
+// HashFunc returns zero. The digest passed to PublicKey.Verify is verified as given.
+func (opts *ECDSASignatureOptions) HashFunc() crypto.Hash {
+	return 0
+}
+
+// ParseECDSASignature returns the components of an ECDSA signature encoded either as DER or raw r||s, detecting the
+// encoding. DER encodings must be minimal. Both r and s must be in the range [1, N-1], where N is the order of curve.
+func ParseECDSASignature(sig []byte, curve elliptic.Curve) (r, s *big.Int, err error) {
+	return ParseECDSASignatureWithOptions(sig, curve, ECDSASignatureOptions{})
+}
+
+// ParseECDSASignatureWithOptions returns the components of an ECDSA signature, as ParseECDSASignature, with the
+// encoding and strictness controlled by opts.
+func ParseECDSASignatureWithOptions(sig []byte, curve elliptic.Curve, opts ECDSASignatureOptions) (r, s *big.Int,
+	err error) {
+
+	if curve == nil {
+		return nil, nil, errUnsupportedEllipticCurve
+	}
+	size := ecdsaCurveSize(curve)
+
+	switch opts.Encoding {
+	case ECDSASignatureAuto:
+		if r, s, err = parseDERECDSASignature(sig, opts.Lenient); err != nil {
+			if len(sig) != 2*size {
+				return nil, nil, err
+			}
+			r, s, err = parseRawECDSASignature(sig, size)
+		}
+	case ECDSASignatureDER:
+		r, s, err = parseDERECDSASignature(sig, opts.Lenient)
+	case ECDSASignatureRaw:
+		r, s, err = parseRawECDSASignature(sig, size)
+	default:
+		return nil, nil, withMessagef(ErrInvalidECDSASignature, "unknown signature encoding %d", opts.Encoding)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n := curve.Params().N
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(n) >= 0 || s.Cmp(n) >= 0 {
+		return nil, nil, withMessage(ErrInvalidECDSASignature, "signature component out of range")
+	}
+	return r, s, nil
+}
+
+// MarshalECDSASignatureRaw returns the raw r||s encoding of an ECDSA signature, each component left-padded to the
+// size of curve.
+func MarshalECDSASignatureRaw(r, s *big.Int, curve elliptic.Curve) ([]byte, error) {
+	if r == nil || s == nil {
+		return nil, withMessage(ErrInvalidECDSASignature, "missing signature component")
+	}
+	if curve == nil {
+		return nil, errUnsupportedEllipticCurve
+	}
+	sig := dsaSignature{R: r, S: s}
+	return sig.marshalBytes(ecdsaCurveSize(curve))
+}
+
+// MarshalECDSASignatureDER returns the DER encoding of an ECDSA signature.
+func MarshalECDSASignatureDER(r, s *big.Int) ([]byte, error) {
+	if r == nil || s == nil {
+		return nil, withMessage(ErrInvalidECDSASignature, "missing signature component")
+	}
+	sig := dsaSignature{R: r, S: s}
+	return sig.marshalDER()
+}
+
+// ecdsaCurveSize returns the size in bytes of each component of a raw signature for curve, which is the length of
+// its order.
+func ecdsaCurveSize(curve elliptic.Curve) int {
+	return (curve.Params().N.BitLen() + 7) / 8
+}
+
+// parseRawECDSASignature splits a raw r||s signature with components of size bytes.
+func parseRawECDSASignature(sig []byte, size int) (r, s *big.Int, err error) {
+	if len(sig) != 2*size {
+		return nil, nil, withMessagef(ErrInvalidECDSASignature, "raw signature is %d bytes, expected %d",
+			len(sig), 2*size)
+	}
+	r = new(big.Int).SetBytes(sig[:size])
+	s = new(big.Int).SetBytes(sig[size:])
+	return r, s, nil
+}
+
+// parseDERECDSASignature parses SEQUENCE { r INTEGER, s INTEGER }. Unless lenient is set, lengths and integers must
+// be minimally encoded. Trailing data and negative integers are always rejected.
+func parseDERECDSASignature(sig []byte, lenient bool) (r, s *big.Int, err error) {
+	body, rest, err := parseDERElement(sig, 0x30, lenient)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) > 0 {
+		return nil, nil, withMessage(ErrInvalidECDSASignature, "unexpected data after DER signature")
+	}
+	if r, body, err = parseDERInteger(body, lenient); err != nil {
+		return nil, nil, err
+	}
+	if s, body, err = parseDERInteger(body, lenient); err != nil {
+		return nil, nil, err
+	}
+	if len(body) > 0 {
+		return nil, nil, withMessage(ErrInvalidECDSASignature, "unexpected data in DER signature")
+	}
+	return r, s, nil
+}
+
+// parseDERInteger parses a non-negative INTEGER from the start of b, returning the value and the remaining input.
+func parseDERInteger(b []byte, lenient bool) (*big.Int, []byte, error) {
+	content, rest, err := parseDERElement(b, 0x02, lenient)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(content) == 0 {
+		return nil, nil, withMessage(ErrInvalidECDSASignature, "empty DER integer")
+	}
+	if content[0]&0x80 != 0 {
+		return nil, nil, withMessage(ErrInvalidECDSASignature, "negative DER integer")
+	}
+	if !lenient && len(content) > 1 && content[0] == 0 && content[1]&0x80 == 0 {
+		return nil, nil, withMessage(ErrInvalidECDSASignature, "DER integer is not minimally encoded")
+	}
+	return new(big.Int).SetBytes(content), rest, nil
+}
+
+// parseDERElement parses an element with the given single-byte tag from the start of b, returning its contents and
+// the remaining input. Unless lenient is set, the length must be minimally encoded.
+func parseDERElement(b []byte, tag byte, lenient bool) (content, rest []byte, err error) {
+	if len(b) < 2 || b[0] != tag {
+		return nil, nil, withMessagef(ErrInvalidECDSASignature, "expected DER tag 0x%02x", tag)
+	}
+
+	length := int(b[1])
+	b = b[2:]
+	if length&0x80 != 0 {
+		// Long form: the low bits give the number of length bytes that follow. A signature never needs more than
+		// two of them.
+		count := length & 0x7f
+		if count == 0 || count > 2 || len(b) < count {
+			return nil, nil, withMessage(ErrInvalidECDSASignature, "invalid DER length")
+		}
+		length = 0
+		for _, lb := range b[:count] {
+			length = length<<8 | int(lb)
+		}
+		b = b[count:]
+		if !lenient && (length < 0x80 || (count == 2 && length < 0x100)) {
+			return nil, nil, withMessage(ErrInvalidECDSASignature, "DER length is not minimally encoded")
+		}
+	}
+
+	if length > len(b) {
+		return nil, nil, withMessage(ErrInvalidECDSASignature, "DER signature is truncated")
+	}
+	return b[:length], b[length:], nil
+}
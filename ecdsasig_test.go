@@ -0,0 +1,171 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestECDSASignatureRoundTrip(t *testing.T) {
+	curve := elliptic.P256()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("round trip"))
+
+	for i := 0; i < 20; i++ {
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		require.NoError(t, err)
+
+		der, err := MarshalECDSASignatureDER(r, s)
+		require.NoError(t, err)
+		raw, err := MarshalECDSASignatureRaw(r, s, curve)
+		require.NoError(t, err)
+		require.Len(t, raw, 64)
+
+		for _, sig := range [][]byte{der, raw} {
+			r2, s2, err := ParseECDSASignature(sig, curve)
+			require.NoError(t, err)
+			assert.Equal(t, 0, r.Cmp(r2))
+			assert.Equal(t, 0, s.Cmp(s2))
+		}
+
+		_, _, err = ParseECDSASignatureWithOptions(der, curve, ECDSASignatureOptions{Encoding: ECDSASignatureDER})
+		require.NoError(t, err)
+		_, _, err = ParseECDSASignatureWithOptions(raw, curve, ECDSASignatureOptions{Encoding: ECDSASignatureRaw})
+		require.NoError(t, err)
+		_, _, err = ParseECDSASignatureWithOptions(raw, curve, ECDSASignatureOptions{Encoding: ECDSASignatureDER})
+		require.Error(t, err)
+	}
+}
+
+func TestParseECDSASignatureStrictness(t *testing.T) {
+	curve := elliptic.P256()
+	one, two := []byte{0x02, 0x01, 0x01}, []byte{0x02, 0x01, 0x02}
+
+	cases := []struct {
+		name    string
+		sig     []byte
+		lenient bool
+	}{
+		{"padded integer", concat([]byte{0x30, 0x07, 0x02, 0x02, 0x00, 0x01}, two), true},
+		{"long form length", concat([]byte{0x30, 0x81, 0x06}, one, two), true},
+		{"two byte length", concat([]byte{0x30, 0x82, 0x00, 0x06}, one, two), true},
+		{"trailing data", concat([]byte{0x30, 0x06}, one, two, []byte{0}), false},
+		{"data after integers", concat([]byte{0x30, 0x07}, one, two, []byte{0}), false},
+		{"negative integer", concat([]byte{0x30, 0x06, 0x02, 0x01, 0x81}, two), false},
+		{"empty integer", concat([]byte{0x30, 0x05, 0x02, 0x00}, two), false},
+		{"zero integer", concat([]byte{0x30, 0x06, 0x02, 0x01, 0x00}, two), false},
+		{"truncated", concat([]byte{0x30, 0x07}, one, two), false},
+		{"wrong tag", concat([]byte{0x31, 0x06}, one, two), false},
+		{"one integer", concat([]byte{0x30, 0x03}, one), false},
+		{"empty", nil, false},
+	}
+
+	for _, c := range cases {
+		_, _, err := ParseECDSASignature(c.sig, curve)
+		assert.True(t, errors.Is(err, ErrInvalidECDSASignature), "%s: %v", c.name, err)
+
+		_, _, err = ParseECDSASignatureWithOptions(c.sig, curve, ECDSASignatureOptions{Lenient: true})
+		if c.lenient {
+			assert.NoError(t, err, c.name)
+		} else {
+			assert.Error(t, err, c.name)
+		}
+	}
+
+	r, s, err := ParseECDSASignature(concat([]byte{0x30, 0x06}, one, two), curve)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), r.Int64())
+	assert.Equal(t, int64(2), s.Int64())
+}
+
+func TestParseECDSASignatureRange(t *testing.T) {
+	curve := elliptic.P256()
+	n := curve.Params().N
+
+	for _, c := range []struct{ r, s *big.Int }{
+		{new(big.Int).Set(n), big.NewInt(1)},
+		{big.NewInt(1), new(big.Int).Add(n, big.NewInt(1))},
+		{big.NewInt(0), big.NewInt(1)},
+	} {
+		raw, err := MarshalECDSASignatureRaw(c.r, c.s, curve)
+		require.NoError(t, err)
+		_, _, err = ParseECDSASignature(raw, curve)
+		assert.True(t, errors.Is(err, ErrInvalidECDSASignature), "r=%v s=%v", c.r, c.s)
+
+		der, err := MarshalECDSASignatureDER(c.r, c.s)
+		require.NoError(t, err)
+		_, _, err = ParseECDSASignatureWithOptions(der, curve, ECDSASignatureOptions{Lenient: true})
+		assert.True(t, errors.Is(err, ErrInvalidECDSASignature), "r=%v s=%v", c.r, c.s)
+	}
+
+	_, _, err := ParseECDSASignature(make([]byte, 63), curve)
+	assert.Error(t, err)
+	_, err = MarshalECDSASignatureRaw(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1), curve)
+	assert.Error(t, err)
+	_, err = MarshalECDSASignatureDER(nil, big.NewInt(1))
+	assert.Error(t, err)
+}
+
+func TestVerifyECDSASignatureEncodings(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		key, err := ctx.GenerateECDSAKeyPair(id, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		pub, err := ctx.FindPublicKey(id, nil)
+		require.NoError(t, err)
+		require.NotNil(t, pub)
+
+		digest := sha256.Sum256([]byte("encodings"))
+		der, err := key.Sign(nil, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+
+		r, s, err := ParseECDSASignature(der, elliptic.P256())
+		require.NoError(t, err)
+		raw, err := MarshalECDSASignatureRaw(r, s, elliptic.P256())
+		require.NoError(t, err)
+
+		require.NoError(t, pub.Verify(digest[:], der, crypto.SHA256))
+		require.Error(t, pub.Verify(digest[:], raw, crypto.SHA256))
+
+		require.NoError(t, pub.Verify(digest[:], raw, &ECDSASignatureOptions{}))
+		require.NoError(t, pub.Verify(digest[:], der, &ECDSASignatureOptions{}))
+		require.NoError(t, pub.Verify(digest[:], raw, &ECDSASignatureOptions{Encoding: ECDSASignatureRaw}))
+
+		// Re-encode with a non-minimal length, which is only accepted in lenient mode.
+		padded := concat([]byte{0x30, 0x81}, der[1:])
+		require.Error(t, pub.Verify(digest[:], padded, &ECDSASignatureOptions{}))
+		require.NoError(t, pub.Verify(digest[:], padded, &ECDSASignatureOptions{Lenient: true}))
+	})
+}
@@ -0,0 +1,344 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// oidPrimeField is the field type of ECParameters over a prime field (ANSI X9.62).
+var oidPrimeField = asn1.ObjectIdentifier{1, 2, 840, 10045, 1, 1}
+
+// explicitCurveName is the name of a curve given by explicit parameters without ECDomainParameters.Name.
+const explicitCurveName = "explicit"
+
+// errInvalidECParameters is returned for explicit EC domain parameters that do not describe a usable curve.
+var errInvalidECParameters = errors.New("invalid explicit EC parameters")
+
+// ECDomainParameters are the explicit domain parameters of a prime curve y² = x³ + ax + b, as carried in
+// CKA_EC_PARAMS by the ECParameters structure of ANSI X9.62 and SEC 1. They describe curves that have no
+// named-curve OID, see NewExplicitCurve.
+type ECDomainParameters struct {
+	// Name is the Params().Name of the curve. It is not encoded, and defaults to "explicit".
+	Name string
+
+	// P is the prime defining the field.
+	P *big.Int
+
+	// A and B are the coefficients of the curve equation.
+	A, B *big.Int
+
+	// Gx and Gy are the coordinates of the base point.
+	Gx, Gy *big.Int
+
+	// N is the order of the base point. Signatures on the curve have two components of its length.
+	N *big.Int
+
+	// Cofactor is the cofactor of the curve. It is optional.
+	Cofactor *big.Int
+
+	// Seed is the seed the parameters were generated from. It is optional.
+	Seed []byte
+}
+
+// ecParametersASN1 is the ECParameters structure of SEC 1 section C.2, for a prime field.
+type ecParametersASN1 struct {
+	Version  int
+	FieldID  ecFieldIDASN1
+	Curve    ecCurveASN1
+	Base     []byte
+	Order    *big.Int
+	Cofactor *big.Int `asn1:"optional"`
+}
+
+type ecFieldIDASN1 struct {
+	FieldType  asn1.ObjectIdentifier
+	Parameters asn1.RawValue
+}
+
+type ecCurveASN1 struct {
+	A    []byte
+	B    []byte
+	Seed asn1.BitString `asn1:"optional"`
+}
+
+// NewExplicitCurve returns the curve described by params, for use with GenerateECDSAKeyPair, which passes the
+// parameters to the token as a DER-encoded ECParameters in CKA_EC_PARAMS rather than as a named-curve OID. The
+// parameters are checked first: P and N must be prime, the curve must not be singular and N must be the order of the
+// base point. Only the token's CKF_EC_ECPARAMETERS flag is checked on generation; the token may accept explicit
+// parameters only for curves it knows.
+//
+// The arithmetic of the curve is not constant time. It is only used on public keys.
+func NewExplicitCurve(params *ECDomainParameters) (elliptic.Curve, error) {
+	curve, err := newExplicitCurve(params)
+	if err != nil {
+		return nil, err
+	}
+	if curve.explicit, err = marshalExplicitECParams(curve, params); err != nil {
+		return nil, err
+	}
+	return curve, nil
+}
+
+// ParseECParams returns the curve described by a CKA_EC_PARAMS value, which is either the DER encoding of a
+// named-curve OID that crypto11 supports or a DER-encoded ECParameters with explicit parameters. For explicit
+// parameters, the value is passed to the token unchanged by GenerateECDSAKeyPair.
+func ParseECParams(ecParams []byte) (elliptic.Curve, error) {
+	if len(ecParams) > 0 && ecParams[0] == asn1.TagSequence|0x20 {
+		params, err := unmarshalExplicitECParams(ecParams)
+		if err != nil {
+			return nil, err
+		}
+		curve, err := newExplicitCurve(params)
+		if err != nil {
+			return nil, err
+		}
+		curve.explicit = append([]byte(nil), ecParams...)
+		return curve, nil
+	}
+	return unmarshalEcParams(ecParams)
+}
+
+// ExplicitParameters returns the domain parameters of a curve made by NewExplicitCurve or ParseECParams, or found
+// on a key pair whose CKA_EC_PARAMS holds explicit parameters. It returns false for named curves.
+func ExplicitParameters(curve elliptic.Curve) (*ECDomainParameters, bool) {
+	w, ok := curve.(*weierstrassCurve)
+	if !ok || w.explicit == nil {
+		return nil, false
+	}
+	params, err := unmarshalExplicitECParams(w.explicit)
+	if err != nil {
+		return nil, false
+	}
+	params.Name = w.params.Name
+	return params, true
+}
+
+// newExplicitCurve checks params and returns a curve for them, without its encoding.
+func newExplicitCurve(params *ECDomainParameters) (*weierstrassCurve, error) {
+	if params == nil || params.P == nil || params.A == nil || params.B == nil || params.Gx == nil ||
+		params.Gy == nil || params.N == nil {
+		return nil, fmt.Errorf("%w: a parameter is missing", errInvalidECParameters)
+	}
+	p := params.P
+	inField := func(x *big.Int) bool { return x.Sign() >= 0 && x.Cmp(p) < 0 }
+	switch {
+	case p.Cmp(big.NewInt(3)) <= 0 || !p.ProbablyPrime(20):
+		return nil, fmt.Errorf("%w: P is not an odd prime", errInvalidECParameters)
+	case !inField(params.A) || !inField(params.B):
+		return nil, fmt.Errorf("%w: A and B must lie in [0, P)", errInvalidECParameters)
+	case params.B.Sign() == 0:
+		// (0, 0) stands for the point at infinity, as in crypto/elliptic, so it must not be on the curve.
+		return nil, fmt.Errorf("%w: B must not be zero", errInvalidECParameters)
+	case params.N.Cmp(big.NewInt(1)) <= 0 || !params.N.ProbablyPrime(20):
+		return nil, fmt.Errorf("%w: N is not a prime", errInvalidECParameters)
+	case params.Cofactor != nil && params.Cofactor.Sign() <= 0:
+		return nil, fmt.Errorf("%w: the cofactor must be positive", errInvalidECParameters)
+	}
+
+	// 4a³ + 27b² ≠ 0 mod P
+	discriminant := new(big.Int).Exp(params.A, big.NewInt(3), p)
+	discriminant.Mul(discriminant, big.NewInt(4))
+	b2 := new(big.Int).Mul(params.B, params.B)
+	discriminant.Add(discriminant, b2.Mul(b2, big.NewInt(27)))
+	if discriminant.Mod(discriminant, p).Sign() == 0 {
+		return nil, fmt.Errorf("%w: the curve is singular", errInvalidECParameters)
+	}
+
+	name := params.Name
+	if name == "" {
+		name = explicitCurveName
+	}
+	curve := &weierstrassCurve{
+		params: &elliptic.CurveParams{P: new(big.Int).Set(p), N: new(big.Int).Set(params.N),
+			B: new(big.Int).Set(params.B), Gx: new(big.Int).Set(params.Gx), Gy: new(big.Int).Set(params.Gy),
+			BitSize: p.BitLen(), Name: name},
+		a: new(big.Int).Set(params.A),
+	}
+	if !curve.IsOnCurve(params.Gx, params.Gy) {
+		return nil, fmt.Errorf("%w: the base point is not on the curve", errInvalidECParameters)
+	}
+	if x, y := curve.ScalarBaseMult(params.N.Bytes()); x.Sign() != 0 || y.Sign() != 0 {
+		return nil, fmt.Errorf("%w: N is not the order of the base point", errInvalidECParameters)
+	}
+	return curve, nil
+}
+
+// marshalExplicitECParams returns the DER-encoded ECParameters of curve, with the optional fields of params.
+func marshalExplicitECParams(curve *weierstrassCurve, params *ECDomainParameters) ([]byte, error) {
+	prime, err := asn1.Marshal(curve.params.P)
+	if err != nil {
+		return nil, err
+	}
+	size := (curve.params.BitSize + 7) / 8
+	fieldElement := func(x *big.Int) []byte {
+		b := make([]byte, size)
+		value := x.Bytes()
+		copy(b[size-len(value):], value)
+		return b
+	}
+
+	raw := ecParametersASN1{
+		Version:  1,
+		FieldID:  ecFieldIDASN1{FieldType: oidPrimeField, Parameters: asn1.RawValue{FullBytes: prime}},
+		Curve:    ecCurveASN1{A: fieldElement(curve.a), B: fieldElement(curve.params.B)},
+		Base:     elliptic.Marshal(curve, curve.params.Gx, curve.params.Gy),
+		Order:    curve.params.N,
+		Cofactor: params.Cofactor,
+	}
+	if len(params.Seed) > 0 {
+		raw.Curve.Seed = asn1.BitString{Bytes: params.Seed, BitLength: 8 * len(params.Seed)}
+	}
+	return asn1.Marshal(raw)
+}
+
+// unmarshalExplicitECParams parses a DER-encoded ECParameters over a prime field. The parameters are not checked.
+func unmarshalExplicitECParams(der []byte) (*ECDomainParameters, error) {
+	var raw ecParametersASN1
+	rest, err := asn1.Unmarshal(der, &raw)
+	if err != nil {
+		return nil, withMessage(err, "ECParameters are invalid ASN.1")
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("unexpected data found after ECParameters")
+	}
+	if raw.Version != 1 {
+		return nil, fmt.Errorf("%w: unsupported ECParameters version %d", errInvalidECParameters, raw.Version)
+	}
+	if !raw.FieldID.FieldType.Equal(oidPrimeField) {
+		return nil, fmt.Errorf("%w: field type %v is not a prime field", errUnsupportedEllipticCurve,
+			raw.FieldID.FieldType)
+	}
+	var p *big.Int
+	if rest, err = asn1.Unmarshal(raw.FieldID.Parameters.FullBytes, &p); err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("%w: the prime is not an INTEGER", errInvalidECParameters)
+	}
+	if p.Sign() <= 0 || raw.Order == nil {
+		return nil, fmt.Errorf("%w: a parameter is missing", errInvalidECParameters)
+	}
+
+	params := &ECDomainParameters{
+		P:        p,
+		A:        new(big.Int).SetBytes(raw.Curve.A),
+		B:        new(big.Int).SetBytes(raw.Curve.B),
+		N:        raw.Order,
+		Cofactor: raw.Cofactor,
+	}
+	if len(raw.Curve.Seed.Bytes) > 0 {
+		params.Seed = raw.Curve.Seed.Bytes
+	}
+	if params.Gx, params.Gy, err = decodeECPoint(raw.Base, params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// decodeECPoint decodes the uncompressed or compressed encoding of a point on the curve of params.
+func decodeECPoint(encoded []byte, params *ECDomainParameters) (*big.Int, *big.Int, error) {
+	p := params.P
+	size := (p.BitLen() + 7) / 8
+	switch {
+	case len(encoded) == 1+2*size && encoded[0] == 4:
+		return new(big.Int).SetBytes(encoded[1 : 1+size]), new(big.Int).SetBytes(encoded[1+size:]), nil
+
+	case len(encoded) == 1+size && (encoded[0] == 2 || encoded[0] == 3):
+		x := new(big.Int).SetBytes(encoded[1:])
+		if x.Cmp(p) >= 0 {
+			break
+		}
+		// y² = x³ + ax + b
+		rhs := new(big.Int).Mul(x, x)
+		rhs.Add(rhs, params.A)
+		rhs.Mul(rhs, x)
+		rhs.Add(rhs, params.B)
+		rhs.Mod(rhs, p)
+		y := new(big.Int).ModSqrt(rhs, p)
+		if y == nil {
+			break
+		}
+		if y.Bit(0) != uint(encoded[0]&1) {
+			y.Sub(p, y)
+		}
+		return x, y, nil
+	}
+	return nil, nil, fmt.Errorf("%w: the base point is malformed", errInvalidECParameters)
+}
+
+// unmarshalExplicitEcParams returns the curve of a key pair whose CKA_EC_PARAMS holds explicit parameters. Parameters
+// of a well-known curve are returned as that curve.
+func unmarshalExplicitEcParams(ecParams []byte) (elliptic.Curve, error) {
+	curve, err := ParseECParams(ecParams)
+	if err != nil {
+		return nil, err
+	}
+	w := curve.(*weierstrassCurve)
+	for _, known := range usableCurves() {
+		if sameDomain(w, known) {
+			return known, nil
+		}
+	}
+	return curve, nil
+}
+
+// sameDomain returns true if explicit and known are the same curve, whatever their names.
+func sameDomain(explicit *weierstrassCurve, known elliptic.Curve) bool {
+	pe, pk := explicit.params, known.Params()
+	if pe.P.Cmp(pk.P) != 0 || pe.N.Cmp(pk.N) != 0 || pe.B.Cmp(pk.B) != 0 || pe.Gx.Cmp(pk.Gx) != 0 ||
+		pe.Gy.Cmp(pk.Gy) != 0 {
+		return false
+	}
+	// The curves of crypto/elliptic have a = -3.
+	a := new(big.Int).Sub(pk.P, big.NewInt(3))
+	if w, ok := known.(*weierstrassCurve); ok {
+		a = w.a
+	}
+	return explicit.a.Cmp(a) == 0
+}
+
+// checkExplicitCurveInfo returns an error if a token with the given CKM_EC_KEY_PAIR_GEN mechanism information cannot
+// generate a key pair on curve, which has explicit parameters. A nil info, or a bound or flag the token does not
+// report, is not checked.
+func checkExplicitCurveInfo(curve *weierstrassCurve, info *pkcs11.MechanismInfo) error {
+	if info == nil {
+		return nil
+	}
+	name := curve.params.Name
+	bits := uint(curve.params.BitSize)
+	if (info.MinKeySize > 0 && bits < info.MinKeySize) || (info.MaxKeySize > 0 && bits > info.MaxKeySize) {
+		return fmt.Errorf("%w %q: %d-bit curves are outside the range of the token (%d to %d bits)",
+			errUnsupportedEllipticCurve, name, bits, info.MinKeySize, info.MaxKeySize)
+	}
+	if info.Flags&(pkcs11.CKF_EC_F_P|pkcs11.CKF_EC_F_2M) != 0 && info.Flags&pkcs11.CKF_EC_F_P == 0 {
+		return fmt.Errorf("%w %q: the token does not support prime curves", errUnsupportedEllipticCurve, name)
+	}
+	if info.Flags&(pkcs11.CKF_EC_ECPARAMETERS|pkcs11.CKF_EC_NAMEDCURVE) != 0 &&
+		info.Flags&pkcs11.CKF_EC_ECPARAMETERS == 0 {
+		return fmt.Errorf("%w %q: the token does not accept explicit parameters", errUnsupportedEllipticCurve, name)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hexInt(s string) *big.Int {
+	i, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex integer " + s)
+	}
+	return i
+}
+
+// brainpoolP256t1 is the twisted Brainpool curve of RFC 5639, which has no entry in wellKnownCurves.
+func brainpoolP256t1() *ECDomainParameters {
+	return &ECDomainParameters{
+		Name:     "brainpoolP256t1",
+		P:        hexInt("A9FB57DBA1EEA9BC3E660A909D838D726E3BF623D52620282013481D1F6E5377"),
+		A:        hexInt("A9FB57DBA1EEA9BC3E660A909D838D726E3BF623D52620282013481D1F6E5374"),
+		B:        hexInt("662C61C430D84EA4FE66A7733D0B76B7BF93EBC4AF2F49256AE58101FEE92B04"),
+		Gx:       hexInt("A3E8EB3CC1CFE7B7732213B23A656149AFA142C47AAFBC2B79A191562E1305F4"),
+		Gy:       hexInt("2D996C823439C56D7F7B22E14644417E69BCB6DE39D027001DABE8F35B25C9BE"),
+		N:        hexInt("A9FB57DBA1EEA9BC3E660A909D838D718C397AA3B561A6F7901E0E82974856A7"),
+		Cofactor: big.NewInt(1),
+	}
+}
+
+// p256Parameters returns the explicit parameters of P-256.
+func p256Parameters() *ECDomainParameters {
+	params := elliptic.P256().Params()
+	return &ECDomainParameters{
+		Name: "explicit P-256",
+		P:    params.P,
+		A:    new(big.Int).Sub(params.P, big.NewInt(3)),
+		B:    params.B,
+		Gx:   params.Gx,
+		Gy:   params.Gy,
+		N:    params.N,
+	}
+}
+
+func TestExplicitCurveEncoding(t *testing.T) {
+	params := brainpoolP256t1()
+	params.Seed = []byte("seed")
+	curve, err := NewExplicitCurve(params)
+	require.NoError(t, err)
+	assert.Equal(t, "brainpoolP256t1", curve.Params().Name)
+	assert.Equal(t, 256, curve.Params().BitSize)
+
+	ecParams, err := marshalEcParams(curve)
+	require.NoError(t, err)
+
+	parsed, err := ParseECParams(ecParams)
+	require.NoError(t, err)
+	assert.Equal(t, explicitCurveName, parsed.Params().Name)
+	roundTrip, ok := ExplicitParameters(parsed)
+	require.True(t, ok)
+	for _, pair := range [][2]*big.Int{{params.P, roundTrip.P}, {params.A, roundTrip.A}, {params.B, roundTrip.B},
+		{params.Gx, roundTrip.Gx}, {params.Gy, roundTrip.Gy}, {params.N, roundTrip.N},
+		{params.Cofactor, roundTrip.Cofactor}} {
+		assert.Zero(t, pair[0].Cmp(pair[1]))
+	}
+	assert.Equal(t, params.Seed, roundTrip.Seed)
+
+	// The encoding is passed through unchanged.
+	reencoded, err := marshalEcParams(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, ecParams, reencoded)
+
+	// Keys on the curve can be used in software.
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	require.NoError(t, err)
+	loaded, err := unmarshalEcParams(ecParams)
+	require.NoError(t, err)
+	x, y, err := unmarshalEcPoint(mustMarshal(elliptic.Marshal(loaded, priv.X, priv.Y)), loaded)
+	require.NoError(t, err)
+	assert.Equal(t, priv.X, x)
+	assert.Equal(t, priv.Y, y)
+
+	digest := sha256.Sum256(randomBytes())
+	sig, err := priv.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	assert.NoError(t, verifyInSoftware(&ecdsa.PublicKey{Curve: loaded, X: x, Y: y}, digest[:], sig, crypto.SHA256))
+	_, err = PublicKeyFingerprint(&priv.PublicKey)
+	assert.NoError(t, err)
+
+	_, ok = ExplicitParameters(elliptic.P256())
+	assert.False(t, ok)
+}
+
+func TestExplicitParametersOfKnownCurves(t *testing.T) {
+	// Loaded keys with the explicit parameters of a well-known curve are given that curve.
+	curve, err := NewExplicitCurve(p256Parameters())
+	require.NoError(t, err)
+	ecParams, err := marshalEcParams(curve)
+	require.NoError(t, err)
+	loaded, err := unmarshalEcParams(ecParams)
+	require.NoError(t, err)
+	assert.True(t, loaded == elliptic.P256())
+
+	k1 := secp256k1.Params()
+	curve, err = NewExplicitCurve(&ECDomainParameters{P: k1.P, A: big.NewInt(0), B: k1.B, Gx: k1.Gx, Gy: k1.Gy,
+		N: k1.N})
+	require.NoError(t, err)
+	ecParams, err = marshalEcParams(curve)
+	require.NoError(t, err)
+	loaded, err = unmarshalEcParams(ecParams)
+	require.NoError(t, err)
+	assert.True(t, loaded == Secp256k1())
+
+	// Named curves parse as before.
+	parsed, err := ParseECParams(wellKnownCurves["P-384"].oid)
+	require.NoError(t, err)
+	assert.True(t, parsed == elliptic.P384())
+	_, err = ParseECParams(wellKnownCurves["B-163"].oid)
+	assert.Equal(t, errUnsupportedEllipticCurve, err)
+}
+
+func TestExplicitCurveCompressedBasePoint(t *testing.T) {
+	params := brainpoolP256t1()
+	curve, err := newExplicitCurve(params)
+	require.NoError(t, err)
+	ecParams, err := marshalExplicitECParams(curve, params)
+	require.NoError(t, err)
+
+	// Replace the uncompressed base point with its compressed form.
+	uncompressed := elliptic.Marshal(curve, params.Gx, params.Gy)
+	compressed := append([]byte{byte(2 + params.Gy.Bit(0))}, uncompressed[1:33]...)
+	raw, err := unmarshalExplicitECParams(ecParams)
+	require.NoError(t, err)
+	x, y, err := decodeECPoint(compressed, raw)
+	require.NoError(t, err)
+	assert.Zero(t, params.Gx.Cmp(x))
+	assert.Zero(t, params.Gy.Cmp(y))
+
+	_, _, err = decodeECPoint(compressed[:20], raw)
+	assert.True(t, errors.Is(err, errInvalidECParameters))
+}
+
+func TestExplicitCurveValidation(t *testing.T) {
+	tests := map[string]func(p *ECDomainParameters){
+		"missing":      func(p *ECDomainParameters) { p.N = nil },
+		"composite P":  func(p *ECDomainParameters) { p.P = new(big.Int).Add(p.P, big.NewInt(2)) },
+		"A too large":  func(p *ECDomainParameters) { p.A = p.P },
+		"zero B":       func(p *ECDomainParameters) { p.B = big.NewInt(0) },
+		"composite N":  func(p *ECDomainParameters) { p.N = new(big.Int).Add(p.N, big.NewInt(1)) },
+		"wrong N":      func(p *ECDomainParameters) { p.N = elliptic.P256().Params().N },
+		"off curve":    func(p *ECDomainParameters) { p.Gy = new(big.Int).Add(p.Gy, big.NewInt(1)) },
+		"bad cofactor": func(p *ECDomainParameters) { p.Cofactor = big.NewInt(0) },
+		"singular": func(p *ECDomainParameters) {
+			// 4(-3)³ + 27(2)² = 0
+			p.A = new(big.Int).Sub(p.P, big.NewInt(3))
+			p.B = big.NewInt(2)
+		},
+	}
+	for name, modify := range tests {
+		params := brainpoolP256t1()
+		modify(params)
+		_, err := NewExplicitCurve(params)
+		assert.True(t, errors.Is(err, errInvalidECParameters), "%s: %v", name, err)
+	}
+
+	_, err := NewExplicitCurve(nil)
+	assert.Error(t, err)
+	_, err = ParseECParams([]byte{0x30, 0x00})
+	assert.Error(t, err)
+}
+
+func TestCheckExplicitCurveInfo(t *testing.T) {
+	curve, err := NewExplicitCurve(brainpoolP256t1())
+	require.NoError(t, err)
+	w := curve.(*weierstrassCurve)
+
+	assert.NoError(t, checkECCurveInfo(curve, nil))
+	assert.NoError(t, checkECCurveInfo(curve, &pkcs11.MechanismInfo{MinKeySize: 256, MaxKeySize: 521,
+		Flags: pkcs11.CKF_EC_F_P | pkcs11.CKF_EC_ECPARAMETERS}))
+	for _, info := range []*pkcs11.MechanismInfo{
+		{MinKeySize: 384, MaxKeySize: 521},
+		{Flags: pkcs11.CKF_EC_F_2M | pkcs11.CKF_EC_ECPARAMETERS},
+		{Flags: pkcs11.CKF_EC_F_P | pkcs11.CKF_EC_NAMEDCURVE},
+	} {
+		err := checkExplicitCurveInfo(w, info)
+		assert.True(t, errors.Is(err, errUnsupportedEllipticCurve), "%+v: %v", info, err)
+	}
+}
+
+func TestECDSASignatureSizeUsesOrder(t *testing.T) {
+	// A curve whose order is shorter than its field, as with a cofactor greater than one.
+	curve := &weierstrassCurve{params: &elliptic.CurveParams{BitSize: 256, N: new(big.Int).Lsh(big.NewInt(1), 199)}}
+	assert.Equal(t, 25, ecdsaCurveSize(curve))
+}
+
+func TestHardExplicitCurve(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		curve, err := NewExplicitCurve(p256Parameters())
+		require.NoError(t, err)
+		if err := ctx.checkECCurve(curve); err != nil {
+			t.Skipf("token does not accept explicit parameters: %v", err)
+		}
+
+		id := randomBytes()
+		key, err := ctx.GenerateECDSAKeyPair(id, curve)
+		if isPKCS11Error(err, pkcs11.CKR_CURVE_NOT_SUPPORTED, pkcs11.CKR_DOMAIN_PARAMS_INVALID,
+			pkcs11.CKR_ATTRIBUTE_VALUE_INVALID, pkcs11.CKR_TEMPLATE_INCONSISTENT) {
+			t.Skipf("token rejected the explicit parameters: %v", err)
+		}
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		pub, ok := key.Public().(*ecdsa.PublicKey)
+		require.True(t, ok, "%T", key.Public())
+		assert.True(t, pub.Curve == elliptic.P256())
+
+		digest := sha256.Sum256(randomBytes())
+		sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+		require.NoError(t, verifyInSoftware(pub, digest[:], sig, crypto.SHA256))
+
+		found, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		assert.Equal(t, pub, found.Public())
+	})
+}
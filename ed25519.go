@@ -0,0 +1,303 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ckkECEdwards is the PKCS#11 3.0 key type of Edwards curve keys, which github.com/miekg/pkcs11 does not define. See
+// also ckmECEdwardsKeyPairGen and ckmEdDSA.
+const ckkECEdwards = 0x00000040
+
+// ed25519OID is the DER encoding of the OID of Ed25519 (RFC 8410), used as CKA_EC_PARAMS for generated keys.
+var ed25519OID = mustMarshal(asn1.ObjectIdentifier{1, 3, 101, 112})
+
+// ed25519CurveName is the DER encoding of the PrintableString "edwards25519", which PKCS#11 3.0 also permits as the
+// CKA_EC_PARAMS of an Ed25519 key.
+var ed25519CurveName = mustMarshal("edwards25519")
+
+// errUnsupportedEd25519Options is returned by Ed25519 and Ed448 signing unless opts.HashFunc() is zero.
+var errUnsupportedEd25519Options = errors.New("EdDSA signs the message itself: opts.HashFunc() must be zero")
+
+// errUnsupportedEdwardsCurve is returned for CKK_EC_EDWARDS keys whose CKA_EC_PARAMS name neither Ed25519 nor Ed448.
+var errUnsupportedEdwardsCurve = withMessage(errUnsupportedEllipticCurve, "Edwards curve is neither Ed25519 nor Ed448")
+
+// pkcs11PrivateKeyEd25519 contains a reference to a loaded PKCS#11 Ed25519 private key object.
+type pkcs11PrivateKeyEd25519 struct {
+	pkcs11PrivateKey
+}
+
+// isEd25519Params returns true if params, a CKA_EC_PARAMS value, names the Ed25519 curve.
+func isEd25519Params(params []byte) bool {
+	return bytes.Equal(params, ed25519OID) || bytes.Equal(params, ed25519CurveName)
+}
+
+// unmarshalEdwardsPoint decodes a CKA_EC_POINT value, which PKCS#11 3.0 defines as a DER-encoded OCTET STRING
+// holding the size-byte public key. Some tokens return the bare public key instead.
+func unmarshalEdwardsPoint(b []byte, size int) ([]byte, error) {
+	if len(b) == size {
+		return append([]byte(nil), b...), nil
+	}
+	var point []byte
+	extra, err := asn1.Unmarshal(b, &point)
+	if err != nil {
+		return nil, withMessage(err, "Edwards curve point is invalid ASN.1")
+	}
+	if len(extra) > 0 {
+		return nil, errors.New("unexpected data found when parsing Edwards curve point")
+	}
+	if len(point) != size {
+		return nil, fmt.Errorf("Edwards curve point is %d bytes, expected %d", len(point), size)
+	}
+	return point, nil
+}
+
+// Export the public key corresponding to a private Ed25519 or Ed448 key, as an ed25519.PublicKey or an
+// Ed448PublicKey. Both use CKK_EC_EDWARDS, so the curve is taken from CKA_EC_PARAMS.
+func exportEdwardsPublicKey(session *pkcs11Session, pubHandle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	}
+	attributes, err := session.ctx.GetAttributeValue(session.handle, pubHandle, template)
+	if err != nil {
+		return nil, err
+	}
+
+	switch params := attributes[0].Value; {
+	case isEd25519Params(params):
+		point, err := unmarshalEdwardsPoint(attributes[1].Value, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(point), nil
+	case isEd448Params(params):
+		point, err := unmarshalEdwardsPoint(attributes[1].Value, Ed448PublicKeySize)
+		if err != nil {
+			return nil, err
+		}
+		return Ed448PublicKey(point), nil
+	default:
+		return nil, errUnsupportedEdwardsCurve
+	}
+}
+
+// edwardsKeyIsEd448 reads CKA_EC_PARAMS from an Edwards curve key object, returning true for Ed448 and false for
+// Ed25519.
+func edwardsKeyIsEd448(session *pkcs11Session, handle pkcs11.ObjectHandle) (bool, error) {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil)}
+	attributes, err := session.ctx.GetAttributeValue(session.handle, handle, template)
+	if err != nil {
+		return false, err
+	}
+
+	switch params := attributes[0].Value; {
+	case isEd25519Params(params):
+		return false, nil
+	case isEd448Params(params):
+		return true, nil
+	default:
+		return false, errUnsupportedEdwardsCurve
+	}
+}
+
+// GenerateEd25519KeyPair creates an Ed25519 key pair on the token. The id parameter is used to set CKA_ID and must be
+// non-nil. The token must support CKM_EC_EDWARDS_KEY_PAIR_GEN and CKM_EDDSA, which PKCS#11 3.0 defines.
+func (c *Context) GenerateEd25519KeyPair(id []byte) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	public, err := NewAttributeSetWithID(id)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the AttributeSet to allow modifications.
+	private := public.Copy()
+
+	return c.GenerateEd25519KeyPairWithAttributes(public, private)
+}
+
+// GenerateEd25519KeyPairWithLabel creates an Ed25519 key pair on the token. The id and label parameters are used to
+// set CKA_ID and CKA_LABEL respectively and must be non-nil.
+func (c *Context) GenerateEd25519KeyPairWithLabel(id, label []byte) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	public, err := NewAttributeSetWithIDAndLabel(id, label)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the AttributeSet to allow modifications.
+	private := public.Copy()
+
+	return c.GenerateEd25519KeyPairWithAttributes(public, private)
+}
+
+// GenerateEd25519KeyPairWithAttributes generates an Ed25519 key pair on the token. After this function returns,
+// public and private will contain the attributes applied to the key pair. If required attributes are missing, they
+// will be set to a default value.
+//
+// An error wrapping ErrMechanismNotSupported is returned, without attempting generation, if the token does not
+// advertise CKM_EC_EDWARDS_KEY_PAIR_GEN.
+func (c *Context) GenerateEd25519KeyPairWithAttributes(public, private AttributeSet) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	return c.generateEdwardsKeyPair(public, private, ed25519OID, 255, func(key pkcs11PrivateKey) Signer {
+		return &pkcs11PrivateKeyEd25519{pkcs11PrivateKey: key}
+	})
+}
+
+// generateEdwardsKeyPair generates a CKK_EC_EDWARDS key pair with the given CKA_EC_PARAMS, for a curve of the given
+// size in bits. newKey wraps the private key in the Signer for the curve.
+func (c *Context) generateEdwardsKeyPair(public, private AttributeSet, params []byte, bits uint,
+	newKey func(key pkcs11PrivateKey) Signer) (Signer, error) {
+
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
+	if err := c.checkEdwardsCurve(bits); err != nil {
+		return nil, err
+	}
+
+	var k Signer
+	err := c.withSession(func(session *pkcs11Session) error {
+		public.AddIfNotPresent([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkECEdwards),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+		})
+		private.AddIfNotPresent([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		})
+
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmECEdwardsKeyPairGen, nil)}
+		pubHandle, privHandle, err := session.ctx.GenerateKeyPair(session.handle,
+			mech,
+			public.ToSlice(),
+			private.ToSlice())
+		if isPKCS11Error(err, pkcs11.CKR_CURVE_NOT_SUPPORTED, pkcs11.CKR_DOMAIN_PARAMS_INVALID) {
+			return withMessage(ErrMechanismNotSupported, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		pub, err := exportEdwardsPublicKey(session, pubHandle)
+		if err != nil {
+			return err
+		}
+		k = newKey(pkcs11PrivateKey{
+			pkcs11Object: pkcs11Object{
+				handle:  privHandle,
+				context: c,
+			},
+			pubKeyHandle: pubHandle,
+		})
+		key := tokenKeyOf(k)
+		c.retainPublicKey(key, pub)
+		c.pinKey(session, key, pub)
+		return nil
+	})
+	return k, err
+}
+
+// checkEdwardsCurve returns an error wrapping ErrMechanismNotSupported if the token does not advertise
+// CKM_EC_EDWARDS_KEY_PAIR_GEN, or reports key sizes that exclude a curve of the given size in bits.
+func (c *Context) checkEdwardsCurve(bits uint) error {
+	if !c.tokenSupports(ckmECEdwardsKeyPairGen, pkcs11.CKF_GENERATE_KEY_PAIR) {
+		return withMessage(ErrMechanismNotSupported, "CKM_EC_EDWARDS_KEY_PAIR_GEN")
+	}
+	info, err := c.ctx.GetMechanismInfo(c.slot, []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmECEdwardsKeyPairGen, nil)})
+	if err == nil && !edwardsCurveFitsMechanism(bits, &info) {
+		return withMessagef(ErrMechanismNotSupported, "CKM_EC_EDWARDS_KEY_PAIR_GEN for %d-bit curves "+
+			"(token supports %d to %d bits)", bits, info.MinKeySize, info.MaxKeySize)
+	}
+	return nil
+}
+
+// edwardsCurveFitsMechanism returns true if a token with the given CKM_EC_EDWARDS_KEY_PAIR_GEN mechanism information
+// can generate a key on a curve of the given size in bits. A bound the token does not report is not checked.
+func edwardsCurveFitsMechanism(bits uint, info *pkcs11.MechanismInfo) bool {
+	return (info.MinKeySize == 0 || bits >= info.MinKeySize) && (info.MaxKeySize == 0 || bits <= info.MaxKeySize)
+}
+
+// Sign signs message with an Ed25519 key, using CKM_EDDSA without a prehash, so that the signature is the same as
+// one made by ed25519.PrivateKey. As for ed25519.PrivateKey, the whole message is passed as digest and
+// opts.HashFunc() must be zero; Ed25519ph is not supported.
+//
+// This completes the implemention of crypto.Signer for pkcs11PrivateKeyEd25519.
+//
+// The rand argument is ignored. The return value is the 64-byte signature.
+func (signer *pkcs11PrivateKeyEd25519) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte,
+	error) {
+
+	return signer.signEdDSA(message, opts, nil)
+}
+
+// signEdDSA signs message with CKM_EDDSA and the given mechanism parameter, as described for the Sign method of
+// Ed25519 and Ed448 keys.
+func (k *pkcs11PrivateKey) signEdDSA(message []byte, opts crypto.SignerOpts, params []byte) ([]byte, error) {
+	if err := k.checkArchived("signing"); err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.HashFunc() != 0 {
+		return nil, errUnsupportedEd25519Options
+	}
+	if profile := k.profileFor(MechanismSign); profile != nil {
+		return k.signWithProfile(profile, message)
+	}
+
+	var signature []byte
+	err := k.withSession(func(session *pkcs11Session) (err error) {
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmEdDSA, params)}
+		if err = session.signInit(mech, k.handle); err != nil {
+			return err
+		}
+		if signature, err = session.sign(ckmEdDSA, message); err != nil {
+			return err
+		}
+		return k.checkSignatureLength(signature)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalEdwardsPoint(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := asn1.Marshal([]byte(pub))
+	require.NoError(t, err)
+
+	// Both the standard DER encoding and the bare key returned by some tokens are accepted
+	for _, encoded := range [][]byte{der, pub} {
+		point, err := unmarshalEdwardsPoint(encoded, ed25519.PublicKeySize)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(pub), point)
+	}
+
+	_, err = unmarshalEdwardsPoint(der[:len(der)-1], ed25519.PublicKeySize)
+	assert.Error(t, err)
+
+	_, err = unmarshalEdwardsPoint(der, Ed448PublicKeySize)
+	assert.Error(t, err)
+}
+
+func TestIsEd25519Params(t *testing.T) {
+	assert.True(t, isEd25519Params(ed25519OID))
+	assert.True(t, isEd25519Params(ed25519CurveName))
+	assert.False(t, isEd25519Params(mustMarshal(asn1.ObjectIdentifier{1, 3, 101, 113})))
+	assert.False(t, isEd25519Params(nil))
+}
+
+func TestHardEd25519(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		if !ctx.tokenSupports(ckmECEdwardsKeyPairGen, pkcs11.CKF_GENERATE_KEY_PAIR) {
+			_, err := ctx.GenerateEd25519KeyPair(randomBytes())
+			assert.True(t, errors.Is(err, ErrMechanismNotSupported), "%v", err)
+			t.Skip("token does not support CKM_EC_EDWARDS_KEY_PAIR_GEN")
+		}
+
+		id := randomBytes()
+		key, err := ctx.GenerateEd25519KeyPair(id)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		pub, ok := key.Public().(ed25519.PublicKey)
+		require.True(t, ok, "%T", key.Public())
+
+		message := randomBytes()
+		sig, err := key.Sign(rand.Reader, message, crypto.Hash(0))
+		require.NoError(t, err)
+		assert.Len(t, sig, ed25519.SignatureSize)
+		assert.True(t, ed25519.Verify(pub, message, sig))
+		require.NoError(t, VerifySignature(key, message, sig, crypto.Hash(0)))
+
+		_, err = key.Sign(rand.Reader, message, crypto.SHA256)
+		assert.Equal(t, errUnsupportedEd25519Options, err)
+
+		found, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, pub, found.Public())
+	})
+}
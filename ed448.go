@@ -0,0 +1,128 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/asn1"
+	"io"
+)
+
+const (
+	// Ed448PublicKeySize is the size, in bytes, of Ed448 public keys.
+	Ed448PublicKeySize = 57
+
+	// Ed448SignatureSize is the size, in bytes, of Ed448 signatures.
+	Ed448SignatureSize = 114
+)
+
+// Ed448PublicKey is an Ed448 public key (RFC 8032), which the standard library does not implement. It is returned
+// by the Public method of Ed448 key pairs. Signatures can be checked with VerifySignature, which uses the token.
+type Ed448PublicKey []byte
+
+// ed448OID is the DER encoding of the OID of Ed448 (RFC 8410), used as CKA_EC_PARAMS for generated keys.
+var ed448OID = mustMarshal(asn1.ObjectIdentifier{1, 3, 101, 113})
+
+// ed448CurveName is the DER encoding of the PrintableString "edwards448", which PKCS#11 3.0 also permits as the
+// CKA_EC_PARAMS of an Ed448 key.
+var ed448CurveName = mustMarshal("edwards448")
+
+// pkcs11PrivateKeyEd448 contains a reference to a loaded PKCS#11 Ed448 private key object.
+type pkcs11PrivateKeyEd448 struct {
+	pkcs11PrivateKey
+}
+
+// isEd448Params returns true if params, a CKA_EC_PARAMS value, names the Ed448 curve.
+func isEd448Params(params []byte) bool {
+	return bytes.Equal(params, ed448OID) || bytes.Equal(params, ed448CurveName)
+}
+
+// ed448Params marshals the CK_EDDSA_PARAMS selecting pure Ed448 without a context: CK_BBOOL phFlag, padded to the
+// alignment of the following CK_ULONG ulContextDataLen, and a null pContextData. Unlike Ed25519, PKCS#11 requires
+// the parameter for Ed448.
+func ed448Params() []byte {
+	phFlag := make([]byte, len(ulongToBytes(0)))
+	return concat(phFlag, ulongToBytes(0), ulongToBytes(0))
+}
+
+// GenerateEd448KeyPair creates an Ed448 key pair on the token. The id parameter is used to set CKA_ID and must be
+// non-nil. An error wrapping ErrMechanismNotSupported is returned if the token cannot generate Ed448 keys, for
+// instance because it only supports Ed25519.
+func (c *Context) GenerateEd448KeyPair(id []byte) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	public, err := NewAttributeSetWithID(id)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the AttributeSet to allow modifications.
+	private := public.Copy()
+
+	return c.GenerateEd448KeyPairWithAttributes(public, private)
+}
+
+// GenerateEd448KeyPairWithLabel creates an Ed448 key pair on the token. The id and label parameters are used to set
+// CKA_ID and CKA_LABEL respectively and must be non-nil.
+func (c *Context) GenerateEd448KeyPairWithLabel(id, label []byte) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	public, err := NewAttributeSetWithIDAndLabel(id, label)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the AttributeSet to allow modifications.
+	private := public.Copy()
+
+	return c.GenerateEd448KeyPairWithAttributes(public, private)
+}
+
+// GenerateEd448KeyPairWithAttributes generates an Ed448 key pair on the token. After this function returns, public
+// and private will contain the attributes applied to the key pair. If required attributes are missing, they will be
+// set to a default value.
+//
+// An error wrapping ErrMechanismNotSupported is returned, without attempting generation, if the token does not
+// advertise CKM_EC_EDWARDS_KEY_PAIR_GEN or reports a maximum key size below 448 bits. It is also returned if the
+// token rejects the Ed448 curve when generating.
+func (c *Context) GenerateEd448KeyPairWithAttributes(public, private AttributeSet) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	return c.generateEdwardsKeyPair(public, private, ed448OID, 448, func(key pkcs11PrivateKey) Signer {
+		return &pkcs11PrivateKeyEd448{pkcs11PrivateKey: key}
+	})
+}
+
+// Sign signs message with an Ed448 key, using CKM_EDDSA for pure Ed448 with an empty context. As for Ed25519, the
+// whole message is passed as digest and opts.HashFunc() must be zero; Ed448ph is not supported.
+//
+// This completes the implemention of crypto.Signer for pkcs11PrivateKeyEd448.
+//
+// The rand argument is ignored. The return value is the 114-byte signature.
+func (signer *pkcs11PrivateKeyEd448) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return signer.signEdDSA(message, opts, ed448Params())
+}
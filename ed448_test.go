@@ -0,0 +1,95 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEd448Params(t *testing.T) {
+	params := ed448Params()
+	assert.Len(t, params, 3*len(ulongToBytes(0)))
+	assert.Equal(t, make([]byte, len(params)), params)
+
+	assert.True(t, isEd448Params(ed448OID))
+	assert.True(t, isEd448Params(ed448CurveName))
+	assert.False(t, isEd448Params(ed25519OID))
+}
+
+func TestEdwardsCurveFitsMechanism(t *testing.T) {
+	ed25519Only := &pkcs11.MechanismInfo{MinKeySize: 255, MaxKeySize: 255}
+	assert.True(t, edwardsCurveFitsMechanism(255, ed25519Only))
+	assert.False(t, edwardsCurveFitsMechanism(448, ed25519Only))
+
+	both := &pkcs11.MechanismInfo{MinKeySize: 255, MaxKeySize: 448}
+	assert.True(t, edwardsCurveFitsMechanism(255, both))
+	assert.True(t, edwardsCurveFitsMechanism(448, both))
+
+	assert.True(t, edwardsCurveFitsMechanism(448, &pkcs11.MechanismInfo{}))
+}
+
+func TestHardEd448(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		if err := ctx.checkEdwardsCurve(448); err != nil {
+			_, err := ctx.GenerateEd448KeyPair(randomBytes())
+			assert.True(t, errors.Is(err, ErrMechanismNotSupported), "%v", err)
+			t.Skip("token does not support Ed448")
+		}
+
+		id := randomBytes()
+		key, err := ctx.GenerateEd448KeyPair(id)
+		if errors.Is(err, ErrMechanismNotSupported) {
+			t.Skip("token rejected the Ed448 curve")
+		}
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		pub, ok := key.Public().(Ed448PublicKey)
+		require.True(t, ok, "%T", key.Public())
+		assert.Len(t, pub, Ed448PublicKeySize)
+
+		message := randomBytes()
+		sig, err := key.Sign(rand.Reader, message, crypto.Hash(0))
+		require.NoError(t, err)
+		assert.Len(t, sig, Ed448SignatureSize)
+		require.NoError(t, VerifySignature(key, message, sig, crypto.Hash(0)))
+
+		sig[0] ^= 1
+		assert.Error(t, VerifySignature(key, message, sig, crypto.Hash(0)))
+
+		_, err = key.Sign(rand.Reader, message, crypto.SHA256)
+		assert.Equal(t, errUnsupportedEd25519Options, err)
+
+		// Both curves use CKK_EC_EDWARDS, so finding the key relies on CKA_EC_PARAMS.
+		found, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		require.IsType(t, &pkcs11PrivateKeyEd448{}, found)
+		assert.Equal(t, pub, found.Public())
+	})
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"github.com/miekg/pkcs11"
+)
+
+// redactedPin replaces a configured PIN in EffectiveConfig.
+const redactedPin = "[redacted]"
+
+// callbackValue stands in for function and reader fields of Config in EffectiveConfig.Callbacks.
+const callbackValue = "callback"
+
+// EffectiveConfig describes the configuration a Context is using, including the values crypto11 chose rather than
+// the caller. It is recorded by Configure as each decision is made and returned by Context.EffectiveConfig, and is
+// intended for diagnostics; it marshals to JSON for inclusion in support bundles.
+type EffectiveConfig struct {
+	// Config is a copy of the configuration with the defaults Configure filled in. Pin is replaced by "[redacted]"
+	// if it was set, and the function and reader fields are cleared; see Callbacks. It cannot be used to configure
+	// another Context unless the Pin is restored.
+	Config Config `json:"config"`
+
+	// Defaulted lists the Config fields which were zero and were given a default value.
+	Defaulted []string `json:"defaulted,omitempty"`
+
+	// Callbacks maps the names of the function and reader fields of Config that were set, such as SessionEventFunc,
+	// to "callback".
+	Callbacks map[string]string `json:"callbacks,omitempty"`
+
+	// LibraryInitialized is true if this Context initialized the PKCS#11 library, and false if it shares the library
+	// with an earlier Context.
+	LibraryInitialized bool `json:"libraryInitialized"`
+
+	// Slot is the slot containing the token.
+	Slot uint `json:"slot"`
+
+	// TokenSelectedBy is the Config field that selected the token: "TokenSerial", "TokenLabel" or "SlotNumber".
+	TokenSelectedBy string `json:"tokenSelectedBy"`
+
+	// TokenLabel and TokenSerial identify the token that was selected.
+	TokenLabel  string `json:"tokenLabel"`
+	TokenSerial string `json:"tokenSerial"`
+
+	// PinSource is "config" if the PIN was taken from Config.Pin, "empty" if an empty PIN was used because
+	// AllowEmptyPin is set, "sessionSetup" if Config.SessionSetup logs in instead, or "none" if there was no login.
+	PinSource string `json:"pinSource"`
+
+	// LoggedIn is true if Configure logged into the token.
+	LoggedIn bool `json:"loggedIn"`
+
+	// MaxSessions is the number of sessions the Context may open, including the persistent session. It is
+	// Config.MaxSessions, lowered to the token's maximum if that is smaller, in which case MaxSessionsLimitedByToken
+	// is true.
+	MaxSessions               int  `json:"maxSessions"`
+	MaxSessionsLimitedByToken bool `json:"maxSessionsLimitedByToken"`
+
+	// SessionFlags lists the flags sessions are opened with.
+	SessionFlags []string `json:"sessionFlags"`
+}
+
+// EffectiveConfig returns a copy of the configuration the Context is using, with secrets removed.
+func (c *Context) EffectiveConfig() EffectiveConfig {
+	effective := c.effective
+	effective.Config = sanitizeConfig(&c.effective.Config)
+	effective.Defaulted = append([]string(nil), c.effective.Defaulted...)
+	effective.SessionFlags = append([]string(nil), c.effective.SessionFlags...)
+	if c.effective.Callbacks != nil {
+		effective.Callbacks = make(map[string]string, len(c.effective.Callbacks))
+		for field, value := range c.effective.Callbacks {
+			effective.Callbacks[field] = value
+		}
+	}
+	return effective
+}
+
+// recordConfig stores a sanitized copy of config, which must already have its defaults applied, and notes which of
+// its callbacks are set.
+func (e *EffectiveConfig) recordConfig(config *Config) {
+	e.Config = sanitizeConfig(config)
+
+	for field, set := range map[string]bool{
+		"SessionEventFunc": config.SessionEventFunc != nil,
+		"KeyWarningFunc":   config.KeyWarningFunc != nil,
+		"OnSaturation":     config.OnSaturation != nil,
+		"Rand":             config.Rand != nil,
+		"SessionSetup":     config.SessionSetup != nil,
+	} {
+		if !set {
+			continue
+		}
+		if e.Callbacks == nil {
+			e.Callbacks = map[string]string{}
+		}
+		e.Callbacks[field] = callbackValue
+	}
+}
+
+// recordToken notes which token Configure selected and how.
+func (e *EffectiveConfig) recordToken(config *Config, slot uint, tokenInfo *pkcs11.TokenInfo) {
+	e.Slot = slot
+	e.TokenLabel = tokenInfo.Label
+	e.TokenSerial = tokenInfo.SerialNumber
+	switch {
+	case config.SlotNumber != nil:
+		e.TokenSelectedBy = "SlotNumber"
+	case config.TokenSerial != "":
+		e.TokenSelectedBy = "TokenSerial"
+	default:
+		e.TokenSelectedBy = "TokenLabel"
+	}
+}
+
+// recordLogin notes whether Configure logs in, and with which PIN.
+func (e *EffectiveConfig) recordLogin(config *Config, login bool) {
+	e.LoggedIn = login
+	switch {
+	case config.SessionSetupReplacesLogin:
+		e.PinSource = "sessionSetup"
+	case !login:
+		e.PinSource = "none"
+	case config.Pin != "":
+		e.PinSource = "config"
+	default:
+		e.PinSource = "empty"
+	}
+}
+
+// sanitizeConfig returns a copy of config that shares no memory with it, with the PIN redacted and the function and
+// reader fields cleared. Sanitizing an already sanitized copy changes nothing.
+func sanitizeConfig(config *Config) Config {
+	sanitized := *config
+	if sanitized.Pin != "" {
+		sanitized.Pin = redactedPin
+	}
+	if config.SlotNumber != nil {
+		slot := *config.SlotNumber
+		sanitized.SlotNumber = &slot
+	}
+	sanitized.MechanismProfiles = append([]MechanismProfile(nil), config.MechanismProfiles...)
+	sanitized.SessionEventFunc = nil
+	sanitized.KeyWarningFunc = nil
+	sanitized.OnSaturation = nil
+	sanitized.Rand = nil
+	sanitized.SessionSetup = nil
+	return sanitized
+}
+
+// sessionFlagNames lists the names of the CKF_ session flags set in flags.
+func sessionFlagNames(flags uint) []string {
+	var names []string
+	for _, flag := range []struct {
+		value uint
+		name  string
+	}{
+		{pkcs11.CKF_RW_SESSION, "CKF_RW_SESSION"},
+		{pkcs11.CKF_SERIAL_SESSION, "CKF_SERIAL_SESSION"},
+	} {
+		if flags&flag.value != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	require.NotEmpty(t, config.Pin)
+	pin := config.Pin
+	config.MaxSessions = 0
+	config.GCMIVLength = 0
+	config.SessionEventFunc = func(SessionEvent) {}
+	config.KeyWarningFunc = func(KeyWarning) {}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	effective := ctx.EffectiveConfig()
+	assert.Equal(t, redactedPin, effective.Config.Pin)
+	assert.Nil(t, effective.Config.SessionEventFunc)
+	assert.Nil(t, effective.Config.KeyWarningFunc)
+	assert.Equal(t, map[string]string{"SessionEventFunc": "callback", "KeyWarningFunc": "callback"},
+		effective.Callbacks)
+	assert.Contains(t, effective.Defaulted, "MaxSessions")
+	assert.Contains(t, effective.Defaulted, "GCMIVLength")
+	assert.Equal(t, DefaultMaxSessions, effective.Config.MaxSessions)
+	assert.Equal(t, DefaultGCMIVLength, effective.Config.GCMIVLength)
+
+	assert.Equal(t, ctx.slot, effective.Slot)
+	assert.Equal(t, ctx.token.Label, effective.TokenLabel)
+	assert.Equal(t, ctx.token.SerialNumber, effective.TokenSerial)
+	assert.Equal(t, "TokenLabel", effective.TokenSelectedBy)
+	assert.Equal(t, "config", effective.PinSource)
+	assert.True(t, effective.LoggedIn)
+	assert.Equal(t, []string{"CKF_RW_SESSION", "CKF_SERIAL_SESSION"}, effective.SessionFlags)
+	assert.True(t, effective.MaxSessions > 1 && effective.MaxSessions <= DefaultMaxSessions)
+	assert.Equal(t, effective.MaxSessions < DefaultMaxSessions, effective.MaxSessionsLimitedByToken)
+
+	// The caller's Config and later changes to it do not leak into the copy.
+	assert.Equal(t, pin, config.Pin)
+	config.MaxSessions = 7
+	effective.Defaulted[0] = "changed"
+	assert.Equal(t, DefaultMaxSessions, ctx.EffectiveConfig().Config.MaxSessions)
+	assert.NotEqual(t, "changed", ctx.EffectiveConfig().Defaulted[0])
+
+	data, err := json.Marshal(effective)
+	require.NoError(t, err)
+	assert.False(t, strings.Contains(string(data), pin), "%s", data)
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "config", decoded["pinSource"])
+	assert.Equal(t, redactedPin, decoded["config"].(map[string]interface{})["Pin"])
+}
+
+func TestEffectiveConfigPinSource(t *testing.T) {
+	for _, test := range []struct {
+		config   Config
+		login    bool
+		expected string
+	}{
+		{Config{Pin: "secret"}, true, "config"},
+		{Config{AllowEmptyPin: true}, true, "empty"},
+		{Config{PublicOnly: true}, false, "none"},
+	} {
+		var effective EffectiveConfig
+		effective.recordLogin(&test.config, test.login)
+		assert.Equal(t, test.expected, effective.PinSource)
+		assert.Equal(t, test.login, effective.LoggedIn)
+	}
+
+	slot := 3
+	sanitized := sanitizeConfig(&Config{SlotNumber: &slot})
+	assert.Empty(t, sanitized.Pin)
+	slot = 4
+	assert.Equal(t, 3, *sanitized.SlotNumber)
+}
@@ -0,0 +1,345 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// enumNames holds the string forms of an enumerated type, indexed by value minus the value of the first constant.
+type enumNames struct {
+	typeName string
+	first    int
+	names    []string
+}
+
+// format returns the string form of v, or TypeName(v) if v is not a defined value.
+func (e enumNames) format(v int) string {
+	if i := v - e.first; i >= 0 && i < len(e.names) {
+		return e.names[i]
+	}
+	return e.typeName + "(" + strconv.Itoa(v) + ")"
+}
+
+// parse returns the value whose string form is s, ignoring case and surrounding spaces.
+func (e enumNames) parse(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range e.names {
+		if s == name {
+			return e.first + i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown %s %q", e.typeName, s)
+}
+
+var paddingModeNames = enumNames{"PaddingMode", int(PaddingNone), []string{"none", "pkcs"}}
+
+// String returns "none" or "pkcs".
+func (m PaddingMode) String() string {
+	return paddingModeNames.format(int(m))
+}
+
+// ParsePaddingMode returns the PaddingMode named by s, as returned by PaddingMode.String.
+func ParsePaddingMode(s string) (PaddingMode, error) {
+	v, err := paddingModeNames.parse(s)
+	return PaddingMode(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON configuration uses the string form.
+func (m PaddingMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *PaddingMode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParsePaddingMode(string(text))
+	return
+}
+
+// keyPurposeFlags are the components of a KeyPurpose, which combine as a bitmask: the value of names[i] is 1<<i.
+var keyPurposeFlags = enumNames{"KeyPurpose", 0, []string{"sign", "decrypt", "unwrap"}}
+
+// String returns the '|'-separated names of the purposes in p, from "sign", "decrypt" and "unwrap", for instance
+// "sign|decrypt".
+func (p KeyPurpose) String() string {
+	if p <= 0 || p&^keyPurposeAll != 0 {
+		return keyPurposeFlags.typeName + "(" + strconv.Itoa(int(p)) + ")"
+	}
+	var names []string
+	for i, name := range keyPurposeFlags.names {
+		if p&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// ParseKeyPurpose returns the KeyPurpose named by s. s is a '|'-separated list of "sign", "decrypt" and "unwrap", as
+// returned by KeyPurpose.String.
+func ParseKeyPurpose(s string) (KeyPurpose, error) {
+	var purpose KeyPurpose
+	for _, part := range strings.Split(s, "|") {
+		v, err := keyPurposeFlags.parse(part)
+		if err != nil {
+			return 0, err
+		}
+		purpose |= 1 << uint(v)
+	}
+	return purpose, nil
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON configuration uses the string form.
+func (p KeyPurpose) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *KeyPurpose) UnmarshalText(text []byte) (err error) {
+	*p, err = ParseKeyPurpose(string(text))
+	return
+}
+
+var idConflictPolicyNames = enumNames{"IDConflictPolicy", int(IDConflictFail), []string{"fail", "skip", "replace"}}
+
+// String returns "fail", "skip" or "replace".
+func (p IDConflictPolicy) String() string {
+	return idConflictPolicyNames.format(int(p))
+}
+
+// ParseIDConflictPolicy returns the IDConflictPolicy named by s, as returned by IDConflictPolicy.String.
+func ParseIDConflictPolicy(s string) (IDConflictPolicy, error) {
+	v, err := idConflictPolicyNames.parse(s)
+	return IDConflictPolicy(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON configuration uses the string form.
+func (p IDConflictPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *IDConflictPolicy) UnmarshalText(text []byte) (err error) {
+	*p, err = ParseIDConflictPolicy(string(text))
+	return
+}
+
+var importOutcomeNames = enumNames{"ImportOutcome", int(ImportCreated), []string{"created", "skipped", "replaced"}}
+
+// String returns "created", "skipped" or "replaced".
+func (o ImportOutcome) String() string {
+	return importOutcomeNames.format(int(o))
+}
+
+// ParseImportOutcome returns the ImportOutcome named by s, as returned by ImportOutcome.String.
+func ParseImportOutcome(s string) (ImportOutcome, error) {
+	v, err := importOutcomeNames.parse(s)
+	return ImportOutcome(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON output uses the string form.
+func (o ImportOutcome) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (o *ImportOutcome) UnmarshalText(text []byte) (err error) {
+	*o, err = ParseImportOutcome(string(text))
+	return
+}
+
+var sessionEventTypeNames = enumNames{"SessionEventType", int(SessionCreated),
+	[]string{"created", "create-failed", "closed", "recycled", "login"}}
+
+// String returns "created", "create-failed", "closed", "recycled" or "login".
+func (t SessionEventType) String() string {
+	return sessionEventTypeNames.format(int(t))
+}
+
+// ParseSessionEventType returns the SessionEventType named by s, as returned by SessionEventType.String.
+func ParseSessionEventType(s string) (SessionEventType, error) {
+	v, err := sessionEventTypeNames.parse(s)
+	return SessionEventType(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON output uses the string form.
+func (t SessionEventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *SessionEventType) UnmarshalText(text []byte) (err error) {
+	*t, err = ParseSessionEventType(string(text))
+	return
+}
+
+var keyWarningTypeNames = enumNames{"KeyWarningType", int(DualUseKeyGenerated),
+	[]string{"dual-use-key", "object-reaped", "allowed-mechanisms-rejected", "rsa-exponent-assumed"}}
+
+// String returns "dual-use-key", "object-reaped", "allowed-mechanisms-rejected" or "rsa-exponent-assumed".
+func (t KeyWarningType) String() string {
+	return keyWarningTypeNames.format(int(t))
+}
+
+// ParseKeyWarningType returns the KeyWarningType named by s, as returned by KeyWarningType.String.
+func ParseKeyWarningType(s string) (KeyWarningType, error) {
+	v, err := keyWarningTypeNames.parse(s)
+	return KeyWarningType(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON output uses the string form.
+func (t KeyWarningType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *KeyWarningType) UnmarshalText(text []byte) (err error) {
+	*t, err = ParseKeyWarningType(string(text))
+	return
+}
+
+var mechanismOperationNames = enumNames{"MechanismOperation", int(MechanismSign), []string{"sign", "decrypt"}}
+
+// String returns "sign" or "decrypt".
+func (o MechanismOperation) String() string {
+	return mechanismOperationNames.format(int(o))
+}
+
+// ParseMechanismOperation returns the MechanismOperation named by s, as returned by MechanismOperation.String.
+func ParseMechanismOperation(s string) (MechanismOperation, error) {
+	v, err := mechanismOperationNames.parse(s)
+	return MechanismOperation(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON configuration uses the string form.
+func (o MechanismOperation) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (o *MechanismOperation) UnmarshalText(text []byte) (err error) {
+	*o, err = ParseMechanismOperation(string(text))
+	return
+}
+
+var shredAssuranceNames = enumNames{"ShredAssurance", int(ShredDestroyed),
+	[]string{"destroyed", "destroyed-and-verified", "vendor-assured"}}
+
+// String returns "destroyed", "destroyed-and-verified" or "vendor-assured".
+func (a ShredAssurance) String() string {
+	return shredAssuranceNames.format(int(a))
+}
+
+// ParseShredAssurance returns the ShredAssurance named by s, as returned by ShredAssurance.String.
+func ParseShredAssurance(s string) (ShredAssurance, error) {
+	v, err := shredAssuranceNames.parse(s)
+	return ShredAssurance(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON audit records use the string form.
+func (a ShredAssurance) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (a *ShredAssurance) UnmarshalText(text []byte) (err error) {
+	*a, err = ParseShredAssurance(string(text))
+	return
+}
+
+var ecdsaSignatureEncodingNames = enumNames{"ECDSASignatureEncoding", int(ECDSASignatureAuto),
+	[]string{"auto", "der", "raw"}}
+
+// String returns "auto", "der" or "raw".
+func (e ECDSASignatureEncoding) String() string {
+	return ecdsaSignatureEncodingNames.format(int(e))
+}
+
+// ParseECDSASignatureEncoding returns the ECDSASignatureEncoding named by s, as returned by
+// ECDSASignatureEncoding.String.
+func ParseECDSASignatureEncoding(s string) (ECDSASignatureEncoding, error) {
+	v, err := ecdsaSignatureEncodingNames.parse(s)
+	return ECDSASignatureEncoding(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON configuration uses the string form.
+func (e ECDSASignatureEncoding) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (e *ECDSASignatureEncoding) UnmarshalText(text []byte) (err error) {
+	*e, err = ParseECDSASignatureEncoding(string(text))
+	return
+}
+
+var lockingModeNames = enumNames{"LockingMode", int(LockingOS), []string{"os", "mutexes", "none"}}
+
+// String returns "os", "mutexes" or "none".
+func (m LockingMode) String() string {
+	return lockingModeNames.format(int(m))
+}
+
+// ParseLockingMode returns the LockingMode named by s, as returned by LockingMode.String.
+func ParseLockingMode(s string) (LockingMode, error) {
+	v, err := lockingModeNames.parse(s)
+	return LockingMode(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON configuration uses the string form.
+func (m LockingMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *LockingMode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseLockingMode(string(text))
+	return
+}
+
+var certificateBindingStatusNames = enumNames{"CertificateBindingStatus", int(BindingOK),
+	[]string{"ok", "key-mismatch", "expired", "not-yet-valid", "missing-certificate", "missing-key", "unreadable"}}
+
+// String returns "ok", "key-mismatch", "expired", "not-yet-valid", "missing-certificate", "missing-key" or
+// "unreadable".
+func (s CertificateBindingStatus) String() string {
+	return certificateBindingStatusNames.format(int(s))
+}
+
+// ParseCertificateBindingStatus returns the CertificateBindingStatus named by s, as returned by
+// CertificateBindingStatus.String.
+func ParseCertificateBindingStatus(s string) (CertificateBindingStatus, error) {
+	v, err := certificateBindingStatusNames.parse(s)
+	return CertificateBindingStatus(v), err
+}
+
+// MarshalText implements encoding.TextMarshaler, so that JSON output uses the string form.
+func (s CertificateBindingStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *CertificateBindingStatus) UnmarshalText(text []byte) (err error) {
+	*s, err = ParseCertificateBindingStatus(string(text))
+	return
+}
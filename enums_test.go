@@ -0,0 +1,124 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnumStrings(t *testing.T) {
+	assert.Equal(t, "pkcs", PaddingPKCS.String())
+	assert.Equal(t, "sign", KeyPurposeSigning.String())
+	assert.Equal(t, "sign|decrypt", KeyPurposeBoth.String())
+	assert.Equal(t, "decrypt|unwrap", (KeyPurposeDecryption | KeyPurposeUnwrapping).String())
+	assert.Equal(t, "replace", IDConflictReplace.String())
+	assert.Equal(t, "skipped", ImportSkipped.String())
+	assert.Equal(t, "recycled", SessionRecycled.String())
+	assert.Equal(t, "raw", ECDSASignatureRaw.String())
+	assert.Equal(t, "mutexes", LockingMutexes.String())
+
+	assert.Equal(t, "KeyPurpose(0)", KeyPurpose(0).String())
+	assert.Equal(t, "KeyPurpose(8)", KeyPurpose(8).String())
+	assert.Equal(t, "PaddingMode(9)", PaddingMode(9).String())
+}
+
+func TestEnumParseRoundTrip(t *testing.T) {
+	for _, m := range []PaddingMode{PaddingNone, PaddingPKCS} {
+		parsed, err := ParsePaddingMode(m.String())
+		require.NoError(t, err)
+		assert.Equal(t, m, parsed)
+	}
+	for _, p := range []KeyPurpose{KeyPurposeSigning, KeyPurposeDecryption, KeyPurposeBoth, KeyPurposeUnwrapping,
+		KeyPurposeSigning | KeyPurposeUnwrapping, keyPurposeAll} {
+		parsed, err := ParseKeyPurpose(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	for _, p := range []IDConflictPolicy{IDConflictFail, IDConflictSkip, IDConflictReplace} {
+		parsed, err := ParseIDConflictPolicy(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	for _, o := range []ImportOutcome{ImportCreated, ImportSkipped, ImportReplaced} {
+		parsed, err := ParseImportOutcome(o.String())
+		require.NoError(t, err)
+		assert.Equal(t, o, parsed)
+	}
+	for e := SessionCreated; e <= LoginPerformed; e++ {
+		parsed, err := ParseSessionEventType(e.String())
+		require.NoError(t, err)
+		assert.Equal(t, e, parsed)
+	}
+	for w := DualUseKeyGenerated; w <= RSAExponentAssumed; w++ {
+		parsed, err := ParseKeyWarningType(w.String())
+		require.NoError(t, err)
+		assert.Equal(t, w, parsed)
+	}
+	for e := ECDSASignatureAuto; e <= ECDSASignatureRaw; e++ {
+		parsed, err := ParseECDSASignatureEncoding(e.String())
+		require.NoError(t, err)
+		assert.Equal(t, e, parsed)
+	}
+	for m := LockingOS; m <= LockingNone; m++ {
+		parsed, err := ParseLockingMode(m.String())
+		require.NoError(t, err)
+		assert.Equal(t, m, parsed)
+	}
+	for s := BindingOK; s <= BindingUnreadable; s++ {
+		parsed, err := ParseCertificateBindingStatus(s.String())
+		require.NoError(t, err)
+		assert.Equal(t, s, parsed)
+	}
+}
+
+func TestParseKeyPurpose(t *testing.T) {
+	p, err := ParseKeyPurpose(" Decrypt | SIGN ")
+	require.NoError(t, err)
+	assert.Equal(t, KeyPurposeBoth, p)
+
+	_, err = ParseKeyPurpose("sign|derive")
+	assert.Error(t, err)
+
+	_, err = ParseKeyPurpose("")
+	assert.Error(t, err)
+}
+
+func TestEnumJSON(t *testing.T) {
+	type options struct {
+		Purpose KeyPurpose
+		Policy  IDConflictPolicy
+	}
+
+	var o options
+	require.NoError(t, json.Unmarshal([]byte(`{"Purpose":"sign|decrypt","Policy":"skip"}`), &o))
+	assert.Equal(t, options{KeyPurposeBoth, IDConflictSkip}, o)
+
+	data, err := json.Marshal(o)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"Purpose":"sign|decrypt","Policy":"skip"}`, string(data))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"Policy":"overwrite"}`), &o))
+}
@@ -0,0 +1,333 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// EnvelopeVersion1 is the Version of envelopes made by EncryptEnvelope. The data key is a 256-bit AES key, read from
+// the token random number generator. The payload is encrypted with AES-GCM under the data key, with a 12-byte nonce
+// and the additional data "crypto11 envelope v1". The data key is encrypted with RSA-OAEP using SHA-256 for both the
+// hash and MGF1, and an empty label.
+const EnvelopeVersion1 = 1
+
+// envelopeKeySize is the length of the data key of a version 1 envelope.
+const envelopeKeySize = 32
+
+// envelopeNonceSize is the length of the AES-GCM nonce of a version 1 envelope.
+const envelopeNonceSize = 12
+
+// envelopeAdditionalData is the AES-GCM additional data of a version 1 envelope, which binds the version to the
+// ciphertext.
+var envelopeAdditionalData = []byte("crypto11 envelope v1")
+
+// envelopeOAEPOptions are the RSA-OAEP options protecting the data key of a version 1 envelope.
+var envelopeOAEPOptions = &rsa.OAEPOptions{Hash: crypto.SHA256}
+
+// ErrEnvelopeVersion is returned by DecryptEnvelope for an envelope with a Version it does not support.
+var ErrEnvelopeVersion = errors.New("unsupported envelope version")
+
+// Envelope is a payload encrypted by EncryptEnvelope. The JSON encoding of an Envelope is a stable format for
+// storing it; its fields are interpreted according to Version, see EnvelopeVersion1.
+type Envelope struct {
+	// Version identifies the algorithms used to make the envelope.
+	Version int `json:"version"`
+
+	// WrappedKey is the data key, encrypted with the RSA key.
+	WrappedKey []byte `json:"wrappedKey"`
+
+	// Nonce is the AES-GCM nonce.
+	Nonce []byte `json:"nonce"`
+
+	// Ciphertext is the payload encrypted with the data key, followed by the AES-GCM tag.
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// EncryptEnvelope encrypts plaintext of any length for the holder of an RSA private key, returning a version 1
+// Envelope (see EnvelopeVersion1). The data key and nonce are read from the token, the payload is encrypted in
+// software and the data key is wrapped with key, which is either an *rsa.PublicKey or an Encrypter such as an RSA key
+// pair or PublicKey, which encrypt on the token. DecryptEnvelope recovers the plaintext.
+//
+// The payload is encrypted in software, so EncryptEnvelope fails if Config.ForbidSoftwareFallback is set.
+func (c *Context) EncryptEnvelope(key interface{}, plaintext []byte) (*Envelope, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	// Check the key before drawing on the token.
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k == nil || k.N == nil {
+			return nil, errMalformedRSAPublicKey
+		}
+	case Encrypter:
+		if isNilPointer(k) {
+			return nil, errors.New("envelope key is nil")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported envelope key type: %T", key)
+	}
+
+	random, err := c.NewRandomReader()
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, envelopeKeySize)
+	defer zeroize(dataKey)
+	if _, err = io.ReadFull(random, dataKey); err != nil {
+		return nil, withMessage(err, "generating data key")
+	}
+
+	aead, err := c.envelopeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(random, nonce); err != nil {
+		return nil, withMessage(err, "generating nonce")
+	}
+
+	var wrappedKey []byte
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		wrappedKey, err = rsa.EncryptOAEP(envelopeOAEPOptions.Hash.New(), c.randReader(), k, dataKey, nil)
+	case Encrypter:
+		wrappedKey, err = k.Encrypt(dataKey, envelopeOAEPOptions)
+	}
+	if err != nil {
+		return nil, withMessage(err, "wrapping data key")
+	}
+
+	return &Envelope{
+		Version:    EnvelopeVersion1,
+		WrappedKey: wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, envelopeAdditionalData),
+	}, nil
+}
+
+// DecryptEnvelope returns the plaintext of an Envelope made by EncryptEnvelope, unwrapping the data key with key,
+// which may be an RSA key pair on the token or any other crypto.Decrypter. An error wrapping ErrEnvelopeVersion is
+// returned if the envelope's Version is not supported.
+//
+// The payload is decrypted in software, so DecryptEnvelope fails if Config.ForbidSoftwareFallback is set. To keep the
+// data key on the token, use UnwrapEnvelopeKey with EnvelopeKeyOptions.KeepOnToken.
+func (c *Context) DecryptEnvelope(key crypto.Decrypter, envelope *Envelope) ([]byte, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+	if envelope == nil {
+		return nil, errors.New("envelope is nil")
+	}
+	if envelope.Version != EnvelopeVersion1 {
+		return nil, withMessagef(ErrEnvelopeVersion, "version %d", envelope.Version)
+	}
+
+	envelopeCipher, err := c.decryptEnvelopeKey(key, envelope.WrappedKey, envelopeOAEPOptions)
+	if err != nil {
+		return nil, err
+	}
+	return envelopeCipher.OpenEnvelope(envelope)
+}
+
+// decryptEnvelopeKey decrypts wrappedKey with key and returns a cipher holding the data key in memory.
+func (c *Context) decryptEnvelopeKey(key crypto.Decrypter, wrappedKey []byte, oaep *rsa.OAEPOptions) (
+	*EnvelopeCipher, error) {
+
+	dataKey, err := key.Decrypt(nil, wrappedKey, oaep)
+	if err != nil {
+		return nil, withMessage(err, "unwrapping data key")
+	}
+	defer zeroize(dataKey)
+	if len(dataKey) != envelopeKeySize {
+		return nil, fmt.Errorf("unwrapped data key has %d bytes, expected %d", len(dataKey), envelopeKeySize)
+	}
+
+	aead, err := c.envelopeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EnvelopeCipher{AEAD: aead}, nil
+}
+
+// EnvelopeKeyOptions configures UnwrapEnvelopeKey.
+type EnvelopeKeyOptions struct {
+	// OAEP gives the RSA-OAEP hash and label the data key was wrapped with. If nil, those of EnvelopeVersion1 are
+	// used.
+	OAEP *rsa.OAEPOptions
+
+	// KeepOnToken unwraps the data key into a session object with C_UnwrapKey, so that it never leaves the token, and
+	// decrypts payloads with AES-GCM on the token. Otherwise the data key is decrypted with C_Decrypt and payloads
+	// are decrypted in software, which fails if Config.ForbidSoftwareFallback is set.
+	KeepOnToken bool
+}
+
+// EnvelopeCipher is the data key of an envelope, unwrapped by UnwrapEnvelopeKey. It is an AES-GCM cipher.AEAD with
+// a 12-byte nonce, for opening payloads; Seal is not supported for a data key kept on the token. Close releases
+// the data key.
+type EnvelopeCipher struct {
+	cipher.AEAD
+
+	// key is the session object holding the data key, or nil if it is held in memory.
+	key *SecretKey
+}
+
+// UnwrapEnvelopeKey unwraps wrappedKey, the WrappedKey of an Envelope, with the RSA key pair key, returning a cipher
+// for opening the payload. With opts.KeepOnToken the data key is a session object on the token: it is destroyed by
+// Close, and also by the token if the pool discards the session that created it, after which Open fails.
+func (c *Context) UnwrapEnvelopeKey(key Signer, wrappedKey []byte, opts *EnvelopeKeyOptions) (*EnvelopeCipher,
+	error) {
+
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	unwrapper, ok := key.(*pkcs11PrivateKeyRSA)
+	if !ok || unwrapper.context != c {
+		return nil, errors.New("envelope key must be an RSA key pair belonging to this context")
+	}
+	if opts == nil {
+		opts = &EnvelopeKeyOptions{}
+	}
+	oaep := opts.OAEP
+	if oaep == nil {
+		oaep = envelopeOAEPOptions
+	}
+
+	if !opts.KeepOnToken {
+		return c.decryptEnvelopeKey(unwrapper, wrappedKey, oaep)
+	}
+
+	if err := unwrapper.checkUsage("unwrapping", pkcs11.CKA_UNWRAP, pkcs11.CKM_RSA_PKCS_OAEP); err != nil {
+		return nil, err
+	}
+	if err := c.checkOptionsHashes(oaep); err != nil {
+		return nil, err
+	}
+	params, err := oaepParams(oaep)
+	if err != nil {
+		return nil, err
+	}
+	oaepMech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	}
+
+	var handle pkcs11.ObjectHandle
+	err = unwrapper.withSession(func(session *pkcs11Session) (err error) {
+		handle, err = session.ctx.UnwrapKey(session.handle, oaepMech, unwrapper.handle, wrappedKey, template)
+		if err != nil {
+			return oaepLabelError(withMessage(err, "unwrapping data key"), oaep.Label)
+		}
+		defer func() {
+			if err != nil {
+				_ = session.ctx.DestroyObject(session.handle, handle)
+			}
+		}()
+
+		attributes, err := session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, nil),
+		})
+		if err != nil {
+			return withMessage(err, "reading data key length")
+		}
+		if length := bytesToUlong(attributes[0].Value); length != envelopeKeySize {
+			return fmt.Errorf("unwrapped data key has %d bytes, expected %d", length, envelopeKeySize)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	secret := newSecretKey(c, handle, CipherAES)
+	return &EnvelopeCipher{
+		AEAD: genericAead{
+			key:       secret,
+			overhead:  16,
+			nonceSize: envelopeNonceSize,
+			makeMech: func(nonce []byte, additionalData []byte, _ bool) ([]*pkcs11.Mechanism, *pkcs11.GCMParams,
+				error) {
+				params := pkcs11.NewGCMParams(nonce, additionalData, 16*8 /*bits*/)
+				return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}, params, nil
+			},
+		},
+		key: secret,
+	}, nil
+}
+
+// OpenEnvelope returns the plaintext of envelope, whose data key must be the one this cipher was unwrapped from. An
+// error wrapping ErrEnvelopeVersion is returned if the envelope's Version is not supported.
+func (e *EnvelopeCipher) OpenEnvelope(envelope *Envelope) ([]byte, error) {
+	if envelope == nil {
+		return nil, errors.New("envelope is nil")
+	}
+	if envelope.Version != EnvelopeVersion1 {
+		return nil, withMessagef(ErrEnvelopeVersion, "version %d", envelope.Version)
+	}
+	if len(envelope.Nonce) != e.NonceSize() {
+		return nil, fmt.Errorf("envelope nonce has %d bytes, expected %d", len(envelope.Nonce), e.NonceSize())
+	}
+	return e.Open(nil, envelope.Nonce, envelope.Ciphertext, envelopeAdditionalData)
+}
+
+// Close destroys the data key if it is kept on the token. The cipher must not be used afterwards.
+func (e *EnvelopeCipher) Close() error {
+	if e.key == nil {
+		return nil
+	}
+	return e.key.Delete()
+}
+
+// envelopeAEAD returns the AES-GCM cipher for dataKey.
+func (c *Context) envelopeAEAD(dataKey []byte) (cipher.AEAD, error) {
+	if err := c.allowSoftwareFallback("envelope encryption"); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// zeroize overwrites b with zeros.
+func zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeEncoding(t *testing.T) {
+	envelope := Envelope{Version: EnvelopeVersion1, WrappedKey: []byte{1}, Nonce: []byte{2}, Ciphertext: []byte{3}}
+	encoded, err := json.Marshal(&envelope)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version":1,"wrappedKey":"AQ==","nonce":"Ag==","ciphertext":"Aw=="}`, string(encoded))
+}
+
+func TestDecryptEnvelopeVersion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ctx := &Context{cfg: &Config{}}
+	_, err = ctx.DecryptEnvelope(key, &Envelope{Version: 2})
+	require.True(t, errors.Is(err, ErrEnvelopeVersion))
+}
+
+func TestEnvelopeForbidSoftwareFallback(t *testing.T) {
+	ctx := &Context{cfg: &Config{ForbidSoftwareFallback: true}}
+	_, err := ctx.envelopeAEAD(make([]byte, envelopeKeySize))
+	require.True(t, errors.Is(err, ErrSoftwareFallbackForbidden))
+}
+
+func TestEnvelopeSoftwareKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		plaintext := make([]byte, 100000)
+		_, err = rand.Read(plaintext)
+		require.NoError(t, err)
+
+		envelope, err := ctx.EncryptEnvelope(&key.PublicKey, plaintext)
+		require.NoError(t, err)
+		require.Equal(t, EnvelopeVersion1, envelope.Version)
+		require.Len(t, envelope.Nonce, 12)
+
+		decrypted, err := ctx.DecryptEnvelope(key, envelope)
+		require.NoError(t, err)
+		require.Equal(t, plaintext, decrypted)
+
+		envelope.Ciphertext[0] ^= 1
+		_, err = ctx.DecryptEnvelope(key, envelope)
+		require.Error(t, err)
+
+		_, err = ctx.EncryptEnvelope(key, plaintext)
+		require.Error(t, err)
+	})
+}
+
+// skipIfNoEnvelopeOAEP skips tests that decrypt envelopes on the token, which needs RSA-OAEP with SHA-256.
+func skipIfNoEnvelopeOAEP(t *testing.T, ctx *Context) {
+	skipIfMechUnsupported(t, ctx, pkcs11.CKM_RSA_PKCS_OAEP)
+	info, err := ctx.ctx.GetInfo()
+	require.NoError(t, err)
+	if info.ManufacturerID == "SoftHSM" {
+		t.Skipf("SoftHSM OAEP only supports SHA-1 with no label")
+	}
+}
+
+func TestEnvelopeTokenKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfNoEnvelopeOAEP(t, ctx)
+
+		key, err := ctx.GenerateRSAKeyPairWithLabel(randomBytes(), randomBytes(), 2048)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		plaintext := []byte("a payload too long for RSA-OAEP alone, or at least pretending to be")
+
+		envelope, err := ctx.EncryptEnvelope(key, plaintext)
+		require.NoError(t, err)
+		decrypted, err := ctx.DecryptEnvelope(key, envelope)
+		require.NoError(t, err)
+		require.Equal(t, plaintext, decrypted)
+
+		envelope, err = ctx.EncryptEnvelope(key.Public(), plaintext)
+		require.NoError(t, err)
+		decrypted, err = ctx.DecryptEnvelope(key, envelope)
+		require.NoError(t, err)
+		require.Equal(t, plaintext, decrypted)
+	})
+}
+
+func TestUnwrapEnvelopeKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfNoEnvelopeOAEP(t, ctx)
+
+		key, err := ctx.GenerateRSAKeyPairWithLabel(randomBytes(), randomBytes(), 2048)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		plaintext := []byte("opened with a data key that may never leave the token")
+		envelope, err := ctx.EncryptEnvelope(key, plaintext)
+		require.NoError(t, err)
+
+		for _, keepOnToken := range []bool{false, true} {
+			envelopeCipher, err := ctx.UnwrapEnvelopeKey(key, envelope.WrappedKey,
+				&EnvelopeKeyOptions{KeepOnToken: keepOnToken})
+			require.NoError(t, err, "KeepOnToken %v", keepOnToken)
+			require.Equal(t, keepOnToken, envelopeCipher.key != nil)
+			require.Equal(t, 12, envelopeCipher.NonceSize())
+
+			decrypted, err := envelopeCipher.OpenEnvelope(envelope)
+			require.NoError(t, err)
+			require.Equal(t, plaintext, decrypted)
+
+			decrypted, err = envelopeCipher.Open(nil, envelope.Nonce, envelope.Ciphertext, envelopeAdditionalData)
+			require.NoError(t, err)
+			require.Equal(t, plaintext, decrypted)
+
+			_, err = envelopeCipher.Open(nil, envelope.Nonce, envelope.Ciphertext, nil)
+			require.Error(t, err)
+
+			require.NoError(t, envelopeCipher.Close())
+		}
+
+		_, err = ctx.UnwrapEnvelopeKey(nil, envelope.WrappedKey, nil)
+		require.Error(t, err)
+	})
+}
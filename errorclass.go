@@ -0,0 +1,192 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Error classes returned by ClassifyError and counted by Context.ErrorCounters.
+const (
+	// ErrorClassPIN covers a PIN that is incorrect, invalid, expired or locked.
+	ErrorClassPIN = "pin"
+
+	// ErrorClassPoolExhausted covers failures to obtain a session from the pool, see ErrPoolExhausted.
+	ErrorClassPoolExhausted = "pool_exhausted"
+
+	// ErrorClassDevice covers failures of the token itself, including its removal.
+	ErrorClassDevice = "device"
+
+	// ErrorClassSession covers sessions that were closed or invalidated, and a suspended Context.
+	ErrorClassSession = "session"
+
+	// ErrorClassKeyNotFound covers object handles that no longer refer to an object, and key pairs that could not be
+	// found again after Resume.
+	ErrorClassKeyNotFound = "key_not_found"
+
+	// ErrorClassMechanismInvalid covers mechanisms, mechanism parameters and hashes the token does not support.
+	ErrorClassMechanismInvalid = "mechanism_invalid"
+
+	// ErrorClassSignatureInvalid covers signatures that failed verification.
+	ErrorClassSignatureInvalid = "signature_invalid"
+
+	// ErrorClassOther covers every other error.
+	ErrorClassOther = "other"
+)
+
+// errorClasses lists the error classes in the order of the counters in errorCounters.
+var errorClasses = []string{
+	ErrorClassPIN,
+	ErrorClassPoolExhausted,
+	ErrorClassDevice,
+	ErrorClassSession,
+	ErrorClassKeyNotFound,
+	ErrorClassMechanismInvalid,
+	ErrorClassSignatureInvalid,
+	ErrorClassOther,
+}
+
+// errorClassCodes maps PKCS#11 return values to error classes.
+var errorClassCodes = map[pkcs11.Error]string{
+	pkcs11.CKR_PIN_INCORRECT:              ErrorClassPIN,
+	pkcs11.CKR_PIN_INVALID:                ErrorClassPIN,
+	pkcs11.CKR_PIN_LEN_RANGE:              ErrorClassPIN,
+	pkcs11.CKR_PIN_EXPIRED:                ErrorClassPIN,
+	pkcs11.CKR_PIN_LOCKED:                 ErrorClassPIN,
+	pkcs11.CKR_DEVICE_ERROR:               ErrorClassDevice,
+	pkcs11.CKR_DEVICE_MEMORY:              ErrorClassDevice,
+	pkcs11.CKR_DEVICE_REMOVED:             ErrorClassDevice,
+	pkcs11.CKR_TOKEN_NOT_PRESENT:          ErrorClassDevice,
+	pkcs11.CKR_TOKEN_NOT_RECOGNIZED:       ErrorClassDevice,
+	pkcs11.CKR_GENERAL_ERROR:              ErrorClassDevice,
+	pkcs11.CKR_SESSION_CLOSED:             ErrorClassSession,
+	pkcs11.CKR_SESSION_HANDLE_INVALID:     ErrorClassSession,
+	pkcs11.CKR_OBJECT_HANDLE_INVALID:      ErrorClassKeyNotFound,
+	pkcs11.CKR_KEY_HANDLE_INVALID:         ErrorClassKeyNotFound,
+	pkcs11.CKR_MECHANISM_INVALID:          ErrorClassMechanismInvalid,
+	pkcs11.CKR_MECHANISM_PARAM_INVALID:    ErrorClassMechanismInvalid,
+	pkcs11.CKR_KEY_FUNCTION_NOT_PERMITTED: ErrorClassMechanismInvalid,
+	pkcs11.CKR_SIGNATURE_INVALID:          ErrorClassSignatureInvalid,
+	pkcs11.CKR_SIGNATURE_LEN_RANGE:        ErrorClassSignatureInvalid,
+}
+
+// errorClassSentinels maps crypto11 errors to error classes.
+var errorClassSentinels = []struct {
+	err   error
+	class string
+}{
+	{ErrPoolExhausted, ErrorClassPoolExhausted},
+	{ErrTokenNotFound, ErrorClassDevice},
+	{ErrSuspended, ErrorClassSession},
+	{ErrHandlesChanged, ErrorClassKeyNotFound},
+	{ErrKeyMismatch, ErrorClassKeyNotFound},
+	{ErrMechanismNotSupported, ErrorClassMechanismInvalid},
+	{ErrUnsupportedHash, ErrorClassMechanismInvalid},
+	{ErrSignatureInvalid, ErrorClassSignatureInvalid},
+}
+
+// ClassifyError returns the error class of err, one of the ErrorClass constants, or "" if err is nil. Errors
+// wrapping a crypto11 error, such as ErrPoolExhausted, are classified by that error; otherwise errors wrapping a
+// PKCS#11 return value are classified by the return value. Applications can use ClassifyError to label their own
+// metrics consistently with Context.ErrorCounters.
+func ClassifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, sentinel := range errorClassSentinels {
+		if errors.Is(err, sentinel.err) {
+			return sentinel.class
+		}
+	}
+	var p11Err pkcs11.Error
+	if errors.As(err, &p11Err) {
+		if class, ok := errorClassCodes[p11Err]; ok {
+			return class
+		}
+	}
+	return ErrorClassOther
+}
+
+// errorCounters counts the errors returned by operations on the token, by class. A nil *errorCounters counts
+// nothing.
+type errorCounters struct {
+	// counts is indexed like errorClasses, and accessed with sync/atomic
+	counts []uint64
+
+	// resetOnRead is Config.ResetErrorCountersOnRead.
+	resetOnRead bool
+}
+
+// newErrorCounters creates error counters for config.
+func newErrorCounters(config *Config) *errorCounters {
+	return &errorCounters{
+		counts:      make([]uint64, len(errorClasses)),
+		resetOnRead: config.ResetErrorCountersOnRead,
+	}
+}
+
+// observe counts err, if it is not nil.
+func (e *errorCounters) observe(err error) {
+	if e == nil || err == nil {
+		return
+	}
+	class := ClassifyError(err)
+	for i := range errorClasses {
+		if errorClasses[i] == class {
+			atomic.AddUint64(&e.counts[i], 1)
+			return
+		}
+	}
+}
+
+// snapshot returns the counts by class, resetting them if resetOnRead is set.
+func (e *errorCounters) snapshot() map[string]uint64 {
+	return e.read(e != nil && e.resetOnRead)
+}
+
+// read returns the counts by class, resetting them if reset is true.
+func (e *errorCounters) read(reset bool) map[string]uint64 {
+	counts := make(map[string]uint64, len(errorClasses))
+	for i, class := range errorClasses {
+		if e == nil {
+			counts[class] = 0
+		} else if reset {
+			counts[class] = atomic.SwapUint64(&e.counts[i], 0)
+		} else {
+			counts[class] = atomic.LoadUint64(&e.counts[i])
+		}
+	}
+	return counts
+}
+
+// ErrorCounters returns the number of errors of each class (see ClassifyError) returned by operations that used a
+// session, including failures to obtain one. Every class is present in the map. The counts are monotonic, unless
+// Config.ResetErrorCountersOnRead is set, in which case each call returns the counts since the previous call.
+//
+// Errors detected before the token is used, such as invalid arguments, are not counted. Errors that crypto11 handles
+// itself, such as a token rejecting a probe for an optional feature, are.
+func (c *Context) ErrorCounters() map[string]uint64 {
+	return c.errorCounters.snapshot()
+}
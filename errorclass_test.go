@@ -0,0 +1,103 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{nil, ""},
+		{pkcs11.Error(pkcs11.CKR_PIN_INCORRECT), ErrorClassPIN},
+		{withMessage(pkcs11.Error(pkcs11.CKR_PIN_LOCKED), "logging in"), ErrorClassPIN},
+		{withMessagef(ErrPoolExhausted, "timed out after %v", 1), ErrorClassPoolExhausted},
+		{pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED), ErrorClassDevice},
+		{ErrSuspended, ErrorClassSession},
+		{pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID), ErrorClassSession},
+		{fmt.Errorf("signing: %w", pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID)), ErrorClassKeyNotFound},
+		{ErrKeyMismatch, ErrorClassKeyNotFound},
+		{pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID), ErrorClassMechanismInvalid},
+		{withMessage(ErrMechanismNotSupported, "SHA3-256"), ErrorClassMechanismInvalid},
+		{ErrSignatureInvalid, ErrorClassSignatureInvalid},
+		{pkcs11.Error(pkcs11.CKR_DATA_LEN_RANGE), ErrorClassOther},
+		{errors.New("something else"), ErrorClassOther},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.class, ClassifyError(test.err), "%v", test.err)
+	}
+}
+
+func TestErrorCountersSnapshot(t *testing.T) {
+	counters := newErrorCounters(&Config{})
+	counters.observe(nil)
+	counters.observe(pkcs11.Error(pkcs11.CKR_PIN_INCORRECT))
+	counters.observe(ErrPoolExhausted)
+	counters.observe(ErrPoolExhausted)
+
+	for i := 0; i < 2; i++ {
+		counts := counters.snapshot()
+		require.Len(t, counts, len(errorClasses))
+		require.Equal(t, uint64(1), counts[ErrorClassPIN])
+		require.Equal(t, uint64(2), counts[ErrorClassPoolExhausted])
+		require.Equal(t, uint64(0), counts[ErrorClassOther])
+	}
+
+	counters.resetOnRead = true
+	require.Equal(t, uint64(2), counters.snapshot()[ErrorClassPoolExhausted])
+	require.Equal(t, uint64(0), counters.snapshot()[ErrorClassPoolExhausted])
+
+	var none *errorCounters
+	none.observe(ErrPoolExhausted)
+	require.Len(t, none.snapshot(), len(errorClasses))
+}
+
+func TestErrorCounters(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.ResetErrorCountersOnRead = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, ctx.Close())
+	}()
+	ctx.ErrorCounters()
+
+	err = ctx.withSession(func(session *pkcs11Session) error {
+		return pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	})
+	require.Error(t, err)
+
+	counts := ctx.ErrorCounters()
+	require.Equal(t, uint64(1), counts[ErrorClassMechanismInvalid])
+	require.Equal(t, uint64(0), counts[ErrorClassOther])
+	require.Equal(t, uint64(0), ctx.ErrorCounters()[ErrorClassMechanismInvalid])
+}
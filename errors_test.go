@@ -0,0 +1,111 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMessage(t *testing.T) {
+	assert.Nil(t, withMessage(nil, "context"))
+	assert.Nil(t, withMessagef(nil, "context %d", 1))
+
+	err := withMessagef(withMessage(ErrIDExists, "inner"), "outer %d", 2)
+	assert.Equal(t, "outer 2: inner: "+ErrIDExists.Error(), err.Error())
+	assert.True(t, errors.Is(err, ErrIDExists))
+
+	err = withMessage(pkcs11.Error(pkcs11.CKR_PIN_INCORRECT), "login")
+	var p11Err pkcs11.Error
+	require.True(t, errors.As(err, &p11Err))
+	assert.Equal(t, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT), p11Err)
+}
+
+func TestIsPKCS11Error(t *testing.T) {
+	wrapped := withMessage(pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID), "reading attributes")
+
+	assert.True(t, isPKCS11Error(wrapped, pkcs11.CKR_OBJECT_HANDLE_INVALID))
+	assert.True(t, isPKCS11Error(wrapped, pkcs11.CKR_ARGUMENTS_BAD, pkcs11.CKR_OBJECT_HANDLE_INVALID))
+	assert.False(t, isPKCS11Error(wrapped, pkcs11.CKR_ARGUMENTS_BAD))
+	assert.False(t, isPKCS11Error(nil, pkcs11.CKR_OBJECT_HANDLE_INVALID))
+	assert.False(t, isPKCS11Error(ErrIDExists, pkcs11.CKR_OBJECT_HANDLE_INVALID))
+}
+
+// TestSentinelErrorChains checks the sentinel errors that can be reached without a token remain visible to
+// errors.Is through the public API. TestSentinelErrorChainsOnToken covers the rest.
+func TestSentinelErrorChains(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("sentinel"))
+
+	for name, test := range map[string]struct {
+		sentinel error
+		f        func() error
+	}{
+		"ErrUnsupportedHash": {ErrUnsupportedHash, func() error {
+			return VerifySignature(rsaKey, digest[:], make([]byte, 128), crypto.Hash(99))
+		}},
+		"ErrSignatureInvalid": {ErrSignatureInvalid, func() error {
+			return VerifySignature(ecKey, digest[:], []byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01}, crypto.SHA256)
+		}},
+	} {
+		err := test.f()
+		require.Error(t, err, name)
+		assert.True(t, errors.Is(err, test.sentinel), "%s: %v", name, err)
+	}
+}
+
+func TestSentinelErrorChainsOnToken(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.TokenLabel = ""
+	config.TokenSerial = "no such token"
+	config.SlotNumber = nil
+
+	_, err = Configure(config)
+	assert.True(t, errors.Is(err, ErrTokenNotFound), "%v", err)
+
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		digest := sha256.Sum256([]byte("sentinel"))
+		_, err = key.Sign(rand.Reader, digest[:], crypto.Hash(99))
+		assert.True(t, errors.Is(err, ErrUnsupportedHash), "%v", err)
+
+		err = VerifySignature(key, digest[:], make([]byte, rsaSize/8), crypto.SHA256)
+		assert.True(t, errors.Is(err, ErrSignatureInvalid), "%v", err)
+	})
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionEventQueueLength is the number of events that may be waiting for delivery to a SessionEventFunc. Events
+// raised while the queue is full are dropped and counted, see Context.DroppedEvents.
+const sessionEventQueueLength = 256
+
+// SessionEventType identifies the kind of session lifecycle event reported to a SessionEventFunc.
+type SessionEventType int
+
+const (
+	// SessionCreated is reported when a new session is opened for the pool.
+	SessionCreated SessionEventType = iota
+
+	// SessionCreateFailed is reported when C_OpenSession fails. The event Err field holds the PKCS#11 error.
+	SessionCreateFailed
+
+	// SessionClosed is reported when the pool closes a session, for instance because it has been idle or
+	// because the Context is being closed.
+	SessionClosed
+
+	// SessionRecycled is reported when a session is discarded because an operation found it to be unusable (e.g.
+	// CKR_SESSION_HANDLE_INVALID), or because an operation failed part-way and left an operation active that could
+	// not be ended. The pool opens a replacement session. The event Err field holds the error that caused the
+	// session to be discarded, if any.
+	SessionRecycled
+
+	// LoginPerformed is reported after C_Login is called on the long-term session. The event Err field is set
+	// if the login failed.
+	LoginPerformed
+)
+
+// SessionEvent describes a session lifecycle event.
+type SessionEvent struct {
+	// Type identifies the event.
+	Type SessionEventType
+
+	// Slot is the slot containing the token.
+	Slot uint
+
+	// Duration is the time taken by the PKCS#11 call that triggered the event, if any.
+	Duration time.Duration
+
+	// Err is the error associated with the event, if any.
+	Err error
+
+	// TraceID is the trace ID of the operation that caused a SessionRecycled event, if its context had one. See
+	// WithTraceID.
+	TraceID string
+}
+
+// SessionEventFunc is called with session lifecycle events. See Config.SessionEventFunc.
+type SessionEventFunc func(event SessionEvent)
+
+// sessionEvents delivers session events to a SessionEventFunc from a dedicated goroutine, so that a slow consumer
+// cannot block PKCS#11 operations. A nil *sessionEvents silently discards all events.
+type sessionEvents struct {
+	slot   uint
+	queue  chan SessionEvent
+	done   chan struct{}
+	mutex  sync.RWMutex
+	closed bool
+
+	// dropped counts events discarded because the queue was full. Accessed with sync/atomic.
+	dropped uint64
+}
+
+// newSessionEvents starts delivering events to f. If f is nil, nil is returned.
+func newSessionEvents(f SessionEventFunc) *sessionEvents {
+	if f == nil {
+		return nil
+	}
+
+	e := &sessionEvents{
+		queue: make(chan SessionEvent, sessionEventQueueLength),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(e.done)
+		for event := range e.queue {
+			f(event)
+		}
+	}()
+
+	return e
+}
+
+// raise queues an event for delivery. The event is dropped and counted if the queue is full.
+func (e *sessionEvents) raise(eventType SessionEventType, duration time.Duration, err error) {
+	e.raiseTraced(eventType, duration, err, "")
+}
+
+// raiseTraced queues an event caused by the operation with the given trace ID for delivery.
+func (e *sessionEvents) raiseTraced(eventType SessionEventType, duration time.Duration, err error, traceID string) {
+	e.deliver(SessionEvent{Type: eventType, Duration: duration, Err: err, TraceID: traceID})
+}
+
+// deliver queues event for delivery, setting its slot. The event is dropped and counted if the queue is full.
+func (e *sessionEvents) deliver(event SessionEvent) {
+	if e == nil {
+		return
+	}
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if e.closed {
+		return
+	}
+
+	event.Slot = e.slot
+	select {
+	case e.queue <- event:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+// droppedCount returns the number of events dropped so far.
+func (e *sessionEvents) droppedCount() uint64 {
+	if e == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// close stops event delivery, after waiting for queued events to be delivered.
+func (e *sessionEvents) close() {
+	if e == nil {
+		return
+	}
+
+	e.mutex.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mutex.Unlock()
+
+	<-e.done
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionEventsNil(t *testing.T) {
+	var e *sessionEvents
+	assert.Nil(t, newSessionEvents(nil))
+
+	// Must not panic
+	e.raise(SessionCreated, 0, nil)
+	e.close()
+}
+
+func TestSessionEventsDoNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var received []SessionEvent
+
+	e := newSessionEvents(func(event SessionEvent) {
+		<-release
+		mutex.Lock()
+		received = append(received, event)
+		mutex.Unlock()
+	})
+	e.slot = 7
+
+	failure := errors.New("failure")
+
+	// The consumer is stalled, so all but the first queueLength+1 events must be dropped without blocking.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*sessionEventQueueLength; i++ {
+			e.raise(SessionCreateFailed, time.Second, failure)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("raising events blocked")
+	}
+
+	close(release)
+	e.close()
+
+	require.NotEmpty(t, received)
+	assert.True(t, len(received) <= sessionEventQueueLength+1)
+	assert.Equal(t, uint64(2*sessionEventQueueLength-len(received)), e.droppedCount())
+	assert.Equal(t, SessionEvent{Type: SessionCreateFailed, Slot: 7, Duration: time.Second, Err: failure}, received[0])
+
+	// Events after close are ignored
+	e.raise(SessionCreated, 0, nil)
+}
+
+func TestSessionEventFunc(t *testing.T) {
+	cfg, err := getConfig("config")
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	seen := map[SessionEventType]int{}
+	cfg.SessionEventFunc = func(event SessionEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		seen[event.Type]++
+	}
+
+	ctx, err := Configure(cfg)
+	require.NoError(t, err)
+
+	_, err = ctx.FindKey(randomBytes(), nil)
+	require.NoError(t, err)
+
+	// Close waits for queued events to be delivered
+	require.NoError(t, ctx.Close())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, 1, seen[LoginPerformed])
+	assert.Equal(t, 1, seen[SessionCreated])
+	assert.Equal(t, 1, seen[SessionClosed])
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Command csr writes a PEM-encoded certificate signing request for a key pair held on a PKCS#11 token, generating a
+// P-256 ECDSA key pair first if -generate is given and no key pair has the label.
+//
+//	csr -config crypto11.json -label web -cn www.example.com -dns www.example.com,example.com -generate
+package main
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "csr:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("csr", flag.ContinueOnError)
+	config := flags.String("config", "config", "crypto11 configuration `file`")
+	label := flags.String("label", "", "CKA_LABEL of the key pair")
+	commonName := flags.String("cn", "", "common name of the subject")
+	dnsNames := flags.String("dns", "", "comma-separated DNS names to request")
+	generate := flags.Bool("generate", false, "generate a P-256 key pair if none has the label")
+	out := flags.String("out", "", "output `file`, standard output if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *label == "" || *commonName == "" {
+		return errors.New("-label and -cn are required")
+	}
+
+	ctx, err := crypto11.ConfigureFromFile(*config)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ctx.Close() }()
+
+	key, err := findOrGenerate(ctx, []byte(*label), *generate)
+	if err != nil {
+		return err
+	}
+
+	algorithm, err := ctx.X509SignatureAlgorithm(key)
+	if err != nil {
+		return err
+	}
+	template := &x509.CertificateRequest{
+		Subject:            pkix.Name{CommonName: *commonName},
+		SignatureAlgorithm: algorithm,
+	}
+	if *dnsNames != "" {
+		template.DNSNames = strings.Split(*dnsNames, ",")
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return fmt.Errorf("creating the request: %w", err)
+	}
+
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	if *out == "" {
+		_, err = stdout.Write(encoded)
+		return err
+	}
+	return ioutil.WriteFile(*out, encoded, 0644)
+}
+
+// findOrGenerate returns the key pair with the label, generating one if there is none and generate is true.
+func findOrGenerate(ctx *crypto11.Context, label []byte, generate bool) (crypto11.Signer, error) {
+	key, err := ctx.FindKeyPair(nil, label)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		return key, nil
+	}
+	if !generate {
+		return nil, fmt.Errorf("no key pair has the label %q", label)
+	}
+
+	id, err := ctx.GenerateID()
+	if err != nil {
+		return nil, err
+	}
+	return ctx.GenerateECDSAKeyPairWithLabel(id, label, elliptic.P256())
+}
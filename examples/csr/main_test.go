@@ -0,0 +1,76 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11/examples/internal/smoke"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequiredFlags(t *testing.T) {
+	assert.Error(t, run([]string{"-cn", "example"}, &bytes.Buffer{}))
+	assert.Error(t, run([]string{"-label", "example"}, &bytes.Buffer{}))
+	assert.Error(t, run([]string{"-unknown"}, &bytes.Buffer{}))
+}
+
+func TestSmoke(t *testing.T) {
+	config := smoke.Config(t)
+	label := smoke.Label(t)
+
+	var out bytes.Buffer
+	require.NoError(t, run([]string{"-config", config, "-label", label, "-cn", "www.example.com",
+		"-dns", "www.example.com,example.com", "-generate"}, &out))
+
+	ctx := smoke.Context(t, config)
+	defer func() { require.NoError(t, ctx.Close()) }()
+	key, err := ctx.FindKeyPair(nil, []byte(label))
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	defer func() { _ = key.Delete() }()
+
+	block, _ := pem.Decode(out.Bytes())
+	require.NotNil(t, block)
+	assert.Equal(t, "CERTIFICATE REQUEST", block.Type)
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+	assert.NoError(t, request.CheckSignature())
+	assert.Equal(t, "www.example.com", request.Subject.CommonName)
+	assert.Equal(t, []string{"www.example.com", "example.com"}, request.DNSNames)
+	assert.Equal(t, key.Public(), request.PublicKey)
+
+	// A second run uses the key pair made by the first.
+	out.Reset()
+	require.NoError(t, run([]string{"-config", config, "-label", label, "-cn", "www.example.com"}, &out))
+	block, _ = pem.Decode(out.Bytes())
+	require.NotNil(t, block)
+	request, err = x509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, key.Public(), request.PublicKey)
+
+	assert.Error(t, run([]string{"-config", config, "-label", label + "-missing", "-cn", "x"}, &out))
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Command envelope encrypts a file for an RSA key pair held on a PKCS#11 token, or decrypts a file it encrypted. The
+// file is encrypted in software under a fresh data key, which is wrapped with RSA-OAEP, see crypto11.EncryptEnvelope.
+// The encrypted file holds the JSON encoding of a crypto11.Envelope.
+//
+//	envelope -config crypto11.json -label archive -generate -in report.pdf -out report.pdf.env
+//	envelope -config crypto11.json -label archive -decrypt -in report.pdf.env -out report.pdf
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// keyBits is the size of the RSA key pairs made by -generate.
+const keyBits = 2048
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "envelope:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("envelope", flag.ContinueOnError)
+	config := flags.String("config", "config", "crypto11 configuration `file`")
+	label := flags.String("label", "", "CKA_LABEL of the RSA key pair")
+	decrypt := flags.Bool("decrypt", false, "decrypt rather than encrypt")
+	generate := flags.Bool("generate", false, "generate an RSA key pair for decryption if none has the label")
+	in := flags.String("in", "", "input `file`, standard input if empty")
+	out := flags.String("out", "", "output `file`, standard output if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *label == "" {
+		return errors.New("-label is required")
+	}
+	if *decrypt && *generate {
+		return errors.New("-generate cannot be combined with -decrypt")
+	}
+
+	input, err := readInput(*in, stdin)
+	if err != nil {
+		return err
+	}
+
+	ctx, err := crypto11.ConfigureFromFile(*config)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ctx.Close() }()
+
+	key, err := findOrGenerate(ctx, []byte(*label), *generate)
+	if err != nil {
+		return err
+	}
+
+	var output []byte
+	if *decrypt {
+		output, err = open(ctx, key, input)
+	} else {
+		output, err = seal(ctx, key, input)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = stdout.Write(output)
+		return err
+	}
+	return ioutil.WriteFile(*out, output, 0600)
+}
+
+// seal encrypts plaintext for key and returns the encoded envelope.
+func seal(ctx *crypto11.Context, key crypto11.SignerDecrypter, plaintext []byte) ([]byte, error) {
+	envelope, err := ctx.EncryptEnvelope(key, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting: %w", err)
+	}
+	return json.Marshal(envelope)
+}
+
+// open decodes an envelope and decrypts it with key.
+func open(ctx *crypto11.Context, key crypto11.SignerDecrypter, encoded []byte) ([]byte, error) {
+	var envelope crypto11.Envelope
+	if err := json.Unmarshal(encoded, &envelope); err != nil {
+		return nil, fmt.Errorf("the input is not an envelope: %w", err)
+	}
+	plaintext, err := ctx.DecryptEnvelope(key, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %w", err)
+	}
+	return plaintext, nil
+}
+
+// findOrGenerate returns the RSA key pair with the label, generating one if there is none and generate is true.
+func findOrGenerate(ctx *crypto11.Context, label []byte, generate bool) (crypto11.SignerDecrypter, error) {
+	key, err := ctx.FindKeyPair(nil, label)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		if !generate {
+			return nil, fmt.Errorf("no key pair has the label %q", label)
+		}
+		id, err := ctx.GenerateID()
+		if err != nil {
+			return nil, err
+		}
+		return ctx.GenerateRSAKeyPairForPurpose(id, label, keyBits, crypto11.KeyPurposeDecryption)
+	}
+
+	decrypter, ok := key.(crypto11.SignerDecrypter)
+	if !ok {
+		return nil, fmt.Errorf("the key pair with the label %q is not an RSA key pair", label)
+	}
+	return decrypter, nil
+}
+
+func readInput(path string, stdin io.Reader) ([]byte, error) {
+	if path == "" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(path)
+}
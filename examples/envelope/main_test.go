@@ -0,0 +1,83 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/ThalesIgnite/crypto11/examples/internal/smoke"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequiredFlags(t *testing.T) {
+	assert.Error(t, run(nil, &bytes.Buffer{}, &bytes.Buffer{}))
+	assert.Error(t, run([]string{"-label", "x", "-decrypt", "-generate"}, &bytes.Buffer{}, &bytes.Buffer{}))
+}
+
+func TestSmoke(t *testing.T) {
+	config := smoke.Config(t)
+	label := smoke.Label(t)
+
+	dir, err := ioutil.TempDir("", "crypto11-envelope")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	sealed := filepath.Join(dir, "sealed.json")
+	opened := filepath.Join(dir, "opened")
+
+	plaintext := bytes.Repeat([]byte("envelope example "), 1000)
+	require.NoError(t, run([]string{"-config", config, "-label", label, "-generate", "-out", sealed},
+		bytes.NewReader(plaintext), &bytes.Buffer{}))
+
+	ctx := smoke.Context(t, config)
+	defer func() { require.NoError(t, ctx.Close()) }()
+	key, err := ctx.FindKeyPair(nil, []byte(label))
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	defer func() { _ = key.Delete() }()
+
+	encoded, err := ioutil.ReadFile(sealed)
+	require.NoError(t, err)
+	var envelope crypto11.Envelope
+	require.NoError(t, json.Unmarshal(encoded, &envelope))
+	assert.Equal(t, crypto11.EnvelopeVersion1, envelope.Version)
+	assert.NotContains(t, string(encoded), "envelope example")
+
+	require.NoError(t, run([]string{"-config", config, "-label", label, "-decrypt", "-in", sealed, "-out", opened},
+		nil, &bytes.Buffer{}))
+	decrypted, err := ioutil.ReadFile(opened)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// A damaged envelope is rejected.
+	envelope.Ciphertext[0] ^= 1
+	damaged, err := json.Marshal(&envelope)
+	require.NoError(t, err)
+	assert.Error(t, run([]string{"-config", config, "-label", label, "-decrypt"}, bytes.NewReader(damaged),
+		&bytes.Buffer{}))
+}
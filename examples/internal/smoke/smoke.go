@@ -0,0 +1,61 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package smoke is shared by the tests of the example programs, which run them against a real token when
+// CRYPTO11_EXAMPLES_CONFIG names a crypto11 configuration file, for instance one for SoftHSM.
+package smoke
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// ConfigEnv is the environment variable naming the configuration file used by the smoke runs. They are skipped if it
+// is not set.
+const ConfigEnv = "CRYPTO11_EXAMPLES_CONFIG"
+
+// Config returns the configuration file named by ConfigEnv, skipping t if there is none.
+func Config(t *testing.T) string {
+	path := os.Getenv(ConfigEnv)
+	if path == "" {
+		t.Skipf("set %s to a crypto11 configuration file to run the example against a token", ConfigEnv)
+	}
+	return path
+}
+
+// Context opens a Context with the configuration file, for setting up and checking the objects the example uses.
+// The caller must close it.
+func Context(t *testing.T, path string) *crypto11.Context {
+	ctx, err := crypto11.ConfigureFromFile(path)
+	if err != nil {
+		t.Fatalf("configuring crypto11: %v", err)
+	}
+	return ctx
+}
+
+// Label returns a CKA_LABEL that no other run uses, so that smoke runs do not find each other's objects.
+func Label(t *testing.T) string {
+	return fmt.Sprintf("crypto11-example-%s-%d", t.Name(), time.Now().UnixNano())
+}
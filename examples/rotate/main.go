@@ -0,0 +1,147 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Command rotate replaces the key pair with a CKA_LABEL by a freshly generated one of the same kind and size, under
+// the same label and a new CKA_ID. The old key pair is archived rather than destroyed (see crypto11.Context.Archive),
+// so that it can be restored with Unarchive if the rotation has to be undone. With -purge, key pairs archived at
+// least that long ago are then destroyed.
+//
+//	rotate -config crypto11.json -label signing -reason "annual rotation" -purge 2160h
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "rotate:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	config := flags.String("config", "config", "crypto11 configuration `file`")
+	label := flags.String("label", "", "CKA_LABEL of the key pair to rotate")
+	reason := flags.String("reason", "rotated", "reason recorded in the archive tombstone")
+	purge := flags.Duration("purge", 0, "destroy key pairs archived at least this long ago, if positive")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *label == "" {
+		return errors.New("-label is required")
+	}
+
+	ctx, err := crypto11.ConfigureFromFile(*config)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ctx.Close() }()
+
+	old, err := ctx.FindKeyPair(nil, []byte(*label))
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return fmt.Errorf("no key pair has the label %q", *label)
+	}
+	oldID, err := ctx.GetAttribute(old, crypto11.CkaId)
+	if err != nil {
+		return err
+	}
+
+	// Check that the replacement can be made before archiving, so that an unsupported key pair is left alone.
+	generate, err := generator(ctx, old)
+	if err != nil {
+		return err
+	}
+	id, err := ctx.GenerateID()
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.Archive(old, *reason); err != nil {
+		return err
+	}
+	if _, err = generate(id, []byte(*label)); err != nil {
+		if undoErr := ctx.Unarchive(old); undoErr != nil {
+			return fmt.Errorf("generating the new key pair: %w (restoring the old key pair also failed: %v)", err,
+				undoErr)
+		}
+		return fmt.Errorf("generating the new key pair: %w", err)
+	}
+	_, _ = fmt.Fprintf(stdout, "rotated %q: CKA_ID %s replaces %s, which is archived\n", *label,
+		hex.EncodeToString(id), hex.EncodeToString(oldID.Value))
+
+	if *purge > 0 {
+		destroyed, err := ctx.DestroyArchived(*purge)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(stdout, "destroyed %d key(s) archived more than %s ago\n", destroyed, purge.Round(time.Second))
+	}
+	return nil
+}
+
+// generator returns a function that generates a key pair of the same kind as old.
+func generator(ctx *crypto11.Context, old crypto11.Signer) (func(id, label []byte) (crypto11.Signer, error), error) {
+	switch pub := old.Public().(type) {
+	case *rsa.PublicKey:
+		purpose := crypto11.KeyPurposeSigning
+		if reporter, ok := old.(crypto11.PurposeReporter); ok {
+			var err error
+			if purpose, err = reporter.Purpose(); err != nil {
+				return nil, err
+			}
+		}
+		if purpose == 0 {
+			return nil, errors.New("the RSA key pair permits no operation")
+		}
+		return func(id, label []byte) (crypto11.Signer, error) {
+			return ctx.GenerateRSAKeyPairForPurpose(id, label, pub.N.BitLen(), purpose)
+		}, nil
+
+	case *ecdsa.PublicKey:
+		return func(id, label []byte) (crypto11.Signer, error) {
+			return ctx.GenerateECDSAKeyPairWithLabel(id, label, pub.Curve)
+		}, nil
+
+	case ed25519.PublicKey:
+		return func(id, label []byte) (crypto11.Signer, error) {
+			return ctx.GenerateEd25519KeyPairWithLabel(id, label)
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("cannot rotate key pairs with a %T public key", pub)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/ThalesIgnite/crypto11/examples/internal/smoke"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequiredFlags(t *testing.T) {
+	assert.Error(t, run(nil, &bytes.Buffer{}))
+	assert.Error(t, run([]string{"-label", "x", "-purge", "soon"}, &bytes.Buffer{}))
+}
+
+func TestSmoke(t *testing.T) {
+	config := smoke.Config(t)
+	label := smoke.Label(t)
+
+	ctx := smoke.Context(t, config)
+	defer func() { require.NoError(t, ctx.Close()) }()
+	id, err := ctx.GenerateID()
+	require.NoError(t, err)
+	old, err := ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P256())
+	require.NoError(t, err)
+	defer func() { _ = old.Delete() }()
+
+	var out bytes.Buffer
+	require.NoError(t, run([]string{"-config", config, "-label", label, "-reason", "smoke test"}, &out))
+	assert.Contains(t, out.String(), "rotated")
+
+	current, err := ctx.FindKeyPair(nil, []byte(label))
+	require.NoError(t, err)
+	require.NotNil(t, current)
+	defer func() { _ = current.Delete() }()
+	assert.NotEqual(t, old.Public(), current.Public())
+	assert.Equal(t, elliptic.P256(), current.Public().(interface{ Curve() elliptic.Curve }).Curve())
+
+	// The old key pair is archived, and can be found by its CKA_ID.
+	archived, err := ctx.FindKeyPairWithOptions(id, nil, &crypto11.FindKeyPairOptions{IncludeArchived: true})
+	require.NoError(t, err)
+	require.NotNil(t, archived)
+	assert.True(t, crypto11.Archived(archived))
+	assert.Equal(t, old.Public(), archived.Public())
+
+	assert.Error(t, run([]string{"-config", config, "-label", label + "-missing"}, &out))
+}
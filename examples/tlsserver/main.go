@@ -0,0 +1,159 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Command tlsserver serves HTTPS with a certificate whose private key is held on a PKCS#11 token. The certificate is
+// read from the token too: the one with the CKA_LABEL given by -label, or else the first certificate on the token
+// that has a matching key pair.
+//
+//	tlsserver -config crypto11.json -label web -addr :8443
+//
+// With -selftest, tlsserver makes one request to itself, trusting only its own certificate, prints the response and
+// exits.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "tlsserver:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("tlsserver", flag.ContinueOnError)
+	config := flags.String("config", "config", "crypto11 configuration `file`")
+	label := flags.String("label", "", "CKA_LABEL of the certificate")
+	addr := flags.String("addr", "localhost:8443", "`address` to listen on")
+	selfTest := flags.Bool("selftest", false, "make one request to the server and exit")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, err := crypto11.ConfigureFromFile(*config)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ctx.Close() }()
+
+	certificate, err := loadCertificate(ctx, *label)
+	if err != nil {
+		return err
+	}
+
+	listener, err := tls.Listen("tcp", *addr, &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "hello from %s over %s\n", certificate.Leaf.Subject.CommonName, tlsVersion(r.TLS))
+	})}
+
+	if !*selfTest {
+		_, _ = fmt.Fprintf(stdout, "serving %s on https://%s\n", certificate.Leaf.Subject, listener.Addr())
+		return server.Serve(listener)
+	}
+
+	go func() { _ = server.Serve(listener) }()
+	defer func() { _ = server.Close() }()
+	body, err := get(listener.Addr(), certificate.Leaf)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(body)
+	return err
+}
+
+// loadCertificate returns the certificate with the label and its key pair, or the first certificate with a key pair
+// if label is empty.
+func loadCertificate(ctx *crypto11.Context, label string) (tls.Certificate, error) {
+	if label == "" {
+		certificates, err := ctx.FindAllPairedCertificates()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if len(certificates) == 0 {
+			return tls.Certificate{}, errors.New("no certificate on the token has a key pair")
+		}
+		return certificates[0], nil
+	}
+
+	certificate, err := ctx.FindCertificate(nil, []byte(label), nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if certificate == nil {
+		return tls.Certificate{}, fmt.Errorf("no certificate has the label %q", label)
+	}
+	key, err := ctx.FindKeyPairForCertificate(certificate)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if key == nil {
+		return tls.Certificate{}, fmt.Errorf("no key pair matches the certificate with the label %q", label)
+	}
+	return tls.Certificate{Certificate: [][]byte{certificate.Raw}, PrivateKey: key, Leaf: certificate}, nil
+}
+
+// get requests the root of the server at addr, trusting only leaf.
+func get(addr net.Addr, leaf *x509.Certificate) ([]byte, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	defer client.CloseIdleConnections()
+
+	response, err := client.Get("https://" + addr.String() + "/")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the server returned %s", response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+func tlsVersion(state *tls.ConnectionState) string {
+	switch state.Version {
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("TLS version %#x", state.Version)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11/examples/internal/smoke"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownFlag(t *testing.T) {
+	assert.Error(t, run([]string{"-unknown"}, &bytes.Buffer{}))
+}
+
+func TestSmoke(t *testing.T) {
+	config := smoke.Config(t)
+	label := smoke.Label(t)
+
+	// Provision a key pair and a self-signed certificate for it.
+	ctx := smoke.Context(t, config)
+	defer func() { require.NoError(t, ctx.Close()) }()
+	id, err := ctx.GenerateID()
+	require.NoError(t, err)
+	key, err := ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P256())
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "tlsserver example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	require.NoError(t, ctx.ImportCertificateWithLabel(id, []byte(label), certificate))
+	defer func() { _ = ctx.DeleteCertificate(id, nil, nil) }()
+
+	var out bytes.Buffer
+	require.NoError(t, run([]string{"-config", config, "-label", label, "-addr", "127.0.0.1:0", "-selftest"}, &out))
+	assert.Contains(t, out.String(), "hello from tlsserver example over TLS 1.")
+
+	assert.Error(t, run([]string{"-config", config, "-label", label + "-missing", "-addr", "127.0.0.1:0",
+		"-selftest"}, &out))
+}
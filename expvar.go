@@ -0,0 +1,181 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/thales-e-security/pool"
+)
+
+// DefaultExpvarName is the name of the expvar.Map used by Config.PublishExpvar, unless Config.ExpvarName is set.
+const DefaultExpvarName = "crypto11"
+
+// expvarMutex serializes changes to the keys of the maps published by Config.PublishExpvar, which expvar.Map does not
+// make atomic.
+var expvarMutex sync.Mutex
+
+// expvarEntry records the key under which a Context is published.
+type expvarEntry struct {
+	published *expvar.Map
+	key       string
+}
+
+// expvarState is the value published for a Context. It is computed when the variable is read.
+type expvarState struct {
+	TokenLabel    string                     `json:"tokenLabel"`
+	TokenSerial   string                     `json:"tokenSerial"`
+	Slot          uint                       `json:"slot"`
+	Pool          expvarPoolStats            `json:"pool"`
+	SessionPools  map[string]expvarPoolStats `json:"sessionPools"`
+	Saturation    float64                    `json:"saturation"`
+	ErrorCounters map[string]uint64          `json:"errorCounters"`
+	CallTimings   []expvarCallTiming         `json:"callTimings"`
+	PublicKeys    PublicKeyStats             `json:"publicKeys"`
+}
+
+// expvarPoolStats describes a session pool.
+type expvarPoolStats struct {
+	Capacity    int64 `json:"capacity"`
+	InUse       int64 `json:"inUse"`
+	Available   int64 `json:"available"`
+	WaitCount   int64 `json:"waitCount"`
+	WaitTimeNs  int64 `json:"waitTimeNs"`
+	IdleClosed  int64 `json:"idleClosed"`
+	MaxCapacity int64 `json:"maxCapacity"`
+}
+
+// expvarCallTiming summarizes a CallTiming.
+type expvarCallTiming struct {
+	Function  string                   `json:"function"`
+	Mechanism uint                     `json:"mechanism"`
+	Count     uint64                   `json:"count"`
+	Buckets   []expvarCallTimingBucket `json:"buckets"`
+}
+
+type expvarCallTimingBucket struct {
+	UpperBound string `json:"upperBound"`
+	Count      uint64 `json:"count"`
+}
+
+// publishedExpvarMap returns the expvar.Map called name, publishing it if it does not exist yet. An error is returned
+// if another kind of variable has the name.
+func publishedExpvarMap(name string) (*expvar.Map, error) {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+
+	switch v := expvar.Get(name).(type) {
+	case nil:
+		return expvar.NewMap(name), nil
+	case *expvar.Map:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("expvar %q is already published as a %T, not an expvar.Map", name, v)
+	}
+}
+
+// publishExpvar adds the Context to published under the serial number of its token, or its slot number if the token
+// has no serial number. Contexts on the same token are told apart by a suffix, "#2" for the second and so on.
+func (c *Context) publishExpvar(published *expvar.Map) {
+	base := strings.TrimSpace(c.token.SerialNumber)
+	if base == "" {
+		base = fmt.Sprintf("slot %d", c.slot)
+	}
+
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+
+	key := base
+	for n := 2; published.Get(key) != nil; n++ {
+		key = fmt.Sprintf("%s#%d", base, n)
+	}
+	published.Set(key, expvar.Func(c.expvarState))
+	c.expvar = &expvarEntry{published: published, key: key}
+}
+
+// unpublishExpvar removes the Context from the map it was published in, if any.
+func (c *Context) unpublishExpvar() {
+	if c.expvar == nil {
+		return
+	}
+	expvarMutex.Lock()
+	c.expvar.published.Delete(c.expvar.key)
+	expvarMutex.Unlock()
+	c.expvar = nil
+}
+
+// expvarState reads the statistics of the Context. Unlike ErrorCounters, it never resets the error counters, so
+// reading the variable does not disturb other consumers of Config.ResetErrorCountersOnRead.
+func (c *Context) expvarState() interface{} {
+	state := expvarState{
+		TokenLabel:    c.token.Label,
+		TokenSerial:   c.token.SerialNumber,
+		Slot:          c.slot,
+		SessionPools:  map[string]expvarPoolStats{},
+		Saturation:    c.saturation.level(),
+		ErrorCounters: c.errorCounters.read(false),
+		CallTimings:   []expvarCallTiming{},
+		PublicKeys:    c.publicKeys.snapshot(),
+	}
+
+	// Resume replaces the pools, so hold it off while they are read.
+	c.suspension.transition.Lock()
+	state.Pool = newExpvarPoolStats(c.pool)
+	c.sessionPools.mutex.Lock()
+	for name, sp := range c.sessionPools.byName {
+		state.SessionPools[name] = newExpvarPoolStats(sp.resources)
+	}
+	c.sessionPools.mutex.Unlock()
+	c.suspension.transition.Unlock()
+
+	for _, timing := range c.CallTimings() {
+		summary := expvarCallTiming{Function: timing.Function, Mechanism: timing.Mechanism, Count: timing.Count()}
+		for _, bucket := range timing.Buckets {
+			upperBound := bucket.UpperBound.String()
+			if bucket.UpperBound == math.MaxInt64 {
+				upperBound = "+Inf"
+			}
+			summary.Buckets = append(summary.Buckets, expvarCallTimingBucket{
+				UpperBound: upperBound,
+				Count:      bucket.Count,
+			})
+		}
+		state.CallTimings = append(state.CallTimings, summary)
+	}
+	return state
+}
+
+func newExpvarPoolStats(resources *pool.ResourcePool) expvarPoolStats {
+	return expvarPoolStats{
+		Capacity:    resources.Capacity(),
+		InUse:       resources.InUse(),
+		Available:   resources.Available(),
+		WaitCount:   resources.WaitCount(),
+		WaitTimeNs:  int64(resources.WaitTime()),
+		IdleClosed:  resources.IdleClosed(),
+		MaxCapacity: resources.MaxCap(),
+	}
+}
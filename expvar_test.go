@@ -0,0 +1,151 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.PublishExpvar = true
+	config.ExpvarName = "crypto11-test-publish"
+	config.CollectCallTimings = true
+	config.ResetErrorCountersOnRead = true
+
+	first, err := Configure(config)
+	require.NoError(t, err)
+	second, err := Configure(config)
+	require.NoError(t, err)
+
+	published, ok := expvar.Get(config.ExpvarName).(*expvar.Map)
+	require.True(t, ok)
+
+	if serial := strings.TrimSpace(first.token.SerialNumber); serial != "" {
+		assert.Equal(t, serial, first.expvar.key)
+	}
+	assert.Equal(t, first.expvar.key+"#2", second.expvar.key)
+	require.NotNil(t, published.Get(first.expvar.key))
+	require.NotNil(t, published.Get(second.expvar.key))
+
+	_, err = first.FindKey(nil, []byte("crypto11 expvar test"))
+	require.NoError(t, err)
+	first.errorCounters.observe(ErrPoolExhausted)
+
+	var state map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(published.Get(first.expvar.key).String()), &state))
+	for _, name := range []string{"tokenLabel", "tokenSerial", "slot", "pool", "sessionPools", "saturation",
+		"errorCounters", "callTimings", "publicKeys"} {
+		assert.Contains(t, state, name)
+	}
+	pool := state["pool"].(map[string]interface{})
+	assert.EqualValues(t, first.pool.Capacity(), pool["capacity"])
+	assert.NotEmpty(t, state["callTimings"])
+
+	// Reading the variable does not reset the error counters.
+	counts := state["errorCounters"].(map[string]interface{})
+	assert.EqualValues(t, 1, counts[ClassifyError(ErrPoolExhausted)])
+	assert.EqualValues(t, 1, first.ErrorCounters()[ClassifyError(ErrPoolExhausted)])
+
+	// Close removes the entry of the Context.
+	key := first.expvar.key
+	require.NoError(t, first.Close())
+	assert.Nil(t, published.Get(key))
+	assert.NotNil(t, published.Get(second.expvar.key))
+	require.NoError(t, second.Close())
+
+	// The key of a closed Context is reused.
+	third, err := Configure(config)
+	require.NoError(t, err)
+	assert.Equal(t, key, third.expvar.key)
+	require.NoError(t, third.Close())
+}
+
+func TestPublishExpvarDuringResume(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.PublishExpvar = true
+	config.ExpvarName = "crypto11-test-resume"
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	published := expvar.Get(config.ExpvarName).(*expvar.Map).Get(ctx.expvar.key)
+	require.NotNil(t, published)
+
+	// Run with -race to check the pool is not read while Resume replaces it.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, ctx.Suspend(context.Background()))
+			assert.NoError(t, ctx.Resume())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			var state map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(published.String()), &state))
+		}
+	}
+}
+
+func TestPublishExpvarNameInUse(t *testing.T) {
+	if expvar.Get("crypto11-test-int") == nil {
+		expvar.NewInt("crypto11-test-int")
+	}
+
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.PublishExpvar = true
+	config.ExpvarName = "crypto11-test-int"
+	_, err = Configure(config)
+	assert.Error(t, err)
+}
+
+func TestPublishExpvarDefaultName(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.PublishExpvar = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	assert.Equal(t, DefaultExpvarName, ctx.cfg.ExpvarName)
+	assert.Contains(t, ctx.EffectiveConfig().Defaulted, "ExpvarName")
+	published, ok := expvar.Get(DefaultExpvarName).(*expvar.Map)
+	require.True(t, ok)
+	assert.NotNil(t, published.Get(ctx.expvar.key))
+}
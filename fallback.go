@@ -0,0 +1,49 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+)
+
+// ErrSoftwareFallbackForbidden is returned, wrapped with the name of the operation, when Config.ForbidSoftwareFallback
+// is set and an operation would perform cryptography on secret-dependent data in software. Use errors.Is to test for
+// it.
+var ErrSoftwareFallbackForbidden = errors.New("software cryptography fallback forbidden")
+
+// softwareFallbacks lists every operation that may fall back to software cryptography on secret-dependent data.
+// Each must be guarded by a call to allowSoftwareFallback. TestSoftwareFallbacksGuarded checks that software
+// cryptography is only used in functions that are guarded, so new fallbacks must be added here.
+//
+// The only such operation is the AES-GCM encryption of envelope payloads (see EncryptEnvelope); all other
+// secret-dependent computation is performed by the token. Operations on public data only, such as signature
+// verification and public key parsing, are not fallbacks.
+var softwareFallbacks = []string{"envelope encryption"}
+
+// allowSoftwareFallback returns an error if software fallback is forbidden by the configuration. operation must be
+// listed in softwareFallbacks.
+func (c *Context) allowSoftwareFallback(operation string) error {
+	if c.cfg.ForbidSoftwareFallback {
+		return withMessage(ErrSoftwareFallbackForbidden, operation)
+	}
+	return nil
+}
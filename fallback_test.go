@@ -0,0 +1,151 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// softwareCryptoCalls are functions that compute on secret data in software. Calling them outside a function
+// guarded by allowSoftwareFallback is a software fallback.
+var softwareCryptoCalls = map[string][]string{
+	"crypto/aes":     {"NewCipher"},
+	"crypto/cipher":  {"NewGCM", "NewGCMWithNonceSize", "NewGCMWithTagSize", "NewCBCEncrypter", "NewCBCDecrypter"},
+	"crypto/des":     {"NewCipher", "NewTripleDESCipher"},
+	"crypto/dsa":     {"Sign"},
+	"crypto/ecdsa":   {"Sign", "SignASN1"},
+	"crypto/ed25519": {"GenerateKey", "NewKeyFromSeed", "Sign"},
+	"crypto/hmac":    {"New"},
+	"crypto/rsa":     {"DecryptOAEP", "DecryptPKCS1v15", "DecryptPKCS1v15SessionKey", "SignPKCS1v15", "SignPSS"},
+}
+
+// softwareCryptoPackages are packages whose secret computations are methods, such as ecdh.PrivateKey.ECDH, which
+// softwareCryptoCalls cannot follow. Importing them at all counts as a software fallback.
+var softwareCryptoPackages = []string{"crypto/ecdh"}
+
+func TestAllowSoftwareFallback(t *testing.T) {
+	allowed := &Context{cfg: &Config{}}
+	assert.NoError(t, allowed.allowSoftwareFallback("test operation"))
+
+	forbidden := &Context{cfg: &Config{ForbidSoftwareFallback: true}}
+	err := forbidden.allowSoftwareFallback("test operation")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrSoftwareFallbackForbidden))
+	assert.Contains(t, err.Error(), "test operation")
+}
+
+// TestSoftwareFallbacksGuarded checks that software cryptography is only used in functions guarded by
+// allowSoftwareFallback, and that every guarded operation is listed in softwareFallbacks.
+func TestSoftwareFallbacksGuarded(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	require.NoError(t, err)
+
+	guarded := map[string]bool{}
+	fset := token.NewFileSet()
+
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		require.NoError(t, err)
+
+		imports := map[string]string{}
+		for _, spec := range file.Imports {
+			path, _ := strconv.Unquote(spec.Path.Value)
+			for _, pkg := range softwareCryptoPackages {
+				assert.NotEqual(t, pkg, path, "%s: software cryptography package imported",
+					fset.Position(spec.Pos()))
+			}
+			local := filepath.Base(path)
+			if spec.Name != nil {
+				local = spec.Name.Name
+			}
+			imports[local] = path
+		}
+
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil {
+				continue
+			}
+
+			var operations []string
+			var softwareCalls []string
+
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+
+				if sel.Sel.Name == "allowSoftwareFallback" {
+					require.Len(t, call.Args, 1)
+					lit, ok := call.Args[0].(*ast.BasicLit)
+					require.True(t, ok, "%s: allowSoftwareFallback must be called with a string literal",
+						fset.Position(call.Pos()))
+					operation, _ := strconv.Unquote(lit.Value)
+					operations = append(operations, operation)
+					return true
+				}
+
+				if pkg, ok := sel.X.(*ast.Ident); ok {
+					for _, f := range softwareCryptoCalls[imports[pkg.Name]] {
+						if f == sel.Sel.Name {
+							softwareCalls = append(softwareCalls, fset.Position(call.Pos()).String())
+						}
+					}
+				}
+				return true
+			})
+
+			if len(softwareCalls) > 0 {
+				assert.NotEmpty(t, operations, "software cryptography without allowSoftwareFallback at %v",
+					softwareCalls)
+			}
+			for _, operation := range operations {
+				guarded[operation] = true
+			}
+		}
+	}
+
+	listed := map[string]bool{}
+	for _, operation := range softwareFallbacks {
+		listed[operation] = true
+	}
+	assert.Equal(t, listed, guarded, "softwareFallbacks does not match the guarded operations")
+}
@@ -0,0 +1,306 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Sealed fields ----------------------------------------------------------
+//
+// SealField encrypts small values under an AES-256 token key, identified by its label, using GCM. A sealed field is
+// laid out as follows. Version 1 is the only version.
+//
+//	offset  length  contents
+//	0       1       format version, 1
+//	1       1       length n of the key identifier, at least 1
+//	2       n       key identifier: the CKA_ID of the token key
+//	2+n     1       length m of the GCM nonce, at least 1
+//	3+n     m       GCM nonce
+//	3+n+m   rest    GCM ciphertext, with a 16 byte tag
+//
+// The additional data authenticated by GCM is the header (every byte before the ciphertext) followed by the caller's
+// additional data, so the version and key identifier cannot be altered.
+//
+// Field keys have a 4 byte big-endian CKA_ID holding their version, starting at 1. Fields are sealed with the key of
+// the highest version, and opened with the key recorded in the field, so older fields remain readable after
+// RotateFieldKey.
+
+// fieldFormatVersion is the version byte written by SealField.
+const fieldFormatVersion = 1
+
+// fieldKeyBits is the size of field keys.
+const fieldKeyBits = 256
+
+// fieldTagLength is the length of the GCM tag in a sealed field.
+const fieldTagLength = 16
+
+// ErrFieldOpen is returned by OpenField when a sealed field is malformed, was sealed with a key that cannot be found,
+// or fails authentication.
+var ErrFieldOpen = errors.New("sealed field cannot be opened")
+
+// fieldKey is a field key found on the token.
+type fieldKey struct {
+	key     *SecretKey
+	version uint32
+}
+
+// SealField encrypts plaintext, authenticating aad, under the newest field key with the given label. If there is no
+// field key with the label, version 1 is generated. The returned value holds everything OpenField needs apart from
+// aad; its format is described in fields.go.
+//
+// Field keys generated concurrently by two processes may share a version, so provision the first key with
+// RotateFieldKey when several processes seal fields under the same label.
+func (c *Context) SealField(keyLabel string, plaintext, aad []byte) ([]byte, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if c.cfg.UseGCMIVFromHSM {
+		// The token chooses GCM nonces, but the nonce is part of the authenticated header.
+		return nil, errors.New("sealed fields cannot be used with UseGCMIVFromHSM")
+	}
+
+	current, err := c.currentFieldKey(keyLabel)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		if current, err = c.newFieldKey(keyLabel, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	nonceReader, err := c.nonceReader()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, c.cfg.GCMIVLength)
+	if _, err = io.ReadFull(nonceReader, nonce); err != nil {
+		return nil, withMessage(err, "generating nonce")
+	}
+
+	header := fieldHeader(fieldKeyID(current.version), nonce)
+
+	ciphertext, err := current.key.cryptGCM(true, nonce, plaintext, concat(header, aad))
+	if err != nil {
+		return nil, err
+	}
+	return concat(header, ciphertext), nil
+}
+
+// OpenField decrypts a value returned by SealField with the same keyLabel, authenticating aad. If the field is
+// malformed, its key cannot be found, or authentication fails, an error wrapping ErrFieldOpen is returned.
+func (c *Context) OpenField(keyLabel string, sealed, aad []byte) ([]byte, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	id, nonce, ciphertext, err := parseField(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := c.FindKey(id, []byte(keyLabel))
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, withMessage(ErrFieldOpen, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, withMessagef(ErrFieldOpen, "no key with label %q and ID %x", keyLabel, id)
+	}
+
+	header := sealed[:len(sealed)-len(ciphertext)]
+	plaintext, err := key.cryptGCM(false, nonce, ciphertext, concat(header, aad))
+	if isPKCS11Error(err, pkcs11.CKR_ENCRYPTED_DATA_INVALID, pkcs11.CKR_ENCRYPTED_DATA_LEN_RANGE) {
+		return nil, withMessage(ErrFieldOpen, "authentication failed")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// RotateFieldKey generates a field key with the given label, with a version one higher than any existing field key,
+// and returns the new version. Later calls to SealField use the new key, while fields sealed under older keys can
+// still be opened until those keys are deleted.
+func (c *Context) RotateFieldKey(keyLabel string) (uint32, error) {
+	if c.closed.Get() {
+		return 0, errClosed
+	}
+
+	current, err := c.currentFieldKey(keyLabel)
+	if err != nil {
+		return 0, err
+	}
+	var version uint32
+	if current != nil {
+		version = current.version
+	}
+
+	key, err := c.newFieldKey(keyLabel, version)
+	if err != nil {
+		return 0, err
+	}
+	return key.version, nil
+}
+
+// currentFieldKey returns the field key with the given label and the highest version, or nil if there is none. Keys
+// with the label whose CKA_ID is not a version number are ignored.
+func (c *Context) currentFieldKey(keyLabel string) (*fieldKey, error) {
+	var current *fieldKey
+	err := c.withSession(func(session *pkcs11Session) error {
+		handles, err := findKeys(session, nil, []byte(keyLabel), uintPtr(pkcs11.CKO_SECRET_KEY),
+			uintPtr(pkcs11.CKK_AES))
+		if err != nil {
+			return err
+		}
+
+		for _, handle := range handles {
+			attributes, err := session.ctx.GetAttributeValue(session.handle, handle,
+				[]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, nil)})
+			if isObjectGone(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			id := attributes[0].Value
+			if len(id) != 4 {
+				continue
+			}
+			version := binary.BigEndian.Uint32(id)
+			if current == nil || version > current.version {
+				current = &fieldKey{key: newSecretKey(c, handle, CipherAES), version: version}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return current, nil
+}
+
+// newFieldKey generates a field key with a version one higher than seen, unless another caller of this Context has
+// already done so, in which case that key is returned.
+func (c *Context) newFieldKey(keyLabel string, seen uint32) (*fieldKey, error) {
+	c.fieldKeyMutex.Lock()
+	defer c.fieldKeyMutex.Unlock()
+
+	current, err := c.currentFieldKey(keyLabel)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && current.version > seen {
+		return current, nil
+	}
+
+	version := seen + 1
+	key, err := c.GenerateSecretKeyWithLabel(fieldKeyID(version), []byte(keyLabel), fieldKeyBits, CipherAES)
+	if err != nil {
+		return nil, err
+	}
+	return &fieldKey{key: key, version: version}, nil
+}
+
+// fieldKeyID returns the CKA_ID of the field key with the given version.
+func fieldKeyID(version uint32) []byte {
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, version)
+	return id
+}
+
+// fieldHeader returns the header of a sealed field.
+func fieldHeader(id, nonce []byte) []byte {
+	header := make([]byte, 0, 3+len(id)+len(nonce))
+	header = append(header, fieldFormatVersion, byte(len(id)))
+	header = append(header, id...)
+	header = append(header, byte(len(nonce)))
+	return append(header, nonce...)
+}
+
+// parseField splits a sealed field into its key identifier, nonce and ciphertext.
+func parseField(sealed []byte) (id, nonce, ciphertext []byte, err error) {
+	if len(sealed) < 2 {
+		return nil, nil, nil, withMessage(ErrFieldOpen, "field is truncated")
+	}
+	if sealed[0] != fieldFormatVersion {
+		return nil, nil, nil, withMessagef(ErrFieldOpen, "unsupported field format version %d", sealed[0])
+	}
+
+	rest := sealed[1:]
+	for _, field := range []*[]byte{&id, &nonce} {
+		if len(rest) < 1 || rest[0] == 0 || len(rest) < 1+int(rest[0]) {
+			return nil, nil, nil, withMessage(ErrFieldOpen, "field is truncated")
+		}
+		*field, rest = rest[1:1+int(rest[0])], rest[1+int(rest[0]):]
+	}
+
+	if len(rest) < fieldTagLength {
+		return nil, nil, nil, withMessage(ErrFieldOpen, "field is truncated")
+	}
+	return id, nonce, rest, nil
+}
+
+// cryptGCM encrypts or decrypts input with GCM on the token. Unlike the cipher.AEAD returned by NewGCM, it returns
+// errors rather than panicking, and always supplies the nonce.
+func (key *SecretKey) cryptGCM(encrypt bool, nonce, input, aad []byte) ([]byte, error) {
+	if err := key.checkCipherUsage("GCM", key.Cipher.GCMMech, encrypt, !encrypt); err != nil {
+		return nil, err
+	}
+	if limit := key.context.maxSingleCallSize(); limit > 0 && len(input) > limit {
+		return nil, withMessagef(ErrInputTooLarge, "%d byte input, limit %d bytes", len(input), limit)
+	}
+
+	var output []byte
+	err := key.withSession(func(session *pkcs11Session) error {
+		params := pkcs11.NewGCMParams(nonce, aad, fieldTagLength*8)
+		defer params.Free()
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(key.Cipher.GCMMech, params)}
+
+		var err error
+		if encrypt {
+			if err = session.encryptInit(mech, key.handle); err != nil {
+				return err
+			}
+			output, err = session.encrypt(input)
+			return err
+		}
+
+		if err = session.decryptInit(mech, key.handle); err != nil {
+			return err
+		}
+		output, err = session.decrypt(key.Cipher.GCMMech, input)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
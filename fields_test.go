@@ -0,0 +1,113 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseField(t *testing.T) {
+	header := fieldHeader(fieldKeyID(7), []byte{1, 2, 3})
+	require.Equal(t, []byte{1, 4, 0, 0, 0, 7, 3, 1, 2, 3}, header)
+
+	ciphertext := make([]byte, fieldTagLength+1)
+	id, nonce, rest, err := parseField(concat(header, ciphertext))
+	require.NoError(t, err)
+	assert.Equal(t, fieldKeyID(7), id)
+	assert.Equal(t, []byte{1, 2, 3}, nonce)
+	assert.Equal(t, ciphertext, rest)
+
+	for _, sealed := range [][]byte{
+		nil,
+		{1},
+		{2, 4, 0, 0, 0, 7, 3, 1, 2, 3},
+		{1, 0, 3, 1, 2, 3},
+		{1, 4, 0, 0, 0, 7, 0},
+		{1, 4, 0, 0, 0},
+		{1, 4, 0, 0, 0, 7, 3, 1, 2},
+		concat(header, make([]byte, fieldTagLength-1)),
+	} {
+		_, _, _, err := parseField(sealed)
+		assert.True(t, errors.Is(err, ErrFieldOpen), "%x: %v", sealed, err)
+	}
+}
+
+func TestSealField(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		label := fmt.Sprintf("field-%x", randomBytes())
+		defer func() {
+			keys, err := ctx.FindKeys(nil, []byte(label))
+			require.NoError(t, err)
+			for _, key := range keys {
+				require.NoError(t, key.Delete())
+			}
+		}()
+
+		plaintext, aad := []byte("card number 4111 1111 1111 1111"), []byte("customer 1")
+		sealed, err := ctx.SealField(label, plaintext, aad)
+		require.NoError(t, err)
+		require.Equal(t, byte(fieldFormatVersion), sealed[0])
+
+		opened, err := ctx.OpenField(label, sealed, aad)
+		require.NoError(t, err)
+		require.Equal(t, plaintext, opened)
+
+		// Each field has its own nonce.
+		again, err := ctx.SealField(label, plaintext, aad)
+		require.NoError(t, err)
+		require.NotEqual(t, sealed, again)
+
+		_, err = ctx.OpenField(label, sealed, []byte("customer 2"))
+		require.True(t, errors.Is(err, ErrFieldOpen), "unexpected error: %v", err)
+
+		for i := range sealed {
+			garbled := append([]byte(nil), sealed...)
+			garbled[i] ^= 0x01
+			_, err = ctx.OpenField(label, garbled, aad)
+			require.True(t, errors.Is(err, ErrFieldOpen), "byte %d: %v", i, err)
+		}
+
+		_, err = ctx.OpenField(label+"-other", sealed, aad)
+		require.True(t, errors.Is(err, ErrFieldOpen), "unexpected error: %v", err)
+
+		version, err := ctx.RotateFieldKey(label)
+		require.NoError(t, err)
+		require.Equal(t, uint32(2), version)
+
+		rotated, err := ctx.SealField(label, plaintext, aad)
+		require.NoError(t, err)
+		id, _, _, err := parseField(rotated)
+		require.NoError(t, err)
+		require.Equal(t, fieldKeyID(2), id)
+
+		for _, s := range [][]byte{sealed, rotated} {
+			opened, err = ctx.OpenField(label, s, aad)
+			require.NoError(t, err)
+			require.Equal(t, plaintext, opened)
+		}
+	})
+}
@@ -0,0 +1,265 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build go1.18
+// +build go1.18
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// The fuzz targets in this file cover the parsers that convert attribute values read from a token into Go
+// values. Seeds include the real-world vendor quirks we know about; larger ones, such as whole certificates, are kept
+// in testdata/fuzz. Run them with, for example:
+//
+//	go test -run XXX -fuzz FuzzUnmarshalEcPoint
+
+func FuzzParseRSAPublicKey(f *testing.F) {
+	f.Add([]byte{0xc5, 0x3b}, []byte{1, 0, 1})
+	// Exponent with leading zero bytes, as returned by some tokens
+	f.Add([]byte{0xc5, 0x3b}, []byte{0, 0, 0, 0, 0, 1, 0, 1})
+	// Empty and even moduli
+	f.Add([]byte{}, []byte{1, 0, 1})
+	f.Add([]byte{0xc5, 0x3a}, []byte{3})
+	// Exponent wider than an int on 32-bit platforms
+	f.Add([]byte{0xc5, 0x3b}, []byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, modulus, exponent []byte) {
+		pub, err := parseRSAPublicKey(modulus, exponent)
+		if err != nil {
+			return
+		}
+		if pub.N.Bit(0) != 1 || pub.E < 2 {
+			t.Fatalf("accepted malformed RSA public key N=%v E=%d", pub.N, pub.E)
+		}
+	})
+}
+
+func FuzzParseDSAPublicKey(f *testing.F) {
+	f.Add([]byte{23}, []byte{11}, []byte{4}, []byte{8})
+	f.Add([]byte{}, []byte{}, []byte{}, []byte{})
+	// Parameters with leading zero bytes
+	f.Add([]byte{0, 23}, []byte{0, 11}, []byte{0, 4}, []byte{0, 8})
+
+	f.Fuzz(func(t *testing.T, p, q, g, y []byte) {
+		pub, err := parseDSAPublicKey(p, q, g, y)
+		if err != nil {
+			return
+		}
+		if pub.Q.Cmp(pub.P) >= 0 || pub.G.Cmp(pub.P) >= 0 || pub.Y.Cmp(pub.P) >= 0 {
+			t.Fatal("accepted DSA public key with values outside the group")
+		}
+	})
+}
+
+func FuzzUnmarshalEcParams(f *testing.F) {
+	for _, ci := range wellKnownCurves {
+		f.Add(ci.oid)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x06})
+	// Explicit ECParameters rather than a named curve
+	f.Add([]byte{0x30, 0x03, 0x02, 0x01, 0x01})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		curve, err := unmarshalEcParams(b)
+		if err == nil && curve == nil {
+			t.Fatal("nil curve returned without an error")
+		}
+	})
+}
+
+func FuzzUnmarshalEcPoint(f *testing.F) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	raw := elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+	der, err := asn1.Marshal(raw)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(der)
+	// Raw point without the OCTET STRING wrapper, as returned by some tokens
+	f.Add(raw)
+	// Truncated and padded encodings
+	f.Add(der[:len(der)-1])
+	f.Add(append(append([]byte{}, der...), 0))
+	f.Add([]byte{0x04, 0x00})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		x, y, err := unmarshalEcPoint(b, elliptic.P256())
+		if err != nil {
+			return
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			t.Fatal("accepted point that is not on the curve")
+		}
+	})
+}
+
+func FuzzParseCertificateValue(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x30, 0x00})
+	f.Add([]byte("-----BEGIN CERTIFICATE-----\n"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cert, err := parseCertificateValue(b)
+		if err != nil {
+			return
+		}
+		// Trailing bytes, such as the padding some tokens return, must be rejected rather than dropped.
+		if !bytes.Equal(cert.Raw, b) {
+			t.Fatalf("parsed %d of %d bytes as a certificate", len(cert.Raw), len(b))
+		}
+
+		// The accepted value must be a DER certificate that re-encodes byte-for-byte from its parts.
+		var parts struct {
+			TBSCertificate     asn1.RawValue
+			SignatureAlgorithm asn1.RawValue
+			SignatureValue     asn1.RawValue
+		}
+		if rest, err := asn1.Unmarshal(b, &parts); err != nil || len(rest) != 0 {
+			t.Fatalf("accepted a certificate that is not a DER SEQUENCE of three values: %v", err)
+		}
+		if !bytes.Equal(parts.TBSCertificate.FullBytes, cert.RawTBSCertificate) {
+			t.Fatal("TBSCertificate differs from the parsed certificate")
+		}
+		encoded, err := asn1.Marshal(parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, b) {
+			t.Fatalf("certificate re-encodes as %x", encoded)
+		}
+	})
+}
+
+func FuzzCheckGCMIVEcho(f *testing.F) {
+	f.Add(make([]byte, 12), make([]byte, 12))
+	// Tokens that leave the IV alone echo nothing back
+	f.Add(make([]byte, 12), []byte{})
+	// A token-generated IV longer than the caller's nonce
+	f.Add(make([]byte, 12), make([]byte, 16))
+
+	// A token-generated IV of the caller's nonce length
+	f.Add(make([]byte, 12), []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})
+
+	f.Fuzz(func(t *testing.T, nonce, echoed []byte) {
+		err := checkGCMIVEcho(nonce, echoed)
+		if err == nil && !bytes.Equal(nonce, echoed) {
+			t.Fatalf("accepted IV %x for nonce %x", echoed, nonce)
+		}
+		if err != nil && bytes.Equal(nonce, echoed) {
+			t.Fatalf("rejected the echoed nonce %x: %v", nonce, err)
+		}
+	})
+}
+
+func FuzzDSASignature(f *testing.F) {
+	der, err := asn1.Marshal(dsaSignature{R: big.NewInt(1), S: big.NewInt(2)})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(der)
+	f.Add([]byte{1, 2})
+	f.Add([]byte{1})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var sig dsaSignature
+		if err := sig.unmarshalBytes(b); err == nil && (sig.R == nil || sig.S == nil) {
+			t.Fatal("raw signature parsed without values")
+		}
+
+		sig = dsaSignature{}
+		if err := sig.unmarshalDER(b); err == nil && (sig.R == nil || sig.S == nil) {
+			t.Fatal("DER signature parsed without values")
+		}
+	})
+}
+
+func FuzzParseECDSASignature(f *testing.F) {
+	der, err := MarshalECDSASignatureDER(big.NewInt(1), big.NewInt(2))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(der)
+	f.Add(make([]byte, 64))
+	f.Add([]byte{0x30, 0x81, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x02})
+	f.Add([]byte{})
+
+	curve := elliptic.P256()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, s, err := ParseECDSASignatureWithOptions(b, curve, ECDSASignatureOptions{Encoding: ECDSASignatureDER})
+		if err != nil {
+			return
+		}
+		// Strict parsing only accepts the canonical encoding, so re-encoding must reproduce the input.
+		encoded, err := MarshalECDSASignatureDER(r, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != string(b) {
+			t.Fatalf("accepted non-canonical encoding %x", b)
+		}
+	})
+}
+
+func FuzzDecodeBackup(f *testing.F) {
+	attributes := NewAttributeSet()
+	if err := attributes.Set(CkaClass, pkcs11.CKO_SECRET_KEY); err != nil {
+		f.Fatal(err)
+	}
+	blob := encodeBackup(0, pkcs11.CKM_AES_KEY_WRAP, nil, attributes, []byte("wrapped"))
+	f.Add(blob)
+	f.Add(append(encodeBackup(backupAuthenticated, pkcs11.CKM_AES_CBC_PAD, make([]byte, 16), attributes,
+		[]byte("wrapped")), make([]byte, backupMACLength)...))
+	// Authenticated header followed by fewer bytes than the HMAC and the rest of the header need
+	f.Add(append([]byte("C11W\x01\x01"), make([]byte, 30)...))
+	f.Add(blob[:len(blob)-1])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		backup, err := decodeBackup(b)
+		if err != nil {
+			return
+		}
+		// Every valid blob has a single encoding, so re-encoding must reproduce the input.
+		encoded := encodeBackup(backup.flags, backup.mechanism, backup.iv, backup.attributes, backup.wrapped)
+		encoded = append(encoded, backup.mac...)
+		if string(encoded) != string(b) {
+			t.Fatalf("accepted non-canonical backup blob %x", b)
+		}
+	})
+}
@@ -4,7 +4,6 @@ go 1.13
 
 require (
 	github.com/miekg/pkcs11 v1.1.1
-	github.com/pkg/errors v0.8.1
 	github.com/stretchr/testify v1.3.0
 	github.com/thales-e-security/pool v0.0.2
 )
@@ -0,0 +1,311 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// The tests in this file check token output against the Go standard library and against known-good values stored
+// in testdata/golden.json, so that mistakes in mechanism parameter encoding cannot hide behind tests that both
+// produce and check results on the token.
+
+type goldenMAC struct {
+	Key     hexBytes
+	Message hexBytes
+	MAC     hexBytes
+}
+
+type goldenVectors struct {
+	Message     hexBytes
+	RSAKey      hexBytes
+	RSAPKCS1v15 map[string]hexBytes
+	RSAOAEP     map[string]hexBytes
+	GCM         struct {
+		Key            hexBytes
+		Nonce          hexBytes
+		AdditionalData hexBytes
+		Ciphertext     hexBytes
+	}
+	CMAC       goldenMAC
+	HMACSHA256 goldenMAC
+}
+
+// hexBytes is a byte slice stored as a hex string.
+type hexBytes []byte
+
+func (h *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(s)
+	*h = b
+	return err
+}
+
+var goldenHashes = map[string]crypto.Hash{
+	"SHA1":   crypto.SHA1,
+	"SHA224": crypto.SHA224,
+	"SHA256": crypto.SHA256,
+	"SHA384": crypto.SHA384,
+	"SHA512": crypto.SHA512,
+}
+
+func loadGoldenVectors(t *testing.T) *goldenVectors {
+	data, err := ioutil.ReadFile("testdata/golden.json")
+	require.NoError(t, err)
+
+	var vectors goldenVectors
+	require.NoError(t, json.Unmarshal(data, &vectors))
+	return &vectors
+}
+
+// importRSAPrivateKey creates a session object holding key, so that token output can be compared with stored
+// values.
+func importRSAPrivateKey(t *testing.T, ctx *Context, key *rsa.PrivateKey) *pkcs11PrivateKeyRSA {
+	var handle pkcs11.ObjectHandle
+	err := ctx.withSession(func(session *pkcs11Session) (err error) {
+		handle, err = session.ctx.CreateObject(session.handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(key.E)).Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, key.D.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, key.Primes[0].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, key.Primes[1].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, key.Precomputed.Dp.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, key.Precomputed.Dq.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, key.Precomputed.Qinv.Bytes()),
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	return &pkcs11PrivateKeyRSA{pkcs11PrivateKey: pkcs11PrivateKey{
+		pkcs11Object: pkcs11Object{handle: handle, context: ctx},
+		pubKey:       &key.PublicKey,
+	}}
+}
+
+func TestGoldenRSA(t *testing.T) {
+	vectors := loadGoldenVectors(t)
+
+	goKey, err := x509.ParsePKCS1PrivateKey(vectors.RSAKey)
+	require.NoError(t, err)
+
+	withContext(t, func(ctx *Context) {
+		key := importRSAPrivateKey(t, ctx, goKey)
+		defer func() { _ = key.pkcs11Object.Delete() }()
+
+		for name, h := range goldenHashes {
+			digester := h.New()
+			digester.Write(vectors.Message)
+			digest := digester.Sum(nil)
+
+			// PKCS#1 v1.5 signatures are deterministic, so must match the stored value exactly
+			sig, err := key.Sign(nil, digest, h)
+			require.NoError(t, err, name)
+			require.Equal(t, []byte(vectors.RSAPKCS1v15[name]), sig, name)
+			require.NoError(t, rsa.VerifyPKCS1v15(&goKey.PublicKey, h, digest, sig), name)
+
+			pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: h}
+			sig, err = key.Sign(nil, digest, pssOpts)
+			require.NoError(t, err, name)
+			require.NoError(t, rsa.VerifyPSS(&goKey.PublicKey, h, digest, sig, pssOpts), name)
+		}
+
+		for name, ciphertext := range vectors.RSAOAEP {
+			h := goldenHashes[name]
+			opts := &rsa.OAEPOptions{Hash: h}
+
+			plaintext, err := key.Decrypt(nil, ciphertext, opts)
+			require.NoError(t, err, name)
+			require.Equal(t, []byte(vectors.Message), plaintext, name)
+
+			fresh, err := rsa.EncryptOAEP(h.New(), rand.Reader, &goKey.PublicKey, vectors.Message, nil)
+			require.NoError(t, err, name)
+			plaintext, err = key.Decrypt(nil, fresh, opts)
+			require.NoError(t, err, name)
+			require.Equal(t, []byte(vectors.Message), plaintext, name)
+		}
+	})
+}
+
+func TestGoldenECDSA(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		for _, curve := range curves {
+			name := curve.Params().Name
+
+			// Generate an extractable key, so the private scalar can be checked against the public key
+			public, err := NewAttributeSetWithID(randomBytes())
+			require.NoError(t, err)
+			private := public.Copy()
+			require.NoError(t, private.Set(CkaExtractable, true))
+			require.NoError(t, private.Set(CkaSensitive, false))
+
+			key, err := ctx.GenerateECDSAKeyPairWithAttributes(public, private, curve)
+			if err != nil {
+				t.Logf("skipping %s: %v", name, err)
+				continue
+			}
+
+			value, err := ctx.GetAttribute(key, CkaValue)
+			require.NoError(t, err, name)
+			pub := key.Public().(*ecdsa.PublicKey)
+			x, y := curve.ScalarBaseMult(value.Value)
+			require.Equal(t, 0, x.Cmp(pub.X), name)
+			require.Equal(t, 0, y.Cmp(pub.Y), name)
+
+			digest := sha256.Sum256([]byte(name))
+			der, err := key.Sign(nil, digest[:], crypto.SHA256)
+			require.NoError(t, err, name)
+
+			var sig dsaSignature
+			require.NoError(t, sig.unmarshalDER(der), name)
+			require.True(t, ecdsa.Verify(pub, digest[:], sig.R, sig.S), name)
+
+			require.NoError(t, key.Delete())
+		}
+	})
+}
+
+func TestGoldenGCM(t *testing.T) {
+	vectors := loadGoldenVectors(t)
+
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_AES_GCM)
+
+		key, err := ctx.ImportSecretKey(randomBytes(), vectors.GCM.Key, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		aead, err := key.NewGCM()
+		require.NoError(t, err)
+		if aead.NonceSize() != len(vectors.GCM.Nonce) {
+			t.Skipf("token uses %d byte GCM IVs", aead.NonceSize())
+		}
+
+		sealed := aead.Seal(nil, vectors.GCM.Nonce, vectors.Message, vectors.GCM.AdditionalData)
+		require.Equal(t, []byte(vectors.GCM.Ciphertext), sealed)
+
+		opened, err := aead.Open(nil, vectors.GCM.Nonce, vectors.GCM.Ciphertext, vectors.GCM.AdditionalData)
+		require.NoError(t, err)
+		require.Equal(t, []byte(vectors.Message), opened)
+	})
+}
+
+func TestGoldenGCMExtractable(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_AES_GCM)
+
+		template, err := NewAttributeSetWithID(randomBytes())
+		require.NoError(t, err)
+		require.NoError(t, template.Set(CkaExtractable, true))
+		require.NoError(t, template.Set(CkaSensitive, false))
+
+		key, err := ctx.GenerateSecretKeyWithAttributes(template, 256, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		value, err := ctx.GetAttribute(key, CkaValue)
+		require.NoError(t, err)
+
+		aead, err := key.NewGCM()
+		require.NoError(t, err)
+
+		block, err := aes.NewCipher(value.Value)
+		require.NoError(t, err)
+		soft, err := cipher.NewGCMWithNonceSize(block, aead.NonceSize())
+		require.NoError(t, err)
+
+		nonce := make([]byte, aead.NonceSize())
+		_, err = rand.Read(nonce)
+		require.NoError(t, err)
+
+		plaintext := []byte("golden GCM plaintext")
+		sealed := aead.Seal(nil, nonce, plaintext, nil)
+		require.Equal(t, soft.Seal(nil, nonce, plaintext, nil), sealed)
+	})
+}
+
+func TestGoldenMACs(t *testing.T) {
+	vectors := loadGoldenVectors(t)
+
+	withContext(t, func(ctx *Context) {
+		t.Run("HMAC", func(t *testing.T) {
+			key, err := ctx.ImportSecretKey(randomBytes(), vectors.HMACSHA256.Key, CipherGeneric)
+			require.NoError(t, err)
+			defer func() { _ = key.Delete() }()
+
+			h, err := key.NewHMAC(pkcs11.CKM_SHA256_HMAC, 0)
+			require.NoError(t, err)
+			_, err = h.Write(vectors.HMACSHA256.Message)
+			require.NoError(t, err)
+			mac := h.Sum(nil)
+
+			require.Equal(t, []byte(vectors.HMACSHA256.MAC), mac)
+
+			soft := hmac.New(sha256.New, vectors.HMACSHA256.Key)
+			soft.Write(vectors.HMACSHA256.Message)
+			require.Equal(t, soft.Sum(nil), mac)
+		})
+
+		t.Run("CMAC", func(t *testing.T) {
+			skipIfMechUnsupported(t, ctx, pkcs11.CKM_AES_CMAC)
+
+			template, err := NewAttributeSetWithID(randomBytes())
+			require.NoError(t, err)
+			require.NoError(t, template.Set(CkaSign, true))
+
+			key, err := ctx.ImportSecretKeyWithAttributes(template, vectors.CMAC.Key, CipherAES)
+			require.NoError(t, err)
+			defer func() { _ = key.Delete() }()
+
+			h, err := key.NewHMAC(pkcs11.CKM_AES_CMAC, 16)
+			require.NoError(t, err)
+			_, err = h.Write(vectors.CMAC.Message)
+			require.NoError(t, err)
+
+			require.Equal(t, []byte(vectors.CMAC.MAC), h.Sum(nil))
+		})
+	})
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"sort"
+
+	// Every registered SHA-1 and SHA-2 hash can be computed in software, for instance for software PSS encoding, so
+	// crypto.Hash.New must not panic for any of them. SHA-3 is only available in software if the application links
+	// an implementation, see softwareHash.
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS#11 3.0 SHA-3 identifiers not defined by github.com/miekg/pkcs11.
+const (
+	ckgMGF1SHA3_224 = 0x00000006
+	ckgMGF1SHA3_256 = 0x00000007
+	ckgMGF1SHA3_384 = 0x00000008
+	ckgMGF1SHA3_512 = 0x00000009
+
+	ckmECDSASHA3_224 = 0x00001047
+	ckmECDSASHA3_256 = 0x00001048
+	ckmECDSASHA3_384 = 0x00001049
+	ckmECDSASHA3_512 = 0x0000104A
+)
+
+// ErrUnsupportedHash is wrapped by the errors returned when SignerOpts, DecrypterOpts or another argument names a
+// hash function that crypto11 cannot use. The error message includes the numeric crypto.Hash value.
+var ErrUnsupportedHash = errors.New("unsupported hash function")
+
+// hashInfo describes how a hash function is used with PKCS#11.
+type hashInfo struct {
+	// mechanism is the CKM_ digest mechanism.
+	mechanism uint
+
+	// mgf is the CKG_MGF1_ mask generation function, for PSS and OAEP.
+	mgf uint
+
+	// size is the digest length in bytes.
+	size uint
+
+	// digestInfoPrefix is the DER encoding of the DigestInfo that precedes the digest in PKCS#1 v1.5 signatures.
+	digestInfoPrefix []byte
+
+	// rsaPKCS, rsaPSS, ecdsa and dsa are the combined mechanisms that hash with this function on the token and then
+	// sign or verify with RSA PKCS#1 v1.5, RSA-PSS, ECDSA and DSA respectively.
+	rsaPKCS, rsaPSS, ecdsa, dsa uint
+}
+
+// signMechanism returns the combined mechanism that hashes with this function and then signs or verifies with a key
+// of keyType, using RSA-PSS rather than PKCS#1 v1.5 for RSA keys if pss is set. It returns zero for other key types.
+func (info hashInfo) signMechanism(keyType uint, pss bool) uint {
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		if pss {
+			return info.rsaPSS
+		}
+		return info.rsaPKCS
+	case pkcs11.CKK_ECDSA:
+		return info.ecdsa
+	case pkcs11.CKK_DSA:
+		return info.dsa
+	}
+	return 0
+}
+
+// hashRegistry holds the hash functions supported by crypto11. Every translation from a crypto.Hash to a PKCS#11
+// mechanism or parameter goes through it, see lookupHash.
+var hashRegistry = map[crypto.Hash]hashInfo{
+	crypto.SHA1: {pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1, 20,
+		[]byte{0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+		pkcs11.CKM_SHA1_RSA_PKCS, pkcs11.CKM_SHA1_RSA_PKCS_PSS, pkcs11.CKM_ECDSA_SHA1, pkcs11.CKM_DSA_SHA1},
+	crypto.SHA224: {pkcs11.CKM_SHA224, pkcs11.CKG_MGF1_SHA224, 28,
+		[]byte{0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+		pkcs11.CKM_SHA224_RSA_PKCS, pkcs11.CKM_SHA224_RSA_PKCS_PSS, pkcs11.CKM_ECDSA_SHA224, pkcs11.CKM_DSA_SHA224},
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, 32,
+		[]byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+		pkcs11.CKM_SHA256_RSA_PKCS, pkcs11.CKM_SHA256_RSA_PKCS_PSS, pkcs11.CKM_ECDSA_SHA256, pkcs11.CKM_DSA_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384, 48,
+		[]byte{0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+		pkcs11.CKM_SHA384_RSA_PKCS, pkcs11.CKM_SHA384_RSA_PKCS_PSS, pkcs11.CKM_ECDSA_SHA384, pkcs11.CKM_DSA_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512, 64,
+		[]byte{0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+		pkcs11.CKM_SHA512_RSA_PKCS, pkcs11.CKM_SHA512_RSA_PKCS_PSS, pkcs11.CKM_ECDSA_SHA512, pkcs11.CKM_DSA_SHA512},
+	crypto.SHA3_224: {pkcs11.CKM_SHA3_224, ckgMGF1SHA3_224, 28,
+		[]byte{0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x07, 0x05, 0x00, 0x04, 0x1c},
+		pkcs11.CKM_SHA3_224_RSA_PKCS, pkcs11.CKM_SHA3_224_RSA_PKCS_PSS, ckmECDSASHA3_224, pkcs11.CKM_DSA_SHA3_224},
+	crypto.SHA3_256: {pkcs11.CKM_SHA3_256, ckgMGF1SHA3_256, 32,
+		[]byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x08, 0x05, 0x00, 0x04, 0x20},
+		pkcs11.CKM_SHA3_256_RSA_PKCS, pkcs11.CKM_SHA3_256_RSA_PKCS_PSS, ckmECDSASHA3_256, pkcs11.CKM_DSA_SHA3_256},
+	crypto.SHA3_384: {pkcs11.CKM_SHA3_384, ckgMGF1SHA3_384, 48,
+		[]byte{0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x09, 0x05, 0x00, 0x04, 0x30},
+		pkcs11.CKM_SHA3_384_RSA_PKCS, pkcs11.CKM_SHA3_384_RSA_PKCS_PSS, ckmECDSASHA3_384, pkcs11.CKM_DSA_SHA3_384},
+	crypto.SHA3_512: {pkcs11.CKM_SHA3_512, ckgMGF1SHA3_512, 64,
+		[]byte{0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x0a, 0x05, 0x00, 0x04, 0x40},
+		pkcs11.CKM_SHA3_512_RSA_PKCS, pkcs11.CKM_SHA3_512_RSA_PKCS_PSS, ckmECDSASHA3_512, pkcs11.CKM_DSA_SHA3_512},
+}
+
+// optionalHashes are the hash functions that many tokens lack. Before one is named in PSS or OAEP parameters, the
+// token must advertise its digest mechanism, see checkTokenHash.
+var optionalHashes = map[crypto.Hash]bool{
+	crypto.SHA3_224: true,
+	crypto.SHA3_256: true,
+	crypto.SHA3_384: true,
+	crypto.SHA3_512: true,
+}
+
+// SupportedHashes returns the hash functions that crypto11 can use for RSA PKCS#1 v1.5 and PSS signatures, RSA-OAEP
+// decryption and on-token hashing, in ascending order. ECDSA and DSA signing accept a digest from any hash
+// function, since the token only sees the digest. Any other hash function is rejected with an error wrapping
+// ErrUnsupportedHash. crypto.Hash(0) is also accepted for PKCS#1 v1.5 signatures, with digest signed as given.
+//
+// The SHA-3 hashes can always be used for PKCS#1 v1.5 signatures. For PSS and OAEP the token must support the SHA-3
+// digest mechanism, otherwise an error wrapping ErrMechanismNotSupported is returned. Software PSS encoding and
+// software verification of PSS signatures also need a SHA-3 implementation linked into the application, such as
+// golang.org/x/crypto/sha3.
+func SupportedHashes() []crypto.Hash {
+	hashes := make([]crypto.Hash, 0, len(hashRegistry))
+	for h := range hashRegistry {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	return hashes
+}
+
+// lookupHash returns the registry entry for hash.
+func lookupHash(hash crypto.Hash) (hashInfo, error) {
+	info, ok := hashRegistry[hash]
+	if !ok {
+		return hashInfo{}, unsupportedHash(hash)
+	}
+	return info, nil
+}
+
+// lookupSignMechanism returns the combined mechanism that hashes with hash and then signs or verifies with a key of
+// keyType, see hashInfo.signMechanism.
+func lookupSignMechanism(keyType uint, hash crypto.Hash, pss bool) (uint, error) {
+	info, err := lookupHash(hash)
+	if err != nil {
+		return 0, err
+	}
+	mechanism := info.signMechanism(keyType, pss)
+	if mechanism == 0 {
+		return 0, withMessagef(unsupportedHash(hash), "key type %X", keyType)
+	}
+	return mechanism, nil
+}
+
+// unsupportedHash returns an error for hash that wraps ErrUnsupportedHash.
+func unsupportedHash(hash crypto.Hash) error {
+	return withMessagef(ErrUnsupportedHash, "crypto.Hash(%d)", uint(hash))
+}
+
+// softwareHash returns an error wrapping ErrUnsupportedHash unless hash is supported and can be computed in software.
+func softwareHash(hash crypto.Hash) error {
+	if _, err := lookupHash(hash); err != nil {
+		return err
+	}
+	if !hash.Available() {
+		return withMessagef(ErrUnsupportedHash, "crypto.Hash(%d) is not linked into the application", uint(hash))
+	}
+	return nil
+}
+
+// checkTokenHash returns an error wrapping ErrMechanismNotSupported if hash is optional and the token does not
+// advertise its digest mechanism. Unsupported hashes are left for lookupHash to reject.
+func (c *Context) checkTokenHash(hash crypto.Hash) error {
+	info, ok := hashRegistry[hash]
+	if !ok || !optionalHashes[hash] || c.tokenSupports(info.mechanism, pkcs11.CKF_DIGEST) {
+		return nil
+	}
+	return withMessagef(ErrMechanismNotSupported, "token does not support digest mechanism 0x%X", info.mechanism)
+}
+
+// checkOptionsHashes applies checkTokenHash to the hash functions that *rsa.PSSOptions or *rsa.OAEPOptions name in
+// mechanism parameters. Other options are not checked.
+func (c *Context) checkOptionsHashes(opts interface{}) error {
+	switch o := opts.(type) {
+	case *rsa.PSSOptions:
+		return c.checkTokenHash(o.Hash)
+	case *rsa.OAEPOptions:
+		if err := c.checkTokenHash(o.Hash); err != nil {
+			return err
+		}
+		return c.checkTokenHash(oaepMGFHash(o))
+	}
+	return nil
+}
+
+// tokenHashes returns the SupportedHashes that the token can use in PSS and OAEP parameters.
+func (c *Context) tokenHashes() []crypto.Hash {
+	var hashes []crypto.Hash
+	for _, hash := range SupportedHashes() {
+		if c.checkTokenHash(hash) == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// hashToPKCS11 returns the digest mechanism, MGF1 function and digest length for hashFunction.
+func hashToPKCS11(hashFunction crypto.Hash) (hashAlg uint, mgfAlg uint, hashLen uint, err error) {
+	info, err := lookupHash(hashFunction)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return info.mechanism, info.mgf, info.size, nil
+}
+
+// pkcs1v15DigestInfo calculates T for EMSA-PKCS1-v1_5. If hash is zero, digest is returned as given.
+func pkcs1v15DigestInfo(hash crypto.Hash, digest []byte) ([]byte, error) {
+	if hash == 0 {
+		return digest, nil
+	}
+	info, err := lookupHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	T := make([]byte, len(info.digestInfoPrefix)+len(digest))
+	copy(T[0:len(info.digestInfoPrefix)], info.digestInfoPrefix)
+	copy(T[len(info.digestInfoPrefix):], digest)
+	return T, nil
+}
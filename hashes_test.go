@@ -0,0 +1,188 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// maxTestHash is the largest crypto.Hash value tried by the tests below, well beyond those defined by the standard
+// library.
+const maxTestHash = 64
+
+func TestSupportedHashes(t *testing.T) {
+	assert.Equal(t, []crypto.Hash{crypto.SHA1, crypto.SHA224, crypto.SHA256, crypto.SHA384, crypto.SHA512,
+		crypto.SHA3_224, crypto.SHA3_256, crypto.SHA3_384, crypto.SHA3_512}, SupportedHashes())
+
+	for _, h := range SupportedHashes() {
+		_, _, size, err := hashToPKCS11(h)
+		require.NoError(t, err)
+		assert.Equal(t, uint(h.Size()), size)
+
+		// The DigestInfo ends with the OCTET STRING header of the digest.
+		prefix := hashRegistry[h].digestInfoPrefix
+		assert.Equal(t, []byte{0x04, byte(h.Size())}, prefix[len(prefix)-2:])
+		assert.Equal(t, len(prefix)+h.Size()-2, int(prefix[1]))
+	}
+}
+
+func TestSoftwareHash(t *testing.T) {
+	for _, h := range SupportedHashes() {
+		err := softwareHash(h)
+		if h.Available() {
+			assert.NoError(t, err)
+		} else {
+			assert.True(t, errors.Is(err, ErrUnsupportedHash), "crypto.Hash(%d)", h)
+		}
+	}
+	assert.True(t, errors.Is(softwareHash(crypto.MD5), ErrUnsupportedHash))
+}
+
+// checkHashError fails the test unless err is nil for a supported hash and has ErrUnsupportedHash as its cause
+// otherwise.
+func checkHashError(t *testing.T, h crypto.Hash, supported bool, err error) {
+	if supported {
+		return
+	}
+	require.Error(t, err, "crypto.Hash(%d)", h)
+	assert.True(t, errors.Is(err, ErrUnsupportedHash), "crypto.Hash(%d)", h)
+}
+
+func TestUnsupportedHashOptions(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	digest := make([]byte, 32)
+	for h := crypto.Hash(0); h <= maxTestHash; h++ {
+		_, supported := hashRegistry[h]
+
+		_, _, _, err := hashToPKCS11(h)
+		checkHashError(t, h, supported, err)
+
+		_, err = pkcs1v15DigestInfo(h, digest)
+		checkHashError(t, h, supported || h == 0, err)
+
+		_, err = pssMechanism(&rsa.PSSOptions{Hash: h, SaltLength: rsa.PSSSaltLengthEqualsHash}, 2048)
+		checkHashError(t, h, supported, err)
+
+		// Software verification fails for every hash, because the signature is wrong, but must not panic.
+		err = VerifySignature(rsaKey, digest, make([]byte, 128), h)
+		checkHashError(t, h, supported || h == 0, err)
+		err = VerifySignature(rsaKey, digest, make([]byte, 128), &rsa.PSSOptions{Hash: h})
+		checkHashError(t, h, supported, err)
+		assert.Error(t, VerifySignature(ecdsaKey, digest, []byte{0x30, 0}, h))
+	}
+}
+
+func TestSignAndDecryptWithEveryHash(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		rsaKey, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = rsaKey.Delete() }()
+
+		ecdsaKey, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = ecdsaKey.Delete() }()
+
+		dsaKey, err := ctx.GenerateDSAKeyPair(randomBytes(), dsaSizes[dsa.L2048N224])
+		require.NoError(t, err)
+		defer func() { _ = dsaKey.Delete() }()
+
+		digest := make([]byte, 28)
+		ciphertext := make([]byte, rsaSize/8)
+
+		for h := crypto.Hash(0); h <= maxTestHash; h++ {
+			_, supported := hashRegistry[h]
+
+			_, err = rsaKey.Sign(rand.Reader, digest, h)
+			checkHashError(t, h, supported || h == 0, err)
+
+			_, err = rsaKey.Sign(rand.Reader, digest, &rsa.PSSOptions{Hash: h, SaltLength: rsa.PSSSaltLengthEqualsHash})
+			checkHashError(t, h, supported, err)
+
+			_, err = rsaKey.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{Hash: h})
+			checkHashError(t, h, supported, err)
+
+			// ECDSA and DSA only see the digest, so every hash is accepted.
+			_, err = ecdsaKey.Sign(rand.Reader, digest, h)
+			assert.NoError(t, err)
+			_, err = dsaKey.Sign(rand.Reader, digest, h)
+			assert.NoError(t, err)
+		}
+
+		_, err = rsaKey.Sign(rand.Reader, digest, nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestSignWithSHA3(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		rsaKey, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeSigning)
+		require.NoError(t, err)
+		defer func() { _ = rsaKey.Delete() }()
+		ecdsaKey, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = ecdsaKey.Delete() }()
+
+		for _, h := range []crypto.Hash{crypto.SHA3_224, crypto.SHA3_256, crypto.SHA3_384, crypto.SHA3_512} {
+			digest := make([]byte, h.Size())
+			_, err = rand.Read(digest)
+			require.NoError(t, err)
+
+			// PKCS#1 v1.5 only needs the DigestInfo prefix, so it works on every token.
+			sig, err := rsaKey.Sign(rand.Reader, digest, h)
+			require.NoError(t, err, "crypto.Hash(%d)", h)
+			require.NoError(t, VerifySignature(rsaKey, digest, sig, h))
+			_, err = rsaKey.Sign(rand.Reader, digest[1:], h)
+			assert.Error(t, err)
+
+			sig, err = ecdsaKey.Sign(rand.Reader, digest, h)
+			require.NoError(t, err)
+			require.NoError(t, VerifySignature(ecdsaKey, digest, sig, h))
+
+			// PSS names the hash in its parameters, so it needs the token's SHA-3 digest mechanism.
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: h}
+			sig, err = rsaKey.Sign(rand.Reader, digest, opts)
+			if !ctx.tokenSupports(hashRegistry[h].mechanism, pkcs11.CKF_DIGEST) {
+				assert.True(t, errors.Is(err, ErrMechanismNotSupported), "%v", err)
+				continue
+			}
+			require.NoError(t, err)
+			if h.Available() {
+				require.NoError(t, VerifySignature(rsaKey, digest, sig, opts))
+			}
+		}
+	})
+}
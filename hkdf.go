@@ -0,0 +1,145 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+/*
+#include <stdlib.h>
+
+// ckHKDFParams is CK_HKDF_PARAMS. CK_ULONG is unsigned long, which is narrower than a pointer on LLP64 platforms
+// such as Windows, and Cryptoki structures are packed there, as in the miekg/pkcs11 headers.
+#ifdef _WIN32
+#pragma pack(push, 1)
+#endif
+typedef struct {
+	unsigned char bExtract;
+	unsigned char bExpand;
+	unsigned long prfHashMechanism;
+	unsigned long ulSaltType;
+	unsigned char *pSalt;
+	unsigned long ulSaltLen;
+	unsigned long hSaltKey;
+	unsigned char *pInfo;
+	unsigned long ulInfoLen;
+} ckHKDFParams;
+#ifdef _WIN32
+#pragma pack(pop)
+#endif
+*/
+import "C"
+
+import (
+	"crypto"
+	"errors"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	// CKM_HKDF_DERIVE is the PKCS#11 v3.0 HKDF key derivation mechanism.
+	CKM_HKDF_DERIVE = 0x0000402a
+
+	// ckfHKDFSaltNull indicates no salt is supplied to CKM_HKDF_DERIVE.
+	ckfHKDFSaltNull = 0x00000001
+
+	// ckfHKDFSaltData indicates the salt is supplied as data to CKM_HKDF_DERIVE.
+	ckfHKDFSaltData = 0x00000002
+)
+
+// DeriveHKDF derives a new secret key from this key using HKDF (RFC 5869), computed on the token with
+// CKM_HKDF_DERIVE. Both the extract and expand steps are performed. The salt may be nil.
+//
+// The base key must permit derivation (CKA_DERIVE). Keys imported or generated with CipherGeneric do so by default.
+//
+// After this function returns, template will contain the attributes applied to the derived key. If required
+// attributes are missing, they will be set to a default value.
+func (key *SecretKey) DeriveHKDF(template AttributeSet, hash crypto.Hash, salt, info []byte, bits int,
+	cipher *SymmetricCipher) (k *SecretKey, err error) {
+
+	c := key.context
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if err = key.checkArchived("HKDF"); err != nil {
+		return nil, err
+	}
+
+	if bits <= 0 || bits%8 != 0 {
+		return nil, errors.New("key length must be a positive whole number of bytes")
+	}
+	if len(cipher.GenParams) == 0 {
+		return nil, errors.New("cipher must have GenParams")
+	}
+
+	hashMech, _, _, err := hashToPKCS11(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	addSecretKeyDefaults(template, cipher)
+	template.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, cipher.GenParams[0].KeyType),
+	})
+	_ = template.Set(CkaValueLen, bits/8) // safe for an int
+
+	params, free := hkdfParams(hashMech, salt, info)
+	defer free()
+
+	err = c.withSession(func(session *pkcs11Session) error {
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(CKM_HKDF_DERIVE, params)}
+		handle, err := session.ctx.DeriveKey(session.handle, mech, key.handle, template.ToSlice())
+		if err != nil {
+			return err
+		}
+		k = newSecretKey(c, handle, cipher)
+		return nil
+	})
+	return k, err
+}
+
+// hkdfParams marshals a CK_HKDF_PARAMS structure. The structure contains pointers, so the salt and info are copied
+// into C memory, which must be released by calling the returned function once the mechanism has been used.
+func hkdfParams(hashMech uint, salt, info []byte) (params []byte, free func()) {
+	p := C.ckHKDFParams{
+		bExtract:         1,
+		bExpand:          1,
+		prfHashMechanism: C.ulong(hashMech),
+		ulSaltType:       ckfHKDFSaltNull,
+	}
+
+	if len(salt) > 0 {
+		p.pSalt = (*C.uchar)(C.CBytes(salt))
+		p.ulSaltLen = C.ulong(len(salt))
+		p.ulSaltType = ckfHKDFSaltData
+	}
+	if len(info) > 0 {
+		p.pInfo = (*C.uchar)(C.CBytes(info))
+		p.ulInfoLen = C.ulong(len(info))
+	}
+
+	pSalt, pInfo := unsafe.Pointer(p.pSalt), unsafe.Pointer(p.pInfo)
+	return C.GoBytes(unsafe.Pointer(&p), C.int(unsafe.Sizeof(p))), func() {
+		C.free(pSalt)
+		C.free(pInfo)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	_ "crypto/sha256"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHKDF(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, CKM_HKDF_DERIVE)
+
+		// Import a 32-byte PSK as a generic secret
+		psk := randomBytes()
+		base, err := ctx.ImportSecretKey(randomBytes(), psk, CipherGeneric)
+		require.NoError(t, err)
+		defer func() { _ = base.Delete() }()
+
+		salt := []byte("salt")
+		info := []byte("crypto11 HKDF test")
+
+		// Derive an extractable copy, to compare against a software implementation
+		template := NewAttributeSet()
+		require.NoError(t, template.Set(CkaSensitive, false))
+		require.NoError(t, template.Set(CkaExtractable, true))
+		require.NoError(t, template.Set(CkaToken, false))
+
+		derived, err := base.DeriveHKDF(template, crypto.SHA256, salt, info, 256, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = derived.Delete() }()
+
+		value, err := ctx.GetAttribute(derived, CkaValue)
+		require.NoError(t, err)
+		expected := softHKDF(crypto.SHA256, psk, salt, info, 32)
+		require.Equal(t, expected, value.Value)
+
+		// Use the derived key for GCM on the token
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_AES_GCM)
+		aead, err := derived.NewGCM()
+		require.NoError(t, err)
+		testAEADMode(t, aead, 127, 129)
+
+		// And check it matches software GCM with the same key
+		block, err := aes.NewCipher(expected)
+		require.NoError(t, err)
+		soft, err := cipher.NewGCMWithNonceSize(block, aead.NonceSize())
+		require.NoError(t, err)
+
+		nonce := make([]byte, aead.NonceSize())
+		plaintext := []byte("plaintext")
+		require.Equal(t, soft.Seal(nil, nonce, plaintext, nil), aead.Seal(nil, nonce, plaintext, nil))
+	})
+}
+
+func TestHKDFParamsLayout(t *testing.T) {
+	ulong := len(ulongToBytes(0))
+	pointer := int(unsafe.Sizeof(uintptr(0)))
+	align := func(offset, size int) int {
+		if runtime.GOOS == "windows" {
+			// Cryptoki structures are packed on Windows
+			return offset
+		}
+		return (offset + size - 1) / size * size
+	}
+
+	// Offsets of the CK_HKDF_PARAMS fields, with CK_ULONG and pointers at their own widths
+	prfHashMechanism := align(2, ulong)
+	ulSaltType := prfHashMechanism + ulong
+	ulSaltLen := align(ulSaltType+ulong, pointer) + pointer
+	pInfo := align(ulSaltLen+2*ulong, pointer)
+	ulInfoLen := pInfo + pointer
+
+	params, free := hkdfParams(pkcs11.CKM_SHA256, []byte("salt"), []byte("information"))
+	defer free()
+
+	require.Len(t, params, align(ulInfoLen+ulong, pointer))
+	assert.Equal(t, []byte{1, 1}, params[:2])
+	assert.Equal(t, uint(pkcs11.CKM_SHA256), bytesToUlong(params[prfHashMechanism:prfHashMechanism+ulong]))
+	assert.Equal(t, uint(ckfHKDFSaltData), bytesToUlong(params[ulSaltType:ulSaltType+ulong]))
+	assert.Equal(t, uint(4), bytesToUlong(params[ulSaltLen:ulSaltLen+ulong]))
+	assert.Equal(t, uint(11), bytesToUlong(params[ulInfoLen:ulInfoLen+ulong]))
+
+	params, free = hkdfParams(pkcs11.CKM_SHA256, nil, nil)
+	defer free()
+	assert.Equal(t, uint(ckfHKDFSaltNull), bytesToUlong(params[ulSaltType:ulSaltType+ulong]))
+	assert.Equal(t, make([]byte, pointer), params[pInfo:pInfo+pointer])
+}
+
+func TestImportGenericSecret(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		// A length that isn't a valid AES key size
+		value := append(randomBytes(), 1, 2, 3)
+		key, err := ctx.ImportSecretKey(randomBytes(), value, CipherGeneric)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		attrs, err := ctx.GetAttributes(key, []AttributeType{CkaValueLen, CkaDerive, CkaSign})
+		require.NoError(t, err)
+		require.Equal(t, uint(len(value)), bytesToUlong(attrs[CkaValueLen].Value))
+		require.Equal(t, []byte{1}, attrs[CkaDerive].Value)
+		require.Equal(t, []byte{1}, attrs[CkaSign].Value)
+
+		_, err = ctx.ImportSecretKey(randomBytes(), nil, CipherGeneric)
+		require.Error(t, err)
+
+		_, err = ctx.GenerateSecretKey(randomBytes(), 257, CipherGeneric)
+		require.Error(t, err)
+	})
+}
+
+// softHKDF is a straightforward software implementation of RFC 5869.
+func softHKDF(hash crypto.Hash, secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, hash.Size())
+	}
+	extract := hmac.New(hash.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var result, previous []byte
+	for counter := byte(1); len(result) < length; counter++ {
+		expand := hmac.New(hash.New, prk)
+		expand.Write(previous)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		previous = expand.Sum(nil)
+		result = append(result, previous...)
+	}
+	return result[:length]
+}
@@ -64,14 +64,18 @@ type hmacImplementation struct {
 	// Hash size
 	size int
 
+	// knownSize is set if size is defined by the mechanism, or by the length of a _GENERAL mechanism, so that the
+	// result returned by the token can be checked.
+	knownSize bool
+
 	// Block size
 	blockSize int
 
 	// PKCS#11 mechanism information
 	mechDescription []*pkcs11.Mechanism
 
-	// Cleanup function
-	cleanup func()
+	// Cleanup function, which returns the session to the pool. err is the error that finished the operation, if any.
+	cleanup func(err error)
 
 	// Count of updates
 	updates uint64
@@ -87,8 +91,8 @@ type hmacInfo struct {
 }
 
 var hmacInfos = map[int]*hmacInfo{
-	pkcs11.CKM_MD5_HMAC:                {20, 64, false},
-	pkcs11.CKM_MD5_HMAC_GENERAL:        {20, 64, true},
+	pkcs11.CKM_MD5_HMAC:                {16, 64, false},
+	pkcs11.CKM_MD5_HMAC_GENERAL:        {16, 64, true},
 	pkcs11.CKM_SHA_1_HMAC:              {20, 64, false},
 	pkcs11.CKM_SHA_1_HMAC_GENERAL:      {20, 64, true},
 	pkcs11.CKM_SHA224_HMAC:             {28, 64, false},
@@ -105,6 +109,10 @@ var hmacInfos = map[int]*hmacInfo{
 	pkcs11.CKM_SHA512_256_HMAC_GENERAL: {32, 128, true},
 	pkcs11.CKM_RIPEMD160_HMAC:          {20, 64, false},
 	pkcs11.CKM_RIPEMD160_HMAC_GENERAL:  {20, 64, true},
+	pkcs11.CKM_AES_CMAC:                {16, 16, false},
+	pkcs11.CKM_AES_CMAC_GENERAL:        {16, 16, true},
+	pkcs11.CKM_DES3_CMAC:               {8, 8, false},
+	pkcs11.CKM_DES3_CMAC_GENERAL:       {8, 8, true},
 }
 
 // errHmacClosed is called if an HMAC is updated after it has finished.
@@ -120,13 +128,23 @@ var errHmacClosed = errors.New("already called Sum()")
 //
 // The Reset() method is not implemented.
 // After Sum() is called no new data may be added.
+//
+// For mechanisms in the built-in list, which includes CMAC, Sum() panics with a *MalformedTokenOutputError if the
+// token returns a MAC of the wrong size, unless Config.SkipOutputLengthChecks is set.
+//
+// A *KeyUsageError is returned if the key lacks CKA_SIGN.
 func (key *SecretKey) NewHMAC(mech int, length int) (hash.Hash, error) {
+	if err := key.checkSignUsage("HMAC"); err != nil {
+		return nil, err
+	}
+
 	hi := hmacImplementation{
 		key: key,
 	}
 	var params []byte
 	if info, ok := hmacInfos[mech]; ok {
 		hi.blockSize = info.blockSize
+		hi.knownSize = true
 		if info.general {
 			hi.size = length
 			params = ulongToBytes(uint(length))
@@ -144,18 +162,18 @@ func (key *SecretKey) NewHMAC(mech int, length int) (hash.Hash, error) {
 }
 
 func (hi *hmacImplementation) initialize() (err error) {
-	session, err := hi.key.context.getSession()
+	session, err := hi.key.getSession()
 	if err != nil {
 		return err
 	}
 
 	hi.session = session
-	hi.cleanup = func() {
-		hi.key.context.pool.Put(session)
+	hi.cleanup = func(err error) {
+		hi.key.context.putSession(session, err)
 		hi.session = nil
 	}
-	if err = hi.session.ctx.SignInit(hi.session.handle, hi.mechDescription, hi.key.handle); err != nil {
-		hi.cleanup()
+	if err = hi.session.signInit(hi.mechDescription, hi.key.handle); err != nil {
+		hi.cleanup(err)
 		return
 	}
 	hi.updates = 0
@@ -170,7 +188,10 @@ func (hi *hmacImplementation) Write(p []byte) (n int, err error) {
 		}
 		return
 	}
-	if err = hi.session.ctx.SignUpdate(hi.session.handle, p); err != nil {
+	if err = checkSession(hi.session); err != nil {
+		return
+	}
+	if err = hi.session.signUpdate(p); err != nil {
 		return
 	}
 	hi.updates++
@@ -180,19 +201,27 @@ func (hi *hmacImplementation) Write(p []byte) (n int, err error) {
 
 func (hi *hmacImplementation) Sum(b []byte) []byte {
 	if hi.result == nil {
+		if err := checkSession(hi.session); err != nil {
+			panic(err)
+		}
 		var err error
 		if hi.updates == 0 {
 			// http://docs.oasis-open.org/pkcs11/pkcs11-base/v2.40/os/pkcs11-base-v2.40-os.html#_Toc322855304
 			// We must ensure that C_SignUpdate is called _at least once_.
-			if err = hi.session.ctx.SignUpdate(hi.session.handle, []byte{}); err != nil {
+			if err = hi.session.signUpdate([]byte{}); err != nil {
+				hi.cleanup(err)
 				panic(err)
 			}
 		}
-		hi.result, err = hi.session.ctx.SignFinal(hi.session.handle)
-		hi.cleanup()
+		result, err := hi.session.signFinal()
+		if err == nil && hi.knownSize {
+			err = hi.key.context.checkOutputLength("MAC", "the size defined by the mechanism", hi.size, result)
+		}
+		hi.cleanup(err)
 		if err != nil {
 			panic(err)
 		}
+		hi.result = result
 	}
 	return append(b, hi.result...)
 }
@@ -0,0 +1,211 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+)
+
+// DefaultBootstrapValidity is the validity of bootstrap certificates when IdentityRequest.BootstrapValidity is zero.
+const DefaultBootstrapValidity = 24 * time.Hour
+
+// KeyRequest describes a key pair to generate. Exactly one of RSABits and Curve must be set.
+type KeyRequest struct {
+	// ID is used to set CKA_ID. If nil, a random ID is generated from Config.Rand.
+	ID []byte
+
+	// Label, if non-nil, is used to set CKA_LABEL.
+	Label []byte
+
+	// RSABits requests an RSA key pair of this size, for signing only (see KeyPurposeSigning).
+	RSABits int
+
+	// Curve requests an ECDSA key pair on this curve.
+	Curve elliptic.Curve
+}
+
+// validate checks that req describes exactly one kind of key pair.
+func (req *KeyRequest) validate() error {
+	if (req.RSABits == 0) == (req.Curve == nil) {
+		return errors.New("exactly one of RSABits and Curve must be set")
+	}
+	return nil
+}
+
+// generateKeyPair generates the key pair described by req.
+func (c *Context) generateKeyPair(req KeyRequest) (Signer, error) {
+	if req.RSABits != 0 {
+		return c.GenerateRSAKeyPairForPurpose(req.ID, req.Label, req.RSABits, KeyPurposeSigning)
+	}
+	if req.Label != nil {
+		return c.GenerateECDSAKeyPairWithLabel(req.ID, req.Label, req.Curve)
+	}
+	return c.GenerateECDSAKeyPair(req.ID, req.Curve)
+}
+
+// IdentityRequest describes a service identity for ProvisionIdentity.
+type IdentityRequest struct {
+	// Key describes the key pair to generate.
+	Key KeyRequest
+
+	// Subject is the subject of the certificate signing request and of any bootstrap certificate.
+	Subject pkix.Name
+
+	// Subject alternative names for the certificate signing request and any bootstrap certificate.
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+
+	// BootstrapCertificate requests a self-signed certificate for the key pair, stored on the token, so that the
+	// identity can be used before the CA issues its certificate.
+	BootstrapCertificate bool
+
+	// BootstrapValidity is how long the bootstrap certificate is valid for. If zero, DefaultBootstrapValidity is used.
+	BootstrapValidity time.Duration
+}
+
+// IdentityResult holds the artifacts created by ProvisionIdentity.
+type IdentityResult struct {
+	// Signer is the new key pair.
+	Signer Signer
+
+	// ID is the CKA_ID of the key pair and of any bootstrap certificate.
+	ID []byte
+
+	// CSR is the DER-encoded certificate signing request.
+	CSR []byte
+
+	// Certificate is the bootstrap certificate stored on the token, or nil if none was requested.
+	Certificate *x509.Certificate
+}
+
+// ProvisionIdentity generates a key pair, creates a certificate signing request for it and, if requested, stores a
+// self-signed bootstrap certificate on the token. The key pair and certificate share the CKA_ID req.Key.ID (or a
+// generated ID, if that is nil), and the certificate has the CKA_LABEL req.Key.Label if that is set.
+//
+// If any step fails, the key pair is deleted again, so that nothing is left on the token.
+func (c *Context) ProvisionIdentity(req IdentityRequest) (result IdentityResult, err error) {
+	if c.closed.Get() {
+		return result, errClosed
+	}
+
+	if err = req.Key.validate(); err != nil {
+		return result, err
+	}
+	if req.BootstrapValidity < 0 {
+		return result, errors.New("BootstrapValidity cannot be negative")
+	}
+	if req.Key.ID == nil {
+		if req.Key.ID, err = c.generateID(); err != nil {
+			return result, err
+		}
+	}
+
+	key, err := c.generateKeyPair(req.Key)
+	if err != nil {
+		return result, withMessage(err, "generating key pair")
+	}
+	defer func() {
+		if err != nil {
+			_ = key.Delete()
+		}
+	}()
+
+	csrTemplate := &x509.CertificateRequest{
+		Subject:        req.Subject,
+		DNSNames:       req.DNSNames,
+		EmailAddresses: req.EmailAddresses,
+		IPAddresses:    req.IPAddresses,
+		URIs:           req.URIs,
+	}
+	csr, err := x509.CreateCertificateRequest(c.randReader(), csrTemplate, key)
+	if err != nil {
+		return result, withMessage(err, "creating certificate signing request")
+	}
+
+	var certificate *x509.Certificate
+	if req.BootstrapCertificate {
+		if certificate, err = bootstrapCertificate(req, key, c.randReader(), c.referenceTime()); err != nil {
+			return result, err
+		}
+		if req.Key.Label != nil {
+			err = c.ImportCertificateWithLabel(req.Key.ID, req.Key.Label, certificate)
+		} else {
+			err = c.ImportCertificate(req.Key.ID, certificate)
+		}
+		if err != nil {
+			return result, withMessage(err, "storing bootstrap certificate")
+		}
+	}
+
+	return IdentityResult{Signer: key, ID: req.Key.ID, CSR: csr, Certificate: certificate}, nil
+}
+
+// bootstrapCertificate creates a self-signed certificate for key, suitable for TLS clients and servers, valid from
+// now. The serial number is read from random.
+func bootstrapCertificate(req IdentityRequest, key Signer, random io.Reader, now time.Time) (*x509.Certificate, error) {
+	validity := req.BootstrapValidity
+	if validity == 0 {
+		validity = DefaultBootstrapValidity
+	}
+
+	serial, err := rand.Int(random, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, withMessage(err, "generating serial number")
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := key.Public().(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        req.Subject,
+		NotBefore:      now,
+		NotAfter:       now.Add(validity),
+		KeyUsage:       keyUsage,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:       req.DNSNames,
+		EmailAddresses: req.EmailAddresses,
+		IPAddresses:    req.IPAddresses,
+		URIs:           req.URIs,
+	}
+
+	der, err := x509.CreateCertificate(random, template, template, key.Public(), key)
+	if err != nil {
+		return nil, withMessage(err, "creating bootstrap certificate")
+	}
+	certificate, err := x509.ParseCertificate(der)
+	return certificate, withMessage(err, "parsing bootstrap certificate")
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRequestValidate(t *testing.T) {
+	assert.NoError(t, (&KeyRequest{RSABits: 2048}).validate())
+	assert.Error(t, (&KeyRequest{ID: []byte("id")}).validate())
+	assert.Error(t, (&KeyRequest{ID: []byte("id"), RSABits: 2048, Curve: elliptic.P256()}).validate())
+	assert.NoError(t, (&KeyRequest{ID: []byte("id"), RSABits: 2048}).validate())
+	assert.NoError(t, (&KeyRequest{ID: []byte("id"), Curve: elliptic.P256()}).validate())
+}
+
+func TestProvisionIdentity(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		for _, key := range []KeyRequest{
+			{ID: randomBytes(), Label: randomBytes(), Curve: elliptic.P256()},
+			{ID: randomBytes(), RSABits: rsaSize},
+		} {
+			result, err := ctx.ProvisionIdentity(IdentityRequest{
+				Key:                  key,
+				Subject:              pkix.Name{CommonName: "service.example.com"},
+				DNSNames:             []string{"service.example.com"},
+				BootstrapCertificate: true,
+				BootstrapValidity:    time.Hour,
+			})
+			require.NoError(t, err)
+			defer func() {
+				_ = ctx.DeleteCertificate(key.ID, nil, nil)
+				_ = result.Signer.Delete()
+			}()
+
+			csr, err := x509.ParseCertificateRequest(result.CSR)
+			require.NoError(t, err)
+			require.NoError(t, csr.CheckSignature())
+			assert.Equal(t, "service.example.com", csr.Subject.CommonName)
+			assert.Equal(t, []string{"service.example.com"}, csr.DNSNames)
+			assert.True(t, publicKeysEqual(result.Signer.Public(), csr.PublicKey))
+
+			require.NotNil(t, result.Certificate)
+			require.NoError(t, result.Certificate.CheckSignatureFrom(result.Certificate))
+			assert.True(t, result.Certificate.NotAfter.Sub(result.Certificate.NotBefore) <= time.Hour)
+
+			// Everything shares the CKA_ID
+			stored, err := ctx.FindCertificate(key.ID, key.Label, nil)
+			require.NoError(t, err)
+			require.NotNil(t, stored)
+			assert.Equal(t, result.Certificate.Raw, stored.Raw)
+
+			found, err := ctx.FindKeyPair(key.ID, nil)
+			require.NoError(t, err)
+			require.NotNil(t, found)
+			assert.True(t, publicKeysEqual(found.Public(), result.Signer.Public()))
+		}
+	})
+}
+
+func TestProvisionIdentityWithoutBootstrap(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		result, err := ctx.ProvisionIdentity(IdentityRequest{
+			Key:     KeyRequest{ID: id, Curve: elliptic.P256()},
+			Subject: pkix.Name{CommonName: "no bootstrap"},
+		})
+		require.NoError(t, err)
+		defer func() { _ = result.Signer.Delete() }()
+
+		assert.Nil(t, result.Certificate)
+		assert.NotEmpty(t, result.CSR)
+
+		cert, err := ctx.FindCertificate(id, nil, nil)
+		require.NoError(t, err)
+		assert.Nil(t, cert)
+	})
+}
+
+func TestProvisionIdentityCleanup(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+
+		// The CSR cannot be created, because the email address cannot be encoded as an IA5String.
+		_, err := ctx.ProvisionIdentity(IdentityRequest{
+			Key:            KeyRequest{ID: id, Curve: elliptic.P256()},
+			EmailAddresses: []string{"ü@example.com"},
+		})
+		require.Error(t, err)
+
+		key, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		assert.Nil(t, key)
+	})
+}
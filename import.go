@@ -0,0 +1,198 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrIDExists is returned by imports using IDConflictFail when the token already holds an object of the same class
+// with the same CKA_ID.
+var ErrIDExists = errors.New("an object with this CKA_ID already exists")
+
+// IDConflictPolicy selects what an import does when the token already holds an object of the same class with the
+// same CKA_ID. Objects of other classes, such as a certificate and the key pair it belongs to, do not conflict.
+type IDConflictPolicy int
+
+const (
+	// IDConflictFail fails the import with an error wrapping ErrIDExists.
+	IDConflictFail IDConflictPolicy = iota
+
+	// IDConflictSkip leaves the existing object in place and returns it instead of importing.
+	IDConflictSkip
+
+	// IDConflictReplace imports the new object and then destroys the existing objects. If an existing object cannot
+	// be destroyed, the new object is destroyed again and an error is returned. Where several objects already
+	// shared the CKA_ID, any destroyed before the failure are not restored.
+	IDConflictReplace
+)
+
+// ImportOutcome reports what an import with an IDConflictPolicy did.
+type ImportOutcome int
+
+const (
+	// ImportCreated means no object with the CKA_ID existed, and the new object was created.
+	ImportCreated ImportOutcome = iota
+
+	// ImportSkipped means an object with the CKA_ID existed and was returned instead.
+	ImportSkipped
+
+	// ImportReplaced means the new object was created and the objects previously using the CKA_ID were destroyed.
+	ImportReplaced
+)
+
+// ImportCertificateWithPolicy imports a certificate onto the token, applying policy if a certificate with the same
+// CKA_ID already exists. template must contain a non-empty CKA_ID, and is completed as for
+// ImportCertificateWithAttributes. The certificate now on the token is returned, which is the existing certificate
+// if the import was skipped.
+//
+// Checking for an existing certificate and importing are not atomic, so concurrent imports with the same CKA_ID
+// can still create duplicates.
+func (c *Context) ImportCertificateWithPolicy(template AttributeSet, certificate *x509.Certificate,
+	policy IDConflictPolicy) (*x509.Certificate, ImportOutcome, error) {
+
+	if c.closed.Get() {
+		return nil, 0, errClosed
+	}
+
+	if err := addCertificateAttributes(template, certificate); err != nil {
+		return nil, 0, err
+	}
+
+	var result *x509.Certificate
+	var outcome ImportOutcome
+	err := c.withSession(func(session *pkcs11Session) error {
+		handle, o, err := importWithPolicy(session, template, policy)
+		if err != nil {
+			return err
+		}
+		outcome = o
+
+		if outcome != ImportSkipped {
+			result = certificate
+			return nil
+		}
+
+		attributes := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)}
+		if attributes, err = session.ctx.GetAttributeValue(session.handle, handle, attributes); err != nil {
+			return err
+		}
+		result, err = x509.ParseCertificate(attributes[0].Value)
+		return withMessage(err, "parsing existing certificate")
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, outcome, nil
+}
+
+// ImportSecretKeyWithPolicy imports a secret key value onto the token, applying policy if a secret key with the
+// same CKA_ID already exists. template must contain a non-empty CKA_ID, and is completed as for
+// ImportSecretKeyWithAttributes. The key now on the token is returned, which is the existing key if the import was
+// skipped; it is assumed to be a key for cipher.
+//
+// Checking for an existing key and importing are not atomic, so concurrent imports with the same CKA_ID can still
+// create duplicates.
+func (c *Context) ImportSecretKeyWithPolicy(template AttributeSet, value []byte, cipher *SymmetricCipher,
+	policy IDConflictPolicy) (*SecretKey, ImportOutcome, error) {
+
+	if c.closed.Get() {
+		return nil, 0, errClosed
+	}
+
+	if c.cfg.PublicOnly {
+		return nil, 0, ErrLoginRequired
+	}
+
+	if err := c.addSecretKeyImportAttributes(template, value, cipher); err != nil {
+		return nil, 0, err
+	}
+	// Don't keep a copy of the key material in the caller's template
+	defer template.Unset(CkaValue)
+
+	var key *SecretKey
+	var outcome ImportOutcome
+	err := c.withSession(func(session *pkcs11Session) error {
+		handle, o, err := importWithPolicy(session, template, policy)
+		if err != nil {
+			return err
+		}
+		key, outcome = newSecretKey(c, handle, cipher), o
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return key, outcome, nil
+}
+
+// importWithPolicy creates an object from template, applying policy to existing objects with the CKA_CLASS and
+// CKA_ID of the template. The handle of the object now on the token is returned.
+func importWithPolicy(session *pkcs11Session, template AttributeSet,
+	policy IDConflictPolicy) (pkcs11.ObjectHandle, ImportOutcome, error) {
+
+	idAttribute, ok := template[CkaId]
+	if !ok || len(idAttribute.Value) == 0 {
+		return 0, 0, errors.New("template must contain a non-empty CKA_ID")
+	}
+	id := idAttribute.Value
+	class := bytesToUlong(template[CkaClass].Value)
+
+	if policy != IDConflictFail && policy != IDConflictSkip && policy != IDConflictReplace {
+		return 0, 0, fmt.Errorf("unknown ID conflict policy %d", policy)
+	}
+
+	existing, err := findKeys(session, id, nil, &class, nil)
+	if err != nil {
+		return 0, 0, withMessage(err, "finding existing objects")
+	}
+
+	if len(existing) > 0 {
+		switch policy {
+		case IDConflictFail:
+			return 0, 0, withMessagef(ErrIDExists, "CKA_ID %x", id)
+		case IDConflictSkip:
+			return existing[0], ImportSkipped, nil
+		}
+	}
+
+	handle, err := session.ctx.CreateObject(session.handle, template.ToSlice())
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(existing) == 0 {
+		return handle, ImportCreated, nil
+	}
+
+	for _, old := range existing {
+		if err = session.ctx.DestroyObject(session.handle, old); err != nil {
+			// Roll back, so the token keeps the objects that could not be replaced
+			_ = session.ctx.DestroyObject(session.handle, handle)
+			return 0, 0, withMessage(err, "destroying existing object; import rolled back")
+		}
+	}
+	return handle, ImportReplaced, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportCertificateWithPolicy(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		defer func() { _ = ctx.DeleteCertificate(id, nil, nil) }()
+
+		newKey := func() *ecdsa.PrivateKey {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			require.NoError(t, err)
+			return key
+		}
+		first := generateCertForSigner(t, newKey(), id)
+		second := generateCertForSigner(t, newKey(), id)
+
+		template := func() AttributeSet {
+			template, err := NewAttributeSetWithID(id)
+			require.NoError(t, err)
+			return template
+		}
+
+		cert, outcome, err := ctx.ImportCertificateWithPolicy(template(), first, IDConflictFail)
+		require.NoError(t, err)
+		assert.Equal(t, ImportCreated, outcome)
+		assert.Equal(t, first.Raw, cert.Raw)
+
+		_, _, err = ctx.ImportCertificateWithPolicy(template(), second, IDConflictFail)
+		assert.True(t, errors.Is(err, ErrIDExists))
+
+		cert, outcome, err = ctx.ImportCertificateWithPolicy(template(), second, IDConflictSkip)
+		require.NoError(t, err)
+		assert.Equal(t, ImportSkipped, outcome)
+		assert.Equal(t, first.Raw, cert.Raw)
+
+		cert, outcome, err = ctx.ImportCertificateWithPolicy(template(), second, IDConflictReplace)
+		require.NoError(t, err)
+		assert.Equal(t, ImportReplaced, outcome)
+		assert.Equal(t, second.Raw, cert.Raw)
+
+		found, err := ctx.FindCertificate(id, nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, second.Raw, found.Raw)
+	})
+}
+
+func TestImportSecretKeyWithPolicy(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		cipher := Ciphers[pkcs11.CKK_AES]
+		id := randomBytes()
+		template := func() AttributeSet {
+			template, err := NewAttributeSetWithID(id)
+			require.NoError(t, err)
+			return template
+		}
+
+		key, outcome, err := ctx.ImportSecretKeyWithPolicy(template(), make([]byte, 16), cipher, IDConflictFail)
+		require.NoError(t, err)
+		assert.Equal(t, ImportCreated, outcome)
+		defer func() { _ = key.Delete() }()
+
+		_, _, err = ctx.ImportSecretKeyWithPolicy(template(), make([]byte, 16), cipher, IDConflictFail)
+		assert.True(t, errors.Is(err, ErrIDExists))
+
+		skipped, outcome, err := ctx.ImportSecretKeyWithPolicy(template(), make([]byte, 16), cipher, IDConflictSkip)
+		require.NoError(t, err)
+		assert.Equal(t, ImportSkipped, outcome)
+		assert.Equal(t, key.handle, skipped.handle)
+
+		replaced, outcome, err := ctx.ImportSecretKeyWithPolicy(template(), make([]byte, 16), cipher,
+			IDConflictReplace)
+		require.NoError(t, err)
+		assert.Equal(t, ImportReplaced, outcome)
+		defer func() { _ = replaced.Delete() }()
+
+		keys, err := ctx.FindKeys(id, nil)
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		assert.Equal(t, replaced.handle, keys[0].handle)
+
+		// A template without a CKA_ID cannot be checked
+		_, _, err = ctx.ImportSecretKeyWithPolicy(NewAttributeSet(), make([]byte, 16), cipher, IDConflictFail)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// LockingMode selects the locking that CK_C_INITIALIZE_ARGS asks of the PKCS#11 library when it is initialized. See
+// Config.Locking.
+type LockingMode int
+
+const (
+	// LockingOS sets CKF_OS_LOCKING_OK and passes no mutex functions, so the library uses operating system locking
+	// primitives. This is the default.
+	LockingOS LockingMode = iota
+
+	// LockingMutexes passes mutex functions implemented by crypto11, without CKF_OS_LOCKING_OK, so the library must
+	// use them. Not supported on Windows.
+	LockingMutexes
+
+	// LockingNone passes neither CKF_OS_LOCKING_OK nor mutex functions, which tells the library that it will not be
+	// called from several threads at once. crypto11 makes calls from many goroutines, so this is only safe with
+	// libraries that lock regardless, or when the application serialises all use of the library. Not supported on
+	// Windows.
+	LockingNone
+)
+
+// LockingConflictError is returned by Configure when a library is already initialized, by an earlier Context, with
+// different locking than the Config asks for. Only the first Context using a library initializes it, so its choice
+// applies to every later Context.
+type LockingConflictError struct {
+	// Path is the library path.
+	Path string
+
+	// Negotiated is the locking the library was initialized with.
+	Negotiated LockingMode
+
+	// Requested is the locking the rejected Config asked for.
+	Requested LockingMode
+}
+
+func (e *LockingConflictError) Error() string {
+	return fmt.Sprintf("PKCS#11 library %s is already initialized with %s locking, not %s", e.Path, e.Negotiated,
+		e.Requested)
+}
+
+// libraryLocking records the locking each library was initialized with, by path. Like refCount, it must not be read
+// or modified without holding refCountMutex.
+var libraryLocking = map[string]LockingMode{}
+
+// plainInitialize and initializeWithArgs call C_Initialize, without and with Config.InitArgs or non-default locking
+// respectively. Tests replace them to observe how the library is initialized.
+var (
+	plainInitialize    = (*pkcs11.Ctx).Initialize
+	initializeWithArgs = initializeModuleWithArgs
+)
+
+// initializeLibrary calls C_Initialize for the library of c, passing Config.InitArgs and Config.Locking.
+func (c *Context) initializeLibrary() error {
+	var err error
+	if c.cfg.InitArgs == "" && c.cfg.Locking == LockingOS {
+		err = plainInitialize(c.ctx)
+	} else {
+		err = initializeWithArgs(c.cfg.Path, c.cfg.InitArgs, c.cfg.Locking)
+	}
+	if isPKCS11Error(err, pkcs11.CKR_CANT_LOCK) {
+		return withMessagef(err, "library does not support %s locking", c.cfg.Locking)
+	}
+	return err
+}
+
+// LibraryInfo describes the PKCS#11 library used by a Context, as reported by C_GetInfo, and how it was initialized.
+type LibraryInfo struct {
+	// CryptokiVersion is the version of the PKCS#11 interface the library implements.
+	CryptokiVersion pkcs11.Version
+
+	// ManufacturerID identifies the library manufacturer.
+	ManufacturerID string
+
+	// Flags holds the CK_INFO flags, which PKCS#11 2.40 reserves.
+	Flags uint
+
+	// LibraryDescription describes the library.
+	LibraryDescription string
+
+	// LibraryVersion is the version of the library itself.
+	LibraryVersion pkcs11.Version
+
+	// TokenFlags holds the CKF_ flags of the token used by the Context, as reported by C_GetTokenInfo when the
+	// Context was created.
+	TokenFlags uint
+
+	// Locking is the locking the library was initialized with, by the first Context to use it.
+	Locking LockingMode
+}
+
+// LibraryInfo returns information about the PKCS#11 library and the locking it was initialized with.
+func (c *Context) LibraryInfo() (LibraryInfo, error) {
+	if c.closed.Get() {
+		return LibraryInfo{}, errClosed
+	}
+
+	info, err := c.ctx.GetInfo()
+	if err != nil {
+		return LibraryInfo{}, withMessage(err, "failed to read library information")
+	}
+	return LibraryInfo{
+		CryptokiVersion:    info.CryptokiVersion,
+		ManufacturerID:     info.ManufacturerID,
+		Flags:              info.Flags,
+		LibraryDescription: info.LibraryDescription,
+		LibraryVersion:     info.LibraryVersion,
+		TokenFlags:         c.token.Flags,
+		Locking:            c.locking,
+	}, nil
+}
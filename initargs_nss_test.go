@@ -0,0 +1,61 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build crypto11_nss
+// +build crypto11_nss
+
+package crypto11
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestNSSSoftoken configures a Context for NSS softoken. It needs the build tag crypto11_nss and a configuration
+// file, named by CRYPTO11_NSS_CONFIG or "config.nss" by default, whose Path is libsoftokn3 and whose InitArgs
+// names an NSS database, for instance:
+//
+//	{
+//	  "Path": "/usr/lib/x86_64-linux-gnu/libsoftokn3.so",
+//	  "TokenLabel": "NSS Certificate DB",
+//	  "LoginNotSupported": true,
+//	  "InitArgs": "configdir='sql:/tmp/nssdb' certPrefix='' keyPrefix='' secmod='secmod.db'"
+//	}
+func TestNSSSoftoken(t *testing.T) {
+	location := os.Getenv("CRYPTO11_NSS_CONFIG")
+	if location == "" {
+		location = "config.nss"
+	}
+	config, err := loadConfigFromFile(location)
+	require.NoError(t, err)
+	require.NotEmpty(t, config.InitArgs)
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	reader, err := ctx.NewRandomReader()
+	require.NoError(t, err)
+	_, err = reader.Read(make([]byte, 16))
+	require.NoError(t, err)
+}
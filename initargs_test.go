@@ -0,0 +1,129 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitializeLibraryPassesInitArgs(t *testing.T) {
+	defer func(plain func(*pkcs11.Ctx) error, withArgs func(string, string, LockingMode) error) {
+		plainInitialize, initializeWithArgs = plain, withArgs
+	}(plainInitialize, initializeWithArgs)
+
+	var plainCalls int
+	var gotPath, gotArgs string
+	var gotLocking LockingMode
+	plainInitialize = func(*pkcs11.Ctx) error {
+		plainCalls++
+		return nil
+	}
+	initializeWithArgs = func(path, args string, locking LockingMode) error {
+		gotPath, gotArgs, gotLocking = path, args, locking
+		return nil
+	}
+
+	const nssArgs = "configdir='sql:/tmp/nssdb' certPrefix='' keyPrefix='' secmod='secmod.db'"
+	c := &Context{cfg: &Config{Path: "/usr/lib/libsoftokn3.so", InitArgs: nssArgs}}
+	assert.NoError(t, c.initializeLibrary())
+	assert.Equal(t, 0, plainCalls)
+	assert.Equal(t, "/usr/lib/libsoftokn3.so", gotPath)
+	assert.Equal(t, nssArgs, gotArgs)
+
+	gotArgs = ""
+	c = &Context{cfg: &Config{Path: "/usr/lib/softhsm/libsofthsm2.so"}}
+	assert.NoError(t, c.initializeLibrary())
+	assert.Equal(t, 1, plainCalls)
+	assert.Equal(t, "", gotArgs)
+
+	// Locking other than the default needs our own C_Initialize call, with or without InitArgs.
+	c = &Context{cfg: &Config{Path: "/usr/lib/softhsm/libsofthsm2.so", Locking: LockingMutexes}}
+	assert.NoError(t, c.initializeLibrary())
+	assert.Equal(t, 1, plainCalls)
+	assert.Equal(t, "/usr/lib/softhsm/libsofthsm2.so", gotPath)
+	assert.Equal(t, LockingMutexes, gotLocking)
+}
+
+func TestInitializeModuleWithArgsMissingLibrary(t *testing.T) {
+	assert.Error(t, initializeModuleWithArgs("/no/such/library.so", "configdir=''", LockingOS))
+}
+
+func TestLockingValidation(t *testing.T) {
+	config := &Config{TokenLabel: "token", Pin: "pin", Locking: LockingNone + 1}
+	assert.Error(t, config.Validate())
+	config.Locking = LockingMutexes
+	assert.NoError(t, config.Validate())
+}
+
+func TestLockingConflict(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		info, err := ctx.LibraryInfo()
+		require.NoError(t, err)
+		assert.NotEmpty(t, info.ManufacturerID)
+		assert.Equal(t, ctx.cfg.Locking, info.Locking)
+		assert.Equal(t, ctx.token.Flags, info.TokenFlags)
+
+		config, err := loadConfigFromFile("config")
+		require.NoError(t, err)
+		config.Locking = LockingMutexes
+		if ctx.cfg.Locking == LockingMutexes {
+			config.Locking = LockingOS
+		}
+
+		_, err = Configure(config)
+		var conflict *LockingConflictError
+		require.True(t, errors.As(err, &conflict), "unexpected error: %v", err)
+		assert.Equal(t, ctx.cfg.Locking, conflict.Negotiated)
+		assert.Equal(t, config.Locking, conflict.Requested)
+		assert.Equal(t, config.Path, conflict.Path)
+	})
+}
+
+func TestLockingMutexes(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.Locking = LockingMutexes
+
+	ctx, err := Configure(config)
+	if isPKCS11Error(err, pkcs11.CKR_CANT_LOCK) {
+		t.Skip("library does not accept mutex functions")
+	}
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	info, err := ctx.LibraryInfo()
+	require.NoError(t, err)
+	assert.Equal(t, LockingMutexes, info.Locking)
+
+	// A second Context shares the initialization.
+	second, err := Configure(config)
+	require.NoError(t, err)
+	require.NoError(t, second.Close())
+
+	_, err = ctx.FindKey(nil, []byte("no such key"))
+	require.NoError(t, err)
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build !windows
+// +build !windows
+
+package crypto11
+
+/*
+#cgo linux LDFLAGS: -ldl
+#cgo darwin LDFLAGS: -ldl
+#cgo freebsd LDFLAGS: -ldl
+
+#include <dlfcn.h>
+#include <stdlib.h>
+
+// Just enough of the PKCS#11 types to call C_Initialize through the function list.
+typedef unsigned long ck_rv;
+
+typedef struct {
+	ck_rv (*create_mutex)(void **);
+	ck_rv (*destroy_mutex)(void *);
+	ck_rv (*lock_mutex)(void *);
+	ck_rv (*unlock_mutex)(void *);
+	unsigned long flags;
+	void *reserved;
+} ck_c_initialize_args;
+
+typedef struct {
+	unsigned char major, minor;
+	ck_rv (*initialize)(void *);
+} ck_function_list_head;
+
+#define CKF_OS_LOCKING_OK 2
+
+// The mutex functions are implemented in Go, see mutexes_unix.go.
+extern unsigned long crypto11CreateMutex(void **mutex);
+extern unsigned long crypto11DestroyMutex(void *mutex);
+extern unsigned long crypto11LockMutex(void *mutex);
+extern unsigned long crypto11UnlockMutex(void *mutex);
+
+enum { load_ok, load_no_library, load_no_function_list };
+
+// Values of LockingMode.
+enum { locking_os, locking_mutexes, locking_none };
+
+static int initialize_with_reserved(const char *path, char *reserved, int locking, ck_rv *rv) {
+	void *handle = dlopen(path, RTLD_LAZY);
+	if (handle == NULL) {
+		return load_no_library;
+	}
+
+	ck_rv (*get_function_list)(ck_function_list_head **) = (ck_rv (*)(ck_function_list_head **))
+		dlsym(handle, "C_GetFunctionList");
+	ck_function_list_head *functions = NULL;
+	if (get_function_list == NULL || get_function_list(&functions) != 0 || functions == NULL) {
+		dlclose(handle);
+		return load_no_function_list;
+	}
+
+	ck_c_initialize_args args = {0};
+	switch (locking) {
+	case locking_os:
+		args.flags = CKF_OS_LOCKING_OK;
+		break;
+	case locking_mutexes:
+		args.create_mutex = crypto11CreateMutex;
+		args.destroy_mutex = crypto11DestroyMutex;
+		args.lock_mutex = crypto11LockMutex;
+		args.unlock_mutex = crypto11UnlockMutex;
+		break;
+	}
+	args.reserved = reserved;
+	*rv = functions->initialize(&args);
+
+	// The library stays loaded, as pkcs11.New holds its own reference.
+	dlclose(handle);
+	return load_ok;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// initializeModuleWithArgs calls C_Initialize for the library at path with the requested locking and args, if not
+// empty, in the pReserved field of CK_C_INITIALIZE_ARGS. The miekg/pkcs11 bindings cannot pass pReserved or mutex
+// functions, so the library is opened again to reach its function list; the dynamic linker returns the instance
+// already loaded by pkcs11.New.
+func initializeModuleWithArgs(path string, args string, locking LockingMode) error {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	// Some libraries, such as NSS softoken, keep the pointer, so the string is deliberately never freed.
+	var cArgs *C.char
+	if args != "" {
+		cArgs = C.CString(args)
+	}
+
+	var rv C.ck_rv
+	switch C.initialize_with_reserved(cPath, cArgs, C.int(locking), &rv) {
+	case C.load_no_library:
+		return errors.New("could not open PKCS#11")
+	case C.load_no_function_list:
+		return errors.New("could not read PKCS#11 function list")
+	}
+	if rv != 0 {
+		return pkcs11.Error(rv)
+	}
+	return nil
+}
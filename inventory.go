@@ -0,0 +1,289 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ckaUniqueID is CKA_UNIQUE_ID, defined in PKCS#11 3.0.
+const ckaUniqueID = AttributeType(0x00000004)
+
+// InventoryAttributes lists the attributes recorded for each object in an Inventory. Apart from CKA_CLASS,
+// CKA_KEY_TYPE and CKA_UNIQUE_ID, these are attributes that may change during the lifetime of an object.
+var InventoryAttributes = []AttributeType{
+	CkaClass, CkaKeyType, ckaUniqueID,
+	CkaLabel, CkaId,
+	CkaEncrypt, CkaDecrypt, CkaSign, CkaVerify, CkaWrap, CkaUnwrap, CkaDerive,
+	CkaStartDate, CkaEndDate,
+}
+
+// Inventory is a snapshot of the objects on a token. Use Context.Inventory to take a snapshot, Marshal and
+// UnmarshalInventory to store it, and Diff to compare two snapshots.
+type Inventory struct {
+	// TokenLabel and TokenSerial identify the token.
+	TokenLabel  string
+	TokenSerial string
+
+	// Time is when the snapshot was taken, by the token clock if Config.UseTokenClock is set and by the host clock
+	// otherwise.
+	Time time.Time
+
+	// Objects holds the objects found on the token, ordered by handle.
+	Objects []InventoryObject
+
+	// Bindings holds the binding status of each certificate with a CKA_ID, ordered by certificate handle. See
+	// CertificateBinding. Private keys are not visible to a Context configured with Config.PublicOnly, so there
+	// every certificate is reported as BindingMissingKey.
+	Bindings []CertificateBinding `json:",omitempty"`
+}
+
+// InventoryObject records the attributes of a single token object.
+type InventoryObject struct {
+	// Handle is the object handle at the time of the snapshot.
+	Handle pkcs11.ObjectHandle
+
+	// Attributes holds the values of the readable attributes from InventoryAttributes. An attribute that is
+	// present with a zero-length value, such as an empty CKA_LABEL, is recorded as an empty, non-nil slice.
+	Attributes map[AttributeType][]byte
+
+	// Absent lists the attributes from InventoryAttributes that the object does not have, because the token
+	// reported CKR_ATTRIBUTE_TYPE_INVALID for them.
+	Absent []AttributeType `json:",omitempty"`
+
+	// Unreadable lists the attributes from InventoryAttributes that could not be read for any other reason, for
+	// instance because they are sensitive.
+	Unreadable []AttributeType `json:",omitempty"`
+}
+
+// Present returns true if the object has attribute t, even if its value is empty. It returns false if t is absent
+// or could not be read.
+func (o InventoryObject) Present(t AttributeType) bool {
+	_, ok := o.Attributes[t]
+	return ok
+}
+
+// AttributeChange describes an attribute whose value differs between two snapshots. A nil Before or After value
+// means the attribute was absent; an empty, non-nil value means it was present with a zero-length value.
+type AttributeChange struct {
+	Type   AttributeType
+	Before []byte
+	After  []byte
+}
+
+// ObjectChange describes an object present in both snapshots whose attributes differ.
+type ObjectChange struct {
+	// Before and After are the object in the older and newer snapshots.
+	Before, After InventoryObject
+
+	// Changes lists the differing attributes, ordered by attribute type.
+	Changes []AttributeChange
+}
+
+// InventoryDiff is the difference between two snapshots.
+type InventoryDiff struct {
+	Added    []InventoryObject
+	Removed  []InventoryObject
+	Modified []ObjectChange
+}
+
+// Inventory takes a snapshot of all objects visible to the Context.
+func (c *Context) Inventory() (*Inventory, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	inventory := &Inventory{
+		TokenLabel:  c.token.Label,
+		TokenSerial: c.token.SerialNumber,
+		Time:        c.referenceTime(),
+	}
+
+	err := c.scanObjects(nil, func(session *pkcs11Session, handles []pkcs11.ObjectHandle) error {
+		for _, handle := range handles {
+			inventory.Objects = append(inventory.Objects, readInventoryObject(session, handle))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	inventory.sort()
+	if inventory.Bindings, err = c.inventoryBindings(inventory.Objects, inventory.Time); err != nil {
+		return nil, err
+	}
+	return inventory, nil
+}
+
+// readInventoryObject reads the InventoryAttributes of an object one at a time, so that an attribute the token
+// refuses to return does not prevent the others from being recorded.
+func readInventoryObject(session *pkcs11Session, handle pkcs11.ObjectHandle) InventoryObject {
+	object := InventoryObject{
+		Handle:     handle,
+		Attributes: map[AttributeType][]byte{},
+	}
+
+	for _, t := range InventoryAttributes {
+		values, err := session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(t, nil),
+		})
+		if isPKCS11Error(err, pkcs11.CKR_ATTRIBUTE_TYPE_INVALID) {
+			object.Absent = append(object.Absent, t)
+			continue
+		}
+		if err != nil || len(values) != 1 || values[0].Value == nil {
+			object.Unreadable = append(object.Unreadable, t)
+			continue
+		}
+		object.Attributes[t] = values[0].Value
+	}
+
+	return object
+}
+
+// Marshal returns a JSON encoding of the inventory. The encoding is stable: the same inventory always produces
+// the same bytes.
+func (inv *Inventory) Marshal() ([]byte, error) {
+	copied := *inv
+	copied.Objects = append([]InventoryObject(nil), inv.Objects...)
+	copied.sort()
+	return json.Marshal(&copied)
+}
+
+// UnmarshalInventory decodes an inventory encoded by Marshal.
+func UnmarshalInventory(data []byte) (*Inventory, error) {
+	var inventory Inventory
+	if err := json.Unmarshal(data, &inventory); err != nil {
+		return nil, withMessage(err, "failed to decode inventory")
+	}
+	inventory.sort()
+	return &inventory, nil
+}
+
+func (inv *Inventory) sort() {
+	sort.Slice(inv.Objects, func(i, j int) bool { return inv.Objects[i].Handle < inv.Objects[j].Handle })
+	for i := range inv.Objects {
+		sortAttributeTypes(inv.Objects[i].Absent)
+		sortAttributeTypes(inv.Objects[i].Unreadable)
+	}
+}
+
+func sortAttributeTypes(types []AttributeType) {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+}
+
+// Diff reports the objects added, removed and modified since the older snapshot.
+//
+// Objects are matched by CKA_UNIQUE_ID when both snapshots have it, and otherwise by handle together with CKA_CLASS
+// and CKA_KEY_TYPE. Handles are only guaranteed to be stable for as long as a Context is open, so snapshots taken
+// by different Contexts on tokens without CKA_UNIQUE_ID may report modified objects as removed and added.
+//
+// An attribute that was unreadable in either snapshot is not compared. An attribute that is absent in one snapshot
+// and present in the other, even with an empty value, is reported as changed.
+func (inv *Inventory) Diff(older *Inventory) *InventoryDiff {
+	diff := &InventoryDiff{}
+	matched := make([]bool, len(older.Objects))
+
+	for _, after := range inv.Objects {
+		index := -1
+		for i, before := range older.Objects {
+			if !matched[i] && sameObject(before, after) {
+				index = i
+				break
+			}
+		}
+
+		if index < 0 {
+			diff.Added = append(diff.Added, after)
+			continue
+		}
+
+		matched[index] = true
+		before := older.Objects[index]
+		if changes := compareObjects(before, after); len(changes) > 0 {
+			diff.Modified = append(diff.Modified, ObjectChange{Before: before, After: after, Changes: changes})
+		}
+	}
+
+	for i, before := range older.Objects {
+		if !matched[i] {
+			diff.Removed = append(diff.Removed, before)
+		}
+	}
+
+	return diff
+}
+
+// sameObject returns true if a and b are the same token object in different snapshots.
+func sameObject(a, b InventoryObject) bool {
+	idA, okA := a.Attributes[ckaUniqueID]
+	idB, okB := b.Attributes[ckaUniqueID]
+	if okA && okB {
+		return bytes.Equal(idA, idB)
+	}
+
+	return a.Handle == b.Handle &&
+		bytes.Equal(a.Attributes[CkaClass], b.Attributes[CkaClass]) &&
+		bytes.Equal(a.Attributes[CkaKeyType], b.Attributes[CkaKeyType])
+}
+
+// compareObjects returns the attributes that differ between two snapshots of an object, skipping any that were
+// unreadable in either.
+func compareObjects(before, after InventoryObject) []AttributeChange {
+	var changes []AttributeChange
+
+	for _, t := range InventoryAttributes {
+		if before.unreadable(t) || after.unreadable(t) {
+			continue
+		}
+
+		b, inBefore := before.Attributes[t]
+		a, inAfter := after.Attributes[t]
+		if inBefore == inAfter && bytes.Equal(b, a) {
+			continue
+		}
+		changes = append(changes, AttributeChange{Type: t, Before: b, After: a})
+	}
+
+	return changes
+}
+
+// hasClass returns true if the CKA_CLASS of the object was read and is class.
+func (o InventoryObject) hasClass(class uint) bool {
+	value, ok := o.Attributes[CkaClass]
+	return ok && bytesToUlong(value) == class
+}
+
+func (o InventoryObject) unreadable(t AttributeType) bool {
+	for _, u := range o.Unreadable {
+		if u == t {
+			return true
+		}
+	}
+	return false
+}
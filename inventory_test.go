@@ -0,0 +1,227 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func inventoryObject(handle pkcs11.ObjectHandle, label string, unreadable ...AttributeType) InventoryObject {
+	return InventoryObject{
+		Handle: handle,
+		Attributes: map[AttributeType][]byte{
+			CkaClass:   ulongToBytes(pkcs11.CKO_SECRET_KEY),
+			CkaKeyType: ulongToBytes(pkcs11.CKK_AES),
+			CkaLabel:   []byte(label),
+		},
+		Unreadable: unreadable,
+	}
+}
+
+func TestInventoryDiff(t *testing.T) {
+	older := &Inventory{Objects: []InventoryObject{
+		inventoryObject(1, "unchanged"),
+		inventoryObject(2, "before"),
+		inventoryObject(3, "removed"),
+		inventoryObject(4, "unreadable", CkaLabel),
+	}}
+	newer := &Inventory{Objects: []InventoryObject{
+		inventoryObject(1, "unchanged"),
+		inventoryObject(2, "after"),
+		inventoryObject(4, "now readable"),
+		inventoryObject(5, "added"),
+	}}
+
+	diff := newer.Diff(older)
+
+	require.Len(t, diff.Added, 1)
+	assert.Equal(t, pkcs11.ObjectHandle(5), diff.Added[0].Handle)
+
+	require.Len(t, diff.Removed, 1)
+	assert.Equal(t, pkcs11.ObjectHandle(3), diff.Removed[0].Handle)
+
+	// Object 4 is not reported, as its label could not be read in the older snapshot
+	require.Len(t, diff.Modified, 1)
+	assert.Equal(t, pkcs11.ObjectHandle(2), diff.Modified[0].After.Handle)
+	assert.Equal(t, []AttributeChange{{Type: CkaLabel, Before: []byte("before"), After: []byte("after")}},
+		diff.Modified[0].Changes)
+}
+
+func TestInventoryDiffUniqueID(t *testing.T) {
+	before := inventoryObject(1, "label")
+	before.Attributes[ckaUniqueID] = []byte("abc")
+	after := inventoryObject(7, "label")
+	after.Attributes[ckaUniqueID] = []byte("abc")
+
+	// The handle changed, but CKA_UNIQUE_ID identifies the object
+	diff := (&Inventory{Objects: []InventoryObject{after}}).Diff(&Inventory{Objects: []InventoryObject{before}})
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Empty(t, diff.Modified)
+}
+
+func TestInventoryMarshal(t *testing.T) {
+	inventory := &Inventory{
+		TokenLabel:  "token",
+		TokenSerial: "1234",
+		Time:        time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		Objects: []InventoryObject{
+			inventoryObject(2, "two", CkaStartDate, CkaEndDate),
+			inventoryObject(1, "one"),
+		},
+	}
+
+	data, err := inventory.Marshal()
+	require.NoError(t, err)
+
+	// Marshalling is stable regardless of object order
+	inventory.Objects[0], inventory.Objects[1] = inventory.Objects[1], inventory.Objects[0]
+	again, err := inventory.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, data, again)
+
+	decoded, err := UnmarshalInventory(data)
+	require.NoError(t, err)
+	assert.Equal(t, inventory, decoded)
+	assert.Empty(t, decoded.Diff(inventory).Modified)
+}
+
+func TestContextInventory(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		before, err := ctx.Inventory()
+		require.NoError(t, err)
+
+		key, err := ctx.GenerateSecretKey(randomBytes(), 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		after, err := ctx.Inventory()
+		require.NoError(t, err)
+
+		diff := after.Diff(before)
+		require.Len(t, diff.Added, 1)
+		assert.Equal(t, key.handle, diff.Added[0].Handle)
+		assert.Empty(t, diff.Removed)
+	})
+}
+
+func TestInventoryDiffEmptyAttribute(t *testing.T) {
+	absent := inventoryObject(1, "")
+	delete(absent.Attributes, CkaLabel)
+	absent.Absent = []AttributeType{CkaLabel}
+	empty := inventoryObject(1, "")
+
+	assert.False(t, absent.Present(CkaLabel))
+	assert.True(t, empty.Present(CkaLabel))
+
+	// Gaining an empty label is a change
+	diff := (&Inventory{Objects: []InventoryObject{empty}}).Diff(&Inventory{Objects: []InventoryObject{absent}})
+	require.Len(t, diff.Modified, 1)
+	assert.Equal(t, []AttributeChange{{Type: CkaLabel, Before: nil, After: []byte{}}}, diff.Modified[0].Changes)
+
+	// The distinction survives marshalling
+	data, err := (&Inventory{Objects: []InventoryObject{absent, empty}}).Marshal()
+	require.NoError(t, err)
+	decoded, err := UnmarshalInventory(data)
+	require.NoError(t, err)
+	assert.False(t, decoded.Objects[0].Present(CkaLabel))
+	assert.True(t, decoded.Objects[1].Present(CkaLabel))
+}
+
+func TestContextInventoryEmptyLabel(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateSecretKeyWithLabel(randomBytes(), []byte{}, 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		inventory, err := ctx.Inventory()
+		require.NoError(t, err)
+
+		var object *InventoryObject
+		for i := range inventory.Objects {
+			if inventory.Objects[i].Handle == key.handle {
+				object = &inventory.Objects[i]
+			}
+		}
+		require.NotNil(t, object)
+		assert.True(t, object.Present(CkaLabel))
+		assert.Equal(t, []byte{}, object.Attributes[CkaLabel])
+	})
+}
+
+func TestContextInventoryBindings(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id, otherID := randomBytes(), randomBytes()
+		key, err := ctx.GenerateECDSAKeyPair(id, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		other, err := ctx.GenerateECDSAKeyPair(otherID, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = other.Delete() }()
+
+		now := time.Now()
+		require.NoError(t, ctx.ImportCertificate(id, certificateWithValidity(t, key, now.Add(-time.Hour),
+			now.Add(time.Hour))))
+		defer func() { _ = ctx.DeleteCertificate(id, nil, nil) }()
+
+		// A renewal installed against the wrong key.
+		require.NoError(t, ctx.ImportCertificate(otherID, certificateWithValidity(t, key, now.Add(-time.Hour),
+			now.Add(time.Hour))))
+		defer func() { _ = ctx.DeleteCertificate(otherID, nil, nil) }()
+
+		orphanID := randomBytes()
+		require.NoError(t, ctx.ImportCertificate(orphanID, certificateWithValidity(t, key, now.Add(-time.Hour),
+			now.Add(time.Hour))))
+		defer func() { _ = ctx.DeleteCertificate(orphanID, nil, nil) }()
+
+		inventory, err := ctx.Inventory()
+		require.NoError(t, err)
+
+		statuses := map[string]CertificateBindingStatus{}
+		for _, binding := range inventory.Bindings {
+			for name, bindingID := range map[string][]byte{"key": id, "other": otherID, "orphan": orphanID} {
+				if bytes.Equal(binding.ID, bindingID) {
+					statuses[name] = binding.Status
+				}
+			}
+		}
+		assert.Equal(t, map[string]CertificateBindingStatus{
+			"key":    BindingOK,
+			"other":  BindingKeyMismatch,
+			"orphan": BindingMissingKey,
+		}, statuses)
+
+		data, err := inventory.Marshal()
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"Status":"key-mismatch"`)
+		decoded, err := UnmarshalInventory(data)
+		require.NoError(t, err)
+		assert.Equal(t, inventory.Bindings, decoded.Bindings)
+	})
+}
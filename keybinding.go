@@ -0,0 +1,258 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrKeyMismatch is returned by FindKeyPairWithOptions when a key pair fails a binding check: its private key does
+// not produce signatures that verify with its public key, or its public key is not the expected one.
+var ErrKeyMismatch = errors.New("key pair does not match")
+
+// FindKeyPairOptions control the checks made by FindKeyPairWithOptions.
+type FindKeyPairOptions struct {
+	// VerifyKeyBinding signs a random probe digest with the private key and verifies the signature with the public
+	// key found alongside it. The probe is skipped for private keys whose usage does not permit signing. RSA, ECDSA,
+	// DSA and Ed25519 key pairs can be checked; for other key types an error is returned.
+	VerifyKeyBinding bool
+
+	// ExpectedPublicKey, if non-nil, must equal the public key of the key pair.
+	ExpectedPublicKey crypto.PublicKey
+
+	// ExpectedFingerprint, if non-nil, must equal the PublicKeyFingerprint of the key pair.
+	ExpectedFingerprint []byte
+
+	// IncludeArchived also finds archived key pairs, see Archive. A CKA_LABEL in the search matches archived key
+	// pairs by the label they had before they were archived.
+	IncludeArchived bool
+}
+
+// PublicKeyFingerprint returns the SHA-256 digest of the DER-encoded SubjectPublicKeyInfo of pub. Keys on the
+// secp256k1 and Brainpool curves are supported, although crypto/x509 cannot marshal them.
+func PublicKeyFingerprint(pub crypto.PublicKey) ([]byte, error) {
+	var der []byte
+	var err error
+	if ecdsaPub, ok := pub.(*ecdsa.PublicKey); ok {
+		if curve, ok := ecdsaPub.Curve.(*weierstrassCurve); ok {
+			der, err = marshalWeierstrassPublicKey(ecdsaPub, curve)
+		} else {
+			der, err = x509.MarshalPKIXPublicKey(pub)
+		}
+	} else {
+		der, err = x509.MarshalPKIXPublicKey(pub)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(der)
+	return fingerprint[:], nil
+}
+
+// FindKeyPairWithOptions is FindKeyPair, followed by the checks requested in opts. Use it when labels or IDs on the
+// token may have been changed by someone else, for instance another tenant of a shared token. If a check fails,
+// an error wrapping ErrKeyMismatch is returned. A nil opts makes no checks.
+func (c *Context) FindKeyPairWithOptions(id []byte, label []byte, opts *FindKeyPairOptions) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	attributes, err := idLabelAttributes(id, label)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := c.findKeyPairs(attributes, opts != nil && opts.IncludeArchived)
+	if err != nil || len(signers) == 0 {
+		return nil, err
+	}
+	if opts == nil {
+		return signers[0], nil
+	}
+
+	if err = c.checkKeyBinding(signers[0], opts); err != nil {
+		return nil, err
+	}
+	return signers[0], nil
+}
+
+// FindKeyPairsWithOptions is FindKeyPairsWithAttributes, followed by the checks requested in opts for each key pair
+// found. If a check fails, an error wrapping ErrKeyMismatch is returned. A nil opts makes no checks.
+func (c *Context) FindKeyPairsWithOptions(attributes AttributeSet, opts *FindKeyPairOptions) ([]Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	signers, err := c.findKeyPairs(attributes, opts != nil && opts.IncludeArchived)
+	if err != nil || opts == nil {
+		return signers, err
+	}
+
+	for _, signer := range signers {
+		if err = c.checkKeyBinding(signer, opts); err != nil {
+			return nil, err
+		}
+	}
+	return signers, nil
+}
+
+// checkKeyBinding makes the checks in opts against signer.
+func (c *Context) checkKeyBinding(signer Signer, opts *FindKeyPairOptions) error {
+	pub := signer.Public()
+
+	if opts.ExpectedPublicKey != nil && !publicKeysEqual(pub, opts.ExpectedPublicKey) {
+		return withMessage(ErrKeyMismatch, "public key is not the expected key")
+	}
+
+	if opts.ExpectedFingerprint != nil {
+		fingerprint, err := PublicKeyFingerprint(pub)
+		if err != nil {
+			return withMessage(err, "computing public key fingerprint")
+		}
+		if !bytes.Equal(fingerprint, opts.ExpectedFingerprint) {
+			return withMessage(ErrKeyMismatch, "public key does not have the expected fingerprint")
+		}
+	}
+
+	if !opts.VerifyKeyBinding {
+		return nil
+	}
+
+	probeOpts, ok, err := c.bindingProbeOpts(signer)
+	if err != nil || !ok {
+		return err
+	}
+
+	// DSA tokens may refuse digests longer than the subgroup order, so the probe is no longer than that.
+	digest := make([]byte, sha256.Size)
+	if dsaPub, ok := pub.(*dsa.PublicKey); ok && (dsaPub.Q.BitLen()+7)/8 < len(digest) {
+		digest = digest[:(dsaPub.Q.BitLen()+7)/8]
+	}
+	if _, err = io.ReadFull(c.randReader(), digest); err != nil {
+		return withMessage(err, "generating probe digest")
+	}
+	signature, err := signer.Sign(c.randReader(), digest, probeOpts)
+	if err != nil {
+		return withMessage(err, "signing probe digest")
+	}
+	if err = verifyInSoftware(pub, digest, signature, probeOpts); err != nil {
+		if errors.Is(err, ErrSignatureInvalid) {
+			return withMessage(ErrKeyMismatch, "probe signature does not verify with the public key")
+		}
+		return err
+	}
+	return nil
+}
+
+// bindingProbeOpts returns the signing options for the cheapest mechanism the private key of signer permits, or false
+// if it cannot sign at all. An error is returned for key types whose binding cannot be checked.
+func (c *Context) bindingProbeOpts(signer Signer) (crypto.SignerOpts, bool, error) {
+	k := tokenKeyOf(signer)
+	if k == nil {
+		return nil, false, nil
+	}
+
+	usage, err := c.usageAttributes(k, []AttributeType{CkaSign})
+	if err != nil {
+		return nil, false, withMessage(err, "reading key usage")
+	}
+	if !attributeIsTrue(usage, CkaSign) {
+		return nil, false, nil
+	}
+
+	allowed := c.allowedMechanisms(k)
+	permitted := func(mech uint) bool { return mechanismAllowed(allowed, mech) }
+
+	switch signer.(type) {
+	case *pkcs11PrivateKeyRSA:
+		switch {
+		case permitted(pkcs11.CKM_RSA_PKCS):
+			return crypto.SHA256, true, nil
+		case permitted(pkcs11.CKM_RSA_PKCS_PSS):
+			return &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthEqualsHash}, true, nil
+		}
+	case *pkcs11PrivateKeyECDSA:
+		if permitted(pkcs11.CKM_ECDSA) {
+			return crypto.SHA256, true, nil
+		}
+	case *pkcs11PrivateKeyDSA:
+		if permitted(pkcs11.CKM_DSA) {
+			return crypto.SHA256, true, nil
+		}
+	case *pkcs11PrivateKeyEd25519:
+		// The probe digest is signed as the message.
+		if permitted(ckmEdDSA) {
+			return crypto.Hash(0), true, nil
+		}
+	default:
+		return nil, false, fmt.Errorf("cannot check the key binding of key pairs of type %T", signer)
+	}
+	return nil, false, nil
+}
+
+// allowedMechanisms returns the CKA_ALLOWED_MECHANISMS of k. CKA_ALLOWED_MECHANISMS is optional; if the token
+// cannot report it, nil is returned and any mechanism is assumed to be allowed.
+func (c *Context) allowedMechanisms(k *pkcs11PrivateKey) []uint {
+	handle, _ := k.objectHandles()
+	attributes, err := c.getAttributes(handle, []AttributeType{CkaAllowedMechanisms})
+	if err != nil {
+		return nil
+	}
+	if a := attributes[CkaAllowedMechanisms]; a != nil {
+		return bytesToUlongs(a.Value)
+	}
+	return nil
+}
+
+// mechanismAllowed returns true if mech is in allowed, or allowed is empty.
+func mechanismAllowed(allowed []uint, mech uint) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, m := range allowed {
+		if m == mech {
+			return true
+		}
+	}
+	return false
+}
+
+// bytesToUlongs decodes a CK_ULONG array attribute value, such as CKA_ALLOWED_MECHANISMS.
+func bytesToUlongs(bs []byte) []uint {
+	size := len(ulongToBytes(0))
+	var result []uint
+	for len(bs) >= size {
+		result = append(result, bytesToUlong(bs[:size]))
+		bs = bs[size:]
+	}
+	return result
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicKeyFingerprint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	fingerprint, err := PublicKeyFingerprint(key.Public())
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	expected := sha256.Sum256(der)
+	assert.Equal(t, expected[:], fingerprint)
+
+	_, err = PublicKeyFingerprint("not a key")
+	assert.Error(t, err)
+}
+
+func TestBytesToUlongs(t *testing.T) {
+	data := append(ulongToBytes(pkcs11.CKM_RSA_PKCS), ulongToBytes(pkcs11.CKM_RSA_PKCS_PSS)...)
+	assert.Equal(t, []uint{pkcs11.CKM_RSA_PKCS, pkcs11.CKM_RSA_PKCS_PSS}, bytesToUlongs(data))
+	assert.Nil(t, bytesToUlongs(nil))
+}
+
+func TestFindKeyPairWithOptions(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		key, err := ctx.GenerateECDSAKeyPair(id, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		found, err := ctx.FindKeyPairWithOptions(id, nil, &FindKeyPairOptions{VerifyKeyBinding: true})
+		require.NoError(t, err)
+		require.NotNil(t, found)
+
+		fingerprint, err := PublicKeyFingerprint(key.Public())
+		require.NoError(t, err)
+		found, err = ctx.FindKeyPairWithOptions(id, nil, &FindKeyPairOptions{
+			ExpectedPublicKey:   key.Public(),
+			ExpectedFingerprint: fingerprint,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, found)
+
+		_, err = ctx.FindKeyPairWithOptions(id, nil, &FindKeyPairOptions{ExpectedPublicKey: other.Public()})
+		assert.True(t, errors.Is(err, ErrKeyMismatch), "%v", err)
+
+		_, err = ctx.FindKeyPairWithOptions(id, nil, &FindKeyPairOptions{ExpectedFingerprint: make([]byte, 32)})
+		assert.True(t, errors.Is(err, ErrKeyMismatch), "%v", err)
+
+		found, err = ctx.FindKeyPairWithOptions(randomBytes(), nil, &FindKeyPairOptions{VerifyKeyBinding: true})
+		assert.NoError(t, err)
+		assert.Nil(t, found)
+	})
+}
+
+func TestFindKeyPairWithOptionsDetectsSwappedPublicKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		victim, err := ctx.GenerateECDSAKeyPair(id, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = victim.Delete() }()
+
+		intruder, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = intruder.Delete() }()
+
+		// Replace the public half of victim with that of intruder, so that the key pair found by id no longer
+		// belongs together.
+		err = ctx.withSession(func(session *pkcs11Session) error {
+			if err := session.ctx.DestroyObject(session.handle, tokenKeyOf(victim).pubKeyHandle); err != nil {
+				return err
+			}
+			return session.ctx.SetAttributeValue(session.handle, tokenKeyOf(intruder).pubKeyHandle,
+				[]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, id)})
+		})
+		require.NoError(t, err)
+
+		found, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+
+		_, err = ctx.FindKeyPairWithOptions(id, nil, &FindKeyPairOptions{VerifyKeyBinding: true})
+		assert.True(t, errors.Is(err, ErrKeyMismatch), "%v", err)
+	})
+}
+
+func TestFindKeyPairWithOptionsSkipsNonSigningKeys(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		key, err := ctx.GenerateRSAKeyPairForPurpose(id, nil, rsaSize, KeyPurposeDecryption)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		found, err := ctx.FindKeyPairWithOptions(id, nil, &FindKeyPairOptions{VerifyKeyBinding: true})
+		require.NoError(t, err)
+		assert.NotNil(t, found)
+	})
+}
+
+func TestFindKeyPairWithOptionsEd25519(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		if !ctx.tokenSupports(ckmECEdwardsKeyPairGen, pkcs11.CKF_GENERATE_KEY_PAIR) {
+			t.Skip("token does not support CKM_EC_EDWARDS_KEY_PAIR_GEN")
+		}
+
+		id := randomBytes()
+		key, err := ctx.GenerateEd25519KeyPair(id)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		found, err := ctx.FindKeyPairWithOptions(id, nil, &FindKeyPairOptions{VerifyKeyBinding: true})
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, key.Public(), found.Public())
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"sort"
+
+	"github.com/miekg/pkcs11"
+)
+
+// KeyOperations summarizes the operations a key pair can perform, taking into account both the permissions of the
+// private key object and the mechanisms the token supports. It is returned by the SupportedOperations method of key
+// pairs.
+//
+// The token mechanism list does not say which hash functions can be used with CKM_RSA_PKCS_PSS or
+// CKM_RSA_PKCS_OAEP, which take the hash as a parameter, so SignPSSHashes and DecryptOAEPHashes list every hash
+// function crypto11 supports if the mechanism can be used at all, leaving out SHA-3 unless the token advertises the
+// SHA-3 digest mechanism. Capabilities.SupportsOAEPSHA256 reports whether RSA-OAEP with SHA-256 actually works.
+type KeyOperations struct {
+	// SignPKCS1v15 is true if Sign can make RSA PKCS#1 v1.5 signatures.
+	SignPKCS1v15 bool `json:"signPKCS1v15"`
+
+	// SignPSSHashes lists the hash functions with which Sign can make RSA-PSS signatures.
+	SignPSSHashes []crypto.Hash `json:"signPSSHashes"`
+
+	// SignECDSA is true if Sign can make ECDSA signatures.
+	SignECDSA bool `json:"signECDSA"`
+
+	// SignDSA is true if Sign can make DSA signatures.
+	SignDSA bool `json:"signDSA"`
+
+	// SignMessageHashes lists the hash functions with which SignMessage can hash and sign a message on the token,
+	// using PKCS#1 v1.5 for RSA key pairs.
+	SignMessageHashes []crypto.Hash `json:"signMessageHashes"`
+
+	// SignMessagePSSHashes lists the hash functions with which SignMessage can hash a message on the token and make
+	// an RSA-PSS signature.
+	SignMessagePSSHashes []crypto.Hash `json:"signMessagePSSHashes"`
+
+	// DecryptPKCS1v15 is true if Decrypt can decrypt RSA PKCS#1 v1.5 ciphertexts.
+	DecryptPKCS1v15 bool `json:"decryptPKCS1v15"`
+
+	// DecryptOAEPHashes lists the hash functions with which Decrypt can decrypt RSA-OAEP ciphertexts.
+	DecryptOAEPHashes []crypto.Hash `json:"decryptOAEPHashes"`
+
+	// DecryptRaw is true if Decrypt can perform raw RSA decryption, see RawRSADecryptOptions.
+	DecryptRaw bool `json:"decryptRaw"`
+
+	// Derive is true if the private key can be used with CKM_ECDH1_DERIVE to agree a shared secret.
+	Derive bool `json:"derive"`
+
+	// UnwrapOAEP is true if the private key can unwrap keys wrapped with RSA-OAEP onto the token, see
+	// UnwrapPrivateKey and UnwrapEnvelopeKey.
+	UnwrapOAEP bool `json:"unwrapOAEP"`
+
+	// MechanismProfile is the name of the mechanism profile the key pair uses, if any. Sign or Decrypt then uses the
+	// mechanism of the profile, and the fields describing that operation are false or empty.
+	MechanismProfile string `json:"mechanismProfile,omitempty"`
+}
+
+// SupportedOperations reports the operations the key pair can perform, see KeyOperations. The permissions of the
+// private key object are read from the token, unless the key pair was made by GenerateRSAKeyPairWithOptions, whose
+// options are used instead.
+func (priv *pkcs11PrivateKeyRSA) SupportedOperations() (*KeyOperations, error) {
+	ops, err := priv.supportedOperations(pkcs11.CKK_RSA)
+	if err != nil {
+		return nil, err
+	}
+	if !priv.pkcs1v15DecryptionAllowed() {
+		ops.DecryptPKCS1v15 = false
+	}
+	return ops, nil
+}
+
+// SupportedOperations reports the operations the key pair can perform, see KeyOperations. The permissions of the
+// private key object are read from the token.
+func (signer *pkcs11PrivateKeyECDSA) SupportedOperations() (*KeyOperations, error) {
+	return signer.supportedOperations(pkcs11.CKK_ECDSA)
+}
+
+// SupportedOperations reports the operations the key pair can perform, see KeyOperations. The permissions of the
+// private key object are read from the token.
+func (signer *pkcs11PrivateKeyDSA) SupportedOperations() (*KeyOperations, error) {
+	return signer.supportedOperations(pkcs11.CKK_DSA)
+}
+
+// supportedOperations intersects the permissions of k, a key pair of keyType, with the mechanisms of the token.
+func (k *pkcs11PrivateKey) supportedOperations(keyType uint) (*KeyOperations, error) {
+	if k.context.closed.Get() {
+		return nil, errClosed
+	}
+
+	c := k.context
+	var sign, decrypt, derive, unwrap bool
+	var allowed []uint
+	if k.usage != nil {
+		sign, decrypt, unwrap, allowed = k.usage.sign, k.usage.decrypt, k.usage.unwrap, k.usage.allowed
+	} else {
+		attributes, err := c.usageAttributes(k, []AttributeType{CkaSign, CkaDecrypt, CkaDerive, CkaUnwrap})
+		if err != nil {
+			return nil, withMessage(err, "reading key usage")
+		}
+		sign = attributeIsTrue(attributes, CkaSign)
+		decrypt = attributeIsTrue(attributes, CkaDecrypt)
+		derive = attributeIsTrue(attributes, CkaDerive)
+		unwrap = attributeIsTrue(attributes, CkaUnwrap)
+		allowed = c.allowedMechanisms(k)
+	}
+
+	can := func(permitted bool, mech uint, flag uint) bool {
+		return permitted && mechanismAllowed(allowed, mech) && c.tokenSupports(mech, flag)
+	}
+	hashes := func(pss bool) []crypto.Hash {
+		var result []crypto.Hash
+		for hash, info := range hashRegistry {
+			if mech := info.signMechanism(keyType, pss); mech != 0 && can(sign, mech, pkcs11.CKF_SIGN) {
+				result = append(result, hash)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+		return result
+	}
+
+	ops := &KeyOperations{}
+	if k.mechanismProfile != nil {
+		ops.MechanismProfile = k.mechanismProfile.name
+	}
+	signDirect := k.profileFor(MechanismSign) == nil
+	decryptDirect := k.profileFor(MechanismDecrypt) == nil
+
+	ops.SignMessageHashes = hashes(false)
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		ops.SignMessagePSSHashes = hashes(true)
+		if signDirect {
+			ops.SignPKCS1v15 = can(sign, pkcs11.CKM_RSA_PKCS, pkcs11.CKF_SIGN)
+			pssMechanism := uint(pkcs11.CKM_RSA_PKCS_PSS)
+			if c.softwarePSS() {
+				pssMechanism = pkcs11.CKM_RSA_X_509
+			}
+			if can(sign, pssMechanism, pkcs11.CKF_SIGN) {
+				ops.SignPSSHashes = c.tokenHashes()
+			}
+		}
+		if decryptDirect {
+			ops.DecryptPKCS1v15 = can(decrypt, pkcs11.CKM_RSA_PKCS, pkcs11.CKF_DECRYPT)
+			if can(decrypt, pkcs11.CKM_RSA_PKCS_OAEP, pkcs11.CKF_DECRYPT) {
+				ops.DecryptOAEPHashes = c.tokenHashes()
+			}
+			ops.DecryptRaw = can(decrypt, pkcs11.CKM_RSA_X_509, pkcs11.CKF_DECRYPT)
+		}
+		ops.UnwrapOAEP = can(unwrap, pkcs11.CKM_RSA_PKCS_OAEP, pkcs11.CKF_UNWRAP)
+
+	case pkcs11.CKK_ECDSA:
+		ops.SignECDSA = signDirect && can(sign, pkcs11.CKM_ECDSA, pkcs11.CKF_SIGN)
+		ops.Derive = can(derive, pkcs11.CKM_ECDH1_DERIVE, pkcs11.CKF_DERIVE)
+
+	case pkcs11.CKK_DSA:
+		ops.SignDSA = signDirect && can(sign, pkcs11.CKM_DSA, pkcs11.CKF_SIGN)
+
+	case ckkECMontgomery:
+		ops.Derive = can(derive, pkcs11.CKM_ECDH1_DERIVE, pkcs11.CKF_DERIVE)
+	}
+	return ops, nil
+}
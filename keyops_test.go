@@ -0,0 +1,110 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRsaSupportedOperations(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		signing, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeSigning)
+		require.NoError(t, err)
+		defer func() { _ = signing.Delete() }()
+
+		ops, err := signing.(OperationReporter).SupportedOperations()
+		require.NoError(t, err)
+		assert.Equal(t, ctx.tokenCanSign(pkcs11.CKM_RSA_PKCS), ops.SignPKCS1v15)
+		if ctx.tokenCanSign(pkcs11.CKM_RSA_PKCS_PSS) {
+			assert.Equal(t, ctx.tokenHashes(), ops.SignPSSHashes)
+		}
+		assert.False(t, ops.DecryptPKCS1v15)
+		assert.Empty(t, ops.DecryptOAEPHashes)
+		assert.False(t, ops.SignECDSA)
+		assert.False(t, ops.UnwrapOAEP)
+
+		decryption, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeDecryption)
+		require.NoError(t, err)
+		defer func() { _ = decryption.Delete() }()
+
+		ops, err = decryption.(OperationReporter).SupportedOperations()
+		require.NoError(t, err)
+		assert.False(t, ops.SignPKCS1v15)
+		assert.Empty(t, ops.SignPSSHashes)
+		assert.Empty(t, ops.SignMessageHashes)
+		assert.Equal(t, ctx.tokenSupports(pkcs11.CKM_RSA_PKCS, pkcs11.CKF_DECRYPT), ops.DecryptPKCS1v15)
+
+		// Mechanisms the token does not support are left out.
+		ctx.mechanismFlags.Store(uint(pkcs11.CKM_RSA_PKCS), uint(0))
+		ops, err = signing.(OperationReporter).SupportedOperations()
+		require.NoError(t, err)
+		assert.False(t, ops.SignPKCS1v15)
+	})
+}
+
+func TestRsaSupportedOperationsWithAllowedMechanisms(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairWithOptions(RSAKeyPairOptions{
+			Bits:              rsaSize,
+			Sign:              true,
+			AllowedMechanisms: []uint{pkcs11.CKM_RSA_PKCS_PSS, pkcs11.CKM_SHA256_RSA_PKCS_PSS},
+		})
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		ops, err := key.(OperationReporter).SupportedOperations()
+		require.NoError(t, err)
+		assert.False(t, ops.SignPKCS1v15)
+		assert.Empty(t, ops.SignMessageHashes)
+		assert.False(t, ops.DecryptPKCS1v15)
+		if ctx.tokenCanSign(pkcs11.CKM_RSA_PKCS_PSS) {
+			assert.Equal(t, ctx.tokenHashes(), ops.SignPSSHashes)
+		}
+		if ctx.tokenCanSign(pkcs11.CKM_SHA256_RSA_PKCS_PSS) {
+			assert.Equal(t, []crypto.Hash{crypto.SHA256}, ops.SignMessagePSSHashes)
+		}
+	})
+}
+
+func TestEcdsaSupportedOperations(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		ops, err := key.(OperationReporter).SupportedOperations()
+		require.NoError(t, err)
+		assert.Equal(t, ctx.tokenCanSign(pkcs11.CKM_ECDSA), ops.SignECDSA)
+		assert.False(t, ops.SignPKCS1v15)
+		assert.Empty(t, ops.SignPSSHashes)
+		assert.Empty(t, ops.DecryptOAEPHashes)
+		if ctx.tokenCanSign(pkcs11.CKM_ECDSA_SHA256) {
+			assert.Contains(t, ops.SignMessageHashes, crypto.SHA256)
+		}
+	})
+}
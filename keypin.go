@@ -0,0 +1,169 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/pkcs11"
+)
+
+// keyPin records what a loaded key pair was, so that its handles can be re-resolved and checked after Resume. See
+// Config.RepinKeysAfterResume.
+type keyPin struct {
+	// mutex is held for writing while repin replaces the key pair's handles, and for reading while they are used, see
+	// pkcs11PrivateKey.withSession and pkcs11PrivateKey.objectHandles.
+	mutex sync.RWMutex
+
+	// epoch is the Context handle epoch for which the key pair's handles are known to be valid.
+	epoch uint64
+
+	// id and label are the CKA_ID and CKA_LABEL of the private key.
+	id    []byte
+	label []byte
+
+	// fingerprint identifies the public key, see pinFingerprint. It is nil if it could not be computed.
+	fingerprint []byte
+}
+
+// pinKey records the identity of a newly loaded key pair, if Config.RepinKeysAfterResume is set. If the identity
+// cannot be read, the key pair is still pinned, and fails with ErrKeyMismatch when it is next used after Resume.
+func (c *Context) pinKey(session *pkcs11Session, k *pkcs11PrivateKey, pub crypto.PublicKey) {
+	if !c.cfg.RepinKeysAfterResume {
+		return
+	}
+
+	pin := &keyPin{epoch: atomic.LoadUint64(&c.handleEpoch)}
+	if identity, err := readObjectIdentity(session, k.handle); err == nil {
+		pin.id = identity.id
+		pin.label = identity.label
+	}
+	pin.fingerprint, _ = pinFingerprint(pub)
+	k.pin = pin
+}
+
+// withSession runs f with a session from the key pair's pool, as pkcs11Object.withSession does, after re-resolving
+// the key pair's handles if the Context has been resumed since they were last checked. The handles cannot be replaced
+// while f runs, so f must not call withSession or objectHandles on k itself.
+func (k *pkcs11PrivateKey) withSession(f func(session *pkcs11Session) error) error {
+	return k.pkcs11Object.withSession(func(session *pkcs11Session) error {
+		if err := k.repin(session); err != nil {
+			return err
+		}
+		if pin := k.pin; pin != nil {
+			pin.mutex.RLock()
+			defer pin.mutex.RUnlock()
+		}
+		return f(session)
+	})
+}
+
+// objectHandles returns the handles of the private and public key objects. Code that uses them outside withSession
+// must read them with objectHandles, since repin may replace them concurrently.
+func (k *pkcs11PrivateKey) objectHandles() (private, public pkcs11.ObjectHandle) {
+	if pin := k.pin; pin != nil {
+		pin.mutex.RLock()
+		defer pin.mutex.RUnlock()
+	}
+	return k.handle, k.pubKeyHandle
+}
+
+// repin re-resolves a stale key pair by the CKA_ID and CKA_LABEL recorded when it was loaded, and checks that the
+// public key has the same fingerprint. ErrKeyMismatch is returned if the key pair cannot be found unambiguously or
+// is not the same key pair.
+func (k *pkcs11PrivateKey) repin(session *pkcs11Session) error {
+	pin := k.pin
+	if pin == nil {
+		return nil
+	}
+
+	epoch := atomic.LoadUint64(&k.context.handleEpoch)
+
+	pin.mutex.Lock()
+	defer pin.mutex.Unlock()
+
+	if pin.epoch == epoch {
+		return nil
+	}
+
+	if len(pin.id) == 0 || pin.fingerprint == nil {
+		return withMessage(ErrKeyMismatch, "key pair cannot be re-verified after Resume")
+	}
+
+	// An empty label only matches private keys whose label is also empty.
+	label := pin.label
+	if label == nil {
+		label = []byte{}
+	}
+	handles, err := findKeys(session, pin.id, label, uintPtr(pkcs11.CKO_PRIVATE_KEY), nil)
+	if err != nil {
+		return err
+	}
+	if len(handles) != 1 {
+		return withMessagef(ErrKeyMismatch, "found %d private keys with the key pair's CKA_ID and CKA_LABEL after Resume",
+			len(handles))
+	}
+
+	signer, _, err := k.context.makeKeyPair(session, &handles[0])
+	if err != nil {
+		return withMessage(err, "reloading key pair after Resume")
+	}
+	reloaded := tokenKeyOf(signer)
+	defer reloaded.stopCountingPublicKey()
+	pub := reloaded.pubKey
+	if pub == nil && reloaded.pubKeyExport != nil {
+		if pub, err = reloaded.pubKeyExport(session, reloaded.pubKeyHandle); err != nil {
+			return withMessage(err, "reading public key after Resume")
+		}
+	}
+
+	fingerprint, err := pinFingerprint(pub)
+	if err != nil || !bytes.Equal(fingerprint, pin.fingerprint) {
+		return withMessage(ErrKeyMismatch, "public key fingerprint changed after Resume")
+	}
+
+	k.handle = reloaded.handle
+	k.pubKeyHandle = reloaded.pubKeyHandle
+	pin.epoch = epoch
+	return nil
+}
+
+// pinFingerprint returns PublicKeyFingerprint(pub). DSA keys, which crypto/x509 cannot marshal, are fingerprinted
+// with the SHA-256 digest of their parameters and public value instead.
+func pinFingerprint(pub crypto.PublicKey) ([]byte, error) {
+	dsaPub, ok := pub.(*dsa.PublicKey)
+	if !ok {
+		return PublicKeyFingerprint(pub)
+	}
+
+	digester := sha256.New()
+	for _, n := range [][]byte{dsaPub.P.Bytes(), dsaPub.Q.Bytes(), dsaPub.G.Bytes(), dsaPub.Y.Bytes()} {
+		digester.Write(ulongToBytes(uint(len(n))))
+		digester.Write(n)
+	}
+	return digester.Sum(nil), nil
+}
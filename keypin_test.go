@@ -0,0 +1,200 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"context"
+	"crypto"
+	"crypto/dsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinFingerprint(t *testing.T) {
+	var key dsa.PrivateKey
+	require.NoError(t, dsa.GenerateParameters(&key.Parameters, rand.Reader, dsa.L1024N160))
+	require.NoError(t, dsa.GenerateKey(&key, rand.Reader))
+
+	fingerprint, err := pinFingerprint(&key.PublicKey)
+	require.NoError(t, err)
+	again, err := pinFingerprint(&dsa.PublicKey{Parameters: key.Parameters, Y: key.Y})
+	require.NoError(t, err)
+	assert.Equal(t, fingerprint, again)
+
+	require.NoError(t, dsa.GenerateKey(&key, rand.Reader))
+	other, err := pinFingerprint(&key.PublicKey)
+	require.NoError(t, err)
+	assert.NotEqual(t, fingerprint, other)
+}
+
+// withRepinContext calls f with a Context that has RepinKeysAfterResume set.
+func withRepinContext(t *testing.T, f func(ctx *Context)) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.RepinKeysAfterResume = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	f(ctx)
+}
+
+// suspendAndResume suspends and resumes ctx, marking loaded key pairs stale.
+func suspendAndResume(t *testing.T, ctx *Context) {
+	require.NoError(t, ctx.Suspend(context.Background()))
+	require.NoError(t, ctx.Resume())
+}
+
+func TestRepinKeysAfterResume(t *testing.T) {
+	withRepinContext(t, func(ctx *Context) {
+		id, label := randomBytes(), randomBytes()
+		key, err := ctx.GenerateRSAKeyPairWithLabel(id, label, rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		found, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+
+		suspendAndResume(t, ctx)
+
+		digest := sha256.Sum256([]byte("repinned"))
+		for _, signer := range []Signer{key, found} {
+			signature, err := signer.Sign(nil, digest[:], crypto.SHA256)
+			require.NoError(t, err)
+			require.NoError(t, verifyInSoftware(signer.Public(), digest[:], signature, crypto.SHA256))
+
+			pinned := tokenKeyOf(signer)
+			require.NotNil(t, pinned.pin)
+			assert.Equal(t, ctx.handleEpoch, pinned.pin.epoch)
+		}
+	})
+}
+
+func TestRepinKeysWhileSigning(t *testing.T) {
+	withRepinContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairWithLabel(randomBytes(), randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		digest := sha256.Sum256([]byte("concurrent"))
+		signature, err := key.Sign(nil, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+
+		stop := make(chan struct{})
+		errs := make(chan error, 4)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						errs <- nil
+						return
+					default:
+					}
+					// Verifying uses the public key handle without signing first, so it can overlap a repin.
+					err := VerifySignature(key, digest[:], signature, crypto.SHA256)
+					if err == nil {
+						_, err = key.Sign(nil, digest[:], crypto.SHA256)
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		for i := 0; i < 3; i++ {
+			suspendAndResume(t, ctx)
+		}
+		close(stop)
+		wg.Wait()
+		for i := 0; i < cap(errs); i++ {
+			assert.NoError(t, <-errs)
+		}
+	})
+}
+
+func TestRepinKeysDetectsMismatch(t *testing.T) {
+	withRepinContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairWithLabel(randomBytes(), randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() {
+			// Let the key be deleted despite the tampered fingerprint.
+			tokenKeyOf(key).pin = nil
+			_ = key.Delete()
+		}()
+
+		// Pretend the key pair found after Resume has a different public key.
+		tokenKeyOf(key).pin.fingerprint = make([]byte, sha256.Size)
+		suspendAndResume(t, ctx)
+
+		digest := sha256.Sum256([]byte("replaced"))
+		_, err = key.Sign(nil, digest[:], crypto.SHA256)
+		assert.True(t, errors.Is(err, ErrKeyMismatch), "unexpected error: %v", err)
+
+		err = key.Delete()
+		assert.True(t, errors.Is(err, ErrKeyMismatch), "unexpected error: %v", err)
+	})
+}
+
+func TestRepinKeysDetectsAmbiguity(t *testing.T) {
+	withRepinContext(t, func(ctx *Context) {
+		id, label := randomBytes(), randomBytes()
+		key, err := ctx.GenerateRSAKeyPairWithLabel(id, label, rsaSize)
+		require.NoError(t, err)
+		duplicate, err := ctx.GenerateRSAKeyPairWithLabel(id, label, rsaSize)
+		require.NoError(t, err)
+		defer func() {
+			for _, k := range []Signer{key, duplicate} {
+				tokenKeyOf(k).pin = nil
+				_ = k.Delete()
+			}
+		}()
+
+		suspendAndResume(t, ctx)
+
+		digest := sha256.Sum256([]byte("ambiguous"))
+		_, err = key.Sign(nil, digest[:], crypto.SHA256)
+		assert.True(t, errors.Is(err, ErrKeyMismatch), "unexpected error: %v", err)
+	})
+}
+
+func TestKeysNotPinnedByDefault(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		assert.Nil(t, tokenKeyOf(key).pin)
+	})
+}
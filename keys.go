@@ -24,30 +24,116 @@ package crypto11
 import (
 	"crypto"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/miekg/pkcs11"
-	"github.com/pkg/errors"
+	"github.com/thales-e-security/pool"
 )
 
-const maxHandlePerFind = 20
-
 // errNoCkaId is returned if a private key is found which has no CKA_ID attribute
 var errNoCkaId = errors.New("private key has no CKA_ID")
 
 // errNoPublicHalf is returned if a public half cannot be found to match a given private key
 var errNoPublicHalf = errors.New("could not find public key to match private key")
 
+// emptyMatchAttributes are the attributes for which a zero-length value in a search template matches objects whose
+// attribute is present but empty. Tokens disagree on how to treat such a template entry: some match only empty
+// values, some match everything and some reject the template with CKR_TEMPLATE_INCONSISTENT. So these entries are
+// never passed to the token; the search results are filtered instead.
+var emptyMatchAttributes = []uint{pkcs11.CKA_ID, pkcs11.CKA_LABEL}
+
+// findKeysWithAttributes finds the objects matching template. A nil or zero-length value in the template for one of
+// emptyMatchAttributes matches only objects that have that attribute with an empty value.
 func findKeysWithAttributes(session *pkcs11Session, template []*pkcs11.Attribute) (handles []pkcs11.ObjectHandle, err error) {
-	if err = session.ctx.FindObjectsInit(session.handle, template); err != nil {
+	template, empty := splitEmptyAttributes(template)
+
+	if handles, err = findObjectHandles(session, template); err != nil {
+		return nil, err
+	}
+
+	if len(empty) == 0 {
+		return handles, nil
+	}
+	return filterEmptyAttributes(session, handles, empty)
+}
+
+// splitEmptyAttributes removes the entries for emptyMatchAttributes with a zero-length value from template,
+// returning their types separately.
+func splitEmptyAttributes(template []*pkcs11.Attribute) (remaining []*pkcs11.Attribute, empty []uint) {
+	for _, a := range template {
+		if len(a.Value) == 0 && isEmptyMatchAttribute(a.Type) {
+			empty = append(empty, a.Type)
+			continue
+		}
+		remaining = append(remaining, a)
+	}
+	return remaining, empty
+}
+
+func isEmptyMatchAttribute(t uint) bool {
+	for _, e := range emptyMatchAttributes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// filterEmptyAttributes returns the handles whose objects have every attribute in empty present with a zero-length
+// value. Objects that lack one of the attributes, or that have been destroyed since the search, are dropped.
+func filterEmptyAttributes(session *pkcs11Session, handles []pkcs11.ObjectHandle,
+	empty []uint) ([]pkcs11.ObjectHandle, error) {
+
+	var template []*pkcs11.Attribute
+	for _, t := range empty {
+		template = append(template, pkcs11.NewAttribute(t, nil))
+	}
+
+	var matched []pkcs11.ObjectHandle
+	for _, handle := range handles {
+		values, err := session.ctx.GetAttributeValue(session.handle, handle, template)
+		if err != nil {
+			if isObjectGone(err) || isPKCS11Error(err, pkcs11.CKR_ATTRIBUTE_TYPE_INVALID) {
+				continue
+			}
+			return nil, err
+		}
+
+		match := true
+		for _, v := range values {
+			if v.Value == nil || len(v.Value) != 0 {
+				match = false
+				break
+			}
+		}
+		if match {
+			matched = append(matched, handle)
+		}
+	}
+
+	return matched, nil
+}
+
+// findObjectHandles finds the objects matching template, passing it to the token unchanged. Some modules return
+// fewer handles than requested, as few as one per call, while more objects match, so the search only ends when
+// C_FindObjects returns none.
+func findObjectHandles(session *pkcs11Session, template []*pkcs11.Attribute) (handles []pkcs11.ObjectHandle, err error) {
+	if err = session.findObjectsInit(template); err != nil {
 		return nil, err
 	}
 	defer func() {
-		finalErr := session.ctx.FindObjectsFinal(session.handle)
+		finalErr := session.findObjectsFinal()
 		if err == nil {
 			err = finalErr
 		}
 	}()
 
-	newhandles, _, err := session.ctx.FindObjects(session.handle, maxHandlePerFind)
+	batchSize := session.findBatchSize
+	if batchSize == 0 {
+		batchSize = DefaultFindObjectsBatchSize
+	}
+
+	newhandles, err := session.findObjects(batchSize)
 	if err != nil {
 		return nil, err
 	}
@@ -55,7 +141,7 @@ func findKeysWithAttributes(session *pkcs11Session, template []*pkcs11.Attribute
 	for len(newhandles) > 0 {
 		handles = append(handles, newhandles...)
 
-		newhandles, _, err = session.ctx.FindObjects(session.handle, maxHandlePerFind)
+		newhandles, err = session.findObjects(batchSize)
 		if err != nil {
 			return nil, err
 		}
@@ -64,6 +150,53 @@ func findKeysWithAttributes(session *pkcs11Session, template []*pkcs11.Attribute
 	return handles, nil
 }
 
+// scanObjects finds the objects matching template and calls f with them. Normally f is called once, on the
+// session used for the search. If Config.ReleaseSessionDuringScans is set, f is instead called for batches of
+// Config.FindObjectsBatchSize handles, each on a session taken from the pool for that batch alone.
+func (c *Context) scanObjects(template []*pkcs11.Attribute, f func(session *pkcs11Session,
+	handles []pkcs11.ObjectHandle) error) error {
+
+	if !c.cfg.ReleaseSessionDuringScans {
+		return c.withSession(func(session *pkcs11Session) error {
+			handles, err := findKeysWithAttributes(session, template)
+			if err != nil {
+				return err
+			}
+			return f(session, handles)
+		})
+	}
+
+	var handles []pkcs11.ObjectHandle
+	err := c.withSession(func(session *pkcs11Session) (err error) {
+		handles, err = findKeysWithAttributes(session, template)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for len(handles) > 0 {
+		batch := handles
+		if len(batch) > c.cfg.FindObjectsBatchSize {
+			batch = batch[:c.cfg.FindObjectsBatchSize]
+		}
+		handles = handles[len(batch):]
+
+		err = c.withSession(func(session *pkcs11Session) error {
+			return f(session, batch)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isObjectGone returns true if err shows that an object handle no longer refers to an object.
+func isObjectGone(err error) bool {
+	return isPKCS11Error(err, pkcs11.CKR_OBJECT_HANDLE_INVALID)
+}
+
 // Find key objects.  For asymmetric keys this only finds one half so
 // callers will call it twice. Returns nil if the key does not exist on the token.
 func findKeys(session *pkcs11Session, id []byte, label []byte, keyclass *uint, keytype *uint) (handles []pkcs11.ObjectHandle, err error) {
@@ -125,35 +258,14 @@ func (c *Context) makeKeyPair(session *pkcs11Session, privHandle *pkcs11.ObjectH
 
 	var pubHandle *pkcs11.ObjectHandle
 
-	// Find the public half which has a matching CKA_ID
+	// Find the public half which has a matching CKA_ID and CKA_LABEL. An empty label only matches public keys whose
+	// label is also empty.
+	if label == nil {
+		label = []byte{}
+	}
 	pubHandle, err = findKey(session, id, label, uintPtr(pkcs11.CKO_PUBLIC_KEY), &keyType)
 	if err != nil {
-		p11Err, ok := err.(pkcs11.Error)
-
-		if len(label) == 0 && ok && p11Err == pkcs11.CKR_TEMPLATE_INCONSISTENT {
-			// This probably means we are using a token that doesn't like us passing empty attributes in a template.
-			// For instance CloudHSM cannot search for a key with CKA_LABEL="". So if the private key doesn't have a
-			// label, we need to pass nil into findKeys, then match against the first key without a label.
-
-			pubHandles, err := findKeys(session, id, nil, uintPtr(pkcs11.CKO_PUBLIC_KEY), &keyType)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			for _, handle := range pubHandles {
-				template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil)}
-				template, err = session.ctx.GetAttributeValue(session.handle, handle, template)
-				if err != nil {
-					return nil, nil, err
-				}
-				if len(template[0].Value) == 0 {
-					pubHandle = &handle
-					break
-				}
-			}
-		} else {
-			return nil, nil, err
-		}
+		return nil, nil, err
 	}
 
 	if pubHandle == nil {
@@ -163,8 +275,9 @@ func (c *Context) makeKeyPair(session *pkcs11Session, privHandle *pkcs11.ObjectH
 
 	resultPkcs11PrivateKey := pkcs11PrivateKey{
 		pkcs11Object: pkcs11Object{
-			handle:  *privHandle,
-			context: c,
+			handle:   *privHandle,
+			context:  c,
+			archived: pool.NewAtomicBool(isArchivedLabel(label)),
 		},
 	}
 
@@ -174,6 +287,12 @@ func (c *Context) makeKeyPair(session *pkcs11Session, privHandle *pkcs11.ObjectH
 		pub = certificate.PublicKey
 	}
 
+	if pub == nil && pubHandle == nil && keyType == pkcs11.CKK_RSA {
+		// Some stacks (e.g. the OpenSSL engine) do not keep a public key object. RSA private key objects carry
+		// the modulus and public exponent, so we can still recover the public key.
+		pub, _, _ = c.keyPairRSAPublicKey(session, nil, *privHandle, id, label)
+	}
+
 	if pub == nil && pubHandle == nil {
 		// We can't return a Signer if we don't have private and public key. Treat it as an error.
 		return nil, nil, errNoPublicHalf
@@ -189,41 +308,122 @@ func (c *Context) makeKeyPair(session *pkcs11Session, privHandle *pkcs11.ObjectH
 			result.pkcs11PrivateKey.pubKeyHandle = *pubHandle
 		}
 
-		result.pkcs11PrivateKey.pubKey = pub
+		c.retainPublicKey(&result.pkcs11PrivateKey, pub)
+		c.pinKey(session, &result.pkcs11PrivateKey, pub)
 		return result, certificate, nil
 
 	case pkcs11.CKK_RSA:
 		result := &pkcs11PrivateKeyRSA{pkcs11PrivateKey: resultPkcs11PrivateKey}
+		fromPublicObject := false
 		if pubHandle != nil {
-			if pub, err = exportRSAPublicKey(session, *pubHandle); err != nil {
+			pub, fromPublicObject, err = c.keyPairRSAPublicKey(session, pubHandle, *privHandle, id, label)
+			if err != nil {
 				return nil, nil, err
 			}
 			result.pkcs11PrivateKey.pubKeyHandle = *pubHandle
 		}
 
-		result.pkcs11PrivateKey.pubKey = pub
+		if fromPublicObject || pubHandle == nil {
+			c.retainPublicKey(&result.pkcs11PrivateKey, pub)
+		} else {
+			// Re-reading the public key object would fail, so the copy is kept even if Config.ReleasePublicKeys is set.
+			c.keepPublicKey(&result.pkcs11PrivateKey, pub)
+		}
+		c.pinKey(session, &result.pkcs11PrivateKey, pub)
 		return result, certificate, nil
 
 	case pkcs11.CKK_ECDSA:
 		result := &pkcs11PrivateKeyECDSA{pkcs11PrivateKey: resultPkcs11PrivateKey}
 		if pubHandle != nil {
-			if pub, err = exportECDSAPublicKey(session, *pubHandle); err != nil {
+			pub, err = exportECDSAPublicKey(session, *pubHandle)
+			if err == errUnsupportedEllipticCurve {
+				// Tokens that predate PKCS#11 3.0 may store X25519 keys as CKK_EC.
+				if x25519, _ := exportX25519PublicKey(session, *pubHandle); x25519 != nil {
+					return c.makeX25519KeyPair(session, resultPkcs11PrivateKey, pubHandle, x25519, certificate)
+				}
+			}
+			if err != nil {
 				return nil, nil, err
 			}
 			result.pkcs11PrivateKey.pubKeyHandle = *pubHandle
 		}
 
-		result.pkcs11PrivateKey.pubKey = pub
+		c.retainPublicKey(&result.pkcs11PrivateKey, pub)
+		c.pinKey(session, &result.pkcs11PrivateKey, pub)
+		return result, certificate, nil
+
+	case ckkECEdwards:
+		// Ed25519 and Ed448 share the key type, so the curve is read from the private key.
+		ed448, err := edwardsKeyIsEd448(session, *privHandle)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pubHandle != nil {
+			if pub, err = exportEdwardsPublicKey(session, *pubHandle); err != nil {
+				return nil, nil, err
+			}
+			resultPkcs11PrivateKey.pubKeyHandle = *pubHandle
+		}
+
+		var result Signer = &pkcs11PrivateKeyEd25519{pkcs11PrivateKey: resultPkcs11PrivateKey}
+		if ed448 {
+			result = &pkcs11PrivateKeyEd448{pkcs11PrivateKey: resultPkcs11PrivateKey}
+		}
+		c.retainPublicKey(tokenKeyOf(result), pub)
+		c.pinKey(session, tokenKeyOf(result), pub)
 		return result, certificate, nil
 
+	case ckkECMontgomery:
+		if pubHandle != nil {
+			if pub, err = exportX25519PublicKey(session, *pubHandle); err != nil {
+				return nil, nil, err
+			}
+		}
+		return c.makeX25519KeyPair(session, resultPkcs11PrivateKey, pubHandle, pub, certificate)
+
 	default:
-		return nil, nil, errors.Errorf("unsupported key type: %X", keyType)
+		return nil, nil, fmt.Errorf("unsupported key type: %X", keyType)
+	}
+}
+
+// makeX25519KeyPair completes makeKeyPair for an X25519 key, whose public key pub has been read from pubHandle.
+func (c *Context) makeX25519KeyPair(session *pkcs11Session, key pkcs11PrivateKey, pubHandle *pkcs11.ObjectHandle,
+	pub crypto.PublicKey, certificate *x509.Certificate) (Signer, *x509.Certificate, error) {
+
+	result := &pkcs11PrivateKeyX25519{pkcs11PrivateKey: key}
+	if pubHandle != nil {
+		result.pkcs11PrivateKey.pubKeyHandle = *pubHandle
 	}
+	c.retainPublicKey(&result.pkcs11PrivateKey, pub)
+	c.pinKey(session, &result.pkcs11PrivateKey, pub)
+	return result, certificate, nil
+}
+
+// idLabelAttributes returns the search template for FindKeyPairs and FindKeys. At least one of id and label must be
+// non-nil.
+func idLabelAttributes(id []byte, label []byte) (AttributeSet, error) {
+	if id == nil && label == nil {
+		return nil, errors.New("id and label cannot both be nil")
+	}
+
+	attributes := NewAttributeSet()
+
+	if id != nil {
+		if err := attributes.Set(CkaId, id); err != nil {
+			return nil, err
+		}
+	}
+	if label != nil {
+		if err := attributes.Set(CkaLabel, label); err != nil {
+			return nil, err
+		}
+	}
+	return attributes, nil
 }
 
 // FindKeyPair retrieves a previously created asymmetric key pair, or nil if it cannot be found.
 //
-// At least one of id and label must be specified.
+// At least one of id and label must be specified. They are matched as described for FindKeyPairs.
 // Only private keys that have a non-empty CKA_ID will be found, as this is required to locate the matching public key.
 // If the private key is found, but the public key with a corresponding CKA_ID is not, the key is not returned
 // because we cannot implement crypto.Signer without the public key.
@@ -246,7 +446,8 @@ func (c *Context) FindKeyPair(id []byte, label []byte) (Signer, error) {
 
 // FindKeyPairs retrieves all matching asymmetric key pairs, or a nil slice if none can be found.
 //
-// At least one of id and label must be specified.
+// At least one of id and label must be specified. A nil id or label is ignored. An empty, non-nil id or label only
+// matches keys that have the attribute with a zero-length value; keys that lack the attribute do not match.
 // Only private keys that have a non-empty CKA_ID will be found, as this is required to locate the matching public key.
 // If the private key is found, but the public key with a corresponding CKA_ID is not, the key is not returned
 // because we cannot implement crypto.Signer without the public key.
@@ -255,23 +456,9 @@ func (c *Context) FindKeyPairs(id []byte, label []byte) (signer []Signer, err er
 		return nil, errClosed
 	}
 
-	if id == nil && label == nil {
-		return nil, errors.New("id and label cannot both be nil")
-	}
-
-	attributes := NewAttributeSet()
-
-	if id != nil {
-		err = attributes.Set(CkaId, id)
-		if err != nil {
-			return nil, err
-		}
-	}
-	if label != nil {
-		err = attributes.Set(CkaLabel, label)
-		if err != nil {
-			return nil, err
-		}
+	attributes, err := idLabelAttributes(id, label)
+	if err != nil {
+		return nil, err
 	}
 
 	return c.FindKeyPairsWithAttributes(attributes)
@@ -308,48 +495,74 @@ func (c *Context) FindKeyPairWithAttributes(attributes AttributeSet) (Signer, er
 // Only private keys that have a non-empty CKA_ID will be found, as this is required to locate the matching public key.
 // If the private key is found, but the public key with a corresponding CKA_ID is not, the key is not returned
 // because we cannot implement crypto.Signer without the public key.
+//
+// Archived key pairs are not returned, see FindKeyPairsWithOptions.
+//
+// On tokens whose VendorProfile may hide keys from the session, an error wrapping ErrKeyNotFound is returned instead of
+// a nil slice. This applies to the other functions that find key pairs by ID, label or attributes too.
 func (c *Context) FindKeyPairsWithAttributes(attributes AttributeSet) (signer []Signer, err error) {
 	if c.closed.Get() {
 		return nil, errClosed
 	}
 
+	signer, err = c.findKeyPairs(attributes, false)
+	if err == nil && len(signer) == 0 {
+		err = c.missingKeyError()
+	}
+	return signer, err
+}
+
+// findKeyPairs implements FindKeyPairsWithAttributes, including archived key pairs if includeArchived is true.
+func (c *Context) findKeyPairs(attributes AttributeSet, includeArchived bool) (signer []Signer, err error) {
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
 	var keys []Signer
 
 	if _, ok := attributes[CkaClass]; ok {
-		return nil, errors.Errorf("keypair attribute set must not contain CkaClass")
+		return nil, fmt.Errorf("keypair attribute set must not contain CkaClass")
 	}
 
-	err = c.withSession(func(session *pkcs11Session) error {
+	templates, err := c.archiveTemplates(attributes, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, template := range templates {
 		// Add the private key class to the template to find the private half
-		privAttributes := attributes.Copy()
+		privAttributes := template.Copy()
 		err = privAttributes.Set(CkaClass, pkcs11.CKO_PRIVATE_KEY)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		privHandles, err := findKeysWithAttributes(session, privAttributes.ToSlice())
-		if err != nil {
-			return err
-		}
+		err = c.scanObjects(privAttributes.ToSlice(), func(session *pkcs11Session, privHandles []pkcs11.ObjectHandle) error {
+			for _, privHandle := range privHandles {
+				k, _, err := c.makeKeyPair(session, &privHandle)
 
-		for _, privHandle := range privHandles {
-			k, _, err := c.makeKeyPair(session, &privHandle)
+				if err == errNoCkaId || err == errNoPublicHalf {
+					continue
+				}
+				if err != nil && c.cfg.ReleaseSessionDuringScans && isObjectGone(err) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if !includeArchived && Archived(k) {
+					continue
+				}
 
-			if err == errNoCkaId || err == errNoPublicHalf {
-				continue
-			}
-			if err != nil {
-				return err
+				keys = append(keys, k)
 			}
 
-			keys = append(keys, k)
-		}
+			return nil
+		})
 
-		return nil
-	})
-
-	if err != nil {
-		return nil, err
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return keys, nil
@@ -364,7 +577,11 @@ func (c *Context) FindAllKeyPairs() ([]Signer, error) {
 		return nil, errClosed
 	}
 
-	return c.FindKeyPairsWithAttributes(NewAttributeSet())
+	keys, err := c.FindKeyPairsWithAttributes(NewAttributeSet())
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	return keys, err
 }
 
 // Public returns the public half of a private key.
@@ -372,13 +589,21 @@ func (c *Context) FindAllKeyPairs() ([]Signer, error) {
 // This partially implements the go.crypto.Signer and go.crypto.Decrypter interfaces for
 // pkcs11PrivateKey. (The remains of the implementation is in the
 // key-specific types.)
-func (k pkcs11PrivateKey) Public() crypto.PublicKey {
-	return k.pubKey
+func (k *pkcs11PrivateKey) Public() crypto.PublicKey {
+	if k.pubKeyExport == nil {
+		return k.pubKey
+	}
+	pub, err := k.exportPublicKey()
+	if err != nil {
+		return nil
+	}
+	return pub
 }
 
 // FindKey retrieves a previously created symmetric key, or nil if it cannot be found.
 //
-// Either (but not both) of id and label may be nil, in which case they are ignored.
+// Either (but not both) of id and label may be nil, in which case they are ignored. An empty, non-nil id or label
+// only matches keys whose attribute is present and empty.
 func (c *Context) FindKey(id []byte, label []byte) (*SecretKey, error) {
 	if c.closed.Get() {
 		return nil, errClosed
@@ -398,29 +623,15 @@ func (c *Context) FindKey(id []byte, label []byte) (*SecretKey, error) {
 
 // FindKeys retrieves all matching symmetric keys, or a nil slice if none can be found.
 //
-// At least one of id and label must be specified.
+// At least one of id and label must be specified. They are matched as described for FindKey.
 func (c *Context) FindKeys(id []byte, label []byte) (key []*SecretKey, err error) {
 	if c.closed.Get() {
 		return nil, errClosed
 	}
 
-	if id == nil && label == nil {
-		return nil, errors.New("id and label cannot both be nil")
-	}
-
-	attributes := NewAttributeSet()
-
-	if id != nil {
-		err = attributes.Set(CkaId, id)
-		if err != nil {
-			return nil, err
-		}
-	}
-	if label != nil {
-		err = attributes.Set(CkaLabel, label)
-		if err != nil {
-			return nil, err
-		}
+	attributes, err := idLabelAttributes(id, label)
+	if err != nil {
+		return nil, err
 	}
 
 	return c.FindKeysWithAttributes(attributes)
@@ -445,44 +656,75 @@ func (c *Context) FindKeyWithAttributes(attributes AttributeSet) (*SecretKey, er
 }
 
 // FindKeysWithAttributes retrieves previously created symmetric keys, or a nil slice if none can be found.
+//
+// Archived keys are not returned, see FindKeysWithOptions.
+//
+// On tokens whose VendorProfile may hide keys from the session, an error wrapping ErrKeyNotFound is returned instead of
+// a nil slice. This applies to the other functions that find keys by ID, label or attributes too.
 func (c *Context) FindKeysWithAttributes(attributes AttributeSet) ([]*SecretKey, error) {
 	if c.closed.Get() {
 		return nil, errClosed
 	}
 
+	keys, err := c.findSecretKeys(attributes, false)
+	if err == nil && len(keys) == 0 {
+		err = c.missingKeyError()
+	}
+	return keys, err
+}
+
+// findSecretKeys implements FindKeysWithAttributes, including archived keys if includeArchived is true.
+func (c *Context) findSecretKeys(attributes AttributeSet, includeArchived bool) ([]*SecretKey, error) {
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
 	var keys []*SecretKey
 
 	if _, ok := attributes[CkaClass]; ok {
-		return nil, errors.Errorf("key attribute set must not contain CkaClass")
+		return nil, fmt.Errorf("key attribute set must not contain CkaClass")
 	}
 
-	err := c.withSession(func(session *pkcs11Session) error {
-		// Add the private key class to the template to find the private half
-		privAttributes := attributes.Copy()
-		err := privAttributes.Set(CkaClass, pkcs11.CKO_SECRET_KEY)
-		if err != nil {
-			return err
-		}
-
-		privHandles, err := findKeysWithAttributes(session, privAttributes.ToSlice())
-		if err != nil {
-			return err
-		}
+	templates, err := c.archiveTemplates(attributes, includeArchived)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, privHandle := range privHandles {
-			attributes := []*pkcs11.Attribute{
-				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, 0),
+	err = c.withSession(func(session *pkcs11Session) error {
+		for _, template := range templates {
+			// Add the private key class to the template to find the private half
+			privAttributes := template.Copy()
+			err := privAttributes.Set(CkaClass, pkcs11.CKO_SECRET_KEY)
+			if err != nil {
+				return err
 			}
-			if attributes, err = session.ctx.GetAttributeValue(session.handle, privHandle, attributes); err != nil {
+
+			privHandles, err := findKeysWithAttributes(session, privAttributes.ToSlice())
+			if err != nil {
 				return err
 			}
-			keyType := bytesToUlong(attributes[0].Value)
 
-			if cipher, ok := Ciphers[int(keyType)]; ok {
-				k := &SecretKey{pkcs11Object{privHandle, c}, cipher}
-				keys = append(keys, k)
-			} else {
-				return errors.Errorf("unsupported key type: %X", keyType)
+			for _, privHandle := range privHandles {
+				attributes := []*pkcs11.Attribute{
+					pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, 0),
+					pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+				}
+				if attributes, err = session.ctx.GetAttributeValue(session.handle, privHandle, attributes); err != nil {
+					return err
+				}
+				keyType := bytesToUlong(attributes[0].Value)
+				archived := isArchivedLabel(attributes[1].Value)
+				if archived && !includeArchived {
+					continue
+				}
+
+				if cipher, ok := Ciphers[int(keyType)]; ok {
+					k := newSecretKey(c, privHandle, cipher)
+					k.archived.Set(archived)
+					keys = append(keys, k)
+				} else {
+					return fmt.Errorf("unsupported key type: %X", keyType)
+				}
 			}
 		}
 
@@ -495,13 +737,34 @@ func (c *Context) FindKeysWithAttributes(attributes AttributeSet) ([]*SecretKey,
 	return keys, nil
 }
 
+// FindKeyOptions control the keys found by FindKeysWithOptions.
+type FindKeyOptions struct {
+	// IncludeArchived also finds archived keys, see Archive. A CKA_LABEL in the search matches archived keys by the
+	// label they had before they were archived.
+	IncludeArchived bool
+}
+
+// FindKeysWithOptions is FindKeysWithAttributes, with the keys found controlled by opts. A nil opts is the same as
+// FindKeysWithAttributes.
+func (c *Context) FindKeysWithOptions(attributes AttributeSet, opts *FindKeyOptions) ([]*SecretKey, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	return c.findSecretKeys(attributes, opts != nil && opts.IncludeArchived)
+}
+
 // FindAllKeyPairs retrieves all existing symmetric keys, or a nil slice if none can be found.
 func (c *Context) FindAllKeys() ([]*SecretKey, error) {
 	if c.closed.Get() {
 		return nil, errClosed
 	}
 
-	return c.FindKeysWithAttributes(NewAttributeSet())
+	keys, err := c.FindKeysWithAttributes(NewAttributeSet())
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	return keys, err
 }
 
 func uintPtr(i uint) *uint { return &i }
@@ -528,6 +791,83 @@ func (c *Context) getAttributes(handle pkcs11.ObjectHandle, attributes []Attribu
 	return values, err
 }
 
+// usageAttributes reads usage attributes of the key pair k, such as CKA_SIGN. Key pairs provisioned by other PKCS#11
+// stacks do not always have them on the private key object, so an attribute the private key object lacks is read
+// from the public key object, where some stacks put CKA_SIGN. An attribute neither object has is reported as true,
+// leaving the operation to the token, which applies its own default.
+func (c *Context) usageAttributes(k *pkcs11PrivateKey, attributes []AttributeType) (AttributeSet, error) {
+	var private, public AttributeSet
+	privateHandle, publicHandle := k.objectHandles()
+	err := c.withSession(func(session *pkcs11Session) (err error) {
+		if private, err = readPresentAttributes(session, privateHandle, attributes); err != nil {
+			return err
+		}
+
+		var missing []AttributeType
+		for _, a := range attributes {
+			if _, ok := private[a]; !ok {
+				missing = append(missing, a)
+			}
+		}
+		if len(missing) > 0 && publicHandle != 0 {
+			// The public key object is only a fallback, so failing to read it is not an error.
+			public, _ = readPresentAttributes(session, publicHandle, missing)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeUsageAttributes(attributes, private, public), nil
+}
+
+// mergeUsageAttributes combines usage attributes read from the private and public key objects of a key pair, see
+// usageAttributes.
+func mergeUsageAttributes(attributes []AttributeType, private, public AttributeSet) AttributeSet {
+	merged := NewAttributeSet()
+	for _, a := range attributes {
+		if value, ok := private[a]; ok {
+			merged[a] = value
+		} else if value, ok := public[a]; ok {
+			merged[a] = value
+		} else {
+			merged[a] = pkcs11.NewAttribute(a, true)
+		}
+	}
+	return merged
+}
+
+// readPresentAttributes reads the attributes of an object, leaving out those it does not have.
+func readPresentAttributes(session *pkcs11Session, handle pkcs11.ObjectHandle, attributes []AttributeType) (AttributeSet, error) {
+	template := make([]*pkcs11.Attribute, len(attributes))
+	for i, a := range attributes {
+		template[i] = pkcs11.NewAttribute(a, nil)
+	}
+
+	values := NewAttributeSet()
+	p11values, err := session.ctx.GetAttributeValue(session.handle, handle, template)
+	if err == nil {
+		values.AddIfNotPresent(p11values)
+		return values, nil
+	}
+	if e, ok := err.(pkcs11.Error); !ok || e != pkcs11.CKR_ATTRIBUTE_TYPE_INVALID {
+		return nil, err
+	}
+
+	// The token doesn't say which attributes are missing, so read them one at a time.
+	for _, a := range template {
+		p11values, err = session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{a})
+		if e, ok := err.(pkcs11.Error); ok && e == pkcs11.CKR_ATTRIBUTE_TYPE_INVALID {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values.AddIfNotPresent(p11values)
+	}
+	return values, nil
+}
+
 // GetAttributes gets the values of the specified attributes on the given key or keypair.
 // If the key is asymmetric, then the attributes are retrieved from the private half.
 //
@@ -541,15 +881,21 @@ func (c *Context) GetAttributes(key interface{}, attributes []AttributeType) (a
 
 	switch k := (key).(type) {
 	case *pkcs11PrivateKeyDSA:
-		handle = k.handle
+		handle, _ = k.objectHandles()
 	case *pkcs11PrivateKeyRSA:
-		handle = k.handle
+		handle, _ = k.objectHandles()
 	case *pkcs11PrivateKeyECDSA:
-		handle = k.handle
+		handle, _ = k.objectHandles()
+	case *pkcs11PrivateKeyEd25519:
+		handle, _ = k.objectHandles()
+	case *pkcs11PrivateKeyEd448:
+		handle, _ = k.objectHandles()
+	case *pkcs11PrivateKeyX25519:
+		handle, _ = k.objectHandles()
 	case *SecretKey:
 		handle = k.handle
 	default:
-		return nil, errors.Errorf("not a PKCS#11 key")
+		return nil, fmt.Errorf("not a PKCS#11 key")
 	}
 
 	return c.getAttributes(handle, attributes)
@@ -584,13 +930,19 @@ func (c *Context) GetPubAttributes(key interface{}, attributes []AttributeType)
 
 	switch k := (key).(type) {
 	case *pkcs11PrivateKeyDSA:
-		handle = k.pubKeyHandle
+		_, handle = k.objectHandles()
 	case *pkcs11PrivateKeyRSA:
-		handle = k.pubKeyHandle
+		_, handle = k.objectHandles()
 	case *pkcs11PrivateKeyECDSA:
-		handle = k.pubKeyHandle
+		_, handle = k.objectHandles()
+	case *pkcs11PrivateKeyEd25519:
+		_, handle = k.objectHandles()
+	case *pkcs11PrivateKeyEd448:
+		_, handle = k.objectHandles()
+	case *pkcs11PrivateKeyX25519:
+		_, handle = k.objectHandles()
 	default:
-		return nil, errors.Errorf("not an asymmetric PKCS#11 key")
+		return nil, fmt.Errorf("not an asymmetric PKCS#11 key")
 	}
 
 	return c.getAttributes(handle, attributes)
@@ -1,8 +1,11 @@
 package crypto11
 
 import (
+	"context"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"sync/atomic"
 	"testing"
 
 	"github.com/miekg/pkcs11"
@@ -11,9 +14,14 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-// withContext executes a test function with a context.
+// withContext executes a test function with a context. The context is configured with DebugStrictCleanup, so the
+// test fails if it leaks sessions or session objects.
 func withContext(t *testing.T, f func(ctx *Context)) {
-	ctx, err := ConfigureFromFile("config")
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.DebugStrictCleanup = true
+
+	ctx, err := Configure(config)
 	require.NoError(t, err)
 
 	defer func() {
@@ -221,3 +229,244 @@ func TestGettingUnsupportedKeyTypeAttributes(t *testing.T) {
 		require.Error(t, err)
 	})
 }
+
+func TestMergeUsageAttributes(t *testing.T) {
+	usage := []AttributeType{CkaSign, CkaDecrypt, CkaUnwrap}
+
+	// CKA_SIGN only on the public key object, as some stacks store it; CKA_DECRYPT on neither object
+	private := NewAttributeSet()
+	private.AddIfNotPresent([]*pkcs11.Attribute{pkcs11.NewAttribute(CkaUnwrap, false)})
+	public := NewAttributeSet()
+	public.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(CkaSign, true),
+		pkcs11.NewAttribute(CkaUnwrap, true),
+	})
+
+	merged := mergeUsageAttributes(usage, private, public)
+	require.Len(t, merged, len(usage))
+	assert.Equal(t, []byte{1}, merged[CkaSign].Value)
+	assert.Equal(t, []byte{1}, merged[CkaDecrypt].Value)
+	// The private key object takes precedence
+	assert.Equal(t, []byte{0}, merged[CkaUnwrap].Value)
+
+	merged = mergeUsageAttributes(usage, nil, nil)
+	require.Len(t, merged, len(usage))
+	for _, a := range usage {
+		assert.Equal(t, []byte{1}, merged[a].Value)
+	}
+}
+
+func TestScanObjectsReleasesSession(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+
+	// A pool of one session, so signing has to wait whenever a scan holds it.
+	config.MaxSessions = 2
+	config.FindObjectsBatchSize = 5
+	config.ReleaseSessionDuringScans = true
+	config.PoolWaitTimeout = 0
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	const keyCount = 40
+	label := randomBytes()
+	var keys []Signer
+	for i := 0; i < keyCount; i++ {
+		key, err := ctx.GenerateECDSAKeyPairWithLabel(randomBytes(), label, elliptic.P256())
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+	defer func() {
+		for _, key := range keys {
+			_ = key.Delete()
+		}
+	}()
+
+	template := NewAttributeSet()
+	require.NoError(t, template.Set(CkaLabel, label))
+	require.NoError(t, template.Set(CkaClass, pkcs11.CKO_PRIVATE_KEY))
+
+	batches := 0
+	err = ctx.scanObjects(template.ToSlice(), func(session *pkcs11Session, handles []pkcs11.ObjectHandle) error {
+		assert.True(t, len(handles) <= config.FindObjectsBatchSize)
+		batches++
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, keyCount/config.FindObjectsBatchSize, batches)
+
+	// Block the scan in its first batch until another goroutine is waiting for the only session. Once the batch
+	// returns its session, the waiting goroutine obtains it before the scan takes it back for the next batch.
+	waiting := make(chan struct{})
+	obtained := make(chan error, 1)
+	obtainedFirst := false
+	batches = 0
+	err = ctx.scanObjects(template.ToSlice(), func(session *pkcs11Session, handles []pkcs11.ObjectHandle) error {
+		batches++
+		switch batches {
+		case 1:
+			go func() {
+				waitCtx := &waitingContext{Context: context.Background(), waiting: waiting}
+				obtained <- ctx.withSessionContext(waitCtx, func(session *pkcs11Session) error { return nil })
+			}()
+			<-waiting
+		case 2:
+			select {
+			case err := <-obtained:
+				assert.NoError(t, err)
+				obtainedFirst = true
+			default:
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, keyCount/config.FindObjectsBatchSize, batches)
+	assert.True(t, obtainedFirst, "the session was not released between batches")
+}
+
+// waitingContext closes waiting when Done is called a second time. The pool calls Done once before fetching a
+// session, and again only when it has found no free session and waits for one, see noWaitContext.
+type waitingContext struct {
+	context.Context
+	calls   int32
+	waiting chan struct{}
+}
+
+func (c *waitingContext) Done() <-chan struct{} {
+	if atomic.AddInt32(&c.calls, 1) == 2 {
+		close(c.waiting)
+	}
+	return c.Context.Done()
+}
+
+func TestSplitEmptyAttributes(t *testing.T) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, []byte{}),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte("id")),
+		pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, []byte{}),
+	}
+
+	remaining, empty := splitEmptyAttributes(template)
+	assert.Equal(t, []*pkcs11.Attribute{template[0], template[2], template[3]}, remaining)
+	assert.Equal(t, []uint{pkcs11.CKA_LABEL}, empty)
+}
+
+func TestFindingKeysWithEmptyLabel(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		pair, err := ctx.GenerateECDSAKeyPairWithLabel(id, []byte{}, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = pair.Delete() }()
+
+		secretID := randomBytes()
+		secret, err := ctx.GenerateSecretKeyWithLabel(secretID, []byte{}, 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = secret.Delete() }()
+
+		labelled, err := ctx.GenerateSecretKeyWithLabel(secretID, randomBytes(), 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = labelled.Delete() }()
+
+		// The public half is found even though the label is empty
+		found, err := ctx.FindKeyPair(id, []byte{})
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, pair.Public(), found.Public())
+
+		// An empty label only matches keys whose label is empty...
+		keys, err := ctx.FindKeys(secretID, []byte{})
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		assert.Equal(t, secret.handle, keys[0].handle)
+
+		// ...whereas a nil label is ignored
+		keys, err = ctx.FindKeys(secretID, nil)
+		require.NoError(t, err)
+		assert.Len(t, keys, 2)
+
+		// Every key pair found by an empty label alone has an empty label
+		pairs, err := ctx.FindKeyPairs(nil, []byte{})
+		require.NoError(t, err)
+		require.NotEmpty(t, pairs)
+		for _, p := range pairs {
+			attributes, err := ctx.GetAttributes(p, []AttributeType{CkaLabel})
+			require.NoError(t, err)
+			assert.Empty(t, attributes[CkaLabel].Value)
+		}
+	})
+}
+
+// TestFindObjectsOnePerCall simulates a module that returns at most one object per C_FindObjects call, however
+// many are requested. Searches must still find every matching object.
+func TestFindObjectsOnePerCall(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.CollectCallTimings = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+	ctx.findObjectsLimit = 1
+
+	const keyCount = 3
+	label := randomBytes()
+	ids := make(map[string]bool)
+	for i := 0; i < keyCount; i++ {
+		id := randomBytes()
+		ids[string(id)] = true
+
+		pair, err := ctx.GenerateECDSAKeyPairWithLabel(id, label, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = pair.Delete() }()
+
+		secret, err := ctx.GenerateSecretKeyWithLabel(randomBytes(), label, 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = secret.Delete() }()
+
+		if !shouldSkipTest(skipTestCert) {
+			require.NoError(t, ctx.ImportCertificate(id, generateCertForSigner(t, pair, id)))
+			defer func() { _ = ctx.DeleteCertificate(id, nil, nil) }()
+		}
+	}
+
+	pairs, err := ctx.FindKeyPairs(nil, label)
+	require.NoError(t, err)
+	assert.Len(t, pairs, keyCount)
+
+	keys, err := ctx.FindKeys(nil, label)
+	require.NoError(t, err)
+	assert.Len(t, keys, keyCount)
+
+	template := NewAttributeSet()
+	require.NoError(t, template.Set(CkaLabel, label))
+	pairs, err = ctx.FindKeyPairsWithAttributes(template)
+	require.NoError(t, err)
+	assert.Len(t, pairs, keyCount)
+
+	keys, err = ctx.FindKeysWithAttributes(template)
+	require.NoError(t, err)
+	assert.Len(t, keys, keyCount)
+
+	if !shouldSkipTest(skipTestCert) {
+		certificates, err := ctx.FindAllPairedCertificates()
+		require.NoError(t, err)
+		found := 0
+		for _, certificate := range certificates {
+			if ids[string(certificate.Leaf.SubjectKeyId)] {
+				found++
+			}
+		}
+		assert.Equal(t, keyCount, found)
+	}
+
+	// Each search of keyCount objects took at least keyCount+1 calls, the last returning nothing.
+	for _, timing := range ctx.CallTimings() {
+		if timing.Function == CallFindObjects {
+			assert.True(t, timing.Count() > 4*(keyCount+1), "%d calls", timing.Count())
+		}
+	}
+}
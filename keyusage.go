@@ -0,0 +1,225 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// KeyUsageError is returned by the cipher, block mode and HMAC constructors of SecretKey if the key cannot be used
+// for the requested operation, so that misconfigured keys are reported when the constructor is called rather than on
+// first use. It is also returned by the operations of key pairs made by GenerateRSAKeyPairWithOptions that fall
+// outside the usage they were generated with.
+type KeyUsageError struct {
+	// Label is the CKA_LABEL of the key, if it has one.
+	Label []byte
+
+	// Operation names the operation that was requested, such as "GCM" or "CBC encryption".
+	Operation string
+
+	// Reason describes what is wrong with the key.
+	Reason string
+}
+
+func (e *KeyUsageError) Error() string {
+	if len(e.Label) == 0 {
+		return fmt.Sprintf("key cannot be used for %s: %s", e.Operation, e.Reason)
+	}
+	return fmt.Sprintf("key '%s' cannot be used for %s: %s", e.Label, e.Operation, e.Reason)
+}
+
+// secretKeyTypeNames holds the names of the secret key types, for error messages.
+var secretKeyTypeNames = map[uint]string{
+	pkcs11.CKK_AES:            "CKK_AES",
+	pkcs11.CKK_DES3:           "CKK_DES3",
+	pkcs11.CKK_GENERIC_SECRET: "CKK_GENERIC_SECRET",
+	pkcs11.CKK_SHA_1_HMAC:     "CKK_SHA_1_HMAC",
+	pkcs11.CKK_SHA224_HMAC:    "CKK_SHA224_HMAC",
+	pkcs11.CKK_SHA256_HMAC:    "CKK_SHA256_HMAC",
+	pkcs11.CKK_SHA384_HMAC:    "CKK_SHA384_HMAC",
+	pkcs11.CKK_SHA512_HMAC:    "CKK_SHA512_HMAC",
+}
+
+func secretKeyTypeName(keyType uint) string {
+	if name, ok := secretKeyTypeNames[keyType]; ok {
+		return name
+	}
+	return fmt.Sprintf("key type %#x", keyType)
+}
+
+// aesKeyLengths are the valid CKA_VALUE_LEN values for an AES key.
+var aesKeyLengths = map[int]bool{16: true, 24: true, 32: true}
+
+// secretKeyUsage holds the attributes of a secret key that the constructors check.
+type secretKeyUsage struct {
+	label    []byte
+	keyType  uint
+	valueLen int // zero if the token does not report CKA_VALUE_LEN
+	encrypt  bool
+	decrypt  bool
+	sign     bool
+}
+
+// secretKeyUsageCache holds the secretKeyUsage of a SecretKey once it has been read successfully.
+type secretKeyUsageCache struct {
+	mutex sync.Mutex
+	usage *secretKeyUsage
+}
+
+// newSecretKey returns a SecretKey for the object handle.
+func newSecretKey(c *Context, handle pkcs11.ObjectHandle, cipher *SymmetricCipher) *SecretKey {
+	return &SecretKey{pkcs11Object: pkcs11Object{handle: handle, context: c}, Cipher: cipher,
+		usage: &secretKeyUsageCache{}}
+}
+
+// keyUsage returns the usage attributes of the key, reading them from the token the first time. The attributes are
+// read one at a time, as CKA_VALUE_LEN in particular is not defined for every key type.
+func (key *SecretKey) keyUsage() (*secretKeyUsage, error) {
+	if key.usage != nil {
+		key.usage.mutex.Lock()
+		defer key.usage.mutex.Unlock()
+		if key.usage.usage != nil {
+			return key.usage.usage, nil
+		}
+	}
+
+	usage := &secretKeyUsage{}
+	err := key.withSession(func(session *pkcs11Session) error {
+		read := func(t uint) ([]byte, error) {
+			values, err := session.ctx.GetAttributeValue(session.handle, key.handle, []*pkcs11.Attribute{
+				pkcs11.NewAttribute(t, nil),
+			})
+			if err != nil {
+				return nil, err
+			}
+			return values[0].Value, nil
+		}
+
+		value, err := read(pkcs11.CKA_KEY_TYPE)
+		if err != nil {
+			return err
+		}
+		usage.keyType = bytesToUlong(value)
+
+		usage.label, _ = read(pkcs11.CKA_LABEL)
+		if value, err = read(pkcs11.CKA_VALUE_LEN); err == nil {
+			usage.valueLen = int(bytesToUlong(value))
+		}
+
+		for _, flag := range []struct {
+			t     uint
+			value *bool
+		}{
+			{pkcs11.CKA_ENCRYPT, &usage.encrypt},
+			{pkcs11.CKA_DECRYPT, &usage.decrypt},
+			{pkcs11.CKA_SIGN, &usage.sign},
+		} {
+			// An attribute that cannot be read is taken to be true, leaving the decision to the token. Some tokens,
+			// such as CloudHSM, do not support every usage attribute on every key.
+			value, err := read(flag.t)
+			*flag.value = err != nil || len(value) == 0 || value[0] != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, withMessage(err, "failed to read key attributes")
+	}
+
+	if key.usage != nil {
+		key.usage.usage = usage
+	}
+	return usage, nil
+}
+
+// checkCipherUsage checks that the key can be used with mech, a mechanism of key.Cipher, for operation. encrypt and
+// decrypt say whether the operation needs CKA_ENCRYPT or CKA_DECRYPT; if both are true, either will do.
+func (key *SecretKey) checkCipherUsage(operation string, mech uint, encrypt, decrypt bool) error {
+	if err := key.checkArchived(operation); err != nil {
+		return err
+	}
+	usage, err := key.keyUsage()
+	if err != nil {
+		return err
+	}
+
+	fail := func(format string, args ...interface{}) error {
+		return &KeyUsageError{Label: usage.label, Operation: operation, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	if mech == 0 {
+		return fail("key is %s, which does not support %s", secretKeyTypeName(usage.keyType), operation)
+	}
+	if !key.Cipher.hasKeyType(usage.keyType) {
+		if len(key.Cipher.GenParams) == 0 {
+			return fail("key is %s", secretKeyTypeName(usage.keyType))
+		}
+		return fail("key is %s; %s requires %s", secretKeyTypeName(usage.keyType), operation,
+			secretKeyTypeName(key.Cipher.GenParams[0].KeyType))
+	}
+	if usage.keyType == pkcs11.CKK_AES && usage.valueLen != 0 && !aesKeyLengths[usage.valueLen] {
+		return fail("CKA_VALUE_LEN is %d, not a valid AES key length", usage.valueLen)
+	}
+
+	switch {
+	case encrypt && decrypt:
+		if !usage.encrypt && !usage.decrypt {
+			return fail("key lacks CKA_ENCRYPT and CKA_DECRYPT")
+		}
+	case encrypt:
+		if !usage.encrypt {
+			return fail("key lacks CKA_ENCRYPT")
+		}
+	case decrypt:
+		if !usage.decrypt {
+			return fail("key lacks CKA_DECRYPT")
+		}
+	}
+	return nil
+}
+
+// checkSignUsage checks that the key can be used for MAC operations.
+func (key *SecretKey) checkSignUsage(operation string) error {
+	if err := key.checkArchived(operation); err != nil {
+		return err
+	}
+	usage, err := key.keyUsage()
+	if err != nil {
+		return err
+	}
+	if !usage.sign {
+		return &KeyUsageError{Label: usage.label, Operation: operation, Reason: "key lacks CKA_SIGN"}
+	}
+	return nil
+}
+
+// hasKeyType returns true if keyType is one of the key types of the cipher.
+func (cipher *SymmetricCipher) hasKeyType(keyType uint) bool {
+	for _, params := range cipher.GenParams {
+		if params.KeyType == keyType {
+			return true
+		}
+	}
+	return false
+}
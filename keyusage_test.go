@@ -0,0 +1,84 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyUsageErrorMessage(t *testing.T) {
+	err := &KeyUsageError{Label: []byte("dek-7"), Operation: "GCM", Reason: "key is CKK_DES3; GCM requires CKK_AES"}
+	assert.Equal(t, "key 'dek-7' cannot be used for GCM: key is CKK_DES3; GCM requires CKK_AES", err.Error())
+
+	err = &KeyUsageError{Operation: "CBC encryption", Reason: "key lacks CKA_ENCRYPT"}
+	assert.Equal(t, "key cannot be used for CBC encryption: key lacks CKA_ENCRYPT", err.Error())
+
+	assert.Equal(t, "CKK_DES3", secretKeyTypeName(pkcs11.CKK_DES3))
+	assert.Equal(t, "key type 0x1234", secretKeyTypeName(0x1234))
+}
+
+func TestSymmetricCipherHasKeyType(t *testing.T) {
+	assert.True(t, CipherAES.hasKeyType(pkcs11.CKK_AES))
+	assert.False(t, CipherAES.hasKeyType(pkcs11.CKK_DES3))
+}
+
+func TestConstructorsCheckKeyUsage(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		label := []byte("dek-7")
+
+		des3, err := ctx.GenerateSecretKeyWithLabel(randomBytes(), label, 0, CipherDES3)
+		require.NoError(t, err)
+		defer func() { _ = des3.Delete() }()
+
+		var usageErr *KeyUsageError
+		_, err = des3.NewGCM()
+		require.True(t, errors.As(err, &usageErr), "unexpected error %v", err)
+		assert.Equal(t, label, usageErr.Label)
+		assert.Equal(t, "GCM", usageErr.Operation)
+
+		template, err := NewAttributeSetWithIDAndLabel(randomBytes(), label)
+		require.NoError(t, err)
+		require.NoError(t, template.Set(CkaEncrypt, false))
+		decryptOnly, err := ctx.GenerateSecretKeyWithAttributes(template, 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = decryptOnly.Delete() }()
+
+		iv := make([]byte, decryptOnly.BlockSize())
+		_, err = decryptOnly.NewCBCEncrypterCloser(iv)
+		require.True(t, errors.As(err, &usageErr), "unexpected error %v", err)
+		assert.Equal(t, "key lacks CKA_ENCRYPT", usageErr.Reason)
+
+		decrypter, err := decryptOnly.NewCBCDecrypterCloser(iv)
+		require.NoError(t, err)
+		decrypter.Close()
+
+		// AES keys are generated without CKA_SIGN
+		_, err = decryptOnly.NewHMAC(pkcs11.CKM_SHA256_HMAC, 0)
+		require.True(t, errors.As(err, &usageErr), "unexpected error %v", err)
+		assert.Equal(t, "key lacks CKA_SIGN", usageErr.Reason)
+	})
+}
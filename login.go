@@ -0,0 +1,119 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/pkcs11"
+)
+
+// loginMode records how a token shares login state between the sessions of an application.
+type loginMode int32
+
+const (
+	// loginModeUnknown means the next new session must try to log in to find out.
+	loginModeUnknown loginMode = iota
+
+	// loginModeShared means C_Login on a new session returned CKR_USER_ALREADY_LOGGED_IN, so sessions share the
+	// login of the long-term session, as PKCS#11 requires.
+	loginModeShared
+
+	// loginModePerSession means C_Login on a new session succeeded, so each session must log in itself.
+	loginModePerSession
+)
+
+// sessionLogin logs in the sessions created by the pool. PKCS#11 says the login state is shared by all the sessions
+// an application has with a token, but some modules require each new session to log in, while others return
+// CKR_USER_ALREADY_LOGGED_IN if it does. New sessions therefore try to log in until the token's behaviour is known,
+// and then only if the token needs it. If an operation fails with CKR_USER_NOT_LOGGED_IN, for instance because an
+// administrator logged the application out, the behaviour is forgotten so that the replacement session logs in.
+type sessionLogin struct {
+	// mode is the observed loginMode, accessed atomically.
+	mode int32
+
+	// enabled is true if the Context logs in, see shouldLogin.
+	enabled bool
+
+	// login calls C_Login on a session. It is replaced by tests to simulate token behaviour.
+	login func(session pkcs11.SessionHandle) error
+}
+
+// reset forgets the observed behaviour and records whether sessions are logged in at all.
+func (l *sessionLogin) reset(enabled bool) {
+	l.enabled = enabled
+	l.setMode(loginModeUnknown)
+}
+
+func (l *sessionLogin) getMode() loginMode {
+	return loginMode(atomic.LoadInt32(&l.mode))
+}
+
+func (l *sessionLogin) setMode(mode loginMode) {
+	atomic.StoreInt32(&l.mode, int32(mode))
+}
+
+// loginNew logs in a newly opened session, unless the token is known to share the login of the long-term session.
+// CKR_USER_ALREADY_LOGGED_IN counts as success. Every attempt updates the observed behaviour, so a wrong guess
+// corrects itself.
+func (l *sessionLogin) loginNew(session pkcs11.SessionHandle) error {
+	if !l.enabled || l.getMode() == loginModeShared {
+		return nil
+	}
+
+	err := l.login(session)
+	switch {
+	case err == nil:
+		l.setMode(loginModePerSession)
+	case isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN):
+		l.setMode(loginModeShared)
+	default:
+		return err
+	}
+	return nil
+}
+
+// observe forgets the observed behaviour if err shows a session is no longer logged in.
+func (l *sessionLogin) observe(err error) {
+	if isPKCS11Error(err, pkcs11.CKR_USER_NOT_LOGGED_IN) {
+		l.setMode(loginModeUnknown)
+	}
+}
+
+// SessionSetupFunc completes the set-up of a newly opened session, see Config.SessionSetup.
+type SessionSetupFunc func(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, slot uint) error
+
+// setupSession calls Config.SessionSetup, if it is set, on a newly opened session.
+func (c *Context) setupSession(session pkcs11.SessionHandle) error {
+	if c.cfg.SessionSetup == nil {
+		return nil
+	}
+	return c.cfg.SessionSetup(c.ctx, session, c.slot)
+}
+
+// login calls C_Login on session as the configured user type, with the current PIN.
+func (c *Context) login(session pkcs11.SessionHandle) error {
+	c.pinLock.RLock()
+	defer c.pinLock.RUnlock()
+
+	return c.ctx.Login(session, c.loginUserType(), c.cfg.Pin)
+}
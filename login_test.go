@@ -0,0 +1,226 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLogin simulates the C_Login behaviour of a module, counting calls.
+type fakeLogin struct {
+	calls  int
+	result error
+}
+
+func (f *fakeLogin) login(pkcs11.SessionHandle) error {
+	f.calls++
+	return f.result
+}
+
+func newFakeSessionLogin(result error) (*sessionLogin, *fakeLogin) {
+	fake := &fakeLogin{result: result}
+	l := &sessionLogin{login: fake.login}
+	l.reset(true)
+	return l, fake
+}
+
+func TestSessionLoginPerSession(t *testing.T) {
+	// The module accepts C_Login on every session, so every new session must log in.
+	l, fake := newFakeSessionLogin(nil)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.loginNew(pkcs11.SessionHandle(i)))
+	}
+	assert.Equal(t, 3, fake.calls)
+	assert.Equal(t, loginModePerSession, l.getMode())
+}
+
+func TestSessionLoginShared(t *testing.T) {
+	// The module shares the long-term session's login, so only the first new session tries.
+	l, fake := newFakeSessionLogin(pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.loginNew(pkcs11.SessionHandle(i)))
+	}
+	assert.Equal(t, 1, fake.calls)
+	assert.Equal(t, loginModeShared, l.getMode())
+}
+
+func TestSessionLoginAfterLogout(t *testing.T) {
+	l, fake := newFakeSessionLogin(pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN))
+	require.NoError(t, l.loginNew(1))
+	require.NoError(t, l.loginNew(2))
+	assert.Equal(t, 1, fake.calls)
+
+	// Errors other than CKR_USER_NOT_LOGGED_IN say nothing about the login state.
+	l.observe(nil)
+	l.observe(errInjected)
+	l.observe(pkcs11.Error(pkcs11.CKR_SIGNATURE_INVALID))
+	assert.Equal(t, loginModeShared, l.getMode())
+
+	// An administrator logs the application out. The replacement session logs in again, which restores the
+	// shared login, and the next session finds it already logged in.
+	l.observe(pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN))
+	assert.Equal(t, loginModeUnknown, l.getMode())
+	fake.result = nil
+	require.NoError(t, l.loginNew(3))
+	assert.Equal(t, 2, fake.calls)
+
+	fake.result = pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)
+	require.NoError(t, l.loginNew(4))
+	require.NoError(t, l.loginNew(5))
+	assert.Equal(t, 3, fake.calls)
+	assert.Equal(t, loginModeShared, l.getMode())
+}
+
+func TestSessionLoginFailures(t *testing.T) {
+	l, fake := newFakeSessionLogin(pkcs11.Error(pkcs11.CKR_PIN_INCORRECT))
+	err := l.loginNew(1)
+	assert.True(t, isPKCS11Error(err, pkcs11.CKR_PIN_INCORRECT), "%v", err)
+	assert.Equal(t, loginModeUnknown, l.getMode())
+
+	// Contexts which do not log in never log in new sessions.
+	l.reset(false)
+	assert.NoError(t, l.loginNew(2))
+	assert.Equal(t, 1, fake.calls)
+}
+
+func TestPoolSessionLogin(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	fake := &fakeLogin{result: pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)}
+	ctx.sessionLogin.login = fake.login
+
+	// The first new session finds the login shared, so a replacement for a failed session does not log in.
+	require.Error(t, ctx.withSession(func(*pkcs11Session) error { return errInjected }))
+	require.NoError(t, ctx.withSession(func(*pkcs11Session) error { return nil }))
+	assert.Equal(t, 1, fake.calls)
+	assert.Equal(t, loginModeShared, ctx.sessionLogin.getMode())
+
+	// A session that finds the application logged out is discarded, and its replacement logs in.
+	err = ctx.withSession(func(*pkcs11Session) error { return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN) })
+	require.Error(t, err)
+	require.NoError(t, ctx.withSession(func(*pkcs11Session) error { return nil }))
+	assert.Equal(t, 2, fake.calls)
+
+	// A module that rejects the login fails the new session.
+	ctx.sessionLogin.observe(pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN))
+	fake.result = pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	err = ctx.withSession(func(*pkcs11Session) error { return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN) })
+	require.Error(t, err)
+	err = ctx.withSession(func(*pkcs11Session) error { return nil })
+	assert.True(t, isPKCS11Error(err, pkcs11.CKR_PIN_INCORRECT), "%v", err)
+}
+
+func TestPoolSessionLoginOnToken(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		require.NoError(t, ctx.withSession(func(*pkcs11Session) error { return nil }))
+		assert.NotEqual(t, loginModeUnknown, ctx.sessionLogin.getMode())
+	})
+}
+
+// sessionSetupRecorder counts the sessions passed to Config.SessionSetup, and fails them once fail is set.
+type sessionSetupRecorder struct {
+	calls int32
+	slot  uint
+	fail  atomic.Value
+}
+
+func (r *sessionSetupRecorder) setup(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, slot uint) error {
+	atomic.AddInt32(&r.calls, 1)
+	r.slot = slot
+	if err, ok := r.fail.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func TestSessionSetup(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	recorder := &sessionSetupRecorder{}
+	config.SessionSetup = recorder.setup
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	// The long-term session has been set up.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&recorder.calls))
+	assert.Equal(t, ctx.slot, recorder.slot)
+	assert.Equal(t, "callback", ctx.EffectiveConfig().Callbacks["SessionSetup"])
+
+	require.NoError(t, ctx.withSession(func(*pkcs11Session) error { return nil }))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&recorder.calls))
+
+	// A failed session is replaced by a new one, which is set up too, and setup failures fail the new session.
+	handshakeFailed := errors.New("vendor handshake failed")
+	recorder.fail.Store(handshakeFailed)
+	require.Error(t, ctx.withSession(func(*pkcs11Session) error { return errInjected }))
+	err = ctx.withSession(func(*pkcs11Session) error { return nil })
+	assert.True(t, errors.Is(err, handshakeFailed), "%v", err)
+	assert.Contains(t, err.Error(), "failed to set up new session")
+}
+
+func TestSessionSetupFailsConfigure(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	handshakeFailed := errors.New("vendor handshake failed")
+	config.SessionSetup = func(*pkcs11.Ctx, pkcs11.SessionHandle, uint) error { return handshakeFailed }
+
+	_, err = Configure(config)
+	assert.True(t, errors.Is(err, handshakeFailed), "%v", err)
+	assert.Contains(t, err.Error(), "failed to set up long term session")
+}
+
+func TestSessionSetupReplacesLogin(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	pin := config.Pin
+	config.Pin = ""
+	config.SessionSetupReplacesLogin = true
+	config.SessionSetup = func(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, slot uint) error {
+		err := ctx.Login(session, pkcs11.CKU_USER, pin)
+		if isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return nil
+		}
+		return err
+	}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+	assert.Equal(t, "sessionSetup", ctx.EffectiveConfig().PinSource)
+
+	key, err := ctx.GenerateSecretKey(randomBytes(), 128, CipherAES)
+	require.NoError(t, err)
+	require.NoError(t, key.Delete())
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// MechanismOperation is the operation a MechanismProfile applies to.
+type MechanismOperation int
+
+const (
+	// MechanismSign profiles replace the mechanism used by the Sign method of a key pair.
+	MechanismSign MechanismOperation = iota + 1
+
+	// MechanismDecrypt profiles replace the mechanism used by the Decrypt method of an RSA key pair.
+	MechanismDecrypt
+)
+
+// MechanismProfile names a mechanism, typically a vendor-defined one, so that configuration can select it for a
+// key pair without code changes. See Config.MechanismProfiles and Context.FindKeyPairWithMechanismProfile.
+type MechanismProfile struct {
+	// Name identifies the profile.
+	Name string
+
+	// Mechanism is the CKM_ value of the mechanism.
+	Mechanism uint
+
+	// ParametersHex and ParametersBase64 hold the mechanism parameter, hex or base64 encoded. At most one may be
+	// set. If neither is set, the mechanism has no parameter.
+	ParametersHex    string
+	ParametersBase64 string
+
+	// Operation is the operation the profile applies to, "sign" or "decrypt" in JSON.
+	Operation MechanismOperation
+}
+
+// mechanismProfile is a validated MechanismProfile.
+type mechanismProfile struct {
+	name       string
+	mechanism  uint
+	parameters []byte
+	operation  MechanismOperation
+}
+
+// newMechanismProfiles validates profiles and returns them indexed by name.
+func newMechanismProfiles(profiles []MechanismProfile) (map[string]*mechanismProfile, error) {
+	result := make(map[string]*mechanismProfile, len(profiles))
+
+	for _, p := range profiles {
+		if p.Name == "" {
+			return nil, errors.New("mechanism profile has no name")
+		}
+		if _, ok := result[p.Name]; ok {
+			return nil, fmt.Errorf("mechanism profile %q is defined more than once", p.Name)
+		}
+		if p.Operation != MechanismSign && p.Operation != MechanismDecrypt {
+			return nil, fmt.Errorf("mechanism profile %q has unknown operation %v", p.Name, p.Operation)
+		}
+
+		var parameters []byte
+		var err error
+		switch {
+		case p.ParametersHex != "" && p.ParametersBase64 != "":
+			return nil, fmt.Errorf("mechanism profile %q sets both ParametersHex and ParametersBase64", p.Name)
+		case p.ParametersHex != "":
+			parameters, err = hex.DecodeString(p.ParametersHex)
+		case p.ParametersBase64 != "":
+			parameters, err = base64.StdEncoding.DecodeString(p.ParametersBase64)
+		}
+		if err != nil {
+			return nil, withMessagef(err, "mechanism profile %q has invalid parameters", p.Name)
+		}
+
+		result[p.Name] = &mechanismProfile{
+			name:       p.Name,
+			mechanism:  p.Mechanism,
+			parameters: parameters,
+			operation:  p.Operation,
+		}
+	}
+
+	return result, nil
+}
+
+// pkcs11Mechanism returns the mechanism to pass to the token.
+func (p *mechanismProfile) pkcs11Mechanism() []*pkcs11.Mechanism {
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(p.mechanism, p.parameters)}
+}
+
+// FindKeyPairWithMechanismProfile retrieves a previously created asymmetric key pair, as for FindKeyPair, and
+// makes it use the named profile from Config.MechanismProfiles. A MechanismSign profile replaces the
+// mechanism used by Sign, which then passes the digest to the token unchanged and returns the signature exactly as
+// the token produced it; opts is ignored. A MechanismDecrypt profile does the same for Decrypt, which is only
+// available for RSA key pairs.
+//
+// An error naming the profile is returned if it is not defined. If the key pair cannot be found, nil is returned.
+func (c *Context) FindKeyPairWithMechanismProfile(id []byte, label []byte, profile string) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	p, ok := c.mechanismProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown mechanism profile %q", profile)
+	}
+
+	key, err := c.FindKeyPair(id, label)
+	if err != nil || key == nil {
+		return nil, err
+	}
+
+	k := tokenKeyOf(key)
+	if p.operation == MechanismDecrypt {
+		if _, ok := key.(*pkcs11PrivateKeyRSA); !ok {
+			return nil, fmt.Errorf("mechanism profile %q is for decryption, which needs an RSA key", profile)
+		}
+	}
+	k.mechanismProfile = p
+	return key, nil
+}
+
+// profileFor returns the mechanism profile of k for operation, or nil if there is none.
+func (k *pkcs11PrivateKey) profileFor(operation MechanismOperation) *mechanismProfile {
+	if k.mechanismProfile != nil && k.mechanismProfile.operation == operation {
+		return k.mechanismProfile
+	}
+	return nil
+}
+
+// signWithProfile signs data with the mechanism of profile.
+func (k *pkcs11PrivateKey) signWithProfile(profile *mechanismProfile, data []byte) (signature []byte, err error) {
+	err = k.withSession(func(session *pkcs11Session) error {
+		signature, err = k.signWithProfileInSession(session, profile, data)
+		return err
+	})
+	return signature, withMessagef(err, "signing with mechanism profile %q", profile.name)
+}
+
+// signWithProfileInSession signs data with the mechanism of profile in session.
+func (k *pkcs11PrivateKey) signWithProfileInSession(session *pkcs11Session, profile *mechanismProfile,
+	data []byte) ([]byte, error) {
+
+	if err := session.signInit(profile.pkcs11Mechanism(), k.handle); err != nil {
+		return nil, err
+	}
+	return session.sign(profile.mechanism, data)
+}
+
+// decryptWithProfile decrypts ciphertext with the mechanism of profile.
+func (k *pkcs11PrivateKey) decryptWithProfile(profile *mechanismProfile, ciphertext []byte) (plaintext []byte,
+	err error) {
+
+	err = k.withSession(func(session *pkcs11Session) error {
+		if err = session.decryptInit(profile.pkcs11Mechanism(), k.handle); err != nil {
+			return err
+		}
+		plaintext, err = session.decrypt(profile.mechanism, ciphertext)
+		return err
+	})
+	return plaintext, withMessagef(err, "decrypting with mechanism profile %q", profile.name)
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMechanismProfilesFromJSON(t *testing.T) {
+	var config Config
+	err := json.Unmarshal([]byte(`{"MechanismProfiles": [
+		{"Name": "vendor-sign", "Mechanism": 2147483905, "ParametersHex": "0102", "Operation": "sign"},
+		{"Name": "vendor-decrypt", "Mechanism": 1, "ParametersBase64": "AQI=", "Operation": "decrypt"}
+	]}`), &config)
+	require.NoError(t, err)
+
+	profiles, err := newMechanismProfiles(config.MechanismProfiles)
+	require.NoError(t, err)
+	require.Len(t, profiles, 2)
+
+	assert.Equal(t, &mechanismProfile{"vendor-sign", 0x80000101, []byte{1, 2}, MechanismSign}, profiles["vendor-sign"])
+	assert.Equal(t, &mechanismProfile{"vendor-decrypt", 1, []byte{1, 2}, MechanismDecrypt}, profiles["vendor-decrypt"])
+
+	err = json.Unmarshal([]byte(`{"MechanismProfiles": [{"Name": "x", "Operation": "derive"}]}`), &config)
+	assert.Error(t, err)
+}
+
+func TestMechanismProfileValidation(t *testing.T) {
+	for name, profiles := range map[string][]MechanismProfile{
+		"no name":       {{Operation: MechanismSign}},
+		"duplicate":     {{Name: "a", Operation: MechanismSign}, {Name: "a", Operation: MechanismDecrypt}},
+		"no operation":  {{Name: "a"}},
+		"bad hex":       {{Name: "a", Operation: MechanismSign, ParametersHex: "xyz"}},
+		"bad base64":    {{Name: "a", Operation: MechanismSign, ParametersBase64: "!!"}},
+		"two encodings": {{Name: "a", Operation: MechanismSign, ParametersHex: "01", ParametersBase64: "AQ=="}},
+	} {
+		_, err := newMechanismProfiles(profiles)
+		assert.Error(t, err, name)
+	}
+
+	profiles, err := newMechanismProfiles(nil)
+	require.NoError(t, err)
+	assert.Empty(t, profiles)
+}
+
+func TestFindKeyPairWithMechanismProfile(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.MechanismProfiles = []MechanismProfile{
+		{Name: "hash-and-sign", Mechanism: pkcs11.CKM_SHA256_RSA_PKCS, Operation: MechanismSign},
+		{Name: "raw-decrypt", Mechanism: pkcs11.CKM_RSA_PKCS, Operation: MechanismDecrypt},
+	}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	id := randomBytes()
+	key, err := ctx.GenerateRSAKeyPair(id, rsaSize)
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	_, err = ctx.FindKeyPairWithMechanismProfile(id, nil, "missing")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"missing"`)
+
+	// The profile passes the message to the token, which hashes it.
+	signer, err := ctx.FindKeyPairWithMechanismProfile(id, nil, "hash-and-sign")
+	require.NoError(t, err)
+	require.NotNil(t, signer)
+
+	message := []byte("mechanism profile")
+	sig, err := signer.Sign(rand.Reader, message, crypto.SHA256)
+	require.NoError(t, err)
+	digest := sha256.Sum256(message)
+	require.NoError(t, rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+	// Keys found normally are unaffected.
+	plain, err := ctx.FindKeyPair(id, nil)
+	require.NoError(t, err)
+	sig, err = plain.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+
+	decrypter, err := ctx.FindKeyPairWithMechanismProfile(id, nil, "raw-decrypt")
+	require.NoError(t, err)
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, key.Public().(*rsa.PublicKey), message)
+	require.NoError(t, err)
+	plaintext, err := decrypter.(SignerDecrypter).Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{Hash: crypto.SHA256})
+	require.NoError(t, err)
+	assert.Equal(t, message, plaintext)
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// MustConfigure is like Configure but panics if the Context cannot be created, with a message naming the PKCS#11
+// library, the token that was searched for and the underlying error, including any PKCS#11 return value. It is
+// intended for small programs that cannot continue without a token; services should call Configure and handle the
+// error.
+//
+// Apart from MustConfigure, crypto11 reports failures as errors. The exceptions are the methods of the crypto/cipher
+// interfaces, which have no error result and panic on misuse as the standard library implementations do.
+func MustConfigure(config *Config) *Context {
+	ctx, err := Configure(config)
+	if err != nil {
+		panic(configureFailure(config, err))
+	}
+	return ctx
+}
+
+// configureFailure returns the operator-readable message with which MustConfigure panics.
+func configureFailure(config *Config, err error) string {
+	if config == nil {
+		return fmt.Sprintf("crypto11: cannot configure PKCS#11: %v", err)
+	}
+	return fmt.Sprintf("crypto11: cannot configure PKCS#11 library %q for %s: %v", config.Path,
+		describeTokenSelection(config), err)
+}
+
+// describeTokenSelection describes how config selects a token, for error messages.
+func describeTokenSelection(config *Config) string {
+	var criteria []string
+	if config.SlotNumber != nil {
+		criteria = append(criteria, fmt.Sprintf("slot %d", *config.SlotNumber))
+	}
+	if config.TokenLabel != "" {
+		criteria = append(criteria, fmt.Sprintf("token label %q", config.TokenLabel))
+	}
+	if config.TokenSerial != "" {
+		criteria = append(criteria, fmt.Sprintf("token serial %q", config.TokenSerial))
+	}
+	if len(criteria) == 0 {
+		return "no token"
+	}
+	return strings.Join(criteria, ", ")
+}
+
+// isNilPointer returns true if opts is a nil pointer held in a non-nil interface, such as (*rsa.PSSOptions)(nil)
+// passed as crypto.SignerOpts. Such values get past checks for missing options and must not be dereferenced.
+func isNilPointer(opts interface{}) bool {
+	v := reflect.ValueOf(opts)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
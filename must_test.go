@@ -0,0 +1,184 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recoverPanic calls f and returns the value it panicked with, or nil.
+func recoverPanic(f func()) (value interface{}) {
+	defer func() { value = recover() }()
+	f()
+	return nil
+}
+
+func TestMustConfigurePanicMessage(t *testing.T) {
+	slot := 3
+	config := &Config{Path: "/nonexistent/libpkcs11.so", SlotNumber: &slot, Pin: "1234"}
+
+	value := recoverPanic(func() { MustConfigure(config) })
+	require.NotNil(t, value)
+	message := fmt.Sprint(value)
+	assert.Contains(t, message, `"/nonexistent/libpkcs11.so"`)
+	assert.Contains(t, message, "slot 3")
+
+	message = configureFailure(&Config{Path: "lib.so", TokenLabel: "signing"},
+		withMessage(pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT), "opening session"))
+	assert.Contains(t, message, `token label "signing"`)
+	assert.Contains(t, message, "CKR_TOKEN_NOT_PRESENT")
+
+	value = recoverPanic(func() { MustConfigure(nil) })
+	assert.Contains(t, fmt.Sprint(value), "config is nil")
+}
+
+func TestMustConfigure(t *testing.T) {
+	cfg, err := getConfig("config")
+	require.NoError(t, err)
+
+	var ctx *Context
+	value := recoverPanic(func() { ctx = MustConfigure(cfg) })
+	require.Nil(t, value, "unexpected panic")
+	require.NoError(t, ctx.Close())
+
+	cfg, err = getConfig("config")
+	require.NoError(t, err)
+	cfg.Pin = cfg.Pin + "-wrong"
+
+	value = recoverPanic(func() { MustConfigure(cfg) })
+	require.NotNil(t, value)
+	message := fmt.Sprint(value)
+	assert.Contains(t, message, cfg.Path)
+	assert.Contains(t, message, "CKR_PIN_INCORRECT")
+}
+
+func TestIsNilPointer(t *testing.T) {
+	assert.False(t, isNilPointer(nil))
+	assert.False(t, isNilPointer(crypto.SHA256))
+	assert.False(t, isNilPointer(&rsa.PSSOptions{}))
+	assert.True(t, isNilPointer((*rsa.PSSOptions)(nil)))
+
+	var opts crypto.SignerOpts = (*rsa.PSSOptions)(nil)
+	assert.True(t, isNilPointer(opts))
+}
+
+func TestMalformedInputsDoNotPanic(t *testing.T) {
+	digest := sha256.Sum256([]byte("malformed"))
+
+	assert.NotPanics(t, func() {
+		assert.Error(t, (*Config)(nil).Validate())
+		assert.Nil(t, CopyAttribute(nil))
+
+		_, err := IdentifySigner(nil)
+		assert.Error(t, err)
+		assert.Error(t, VerifySignature(nil, digest[:], nil, crypto.SHA256))
+
+		_, _, err = ParseECDSASignature([]byte{0x30, 0x00}, nil)
+		assert.Error(t, err)
+		_, err = MarshalECDSASignatureRaw(big.NewInt(1), big.NewInt(1), nil)
+		assert.Error(t, err)
+
+		_, err = PublicKeyFingerprint(nil)
+		assert.Error(t, err)
+		_, _, _, err = verifyMechanism(&rsa.PublicKey{}, 0, digest[:], nil, crypto.SHA256)
+		assert.Error(t, err)
+		_, _, _, err = verifyMechanism(&ecdsa.PublicKey{}, 0, digest[:], nil, nil)
+		assert.Error(t, err)
+		_, err = rsaEncryptMechanism(nil, 256, (*rsa.OAEPOptions)(nil))
+		assert.Error(t, err)
+		_, err = rsaEncryptMechanism(nil, 256, &rsa.OAEPOptions{Hash: crypto.Hash(99)})
+		assert.Error(t, err)
+	})
+
+	for _, hash := range SupportedHashes() {
+		assert.True(t, hash.Available(), "%v", hash)
+	}
+}
+
+func TestMalformedOptionsDoNotPanic(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		rsaKey, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = rsaKey.Delete() }()
+
+		ecdsaKey, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = ecdsaKey.Delete() }()
+
+		digest := sha256.Sum256([]byte("malformed options"))
+		signerOpts := []crypto.SignerOpts{
+			nil,
+			crypto.Hash(99),
+			(*rsa.PSSOptions)(nil),
+			&rsa.PSSOptions{Hash: crypto.Hash(99)},
+			(*ECDSASignatureOptions)(nil),
+		}
+		decrypterOpts := []crypto.DecrypterOpts{
+			(*rsa.OAEPOptions)(nil),
+			(*rsa.PKCS1v15DecryptOptions)(nil),
+			&rsa.OAEPOptions{Hash: crypto.Hash(99)},
+			"not options",
+		}
+
+		for _, opts := range signerOpts {
+			opts := opts
+			assert.NotPanics(t, func() {
+				_, _ = rsaKey.Sign(nil, digest[:], opts)
+				_, _ = ecdsaKey.Sign(nil, digest[:], opts)
+				_, _ = rsaKey.(MessageSigner).SignMessage(nil, digest[:], opts)
+				_, _ = ecdsaKey.(MessageSigner).SignMessage(nil, digest[:], opts)
+				_ = VerifySignature(rsaKey, digest[:], digest[:], opts)
+				_ = VerifySignature(ecdsaKey, digest[:], digest[:], opts)
+				if s, err := rsaKey.(StreamingSigner).NewStreamSigner(opts); err == nil {
+					_ = s.Close()
+				}
+			}, "%#v", opts)
+		}
+
+		for _, opts := range decrypterOpts {
+			opts := opts
+			assert.NotPanics(t, func() {
+				_, err := rsaKey.Decrypt(nil, digest[:], opts)
+				assert.Error(t, err)
+				_, err = rsaKey.(Encrypter).Encrypt(digest[:], opts)
+				assert.Error(t, err)
+			}, "%#v", opts)
+		}
+
+		assert.NotPanics(t, func() {
+			verifier := rsaKey.(RSAVerifier)
+			assert.Error(t, verifier.VerifyPSS(crypto.Hash(99), digest[:], digest[:], nil))
+			assert.Error(t, ecdsaKey.(ECDSAVerifier).VerifyECDSA(digest[:], nil))
+		})
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build !windows
+// +build !windows
+
+package crypto11
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// PKCS#11 return values used by the mutex functions.
+const (
+	ckrOK             = 0x000
+	ckrHostMemory     = 0x002
+	ckrMutexBad       = 0x1A0
+	ckrMutexNotLocked = 0x1A1
+)
+
+// libraryMutexes holds the mutexes created by a library initialized with LockingMutexes. Each is identified to the
+// library by a distinct C allocation, since C code may not keep Go pointers. A mutex is a channel with room for one
+// token, which is held while the mutex is locked, so that unlocking a mutex that is not locked can be reported
+// rather than panicking in a cgo callback.
+var libraryMutexes = struct {
+	sync.Mutex
+	byHandle map[unsafe.Pointer]chan struct{}
+}{byHandle: map[unsafe.Pointer]chan struct{}{}}
+
+// libraryMutex returns the mutex identified by handle, or nil if there is none.
+func libraryMutex(handle unsafe.Pointer) chan struct{} {
+	libraryMutexes.Lock()
+	defer libraryMutexes.Unlock()
+	return libraryMutexes.byHandle[handle]
+}
+
+//export crypto11CreateMutex
+func crypto11CreateMutex(mutex *unsafe.Pointer) C.ulong {
+	handle := C.malloc(1)
+	if handle == nil {
+		return ckrHostMemory
+	}
+
+	libraryMutexes.Lock()
+	libraryMutexes.byHandle[handle] = make(chan struct{}, 1)
+	libraryMutexes.Unlock()
+
+	*mutex = handle
+	return ckrOK
+}
+
+//export crypto11DestroyMutex
+func crypto11DestroyMutex(mutex unsafe.Pointer) C.ulong {
+	libraryMutexes.Lock()
+	_, ok := libraryMutexes.byHandle[mutex]
+	delete(libraryMutexes.byHandle, mutex)
+	libraryMutexes.Unlock()
+
+	if !ok {
+		return ckrMutexBad
+	}
+	C.free(mutex)
+	return ckrOK
+}
+
+//export crypto11LockMutex
+func crypto11LockMutex(mutex unsafe.Pointer) C.ulong {
+	m := libraryMutex(mutex)
+	if m == nil {
+		return ckrMutexBad
+	}
+	m <- struct{}{}
+	return ckrOK
+}
+
+//export crypto11UnlockMutex
+func crypto11UnlockMutex(mutex unsafe.Pointer) C.ulong {
+	m := libraryMutex(mutex)
+	if m == nil {
+		return ckrMutexBad
+	}
+	select {
+	case <-m:
+		return ckrOK
+	default:
+		return ckrMutexNotLocked
+	}
+}
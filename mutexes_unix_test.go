@@ -0,0 +1,62 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build !windows
+// +build !windows
+
+package crypto11
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibraryMutexes(t *testing.T) {
+	var mutex unsafe.Pointer
+	require.EqualValues(t, ckrOK, crypto11CreateMutex(&mutex))
+	require.NotNil(t, mutex)
+
+	assert.EqualValues(t, ckrMutexNotLocked, crypto11UnlockMutex(mutex))
+	assert.EqualValues(t, ckrOK, crypto11LockMutex(mutex))
+
+	locked := make(chan struct{})
+	go func() {
+		assert.EqualValues(t, ckrOK, crypto11LockMutex(mutex))
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("mutex locked twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	assert.EqualValues(t, ckrOK, crypto11UnlockMutex(mutex))
+	<-locked
+	assert.EqualValues(t, ckrOK, crypto11UnlockMutex(mutex))
+
+	assert.EqualValues(t, ckrOK, crypto11DestroyMutex(mutex))
+	assert.EqualValues(t, ckrMutexBad, crypto11DestroyMutex(mutex))
+	assert.EqualValues(t, ckrMutexBad, crypto11LockMutex(mutex))
+}
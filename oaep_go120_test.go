@@ -0,0 +1,118 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build go1.20
+// +build go1.20
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// oaepEncrypt implements RSAES-OAEP-ENCRYPT from RFC 8017 section 7.1.1, with independent OAEP and MGF1 hashes.
+func oaepEncrypt(t *testing.T, pub *rsa.PublicKey, hash, mgfHash crypto.Hash, msg, label []byte) []byte {
+	k := (pub.N.BitLen() + 7) / 8
+	hLen := hash.Size()
+	require.True(t, len(msg) <= k-2*hLen-2)
+
+	digester := hash.New()
+	digester.Write(label)
+	em := make([]byte, k)
+	seed := em[1 : 1+hLen]
+	db := em[1+hLen:]
+	copy(db, digester.Sum(nil))
+	db[len(db)-len(msg)-1] = 1
+	copy(db[len(db)-len(msg):], msg)
+	_, err := rand.Read(seed)
+	require.NoError(t, err)
+
+	mgf1XOR(db, mgfHash.New(), seed)
+	mgf1XOR(seed, mgfHash.New(), db)
+
+	c := new(big.Int).Exp(new(big.Int).SetBytes(em), big.NewInt(int64(pub.E)), pub.N).Bytes()
+	ciphertext := make([]byte, k)
+	copy(ciphertext[k-len(c):], c)
+	return ciphertext
+}
+
+func TestOAEPEncryptHelper(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	msg := []byte("check the test encoder")
+
+	ciphertext := oaepEncrypt(t, &key.PublicKey, crypto.SHA256, crypto.SHA1, msg, []byte("label"))
+	plaintext, err := key.Decrypt(rand.Reader, ciphertext,
+		&rsa.OAEPOptions{Hash: crypto.SHA256, MGFHash: crypto.SHA1, Label: []byte("label")})
+	require.NoError(t, err)
+	assert.Equal(t, msg, plaintext)
+}
+
+func TestOAEPParamsMGFHash(t *testing.T) {
+	params, err := oaepParams(&rsa.OAEPOptions{Hash: crypto.SHA256})
+	require.NoError(t, err)
+	assert.Equal(t, uint(pkcs11.CKG_MGF1_SHA256), params.MGF)
+
+	params, err = oaepParams(&rsa.OAEPOptions{Hash: crypto.SHA256, MGFHash: crypto.SHA1})
+	require.NoError(t, err)
+	assert.Equal(t, uint(pkcs11.CKG_MGF1_SHA1), params.MGF)
+
+	_, err = oaepParams(&rsa.OAEPOptions{Hash: crypto.SHA256, MGFHash: crypto.MD5})
+	assert.Error(t, err)
+}
+
+func TestRsaOAEPMGFHash(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), []byte("oaep mgf"), rsaSize, KeyPurposeDecryption)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		pub := key.Public().(*rsa.PublicKey)
+		msg := []byte("mismatched hashes")
+
+		for _, hashes := range [][2]crypto.Hash{
+			{crypto.SHA256, crypto.SHA1},
+			{crypto.SHA1, crypto.SHA256},
+			{crypto.SHA384, crypto.SHA256},
+		} {
+			ciphertext := oaepEncrypt(t, pub, hashes[0], hashes[1], msg, nil)
+			plaintext, err := key.Decrypt(rand.Reader, ciphertext,
+				&rsa.OAEPOptions{Hash: hashes[0], MGFHash: hashes[1]})
+			require.NoError(t, err, "hash %v, MGF1 hash %v", hashes[0], hashes[1])
+			assert.Equal(t, msg, plaintext)
+
+			// The MGF1 hash must be the one used for encryption.
+			_, err = key.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{Hash: hashes[0]})
+			assert.Error(t, err)
+		}
+	})
+}
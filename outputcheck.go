@@ -0,0 +1,106 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+)
+
+// ErrMalformedTokenOutput is wrapped by *MalformedTokenOutputError.
+var ErrMalformedTokenOutput = errors.New("token returned malformed output")
+
+// MalformedTokenOutputError is returned when the token returns a signature, ciphertext or MAC whose length is not
+// the one the operation defines, such as a truncated RSA signature. Such output would otherwise fail far from its
+// source, for instance when a relying party verifies it. It wraps ErrMalformedTokenOutput. See
+// Config.SkipOutputLengthChecks.
+type MalformedTokenOutputError struct {
+	// Operation names the output, such as "RSA signature" or "GCM ciphertext".
+	Operation string
+
+	// Expectation describes where Expected comes from, such as "the modulus length".
+	Expectation string
+
+	// Expected and Actual are the expected and returned lengths, in bytes.
+	Expected, Actual int
+}
+
+func (e *MalformedTokenOutputError) Error() string {
+	return fmt.Sprintf("%s is %d bytes, expected %d (%s)", e.Operation, e.Actual, e.Expected, e.Expectation)
+}
+
+func (e *MalformedTokenOutputError) Unwrap() error {
+	return ErrMalformedTokenOutput
+}
+
+// checkOutputLength returns a *MalformedTokenOutputError if output, returned by the token for operation, is not
+// expected bytes long. No check is made if Config.SkipOutputLengthChecks is set.
+func (c *Context) checkOutputLength(operation, expectation string, expected int, output []byte) error {
+	if c.cfg.SkipOutputLengthChecks || len(output) == expected {
+		return nil
+	}
+	return &MalformedTokenOutputError{Operation: operation, Expectation: expectation, Expected: expected,
+		Actual: len(output)}
+}
+
+// signatureLength describes the length of the signatures made by a key pair, see checkSignatureLength.
+type signatureLength struct {
+	operation, expectation string
+	size                   int
+}
+
+// signatureLengthOf returns the length of signatures, as returned by the token before any change of format, made by
+// the private half of pub: the modulus length for RSA, twice the length of the order for ECDSA and DSA, and the fixed
+// size of Ed25519 and Ed448 signatures. It returns nil for other key types.
+func signatureLengthOf(pub crypto.PublicKey) *signatureLength {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return &signatureLength{"RSA signature", "the modulus length", (pub.N.BitLen() + 7) / 8}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().N.BitLen() + 7) / 8
+		return &signatureLength{"ECDSA signature", "twice the order length", 2 * size}
+	case *dsa.PublicKey:
+		size := (pub.Q.BitLen() + 7) / 8
+		return &signatureLength{"DSA signature", "twice the length of Q", 2 * size}
+	case ed25519.PublicKey:
+		return &signatureLength{"Ed25519 signature", "RFC 8032", ed25519.SignatureSize}
+	case Ed448PublicKey:
+		return &signatureLength{"Ed448 signature", "RFC 8032", Ed448SignatureSize}
+	default:
+		return nil
+	}
+}
+
+// checkSignatureLength checks the length of signature, as returned by the token for k, against the length recorded
+// when k was loaded, see signatureLengthOf.
+func (k *pkcs11PrivateKey) checkSignatureLength(signature []byte) error {
+	length := k.signatureLength
+	if length == nil {
+		return nil
+	}
+	return k.context.checkOutputLength(length.operation, length.expectation, length.size, signature)
+}
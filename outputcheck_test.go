@@ -0,0 +1,111 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckOutputLength(t *testing.T) {
+	ctx := &Context{cfg: &Config{}}
+	assert.NoError(t, ctx.checkOutputLength("GCM ciphertext", "plaintext plus tag", 48, make([]byte, 48)))
+
+	err := ctx.checkOutputLength("GCM ciphertext", "plaintext plus tag", 48, make([]byte, 47))
+	var malformed *MalformedTokenOutputError
+	require.True(t, errors.As(err, &malformed), "%v", err)
+	assert.Equal(t, 48, malformed.Expected)
+	assert.Equal(t, 47, malformed.Actual)
+	assert.True(t, errors.Is(err, ErrMalformedTokenOutput))
+	assert.Contains(t, err.Error(), "plaintext plus tag")
+
+	ctx.cfg.SkipOutputLengthChecks = true
+	assert.NoError(t, ctx.checkOutputLength("GCM ciphertext", "plaintext plus tag", 48, make([]byte, 47)))
+}
+
+func TestCheckSignatureLength(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	require.NoError(t, err)
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	ctx := &Context{cfg: &Config{}}
+	cases := []struct {
+		pub  crypto.PublicKey
+		size int
+	}{
+		{&rsaKey.PublicKey, 128},
+		{&ecdsaKey.PublicKey, 2 * 66},
+		{ed25519Key, ed25519.SignatureSize},
+		{Ed448PublicKey(nil), Ed448SignatureSize},
+	}
+	for _, c := range cases {
+		k := &pkcs11PrivateKey{pkcs11Object: pkcs11Object{context: ctx}}
+		ctx.retainPublicKey(k, c.pub)
+		assert.NoError(t, k.checkSignatureLength(make([]byte, c.size)), "%T", c.pub)
+		err := k.checkSignatureLength(make([]byte, c.size-1))
+		assert.True(t, errors.Is(err, ErrMalformedTokenOutput), "%T: %v", c.pub, err)
+	}
+
+	// For other key types, the expected length is unknown.
+	k := &pkcs11PrivateKey{pkcs11Object: pkcs11Object{context: ctx}}
+	ctx.retainPublicKey(k, X25519PublicKey(nil))
+	assert.NoError(t, k.checkSignatureLength(nil))
+}
+
+func TestCheckSignatureLengthReleasedPublicKey(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.ReleasePublicKeys = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	id := randomBytes()
+	key, err := ctx.GenerateECDSAKeyPair(id, elliptic.P256())
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	found, err := ctx.FindKeyPair(id, nil)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+
+	for _, signer := range []Signer{key, found} {
+		k := tokenKeyOf(signer)
+		require.Nil(t, k.pubKey)
+		assert.NoError(t, k.checkSignatureLength(make([]byte, 64)))
+		err := k.checkSignatureLength(make([]byte, 63))
+		assert.True(t, errors.Is(err, ErrMalformedTokenOutput), "unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PEMImportOptions controls the behaviour of ImportCertificatesPEMWithOptions.
+type PEMImportOptions struct {
+	// StoreUnmatchedLeaves stores leaf certificates for which no key pair is found on the token, with an ID derived
+	// from the subject key identifier. By default they are only reported.
+	StoreUnmatchedLeaves bool
+}
+
+// ImportedCertificate is a certificate handled by ImportCertificatesPEM.
+type ImportedCertificate struct {
+	Certificate *x509.Certificate
+
+	// ID is the CKA_ID of the certificate on the token, or the CKA_ID it would have had if it was not stored.
+	ID []byte
+}
+
+// ImportReport describes the outcome of ImportCertificatesPEM.
+type ImportReport struct {
+	// Created lists the certificates that were stored on the token.
+	Created []ImportedCertificate
+
+	// Skipped lists the certificates that were already on the token.
+	Skipped []ImportedCertificate
+
+	// Unmatched lists the leaf certificates for which no key pair was found on the token. They also appear in
+	// Created if PEMImportOptions.StoreUnmatchedLeaves was set.
+	Unmatched []ImportedCertificate
+}
+
+// ImportCertificatesPEM imports the certificates in a PEM bundle, such as a leaf certificate and its
+// intermediates, next to their key pair. It is equivalent to ImportCertificatesPEMWithOptions with nil options.
+func (c *Context) ImportCertificatesPEM(pemBundle []byte) (ImportReport, error) {
+	return c.ImportCertificatesPEMWithOptions(pemBundle, nil)
+}
+
+// ImportCertificatesPEMWithOptions imports the certificates in a PEM bundle. Blocks other than CERTIFICATE are
+// ignored.
+//
+// Leaf certificates (those that did not issue another certificate in the bundle) are paired with their key pair
+// as for FindKeyPairForCertificate, and stored with the CKA_ID of the private key. Leaves without a key pair are
+// reported as unmatched, and only stored if opts.StoreUnmatchedLeaves is set. Other certificates are stored with
+// their subject key identifier as CKA_ID, or if they have none, with the SHA-1 hash of their public key (RFC 5280
+// s4.2.1.2). A certificate that is already on the token, in any object with the same value, is skipped.
+//
+// If an error occurs, certificates stored before the error are not removed.
+func (c *Context) ImportCertificatesPEMWithOptions(pemBundle []byte, opts *PEMImportOptions) (ImportReport, error) {
+	var report ImportReport
+
+	if c.closed.Get() {
+		return report, errClosed
+	}
+
+	if c.cfg.PublicOnly {
+		return report, ErrLoginRequired
+	}
+
+	if opts == nil {
+		opts = &PEMImportOptions{}
+	}
+
+	certificates, err := parsePEMCertificates(pemBundle)
+	if err != nil {
+		return report, err
+	}
+
+	for _, certificate := range certificates {
+		imported := ImportedCertificate{Certificate: certificate}
+		store := true
+
+		if isLeaf(certificate, certificates) {
+			key, err := c.FindKeyPairForCertificate(certificate)
+			if err != nil {
+				return report, withMessage(err, "finding key pair for certificate")
+			}
+			if key != nil {
+				if imported.ID, err = c.keyPairID(key); err != nil {
+					return report, err
+				}
+			} else {
+				imported.ID, err = subjectKeyID(certificate)
+				if err != nil {
+					return report, err
+				}
+				report.Unmatched = append(report.Unmatched, imported)
+				store = opts.StoreUnmatchedLeaves
+			}
+		} else {
+			if imported.ID, err = subjectKeyID(certificate); err != nil {
+				return report, err
+			}
+		}
+
+		if !store {
+			continue
+		}
+
+		created, err := c.importCertificateIfAbsent(imported)
+		if err != nil {
+			return report, err
+		}
+		if created {
+			report.Created = append(report.Created, imported)
+		} else {
+			report.Skipped = append(report.Skipped, imported)
+		}
+	}
+
+	return report, nil
+}
+
+// parsePEMCertificates parses the CERTIFICATE blocks of a PEM bundle.
+func parsePEMCertificates(pemBundle []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBundle = pem.Decode(pemBundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, withMessagef(err, "parsing certificate %d in bundle", len(certificates)+1)
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	if len(certificates) == 0 {
+		return nil, errors.New("no certificates found in PEM bundle")
+	}
+	return certificates, nil
+}
+
+// isLeaf returns true if certificate did not issue any other certificate in bundle.
+func isLeaf(certificate *x509.Certificate, bundle []*x509.Certificate) bool {
+	for _, other := range bundle {
+		if other != certificate && bytes.Equal(other.RawIssuer, certificate.RawSubject) &&
+			other.CheckSignatureFrom(certificate) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// subjectKeyID returns the subject key identifier of certificate, computing it from the public key if the
+// extension is absent.
+func subjectKeyID(certificate *x509.Certificate) ([]byte, error) {
+	if len(certificate.SubjectKeyId) > 0 {
+		return certificate.SubjectKeyId, nil
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(certificate.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, withMessage(err, "parsing certificate public key")
+	}
+	id := sha1.Sum(spki.PublicKey.Bytes)
+	return id[:], nil
+}
+
+// keyPairID returns the CKA_ID of the private half of key.
+func (c *Context) keyPairID(key Signer) ([]byte, error) {
+	attribute, err := c.GetAttribute(key, CkaId)
+	if err != nil {
+		return nil, withMessage(err, "reading key pair CKA_ID")
+	}
+	if attribute == nil || len(attribute.Value) == 0 {
+		return nil, errors.New("key pair for certificate has no CKA_ID")
+	}
+	return attribute.Value, nil
+}
+
+// importCertificateIfAbsent stores a certificate with the given ID, unless a certificate with the same value is
+// already on the token. It returns true if the certificate was stored.
+func (c *Context) importCertificateIfAbsent(imported ImportedCertificate) (created bool, err error) {
+	template, err := NewAttributeSetWithID(imported.ID)
+	if err != nil {
+		return false, err
+	}
+	if err = addCertificateAttributes(template, imported.Certificate); err != nil {
+		return false, err
+	}
+
+	err = c.withSession(func(session *pkcs11Session) error {
+		existing, err := findKeysWithAttributes(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, imported.Certificate.Raw),
+		})
+		if err != nil || len(existing) > 0 {
+			return err
+		}
+
+		if _, err = session.ctx.CreateObject(session.handle, template.ToSlice()); err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	return created, err
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testChain is a CA certificate and a leaf certificate it issued.
+type testChain struct {
+	ca, leaf *x509.Certificate
+}
+
+// newTestChain issues a leaf certificate for leafKey from a new software CA. The CA certificate has no subject key
+// identifier, so that crypto11 has to compute one.
+func newTestChain(t *testing.T, leafKey crypto.Signer) testChain {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "PEM import CA"},
+		SerialNumber:          big.NewInt(1),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	ca.SubjectKeyId = nil
+
+	leafTemplate := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "PEM import leaf"},
+		SerialNumber: big.NewInt(2),
+		NotAfter:     time.Now().Add(time.Hour),
+		SubjectKeyId: []byte("leaf-ski"),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, leafKey.Public(), caKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(leafDER)
+	require.NoError(t, err)
+
+	return testChain{ca: ca, leaf: leaf}
+}
+
+// bundle returns the PEM encoding of the chain, leaf first, with an unrelated block in between.
+func (chain testChain) bundle() []byte {
+	var out []byte
+	out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain.leaf.Raw})...)
+	out = append(out, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("ignored")})...)
+	out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain.ca.Raw})...)
+	return out
+}
+
+func TestParsePEMCertificates(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	chain := newTestChain(t, key)
+
+	certificates, err := parsePEMCertificates(chain.bundle())
+	require.NoError(t, err)
+	require.Len(t, certificates, 2)
+	assert.Equal(t, chain.leaf.Raw, certificates[0].Raw)
+	assert.Equal(t, chain.ca.Raw, certificates[1].Raw)
+
+	assert.True(t, isLeaf(certificates[0], certificates))
+	assert.False(t, isLeaf(certificates[1], certificates))
+
+	_, err = parsePEMCertificates([]byte("not PEM"))
+	assert.Error(t, err)
+
+	_, err = parsePEMCertificates(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("junk")}))
+	assert.Error(t, err)
+}
+
+func TestSubjectKeyID(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	chain := newTestChain(t, key)
+
+	id, err := subjectKeyID(chain.leaf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("leaf-ski"), id)
+
+	// Go computes the same RFC 5280 method 1 identifier for CA certificates without one.
+	computed, err := subjectKeyID(chain.ca)
+	require.NoError(t, err)
+	reparsed, err := x509.ParseCertificate(chain.ca.Raw)
+	require.NoError(t, err)
+	if len(reparsed.SubjectKeyId) > 0 {
+		assert.Equal(t, reparsed.SubjectKeyId, computed)
+	}
+	assert.Len(t, computed, 20)
+}
+
+func TestImportCertificatesPEM(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		key, err := ctx.GenerateECDSAKeyPair(id, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		chain := newTestChain(t, key)
+		caID, err := subjectKeyID(chain.ca)
+		require.NoError(t, err)
+		defer func() {
+			_ = ctx.DeleteCertificate(id, nil, nil)
+			_ = ctx.DeleteCertificate(caID, nil, nil)
+		}()
+
+		report, err := ctx.ImportCertificatesPEM(chain.bundle())
+		require.NoError(t, err)
+		assert.Equal(t, []ImportedCertificate{{chain.leaf, id}, {chain.ca, caID}}, report.Created)
+		assert.Empty(t, report.Skipped)
+		assert.Empty(t, report.Unmatched)
+
+		found, err := ctx.FindCertificate(id, nil, nil)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, chain.leaf.Raw, found.Raw)
+
+		found, err = ctx.FindCertificate(caID, nil, nil)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, chain.ca.Raw, found.Raw)
+
+		// Importing again finds both certificates already present
+		report, err = ctx.ImportCertificatesPEM(chain.bundle())
+		require.NoError(t, err)
+		assert.Empty(t, report.Created)
+		assert.Len(t, report.Skipped, 2)
+	})
+}
+
+func TestImportCertificatesPEMUnmatched(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		chain := newTestChain(t, key)
+		caID, err := subjectKeyID(chain.ca)
+		require.NoError(t, err)
+		leafID := chain.leaf.SubjectKeyId
+		defer func() {
+			_ = ctx.DeleteCertificate(leafID, nil, nil)
+			_ = ctx.DeleteCertificate(caID, nil, nil)
+		}()
+
+		report, err := ctx.ImportCertificatesPEM(chain.bundle())
+		require.NoError(t, err)
+		assert.Equal(t, []ImportedCertificate{{chain.leaf, leafID}}, report.Unmatched)
+		assert.Equal(t, []ImportedCertificate{{chain.ca, caID}}, report.Created)
+
+		found, err := ctx.FindCertificate(nil, nil, chain.leaf.SerialNumber)
+		require.NoError(t, err)
+		assert.Nil(t, found)
+
+		report, err = ctx.ImportCertificatesPEMWithOptions(chain.bundle(), &PEMImportOptions{StoreUnmatchedLeaves: true})
+		require.NoError(t, err)
+		assert.Equal(t, []ImportedCertificate{{chain.leaf, leafID}}, report.Unmatched)
+		assert.Equal(t, []ImportedCertificate{{chain.leaf, leafID}}, report.Created)
+		assert.Equal(t, []ImportedCertificate{{chain.ca, caID}}, report.Skipped)
+
+		found, err = ctx.FindCertificate(leafID, nil, nil)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, chain.leaf.Raw, found.Raw)
+	})
+}
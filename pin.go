@@ -0,0 +1,105 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"sync"
+)
+
+// errPINNotStored is returned by ChangePIN for Contexts that do not log in with Config.Pin.
+var errPINNotStored = errors.New("the Context does not log in with Config.Pin")
+
+// errPINTokenMismatch is returned by RotatePINAcrossContexts if the Contexts do not use the same token.
+var errPINTokenMismatch = errors.New("the Contexts do not use the same token")
+
+// pinRotationMutex serializes PIN changes, so that concurrent rotations cannot take the PIN locks of the same
+// Contexts in different orders.
+var pinRotationMutex sync.Mutex
+
+// ChangePIN changes the user PIN of the token from oldPin to newPin with C_SetPIN, and then stores newPin as the
+// Config.Pin of the Context, so that sessions opened later log in with it. Sessions that are already logged in are
+// not affected. New sessions wait for the change to finish, rather than logging in with a PIN the token may have
+// just replaced.
+//
+// If the token rejects the change, for instance because newPin does not meet its PIN policy, the error from
+// C_SetPIN is returned and the Context keeps using oldPin. If other Contexts in the process use the same token, use
+// RotatePINAcrossContexts instead, so that their PINs are updated too.
+func (c *Context) ChangePIN(oldPin, newPin string) error {
+	return RotatePINAcrossContexts([]*Context{c}, oldPin, newPin)
+}
+
+// RotatePINAcrossContexts changes the user PIN of the token shared by contexts from oldPin to newPin, and updates
+// the Config.Pin of every one of them. C_SetPIN is called once, with a session of the first Context. Until the stored
+// PINs have been updated, none of the Contexts logs in a new session, so none can log in with the old PIN after the
+// token has changed it. Contexts may be repeated.
+//
+// The Contexts must all log in with Config.Pin and use the same token, which is taken to mean the same library and
+// slot, otherwise an error is returned without changing the PIN. If the token rejects the change, the error from
+// C_SetPIN is returned and every Context keeps using oldPin.
+func RotatePINAcrossContexts(contexts []*Context, oldPin, newPin string) error {
+	if len(contexts) == 0 {
+		return errors.New("no Contexts to change the PIN of")
+	}
+
+	pinRotationMutex.Lock()
+	defer pinRotationMutex.Unlock()
+
+	var unique []*Context
+	seen := make(map[*Context]bool, len(contexts))
+	for _, c := range contexts {
+		if c == nil {
+			return errors.New("Context is nil")
+		}
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+
+		if c.closed.Get() {
+			return errClosed
+		}
+		if !c.sessionLogin.enabled {
+			return errPINNotStored
+		}
+		if c.cfg.Path != contexts[0].cfg.Path || c.slot != contexts[0].slot {
+			return errPINTokenMismatch
+		}
+		unique = append(unique, c)
+	}
+
+	// The session is checked out before taking the PIN locks, since opening a session may need to log in.
+	return unique[0].withSession(func(session *pkcs11Session) error {
+		for _, c := range unique {
+			c.pinLock.Lock()
+			defer c.pinLock.Unlock()
+		}
+
+		if err := session.ctx.SetPIN(session.handle, oldPin, newPin); err != nil {
+			return withMessage(err, "failed to change PIN")
+		}
+		for _, c := range unique {
+			c.cfg.Pin = newPin
+		}
+		return nil
+	})
+}
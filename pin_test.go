@@ -0,0 +1,135 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatePINArguments(t *testing.T) {
+	newContext := func(path string, login bool) *Context {
+		c := &Context{cfg: &Config{Path: path}}
+		c.sessionLogin.reset(login)
+		return c
+	}
+
+	assert.Error(t, RotatePINAcrossContexts(nil, "old", "new"))
+	assert.Error(t, RotatePINAcrossContexts([]*Context{nil}, "old", "new"))
+
+	closed := newContext("a", true)
+	closed.closed.Set(true)
+	assert.Equal(t, errClosed, closed.ChangePIN("old", "new"))
+
+	assert.Equal(t, errPINNotStored, newContext("a", false).ChangePIN("old", "new"))
+
+	err := RotatePINAcrossContexts([]*Context{newContext("a", true), newContext("b", true)}, "old", "new")
+	assert.Equal(t, errPINTokenMismatch, err)
+}
+
+// relogin logs the application out of the token and discards a pool session, so that the next session opened by
+// the pool has to log in with the stored PIN.
+func relogin(t *testing.T, ctx *Context) {
+	require.NoError(t, ctx.ctx.Logout(ctx.persistentSession))
+	err := ctx.withSession(func(*pkcs11Session) error { return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN) })
+	require.Error(t, err)
+}
+
+func TestChangePIN(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		oldPin := ctx.cfg.Pin
+		newPin := oldPin + "-rotated"
+
+		key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		sign := func() error {
+			_, err := key.Sign(rand.Reader, make([]byte, 32), crypto.SHA256)
+			return err
+		}
+
+		// New sessions log in with the original PIN.
+		relogin(t, ctx)
+		require.NoError(t, sign())
+
+		require.NoError(t, ctx.ChangePIN(oldPin, newPin))
+		defer func() { require.NoError(t, ctx.ChangePIN(newPin, oldPin)) }()
+		assert.Equal(t, newPin, ctx.cfg.Pin)
+
+		// Sessions that are already logged in keep working, and new ones log in with the new PIN.
+		require.NoError(t, sign())
+		relogin(t, ctx)
+		require.NoError(t, sign())
+	})
+}
+
+func TestChangePINRejected(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		maxPinLen := ctx.token.MaxPinLen
+		if maxPinLen == 0 || maxPinLen == pkcs11.CK_UNAVAILABLE_INFORMATION || maxPinLen > 4096 {
+			t.Skip("token does not report a usable maximum PIN length")
+		}
+		oldPin := ctx.cfg.Pin
+
+		// A PIN longer than the token allows violates its PIN policy.
+		err := ctx.ChangePIN(oldPin, strings.Repeat("0", int(maxPinLen)+1))
+		require.Error(t, err)
+		assert.Equal(t, oldPin, ctx.cfg.Pin)
+
+		// The token still has the original PIN, which new sessions log in with.
+		relogin(t, ctx)
+		require.NoError(t, ctx.withSession(func(*pkcs11Session) error { return nil }))
+		assert.NotEqual(t, loginModeUnknown, ctx.sessionLogin.getMode())
+	})
+}
+
+func TestRotatePINAcrossContexts(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		config, err := loadConfigFromFile("config")
+		require.NoError(t, err)
+		other, err := Configure(config)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, other.Close()) }()
+
+		oldPin := ctx.cfg.Pin
+		newPin := oldPin + "-rotated"
+
+		contexts := []*Context{ctx, other, ctx}
+		require.NoError(t, RotatePINAcrossContexts(contexts, oldPin, newPin))
+		defer func() { require.NoError(t, RotatePINAcrossContexts(contexts, newPin, oldPin)) }()
+		assert.Equal(t, newPin, ctx.cfg.Pin)
+		assert.Equal(t, newPin, other.cfg.Pin)
+
+		// Either Context can log in new sessions after the change.
+		relogin(t, other)
+		require.NoError(t, other.withSession(func(*pkcs11Session) error { return nil }))
+		assert.NotEqual(t, loginModeUnknown, other.sessionLogin.getMode())
+	})
+}
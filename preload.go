@@ -0,0 +1,175 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// preloadKeyPair loads a single key pair for PreloadKeys. Tests replace it to simulate a high-latency token.
+var preloadKeyPair = func(c *Context, session *pkcs11Session, handle pkcs11.ObjectHandle) (Signer, *x509.Certificate,
+	error) {
+	return c.makeKeyPair(session, &handle)
+}
+
+// KeyLoadError records the failure to load one key pair found by PreloadKeys.
+type KeyLoadError struct {
+	// Handle is the handle of the private key.
+	Handle pkcs11.ObjectHandle
+
+	// Err is the error that occurred.
+	Err error
+}
+
+// PreloadError is returned by PreloadKeys when some key pairs could not be loaded. The key pairs that were loaded
+// are still returned.
+type PreloadError struct {
+	// Failures lists the key pairs that could not be loaded, in the order they were found.
+	Failures []KeyLoadError
+}
+
+func (e *PreloadError) Error() string {
+	if len(e.Failures) == 1 {
+		return fmt.Sprintf("failed to load key pair with handle %d: %v", e.Failures[0].Handle, e.Failures[0].Err)
+	}
+	return fmt.Sprintf("failed to load %d key pairs, first with handle %d: %v", len(e.Failures),
+		e.Failures[0].Handle, e.Failures[0].Err)
+}
+
+// Unwrap returns the error of the first key pair that could not be loaded, so that errors.Is and errors.As can inspect
+// it.
+func (e *PreloadError) Unwrap() error {
+	if len(e.Failures) == 0 {
+		return nil
+	}
+	return e.Failures[0].Err
+}
+
+// PreloadKeys finds the key pairs whose private keys match filter, like FindKeyPairsWithAttributes, but loads them
+// using up to parallelism sessions at once. This is much faster than loading them one at a time when each call to
+// the token has a long round trip, for instance to a network HSM. parallelism is limited to the size of the session
+// pool; values below 1 are treated as 1. A nil filter matches all key pairs.
+//
+// The key pairs are returned in the order the token found them, whatever the parallelism. If some key pairs cannot be
+// loaded, the others are still loaded and returned, together with a *PreloadError listing the failures. If ctx is
+// done before loading finishes, the error from ctx is returned.
+func (c *Context) PreloadKeys(ctx context.Context, filter AttributeSet, parallelism int) ([]Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
+	if _, ok := filter[CkaClass]; ok {
+		return nil, errors.New("keypair attribute set must not contain CkaClass")
+	}
+
+	template := filter.Copy()
+	if err := template.Set(CkaClass, pkcs11.CKO_PRIVATE_KEY); err != nil {
+		return nil, err
+	}
+
+	var handles []pkcs11.ObjectHandle
+	var capacity int
+	err := c.withSessionContext(ctx, func(session *pkcs11Session) (err error) {
+		// Resume replaces the pool, so it is only read while a session is checked out.
+		capacity = int(c.pool.Capacity())
+		handles, err = findKeysWithAttributes(session, template.ToSlice())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if parallelism > capacity {
+		parallelism = capacity
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	signers := make([]Signer, len(handles))
+	errs := make([]error, len(handles))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = c.withSessionContext(ctx, func(session *pkcs11Session) error {
+					signer, _, err := preloadKeyPair(c, session, handles[i])
+					if err == errNoCkaId || err == errNoPublicHalf {
+						// Not a usable key pair, as in FindKeyPairsWithAttributes.
+						return nil
+					}
+					signers[i] = signer
+					return err
+				})
+			}
+		}()
+	}
+
+feed:
+	for i := range handles {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var keys []Signer
+	var failures []KeyLoadError
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			if signers[i] != nil {
+				keys = append(keys, signers[i])
+			}
+		case isObjectGone(err):
+			// Deleted since the search.
+		default:
+			failures = append(failures, KeyLoadError{Handle: handles[i], Err: err})
+		}
+	}
+
+	if failures != nil {
+		return keys, &PreloadError{Failures: failures}
+	}
+	return keys, nil
+}
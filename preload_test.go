@@ -0,0 +1,167 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreloadErrorMessage(t *testing.T) {
+	boom := errors.New("boom")
+	err := &PreloadError{Failures: []KeyLoadError{{Handle: 7, Err: boom}}}
+	assert.Equal(t, "failed to load key pair with handle 7: boom", err.Error())
+
+	err.Failures = append(err.Failures, KeyLoadError{Handle: 9, Err: errors.New("bang")})
+	assert.Equal(t, "failed to load 2 key pairs, first with handle 7: boom", err.Error())
+
+	// The first failure is in the chain.
+	assert.True(t, errors.Is(err, boom))
+	assert.Nil(t, (&PreloadError{}).Unwrap())
+}
+
+// generatePreloadKeys generates count key pairs sharing a random label, and returns a filter matching them.
+func generatePreloadKeys(tb testing.TB, ctx *Context, count int) ([]Signer, AttributeSet) {
+	label := randomBytes()
+	var keys []Signer
+	for i := 0; i < count; i++ {
+		key, err := ctx.GenerateECDSAKeyPairWithLabel(randomBytes(), label, elliptic.P256())
+		require.NoError(tb, err)
+		keys = append(keys, key)
+	}
+
+	filter := NewAttributeSet()
+	require.NoError(tb, filter.Set(CkaLabel, label))
+	return keys, filter
+}
+
+func deleteKeys(keys []Signer) {
+	for _, key := range keys {
+		_ = key.Delete()
+	}
+}
+
+func TestPreloadKeys(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		keys, filter := generatePreloadKeys(t, ctx, 12)
+		defer deleteKeys(keys)
+
+		serial, err := ctx.FindKeyPairsWithAttributes(filter)
+		require.NoError(t, err)
+		require.Len(t, serial, len(keys))
+
+		for _, parallelism := range []int{0, 1, 4, 1000} {
+			loaded, err := ctx.PreloadKeys(context.Background(), filter, parallelism)
+			require.NoError(t, err)
+			require.Len(t, loaded, len(serial))
+			for i := range serial {
+				assert.Equal(t, tokenKeyOf(serial[i]).handle, tokenKeyOf(loaded[i]).handle, "parallelism %d", parallelism)
+			}
+		}
+
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = ctx.PreloadKeys(cancelled, filter, 4)
+		assert.Equal(t, context.Canceled, err)
+
+		withClass := filter.Copy()
+		require.NoError(t, withClass.Set(CkaClass, pkcs11.CKO_PRIVATE_KEY))
+		_, err = ctx.PreloadKeys(context.Background(), withClass, 4)
+		assert.Error(t, err)
+	})
+}
+
+func TestPreloadKeysAggregatesErrors(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		keys, filter := generatePreloadKeys(t, ctx, 6)
+		defer deleteKeys(keys)
+
+		broken := tokenKeyOf(keys[2]).handle
+		failure := errors.New("injected failure")
+
+		defer func(f func(*Context, *pkcs11Session, pkcs11.ObjectHandle) (Signer, *x509.Certificate, error)) {
+			preloadKeyPair = f
+		}(preloadKeyPair)
+		load := preloadKeyPair
+		preloadKeyPair = func(c *Context, session *pkcs11Session, handle pkcs11.ObjectHandle) (Signer,
+			*x509.Certificate, error) {
+			if handle == broken {
+				return nil, nil, failure
+			}
+			return load(c, session, handle)
+		}
+
+		loaded, err := ctx.PreloadKeys(context.Background(), filter, 3)
+		require.Error(t, err)
+		assert.Len(t, loaded, len(keys)-1)
+
+		var preloadErr *PreloadError
+		require.True(t, errors.As(err, &preloadErr))
+		require.Len(t, preloadErr.Failures, 1)
+		assert.Equal(t, broken, preloadErr.Failures[0].Handle)
+		assert.Equal(t, failure, preloadErr.Failures[0].Err)
+	})
+}
+
+// BenchmarkPreloadKeys loads key pairs from a token with 8ms of simulated latency per key, as for a network HSM.
+// The time per operation should fall almost linearly with parallelism, up to the number of sessions.
+func BenchmarkPreloadKeys(b *testing.B) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(b, err)
+	config.MaxSessions = 9
+
+	ctx, err := Configure(config)
+	require.NoError(b, err)
+	defer func() { require.NoError(b, ctx.Close()) }()
+
+	keys, filter := generatePreloadKeys(b, ctx, 32)
+	defer deleteKeys(keys)
+
+	defer func(f func(*Context, *pkcs11Session, pkcs11.ObjectHandle) (Signer, *x509.Certificate, error)) {
+		preloadKeyPair = f
+	}(preloadKeyPair)
+	load := preloadKeyPair
+	preloadKeyPair = func(c *Context, session *pkcs11Session, handle pkcs11.ObjectHandle) (Signer,
+		*x509.Certificate, error) {
+		time.Sleep(8 * time.Millisecond)
+		return load(c, session, handle)
+	}
+
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				loaded, err := ctx.PreloadKeys(context.Background(), filter, parallelism)
+				require.NoError(b, err)
+				require.Len(b, loaded, len(keys))
+			}
+		})
+	}
+}
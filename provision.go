@@ -0,0 +1,218 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// maxTokenLabelLength is the length of the CK_TOKEN_INFO label field.
+const maxTokenLabelLength = 32
+
+// ErrTokenInitNotSupported is wrapped by the error returned by InitializeToken when the PKCS#11 module does not permit
+// tokens to be initialized, or their user PIN set, through the PKCS#11 interface.
+var ErrTokenInitNotSupported = errors.New("token cannot be initialized through PKCS#11")
+
+// errTokenInitialized is returned by InitializeToken rather than erase a token that is already initialized.
+var errTokenInitialized = errors.New("token is already initialized")
+
+// InitializeToken initializes the token in slot of the PKCS#11 module at libraryPath with C_InitToken, giving it
+// label and the security officer PIN soPin, then sets the user PIN to userPin with C_InitPIN. It is intended for
+// tests that want a fresh token, for instance on SoftHSM, rather than shelling out to the module's own tool.
+//
+// A token that is already initialized is never erased: an error is returned instead, as it is if another token
+// already has label. Some modules, such as SoftHSM, move the newly initialized token to a different slot; the token
+// is found again by its label. If the module rejects either call as unsupported or not permitted, the error wraps
+// ErrTokenInitNotSupported.
+//
+// The module is initialized without arguments, unless a Context is already using it, and finalized again
+// afterwards. InitializeToken is safe to call concurrently with Configure and Close.
+func InitializeToken(libraryPath string, slot uint, label, soPin, userPin string) error {
+	if err := checkTokenInitArgs(label, soPin, userPin); err != nil {
+		return err
+	}
+
+	refCountMutex.Lock()
+	defer refCountMutex.Unlock()
+
+	return withLibrary(libraryPath, func(ctx *pkcs11.Ctx) error {
+		return initializeToken(ctx, slot, label, soPin, userPin)
+	})
+}
+
+// ConfigureNewToken initializes the first uninitialized token of the module at config.Path, as InitializeToken does,
+// with the label config.TokenLabel, the security officer PIN soPin and the user PIN config.Pin, and returns a Context
+// for it configured by config. config must not also set TokenSerial or SlotNumber. ErrTokenNotFound is wrapped by the
+// error returned if every token is already initialized.
+//
+// Concurrent calls, for instance from tests run in parallel, initialize different tokens.
+func ConfigureNewToken(config *Config, soPin string) (*Context, error) {
+	if config.TokenSerial != "" || config.SlotNumber != nil {
+		return nil, errors.New("config must select the new token by TokenLabel only")
+	}
+	if err := checkTokenInitArgs(config.TokenLabel, soPin, config.Pin); err != nil {
+		return nil, err
+	}
+
+	err := func() error {
+		refCountMutex.Lock()
+		defer refCountMutex.Unlock()
+
+		return withLibrary(config.Path, func(ctx *pkcs11.Ctx) error {
+			slot, err := uninitializedSlot(ctx)
+			if err != nil {
+				return err
+			}
+			return initializeToken(ctx, slot, config.TokenLabel, soPin, config.Pin)
+		})
+	}()
+	if err != nil {
+		return nil, err
+	}
+	return Configure(config)
+}
+
+// checkTokenInitArgs checks the arguments of InitializeToken.
+func checkTokenInitArgs(label, soPin, userPin string) error {
+	if label == "" || soPin == "" || userPin == "" {
+		return errors.New("token label, SO PIN and user PIN must not be empty")
+	}
+	if len(label) > maxTokenLabelLength {
+		return fmt.Errorf("token label is %d bytes, the limit is %d", len(label), maxTokenLabelLength)
+	}
+	return nil
+}
+
+// withLibrary calls f with a handle on the PKCS#11 module at path. The module is initialized and finalized around f,
+// unless a Context is using it. The caller must hold refCountMutex.
+func withLibrary(path string, f func(ctx *pkcs11.Ctx) error) error {
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return errors.New("could not open PKCS#11")
+	}
+	defer ctx.Destroy()
+
+	if refCount[path] == 0 {
+		if err := ctx.Initialize(); err != nil {
+			return withMessage(err, "failed to initialize PKCS#11 library")
+		}
+		defer func() { _ = ctx.Finalize() }()
+	}
+	return f(ctx)
+}
+
+// uninitializedSlot returns the first slot holding a token that is not initialized.
+func uninitializedSlot(ctx *pkcs11.Ctx) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, withMessage(err, "failed to list PKCS#11 slots")
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, withMessagef(err, "reading token in slot %d", slot)
+		}
+		if info.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 {
+			return slot, nil
+		}
+	}
+	return 0, withMessage(ErrTokenNotFound, "no uninitialized token")
+}
+
+// slotWithLabel returns the slot of the token with label, or ErrTokenNotFound.
+func slotWithLabel(ctx *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, withMessage(err, "failed to list PKCS#11 slots")
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, withMessagef(err, "reading token in slot %d", slot)
+		}
+		if info.Label == label && info.Flags&pkcs11.CKF_TOKEN_INITIALIZED != 0 {
+			return slot, nil
+		}
+	}
+	return 0, ErrTokenNotFound
+}
+
+// isTokenInitRefused returns true if err shows that the module does not let tokens be initialized through PKCS#11.
+func isTokenInitRefused(err error) bool {
+	return isPKCS11Error(err, pkcs11.CKR_FUNCTION_NOT_SUPPORTED, pkcs11.CKR_FUNCTION_REJECTED,
+		pkcs11.CKR_TOKEN_WRITE_PROTECTED, pkcs11.CKR_ACTION_PROHIBITED)
+}
+
+// initializeToken implements InitializeToken.
+func initializeToken(ctx *pkcs11.Ctx, slot uint, label, soPin, userPin string) error {
+	if _, err := slotWithLabel(ctx, label); err == nil {
+		return fmt.Errorf("a token labelled %q already exists", label)
+	} else if !errors.Is(err, ErrTokenNotFound) {
+		return err
+	}
+
+	info, err := ctx.GetTokenInfo(slot)
+	if err != nil {
+		return withMessagef(err, "reading token in slot %d", slot)
+	}
+	if info.Flags&pkcs11.CKF_TOKEN_INITIALIZED != 0 {
+		return withMessagef(errTokenInitialized, "slot %d", slot)
+	}
+	if info.Flags&pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH != 0 {
+		return withMessage(ErrTokenInitNotSupported, "token uses a protected authentication path")
+	}
+
+	if err = ctx.InitToken(slot, soPin, label); err != nil {
+		if isTokenInitRefused(err) {
+			return withMessagef(ErrTokenInitNotSupported, "C_InitToken: %v", err)
+		}
+		return withMessage(err, "C_InitToken")
+	}
+
+	// Some modules, such as SoftHSM, renumber the slots once a token is initialized.
+	slot, err = slotWithLabel(ctx, label)
+	if err != nil {
+		return withMessagef(err, "finding token %q after C_InitToken", label)
+	}
+
+	session, err := ctx.OpenSession(slot, sessionFlags)
+	if err != nil {
+		return withMessage(err, "opening session on new token")
+	}
+	defer func() { _ = ctx.CloseSession(session) }()
+
+	if err = ctx.Login(session, pkcs11.CKU_SO, soPin); err != nil {
+		return withMessage(err, "logging in as security officer")
+	}
+	defer func() { _ = ctx.Logout(session) }()
+
+	if err = ctx.InitPIN(session, userPin); err != nil {
+		if isTokenInitRefused(err) {
+			return withMessagef(ErrTokenInitNotSupported, "C_InitPIN: %v", err)
+		}
+		return withMessage(err, "C_InitPIN")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitializeTokenArguments(t *testing.T) {
+	assert.Error(t, InitializeToken("unused", 0, "", "so", "user"))
+	assert.Error(t, InitializeToken("unused", 0, "label", "", "user"))
+	assert.Error(t, InitializeToken("unused", 0, "label", "so", ""))
+	assert.Error(t, InitializeToken("unused", 0, strings.Repeat("x", maxTokenLabelLength+1), "so", "user"))
+
+	slot := 0
+	_, err := ConfigureNewToken(&Config{Path: "unused", TokenLabel: "label", Pin: "user", SlotNumber: &slot}, "so")
+	assert.Error(t, err)
+}
+
+// TestConfigureNewToken initializes a token, which stays in the module's token store, so it only runs against
+// modules, such as SoftHSM, that have an uninitialized token to spare.
+func TestConfigureNewToken(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	if config.InitArgs != "" {
+		t.Skip("module needs initialization arguments")
+	}
+
+	label := "crypto11 " + hex.EncodeToString(randomBytes()[:8])
+	ctx, err := ConfigureNewToken(&Config{Path: config.Path, TokenLabel: label, Pin: "user pin"}, "so pin")
+	if errors.Is(err, ErrTokenInitNotSupported) || errors.Is(err, ErrTokenNotFound) {
+		t.Skipf("cannot initialize a token: %v", err)
+	}
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, ctx.Close())
+	}()
+
+	info, err := ctx.ctx.GetTokenInfo(ctx.slot)
+	require.NoError(t, err)
+	require.Equal(t, label, info.Label)
+
+	id := randomBytes()
+	key, err := ctx.GenerateRSAKeyPairForPurpose(id, nil, rsaSize, KeyPurposeSigning)
+	require.NoError(t, err)
+	found, err := ctx.FindKeyPair(id, nil)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	require.NoError(t, key.Delete())
+
+	// The label is taken, and the token is not erased.
+	err = InitializeToken(config.Path, ctx.slot, label, "so pin", "user pin")
+	require.Error(t, err)
+}
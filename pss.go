@@ -0,0 +1,187 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/rsa"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pssSupport records whether the token implements CKM_RSA_PKCS_PSS. It is only checked if
+// Config.SoftwarePSSEncoding is set.
+type pssSupport struct {
+	once     sync.Once
+	software bool
+}
+
+// softwarePSS returns true if PSS signatures must be encoded in software, because Config.SoftwarePSSEncoding is set
+// and the token does not list CKM_RSA_PKCS_PSS. If the mechanism list cannot be read, the token mechanism is used.
+func (c *Context) softwarePSS() bool {
+	if !c.cfg.SoftwarePSSEncoding {
+		return false
+	}
+
+	c.pss.once.Do(func() {
+		mechanisms, err := c.ctx.GetMechanismList(c.slot)
+		if err != nil {
+			return
+		}
+		c.pss.software = true
+		for _, mechanism := range mechanisms {
+			if mechanism.Mechanism == pkcs11.CKM_RSA_PKCS_PSS {
+				c.pss.software = false
+			}
+		}
+	})
+	return c.pss.software
+}
+
+// signPSSSoftware makes a PSS signature by encoding digest in software and signing the result with raw RSA on the
+// token.
+func (priv *pkcs11PrivateKeyRSA) signPSSSoftware(digest []byte, opts *rsa.PSSOptions) ([]byte, error) {
+	input, err := priv.pssSoftwareInput(digest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var signature []byte
+	err = priv.withSession(func(session *pkcs11Session) error {
+		signature, err = signRawRSA(session, priv, input)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// pssSoftwareInput returns the EMSA-PSS encoding of digest, padded to the length of the modulus for raw RSA.
+func (priv *pkcs11PrivateKeyRSA) pssSoftwareInput(digest []byte, opts *rsa.PSSOptions) ([]byte, error) {
+	pub, ok := priv.Public().(*rsa.PublicKey)
+	if !ok || pub.N == nil {
+		return nil, errMalformedRSAPublicKey
+	}
+
+	_, _, hLen, err := hashToPKCS11(opts.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if err = softwareHash(opts.Hash); err != nil {
+		return nil, err
+	}
+	if len(digest) != int(hLen) {
+		return nil, errors.New("digest length does not match the PSS hash function")
+	}
+	sLen, err := pssSaltLength(opts, hLen, pub.N.BitLen())
+	if err != nil {
+		return nil, err
+	}
+
+	random, err := priv.context.nonceReader()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, sLen)
+	if _, err = io.ReadFull(random, salt); err != nil {
+		return nil, withMessage(err, "generating PSS salt")
+	}
+
+	em, err := emsaPSSEncode(digest, pub.N.BitLen()-1, salt, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Raw RSA takes an input as long as the modulus, which em is one byte shorter than if the modulus size is a
+	// multiple of 8 bits plus one.
+	input := make([]byte, (pub.N.BitLen()+7)/8)
+	copy(input[len(input)-len(em):], em)
+	return input, nil
+}
+
+// signRawRSA signs input, which must be as long as the modulus, with raw RSA using the private key of key.
+func signRawRSA(session *pkcs11Session, key *pkcs11PrivateKeyRSA, input []byte) ([]byte, error) {
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_X_509, nil)}
+	if err := session.signInit(mech, key.handle); err != nil {
+		return nil, err
+	}
+	signature, err := session.sign(pkcs11.CKM_RSA_X_509, input)
+	if err != nil {
+		return nil, err
+	}
+	return signature, key.checkSignatureLength(signature)
+}
+
+// emsaPSSEncode computes EMSA-PSS-ENCODE from RFC 8017 section 9.1.1, with MGF1 using the same hash as the message.
+func emsaPSSEncode(mHash []byte, emBits int, salt []byte, opts *rsa.PSSOptions) ([]byte, error) {
+	hLen := opts.Hash.Size()
+	sLen := len(salt)
+	emLen := (emBits + 7) / 8
+	if emLen < hLen+sLen+2 {
+		return nil, errors.New("key too small for PSS signature with this hash and salt length")
+	}
+
+	digester := opts.Hash.New()
+	digester.Write(make([]byte, 8))
+	digester.Write(mHash)
+	digester.Write(salt)
+	h := digester.Sum(nil)
+
+	em := make([]byte, emLen)
+	db := em[:emLen-hLen-1]
+	db[emLen-sLen-hLen-2] = 0x01
+	copy(db[emLen-sLen-hLen-1:], salt)
+
+	mgf1XOR(db, opts.Hash.New(), h)
+	db[0] &= 0xff >> uint(8*emLen-emBits)
+
+	copy(em[emLen-hLen-1:], h)
+	em[emLen-1] = 0xbc
+	return em, nil
+}
+
+// mgf1XOR XORs out with the MGF1 mask generated from seed, as in RFC 8017 appendix B.2.1.
+func mgf1XOR(out []byte, digester hash.Hash, seed []byte) {
+	var counter [4]byte
+	var block []byte
+	for done := 0; done < len(out); {
+		digester.Reset()
+		digester.Write(seed)
+		digester.Write(counter[:])
+		block = digester.Sum(block[:0])
+
+		for i := 0; i < len(block) && done < len(out); i++ {
+			out[done] ^= block[i]
+			done++
+		}
+
+		for i := 3; i >= 0; i-- {
+			counter[i]++
+			if counter[i] != 0 {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// rawRSASign performs a raw RSA private key operation, as CKM_RSA_X_509 does.
+func rawRSASign(key *rsa.PrivateKey, em []byte) []byte {
+	m := new(big.Int).SetBytes(em)
+	s := new(big.Int).Exp(m, key.D, key.N).Bytes()
+	sig := make([]byte, (key.N.BitLen()+7)/8)
+	copy(sig[len(sig)-len(s):], s)
+	return sig
+}
+
+func TestEMSAPSSEncode(t *testing.T) {
+	digest := sha256.Sum256([]byte("encode me"))
+
+	// A modulus of 8n+1 bits gives an encoded message one byte shorter than the modulus.
+	for _, bits := range []int{1024, 1025, 1031} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		require.NoError(t, err)
+
+		for _, saltLength := range []int{rsa.PSSSaltLengthAuto, rsa.PSSSaltLengthEqualsHash, 0, 20} {
+			opts := &rsa.PSSOptions{SaltLength: saltLength, Hash: crypto.SHA256}
+			sLen, err := pssSaltLength(opts, 32, bits)
+			require.NoError(t, err)
+
+			salt := make([]byte, sLen)
+			_, err = rand.Read(salt)
+			require.NoError(t, err)
+
+			em, err := emsaPSSEncode(digest[:], bits-1, salt, opts)
+			require.NoError(t, err)
+			require.Len(t, em, (bits-1+7)/8)
+
+			sig := rawRSASign(key, em)
+			require.NoError(t, rsa.VerifyPSS(&key.PublicKey, crypto.SHA256, digest[:], sig, opts),
+				"bits %d, salt length %d", bits, saltLength)
+		}
+	}
+
+	_, err := emsaPSSEncode(digest[:], 511, make([]byte, 32), &rsa.PSSOptions{Hash: crypto.SHA512})
+	require.Error(t, err)
+}
+
+func TestSoftwarePSSDisabled(t *testing.T) {
+	ctx := &Context{cfg: &Config{}}
+	require.False(t, ctx.softwarePSS())
+}
+
+func TestSoftwarePSSSigning(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeSigning)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		sign := func(t *testing.T) {
+			pub := key.Public().(*rsa.PublicKey)
+			digest := sha256.Sum256([]byte("software PSS"))
+			for _, saltLength := range []int{rsa.PSSSaltLengthAuto, rsa.PSSSaltLengthEqualsHash, 20} {
+				opts := &rsa.PSSOptions{SaltLength: saltLength, Hash: crypto.SHA256}
+				sig, err := key.Sign(nil, digest[:], opts)
+				require.NoError(t, err)
+				require.NoError(t, rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, opts))
+			}
+		}
+
+		ctx.cfg.SoftwarePSSEncoding = true
+
+		t.Run("Native", func(t *testing.T) {
+			skipIfMechUnsupported(t, ctx, pkcs11.CKM_RSA_PKCS_PSS)
+			require.False(t, ctx.softwarePSS())
+			sign(t)
+		})
+
+		t.Run("Software", func(t *testing.T) {
+			skipIfMechUnsupported(t, ctx, pkcs11.CKM_RSA_X_509)
+			// Force the fallback on a token that implements PSS.
+			ctx.pss = pssSupport{}
+			ctx.pss.once.Do(func() { ctx.pss.software = true })
+			require.True(t, ctx.softwarePSS())
+			sign(t)
+		})
+	})
+}
@@ -0,0 +1,338 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// verifyMessageChunkSize is the amount of data passed to each C_VerifyUpdate call by VerifyMessage.
+const verifyMessageChunkSize = 64 * 1024
+
+// ErrLoginRequired is returned by operations on private or secret keys when the Context was configured with
+// Config.PublicOnly.
+var ErrLoginRequired = errors.New("operation requires login, but the Context is configured with PublicOnly")
+
+// PublicKey is a reference to a public key object on the token. Public keys can be used without logging in, see
+// Config.PublicOnly.
+type PublicKey struct {
+	pkcs11Object
+
+	// keyType is the CKA_KEY_TYPE of the key.
+	keyType uint
+
+	// pub is an exported copy of the public key, or nil if the token does not allow it to be read.
+	pub crypto.PublicKey
+
+	// modulusBits is the CKA_MODULUS_BITS of an RSA key whose public key cannot be read, or zero if it is unknown.
+	modulusBits int
+}
+
+// FindPublicKey retrieves a public key object, or nil if it cannot be found.
+//
+// Either (but not both) of id and label may be nil, in which case they are ignored. An empty, non-nil id or label
+// only matches keys whose attribute is present and empty.
+func (c *Context) FindPublicKey(id []byte, label []byte) (*PublicKey, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if id == nil && label == nil {
+		return nil, errors.New("id and label cannot both be nil")
+	}
+
+	var key *PublicKey
+	err := c.withSession(func(session *pkcs11Session) error {
+		handle, err := findKey(session, id, label, uintPtr(pkcs11.CKO_PUBLIC_KEY), nil)
+		if err != nil || handle == nil {
+			return err
+		}
+
+		attributes := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil)}
+		if attributes, err = session.ctx.GetAttributeValue(session.handle, *handle, attributes); err != nil {
+			return err
+		}
+		keyType := bytesToUlong(attributes[0].Value)
+
+		var pub crypto.PublicKey
+		var modulusBits int
+		switch keyType {
+		case pkcs11.CKK_RSA:
+			pub, err = exportRSAPublicKey(session, *handle)
+			if isPKCS11Error(err, pkcs11.CKR_ATTRIBUTE_SENSITIVE, pkcs11.CKR_ATTRIBUTE_TYPE_INVALID) {
+				// The key can still be used on the token, see Encrypt.
+				pub, err = nil, nil
+				modulusBits = readModulusBits(session, *handle)
+			}
+		case pkcs11.CKK_ECDSA:
+			pub, err = exportECDSAPublicKey(session, *handle)
+		case pkcs11.CKK_DSA:
+			pub, err = exportDSAPublicKey(session, *handle)
+		case ckkECEdwards:
+			pub, err = exportEdwardsPublicKey(session, *handle)
+		case ckkECMontgomery:
+			pub, err = exportX25519PublicKey(session, *handle)
+		default:
+			return fmt.Errorf("unsupported key type: %X", keyType)
+		}
+		if err != nil {
+			return err
+		}
+
+		key = &PublicKey{pkcs11Object: pkcs11Object{handle: *handle, context: c}, keyType: keyType, pub: pub,
+			modulusBits: modulusBits}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// readModulusBits returns the CKA_MODULUS_BITS of an RSA key, or zero if it cannot be read.
+func readModulusBits(session *pkcs11Session, handle pkcs11.ObjectHandle) int {
+	attributes := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, nil)}
+	attributes, err := session.ctx.GetAttributeValue(session.handle, handle, attributes)
+	if err != nil || len(attributes[0].Value) == 0 {
+		return 0
+	}
+	return int(bytesToUlong(attributes[0].Value))
+}
+
+// Public returns the public key. It returns nil for an RSA key whose public key attributes the token does not allow
+// to be read; such a key can only be used with Encrypt and VerifyMessage.
+func (k *PublicKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Verify checks a signature over digest on the token. Signatures are encoded as returned by the Sign methods of
+// key pairs: DER for ECDSA and DSA, raw for RSA. For RSA keys, opts may be *rsa.PSSOptions to verify a PSS
+// signature, otherwise PKCS#1 v1.5 is used with opts.HashFunc(). For ECDSA keys, opts may be
+// *ECDSASignatureOptions to accept raw r||s signatures or lenient DER; by default ECDSA signatures must be minimal
+// DER. opts is ignored for DSA keys.
+//
+// rsa.PSSSaltLengthAuto differs from crypto/rsa. rsa.VerifyPSS detects the salt length from the signature, but the
+// token cannot, so only a signature with the longest salt the modulus allows is accepted, which is what crypto/rsa
+// produces when signing. To verify signatures with any other salt length, pass that length in opts.SaltLength, or
+// call rsa.VerifyPSS with Public().
+//
+// A nil error is returned if the signature is valid. Otherwise, the token error is returned, typically
+// CKR_SIGNATURE_INVALID or CKR_SIGNATURE_LEN_RANGE.
+func (k *PublicKey) Verify(digest, signature []byte, opts crypto.SignerOpts) error {
+	mech, digest, signature, err := verifyMechanism(k.pub, k.keyType, digest, signature, opts)
+	if err != nil {
+		return err
+	}
+	if err = k.context.checkOptionsHashes(opts); err != nil {
+		return err
+	}
+	return k.withSession(func(session *pkcs11Session) error {
+		return verifyOnToken(session, k.handle, mech, digest, signature)
+	})
+}
+
+// verifyMechanism returns the mechanism that verifies signature over digest with pub, as described for Verify, and
+// the digest and signature in the form the mechanism takes.
+func verifyMechanism(pub crypto.PublicKey, keyType uint, digest, signature []byte,
+	opts crypto.SignerOpts) (mech []*pkcs11.Mechanism, tokenDigest, tokenSignature []byte, err error) {
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if pub.N == nil {
+			return nil, nil, nil, errMalformedRSAPublicKey
+		}
+		if isNilPointer(opts) {
+			return nil, nil, nil, errUnsupportedRSAOptions
+		}
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			if mech, err = pssMechanism(pssOpts, pub.N.BitLen()); err != nil {
+				return nil, nil, nil, err
+			}
+		} else {
+			if opts == nil {
+				return nil, nil, nil, errUnsupportedRSAOptions
+			}
+			mech = []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
+			if digest, err = pkcs1v15DigestInfo(opts.HashFunc(), digest); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+
+	case *ecdsa.PublicKey:
+		mech = []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+		sigOpts := ECDSASignatureOptions{Encoding: ECDSASignatureDER}
+		if o, ok := opts.(*ECDSASignatureOptions); ok && o != nil {
+			sigOpts = *o
+		}
+		r, s, err := ParseECDSASignatureWithOptions(signature, pub.Curve, sigOpts)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if signature, err = MarshalECDSASignatureRaw(r, s, pub.Curve); err != nil {
+			return nil, nil, nil, err
+		}
+
+	case *dsa.PublicKey:
+		if pub.Q == nil {
+			return nil, nil, nil, errMalformedDSAPublicKey
+		}
+		mech = []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_DSA, nil)}
+		if signature, err = rawDSASignature(signature, (pub.Q.BitLen()+7)/8); err != nil {
+			return nil, nil, nil, err
+		}
+
+	case ed25519.PublicKey:
+		if opts != nil && opts.HashFunc() != 0 {
+			return nil, nil, nil, errUnsupportedEd25519Options
+		}
+		mech = []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmEdDSA, nil)}
+
+	case Ed448PublicKey:
+		if opts != nil && opts.HashFunc() != 0 {
+			return nil, nil, nil, errUnsupportedEd25519Options
+		}
+		mech = []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmEdDSA, ed448Params())}
+
+	case nil:
+		return nil, nil, nil, errors.New("public key is not readable")
+
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported key type: %X", keyType)
+	}
+
+	return mech, digest, signature, nil
+}
+
+// verifyOnToken checks signature over digest with mech and the public key object handle.
+func verifyOnToken(session *pkcs11Session, handle pkcs11.ObjectHandle, mech []*pkcs11.Mechanism, digest,
+	signature []byte) error {
+
+	if err := session.verifyInit(mech, handle); err != nil {
+		return err
+	}
+	return session.verify(digest, signature)
+}
+
+// rawDSASignature converts a DER-encoded DSA or ECDSA signature to the raw form used by PKCS#11.
+func rawDSASignature(sigDER []byte, size int) ([]byte, error) {
+	var sig dsaSignature
+	if err := sig.unmarshalDER(sigDER); err != nil {
+		return nil, err
+	}
+	return sig.marshalBytes(size)
+}
+
+// Encrypt encrypts plaintext on the token using an RSA key. opts takes the same values as for the Decrypt method
+// of key pairs: if opts is *rsa.OAEPOptions, RSA-OAEP is used; if it is *RawRSADecryptOptions, raw RSA; otherwise
+// PKCS#1 v1.5 encryption. rsa.ErrMessageTooLong is returned if plaintext is longer than the padding allows: k-11
+// bytes for PKCS#1 v1.5, k-2*hLen-2 for RSA-OAEP and k for raw RSA, for a k-byte modulus and hLen-byte hash. If the
+// modulus size cannot be read, the token checks the length instead.
+func (k *PublicKey) Encrypt(plaintext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if k.keyType != pkcs11.CKK_RSA {
+		return nil, fmt.Errorf("encryption is not supported for key type: %X", k.keyType)
+	}
+
+	size := (k.modulusBits + 7) / 8
+	if pub, ok := k.pub.(*rsa.PublicKey); ok {
+		size = (pub.N.BitLen() + 7) / 8
+	}
+	mech, err := rsaEncryptMechanism(plaintext, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = k.context.checkOptionsHashes(opts); err != nil {
+		return nil, err
+	}
+
+	var ciphertext []byte
+	err = k.withSession(func(session *pkcs11Session) (err error) {
+		ciphertext, err = rsaEncrypt(session, k.handle, mech, plaintext, size, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 {
+		if err = k.context.checkOutputLength("RSA ciphertext", "the modulus length", size, ciphertext); err != nil {
+			return nil, err
+		}
+	}
+	return ciphertext, nil
+}
+
+// VerifyMessage checks a signature over the data read from r, which is hashed on the token with hash. The data is
+// passed to the token in chunks, using a single session for the whole message. RSA signatures use PKCS#1 v1.5, and
+// ECDSA and DSA signatures are DER-encoded, as returned by the Sign methods of key pairs.
+//
+// A nil error is returned if the signature is valid. If reading r fails, the read error is returned.
+func (k *PublicKey) VerifyMessage(r io.Reader, signature []byte, hash crypto.Hash) error {
+	mechanism, err := lookupSignMechanism(k.keyType, hash, false)
+	if err != nil {
+		return err
+	}
+
+	switch pub := k.pub.(type) {
+	case *ecdsa.PublicKey:
+		signature, err = rawDSASignature(signature, ecdsaCurveSize(pub.Curve))
+	case *dsa.PublicKey:
+		signature, err = rawDSASignature(signature, (pub.Q.BitLen()+7)/8)
+	}
+	if err != nil {
+		return err
+	}
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}
+	return k.withSession(func(session *pkcs11Session) error {
+		if err := session.verifyInit(mech, k.handle); err != nil {
+			return err
+		}
+
+		buf := make([]byte, verifyMessageChunkSize)
+		for {
+			n, readErr := r.Read(buf)
+			if n > 0 {
+				if err := session.verifyUpdate(buf[:n]); err != nil {
+					return err
+				}
+			}
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				// There is no way to cancel an operation, but finishing it releases the session for reuse.
+				_ = session.verifyFinal(nil)
+				return readErr
+			}
+		}
+
+		return session.verifyFinal(signature)
+	})
+}
@@ -0,0 +1,222 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicOnlyRejectsPin(t *testing.T) {
+	_, err := Configure(&Config{TokenLabel: "token", Pin: "1234", PublicOnly: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "PublicOnly")
+}
+
+func TestShouldLoginPublicOnly(t *testing.T) {
+	login, err := shouldLogin(&Config{PublicOnly: true}, &pkcs11.TokenInfo{Flags: pkcs11.CKF_LOGIN_REQUIRED})
+	require.NoError(t, err)
+	assert.False(t, login)
+}
+
+func TestRawDSASignature(t *testing.T) {
+	sig := dsaSignature{R: big.NewInt(0x0102), S: big.NewInt(0x03)}
+	der, err := sig.marshalDER()
+	require.NoError(t, err)
+
+	raw, err := rawDSASignature(der, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 1, 2, 0, 0, 0, 3}, raw)
+
+	_, err = rawDSASignature(der, 1)
+	assert.Error(t, err)
+}
+
+// withPublicOnlyContext runs f with a Context for the test token that does not log in.
+func withPublicOnlyContext(t *testing.T, f func(ctx *Context)) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.Pin = ""
+	config.PublicOnly = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	f(ctx)
+}
+
+// publicKeyTemplates returns templates for a key pair whose public half can be read without logging in.
+func publicKeyTemplates(t *testing.T, id []byte) (public, private AttributeSet) {
+	public, err := NewAttributeSetWithID(id)
+	require.NoError(t, err)
+	require.NoError(t, public.Set(CkaPrivate, false))
+	private, err = NewAttributeSetWithID(id)
+	require.NoError(t, err)
+	return public, private
+}
+
+func TestPublicOnlyRSA(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		public, private := publicKeyTemplates(t, id)
+		key, err := ctx.GenerateRSAKeyPairWithAttributes(public, private, rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		digest := sha256.Sum256([]byte("verify only"))
+		sig, err := key.Sign(nil, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+		pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		pssSig, err := key.Sign(nil, digest[:], pssOpts)
+		require.NoError(t, err)
+
+		var ciphertext []byte
+		withPublicOnlyContext(t, func(publicCtx *Context) {
+			pub, err := publicCtx.FindPublicKey(id, nil)
+			require.NoError(t, err)
+			require.NotNil(t, pub)
+			assert.True(t, publicKeysEqual(key.Public(), pub.Public()))
+
+			require.NoError(t, pub.Verify(digest[:], sig, crypto.SHA256))
+			require.NoError(t, pub.Verify(digest[:], pssSig, pssOpts))
+
+			sig[0] ^= 0xff
+			assert.Error(t, pub.Verify(digest[:], sig, crypto.SHA256))
+
+			ciphertext, err = pub.Encrypt([]byte("secret"), &rsa.OAEPOptions{Hash: crypto.SHA256})
+			require.NoError(t, err)
+
+			_, err = publicCtx.FindKeyPair(id, nil)
+			assert.True(t, errors.Is(err, ErrLoginRequired))
+		})
+
+		plaintext, err := key.Decrypt(nil, ciphertext, &rsa.OAEPOptions{Hash: crypto.SHA256})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("secret"), plaintext)
+	})
+}
+
+func TestPublicOnlyECDSA(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		public, private := publicKeyTemplates(t, id)
+		key, err := ctx.GenerateECDSAKeyPairWithAttributes(public, private, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		digest := sha256.Sum256([]byte("verify only"))
+		sig, err := key.Sign(nil, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+
+		withPublicOnlyContext(t, func(publicCtx *Context) {
+			pub, err := publicCtx.FindPublicKey(id, nil)
+			require.NoError(t, err)
+			require.NotNil(t, pub)
+
+			require.NoError(t, pub.Verify(digest[:], sig, crypto.SHA256))
+
+			digest[0] ^= 0xff
+			assert.Error(t, pub.Verify(digest[:], sig, crypto.SHA256))
+
+			_, err = pub.Encrypt([]byte("secret"), nil)
+			assert.Error(t, err)
+
+			_, err = publicCtx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+			assert.Equal(t, ErrLoginRequired, err)
+		})
+	})
+}
+
+// failingReader returns some data, then an error.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestVerifyMessage(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		// Several chunks, with a partial chunk at the end
+		message := make([]byte, 3*verifyMessageChunkSize+17)
+		_, err := rand.Read(message)
+		require.NoError(t, err)
+		digest := sha256.Sum256(message)
+
+		rsaID := randomBytes()
+		public, private := publicKeyTemplates(t, rsaID)
+		rsaKey, err := ctx.GenerateRSAKeyPairWithAttributes(public, private, rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = rsaKey.Delete() }()
+
+		ecID := randomBytes()
+		public, private = publicKeyTemplates(t, ecID)
+		ecKey, err := ctx.GenerateECDSAKeyPairWithAttributes(public, private, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = ecKey.Delete() }()
+
+		for _, tc := range []struct {
+			id  []byte
+			key Signer
+		}{{rsaID, rsaKey}, {ecID, ecKey}} {
+			sig, err := tc.key.Sign(nil, digest[:], crypto.SHA256)
+			require.NoError(t, err)
+
+			pub, err := ctx.FindPublicKey(tc.id, nil)
+			require.NoError(t, err)
+			require.NotNil(t, pub)
+
+			require.NoError(t, pub.VerifyMessage(bytes.NewReader(message), sig, crypto.SHA256))
+
+			tampered := append([]byte{}, message...)
+			tampered[len(tampered)-1] ^= 1
+			assert.Error(t, pub.VerifyMessage(bytes.NewReader(tampered), sig, crypto.SHA256))
+
+			err = pub.VerifyMessage(&failingReader{data: message[:100]}, sig, crypto.SHA256)
+			assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+			// The session used by the failed call must still be usable
+			require.NoError(t, pub.Verify(digest[:], sig, crypto.SHA256))
+
+			assert.Error(t, pub.VerifyMessage(bytes.NewReader(message), sig, crypto.MD5))
+		}
+	})
+}
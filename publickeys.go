@@ -0,0 +1,161 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"math/big"
+	"math/bits"
+	"sync/atomic"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PublicKeyStats describes the public key material retained in memory by key pairs loaded from a Context.
+type PublicKeyStats struct {
+	// Keys is the number of live key pair objects holding a copy of their public key.
+	Keys int64
+
+	// RetainedBytes is an estimate of the memory used by the retained public keys. Only the key material is
+	// counted, not the Go object headers around it.
+	RetainedBytes int64
+}
+
+// publicKeyAccounting tracks the public keys retained by a Context's key pairs. A nil *publicKeyAccounting records
+// nothing.
+type publicKeyAccounting struct {
+	// Atomic fields, accessed with sync/atomic
+	keys  int64
+	bytes int64
+}
+
+// add records that a key of the given size has been retained (n=1) or released (n=-1).
+func (a *publicKeyAccounting) add(n, size int64) {
+	if a == nil {
+		return
+	}
+	atomic.AddInt64(&a.keys, n)
+	atomic.AddInt64(&a.bytes, n*size)
+}
+
+func (a *publicKeyAccounting) snapshot() PublicKeyStats {
+	if a == nil {
+		return PublicKeyStats{}
+	}
+	return PublicKeyStats{
+		Keys:          atomic.LoadInt64(&a.keys),
+		RetainedBytes: atomic.LoadInt64(&a.bytes),
+	}
+}
+
+// PublicKeyStats reports the public key material retained by key pairs loaded from the Context. A key pair is counted
+// from when it is loaded until it is deleted with Delete, so a key pair value that is dropped without being deleted
+// stays counted; count the key pairs an application holds, not each Find call. See also Config.ReleasePublicKeys.
+func (c *Context) PublicKeyStats() PublicKeyStats {
+	return c.publicKeys.snapshot()
+}
+
+// retainPublicKey stores pub as the public half of k. If Config.ReleasePublicKeys is set and k has a public key object,
+// pub is discarded and k.Public re-reads it from the token instead.
+func (c *Context) retainPublicKey(k *pkcs11PrivateKey, pub crypto.PublicKey) {
+	if c.cfg.ReleasePublicKeys && k.pubKeyHandle != 0 {
+		switch pub.(type) {
+		case *rsa.PublicKey:
+			k.pubKeyExport = exportRSAPublicKey
+		case *ecdsa.PublicKey:
+			k.pubKeyExport = exportECDSAPublicKey
+		case *dsa.PublicKey:
+			k.pubKeyExport = exportDSAPublicKey
+		case ed25519.PublicKey, Ed448PublicKey:
+			k.pubKeyExport = exportEdwardsPublicKey
+		case X25519PublicKey:
+			k.pubKeyExport = exportX25519PublicKey
+		}
+		if k.pubKeyExport != nil {
+			k.signatureLength = signatureLengthOf(pub)
+			return
+		}
+	}
+	c.keepPublicKey(k, pub)
+}
+
+// keepPublicKey stores pub as the public half of k, and counts it in Context.PublicKeyStats until
+// stopCountingPublicKey is called. k is counted at most once, however often it is kept.
+func (c *Context) keepPublicKey(k *pkcs11PrivateKey, pub crypto.PublicKey) {
+	k.pubKey = pub
+	k.signatureLength = signatureLengthOf(pub)
+
+	if c.publicKeys != nil && atomic.CompareAndSwapInt32(&k.retained, 0, 1) {
+		c.publicKeys.add(1, publicKeySize(pub))
+	}
+}
+
+// stopCountingPublicKey stops counting the public key of k in Context.PublicKeyStats. It is called when the key pair is
+// deleted, and for key pairs that are loaded only to be discarded.
+func (k *pkcs11PrivateKey) stopCountingPublicKey() {
+	if atomic.CompareAndSwapInt32(&k.retained, 1, 0) {
+		k.context.publicKeys.add(-1, publicKeySize(k.pubKey))
+	}
+}
+
+// exportPublicKey re-reads a released public key from the token.
+func (k *pkcs11PrivateKey) exportPublicKey() (pub crypto.PublicKey, err error) {
+	err = k.withSession(func(session *pkcs11Session) error {
+		pub, err = k.pubKeyExport(session, k.pubKeyHandle)
+		return err
+	})
+	return pub, err
+}
+
+// publicKeySize estimates the number of bytes of key material held by pub.
+func publicKeySize(pub crypto.PublicKey) int64 {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return bigIntSize(pub.N) + bits.UintSize/8
+	case *ecdsa.PublicKey:
+		return bigIntSize(pub.X) + bigIntSize(pub.Y)
+	case *dsa.PublicKey:
+		return bigIntSize(pub.P) + bigIntSize(pub.Q) + bigIntSize(pub.G) + bigIntSize(pub.Y)
+	case ed25519.PublicKey:
+		return int64(cap(pub))
+	case Ed448PublicKey:
+		return int64(cap(pub))
+	case X25519PublicKey:
+		return int64(cap(pub))
+	default:
+		return 0
+	}
+}
+
+func bigIntSize(x *big.Int) int64 {
+	if x == nil {
+		return 0
+	}
+	return int64(cap(x.Bits()) * bits.UintSize / 8)
+}
+
+// exportPublicKeyFunc is the signature of exportRSAPublicKey and friends.
+type exportPublicKeyFunc func(session *pkcs11Session, pubHandle pkcs11.ObjectHandle) (crypto.PublicKey, error)
@@ -0,0 +1,173 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"math/big"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// benchmarkKeyPairCount is the number of key pairs loaded by BenchmarkLoadKeyPairs.
+const benchmarkKeyPairCount = 10000
+
+func TestPublicKeySize(t *testing.T) {
+	modulus := func(bits uint) *big.Int {
+		return new(big.Int).Lsh(big.NewInt(1), bits-1)
+	}
+
+	small := publicKeySize(&rsa.PublicKey{N: modulus(2048), E: 65537})
+	large := publicKeySize(&rsa.PublicKey{N: modulus(4096), E: 65537})
+	assert.True(t, small >= 256, "RSA-2048 key material is at least 256 bytes, got %d", small)
+	assert.True(t, large >= 512, "RSA-4096 key material is at least 512 bytes, got %d", large)
+	assert.True(t, large > small)
+
+	assert.Equal(t, int64(0), publicKeySize(nil))
+}
+
+func TestPublicKeyAccounting(t *testing.T) {
+	var nilAccounting *publicKeyAccounting
+	nilAccounting.add(1, 100)
+	assert.Equal(t, PublicKeyStats{}, nilAccounting.snapshot())
+
+	a := &publicKeyAccounting{}
+	a.add(1, 100)
+	a.add(1, 50)
+	a.add(-1, 100)
+	assert.Equal(t, PublicKeyStats{Keys: 1, RetainedBytes: 50}, a.snapshot())
+}
+
+func TestPublicKeyStats(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		before := ctx.PublicKeyStats()
+
+		key, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		after := ctx.PublicKeyStats()
+		assert.Equal(t, before.Keys+1, after.Keys)
+		assert.Equal(t, before.RetainedBytes+publicKeySize(key.Public()), after.RetainedBytes)
+
+		// Keeping the public key again, as re-pinning does, must not count it twice
+		k := tokenKeyOf(key)
+		ctx.keepPublicKey(k, k.pubKey)
+		assert.Equal(t, after, ctx.PublicKeyStats())
+
+		require.NoError(t, key.Delete())
+		assert.Equal(t, before, ctx.PublicKeyStats())
+	})
+}
+
+func TestReleasePublicKeys(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.ReleasePublicKeys = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	id := randomBytes()
+	key, err := ctx.GenerateECDSAKeyPair(id, elliptic.P256())
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	found, err := ctx.FindKeyPair(id, nil)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+
+	assert.Equal(t, PublicKeyStats{}, ctx.PublicKeyStats())
+
+	// The public key is re-read from the token, and must still match the generated key
+	require.NotNil(t, key.Public())
+	assert.True(t, publicKeysEqual(key.Public(), found.Public()))
+
+	testEcdsaSigning(t, found, crypto.SHA256, "P-256", "SHA-256")
+}
+
+func BenchmarkLoadKeyPairs(b *testing.B) {
+	ctx, err := ConfigureFromFile("config")
+	require.NoError(b, err)
+	defer func() { require.NoError(b, ctx.Close()) }()
+
+	// ECDSA keys are used because generating thousands of large RSA keys takes too long. PublicKeyStats shows the
+	// per-key difference for RSA keys is proportionally larger.
+	label := randomBytes()
+	keys := make([]Signer, 0, benchmarkKeyPairCount)
+	defer func() {
+		for _, key := range keys {
+			_ = key.Delete()
+		}
+	}()
+	for i := 0; i < benchmarkKeyPairCount; i++ {
+		key, err := ctx.GenerateECDSAKeyPairWithLabel(randomBytes(), label, elliptic.P256())
+		require.NoError(b, err)
+		keys = append(keys, key)
+	}
+
+	for _, release := range []bool{false, true} {
+		name := "retained"
+		if release {
+			name = "released"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			config, err := loadConfigFromFile("config")
+			require.NoError(b, err)
+			config.ReleasePublicKeys = release
+
+			loader, err := Configure(config)
+			require.NoError(b, err)
+			defer func() { require.NoError(b, loader.Close()) }()
+
+			for i := 0; i < b.N; i++ {
+				before := heapAlloc()
+				retained := loader.PublicKeyStats().RetainedBytes
+				found, err := loader.FindKeyPairs(nil, label)
+				require.NoError(b, err)
+				require.Len(b, found, benchmarkKeyPairCount)
+
+				b.StopTimer()
+				b.ReportMetric(float64(heapAlloc()-before)/float64(len(found)), "heap-B/key")
+				b.ReportMetric(float64(loader.PublicKeyStats().RetainedBytes-retained)/float64(len(found)),
+					"pubkey-B/key")
+				runtime.KeepAlive(found)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// heapAlloc returns the number of bytes allocated on the heap after a garbage collection.
+func heapAlloc() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
@@ -22,9 +22,27 @@
 package crypto11
 
 import (
+	"crypto/rand"
+	"errors"
 	"io"
+
+	"github.com/miekg/pkcs11"
 )
 
+// generatedIDLength is the length of the CKA_ID values crypto11 generates when Config.GeneratedIDLength is zero.
+const generatedIDLength = 16
+
+// minGeneratedIDLength is the smallest permitted Config.GeneratedIDLength.
+const minGeneratedIDLength = 8
+
+// generatedIDAttempts bounds the number of random values GenerateID tries. With a working random number generator
+// even a single collision is vanishingly unlikely, so running out of attempts means the generator is faulty.
+const generatedIDAttempts = 8
+
+// ErrNoUniqueID is wrapped by the error returned when GenerateID cannot find an unused CKA_ID. This indicates a
+// faulty random number generator (see Config.Rand), rather than an unlucky draw.
+var ErrNoUniqueID = errors.New("could not generate an unused CKA_ID")
+
 // NewRandomReader returns a reader for the random number generator on the token.
 func (c *Context) NewRandomReader() (io.Reader, error) {
 	if c.closed.Get() {
@@ -52,3 +70,68 @@ func (r pkcs11RandReader) Read(data []byte) (n int, err error) {
 	copy(data, result)
 	return len(result), err
 }
+
+// randReader returns the reader for randomness generated by crypto11 itself, see Config.Rand.
+func (c *Context) randReader() io.Reader {
+	if c.cfg.Rand != nil {
+		return c.cfg.Rand
+	}
+	return rand.Reader
+}
+
+// nonceReader returns the reader for random values that are not key material. This is the token random number
+// generator unless Config.UseRandForTokenNonces is set.
+func (c *Context) nonceReader() (io.Reader, error) {
+	if c.cfg.Rand != nil && c.cfg.UseRandForTokenNonces {
+		return c.cfg.Rand, nil
+	}
+	return c.NewRandomReader()
+}
+
+// GenerateID returns a random CKA_ID of Config.GeneratedIDLength bytes, read from Config.Rand, that no object
+// visible to the Context carries. Values already in use are discarded and fresh ones drawn; if none of
+// several attempts is unused, an error wrapping ErrNoUniqueID is returned. Objects the Context cannot see, such as
+// private objects when it is configured with PublicOnly, are not checked.
+func (c *Context) GenerateID() ([]byte, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+	return c.generateID()
+}
+
+// generateID implements GenerateID.
+func (c *Context) generateID() ([]byte, error) {
+	for attempt := 0; attempt < generatedIDAttempts; attempt++ {
+		id, err := c.randomID()
+		if err != nil {
+			return nil, err
+		}
+
+		inUse := false
+		template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, id)}
+		err = c.scanObjects(template, func(_ *pkcs11Session, handles []pkcs11.ObjectHandle) error {
+			inUse = inUse || len(handles) > 0
+			return nil
+		})
+		if err != nil {
+			return nil, withMessage(err, "checking generated CKA_ID")
+		}
+		if !inUse {
+			return id, nil
+		}
+	}
+	return nil, withMessagef(ErrNoUniqueID, "%d random values were all in use", generatedIDAttempts)
+}
+
+// randomID returns a random CKA_ID of Config.GeneratedIDLength bytes read from Config.Rand.
+func (c *Context) randomID() ([]byte, error) {
+	length := c.cfg.GeneratedIDLength
+	if length == 0 {
+		length = generatedIDLength
+	}
+	id := make([]byte, length)
+	if _, err := io.ReadFull(c.randReader(), id); err != nil {
+		return nil, withMessage(err, "generating CKA_ID")
+	}
+	return id, nil
+}
@@ -22,8 +22,15 @@
 package crypto11
 
 import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"errors"
+	mathrand "math/rand"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -46,3 +53,90 @@ func TestRandomReader(t *testing.T) {
 		require.Equal(t, size, n)
 	}
 }
+
+func TestRandSelection(t *testing.T) {
+	ctx := &Context{cfg: &Config{}}
+	assert.Equal(t, rand.Reader, ctx.randReader())
+
+	custom := bytes.NewReader(make([]byte, 64))
+	ctx.cfg.Rand = custom
+	assert.Equal(t, custom, ctx.randReader())
+
+	ctx.cfg.UseRandForTokenNonces = true
+	reader, err := ctx.nonceReader()
+	require.NoError(t, err)
+	assert.Equal(t, custom, reader)
+}
+
+func TestGenerateIDFromRand(t *testing.T) {
+	ids := make([][]byte, 2)
+	for i := range ids {
+		ctx := &Context{cfg: &Config{Rand: mathrand.New(mathrand.NewSource(42))}}
+		id, err := ctx.randomID()
+		require.NoError(t, err)
+		require.Len(t, id, generatedIDLength)
+		ids[i] = id
+	}
+	assert.Equal(t, ids[0], ids[1])
+
+	ctx := &Context{cfg: &Config{Rand: bytes.NewReader(nil), GeneratedIDLength: 32}}
+	_, err := ctx.randomID()
+	assert.Error(t, err)
+
+	ctx.cfg.Rand = bytes.NewReader(make([]byte, 32))
+	id, err := ctx.randomID()
+	require.NoError(t, err)
+	assert.Len(t, id, 32)
+
+	assert.NoError(t, (&Config{TokenLabel: "t", Pin: "p", GeneratedIDLength: minGeneratedIDLength}).Validate())
+	assert.Error(t, (&Config{TokenLabel: "t", Pin: "p", GeneratedIDLength: minGeneratedIDLength - 1}).Validate())
+}
+
+func TestGenerateIDAvoidsCollisions(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()[:generatedIDLength]
+		key, err := ctx.GenerateSecretKey(id, 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, key.Delete()) }()
+
+		// A faulty generator that always returns the same value never yields an unused ID.
+		ctx.cfg.Rand = bytes.NewReader(bytes.Repeat(id, generatedIDAttempts))
+		_, err = ctx.GenerateID()
+		assert.True(t, errors.Is(err, ErrNoUniqueID))
+
+		// A collision is discarded and the next value used.
+		fresh := randomBytes()[:generatedIDLength]
+		ctx.cfg.Rand = bytes.NewReader(append(append([]byte{}, id...), fresh...))
+		generated, err := ctx.GenerateID()
+		require.NoError(t, err)
+		assert.Equal(t, fresh, generated)
+	})
+}
+
+func TestProvisionIdentityWithDeterministicRand(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	var results []IdentityResult
+	for i := 0; i < 2; i++ {
+		config.Rand = mathrand.New(mathrand.NewSource(42))
+
+		result, err := ctx.ProvisionIdentity(IdentityRequest{
+			Key:                  KeyRequest{Curve: elliptic.P256()},
+			Subject:              pkix.Name{CommonName: "service.example.com"},
+			BootstrapCertificate: true,
+		})
+		require.NoError(t, err)
+		require.NoError(t, ctx.DeleteCertificate(result.ID, nil, nil))
+		require.NoError(t, result.Signer.Delete())
+		results = append(results, result)
+	}
+
+	assert.Len(t, results[0].ID, generatedIDLength)
+	assert.Equal(t, results[0].ID, results[1].ID)
+	assert.Equal(t, results[0].Certificate.SerialNumber, results[1].Certificate.SerialNumber)
+}
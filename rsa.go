@@ -24,7 +24,9 @@ package crypto11
 import (
 	"crypto"
 	"crypto/rsa"
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
 
@@ -34,19 +36,117 @@ import (
 // errMalformedRSAPublicKey is returned when an RSA public key is not in a suitable form.
 //
 // Currently this means that the public exponent is either bigger than
-// 32 bits, or less than 2.
+// 31 bits, or less than 2; or that the modulus is even or too small.
 var errMalformedRSAPublicKey = errors.New("malformed RSA public key")
 
 // errUnsupportedRSAOptions is returned when an unsupported RSA option is requested.
 //
-// Currently this means a nontrivial SessionKeyLen when decrypting; or
-// an unsupported hash function; or crypto.rsa.PSSSaltLengthAuto was
-// requested.
+// Currently this means an unsupported hash function or PSS salt length.
 var errUnsupportedRSAOptions = errors.New("unsupported RSA option value")
 
+// KeyPurpose declares what a generated RSA key pair will be used for. It determines the usage attributes set on the
+// key pair. Purposes combine as a bitmask, for instance KeyPurposeDecryption | KeyPurposeUnwrapping.
+type KeyPurpose int
+
+const (
+	// KeyPurposeSigning keys have CKA_SIGN set on the private key and CKA_VERIFY on the public key.
+	KeyPurposeSigning KeyPurpose = iota + 1
+
+	// KeyPurposeDecryption keys have CKA_DECRYPT set on the private key and CKA_ENCRYPT on the public key.
+	KeyPurposeDecryption
+
+	// KeyPurposeBoth keys permit both signing and decryption.
+	KeyPurposeBoth
+
+	// KeyPurposeUnwrapping keys have CKA_UNWRAP set on the private key and CKA_WRAP on the public key, so that they
+	// can unwrap keys onto the token, see UnwrapPrivateKey and UnwrapEnvelopeKey.
+	KeyPurposeUnwrapping KeyPurpose = 4
+)
+
+// keyPurposeAll is the combination of every KeyPurpose.
+const keyPurposeAll = KeyPurposeSigning | KeyPurposeDecryption | KeyPurposeUnwrapping
+
+// errInvalidKeyPurpose is returned when a KeyPurpose is not one of the defined values.
+var errInvalidKeyPurpose = errors.New("invalid key purpose")
+
+// RawRSADecryptOptions may be passed to Decrypt to perform a raw RSA private key operation (CKM_RSA_X_509).
+//
+// The ciphertext must be exactly as long as the modulus, and the plaintext is returned at the same length, with
+// leading zero bytes preserved. No padding is checked or removed: the caller is responsible for verifying and
+// stripping whatever padding scheme it uses. Raw decryption of attacker-supplied ciphertexts is easy to misuse, so
+// prefer OAEP or PKCS#1 v1.5 where they are sufficient.
+type RawRSADecryptOptions struct{}
+
+// errInvalidRSAExponent is returned when a requested RSA public exponent is even, less than 3 or wider than 31 bits.
+var errInvalidRSAExponent = errors.New("RSA public exponent must be odd, at least 3 and at most 31 bits")
+
+// defaultRSAExponent is the public exponent used when none is specified.
+var defaultRSAExponent = big.NewInt(65537)
+
+// applyPurpose sets the usage attributes for purpose on public and private, where not already present.
+func applyPurpose(purpose KeyPurpose, public, private AttributeSet) error {
+	if purpose <= 0 || purpose&^keyPurposeAll != 0 {
+		return errInvalidKeyPurpose
+	}
+	sign := purpose&KeyPurposeSigning != 0
+	decrypt := purpose&KeyPurposeDecryption != 0
+	unwrap := purpose&KeyPurposeUnwrapping != 0
+
+	public.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, sign),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, decrypt),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, unwrap),
+	})
+	private.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, sign),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, decrypt),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, unwrap),
+	})
+	return nil
+}
+
+// Purpose returns the purposes the private key of the key pair permits, according to its CKA_SIGN, CKA_DECRYPT and
+// CKA_UNWRAP attributes, so that the permissions of a key pair found with, for instance, FindKeyPair can be checked.
+// For a key pair returned by GenerateRSAKeyPairWithOptions, the options are used instead. The result is zero if the
+// key pair permits none of them.
+func (k *pkcs11PrivateKey) Purpose() (KeyPurpose, error) {
+	if k.context.closed.Get() {
+		return 0, errClosed
+	}
+
+	var sign, decrypt, unwrap bool
+	if k.usage != nil {
+		sign, decrypt, unwrap = k.usage.sign, k.usage.decrypt, k.usage.unwrap
+	} else {
+		attributes, err := k.context.usageAttributes(k, []AttributeType{CkaSign, CkaDecrypt, CkaUnwrap})
+		if err != nil {
+			return 0, withMessage(err, "reading key usage")
+		}
+		sign = attributeIsTrue(attributes, CkaSign)
+		decrypt = attributeIsTrue(attributes, CkaDecrypt)
+		unwrap = attributeIsTrue(attributes, CkaUnwrap)
+	}
+
+	var purpose KeyPurpose
+	if sign {
+		purpose |= KeyPurposeSigning
+	}
+	if decrypt {
+		purpose |= KeyPurposeDecryption
+	}
+	if unwrap {
+		purpose |= KeyPurposeUnwrapping
+	}
+	return purpose, nil
+}
+
 // pkcs11PrivateKeyRSA contains a reference to a loaded PKCS#11 RSA private key object.
 type pkcs11PrivateKeyRSA struct {
 	pkcs11PrivateKey
+
+	// pkcs1v15Decryption overrides Config.DisallowPKCS1v15Decryption for the key if it is non-nil, see
+	// Context.WithPKCS1v15Decryption.
+	pkcs1v15Decryption *bool
 }
 
 // Export the public key corresponding to a private RSA key.
@@ -59,30 +159,82 @@ func exportRSAPublicKey(session *pkcs11Session, pubHandle pkcs11.ObjectHandle) (
 	if err != nil {
 		return nil, err
 	}
+	pub, err := parseRSAPublicKey(exported[0].Value, exported[1].Value)
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// keyPairRSAPublicKey reads the public key of the RSA key pair whose private key object is privHandle. The public key
+// object pubHandle, if there is one, is tried first and then the private key object, which carries CKA_MODULUS and
+// CKA_PUBLIC_EXPONENT too. If the modulus can be read but neither exponent can, for instance because the token marks
+// it sensitive, the exponent is assumed to be 65537 and the assumption reported, unless
+// Config.StrictRSAPublicExponent is set. fromPublicObject is true if pub was read in full from pubHandle.
+func (c *Context) keyPairRSAPublicKey(session *pkcs11Session, pubHandle *pkcs11.ObjectHandle,
+	privHandle pkcs11.ObjectHandle, id, label []byte) (pub crypto.PublicKey, fromPublicObject bool, err error) {
+
+	handles := []pkcs11.ObjectHandle{privHandle}
+	if pubHandle != nil {
+		handles = []pkcs11.ObjectHandle{*pubHandle, privHandle}
+	}
+
+	var firstErr error
+	for i, handle := range handles {
+		if pub, err = exportRSAPublicKey(session, handle); err == nil {
+			return pub, pubHandle != nil && i == 0, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if c.cfg.StrictRSAPublicExponent {
+		return nil, false, firstErr
+	}
+
+	for _, handle := range handles {
+		template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil)}
+		attributes, err := session.ctx.GetAttributeValue(session.handle, handle, template)
+		if err != nil {
+			continue
+		}
+		if pub, err := parseRSAPublicKey(attributes[0].Value, defaultRSAExponent.Bytes()); err == nil {
+			c.warnings.warn(RSAExponentAssumed, privHandle, id, label, nil)
+			return pub, false, nil
+		}
+	}
+	return nil, false, firstErr
+}
+
+// parseRSAPublicKey converts CKA_MODULUS and CKA_PUBLIC_EXPONENT values into a public key.
+func parseRSAPublicKey(modulusBytes, exponentBytes []byte) (*rsa.PublicKey, error) {
 	var modulus = new(big.Int)
-	modulus.SetBytes(exported[0].Value)
-	var bigExponent = new(big.Int)
-	bigExponent.SetBytes(exported[1].Value)
-	if bigExponent.BitLen() > 32 {
+	modulus.SetBytes(modulusBytes)
+	// An RSA modulus is the product of two odd primes, so it is odd and at least 15
+	if modulus.Bit(0) == 0 || modulus.BitLen() < 4 {
 		return nil, errMalformedRSAPublicKey
 	}
-	if bigExponent.Sign() < 1 {
+	var bigExponent = new(big.Int)
+	bigExponent.SetBytes(exponentBytes)
+	// Limit the exponent to 31 bits so it fits in an int on every platform
+	if bigExponent.BitLen() > 31 {
 		return nil, errMalformedRSAPublicKey
 	}
 	exponent := int(bigExponent.Uint64())
-	result := rsa.PublicKey{
-		N: modulus,
-		E: exponent,
-	}
-	if result.E < 2 {
+	if exponent < 2 {
 		return nil, errMalformedRSAPublicKey
 	}
-	return &result, nil
+	return &rsa.PublicKey{
+		N: modulus,
+		E: exponent,
+	}, nil
 }
 
 // GenerateRSAKeyPair creates an RSA key pair on the token. The id parameter is used to
 // set CKA_ID and must be non-nil. RSA private keys are generated with both sign and decrypt
 // permissions, and a public exponent of 65537.
+//
+// Deprecated: use GenerateRSAKeyPairForPurpose, which only grants the permissions the key needs.
 func (c *Context) GenerateRSAKeyPair(id []byte, bits int) (SignerDecrypter, error) {
 	if c.closed.Get() {
 		return nil, errClosed
@@ -101,6 +253,8 @@ func (c *Context) GenerateRSAKeyPair(id []byte, bits int) (SignerDecrypter, erro
 // GenerateRSAKeyPairWithLabel creates an RSA key pair on the token. The id and label parameters are used to
 // set CKA_ID and CKA_LABEL respectively and must be non-nil. RSA private keys are generated with both sign and decrypt
 // permissions, and a public exponent of 65537.
+//
+// Deprecated: use GenerateRSAKeyPairForPurpose, which only grants the permissions the key needs.
 func (c *Context) GenerateRSAKeyPairWithLabel(id, label []byte, bits int) (SignerDecrypter, error) {
 	if c.closed.Get() {
 		return nil, errClosed
@@ -116,14 +270,139 @@ func (c *Context) GenerateRSAKeyPairWithLabel(id, label []byte, bits int) (Signe
 	return c.GenerateRSAKeyPairWithAttributes(public, private, bits)
 }
 
+// GenerateRSAKeyPairForPurpose creates an RSA key pair on the token, with usage attributes that permit only the
+// declared purpose. The id parameter is used to set CKA_ID and must be non-nil. If label is non-nil, it is used to
+// set CKA_LABEL. The public exponent is 65537.
+func (c *Context) GenerateRSAKeyPairForPurpose(id, label []byte, bits int, purpose KeyPurpose) (SignerDecrypter,
+	error) {
+
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	var public AttributeSet
+	var err error
+	if label == nil {
+		public, err = NewAttributeSetWithID(id)
+	} else {
+		public, err = NewAttributeSetWithIDAndLabel(id, label)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Copy the AttributeSet to allow modifications.
+	private := public.Copy()
+
+	if err = applyPurpose(purpose, public, private); err != nil {
+		return nil, err
+	}
+
+	return c.GenerateRSAKeyPairWithAttributes(public, private, bits)
+}
+
+// GenerateRSAKeyPairWithExponent creates an RSA key pair on the token with the given public exponent, and usage
+// attributes that permit only the declared purpose. The id parameter is used to set CKA_ID and must be non-nil. If
+// label is non-nil, it is used to set CKA_LABEL. If exponent is nil, a public exponent of 65537 is used.
+//
+// The exponent must be odd, at least 3 and fit in 31 bits, since larger exponents cannot be represented by
+// rsa.PublicKey on every platform. The Public method of the returned key reports the chosen exponent.
+func (c *Context) GenerateRSAKeyPairWithExponent(id, label []byte, bits int, purpose KeyPurpose,
+	exponent *big.Int) (SignerDecrypter, error) {
+
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if exponent == nil {
+		exponent = defaultRSAExponent
+	}
+	if err := checkRSAExponent(exponent); err != nil {
+		return nil, err
+	}
+
+	var public AttributeSet
+	var err error
+	if label == nil {
+		public, err = NewAttributeSetWithID(id)
+	} else {
+		public, err = NewAttributeSetWithIDAndLabel(id, label)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Copy the AttributeSet to allow modifications.
+	private := public.Copy()
+
+	if err = applyPurpose(purpose, public, private); err != nil {
+		return nil, err
+	}
+	public.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, exponent.Bytes()),
+	})
+
+	return c.GenerateRSAKeyPairWithAttributes(public, private, bits)
+}
+
+// checkRSAExponent returns errInvalidRSAExponent unless exponent is odd, at least 3 and at most 31 bits wide.
+func checkRSAExponent(exponent *big.Int) error {
+	if exponent.Cmp(big.NewInt(3)) < 0 || exponent.Bit(0) == 0 || exponent.BitLen() > 31 {
+		return errInvalidRSAExponent
+	}
+	return nil
+}
+
+// checkRSAKeySize checks the requested modulus size against the key sizes the token reports for RSA key pair
+// generation. Limits the token reports as zero, or cannot report at all, are not checked.
+func (c *Context) checkRSAKeySize(bits int) error {
+	info, err := c.ctx.GetMechanismInfo(c.slot,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)})
+	if err != nil {
+		return nil
+	}
+	return checkRSAKeySizeRange(bits, int(info.MinKeySize), int(info.MaxKeySize))
+}
+
+// checkRSAKeySizeRange returns an error if bits is outside min and max. A zero bound is ignored.
+func checkRSAKeySizeRange(bits, min, max int) error {
+	if (min > 0 && bits < min) || (max > 0 && bits > max) {
+		switch {
+		case max == 0:
+			return fmt.Errorf("token supports RSA keys of at least %d bits, requested %d", min, bits)
+		case min == 0:
+			return fmt.Errorf("token supports RSA keys of at most %d bits, requested %d", max, bits)
+		}
+		return fmt.Errorf("token supports RSA keys between %d and %d bits, requested %d", min, max, bits)
+	}
+	return nil
+}
+
 // GenerateRSAKeyPairWithAttributes generates an RSA key pair on the token. After this function returns, public and
 // private will contain the attributes applied to the key pair. If required attributes are missing, they will be set to
 // a default value.
+//
+// An error is returned, without attempting generation, if bits is outside the key sizes the token reports for
+// CKM_RSA_PKCS_KEY_PAIR_GEN.
+//
+// If private specifies neither CKA_SIGN nor CKA_DECRYPT, the key pair permits both signing and decryption and a
+// DualUseKeyGenerated warning is raised, see Config.KeyWarningFunc. Set the usage attributes explicitly, or use
+// GenerateRSAKeyPairForPurpose, to avoid this.
 func (c *Context) GenerateRSAKeyPairWithAttributes(public, private AttributeSet, bits int) (SignerDecrypter, error) {
 	if c.closed.Get() {
 		return nil, errClosed
 	}
 
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
+	if err := c.checkRSAKeySize(bits); err != nil {
+		return nil, err
+	}
+
+	_, hasSign := private[CkaSign]
+	_, hasDecrypt := private[CkaDecrypt]
+	dualUse := !hasSign && !hasDecrypt
+
 	var k SignerDecrypter
 
 	err := c.withSession(func(session *pkcs11Session) error {
@@ -134,7 +413,7 @@ func (c *Context) GenerateRSAKeyPairWithAttributes(public, private AttributeSet,
 			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
 			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
-			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, defaultRSAExponent.Bytes()),
 			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
 		})
 		private.AddIfNotPresent([]*pkcs11.Attribute{
@@ -153,20 +432,26 @@ func (c *Context) GenerateRSAKeyPairWithAttributes(public, private AttributeSet,
 		if err != nil {
 			return err
 		}
+		if dualUse {
+			c.warnings.warn(DualUseKeyGenerated, privHandle, attributeValue(private, CkaId),
+				attributeValue(private, CkaLabel), nil)
+		}
 
 		pub, err := exportRSAPublicKey(session, pubHandle)
 		if err != nil {
 			return err
 		}
-		k = &pkcs11PrivateKeyRSA{
+		key := &pkcs11PrivateKeyRSA{
 			pkcs11PrivateKey: pkcs11PrivateKey{
 				pkcs11Object: pkcs11Object{
 					handle:  privHandle,
 					context: c,
 				},
 				pubKeyHandle: pubHandle,
-				pubKey:       pub,
 			}}
+		c.retainPublicKey(&key.pkcs11PrivateKey, pub)
+		c.pinKey(session, &key.pkcs11PrivateKey, pub)
+		k = key
 		return nil
 	})
 	return k, err
@@ -176,19 +461,56 @@ func (c *Context) GenerateRSAKeyPairWithAttributes(public, private AttributeSet,
 //
 // This completes the implemention of crypto.Decrypter for pkcs11PrivateKeyRSA.
 //
-// Note that the SessionKeyLen option (for PKCS#1v1.5 decryption) is not supported.
+// For PKCS#1 v1.5, a positive SessionKeyLen option is handled as by crypto/rsa: SessionKeyLen random bytes are
+// generated on the token before decrypting, and returned instead of an error if the padding is invalid
+// (CKR_ENCRYPTED_DATA_INVALID) or the plaintext has the wrong length, as the Bleichenbacher countermeasure in TLS
+// requires. Only the selection between the random and decrypted keys is constant-time: the token may take
+// measurably different times to reject bad padding, and other PKCS#11 errors are still returned as errors. See
+// rsa.DecryptPKCS1v15SessionKey for the remaining obligations on the caller. For OAEP, MGF1 uses the MGFHash
+// option if it is set (Go 1.20 and later), and otherwise the same hash as Hash. A non-empty Label is passed to the
+// token as CKZ_DATA_SPECIFIED source data; if the token rejects it, the error says so.
+//
+// Pass *RawRSADecryptOptions for a raw RSA operation, which leaves padding verification to the caller.
+//
+// PKCS#1 v1.5 decryption, requested with nil or *rsa.PKCS1v15DecryptOptions, fails with a *PolicyError if
+// Config.DisallowPKCS1v15Decryption is set, unless the key was made by Context.WithPKCS1v15Decryption.
 //
 // The underlying PKCS#11 implementation may impose further restrictions.
 func (priv *pkcs11PrivateKeyRSA) Decrypt(rand io.Reader, ciphertext []byte, options crypto.DecrypterOpts) (plaintext []byte, err error) {
-	err = priv.context.withSession(func(session *pkcs11Session) error {
+	if isNilPointer(options) {
+		return nil, errUnsupportedRSAOptions
+	}
+	if err = priv.checkDecryptUsage(options); err != nil {
+		return nil, err
+	}
+	if err = priv.checkDecryptPolicy(options); err != nil {
+		return nil, err
+	}
+	if profile := priv.profileFor(MechanismDecrypt); profile != nil {
+		return priv.decryptWithProfile(profile, ciphertext)
+	}
+	if err = priv.context.checkOptionsHashes(options); err != nil {
+		return nil, err
+	}
+
+	switch o := options.(type) {
+	case *RawRSADecryptOptions:
+		return priv.decryptRaw(ciphertext)
+	case *rsa.PKCS1v15DecryptOptions:
+		if o.SessionKeyLen > 0 {
+			return priv.decryptPKCS1v15SessionKey(ciphertext, o.SessionKeyLen)
+		}
+	}
+
+	err = priv.withSession(func(session *pkcs11Session) error {
 		if options == nil {
-			plaintext, err = decryptPKCS1v15(session, priv, ciphertext, 0)
+			plaintext, err = decryptPKCS1v15(session, priv, ciphertext)
 		} else {
 			switch o := options.(type) {
 			case *rsa.PKCS1v15DecryptOptions:
-				plaintext, err = decryptPKCS1v15(session, priv, ciphertext, o.SessionKeyLen)
+				plaintext, err = decryptPKCS1v15(session, priv, ciphertext)
 			case *rsa.OAEPOptions:
-				plaintext, err = decryptOAEP(session, priv, ciphertext, o.Hash, o.Label)
+				plaintext, err = decryptOAEP(session, priv, ciphertext, o)
 			default:
 				err = errUnsupportedRSAOptions
 			}
@@ -198,99 +520,232 @@ func (priv *pkcs11PrivateKeyRSA) Decrypt(rand io.Reader, ciphertext []byte, opti
 	return plaintext, err
 }
 
-func decryptPKCS1v15(session *pkcs11Session, key *pkcs11PrivateKeyRSA, ciphertext []byte, sessionKeyLen int) ([]byte, error) {
-	if sessionKeyLen != 0 {
-		return nil, errUnsupportedRSAOptions
-	}
+func decryptPKCS1v15(session *pkcs11Session, key *pkcs11PrivateKeyRSA, ciphertext []byte) ([]byte, error) {
 	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
-	if err := session.ctx.DecryptInit(session.handle, mech, key.handle); err != nil {
+	if err := session.decryptInit(mech, key.handle); err != nil {
 		return nil, err
 	}
-	return session.ctx.Decrypt(session.handle, ciphertext)
+	return session.decrypt(pkcs11.CKM_RSA_PKCS, ciphertext)
 }
 
-func decryptOAEP(session *pkcs11Session, key *pkcs11PrivateKeyRSA, ciphertext []byte, hashFunction crypto.Hash,
-	label []byte) ([]byte, error) {
+// decryptPKCS1v15SessionKey decrypts a PKCS#1 v1.5 ciphertext holding a sessionKeyLen-byte session key. As with
+// rsa.DecryptPKCS1v15SessionKey, a random key is returned instead of an error if the padding is invalid or the
+// plaintext is not sessionKeyLen bytes long. The random key is generated by the token before decrypting.
+func (priv *pkcs11PrivateKeyRSA) decryptPKCS1v15SessionKey(ciphertext []byte, sessionKeyLen int) (key []byte,
+	err error) {
+
+	pub, ok := priv.Public().(*rsa.PublicKey)
+	if !ok || pub.N == nil {
+		return nil, errMalformedRSAPublicKey
+	}
+	size := (pub.N.BitLen() + 7) / 8
+	if size < sessionKeyLen+11 || len(ciphertext) != size {
+		return nil, rsa.ErrDecryption
+	}
 
-	hashAlg, mgfAlg, _, err := hashToPKCS11(hashFunction)
+	err = priv.withSession(func(session *pkcs11Session) error {
+		if key, err = session.ctx.GenerateRandom(session.handle, sessionKeyLen); err != nil {
+			return withMessage(err, "generating random session key")
+		}
+		if len(key) != sessionKeyLen {
+			return errors.New("token returned too few random bytes")
+		}
+
+		plaintext, err := decryptPKCS1v15(session, priv, ciphertext)
+		if isPKCS11Error(err, pkcs11.CKR_ENCRYPTED_DATA_INVALID) {
+			// Bad padding. C_Decrypt has finished the operation, so the session can be reused.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		candidate := make([]byte, sessionKeyLen)
+		copy(candidate, plaintext)
+		subtle.ConstantTimeCopy(subtle.ConstantTimeEq(int32(len(plaintext)), int32(sessionKeyLen)), key, candidate)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return key, nil
+}
 
-	mech := pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP,
-		pkcs11.NewOAEPParams(hashAlg, mgfAlg, pkcs11.CKZ_DATA_SPECIFIED, label))
+// decryptRaw performs a raw RSA private key operation on ciphertext, which must be as long as the modulus.
+func (priv *pkcs11PrivateKeyRSA) decryptRaw(ciphertext []byte) (plaintext []byte, err error) {
+	pub, ok := priv.Public().(*rsa.PublicKey)
+	if !ok || pub.N == nil {
+		return nil, errMalformedRSAPublicKey
+	}
+	size := (pub.N.BitLen() + 7) / 8
+	if len(ciphertext) != size {
+		return nil, fmt.Errorf("raw RSA ciphertext must be %d bytes, got %d", size, len(ciphertext))
+	}
 
-	err = session.ctx.DecryptInit(session.handle, []*pkcs11.Mechanism{mech}, key.handle)
+	err = priv.withSession(func(session *pkcs11Session) error {
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_X_509, nil)}
+		if err := session.decryptInit(mech, priv.handle); err != nil {
+			return err
+		}
+		plaintext, err = session.decrypt(pkcs11.CKM_RSA_X_509, ciphertext)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return session.ctx.Decrypt(session.handle, ciphertext)
+
+	// Some tokens strip leading zero bytes from the result of CKM_RSA_X_509.
+	if len(plaintext) < size {
+		padded := make([]byte, size)
+		copy(padded[size-len(plaintext):], plaintext)
+		plaintext = padded
+	}
+	return plaintext, nil
 }
 
-func hashToPKCS11(hashFunction crypto.Hash) (hashAlg uint, mgfAlg uint, hashLen uint, err error) {
-	switch hashFunction {
-	case crypto.SHA1:
-		return pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1, 20, nil
-	case crypto.SHA224:
-		return pkcs11.CKM_SHA224, pkcs11.CKG_MGF1_SHA224, 28, nil
-	case crypto.SHA256:
-		return pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, 32, nil
-	case crypto.SHA384:
-		return pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384, 48, nil
-	case crypto.SHA512:
-		return pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512, 64, nil
-	default:
-		return 0, 0, 0, errUnsupportedRSAOptions
+func decryptOAEP(session *pkcs11Session, key *pkcs11PrivateKeyRSA, ciphertext []byte, opts *rsa.OAEPOptions) ([]byte,
+	error) {
+
+	params, err := oaepParams(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	mech := pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)
+
+	err = session.decryptInit([]*pkcs11.Mechanism{mech}, key.handle)
+	if err != nil {
+		return nil, oaepLabelError(err, opts.Label)
+	}
+	return session.decrypt(pkcs11.CKM_RSA_PKCS_OAEP, ciphertext)
+}
+
+// oaepLabelError annotates err if it shows that the token rejected the OAEP parameters and label is not empty, since
+// some tokens do not support CKZ_DATA_SPECIFIED source data. Tokens which accept the label but ignore it fail to
+// decrypt labeled ciphertexts, as the label hash does not match, rather than returning the wrong plaintext.
+func oaepLabelError(err error, label []byte) error {
+	if len(label) > 0 && isPKCS11Error(err, pkcs11.CKR_MECHANISM_PARAM_INVALID, pkcs11.CKR_ARGUMENTS_BAD) {
+		return withMessage(err, "token rejected OAEP label (CKZ_DATA_SPECIFIED source data)")
+	}
+	return err
+}
+
+// oaepParams returns the CK_RSA_PKCS_OAEP_PARAMS for opts, with opts.Label as the CKZ_DATA_SPECIFIED source data.
+// MGF1 uses opts.MGFHash, where the Go version has it, or opts.Hash if that is zero.
+func oaepParams(opts *rsa.OAEPOptions) (*pkcs11.OAEPParams, error) {
+	hashAlg, mgfAlg, _, err := hashToPKCS11(opts.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if mgfHash := oaepMGFHash(opts); mgfHash != 0 {
+		if _, mgfAlg, _, err = hashToPKCS11(mgfHash); err != nil {
+			return nil, err
+		}
+	}
+	return pkcs11.NewOAEPParams(hashAlg, mgfAlg, pkcs11.CKZ_DATA_SPECIFIED, opts.Label), nil
+}
+
+func signPSS(session *pkcs11Session, key *pkcs11PrivateKeyRSA, digest []byte, opts *rsa.PSSOptions,
+	modulusBits int) ([]byte, error) {
+
+	mech, err := pssMechanism(opts, modulusBits)
+	if err != nil {
+		return nil, err
+	}
+	if err = session.signInit(mech, key.handle); err != nil {
+		return nil, err
+	}
+	signature, err := session.sign(pkcs11.CKM_RSA_PKCS_PSS, digest)
+	if err != nil {
+		return nil, err
 	}
+	return signature, key.checkSignatureLength(signature)
 }
 
-func signPSS(session *pkcs11Session, key *pkcs11PrivateKeyRSA, digest []byte, opts *rsa.PSSOptions) ([]byte, error) {
+// pssMechanism returns the CKM_RSA_PKCS_PSS mechanism for the given options. As in crypto/rsa,
+// rsa.PSSSaltLengthEqualsHash selects a salt as long as the hash output, and rsa.PSSSaltLengthAuto selects the
+// longest salt that fits a modulus of modulusBits bits. modulusBits is only used for rsa.PSSSaltLengthAuto.
+func pssMechanism(opts *rsa.PSSOptions, modulusBits int) ([]*pkcs11.Mechanism, error) {
 	var hMech, mgf, hLen, sLen uint
 	var err error
 	if hMech, mgf, hLen, err = hashToPKCS11(opts.Hash); err != nil {
 		return nil, err
 	}
-	switch opts.SaltLength {
-	case rsa.PSSSaltLengthAuto: // parseltongue constant
-		// TODO we could (in principle) work out the biggest
-		// possible size from the key, but until someone has
-		// the effort to do that...
-		return nil, errUnsupportedRSAOptions
-	case rsa.PSSSaltLengthEqualsHash:
-		sLen = hLen
-	default:
-		sLen = uint(opts.SaltLength)
+	if sLen, err = pssSaltLength(opts, hLen, modulusBits); err != nil {
+		return nil, err
 	}
 	// TODO this is pretty horrible, maybe the PKCS#11 wrapper
 	// could be improved to help us out here
 	parameters := concat(ulongToBytes(hMech),
 		ulongToBytes(mgf),
 		ulongToBytes(sLen))
-	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, parameters)}
-	if err = session.ctx.SignInit(session.handle, mech, key.handle); err != nil {
-		return nil, err
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, parameters)}, nil
+}
+
+// pssSaltLength returns the salt length for opts, for a hash of hLen bytes and a modulus of modulusBits bits.
+// modulusBits is only used for rsa.PSSSaltLengthAuto.
+func pssSaltLength(opts *rsa.PSSOptions, hLen uint, modulusBits int) (uint, error) {
+	switch {
+	case opts.SaltLength == rsa.PSSSaltLengthAuto:
+		maxSaltLength := (modulusBits-1+7)/8 - 2 - int(hLen)
+		if modulusBits <= 0 || maxSaltLength < 0 {
+			return 0, errUnsupportedRSAOptions
+		}
+		return uint(maxSaltLength), nil
+	case opts.SaltLength == rsa.PSSSaltLengthEqualsHash:
+		return hLen, nil
+	case opts.SaltLength < 0:
+		return 0, errUnsupportedRSAOptions
+	default:
+		return uint(opts.SaltLength), nil
 	}
-	return session.ctx.Sign(session.handle, digest)
 }
 
-var pkcs1Prefix = map[crypto.Hash][]byte{
-	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
-	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
-	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
-	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
-	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+// pssModulusBits returns the modulus size needed by pssMechanism for opts, or zero if it is not needed.
+func pssModulusBits(opts *rsa.PSSOptions, public crypto.PublicKey) (int, error) {
+	if opts.SaltLength != rsa.PSSSaltLengthAuto {
+		return 0, nil
+	}
+	pub, ok := public.(*rsa.PublicKey)
+	if !ok || pub.N == nil {
+		return 0, errMalformedRSAPublicKey
+	}
+	return pub.N.BitLen(), nil
+}
+
+// pkcs1v15SignInput returns T, the payload CKM_RSA_PKCS pads and signs for digest. As with rsa.SignPKCS1v15, a
+// zero hash signs digest as given, so the caller may supply its own DigestInfo or any other payload; otherwise
+// digest must be as long as hash produces. rsa.ErrMessageTooLong is returned if T does not fit the padding for
+// public. If public is not an RSA public key, the length is left for the token to check.
+func pkcs1v15SignInput(hash crypto.Hash, digest []byte, public crypto.PublicKey) ([]byte, error) {
+	T, err := pkcs1v15DigestInfo(hash, digest)
+	if err != nil {
+		return nil, err
+	}
+	if hash != 0 && len(digest) != hash.Size() {
+		return nil, fmt.Errorf("%d-byte digest does not match %d-byte hash function %v", len(digest), hash.Size(),
+			hash)
+	}
+	if pub, ok := public.(*rsa.PublicKey); ok && pub.N != nil {
+		size := (pub.N.BitLen() + 7) / 8
+		if len(T)+11 > size {
+			return nil, withMessagef(rsa.ErrMessageTooLong,
+				"%d-byte PKCS#1 v1.5 payload exceeds %d bytes, the most a %d-bit modulus can sign", len(T),
+				size-11, pub.N.BitLen())
+		}
+	}
+	return T, nil
 }
 
-func signPKCS1v15(session *pkcs11Session, key *pkcs11PrivateKeyRSA, digest []byte, hash crypto.Hash) (signature []byte, err error) {
-	/* Calculate T for EMSA-PKCS1-v1_5. */
-	oid := pkcs1Prefix[hash]
-	T := make([]byte, len(oid)+len(digest))
-	copy(T[0:len(oid)], oid)
-	copy(T[len(oid):], digest)
+// signPKCS1v15 signs T, from pkcs1v15SignInput, with CKM_RSA_PKCS.
+func signPKCS1v15(session *pkcs11Session, key *pkcs11PrivateKeyRSA, T []byte) (signature []byte, err error) {
 	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
-	err = session.ctx.SignInit(session.handle, mech, key.handle)
+	err = session.signInit(mech, key.handle)
+	if err == nil {
+		signature, err = session.sign(pkcs11.CKM_RSA_PKCS, T)
+	}
 	if err == nil {
-		signature, err = session.ctx.Sign(session.handle, T)
+		err = key.checkSignatureLength(signature)
 	}
 	return
 }
@@ -301,18 +756,50 @@ func signPKCS1v15(session *pkcs11Session, key *pkcs11PrivateKeyRSA, digest []byt
 //
 // PKCS#11 expects to pick its own random data where necessary for signatures, so the rand argument is ignored.
 //
-// Note that (at present) the crypto.rsa.PSSSaltLengthAuto option is
-// not supported. The caller must either use
-// crypto.rsa.PSSSaltLengthEqualsHash (recommended) or pass an
-// explicit salt length. Moreover the underlying PKCS#11
-// implementation may impose further restrictions.
+// For PSS, crypto.rsa.PSSSaltLengthEqualsHash and crypto.rsa.PSSSaltLengthAuto are interpreted as by crypto/rsa:
+// a salt as long as the hash, or the longest salt the modulus allows. If the token lacks CKM_RSA_PKCS_PSS, see
+// Config.SoftwarePSSEncoding. The underlying PKCS#11 implementation may impose further restrictions.
+//
+// For PKCS#1 v1.5, crypto.Hash(0) signs digest as given, with no DigestInfo prefix, as rsa.SignPKCS1v15 does. This
+// lets callers sign a DigestInfo they encoded themselves, or the MD5+SHA1 payload of TLS 1.0 and 1.1.
 func (priv *pkcs11PrivateKeyRSA) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error) {
-	err = priv.context.withSession(func(session *pkcs11Session) error {
+	if isNilPointer(opts) {
+		return nil, errUnsupportedRSAOptions
+	}
+	if err = priv.checkSignUsage(opts); err != nil {
+		return nil, err
+	}
+	if profile := priv.profileFor(MechanismSign); profile != nil {
+		return priv.signWithProfile(profile, digest)
+	}
+
+	var modulusBits int
+	var T []byte
+	if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+		if priv.context.softwarePSS() {
+			return priv.signPSSSoftware(digest, pssOpts)
+		}
+		if err = priv.context.checkOptionsHashes(pssOpts); err != nil {
+			return nil, err
+		}
+		// Read before taking a session, since exporting the public key may need one.
+		if modulusBits, err = pssModulusBits(pssOpts, priv.Public()); err != nil {
+			return nil, err
+		}
+	} else if opts != nil {
+		if T, err = pkcs1v15SignInput(opts.HashFunc(), digest, priv.Public()); err != nil {
+			return nil, err
+		}
+	}
+
+	err = priv.withSession(func(session *pkcs11Session) error {
 		switch opts.(type) {
 		case *rsa.PSSOptions:
-			signature, err = signPSS(session, priv, digest, opts.(*rsa.PSSOptions))
+			signature, err = signPSS(session, priv, digest, opts.(*rsa.PSSOptions), modulusBits)
+		case nil:
+			err = errUnsupportedRSAOptions
 		default: /* PKCS1-v1_5 */
-			signature, err = signPKCS1v15(session, priv, digest, opts.HashFunc())
+			signature, err = signPKCS1v15(session, priv, T)
 		}
 		return err
 	})
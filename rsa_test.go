@@ -27,11 +27,15 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	_ "crypto/sha1"
-	_ "crypto/sha256"
+	"crypto/sha256"
 	_ "crypto/sha512"
+	"errors"
+	"math/big"
+	"sync"
 	"testing"
 
 	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -262,3 +266,509 @@ func TestRsaRequiredArgs(t *testing.T) {
 	_, err = ctx.GenerateRSAKeyPairWithLabel(val, nil, 2048)
 	require.Error(t, err)
 }
+
+func TestRsaKeyPurpose(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		cases := []struct {
+			purpose               KeyPurpose
+			sign, decrypt, unwrap bool
+		}{
+			{KeyPurposeSigning, true, false, false},
+			{KeyPurposeDecryption, false, true, false},
+			{KeyPurposeBoth, true, true, false},
+			{KeyPurposeUnwrapping, false, false, true},
+			{KeyPurposeDecryption | KeyPurposeUnwrapping, false, true, true},
+		}
+
+		for _, c := range cases {
+			id := randomBytes()
+			key, err := ctx.GenerateRSAKeyPairForPurpose(id, nil, rsaSize, c.purpose)
+			require.NoError(t, err)
+
+			private, err := ctx.GetAttributes(key, []AttributeType{CkaSign, CkaDecrypt, CkaUnwrap})
+			require.NoError(t, err)
+			require.Equal(t, c.sign, attributeIsTrue(private, CkaSign), "purpose %v", c.purpose)
+			require.Equal(t, c.decrypt, attributeIsTrue(private, CkaDecrypt), "purpose %v", c.purpose)
+			require.Equal(t, c.unwrap, attributeIsTrue(private, CkaUnwrap), "purpose %v", c.purpose)
+
+			public, err := ctx.GetPubAttributes(key, []AttributeType{CkaVerify, CkaEncrypt, CkaWrap})
+			require.NoError(t, err)
+			require.Equal(t, c.sign, attributeIsTrue(public, CkaVerify), "purpose %v", c.purpose)
+			require.Equal(t, c.decrypt, attributeIsTrue(public, CkaEncrypt), "purpose %v", c.purpose)
+			require.Equal(t, c.unwrap, attributeIsTrue(public, CkaWrap), "purpose %v", c.purpose)
+
+			found, err := ctx.FindKeyPair(id, nil)
+			require.NoError(t, err)
+			purpose, err := found.(PurposeReporter).Purpose()
+			require.NoError(t, err)
+			require.Equal(t, c.purpose, purpose)
+
+			require.NoError(t, key.Delete())
+		}
+
+		_, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, 0)
+		require.Equal(t, errInvalidKeyPurpose, err)
+		_, err = ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, 8)
+		require.Equal(t, errInvalidKeyPurpose, err)
+	})
+}
+
+func TestRsaDualUseKeyWarning(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	var warnings []KeyWarning
+	config.KeyWarningFunc = func(warning KeyWarning) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		warnings = append(warnings, warning)
+	}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+
+	id := randomBytes()
+	dualUse, err := ctx.GenerateRSAKeyPairWithLabel(id, []byte("dual use"), rsaSize)
+	require.NoError(t, err)
+	require.NoError(t, dualUse.Delete())
+
+	signing, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeSigning)
+	require.NoError(t, err)
+	require.NoError(t, signing.Delete())
+
+	// Close waits for queued warnings to be delivered
+	require.NoError(t, ctx.Close())
+	assert.Zero(t, ctx.DroppedEvents())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, warnings, 1)
+	assert.Equal(t, DualUseKeyGenerated, warnings[0].Type)
+	assert.Equal(t, dualUse.(*pkcs11PrivateKeyRSA).handle, warnings[0].Handle)
+	assert.Equal(t, id, warnings[0].ID)
+	assert.Equal(t, []byte("dual use"), warnings[0].Label)
+}
+
+func TestRsaSigningKeyCannotDecrypt(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), []byte("signing only"), rsaSize, KeyPurposeSigning)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		testRsaSigning(t, key, false)
+
+		ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, key.Public().(*rsa.PublicKey), []byte("secret"))
+		require.NoError(t, err)
+		_, err = key.Decrypt(rand.Reader, ciphertext, nil)
+		require.Error(t, err)
+	})
+}
+
+func TestPSSMechanismSaltLength(t *testing.T) {
+	saltLength := func(opts *rsa.PSSOptions, bits int) uint {
+		mech, err := pssMechanism(opts, bits)
+		require.NoError(t, err)
+		params := mech[0].Parameter
+		return bytesToUlong(params[len(params)-len(params)/3:])
+	}
+	pss := func(saltLength int, hash crypto.Hash) *rsa.PSSOptions {
+		return &rsa.PSSOptions{SaltLength: saltLength, Hash: hash}
+	}
+
+	assert.Equal(t, uint(32), saltLength(pss(rsa.PSSSaltLengthEqualsHash, crypto.SHA256), 0))
+	assert.Equal(t, uint(222), saltLength(pss(rsa.PSSSaltLengthAuto, crypto.SHA256), 2048))
+	assert.Equal(t, uint(190), saltLength(pss(rsa.PSSSaltLengthAuto, crypto.SHA512), 2048))
+	assert.Equal(t, uint(221), saltLength(pss(rsa.PSSSaltLengthAuto, crypto.SHA256), 2041))
+	assert.Equal(t, uint(20), saltLength(pss(20, crypto.SHA256), 0))
+
+	_, err := pssMechanism(pss(rsa.PSSSaltLengthAuto, crypto.SHA512), 512)
+	assert.Equal(t, errUnsupportedRSAOptions, err)
+	_, err = pssMechanism(pss(-2, crypto.SHA256), 2048)
+	assert.Equal(t, errUnsupportedRSAOptions, err)
+}
+
+func TestRsaPSSSaltLengths(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_RSA_PKCS_PSS)
+
+		for _, bits := range []int{2048, 4096} {
+			key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, bits, KeyPurposeSigning)
+			require.NoError(t, err)
+			defer func() { _ = key.Delete() }()
+			pub := key.Public().(*rsa.PublicKey)
+
+			digest := sha256.Sum256([]byte("salt lengths"))
+			for _, saltLength := range []int{rsa.PSSSaltLengthAuto, rsa.PSSSaltLengthEqualsHash, 20} {
+				opts := &rsa.PSSOptions{SaltLength: saltLength, Hash: crypto.SHA256}
+				sig, err := key.Sign(rand.Reader, digest[:], opts)
+				require.NoError(t, err, "bits %d, salt length %d", bits, saltLength)
+				require.NoError(t, rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, opts),
+					"bits %d, salt length %d", bits, saltLength)
+			}
+
+			// With the maximum salt the signature is also valid for a verifier expecting that length.
+			sig, err := key.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto,
+				Hash: crypto.SHA256})
+			require.NoError(t, err)
+			maxSalt := (bits-1+7)/8 - 2 - crypto.SHA256.Size()
+			require.NoError(t, rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig,
+				&rsa.PSSOptions{SaltLength: maxSalt, Hash: crypto.SHA256}))
+		}
+	})
+}
+
+func TestPKCS1v15SignInput(t *testing.T) {
+	pub := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023), E: 65537}
+	digest := sha256.Sum256([]byte("sign input"))
+
+	T, err := pkcs1v15SignInput(crypto.SHA256, digest[:], pub)
+	require.NoError(t, err)
+	assert.Equal(t, append(hashRegistry[crypto.SHA256].digestInfoPrefix, digest[:]...), T)
+
+	// With no hash, the payload is signed as given, up to the modulus size less 11 bytes of padding.
+	payload := randomBytes()
+	T, err = pkcs1v15SignInput(0, payload, pub)
+	require.NoError(t, err)
+	assert.Equal(t, payload, T)
+
+	_, err = pkcs1v15SignInput(0, make([]byte, 128-11), pub)
+	require.NoError(t, err)
+	_, err = pkcs1v15SignInput(0, make([]byte, 128-10), pub)
+	assert.True(t, errors.Is(err, rsa.ErrMessageTooLong), "%v", err)
+	assert.Contains(t, err.Error(), "1024-bit modulus")
+
+	// Without a public key, the token checks the length.
+	_, err = pkcs1v15SignInput(0, make([]byte, 1024), nil)
+	require.NoError(t, err)
+
+	_, err = pkcs1v15SignInput(crypto.SHA256, digest[:20], pub)
+	assert.Error(t, err)
+}
+
+func TestRsaSignWithoutHash(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		pub := key.Public().(*rsa.PublicKey)
+
+		// A DigestInfo encoded by the caller produces the same signature as letting crypto11 add the prefix.
+		digest := sha256.Sum256([]byte("caller DigestInfo"))
+		digestInfo := append(append([]byte{}, hashRegistry[crypto.SHA256].digestInfoPrefix...), digest[:]...)
+		sig, err := key.Sign(rand.Reader, digestInfo, crypto.Hash(0))
+		require.NoError(t, err)
+		require.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig))
+
+		payload := randomBytes()
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+		require.NoError(t, err)
+		require.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.Hash(0), payload, sig))
+
+		_, err = key.Sign(rand.Reader, make([]byte, rsaSize/8-10), crypto.Hash(0))
+		assert.True(t, errors.Is(err, rsa.ErrMessageTooLong), "%v", err)
+	})
+}
+
+func TestCheckRSAExponent(t *testing.T) {
+	for _, e := range []int64{3, 17, 65537, 1<<31 - 1} {
+		require.NoError(t, checkRSAExponent(big.NewInt(e)), "exponent %d", e)
+	}
+	for _, e := range []int64{-3, 0, 1, 2, 4, 65536, 1<<31 + 1} {
+		require.Equal(t, errInvalidRSAExponent, checkRSAExponent(big.NewInt(e)), "exponent %d", e)
+	}
+}
+
+func TestRsaKeyPairWithExponent(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairWithExponent(randomBytes(), nil, rsaSize, KeyPurposeSigning, big.NewInt(65539))
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		require.Equal(t, 65539, key.Public().(*rsa.PublicKey).E)
+		testRsaSigning(t, key, false)
+
+		key2, err := ctx.GenerateRSAKeyPairWithExponent(randomBytes(), nil, rsaSize, KeyPurposeSigning, nil)
+		require.NoError(t, err)
+		defer func() { _ = key2.Delete() }()
+
+		require.Equal(t, 65537, key2.Public().(*rsa.PublicKey).E)
+
+		_, err = ctx.GenerateRSAKeyPairWithExponent(randomBytes(), nil, rsaSize, KeyPurposeSigning, big.NewInt(4))
+		require.Equal(t, errInvalidRSAExponent, err)
+	})
+}
+
+func TestCheckRSAKeySizeRange(t *testing.T) {
+	require.NoError(t, checkRSAKeySizeRange(2048, 1024, 4096))
+	require.NoError(t, checkRSAKeySizeRange(8192, 0, 0))
+	require.NoError(t, checkRSAKeySizeRange(8192, 1024, 0))
+	require.NoError(t, checkRSAKeySizeRange(512, 0, 4096))
+
+	err := checkRSAKeySizeRange(8192, 1024, 4096)
+	require.EqualError(t, err, "token supports RSA keys between 1024 and 4096 bits, requested 8192")
+	require.Error(t, checkRSAKeySizeRange(512, 1024, 4096))
+	require.EqualError(t, checkRSAKeySizeRange(512, 1024, 0),
+		"token supports RSA keys of at least 1024 bits, requested 512")
+	require.EqualError(t, checkRSAKeySizeRange(8192, 0, 4096),
+		"token supports RSA keys of at most 4096 bits, requested 8192")
+}
+
+func TestRsaKeySizeOutOfRange(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		info, err := ctx.ctx.GetMechanismInfo(ctx.slot,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)})
+		require.NoError(t, err)
+		if info.MaxKeySize == 0 {
+			t.Skip("token does not report a maximum RSA key size")
+		}
+
+		_, err = ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, int(info.MaxKeySize)+8, KeyPurposeSigning)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "token supports RSA keys")
+	})
+}
+
+func TestParseRSAPublicKey(t *testing.T) {
+	pub, err := parseRSAPublicKey([]byte{0xc5, 0x3b}, []byte{0, 0, 1, 0, 1})
+	require.NoError(t, err)
+	require.Equal(t, 65537, pub.E)
+
+	for _, c := range []struct{ modulus, exponent []byte }{
+		{nil, []byte{1, 0, 1}},
+		{[]byte{0xc5, 0x3a}, []byte{1, 0, 1}},
+		{[]byte{0xc5, 0x3b}, nil},
+		{[]byte{0xc5, 0x3b}, []byte{1}},
+		{[]byte{0xc5, 0x3b}, []byte{0x80, 0, 0, 0}},
+	} {
+		_, err := parseRSAPublicKey(c.modulus, c.exponent)
+		require.Equal(t, errMalformedRSAPublicKey, err)
+	}
+}
+
+func TestRsaRawDecrypt(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_RSA_X_509)
+
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), []byte("raw decryption"), rsaSize,
+			KeyPurposeDecryption)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		pub := key.Public().(*rsa.PublicKey)
+		size := (pub.N.BitLen() + 7) / 8
+
+		// Leading zero bytes must survive the round trip.
+		message := make([]byte, size)
+		_, err = rand.Read(message[4:])
+		require.NoError(t, err)
+
+		c := new(big.Int).Exp(new(big.Int).SetBytes(message), big.NewInt(int64(pub.E)), pub.N).Bytes()
+		ciphertext := make([]byte, size)
+		copy(ciphertext[size-len(c):], c)
+
+		plaintext, err := key.Decrypt(rand.Reader, ciphertext, &RawRSADecryptOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, message, plaintext)
+
+		_, err = key.Decrypt(rand.Reader, ciphertext[1:], &RawRSADecryptOptions{})
+		assert.Error(t, err)
+		_, err = key.Decrypt(rand.Reader, append(ciphertext, 0), &RawRSADecryptOptions{})
+		assert.Error(t, err)
+	})
+}
+
+func TestRsaSessionKeyDecrypt(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), []byte("session key"), rsaSize,
+			KeyPurposeDecryption)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		pub := key.Public().(*rsa.PublicKey)
+		sessionKey := make([]byte, 32)
+		_, err = rand.Read(sessionKey)
+		require.NoError(t, err)
+
+		ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, pub, sessionKey)
+		require.NoError(t, err)
+
+		options := &rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(sessionKey)}
+		plaintext, err := key.Decrypt(rand.Reader, ciphertext, options)
+		require.NoError(t, err)
+		assert.Equal(t, sessionKey, plaintext)
+
+		// A plaintext of the wrong length yields a random key, not an error.
+		short, err := rsa.EncryptPKCS1v15(rand.Reader, pub, sessionKey[:16])
+		require.NoError(t, err)
+		plaintext, err = key.Decrypt(rand.Reader, short, options)
+		require.NoError(t, err)
+		assert.Len(t, plaintext, len(sessionKey))
+		assert.NotEqual(t, sessionKey, plaintext)
+
+		// So does a ciphertext with bad padding.
+		garbage := make([]byte, len(ciphertext))
+		garbage[0] = 1
+		plaintext, err = key.Decrypt(rand.Reader, garbage, options)
+		require.NoError(t, err)
+		assert.Len(t, plaintext, len(sessionKey))
+
+		// A session key that cannot fit in the modulus is an error.
+		_, err = key.Decrypt(rand.Reader, ciphertext, &rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(ciphertext)})
+		assert.Equal(t, rsa.ErrDecryption, err)
+	})
+}
+
+func TestOAEPLabelError(t *testing.T) {
+	paramInvalid := pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+
+	err := oaepLabelError(paramInvalid, []byte("label"))
+	assert.True(t, errors.Is(err, paramInvalid))
+	assert.Contains(t, err.Error(), "OAEP label")
+
+	assert.Equal(t, paramInvalid, oaepLabelError(paramInvalid, nil))
+	assert.Equal(t, pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID),
+		oaepLabelError(pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID), []byte("label")))
+}
+
+func TestRsaOAEPLabel(t *testing.T) {
+	if shouldSkipTest(skipTestOAEPLabel) {
+		t.Skip("OAEP labels not supported")
+	}
+
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_RSA_PKCS_OAEP)
+		info, err := ctx.ctx.GetInfo()
+		require.NoError(t, err)
+		if info.ManufacturerID == "SoftHSM" {
+			t.Skipf("SoftHSM OAEP only supports SHA-1 with no label")
+		}
+
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), []byte("oaep label"), rsaSize,
+			KeyPurposeDecryption)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		plaintext := []byte("session key")
+		label := []byte("context binding")
+		ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.Public().(*rsa.PublicKey), plaintext, label)
+		require.NoError(t, err)
+
+		decrypted, err := key.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{Hash: crypto.SHA256, Label: label})
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+
+		for _, wrong := range [][]byte{nil, []byte("other context")} {
+			_, err = key.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{Hash: crypto.SHA256, Label: wrong})
+			assert.Error(t, err, "label %q", wrong)
+		}
+	})
+}
+
+// createRSAPrivateKeyWithoutExponent stores priv on the token as a private key object without CKA_PUBLIC_EXPONENT,
+// as tokens that do not reveal it behave, and with no public key object. It returns false if the token fills in
+// CKA_PUBLIC_EXPONENT regardless.
+func createRSAPrivateKeyWithoutExponent(t *testing.T, ctx *Context, priv *rsa.PrivateKey, id, label []byte) bool {
+	priv.Precompute()
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, priv.N.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, priv.D.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, priv.Primes[0].Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, priv.Primes[1].Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, priv.Precomputed.Dp.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, priv.Precomputed.Dq.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, priv.Precomputed.Qinv.Bytes()),
+	}
+	hidden := false
+	err := ctx.withSession(func(session *pkcs11Session) error {
+		handle, err := session.ctx.CreateObject(session.handle, template)
+		if err != nil {
+			return err
+		}
+		exponent := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil)}
+		exponent, err = session.ctx.GetAttributeValue(session.handle, handle, exponent)
+		hidden = err != nil || len(exponent[0].Value) == 0
+		return nil
+	})
+	require.NoError(t, err)
+	return hidden
+}
+
+func TestRsaKeyPairWithoutReadableExponent(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, rsaSize)
+	require.NoError(t, err)
+
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		label := []byte("no readable exponent")
+		hidden := createRSAPrivateKeyWithoutExponent(t, ctx, priv, id, label)
+
+		var assumed []KeyWarning
+		warnings := newKeyWarnings(func(warning KeyWarning) {
+			assumed = append(assumed, warning)
+		})
+		ctx.warnings = warnings
+		defer func() { ctx.warnings = nil }()
+
+		key, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		require.NotNil(t, key)
+		defer func() { _ = key.Delete() }()
+		if !hidden {
+			t.Skip("token fills in CKA_PUBLIC_EXPONENT")
+		}
+
+		assert.True(t, publicKeysEqual(&priv.PublicKey, key.Public()))
+		testRsaSigning(t, key, false)
+
+		ctx.cfg.StrictRSAPublicExponent = true
+		found, err := ctx.FindKeyPair(id, nil)
+		assert.Nil(t, found)
+		assert.Error(t, err)
+
+		// Closing waits for queued warnings; only the first FindKeyPair assumed the exponent
+		warnings.close()
+		require.Len(t, assumed, 1)
+		assert.Equal(t, RSAExponentAssumed, assumed[0].Type)
+		assert.Equal(t, key.(*pkcs11PrivateKeyRSA).handle, assumed[0].Handle)
+		assert.Equal(t, id, assumed[0].ID)
+		assert.Equal(t, label, assumed[0].Label)
+	})
+}
+
+func TestRsaPublicKeyFromPrivateObject(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		secret, err := ctx.GenerateSecretKey(randomBytes(), 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = secret.Delete() }()
+
+		rsaKey := key.(*pkcs11PrivateKeyRSA)
+		err = ctx.withSession(func(session *pkcs11Session) error {
+			// An object without CKA_MODULUS stands in for a public key object that cannot be read.
+			pub, fromPublicObject, err := ctx.keyPairRSAPublicKey(session, &secret.handle, rsaKey.handle, nil, nil)
+			require.NoError(t, err)
+			assert.False(t, fromPublicObject)
+			assert.True(t, publicKeysEqual(key.Public(), pub))
+
+			pub, fromPublicObject, err = ctx.keyPairRSAPublicKey(session, &rsaKey.pubKeyHandle, rsaKey.handle, nil,
+				nil)
+			require.NoError(t, err)
+			assert.True(t, fromPublicObject)
+			assert.True(t, publicKeysEqual(key.Public(), pub))
+			return nil
+		})
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rsa"
+
+	"github.com/miekg/pkcs11"
+)
+
+// rsaEncryptMechanism returns the mechanism for encrypting plaintext with opts, which take the same values as for
+// Decrypt: nil or *rsa.PKCS1v15DecryptOptions for PKCS#1 v1.5, *rsa.OAEPOptions for RSA-OAEP and
+// *RawRSADecryptOptions for raw RSA. rsa.ErrMessageTooLong is returned if plaintext is too long for the padding and
+// a modulus of size bytes. If size is zero, the length is left for the token to check.
+func rsaEncryptMechanism(plaintext []byte, size int, opts crypto.DecrypterOpts) ([]*pkcs11.Mechanism, error) {
+	if isNilPointer(opts) {
+		return nil, errUnsupportedRSAOptions
+	}
+	var mech *pkcs11.Mechanism
+	limit := size
+	switch o := opts.(type) {
+	case nil, *rsa.PKCS1v15DecryptOptions:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		limit = size - 11
+	case *rsa.OAEPOptions:
+		params, err := oaepParams(o)
+		if err != nil {
+			return nil, err
+		}
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)
+		limit = size - 2*o.Hash.Size() - 2
+	case *RawRSADecryptOptions:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_X_509, nil)
+	default:
+		return nil, errUnsupportedRSAOptions
+	}
+
+	if size > 0 && len(plaintext) > limit {
+		return nil, rsa.ErrMessageTooLong
+	}
+	return []*pkcs11.Mechanism{mech}, nil
+}
+
+// rsaEncrypt encrypts plaintext on the token with the public key object handle, using mech from
+// rsaEncryptMechanism. Raw RSA results are left-padded to size bytes.
+func rsaEncrypt(session *pkcs11Session, handle pkcs11.ObjectHandle, mech []*pkcs11.Mechanism, plaintext []byte,
+	size int, opts crypto.DecrypterOpts) ([]byte, error) {
+
+	if err := session.encryptInit(mech, handle); err != nil {
+		if o, ok := opts.(*rsa.OAEPOptions); ok {
+			return nil, oaepLabelError(err, o.Label)
+		}
+		return nil, err
+	}
+	ciphertext, err := session.encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	// Some tokens strip leading zero bytes from the result of CKM_RSA_X_509.
+	if mech[0].Mechanism == pkcs11.CKM_RSA_X_509 && len(ciphertext) < size {
+		padded := make([]byte, size)
+		copy(padded[size-len(ciphertext):], ciphertext)
+		ciphertext = padded
+	}
+	return ciphertext, nil
+}
+
+// Encrypt encrypts plaintext on the token with the public key object of the key pair, so that the public key need
+// not be used in software. opts takes the same values as for Decrypt, see PublicKey.Encrypt.
+func (priv *pkcs11PrivateKeyRSA) Encrypt(plaintext []byte, opts crypto.DecrypterOpts) (ciphertext []byte,
+	err error) {
+
+	pub, ok := priv.Public().(*rsa.PublicKey)
+	if !ok || pub.N == nil {
+		return nil, errMalformedRSAPublicKey
+	}
+	size := (pub.N.BitLen() + 7) / 8
+	mech, err := rsaEncryptMechanism(plaintext, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = priv.context.checkOptionsHashes(opts); err != nil {
+		return nil, err
+	}
+
+	err = priv.withSession(func(session *pkcs11Session) error {
+		ciphertext, err = rsaEncrypt(session, priv.pubKeyHandle, mech, plaintext, size, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = priv.context.checkOutputLength("RSA ciphertext", "the modulus length", size, ciphertext); err != nil {
+		return nil, err
+	}
+	return ciphertext, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRsaEncryptMechanism(t *testing.T) {
+	const size = 256
+
+	for _, test := range []struct {
+		opts      crypto.DecrypterOpts
+		mechanism uint
+		limit     int
+	}{
+		{nil, pkcs11.CKM_RSA_PKCS, size - 11},
+		{&rsa.PKCS1v15DecryptOptions{}, pkcs11.CKM_RSA_PKCS, size - 11},
+		{&rsa.OAEPOptions{Hash: crypto.SHA1}, pkcs11.CKM_RSA_PKCS_OAEP, size - 42},
+		{&rsa.OAEPOptions{Hash: crypto.SHA256}, pkcs11.CKM_RSA_PKCS_OAEP, size - 66},
+		{&RawRSADecryptOptions{}, pkcs11.CKM_RSA_X_509, size},
+	} {
+		mech, err := rsaEncryptMechanism(make([]byte, test.limit), size, test.opts)
+		require.NoError(t, err, "%T", test.opts)
+		assert.Equal(t, test.mechanism, mech[0].Mechanism)
+
+		_, err = rsaEncryptMechanism(make([]byte, test.limit+1), size, test.opts)
+		assert.Equal(t, rsa.ErrMessageTooLong, err, "%T", test.opts)
+
+		// With an unknown modulus size, the token checks the length.
+		_, err = rsaEncryptMechanism(make([]byte, test.limit+1), 0, test.opts)
+		assert.NoError(t, err, "%T", test.opts)
+	}
+
+	_, err := rsaEncryptMechanism(nil, size, &rsa.PSSOptions{})
+	assert.Equal(t, errUnsupportedRSAOptions, err)
+}
+
+func TestRsaKeyPairEncrypt(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeDecryption)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		encrypter, ok := key.(Encrypter)
+		require.True(t, ok)
+		size := (key.Public().(*rsa.PublicKey).N.BitLen() + 7) / 8
+
+		for name, opts := range map[string]crypto.DecrypterOpts{
+			"Nil":      nil,
+			"PKCS1v15": &rsa.PKCS1v15DecryptOptions{},
+			"OAEPSHA1": &rsa.OAEPOptions{Hash: crypto.SHA1},
+			"Raw":      &RawRSADecryptOptions{},
+		} {
+			t.Run(name, func(t *testing.T) {
+				if _, raw := opts.(*RawRSADecryptOptions); raw {
+					skipIfMechUnsupported(t, ctx, pkcs11.CKM_RSA_X_509)
+				}
+
+				plaintext := []byte("encrypted on the token")
+				if _, raw := opts.(*RawRSADecryptOptions); raw {
+					plaintext = make([]byte, size)
+					_, err := rand.Read(plaintext[1:])
+					require.NoError(t, err)
+				}
+
+				ciphertext, err := encrypter.Encrypt(plaintext, opts)
+				require.NoError(t, err)
+				assert.Len(t, ciphertext, size)
+
+				decrypted, err := key.Decrypt(rand.Reader, ciphertext, opts)
+				require.NoError(t, err)
+				assert.True(t, bytes.Equal(plaintext, decrypted))
+
+				_, err = encrypter.Encrypt(make([]byte, size+1), opts)
+				assert.Equal(t, rsa.ErrMessageTooLong, err)
+			})
+		}
+	})
+}
+
+func TestPublicKeyEncryptUnreadableModulus(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		key, err := ctx.GenerateRSAKeyPairForPurpose(id, nil, rsaSize, KeyPurposeDecryption)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		found, err := ctx.FindPublicKey(id, nil)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+
+		// As found by FindPublicKey when the token refuses to reveal CKA_MODULUS.
+		pub := &PublicKey{pkcs11Object: found.pkcs11Object, keyType: pkcs11.CKK_RSA, modulusBits: rsaSize}
+		var encrypter Encrypter = pub
+		assert.Nil(t, encrypter.Public())
+
+		ciphertext, err := pub.Encrypt([]byte("public key hidden"), nil)
+		require.NoError(t, err)
+		plaintext, err := key.Decrypt(rand.Reader, ciphertext, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("public key hidden"), plaintext)
+
+		_, err = pub.Encrypt(make([]byte, rsaSize/8-10), nil)
+		assert.Equal(t, rsa.ErrMessageTooLong, err)
+
+		assert.Error(t, pub.Verify(make([]byte, 32), make([]byte, rsaSize/8), crypto.SHA256))
+	})
+}
@@ -0,0 +1,257 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// RSAKeyPairOptions controls the key pair created by GenerateRSAKeyPairWithOptions.
+type RSAKeyPairOptions struct {
+	// ID is used to set CKA_ID. If it is nil, an unused ID is generated, see Context.GenerateID.
+	ID []byte
+
+	// Label, if not nil, is used to set CKA_LABEL.
+	Label []byte
+
+	// Bits is the modulus size.
+	Bits int
+
+	// Exponent is the public exponent, which is checked as for GenerateRSAKeyPairWithExponent. If it is nil,
+	// 65537 is used.
+	Exponent *big.Int
+
+	// Sign, Decrypt and Unwrap set CKA_SIGN, CKA_DECRYPT and CKA_UNWRAP on the private key, and CKA_VERIFY,
+	// CKA_ENCRYPT and CKA_WRAP on the public key. At least one must be set.
+	Sign    bool
+	Decrypt bool
+	Unwrap  bool
+
+	// AllowedMechanisms, if not empty, is written to CKA_ALLOWED_MECHANISMS on the private key, so that the token
+	// refuses any other mechanism. If the token rejects the attribute, the key pair is generated without it, an
+	// AllowedMechanismsRejected warning is raised, and only the returned key enforces the list; see
+	// RequireAllowedMechanisms.
+	AllowedMechanisms []uint
+
+	// RequireAllowedMechanisms makes generation fail, rather than proceed without CKA_ALLOWED_MECHANISMS, if the
+	// token rejects the attribute.
+	RequireAllowedMechanisms bool
+}
+
+// errNoKeyUsage is returned by GenerateRSAKeyPairWithOptions if no usage is requested.
+var errNoKeyUsage = errors.New("at least one of Sign, Decrypt and Unwrap must be set")
+
+// keyPairUsage records the usage a key pair was generated with, see RSAKeyPairOptions. Operations outside it fail
+// with a *KeyUsageError before the token is called.
+type keyPairUsage struct {
+	label   []byte
+	sign    bool
+	decrypt bool
+	unwrap  bool
+
+	// allowed is the CKA_ALLOWED_MECHANISMS list, or nil if any mechanism may be used.
+	allowed []uint
+}
+
+// GenerateRSAKeyPairWithOptions creates an RSA key pair on the token with exactly the usage given by opts, and
+// optionally restricts the mechanisms the private key may be used with. The returned key checks each Sign, Decrypt,
+// SignMessage, NewStreamSigner and UnwrapPrivateKey operation against opts before calling the token, returning a
+// *KeyUsageError for operations outside them. Keys found again later, for instance with FindKeyPair or after a
+// restart, are only restricted by the token. In particular, if the token rejected CKA_ALLOWED_MECHANISMS, the list is
+// not stored anywhere and a key pair found again may be used with any mechanism its usage attributes permit.
+//
+// CKM_RSA_PKCS serves both signing and decryption, so it is the usage flags, rather than AllowedMechanisms, that stop
+// a PKCS#1 v1.5 signing key being used for decryption.
+func (c *Context) GenerateRSAKeyPairWithOptions(opts RSAKeyPairOptions) (SignerDecrypter, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if !opts.Sign && !opts.Decrypt && !opts.Unwrap {
+		return nil, errNoKeyUsage
+	}
+	exponent := opts.Exponent
+	if exponent == nil {
+		exponent = defaultRSAExponent
+	}
+	if err := checkRSAExponent(exponent); err != nil {
+		return nil, err
+	}
+
+	id := opts.ID
+	if id == nil {
+		var err error
+		if id, err = c.generateID(); err != nil {
+			return nil, err
+		}
+	}
+	public, err := NewAttributeSetWithID(id)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Label != nil {
+		if err = public.Set(CkaLabel, opts.Label); err != nil {
+			return nil, err
+		}
+	}
+	// Copy the AttributeSet to allow modifications.
+	private := public.Copy()
+
+	public.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, opts.Sign),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, opts.Decrypt),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, opts.Unwrap),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, exponent.Bytes()),
+	})
+	private.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, opts.Sign),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, opts.Decrypt),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, opts.Unwrap),
+	})
+
+	usage := &keyPairUsage{
+		label:   opts.Label,
+		sign:    opts.Sign,
+		decrypt: opts.Decrypt,
+		unwrap:  opts.Unwrap,
+	}
+
+	// rejected is the token's error if it rejected CKA_ALLOWED_MECHANISMS
+	var rejected error
+	if len(opts.AllowedMechanisms) > 0 {
+		usage.allowed = append([]uint(nil), opts.AllowedMechanisms...)
+
+		restricted := private.Copy()
+		if err = restricted.Set(CkaAllowedMechanisms, ulongsToBytes(usage.allowed)); err != nil {
+			return nil, err
+		}
+		key, err := c.GenerateRSAKeyPairWithAttributes(public.Copy(), restricted, opts.Bits)
+		if err == nil {
+			key.(*pkcs11PrivateKeyRSA).usage = usage
+			return key, nil
+		}
+		if opts.RequireAllowedMechanisms || !isAttributeRejected(err) {
+			return nil, withMessage(err, "generating RSA key pair with CKA_ALLOWED_MECHANISMS")
+		}
+		rejected = err
+	}
+
+	key, err := c.GenerateRSAKeyPairWithAttributes(public, private, opts.Bits)
+	if err != nil {
+		return nil, err
+	}
+	key.(*pkcs11PrivateKeyRSA).usage = usage
+	if rejected != nil {
+		c.warnings.warn(AllowedMechanismsRejected, key.(*pkcs11PrivateKeyRSA).handle, id, opts.Label, rejected)
+	}
+	return key, nil
+}
+
+// isAttributeRejected returns true if err may mean the token does not support an attribute in a template. Some
+// tokens, such as NSS, report CKR_GENERAL_ERROR for CKA_ALLOWED_MECHANISMS, so that is included; a failure
+// unrelated to the attribute will recur when generation is retried without it.
+func isAttributeRejected(err error) bool {
+	return isPKCS11Error(err, pkcs11.CKR_ATTRIBUTE_TYPE_INVALID, pkcs11.CKR_ATTRIBUTE_VALUE_INVALID,
+		pkcs11.CKR_TEMPLATE_INCONSISTENT, pkcs11.CKR_GENERAL_ERROR)
+}
+
+// ulongsToBytes encodes a CK_ULONG array attribute value, such as CKA_ALLOWED_MECHANISMS.
+func ulongsToBytes(values []uint) []byte {
+	var encoded []byte
+	for _, v := range values {
+		encoded = append(encoded, ulongToBytes(v)...)
+	}
+	return encoded
+}
+
+// checkUsage returns a *KeyUsageError if the key pair was generated without the usage attribute, one of CKA_SIGN,
+// CKA_DECRYPT or CKA_UNWRAP, or if mechanism is not in its allowed mechanisms. Key pairs not generated by
+// GenerateRSAKeyPairWithOptions are only checked not to be archived.
+func (k *pkcs11PrivateKey) checkUsage(operation string, attribute uint, mechanism uint) error {
+	if err := k.checkArchived(operation); err != nil {
+		return err
+	}
+	u := k.usage
+	if u == nil {
+		return nil
+	}
+
+	var permitted bool
+	var name string
+	switch attribute {
+	case pkcs11.CKA_SIGN:
+		permitted, name = u.sign, "CKA_SIGN"
+	case pkcs11.CKA_DECRYPT:
+		permitted, name = u.decrypt, "CKA_DECRYPT"
+	case pkcs11.CKA_UNWRAP:
+		permitted, name = u.unwrap, "CKA_UNWRAP"
+	}
+	if !permitted {
+		return &KeyUsageError{Label: u.label, Operation: operation, Reason: "key lacks " + name}
+	}
+	if !mechanismAllowed(u.allowed, mechanism) {
+		return &KeyUsageError{Label: u.label, Operation: operation,
+			Reason: fmt.Sprintf("mechanism %#x is not in CKA_ALLOWED_MECHANISMS", mechanism)}
+	}
+	return nil
+}
+
+// checkSignUsage checks that Sign may be called with opts, see checkUsage.
+func (priv *pkcs11PrivateKeyRSA) checkSignUsage(opts interface{}) error {
+	if priv.usage == nil {
+		return priv.checkArchived("signing")
+	}
+	mechanism := uint(pkcs11.CKM_RSA_PKCS)
+	if profile := priv.profileFor(MechanismSign); profile != nil {
+		mechanism = profile.mechanism
+	} else if _, ok := opts.(*rsa.PSSOptions); ok {
+		mechanism = pkcs11.CKM_RSA_PKCS_PSS
+		if priv.context.softwarePSS() {
+			mechanism = pkcs11.CKM_RSA_X_509
+		}
+	}
+	return priv.checkUsage("signing", pkcs11.CKA_SIGN, mechanism)
+}
+
+// checkDecryptUsage checks that Decrypt may be called with opts, see checkUsage.
+func (priv *pkcs11PrivateKeyRSA) checkDecryptUsage(opts interface{}) error {
+	if priv.usage == nil {
+		return priv.checkArchived("decryption")
+	}
+	mechanism := uint(pkcs11.CKM_RSA_PKCS)
+	if profile := priv.profileFor(MechanismDecrypt); profile != nil {
+		mechanism = profile.mechanism
+	} else {
+		switch opts.(type) {
+		case *RawRSADecryptOptions:
+			mechanism = pkcs11.CKM_RSA_X_509
+		case *rsa.OAEPOptions:
+			mechanism = pkcs11.CKM_RSA_PKCS_OAEP
+		}
+	}
+	return priv.checkUsage("decryption", pkcs11.CKA_DECRYPT, mechanism)
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireKeyUsageError fails the test unless err is a *KeyUsageError.
+func requireKeyUsageError(t *testing.T, err error) {
+	var usageErr *KeyUsageError
+	require.True(t, errors.As(err, &usageErr), "%v", err)
+}
+
+func TestGenerateRSAKeyPairWithOptions(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		opts := RSAKeyPairOptions{
+			Label:             randomBytes(),
+			Bits:              rsaSize,
+			Sign:              true,
+			AllowedMechanisms: []uint{pkcs11.CKM_RSA_PKCS_PSS, pkcs11.CKM_SHA256_RSA_PKCS_PSS},
+		}
+		key, err := ctx.GenerateRSAKeyPairWithOptions(opts)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		attributes, err := key.(*pkcs11PrivateKeyRSA).context.getAttributes(key.(*pkcs11PrivateKeyRSA).handle,
+			[]AttributeType{CkaId, CkaSign, CkaDecrypt, CkaUnwrap})
+		require.NoError(t, err)
+		assert.Len(t, attributes[CkaId].Value, generatedIDLength)
+		assert.Equal(t, []byte{1}, attributes[CkaSign].Value)
+		assert.Equal(t, []byte{0}, attributes[CkaDecrypt].Value)
+		assert.Equal(t, []byte{0}, attributes[CkaUnwrap].Value)
+
+		digest := sha256.Sum256([]byte("policy says sign only"))
+		pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		signature, err := key.Sign(nil, digest[:], pssOpts)
+		require.NoError(t, err)
+		require.NoError(t, rsa.VerifyPSS(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], signature, pssOpts))
+
+		// Operations outside the generated usage fail before reaching the token, whether or not the token
+		// accepted CKA_ALLOWED_MECHANISMS.
+		_, err = key.Sign(nil, digest[:], crypto.SHA256)
+		requireKeyUsageError(t, err)
+
+		_, err = key.Decrypt(nil, signature, nil)
+		requireKeyUsageError(t, err)
+
+		_, err = key.(MessageSigner).SignMessage(nil, []byte("message"), crypto.SHA256)
+		requireKeyUsageError(t, err)
+
+		_, err = ctx.UnwrapPrivateKey(key, make([]byte, rsaSize/8), pkcs11.CKM_RSA_PKCS_OAEP, nil, NewAttributeSet())
+		requireKeyUsageError(t, err)
+
+		// RequireAllowedMechanisms only succeeds if the token stores the attribute.
+		tokenEnforced := len(ctx.allowedMechanisms(&key.(*pkcs11PrivateKeyRSA).pkcs11PrivateKey)) > 0
+		opts.Label = nil
+		opts.RequireAllowedMechanisms = true
+		required, err := ctx.GenerateRSAKeyPairWithOptions(opts)
+		if tokenEnforced {
+			require.NoError(t, err)
+			assert.NoError(t, required.Delete())
+		} else {
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestAllowedMechanismsRejectedWarning(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	var rejected []KeyWarning
+	config.KeyWarningFunc = func(warning KeyWarning) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if warning.Type == AllowedMechanismsRejected {
+			rejected = append(rejected, warning)
+		}
+	}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+
+	id := randomBytes()
+	key, err := ctx.GenerateRSAKeyPairWithOptions(RSAKeyPairOptions{
+		ID:                id,
+		Label:             []byte("restricted"),
+		Bits:              rsaSize,
+		Sign:              true,
+		AllowedMechanisms: []uint{pkcs11.CKM_RSA_PKCS_PSS},
+	})
+	require.NoError(t, err)
+	handle := key.(*pkcs11PrivateKeyRSA).handle
+	tokenEnforced := len(ctx.allowedMechanisms(&key.(*pkcs11PrivateKeyRSA).pkcs11PrivateKey)) > 0
+	require.NoError(t, key.Delete())
+
+	// Close waits for queued warnings to be delivered
+	require.NoError(t, ctx.Close())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if tokenEnforced {
+		assert.Empty(t, rejected)
+	} else {
+		require.Len(t, rejected, 1)
+		assert.Error(t, rejected[0].Err)
+		assert.Equal(t, handle, rejected[0].Handle)
+		assert.Equal(t, id, rejected[0].ID)
+		assert.Equal(t, []byte("restricted"), rejected[0].Label)
+	}
+}
+
+func TestGenerateRSAKeyPairWithOptionsErrors(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		_, err := ctx.GenerateRSAKeyPairWithOptions(RSAKeyPairOptions{Bits: rsaSize})
+		assert.Equal(t, errNoKeyUsage, err)
+
+		_, err = ctx.GenerateRSAKeyPairWithOptions(RSAKeyPairOptions{Bits: rsaSize, Sign: true,
+			Exponent: big.NewInt(4)})
+		assert.Equal(t, errInvalidRSAExponent, err)
+	})
+}
+
+func TestKeyPairCheckUsage(t *testing.T) {
+	var unrestricted pkcs11PrivateKey
+	assert.NoError(t, unrestricted.checkUsage("decryption", pkcs11.CKA_DECRYPT, pkcs11.CKM_RSA_X_509))
+
+	k := pkcs11PrivateKey{usage: &keyPairUsage{label: []byte("wrapper"), unwrap: true,
+		allowed: []uint{pkcs11.CKM_RSA_PKCS_OAEP}}}
+	assert.NoError(t, k.checkUsage("unwrapping", pkcs11.CKA_UNWRAP, pkcs11.CKM_RSA_PKCS_OAEP))
+	assert.EqualError(t, k.checkUsage("unwrapping", pkcs11.CKA_UNWRAP, pkcs11.CKM_RSA_PKCS),
+		"key 'wrapper' cannot be used for unwrapping: mechanism 0x1 is not in CKA_ALLOWED_MECHANISMS")
+	assert.EqualError(t, k.checkUsage("signing", pkcs11.CKA_SIGN, pkcs11.CKM_RSA_PKCS_OAEP),
+		"key 'wrapper' cannot be used for signing: key lacks CKA_SIGN")
+
+	assert.Equal(t, append(ulongToBytes(1), ulongToBytes(9)...), ulongsToBytes([]uint{1, 9}))
+	assert.Equal(t, []uint{1, 9}, bytesToUlongs(ulongsToBytes([]uint{1, 9})))
+}
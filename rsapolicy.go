@@ -0,0 +1,103 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PolicyError is returned by an operation that the key supports but that the policy of the Context, or of the key,
+// forbids. See Config.DisallowPKCS1v15Decryption.
+type PolicyError struct {
+	// Label is the CKA_LABEL of the key, if it has one.
+	Label []byte
+
+	// Operation names the operation that was requested, such as "PKCS#1 v1.5 decryption".
+	Operation string
+
+	// Policy names the setting that forbids the operation.
+	Policy string
+}
+
+func (e *PolicyError) Error() string {
+	if len(e.Label) == 0 {
+		return fmt.Sprintf("%s is disallowed by %s", e.Operation, e.Policy)
+	}
+	return fmt.Sprintf("%s with key '%s' is disallowed by %s", e.Operation, e.Label, e.Policy)
+}
+
+// WithPKCS1v15Decryption returns a copy of key, an RSA key pair of this Context, whose Decrypt method accepts
+// PKCS#1 v1.5 ciphertexts if allowed is true and rejects them with a *PolicyError otherwise, whatever
+// Config.DisallowPKCS1v15Decryption says. The copy shares the token objects of key, whose own policy is unchanged.
+// PKCS#1 v1.5 signatures are not affected.
+func (c *Context) WithPKCS1v15Decryption(key Signer, allowed bool) (Signer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	priv, ok := key.(*pkcs11PrivateKeyRSA)
+	if !ok || priv.context != c {
+		return nil, fmt.Errorf("not an RSA key pair of this Context: %T", key)
+	}
+	result := *priv
+	result.pkcs1v15Decryption = &allowed
+	return &result, nil
+}
+
+// pkcs1v15DecryptionAllowed reports whether the policy permits PKCS#1 v1.5 decryption with priv.
+func (priv *pkcs11PrivateKeyRSA) pkcs1v15DecryptionAllowed() bool {
+	if priv.pkcs1v15Decryption != nil {
+		return *priv.pkcs1v15Decryption
+	}
+	return !priv.context.cfg.DisallowPKCS1v15Decryption
+}
+
+// checkDecryptPolicy returns a *PolicyError if Decrypt would use CKM_RSA_PKCS with opts and the policy forbids it.
+// A MechanismDecrypt profile is checked by its mechanism rather than by opts.
+func (priv *pkcs11PrivateKeyRSA) checkDecryptPolicy(opts interface{}) error {
+	if priv.pkcs1v15DecryptionAllowed() {
+		return nil
+	}
+
+	pkcs1v15 := opts == nil
+	if profile := priv.profileFor(MechanismDecrypt); profile != nil {
+		pkcs1v15 = profile.mechanism == pkcs11.CKM_RSA_PKCS
+	} else if _, ok := opts.(*rsa.PKCS1v15DecryptOptions); ok {
+		pkcs1v15 = true
+	}
+	if !pkcs1v15 {
+		return nil
+	}
+
+	policy := "Config.DisallowPKCS1v15Decryption"
+	if priv.pkcs1v15Decryption != nil {
+		policy = "the key's PKCS#1 v1.5 decryption policy"
+	}
+	var label []byte
+	if priv.usage != nil {
+		label = priv.usage.label
+	}
+	return &PolicyError{Label: label, Operation: "PKCS#1 v1.5 decryption", Policy: policy}
+}
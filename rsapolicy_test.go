@@ -0,0 +1,126 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyErrorMessage(t *testing.T) {
+	err := &PolicyError{Operation: "PKCS#1 v1.5 decryption", Policy: "Config.DisallowPKCS1v15Decryption"}
+	assert.Equal(t, "PKCS#1 v1.5 decryption is disallowed by Config.DisallowPKCS1v15Decryption", err.Error())
+
+	err.Label = []byte("legacy")
+	assert.Equal(t, "PKCS#1 v1.5 decryption with key 'legacy' is disallowed by Config.DisallowPKCS1v15Decryption",
+		err.Error())
+}
+
+func TestDisallowPKCS1v15Decryption(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeBoth)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		pub := key.Public().(*rsa.PublicKey)
+		message := []byte("policy")
+		pkcs1v15, err := rsa.EncryptPKCS1v15(rand.Reader, pub, message)
+		require.NoError(t, err)
+
+		ctx.cfg.DisallowPKCS1v15Decryption = true
+		defer func() { ctx.cfg.DisallowPKCS1v15Decryption = false }()
+
+		decrypter := key.(SignerDecrypter)
+		for _, options := range []crypto.DecrypterOpts{nil, &rsa.PKCS1v15DecryptOptions{},
+			&rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(message)}} {
+			_, err = decrypter.Decrypt(rand.Reader, pkcs1v15, options)
+			var policyErr *PolicyError
+			require.True(t, errors.As(err, &policyErr), "%T: %v", options, err)
+			assert.Equal(t, "Config.DisallowPKCS1v15Decryption", policyErr.Policy)
+		}
+
+		// Signing and OAEP are untouched.
+		digest := sha256.Sum256(message)
+		_, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		assert.NoError(t, err)
+		if ctx.tokenSupports(pkcs11.CKM_RSA_PKCS_OAEP, pkcs11.CKF_DECRYPT) {
+			oaep, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, message, nil)
+			require.NoError(t, err)
+			plaintext, err := decrypter.Decrypt(rand.Reader, oaep, &rsa.OAEPOptions{Hash: crypto.SHA256})
+			require.NoError(t, err)
+			assert.Equal(t, message, plaintext)
+		}
+
+		ops, err := key.(OperationReporter).SupportedOperations()
+		require.NoError(t, err)
+		assert.False(t, ops.DecryptPKCS1v15)
+		assert.Equal(t, ctx.tokenSupports(pkcs11.CKM_RSA_PKCS, pkcs11.CKF_SIGN), ops.SignPKCS1v15)
+
+		caps, err := ctx.Capabilities()
+		require.NoError(t, err)
+		assert.True(t, caps.PKCS1v15DecryptionDisallowed)
+
+		// The per-key override lifts the restriction for the copy only.
+		allowed, err := ctx.WithPKCS1v15Decryption(key, true)
+		require.NoError(t, err)
+		plaintext, err := allowed.(SignerDecrypter).Decrypt(rand.Reader, pkcs1v15, nil)
+		require.NoError(t, err)
+		assert.Equal(t, message, plaintext)
+
+		ops, err = allowed.(OperationReporter).SupportedOperations()
+		require.NoError(t, err)
+		assert.Equal(t, ctx.tokenSupports(pkcs11.CKM_RSA_PKCS, pkcs11.CKF_DECRYPT), ops.DecryptPKCS1v15)
+
+		_, err = decrypter.Decrypt(rand.Reader, pkcs1v15, nil)
+		assert.IsType(t, &PolicyError{}, err)
+
+		// And can impose it when the Context allows PKCS#1 v1.5.
+		ctx.cfg.DisallowPKCS1v15Decryption = false
+		denied, err := ctx.WithPKCS1v15Decryption(key, false)
+		require.NoError(t, err)
+		_, err = denied.(SignerDecrypter).Decrypt(rand.Reader, pkcs1v15, nil)
+		assert.IsType(t, &PolicyError{}, err)
+		plaintext, err = decrypter.Decrypt(rand.Reader, pkcs1v15, nil)
+		require.NoError(t, err)
+		assert.Equal(t, message, plaintext)
+	})
+}
+
+func TestWithPKCS1v15DecryptionRejectsOtherKeys(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		_, err = ctx.WithPKCS1v15Decryption(key, true)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// SaturationFunc is called when the session pool saturation crosses Config.SaturationThreshold, in either direction.
+// See Config.OnSaturation.
+type SaturationFunc func(level float64)
+
+// saturation tracks the proportion of pool sessions in use. Reading the level takes no locks. A nil *saturation
+// reports zero.
+type saturation struct {
+	// Atomic fields, accessed with sync/atomic
+	inUse    int64
+	capacity int64
+	smoothed uint64 // math.Float64bits of the smoothed level
+	above    int32  // 1 if the level was at or above threshold when callback was last called
+
+	// smoothing is the weight of the previous level, see Config.SaturationSmoothing.
+	smoothing float64
+
+	threshold float64
+	callback  SaturationFunc
+
+	// mutex serialises calls to callback.
+	mutex sync.Mutex
+}
+
+// newSaturation creates saturation tracking for config.
+func newSaturation(config *Config) *saturation {
+	return &saturation{
+		smoothing: config.SaturationSmoothing,
+		threshold: config.SaturationThreshold,
+		callback:  config.OnSaturation,
+	}
+}
+
+// setCapacity records the number of sessions in the pool.
+func (s *saturation) setCapacity(capacity int) {
+	if s == nil {
+		return
+	}
+	atomic.StoreInt64(&s.capacity, int64(capacity))
+}
+
+// acquired records that a session was taken from the pool.
+func (s *saturation) acquired() {
+	s.update(1)
+}
+
+// released records that a session was returned to the pool.
+func (s *saturation) released() {
+	s.update(-1)
+}
+
+// update adjusts the number of sessions in use, then the smoothed level, and calls the callback if the threshold
+// was crossed.
+func (s *saturation) update(delta int64) {
+	if s == nil {
+		return
+	}
+
+	instant := ratio(atomic.AddInt64(&s.inUse, delta), atomic.LoadInt64(&s.capacity))
+	level := instant
+	if s.smoothing > 0 {
+		for {
+			old := atomic.LoadUint64(&s.smoothed)
+			level = s.smoothing*math.Float64frombits(old) + (1-s.smoothing)*instant
+			if atomic.CompareAndSwapUint64(&s.smoothed, old, math.Float64bits(level)) {
+				break
+			}
+		}
+	}
+
+	if s.callback == nil {
+		return
+	}
+	above := level >= s.threshold
+	if above == (atomic.LoadInt32(&s.above) == 1) {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Another goroutine may have crossed back while we waited.
+	level = s.level()
+	above = level >= s.threshold
+	if above == (atomic.LoadInt32(&s.above) == 1) {
+		return
+	}
+	if above {
+		atomic.StoreInt32(&s.above, 1)
+	} else {
+		atomic.StoreInt32(&s.above, 0)
+	}
+	s.callback(level)
+}
+
+// level returns the current, possibly smoothed, saturation level.
+func (s *saturation) level() float64 {
+	if s == nil {
+		return 0
+	}
+	if s.smoothing > 0 {
+		return math.Float64frombits(atomic.LoadUint64(&s.smoothed))
+	}
+	return ratio(atomic.LoadInt64(&s.inUse), atomic.LoadInt64(&s.capacity))
+}
+
+// ratio returns inUse/capacity, or zero if there is no capacity.
+func ratio(inUse, capacity int64) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return float64(inUse) / float64(capacity)
+}
+
+// Saturation returns the proportion of pool sessions currently in use, from 0 (idle) to 1 (every session checked
+// out, so further operations wait for the pool). If Config.SaturationSmoothing is set, the value is smoothed over
+// recent pool activity. Saturation takes no locks and is cheap enough to call on every request, for instance to
+// shed load at admission.
+func (c *Context) Saturation() float64 {
+	return c.saturation.level()
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaturationNil(t *testing.T) {
+	var s *saturation
+	s.setCapacity(4)
+	s.acquired()
+	s.released()
+	assert.Equal(t, 0.0, s.level())
+}
+
+func TestSaturationLevel(t *testing.T) {
+	s := newSaturation(&Config{})
+	assert.Equal(t, 0.0, s.level())
+
+	s.setCapacity(4)
+	s.acquired()
+	assert.Equal(t, 0.25, s.level())
+	s.acquired()
+	s.acquired()
+	s.acquired()
+	assert.Equal(t, 1.0, s.level())
+	s.released()
+	assert.Equal(t, 0.75, s.level())
+}
+
+func TestSaturationSmoothing(t *testing.T) {
+	s := newSaturation(&Config{SaturationSmoothing: 0.5})
+	s.setCapacity(2)
+
+	s.acquired()
+	assert.Equal(t, 0.25, s.level())
+	s.acquired()
+	assert.Equal(t, 0.625, s.level())
+	s.released()
+	assert.Equal(t, 0.5625, s.level())
+}
+
+func TestSaturationCallback(t *testing.T) {
+	var levels []float64
+	s := newSaturation(&Config{
+		SaturationThreshold: 0.75,
+		OnSaturation:        func(level float64) { levels = append(levels, level) },
+	})
+	s.setCapacity(4)
+
+	s.acquired()
+	s.acquired()
+	assert.Empty(t, levels)
+
+	s.acquired()
+	s.acquired()
+	s.released()
+	assert.Equal(t, []float64{0.75}, levels)
+
+	s.released()
+	assert.Equal(t, []float64{0.75, 0.5}, levels)
+}
+
+func TestSaturationConcurrent(t *testing.T) {
+	var mutex sync.Mutex
+	calls := 0
+	s := newSaturation(&Config{
+		SaturationThreshold: 0.5,
+		OnSaturation: func(level float64) {
+			mutex.Lock()
+			calls++
+			mutex.Unlock()
+		},
+	})
+	s.setCapacity(8)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.acquired()
+				_ = s.level()
+				s.released()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0.0, s.level())
+
+	// Crossings alternate, so after returning to zero there have been as many falls as rises.
+	assert.Equal(t, 0, calls%2)
+}
+
+func TestSaturationConfigValidation(t *testing.T) {
+	for _, modify := range []func(*Config){
+		func(c *Config) { c.SaturationSmoothing = 1 },
+		func(c *Config) { c.SaturationSmoothing = -0.1 },
+		func(c *Config) { c.SaturationThreshold = 1.5 },
+		func(c *Config) { c.OnSaturation = func(float64) {} },
+	} {
+		config, err := loadConfigFromFile("config")
+		require.NoError(t, err)
+		modify(config)
+		_, err = Configure(config)
+		assert.Error(t, err)
+	}
+}
+
+func TestContextSaturation(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.MaxSessions = 3
+
+	var levels []float64
+	var mutex sync.Mutex
+	config.SaturationThreshold = 1
+	config.OnSaturation = func(level float64) {
+		mutex.Lock()
+		levels = append(levels, level)
+		mutex.Unlock()
+	}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	assert.Equal(t, 0.0, ctx.Saturation())
+
+	first, err := ctx.getSession()
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, ctx.Saturation())
+
+	second, err := ctx.getSession()
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, ctx.Saturation())
+
+	ctx.putSession(second, nil)
+	ctx.putSession(first, nil)
+	assert.Equal(t, 0.0, ctx.Saturation())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []float64{1, 0.5}, levels)
+}
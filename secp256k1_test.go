@@ -0,0 +1,133 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecp256k1Arithmetic(t *testing.T) {
+	curve := Secp256k1()
+	params := curve.Params()
+	require.True(t, curve.IsOnCurve(params.Gx, params.Gy))
+	assert.False(t, curve.IsOnCurve(params.Gx, new(big.Int).Add(params.Gy, big.NewInt(1))))
+
+	// 2G, from SEC 2 test vectors.
+	x2, _ := new(big.Int).SetString("C6047F9441ED7D6D3045406E95C07CD85C778E4B8CEF3CA7ABAC09B95C709EE5", 16)
+	y2, _ := new(big.Int).SetString("1AE168FEA63DC339A3C58419466CEAEEF7F632653266D0E1236431A950CFE52A", 16)
+	x, y := curve.Double(params.Gx, params.Gy)
+	assert.Equal(t, x2, x)
+	assert.Equal(t, y2, y)
+	x, y = curve.ScalarBaseMult([]byte{2})
+	assert.Equal(t, x2, x)
+	assert.Equal(t, y2, y)
+
+	// 3G = 2G + G, and nG is the point at infinity.
+	x3, y3 := curve.Add(x2, y2, params.Gx, params.Gy)
+	assert.True(t, curve.IsOnCurve(x3, y3))
+	x, y = curve.ScalarBaseMult([]byte{3})
+	assert.Equal(t, x3, x)
+	assert.Equal(t, y3, y)
+	x, y = curve.ScalarBaseMult(params.N.Bytes())
+	assert.Zero(t, x.Sign())
+	assert.Zero(t, y.Sign())
+}
+
+func TestSecp256k1Encoding(t *testing.T) {
+	curve := Secp256k1()
+	params, err := marshalEcParams(curve)
+	require.NoError(t, err)
+	assert.Equal(t, mustMarshal(secp256k1.oid), params)
+	unmarshalled, err := unmarshalEcParams(params)
+	require.NoError(t, err)
+	assert.True(t, unmarshalled == curve)
+
+	gx, gy := curve.Params().Gx, curve.Params().Gy
+	encoded := mustMarshal(elliptic.Marshal(curve, gx, gy))
+	x, y, err := unmarshalEcPoint(encoded, curve)
+	require.NoError(t, err)
+	assert.Equal(t, gx, x)
+	assert.Equal(t, gy, y)
+
+	fingerprint, err := PublicKeyFingerprint(&ecdsa.PublicKey{Curve: curve, X: gx, Y: gy})
+	require.NoError(t, err)
+	assert.Len(t, fingerprint, sha256.Size)
+	der, err := marshalWeierstrassPublicKey(&ecdsa.PublicKey{Curve: curve, X: gx, Y: gy}, secp256k1)
+	require.NoError(t, err)
+	_, err = x509.ParsePKIXPublicKey(der)
+	assert.Error(t, err, "crypto/x509 should still not know secp256k1")
+}
+
+func TestHardSecp256k1(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		if err := ctx.checkECCurve(Secp256k1()); err != nil {
+			t.Skipf("token does not support secp256k1: %v", err)
+		}
+
+		id := randomBytes()
+		key, err := ctx.GenerateECDSAKeyPair(id, Secp256k1())
+		if isPKCS11Error(err, pkcs11.CKR_CURVE_NOT_SUPPORTED, pkcs11.CKR_DOMAIN_PARAMS_INVALID,
+			pkcs11.CKR_ATTRIBUTE_VALUE_INVALID) {
+			t.Skipf("token rejected secp256k1: %v", err)
+		}
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		pub, ok := key.Public().(*ecdsa.PublicKey)
+		require.True(t, ok, "%T", key.Public())
+		assert.True(t, pub.Curve == Secp256k1())
+
+		digest := sha256.Sum256(randomBytes())
+		sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+		require.NoError(t, VerifySignature(key, digest[:], sig, crypto.SHA256))
+		require.NoError(t, verifyInSoftware(pub, digest[:], sig, crypto.SHA256))
+
+		found, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		require.IsType(t, &pkcs11PrivateKeyECDSA{}, found)
+		assert.Equal(t, pub, found.Public())
+	})
+}
+
+func TestVerifySignatureSoftwareSecp256k1(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(Secp256k1(), rand.Reader)
+	require.NoError(t, err)
+	digest := sha256.Sum256(randomBytes())
+	sig, err := priv.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+
+	assert.NoError(t, verifyInSoftware(&priv.PublicKey, digest[:], sig, crypto.SHA256))
+	digest[0] ^= 1
+	assert.Error(t, verifyInSoftware(&priv.PublicKey, digest[:], sig, crypto.SHA256))
+}
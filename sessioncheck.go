@@ -0,0 +1,117 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build crypto11_sessioncheck
+// +build crypto11_sessioncheck
+
+package crypto11
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/pkcs11"
+)
+
+// This file implements strict checking of session ownership. It is only compiled when the crypto11_sessioncheck
+// build tag is set, so that builds of programs using crypto11, including their -race builds, are unaffected. Every
+// checkout of a session from the pool is given a unique token, and any use of a session by a holder whose token is
+// not current (for instance after the session was returned to the pool) fails with ErrSessionOwnership.
+
+// sessionChecksEnabled is true if session ownership is checked.
+const sessionChecksEnabled = true
+
+// sessionOwnership records the checkout token held by the user of a session.
+type sessionOwnership struct {
+	token uint64
+}
+
+var (
+	// lastSessionToken is the most recently issued checkout token.
+	lastSessionToken uint64
+
+	// sessionOwnersMutex protects sessionOwners.
+	sessionOwnersMutex sync.Mutex
+
+	// sessionOwners maps checked out sessions to the token of their current holder.
+	sessionOwners = map[sessionKey]uint64{}
+)
+
+// sessionKey identifies a session. Handles are only unique within a PKCS#11 library.
+type sessionKey struct {
+	ctx    *pkcs11.Ctx
+	handle pkcs11.SessionHandle
+}
+
+func keyOf(s *pkcs11Session) sessionKey {
+	return sessionKey{s.ctx, s.handle}
+}
+
+// checkoutSession records that the pooled session s has been checked out, and returns a copy of s that carries
+// the new checkout token. It fails if the session is already checked out.
+func checkoutSession(s *pkcs11Session) (*pkcs11Session, error) {
+	token := atomic.AddUint64(&lastSessionToken, 1)
+
+	sessionOwnersMutex.Lock()
+	defer sessionOwnersMutex.Unlock()
+
+	if owner, ok := sessionOwners[keyOf(s)]; ok {
+		return nil, withMessagef(ErrSessionOwnership, "session %d checked out by %d is being checked out again",
+			s.handle, owner)
+	}
+	sessionOwners[keyOf(s)] = token
+
+	held := *s
+	held.token = token
+	return &held, nil
+}
+
+// releaseSession records that s is being returned to the pool. It fails if s is not held by its current owner.
+func releaseSession(s *pkcs11Session) error {
+	sessionOwnersMutex.Lock()
+	defer sessionOwnersMutex.Unlock()
+
+	if err := checkSessionLocked(s); err != nil {
+		return err
+	}
+	delete(sessionOwners, keyOf(s))
+	return nil
+}
+
+// checkSession fails if s is not held by its current owner.
+func checkSession(s *pkcs11Session) error {
+	sessionOwnersMutex.Lock()
+	defer sessionOwnersMutex.Unlock()
+
+	return checkSessionLocked(s)
+}
+
+func checkSessionLocked(s *pkcs11Session) error {
+	owner, ok := sessionOwners[keyOf(s)]
+	if !ok {
+		return withMessagef(ErrSessionOwnership, "session %d used by %d while not checked out", s.handle, s.token)
+	}
+	if owner != s.token {
+		return withMessagef(ErrSessionOwnership, "session %d checked out by %d is being used by %d", s.handle,
+			owner, s.token)
+	}
+	return nil
+}
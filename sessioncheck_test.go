@@ -0,0 +1,97 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build crypto11_sessioncheck
+// +build crypto11_sessioncheck
+
+package crypto11
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionCheckCheckout(t *testing.T) {
+	pooled := &pkcs11Session{handle: 1001}
+
+	held, err := checkoutSession(pooled)
+	require.NoError(t, err)
+	require.NoError(t, checkSession(held))
+
+	// The pooled copy does not carry the checkout token
+	require.True(t, errors.Is(checkSession(pooled), ErrSessionOwnership))
+
+	// A session can only be checked out once at a time
+	_, err = checkoutSession(pooled)
+	require.True(t, errors.Is(err, ErrSessionOwnership))
+
+	require.NoError(t, releaseSession(held))
+
+	// A released session can be checked out again
+	again, err := checkoutSession(pooled)
+	require.NoError(t, err)
+	require.NoError(t, releaseSession(again))
+}
+
+func TestSessionCheckUseAfterRelease(t *testing.T) {
+	pooled := &pkcs11Session{handle: 1002}
+
+	held, err := checkoutSession(pooled)
+	require.NoError(t, err)
+	require.NoError(t, releaseSession(held))
+
+	require.True(t, errors.Is(checkSession(held), ErrSessionOwnership))
+	require.True(t, errors.Is(releaseSession(held), ErrSessionOwnership))
+}
+
+func TestSessionCheckStaleHolder(t *testing.T) {
+	pooled := &pkcs11Session{handle: 1003}
+
+	stale, err := checkoutSession(pooled)
+	require.NoError(t, err)
+	require.NoError(t, releaseSession(stale))
+
+	current, err := checkoutSession(pooled)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, releaseSession(current)) }()
+
+	// A holder from an earlier checkout cannot use or release the session
+	require.True(t, errors.Is(checkSession(stale), ErrSessionOwnership))
+	require.True(t, errors.Is(releaseSession(stale), ErrSessionOwnership))
+	require.NoError(t, checkSession(current))
+}
+
+func TestSessionCheckWithSession(t *testing.T) {
+	ctx, err := ConfigureFromFile("config")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	// A session kept past the end of withSession cannot be used again
+	var kept *pkcs11Session
+	require.NoError(t, ctx.withSession(func(session *pkcs11Session) error {
+		kept = session
+		return nil
+	}))
+	require.True(t, errors.Is(checkSession(kept), ErrSessionOwnership))
+	require.True(t, errors.Is(ctx.putSession(kept, nil), ErrSessionOwnership))
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"github.com/miekg/pkcs11"
+)
+
+// trackObject records that handle is a session object created on s for use by crypto11 itself. Tracked objects
+// that are still present when the session is returned to the pool are destroyed then, so that an operation which
+// fails, panics or forgets to clean up cannot leave objects behind on the token. description identifies the object
+// in SessionObjectReaped warnings.
+func (s *pkcs11Session) trackObject(handle pkcs11.ObjectHandle, description string) {
+	if s.objects == nil {
+		s.objects = make(map[pkcs11.ObjectHandle]string)
+	}
+	s.objects[handle] = description
+}
+
+// preserveObject stops tracking handle, so that it survives the return of the session to the pool. Use this when
+// ownership of a session object passes to the caller.
+func (s *pkcs11Session) preserveObject(handle pkcs11.ObjectHandle) {
+	delete(s.objects, handle)
+}
+
+// destroyObject destroys a tracked session object and stops tracking it.
+func (s *pkcs11Session) destroyObject(handle pkcs11.ObjectHandle) error {
+	delete(s.objects, handle)
+	return s.ctx.DestroyObject(s.handle, handle)
+}
+
+// reapObjects destroys all tracked session objects, raising a SessionObjectReaped warning for each one.
+func (s *pkcs11Session) reapObjects() {
+	for handle, description := range s.objects {
+		err := s.ctx.DestroyObject(s.handle, handle)
+		s.warnings.warnObject(handle, description, err)
+		s.cleanup.leakedObject(handle, description, "reaped when its session was returned to the pool")
+		delete(s.objects, handle)
+	}
+}
+
+// forgetObjects stops tracking all session objects without destroying them. Use this when the session is closed,
+// since the token destroys session objects along with the session that created them.
+func (s *pkcs11Session) forgetObjects() {
+	for handle, description := range s.objects {
+		s.warnings.warnObject(handle, description, nil)
+		s.cleanup.leakedObject(handle, description, "discarded with its session")
+		delete(s.objects, handle)
+	}
+}
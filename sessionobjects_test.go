@@ -0,0 +1,122 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForgetObjects(t *testing.T) {
+	var received []KeyWarning
+	warnings := newKeyWarnings(func(warning KeyWarning) {
+		received = append(received, warning)
+	})
+
+	session := &pkcs11Session{warnings: warnings}
+	session.trackObject(1, "one")
+	session.trackObject(2, "two")
+	session.preserveObject(1)
+	assert.Len(t, session.objects, 1)
+
+	session.forgetObjects()
+	assert.Empty(t, session.objects)
+
+	warnings.close()
+	assert.Equal(t, []KeyWarning{{Type: SessionObjectReaped, Handle: 2, Description: "two"}}, received)
+}
+
+// generateSessionKey creates an AES session object.
+func generateSessionKey(t *testing.T, session *pkcs11Session) pkcs11.ObjectHandle {
+	handle, err := session.ctx.GenerateKey(session.handle,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 16),
+		})
+	require.NoError(t, err)
+	return handle
+}
+
+// sessionObjectExists returns true if handle still refers to an object.
+func sessionObjectExists(ctx *Context, handle pkcs11.ObjectHandle) bool {
+	err := ctx.withSession(func(session *pkcs11Session) error {
+		_, err := session.ctx.GetAttributeValue(session.handle, handle,
+			[]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, nil)})
+		return err
+	})
+	return err == nil
+}
+
+func TestSessionObjectsReaped(t *testing.T) {
+	// The test leaks a session object on purpose, so it cannot use the strict cleanup checks of withContext
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	var objects []pkcs11.ObjectHandle
+	config.KeyWarningFunc = func(warning KeyWarning) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if warning.Type == SessionObjectReaped {
+			assert.NoError(t, warning.Err)
+			assert.Equal(t, "test key", warning.Description)
+			objects = append(objects, warning.Handle)
+		}
+	}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+
+	var reaped, preserved pkcs11.ObjectHandle
+	err = ctx.withSession(func(session *pkcs11Session) error {
+		reaped = generateSessionKey(t, session)
+		session.trackObject(reaped, "test key")
+
+		preserved = generateSessionKey(t, session)
+		session.trackObject(preserved, "preserved test key")
+		session.preserveObject(preserved)
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.False(t, sessionObjectExists(ctx, reaped))
+	assert.True(t, sessionObjectExists(ctx, preserved))
+
+	err = ctx.withSession(func(session *pkcs11Session) error {
+		return session.ctx.DestroyObject(session.handle, preserved)
+	})
+	require.NoError(t, err)
+
+	// Close waits for queued warnings to be delivered
+	require.NoError(t, ctx.Close())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []pkcs11.ObjectHandle{reaped}, objects)
+}
@@ -24,15 +24,92 @@ package crypto11
 import (
 	"context"
 	"errors"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/pkcs11"
 	"github.com/thales-e-security/pool"
 )
 
+// PoolNoWait can be set as Config.PoolWaitTimeout to make operations fail with ErrPoolExhausted, rather than wait,
+// when every session in the pool is in use.
+const PoolNoWait time.Duration = -1
+
+// sessionFlags are the flags every session is opened with. All sessions are read/write so that any operation,
+// including object creation, can use any session.
+const sessionFlags = pkcs11.CKF_SERIAL_SESSION | pkcs11.CKF_RW_SESSION
+
+// ErrPoolExhausted is returned when no session becomes free within Config.PoolWaitTimeout, or immediately if no
+// session is free and PoolWaitTimeout is negative.
+var ErrPoolExhausted = errors.New("no session available from the pool")
+
+// ErrSessionOwnership is returned when a session is used by a holder that no longer owns it, for instance after
+// the session was returned to the pool. It is only detected by builds with the crypto11_sessioncheck build tag,
+// which is intended for testing crypto11 itself.
+var ErrSessionOwnership = errors.New("session used without owning it")
+
+// noWaitContext makes the pool fail immediately, rather than wait, if it has no free session. The pool checks
+// Done before fetching a session, which reports the parent's cancellation; any later call, made once the pool
+// has found no free session and is about to wait, returns a closed channel.
+type noWaitContext struct {
+	context.Context
+	calls int32
+}
+
+// closedChannel is returned by noWaitContext.Done once waiting is forbidden.
+var closedChannel = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+func (c *noWaitContext) Done() <-chan struct{} {
+	if atomic.AddInt32(&c.calls, 1) == 1 {
+		return c.Context.Done()
+	}
+	return closedChannel
+}
+
 // pkcs11Session wraps a PKCS#11 session handle so we can use it in a resource pool.
 type pkcs11Session struct {
 	ctx    *pkcs11.Ctx
 	handle pkcs11.SessionHandle
+
+	// events receives session lifecycle events, it may be nil.
+	events *sessionEvents
+
+	// warnings receives warnings about reaped session objects, it may be nil.
+	warnings *keyWarnings
+
+	// timings collects call durations, it may be nil.
+	timings *callTimings
+
+	// findBatchSize is the maximum number of handles requested from C_FindObjects. If zero,
+	// DefaultFindObjectsBatchSize is used.
+	findBatchSize int
+
+	// findObjectsLimit, if not zero, caps the number of handles requested from C_FindObjects whatever the caller
+	// asks for. It is set by tests, to simulate modules that return fewer objects per call than requested.
+	findObjectsLimit int
+
+	// sessionOwnership identifies the holder of a checked out session, when session checks are enabled.
+	sessionOwnership
+
+	// objects holds the session objects created on this session that must not outlive its use, see trackObject.
+	objects map[pkcs11.ObjectHandle]string
+
+	// cleanup records leaked session objects, it may be nil.
+	cleanup *cleanupTracker
+
+	// traceID is the trace ID of the operation using the session, if any, see WithTraceID.
+	traceID string
+
+	// sessionPool is the pool made by WithPool that the session was checked out from. It is nil if the session came
+	// from the Context's own pool.
+	sessionPool *SessionPool
+
+	// operation is the operation started on the session by an Init call that has not finished, see startOperation.
+	operation sessionOperation
 }
 
 // Close is required to satisfy the pools.Resource interface. It closes the session, but swallows any
@@ -40,31 +117,292 @@ type pkcs11Session struct {
 func (s pkcs11Session) Close() {
 	// We cannot return an error, so we swallow it
 	_ = s.ctx.CloseSession(s.handle)
+	s.forgetObjects()
+	s.events.raise(SessionClosed, 0, nil)
 }
 
 // withSession executes a function with a session.
-func (c *Context) withSession(f func(session *pkcs11Session) error) error {
-	session, err := c.getSession()
+func (c *Context) withSession(f func(session *pkcs11Session) error) (err error) {
+	return c.withSessionContext(context.Background(), f)
+}
+
+// withSessionContext executes a function with a session, giving up waiting for the session if ctx is done. If ctx
+// carries a trace ID, errors are annotated with it, see WithTraceID.
+func (c *Context) withSessionContext(ctx context.Context, f func(session *pkcs11Session) error) (err error) {
+	return c.withPoolSession(ctx, nil, f)
+}
+
+// withPoolSession is withSessionContext, taking the session from sp, or from the Context's own pool if sp is nil.
+func (c *Context) withPoolSession(ctx context.Context, sp *SessionPool,
+	f func(session *pkcs11Session) error) (err error) {
+
+	traceID, _ := TraceIDFromContext(ctx)
+
+	session, err := c.getPoolSession(ctx, sp)
 	if err != nil {
-		return err
+		return withTraceID(err, traceID)
 	}
-	defer c.pool.Put(session)
+	session.traceID = traceID
+	defer func() {
+		if putErr := c.putSession(session, err); err == nil {
+			err = putErr
+		}
+		err = withTraceID(err, traceID)
+	}()
 
+	if err = checkSession(session); err != nil {
+		return err
+	}
 	return f(session)
 }
 
+// putSession returns a session to the pool it came from. The session is discarded, and the pool will open a
+// replacement, if err shows that the session is no longer usable, or if an operation started on the session is still
+// active and cannot be ended, see abandonOperation. Other errors, such as an attribute that could not be read, leave
+// the session usable and it is returned to the pool.
+//
+// putSession only fails if the caller does not own the session, in which case the session is left alone.
+func (c *Context) putSession(session *pkcs11Session, err error) error {
+	if releaseErr := releaseSession(session); releaseErr != nil {
+		return releaseErr
+	}
+	c.cleanup.returned(session)
+	if c.cleanup.isAbandoned() {
+		// Close has already closed the session and finalized the library.
+		return nil
+	}
+	traceID := session.traceID
+	session.traceID = ""
+	resources := c.pool
+	if session.sessionPool != nil {
+		resources = session.sessionPool.resources
+	}
+	defer c.suspension.leave()
+	defer c.saturation.released()
+	c.sessionLogin.observe(err)
+	if err != errStreamAbandoned {
+		c.errorCounters.observe(err)
+	}
+
+	if !isSessionInvalid(err) && session.abandonOperation() {
+		session.reapObjects()
+		resources.Put(session)
+		return nil
+	}
+
+	// Closing fails if the session is already invalid, but we don't want to leak the handle if the token still knows
+	// about it.
+	_ = session.ctx.CloseSession(session.handle)
+	session.forgetObjects()
+	c.events.raiseTraced(SessionRecycled, 0, err, traceID)
+	resources.Put(nil)
+	return nil
+}
+
+// isSessionInvalid returns true if err shows that the session used for an operation can no longer be used.
+func isSessionInvalid(err error) bool {
+	return isPKCS11Error(err, pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED, pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_TOKEN_NOT_PRESENT)
+}
+
+// sessionOperation identifies the kind of operation started on a session by an Init call.
+type sessionOperation int
+
+const (
+	operationNone sessionOperation = iota
+	operationSign
+	operationVerify
+	operationEncrypt
+	operationDecrypt
+	operationDigest
+	operationFind
+)
+
+// startOperation records that the Init call that returned err started operation on the session, unless it failed.
+// Until the operation finishes, the session is not returned to the pool as it is, so that an operation abandoned
+// part-way cannot make the next user of the session fail with CKR_OPERATION_ACTIVE. It returns err.
+func (s *pkcs11Session) startOperation(operation sessionOperation, err error) error {
+	if err == nil {
+		s.operation = operation
+	}
+	return err
+}
+
+// finishOperation records that the operation active on the session has finished, and returns err. Single-part calls
+// such as C_Sign and final calls such as C_SignFinal always finish the operation, whether or not they succeed.
+func (s *pkcs11Session) finishOperation(err error) error {
+	s.operation = operationNone
+	return err
+}
+
+// updateOperation returns err, the result of an update call such as C_SignUpdate, recording that the operation
+// active on the session has finished if the call failed.
+func (s *pkcs11Session) updateOperation(err error) error {
+	if err != nil {
+		s.operation = operationNone
+	}
+	return err
+}
+
+// abandonOperation ends the operation left active on the session, if there is one, and returns false if the
+// session must be discarded instead. Searches and digests are ended with their final call. Other operations may be
+// using single-part mechanisms, for which some tokens reject the final call without ending the operation.
+func (s *pkcs11Session) abandonOperation() bool {
+	switch s.operation {
+	case operationNone:
+		return true
+	case operationFind:
+		return s.findObjectsFinal() == nil
+	case operationDigest:
+		_, err := s.digestFinal()
+		return err == nil
+	}
+	return false
+}
+
+// signInit calls C_SignInit.
+func (s *pkcs11Session) signInit(mech []*pkcs11.Mechanism, key pkcs11.ObjectHandle) error {
+	return s.startOperation(operationSign, s.ctx.SignInit(s.handle, mech, key))
+}
+
+// signUpdate calls C_SignUpdate.
+func (s *pkcs11Session) signUpdate(data []byte) error {
+	return s.updateOperation(s.ctx.SignUpdate(s.handle, data))
+}
+
+// signFinal calls C_SignFinal.
+func (s *pkcs11Session) signFinal() ([]byte, error) {
+	signature, err := s.ctx.SignFinal(s.handle)
+	return signature, s.finishOperation(err)
+}
+
+// verifyInit calls C_VerifyInit.
+func (s *pkcs11Session) verifyInit(mech []*pkcs11.Mechanism, key pkcs11.ObjectHandle) error {
+	return s.startOperation(operationVerify, s.ctx.VerifyInit(s.handle, mech, key))
+}
+
+// verify calls C_Verify.
+func (s *pkcs11Session) verify(data, signature []byte) error {
+	return s.finishOperation(s.ctx.Verify(s.handle, data, signature))
+}
+
+// verifyUpdate calls C_VerifyUpdate.
+func (s *pkcs11Session) verifyUpdate(data []byte) error {
+	return s.updateOperation(s.ctx.VerifyUpdate(s.handle, data))
+}
+
+// verifyFinal calls C_VerifyFinal.
+func (s *pkcs11Session) verifyFinal(signature []byte) error {
+	return s.finishOperation(s.ctx.VerifyFinal(s.handle, signature))
+}
+
+// encryptInit calls C_EncryptInit.
+func (s *pkcs11Session) encryptInit(mech []*pkcs11.Mechanism, key pkcs11.ObjectHandle) error {
+	return s.startOperation(operationEncrypt, s.ctx.EncryptInit(s.handle, mech, key))
+}
+
+// encrypt calls C_Encrypt.
+func (s *pkcs11Session) encrypt(plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.ctx.Encrypt(s.handle, plaintext)
+	return ciphertext, s.finishOperation(err)
+}
+
+// encryptUpdate calls C_EncryptUpdate.
+func (s *pkcs11Session) encryptUpdate(plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.ctx.EncryptUpdate(s.handle, plaintext)
+	return ciphertext, s.updateOperation(err)
+}
+
+// encryptFinal calls C_EncryptFinal.
+func (s *pkcs11Session) encryptFinal() ([]byte, error) {
+	ciphertext, err := s.ctx.EncryptFinal(s.handle)
+	return ciphertext, s.finishOperation(err)
+}
+
+// decryptInit calls C_DecryptInit.
+func (s *pkcs11Session) decryptInit(mech []*pkcs11.Mechanism, key pkcs11.ObjectHandle) error {
+	return s.startOperation(operationDecrypt, s.ctx.DecryptInit(s.handle, mech, key))
+}
+
+// decryptUpdate calls C_DecryptUpdate.
+func (s *pkcs11Session) decryptUpdate(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.ctx.DecryptUpdate(s.handle, ciphertext)
+	return plaintext, s.updateOperation(err)
+}
+
+// decryptFinal calls C_DecryptFinal.
+func (s *pkcs11Session) decryptFinal() ([]byte, error) {
+	plaintext, err := s.ctx.DecryptFinal(s.handle)
+	return plaintext, s.finishOperation(err)
+}
+
+// digestInit calls C_DigestInit.
+func (s *pkcs11Session) digestInit(mech []*pkcs11.Mechanism) error {
+	return s.startOperation(operationDigest, s.ctx.DigestInit(s.handle, mech))
+}
+
+// digestFinal calls C_DigestFinal.
+func (s *pkcs11Session) digestFinal() ([]byte, error) {
+	digest, err := s.ctx.DigestFinal(s.handle)
+	return digest, s.finishOperation(err)
+}
+
+// findObjectsInit calls C_FindObjectsInit.
+func (s *pkcs11Session) findObjectsInit(template []*pkcs11.Attribute) error {
+	return s.startOperation(operationFind, s.ctx.FindObjectsInit(s.handle, template))
+}
+
+// findObjectsFinal calls C_FindObjectsFinal.
+func (s *pkcs11Session) findObjectsFinal() error {
+	return s.finishOperation(s.ctx.FindObjectsFinal(s.handle))
+}
+
 // getSession retrieves a session from the pool, respecting the timeout defined in the Context config.
 // Callers are responsible for putting this session back in the pool.
 func (c *Context) getSession() (*pkcs11Session, error) {
-	ctx := context.Background()
+	return c.getSessionContext(context.Background())
+}
 
+// getSessionContext is getSession, but also gives up waiting for a session if ctx is done, returning ctx.Err().
+func (c *Context) getSessionContext(ctx context.Context) (session *pkcs11Session, err error) {
+	return c.getPoolSession(ctx, nil)
+}
+
+// getPoolSession is getSessionContext, taking the session from sp, or from the Context's own pool if sp is nil.
+func (c *Context) getPoolSession(ctx context.Context, sp *SessionPool) (session *pkcs11Session, err error) {
+	defer func() {
+		c.errorCounters.observe(err)
+	}()
+
+	caller := ctx
+	noWait := c.cfg.PoolWaitTimeout < 0
 	if c.cfg.PoolWaitTimeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(context.Background(), c.cfg.PoolWaitTimeout)
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.PoolWaitTimeout)
 		defer cancel()
 	}
 
-	resource, err := c.pool.Get(ctx)
+	if err = c.suspension.enter(ctx, c.cfg.FailWhileSuspended || noWait); err != nil {
+		return nil, err
+	}
+
+	poolCtx := ctx
+	if noWait {
+		poolCtx = &noWaitContext{Context: ctx}
+	}
+
+	// Resume replaces the pools, so they are only read once the Context is known not to be suspended.
+	resources := c.pool
+	if sp != nil {
+		resources = sp.resources
+	}
+
+	start := c.timings.start()
+	resource, err := resources.Get(poolCtx)
+	c.timings.record(CallPoolWait, 0, start)
+	if err != nil {
+		c.suspension.leave()
+	}
 	if err == pool.ErrClosed {
 		// Our Context must have been closed, return a nicer error.
 		// We don't use errClosed to ensure our tests identify functions that aren't checking for closure
@@ -72,17 +410,50 @@ func (c *Context) getSession() (*pkcs11Session, error) {
 		return nil, errors.New("context is closed")
 	}
 	if err != nil {
+		if callerErr := caller.Err(); callerErr != nil {
+			// The pool reports cancellation as a timeout
+			return nil, callerErr
+		}
+		if err == pool.ErrTimeout {
+			if noWait {
+				return nil, ErrPoolExhausted
+			}
+			return nil, withMessagef(ErrPoolExhausted, "timed out after %v", c.cfg.PoolWaitTimeout)
+		}
 		return nil, err
 	}
 
-	return resource.(*pkcs11Session), nil
+	session, err = checkoutSession(resource.(*pkcs11Session))
+	if err != nil {
+		c.suspension.leave()
+		return nil, err
+	}
+	c.saturation.acquired()
+	session.sessionPool = sp
+	c.cleanup.checkedOut(session)
+	return session, nil
 }
 
 // resourcePoolFactoryFunc is called by the resource pool when a new session is needed.
 func (c *Context) resourcePoolFactoryFunc() (pool.Resource, error) {
-	session, err := c.ctx.OpenSession(c.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	start := time.Now()
+	session, err := c.ctx.OpenSession(c.slot, sessionFlags)
+	c.timings.record(CallOpenSession, 0, start)
 	if err != nil {
+		c.events.raise(SessionCreateFailed, time.Since(start), err)
 		return nil, err
 	}
-	return &pkcs11Session{c.ctx, session}, nil
+	if err = c.sessionLogin.loginNew(session); err != nil {
+		_ = c.ctx.CloseSession(session)
+		c.events.raise(SessionCreateFailed, time.Since(start), err)
+		return nil, withMessage(err, "failed to log into new session")
+	}
+	if err = c.setupSession(session); err != nil {
+		_ = c.ctx.CloseSession(session)
+		c.events.raise(SessionCreateFailed, time.Since(start), err)
+		return nil, withMessage(err, "failed to set up new session")
+	}
+	c.events.raise(SessionCreated, time.Since(start), nil)
+	return &pkcs11Session{ctx: c.ctx, handle: session, events: c.events, warnings: c.warnings, timings: c.timings,
+		findBatchSize: c.cfg.FindObjectsBatchSize, findObjectsLimit: c.findObjectsLimit, cleanup: c.cleanup}, nil
 }
@@ -0,0 +1,303 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"context"
+	"crypto"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errInjected = errors.New("injected fault")
+
+// faultStep is one PKCS#11 call made by a faultSequence.
+type faultStep func(session *pkcs11Session) error
+
+// faultSequence is a multi-step operation which may be interrupted after any step.
+type faultSequence struct {
+	name  string
+	steps []faultStep
+
+	// ended is set if an interrupted operation can be ended, so the session is kept rather than replaced.
+	ended bool
+}
+
+func TestIsSessionInvalid(t *testing.T) {
+	assert.True(t, isSessionInvalid(pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)))
+	assert.True(t, isSessionInvalid(withMessage(pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED), "signing")))
+	assert.False(t, isSessionInvalid(pkcs11.Error(pkcs11.CKR_SIGNATURE_INVALID)))
+	assert.False(t, isSessionInvalid(pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)))
+	assert.False(t, isSessionInvalid(errInjected))
+	assert.False(t, isSessionInvalid(nil))
+}
+
+// TestSessionFaultInjection interrupts multi-step operations part-way with an error, and checks that the session
+// is not returned to the pool with an operation still active.
+func TestSessionFaultInjection(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+
+	// A pool of one session, so any leaked or poisoned session breaks the next operation.
+	config.MaxSessions = 2
+
+	var mutex sync.Mutex
+	recycled := 0
+	config.SessionEventFunc = func(event SessionEvent) {
+		if event.Type == SessionRecycled {
+			mutex.Lock()
+			recycled++
+			mutex.Unlock()
+		}
+	}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+
+	key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	secret, err := ctx.GenerateSecretKey(randomBytes(), 128, CipherAES)
+	require.NoError(t, err)
+	defer func() { _ = secret.Delete() }()
+
+	ecdsaKey := key.(*pkcs11PrivateKeyECDSA)
+	digest := sha256.Sum256([]byte("fault injection"))
+	sig, err := key.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	rawSig, err := rawDSASignature(sig, 32)
+	require.NoError(t, err)
+
+	ecdsaMech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+	aesMech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_CBC, make([]byte, 16))}
+	block := make([]byte, 16)
+
+	sequences := []faultSequence{
+		{"sign", []faultStep{
+			func(s *pkcs11Session) error { return s.signInit(ecdsaMech, ecdsaKey.handle) },
+			func(s *pkcs11Session) error { _, err := s.sign(pkcs11.CKM_ECDSA, digest[:]); return err },
+		}, false},
+		{"verify", []faultStep{
+			func(s *pkcs11Session) error { return s.verifyInit(ecdsaMech, ecdsaKey.pubKeyHandle) },
+			func(s *pkcs11Session) error { return s.verify(digest[:], rawSig) },
+		}, false},
+		{"digest", []faultStep{
+			func(s *pkcs11Session) error {
+				return s.digestInit([]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256, nil)})
+			},
+			func(s *pkcs11Session) error { return s.ctx.DigestUpdate(s.handle, block) },
+			func(s *pkcs11Session) error { _, err := s.digestFinal(); return err },
+		}, true},
+		{"encrypt", []faultStep{
+			func(s *pkcs11Session) error { return s.encryptInit(aesMech, secret.handle) },
+			func(s *pkcs11Session) error { _, err := s.encryptUpdate(block); return err },
+			func(s *pkcs11Session) error { _, err := s.encryptFinal(); return err },
+		}, false},
+		{"decrypt", []faultStep{
+			func(s *pkcs11Session) error { return s.decryptInit(aesMech, secret.handle) },
+			func(s *pkcs11Session) error { _, err := s.decryptUpdate(block); return err },
+			func(s *pkcs11Session) error { _, err := s.decryptFinal(); return err },
+		}, false},
+		{"find", []faultStep{
+			func(s *pkcs11Session) error {
+				return s.findObjectsInit([]*pkcs11.Attribute{
+					pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+				})
+			},
+			func(s *pkcs11Session) error { _, err := s.findObjects(1); return err },
+			func(s *pkcs11Session) error { return s.findObjectsFinal() },
+		}, true},
+	}
+
+	for _, sequence := range sequences {
+		for failAfter := 0; failAfter <= len(sequence.steps); failAfter++ {
+			t.Run(fmt.Sprintf("%s/%d", sequence.name, failAfter), func(t *testing.T) {
+				err := ctx.withSession(func(session *pkcs11Session) error {
+					for _, step := range sequence.steps[:failAfter] {
+						if err := step(session); err != nil {
+							return err
+						}
+					}
+					return errInjected
+				})
+				require.Equal(t, errInjected, err)
+
+				// Operations must still work on the only session in the pool.
+				_, err = key.Sign(nil, digest[:], crypto.SHA256)
+				require.NoError(t, err)
+				_, err = ctx.FindKey(nil, []byte("no such key"))
+				require.NoError(t, err)
+			})
+		}
+	}
+
+	require.NoError(t, ctx.Close())
+
+	// Events are delivered before Close returns. A session is only replaced if it was interrupted between the Init
+	// call and the call that finishes the operation, and the operation could not be ended.
+	expected := 0
+	for _, sequence := range sequences {
+		if !sequence.ended {
+			expected += len(sequence.steps) - 1
+		}
+	}
+	assert.Equal(t, expected, recycled)
+}
+
+// TestAttributeErrorKeepsSession checks that a failure that cannot leave an operation active, such as reading an
+// attribute the object lacks, returns the session to the pool rather than replacing it.
+func TestAttributeErrorKeepsSession(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+
+	// A pool of one session, so a replaced session has a new handle.
+	config.MaxSessions = 2
+
+	var mutex sync.Mutex
+	recycled := 0
+	config.SessionEventFunc = func(event SessionEvent) {
+		if event.Type == SessionRecycled {
+			mutex.Lock()
+			recycled++
+			mutex.Unlock()
+		}
+	}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+
+	secret, err := ctx.GenerateSecretKey(randomBytes(), 128, CipherAES)
+	require.NoError(t, err)
+	defer func() { _ = secret.Delete() }()
+
+	var first, second pkcs11.SessionHandle
+	err = ctx.withSession(func(session *pkcs11Session) error {
+		first = session.handle
+		_, err := session.ctx.GetAttributeValue(session.handle, secret.handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		})
+		return err
+	})
+	require.True(t, isPKCS11Error(err, pkcs11.CKR_ATTRIBUTE_TYPE_INVALID), "unexpected error: %v", err)
+
+	err = ctx.withSession(func(session *pkcs11Session) error {
+		second = session.handle
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	require.NoError(t, ctx.Close())
+	assert.Equal(t, 0, recycled)
+}
+
+func TestNoWaitContext(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	ctx := &noWaitContext{Context: parent}
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("first Done call should report the parent")
+	default:
+	}
+
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("later Done calls should not wait")
+	}
+
+	cancel()
+	select {
+	case <-(&noWaitContext{Context: parent}).Done():
+	default:
+		t.Fatal("first Done call should report parent cancellation")
+	}
+}
+
+// withBusyPool runs f with a Context whose pool has a single session, which is checked out until release is called.
+func withBusyPool(t *testing.T, poolWaitTimeout time.Duration, f func(ctx *Context, release func())) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.MaxSessions = 2
+	config.PoolWaitTimeout = poolWaitTimeout
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	parked, err := ctx.getSession()
+	require.NoError(t, err)
+
+	var once sync.Once
+	release := func() { once.Do(func() { ctx.putSession(parked, nil) }) }
+	defer release()
+
+	f(ctx, release)
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	op := func(ctx *Context) error {
+		return ctx.withSession(func(session *pkcs11Session) error { return nil })
+	}
+
+	t.Run("NoWait", func(t *testing.T) {
+		withBusyPool(t, PoolNoWait, func(ctx *Context, release func()) {
+			start := time.Now()
+			err := op(ctx)
+			assert.Equal(t, ErrPoolExhausted, err)
+			assert.True(t, time.Since(start) < 50*time.Millisecond, "took %v", time.Since(start))
+
+			release()
+			assert.NoError(t, op(ctx))
+		})
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		withBusyPool(t, 100*time.Millisecond, func(ctx *Context, release func()) {
+			start := time.Now()
+			err := op(ctx)
+			assert.True(t, errors.Is(err, ErrPoolExhausted), "unexpected error: %v", err)
+			assert.True(t, time.Since(start) >= 100*time.Millisecond, "took %v", time.Since(start))
+		})
+	})
+
+	t.Run("Forever", func(t *testing.T) {
+		withBusyPool(t, 0, func(ctx *Context, release func()) {
+			time.AfterFunc(200*time.Millisecond, release)
+
+			start := time.Now()
+			assert.NoError(t, op(ctx))
+			assert.True(t, time.Since(start) >= 200*time.Millisecond, "took %v", time.Since(start))
+		})
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ShredAssurance states how thoroughly ShredObject destroyed an object.
+type ShredAssurance int
+
+const (
+	// ShredDestroyed means C_DestroyObject succeeded, but the token could not confirm the object is gone.
+	ShredDestroyed ShredAssurance = iota + 1
+
+	// ShredVerified means C_DestroyObject succeeded and the object can no longer be read or found.
+	ShredVerified
+
+	// ShredVendorAssured means the object was destroyed and verified as for ShredVerified, and the vendor profile
+	// states that the token's destruction is an assured erasure of the key material, see VendorAssuredDestroy.
+	ShredVendorAssured
+)
+
+// ShredResult records the outcome of ShredObject, for audit.
+type ShredResult struct {
+	// Assurance is the level achieved. For key pairs it is the lower level of the two halves.
+	Assurance ShredAssurance
+
+	// Objects is the number of token objects destroyed.
+	Objects int
+
+	// Zeroized is the number of objects whose CKA_VALUE was overwritten with zeros before destruction.
+	Zeroized int
+}
+
+// ShredObject destroys the token objects behind obj, which may be a key pair of any type returned by this package, a
+// *SecretKey, a *PublicKey or a *Counter, and reports the assurance achieved.
+//
+// Each object is destroyed with C_DestroyObject, then checked to be no longer readable or findable. With the
+// VendorZeroizeDataObjects profile, data objects have their value overwritten with zeros before they are destroyed.
+// With the VendorAssuredDestroy profile, verified destruction is reported as ShredVendorAssured. If destruction or
+// verification fails, an error is returned along with a result describing the objects destroyed so far.
+func (c *Context) ShredObject(obj interface{}) (result ShredResult, err error) {
+	if c.closed.Get() {
+		return result, errClosed
+	}
+
+	var handles []pkcs11.ObjectHandle
+	var keyPair *pkcs11PrivateKey
+	switch o := obj.(type) {
+	case crypto.Signer:
+		k := tokenKeyOf(o)
+		if k == nil {
+			return result, fmt.Errorf("cannot shred object of type %T", obj)
+		}
+		keyPair = k
+		private, public := k.objectHandles()
+		handles = append(handles, private)
+		if public != 0 {
+			handles = append(handles, public)
+		}
+	case *SecretKey:
+		handles = append(handles, o.handle)
+	case *PublicKey:
+		handles = append(handles, o.handle)
+	case *Counter:
+		err = c.withSession(func(session *pkcs11Session) (err error) {
+			handles, err = findKeysWithAttributes(session, []*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, o.label),
+			})
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+	default:
+		return result, fmt.Errorf("cannot shred object of type %T", obj)
+	}
+
+	if len(handles) == 0 {
+		return result, errors.New("no objects to shred")
+	}
+
+	err = c.withSession(func(session *pkcs11Session) error {
+		for _, handle := range handles {
+			assurance, zeroized, err := c.shredHandle(session, handle)
+			if zeroized {
+				result.Zeroized++
+			}
+			if err != nil {
+				return err
+			}
+			result.Objects++
+			if result.Assurance == 0 || assurance < result.Assurance {
+				result.Assurance = assurance
+			}
+		}
+		return nil
+	})
+	if err == nil && keyPair != nil {
+		keyPair.stopCountingPublicKey()
+	}
+	return result, err
+}
+
+// shredHandle destroys one object, zeroizing it first if the vendor profile requires, and verifies the result.
+func (c *Context) shredHandle(session *pkcs11Session, handle pkcs11.ObjectHandle) (assurance ShredAssurance,
+	zeroized bool, err error) {
+
+	identity, err := session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return 0, false, withMessage(err, "reading object before shredding")
+	}
+	class := bytesToUlong(identity[0].Value)
+
+	if c.profile.zeroizeDataObjects && class == pkcs11.CKO_DATA {
+		if err = zeroizeValue(session, handle); err != nil {
+			return 0, false, err
+		}
+		zeroized = true
+	}
+
+	if err = session.ctx.DestroyObject(session.handle, handle); err != nil {
+		return 0, zeroized, withMessage(err, "destroying object")
+	}
+
+	// The handle must no longer be readable...
+	_, err = session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, nil),
+	})
+	if err == nil {
+		return 0, zeroized, fmt.Errorf("object %d is still readable after destruction", handle)
+	}
+	if !isObjectGone(err) {
+		return ShredDestroyed, zeroized, nil
+	}
+
+	// ...nor findable by its identity.
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if len(identity[1].Value) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, identity[1].Value))
+	}
+	found, err := findKeysWithAttributes(session, template)
+	if err != nil {
+		return ShredDestroyed, zeroized, nil
+	}
+	for _, h := range found {
+		if h == handle {
+			return 0, zeroized, fmt.Errorf("object %d is still findable after destruction", handle)
+		}
+	}
+
+	if c.profile.assuredDestroy {
+		return ShredVendorAssured, zeroized, nil
+	}
+	return ShredVerified, zeroized, nil
+}
+
+// zeroizeValue overwrites the CKA_VALUE of an object with zeros of the same length.
+func zeroizeValue(session *pkcs11Session, handle pkcs11.ObjectHandle) error {
+	values, err := session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return withMessage(err, "reading object value")
+	}
+	zeros := make([]byte, len(values[0].Value))
+	err = session.ctx.SetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, zeros),
+	})
+	return withMessage(err, "zeroizing object value")
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShredAssuranceString(t *testing.T) {
+	assert.Equal(t, "destroyed", ShredDestroyed.String())
+	assert.Equal(t, "destroyed-and-verified", ShredVerified.String())
+	assert.Equal(t, "vendor-assured", ShredVendorAssured.String())
+}
+
+func TestShredKeyPair(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		key, err := ctx.GenerateECDSAKeyPair(id, elliptic.P256())
+		require.NoError(t, err)
+
+		result, err := ctx.ShredObject(key)
+		require.NoError(t, err)
+		assert.Equal(t, ShredResult{Assurance: ShredVerified, Objects: 2}, result)
+
+		found, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		assert.Nil(t, found)
+	})
+}
+
+func TestShredSecretKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		key, err := ctx.GenerateSecretKey(id, 128, CipherAES)
+		require.NoError(t, err)
+
+		result, err := ctx.ShredObject(key)
+		require.NoError(t, err)
+		assert.Equal(t, ShredResult{Assurance: ShredVerified, Objects: 1}, result)
+
+		found, err := ctx.FindKey(id, nil)
+		require.NoError(t, err)
+		assert.Nil(t, found)
+	})
+}
+
+func TestShredAssuredDestroy(t *testing.T) {
+	withVendorProfile(t, VendorAssuredDestroy, func(ctx *Context) {
+		id := randomBytes()
+		key, err := ctx.GenerateSecretKey(id, 128, CipherAES)
+		require.NoError(t, err)
+
+		// A vendor declaring assured destruction raises the assurance level.
+		result, err := ctx.ShredObject(key)
+		require.NoError(t, err)
+		assert.Equal(t, ShredResult{Assurance: ShredVendorAssured, Objects: 1}, result)
+
+		found, err := ctx.FindKey(id, nil)
+		require.NoError(t, err)
+		assert.Nil(t, found)
+	})
+}
+
+func TestShredCounterZeroizes(t *testing.T) {
+	withVendorProfile(t, VendorZeroizeDataObjects, func(ctx *Context) {
+		counter, err := ctx.Counter(randomBytes())
+		require.NoError(t, err)
+
+		result, err := ctx.ShredObject(counter)
+		require.NoError(t, err)
+		assert.Equal(t, ShredResult{Assurance: ShredVerified, Objects: 1, Zeroized: 1}, result)
+
+		// Shredding again finds nothing left
+		_, err = ctx.ShredObject(counter)
+		assert.Error(t, err)
+	})
+}
+
+func TestShredUnsupported(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		_, err := ctx.ShredObject("not an object")
+		assert.Error(t, err)
+
+		// Signers that are not key pairs on a token are rejected too.
+		software, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		_, err = ctx.ShredObject(software)
+		assert.Error(t, err)
+	})
+}
+
+// withVendorProfile is withContext, with Config.VendorProfile set to profile.
+func withVendorProfile(t *testing.T, profile string, f func(ctx *Context)) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.VendorProfile = profile
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, ctx.Close())
+	}()
+
+	f(ctx)
+}
+
+func TestShredEd25519KeyPair(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		if !ctx.tokenSupports(ckmECEdwardsKeyPairGen, pkcs11.CKF_GENERATE_KEY_PAIR) {
+			t.Skip("token does not support CKM_EC_EDWARDS_KEY_PAIR_GEN")
+		}
+
+		id := randomBytes()
+		key, err := ctx.GenerateEd25519KeyPair(id)
+		require.NoError(t, err)
+
+		result, err := ctx.ShredObject(key)
+		require.NoError(t, err)
+		assert.Equal(t, ShredResult{Assurance: ShredVerified, Objects: 2}, result)
+
+		found, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		assert.Nil(t, found)
+	})
+}
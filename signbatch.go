@@ -0,0 +1,188 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// A BatchSignError is returned by SignBatch when one of the digests could not be signed. The digests before Index
+// were signed, and their signatures are returned with the error; the digest at Index and those after it were not,
+// so a caller can retry the batch from Index.
+type BatchSignError struct {
+	// Index is the index in the batch of the digest that could not be signed.
+	Index int
+
+	// Err is the reason the digest could not be signed.
+	Err error
+}
+
+func (e *BatchSignError) Error() string {
+	return fmt.Sprintf("signing digest %d of batch: %v", e.Index, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *BatchSignError) Unwrap() error {
+	return e.Err
+}
+
+// SignBatch signs each of digests as Sign does with opts, returning the signatures in the same order. All of the
+// digests are signed with one session taken from the pool, which is held until the batch is finished, so the cost of
+// checking out a session is paid once rather than for every signature.
+//
+// Signing stops at the first digest that fails. The error is then a *BatchSignError giving its index, and the
+// signatures returned are those of the digests before it.
+func (priv *pkcs11PrivateKeyRSA) SignBatch(digests [][]byte, opts crypto.SignerOpts) ([][]byte, error) {
+	if isNilPointer(opts) {
+		return nil, errUnsupportedRSAOptions
+	}
+	if err := priv.checkSignUsage(opts); err != nil {
+		return nil, err
+	}
+	if profile := priv.profileFor(MechanismSign); profile != nil {
+		return priv.signBatchWithProfile(profile, digests)
+	}
+
+	pssOpts, isPSS := opts.(*rsa.PSSOptions)
+	switch {
+	case isPSS && priv.context.softwarePSS():
+		prepare := func(digest []byte) ([]byte, error) {
+			return priv.pssSoftwareInput(digest, pssOpts)
+		}
+		return priv.signBatch(digests, prepare, func(session *pkcs11Session, input []byte) ([]byte, error) {
+			return signRawRSA(session, priv, input)
+		})
+
+	case isPSS:
+		if err := priv.context.checkOptionsHashes(pssOpts); err != nil {
+			return nil, err
+		}
+		modulusBits, err := pssModulusBits(pssOpts, priv.Public())
+		if err != nil {
+			return nil, err
+		}
+		return priv.signBatch(digests, nil, func(session *pkcs11Session, digest []byte) ([]byte, error) {
+			return signPSS(session, priv, digest, pssOpts, modulusBits)
+		})
+
+	case opts == nil:
+		return nil, errUnsupportedRSAOptions
+
+	default:
+		hash, public := opts.HashFunc(), priv.Public()
+		prepare := func(digest []byte) ([]byte, error) {
+			return pkcs1v15SignInput(hash, digest, public)
+		}
+		return priv.signBatch(digests, prepare, func(session *pkcs11Session, T []byte) ([]byte, error) {
+			return signPKCS1v15(session, priv, T)
+		})
+	}
+}
+
+// SignBatch signs each of digests as Sign does, returning the DER-encoded signatures in the same order. All of the
+// digests are signed with one session taken from the pool, which is held until the batch is finished, so the cost of
+// checking out a session is paid once rather than for every signature.
+//
+// Signing stops at the first digest that fails. The error is then a *BatchSignError giving its index, and the
+// signatures returned are those of the digests before it.
+func (signer *pkcs11PrivateKeyECDSA) SignBatch(digests [][]byte, opts crypto.SignerOpts) ([][]byte, error) {
+	if err := signer.checkArchived("signing"); err != nil {
+		return nil, err
+	}
+	if profile := signer.profileFor(MechanismSign); profile != nil {
+		return signer.signBatchWithProfile(profile, digests)
+	}
+
+	var prepare func(digest []byte) ([]byte, error)
+	if pub, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		reject := signer.context.cfg.RejectLongECDSADigests
+		prepare = func(digest []byte) ([]byte, error) {
+			return truncateECDSADigest(pub.Curve, digest, reject)
+		}
+	}
+	return signer.signBatch(digests, prepare, func(session *pkcs11Session, digest []byte) ([]byte, error) {
+		sigBytes, err := dsaSignBytes(session, signer.handle, pkcs11.CKM_ECDSA, digest)
+		if err == nil {
+			err = signer.checkSignatureLength(sigBytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dsaSignatureDER(sigBytes)
+	})
+}
+
+// signBatchWithProfile signs each of digests with the mechanism of profile, as signBatch.
+func (k *pkcs11PrivateKey) signBatchWithProfile(profile *mechanismProfile, digests [][]byte) ([][]byte, error) {
+	return k.signBatch(digests, nil, func(session *pkcs11Session, digest []byte) ([]byte, error) {
+		signature, err := k.signWithProfileInSession(session, profile, digest)
+		return signature, withMessagef(err, "signing with mechanism profile %q", profile.name)
+	})
+}
+
+// signBatch signs digests in one session, stopping at the first failure, which is reported as a *BatchSignError.
+// Each digest is first passed to prepare, if it is not nil, before the session is taken, so that preparation which
+// itself needs a session does not hold two at once. sign then signs each prepared input in the session.
+func (k *pkcs11PrivateKey) signBatch(digests [][]byte, prepare func(digest []byte) ([]byte, error),
+	sign func(session *pkcs11Session, input []byte) ([]byte, error)) ([][]byte, error) {
+
+	inputs := digests
+	var prepareErr error
+	if prepare != nil {
+		inputs = make([][]byte, 0, len(digests))
+		for _, digest := range digests {
+			input, err := prepare(digest)
+			if err != nil {
+				prepareErr = err
+				break
+			}
+			inputs = append(inputs, input)
+		}
+	}
+
+	signatures := make([][]byte, 0, len(inputs))
+	if len(inputs) > 0 {
+		err := k.withSession(func(session *pkcs11Session) error {
+			for _, input := range inputs {
+				signature, err := sign(session, input)
+				if err != nil {
+					return err
+				}
+				signatures = append(signatures, signature)
+			}
+			return nil
+		})
+		if err != nil {
+			return signatures, &BatchSignError{Index: len(signatures), Err: err}
+		}
+	}
+
+	if prepareErr != nil {
+		return signatures, &BatchSignError{Index: len(signatures), Err: prepareErr}
+	}
+	return signatures, nil
+}
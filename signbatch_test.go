@@ -0,0 +1,125 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchDigests returns n distinct SHA-256 digests.
+func batchDigests(n int) [][]byte {
+	digests := make([][]byte, n)
+	for i := range digests {
+		digest := sha256.Sum256([]byte(fmt.Sprintf("batch message %d", i)))
+		digests[i] = digest[:]
+	}
+	return digests
+}
+
+func TestRsaSignBatch(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeSigning)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		signer := key.(BatchSigner)
+		pub := key.Public().(*rsa.PublicKey)
+		digests := batchDigests(5)
+
+		t.Run("PKCS1v15", func(t *testing.T) {
+			signatures, err := signer.SignBatch(digests, crypto.SHA256)
+			require.NoError(t, err)
+			require.Len(t, signatures, len(digests))
+			for i, signature := range signatures {
+				assert.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digests[i], signature), "digest %d", i)
+			}
+		})
+
+		t.Run("PSS", func(t *testing.T) {
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			signatures, err := signer.SignBatch(digests, opts)
+			require.NoError(t, err)
+			require.Len(t, signatures, len(digests))
+			for i, signature := range signatures {
+				assert.NoError(t, rsa.VerifyPSS(pub, crypto.SHA256, digests[i], signature, opts), "digest %d", i)
+			}
+		})
+
+		t.Run("Empty", func(t *testing.T) {
+			signatures, err := signer.SignBatch(nil, crypto.SHA256)
+			require.NoError(t, err)
+			assert.Empty(t, signatures)
+		})
+
+		t.Run("Failure", func(t *testing.T) {
+			signatures, err := signer.SignBatch(digests, crypto.Hash(99))
+			var batchErr *BatchSignError
+			require.True(t, errors.As(err, &batchErr), "%v", err)
+			assert.Equal(t, 0, batchErr.Index)
+			assert.True(t, errors.Is(err, ErrUnsupportedHash), "%v", err)
+			assert.Empty(t, signatures)
+
+			_, err = signer.SignBatch(digests, nil)
+			assert.Equal(t, errUnsupportedRSAOptions, err)
+		})
+	})
+}
+
+func TestEcdsaSignBatch(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		signer := key.(BatchSigner)
+		pub := key.Public().(*ecdsa.PublicKey)
+		digests := batchDigests(5)
+
+		signatures, err := signer.SignBatch(digests, crypto.SHA256)
+		require.NoError(t, err)
+		require.Len(t, signatures, len(digests))
+		for i, signature := range signatures {
+			assert.NoError(t, verifyInSoftware(pub, digests[i], signature, crypto.SHA256), "digest %d", i)
+		}
+
+		// Digests after a failing one are not signed, so the caller can retry from the failure.
+		ctx.cfg.RejectLongECDSADigests = true
+		digests[2] = make([]byte, 64)
+		signatures, err = signer.SignBatch(digests, crypto.SHA256)
+		var batchErr *BatchSignError
+		require.True(t, errors.As(err, &batchErr), "%v", err)
+		assert.Equal(t, 2, batchErr.Index)
+		assert.True(t, errors.Is(err, ErrECDSADigestTooLong), "%v", err)
+		require.Len(t, signatures, 2)
+		for i, signature := range signatures {
+			assert.NoError(t, verifyInSoftware(pub, digests[i], signature, crypto.SHA256), "digest %d", i)
+		}
+	})
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Helper functions that work with keys accept any crypto.Signer, so that keys held in software can share a code
+// path with keys held on a token, for instance during a migration. Where a helper can do better for a crypto11
+// key, such as reading its attributes or verifying on the token, it does so and otherwise falls back to software.
+
+// ErrSignatureInvalid is wrapped by the errors returned when a signature does not verify.
+var ErrSignatureInvalid = errors.New("signature is invalid")
+
+// signatureInvalidError reports a signature that does not verify. It matches ErrSignatureInvalid with errors.Is, and
+// wraps the error that showed the signature to be invalid, such as the PKCS#11 error returned by the token.
+type signatureInvalidError struct {
+	err error
+}
+
+func (e *signatureInvalidError) Error() string {
+	return ErrSignatureInvalid.Error() + ": " + e.err.Error()
+}
+
+func (e *signatureInvalidError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is ErrSignatureInvalid.
+func (e *signatureInvalidError) Is(target error) bool {
+	return target == ErrSignatureInvalid
+}
+
+var errNilSigner = errors.New("signer is nil")
+
+// tokenKeyOf returns the crypto11 key pair behind signer, or nil if signer is not a crypto11 key pair.
+func tokenKeyOf(signer crypto.Signer) *pkcs11PrivateKey {
+	switch k := signer.(type) {
+	case *pkcs11PrivateKeyRSA:
+		return &k.pkcs11PrivateKey
+	case *pkcs11PrivateKeyECDSA:
+		return &k.pkcs11PrivateKey
+	case *pkcs11PrivateKeyDSA:
+		return &k.pkcs11PrivateKey
+	case *pkcs11PrivateKeyEd25519:
+		return &k.pkcs11PrivateKey
+	case *pkcs11PrivateKeyEd448:
+		return &k.pkcs11PrivateKey
+	case *pkcs11PrivateKeyX25519:
+		return &k.pkcs11PrivateKey
+	default:
+		return nil
+	}
+}
+
+// SignerIdentity describes a crypto.Signer.
+type SignerIdentity struct {
+	// OnToken is true if the signer is a crypto11 key pair.
+	OnToken bool
+
+	// ID and Label are the CKA_ID and CKA_LABEL of the private key. They are nil for signers that are not on a
+	// token, or if the attribute is absent.
+	ID, Label []byte
+
+	// Public is the public key of the signer.
+	Public crypto.PublicKey
+}
+
+// IdentifySigner describes signer, which need not be a crypto11 key.
+func IdentifySigner(signer crypto.Signer) (*SignerIdentity, error) {
+	if signer == nil {
+		return nil, errNilSigner
+	}
+	identity := &SignerIdentity{Public: signer.Public()}
+
+	k := tokenKeyOf(signer)
+	if k == nil {
+		return identity, nil
+	}
+	identity.OnToken = true
+
+	handle, _ := k.objectHandles()
+	attributes, err := k.context.getAttributes(handle, []AttributeType{CkaId, CkaLabel})
+	if err != nil {
+		return nil, withMessage(err, "reading key identity")
+	}
+	if a := attributes[CkaId]; a != nil && len(a.Value) > 0 {
+		identity.ID = a.Value
+	}
+	if a := attributes[CkaLabel]; a != nil && len(a.Value) > 0 {
+		identity.Label = a.Value
+	}
+	return identity, nil
+}
+
+// VerifySignature checks that signature over digest was made by signer, with signatures encoded as returned by
+// signer.Sign. For crypto11 key pairs the signature is checked on the token, using the public key object. Other
+// signers, and key pairs whose Context has been closed, are checked in software against signer.Public(). RSA,
+// ECDSA, DSA and Ed25519 keys are supported in software; for Ed25519, digest is the message.
+//
+// If the signature does not verify, the returned error wraps ErrSignatureInvalid.
+func VerifySignature(signer crypto.Signer, digest, signature []byte, opts crypto.SignerOpts) error {
+	if signer == nil {
+		return errNilSigner
+	}
+	if k := tokenKeyOf(signer); k != nil && !k.context.closed.Get() {
+		if _, handle := k.objectHandles(); handle != 0 {
+			pub := &PublicKey{pkcs11Object: pkcs11Object{handle: handle, context: k.context,
+				sessionPool: k.sessionPool}, pub: signer.Public()}
+			err := pub.Verify(digest, signature, opts)
+			if isPKCS11Error(err, pkcs11.CKR_SIGNATURE_INVALID, pkcs11.CKR_SIGNATURE_LEN_RANGE) {
+				return &signatureInvalidError{err}
+			}
+			return err
+		}
+	}
+
+	return verifyInSoftware(signer.Public(), digest, signature, opts)
+}
+
+// verifyInSoftware checks a signature against pub without using a token.
+func verifyInSoftware(pub crypto.PublicKey, digest, signature []byte, opts crypto.SignerOpts) error {
+	valid := false
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if isNilPointer(opts) {
+			return errUnsupportedRSAOptions
+		}
+		var err error
+		if opts != nil && opts.HashFunc() != 0 {
+			if _, err = lookupHash(opts.HashFunc()); err != nil {
+				return err
+			}
+		}
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			if err = softwareHash(pssOpts.Hash); err != nil {
+				return err
+			}
+			err = rsa.VerifyPSS(pub, pssOpts.Hash, digest, signature, pssOpts)
+		} else {
+			if opts == nil {
+				return errUnsupportedRSAOptions
+			}
+			// Verified against T, so that hash functions crypto/rsa has no DigestInfo for, such as SHA-3 in older Go
+			// releases, are checked the same way as the rest.
+			var T []byte
+			if T, err = pkcs1v15DigestInfo(opts.HashFunc(), digest); err != nil {
+				return err
+			}
+			err = rsa.VerifyPKCS1v15(pub, 0, T, signature)
+		}
+		valid = err == nil
+
+	case *ecdsa.PublicKey:
+		var sig dsaSignature
+		if err := sig.unmarshalDER(signature); err != nil {
+			return &signatureInvalidError{err}
+		}
+		valid = ecdsa.Verify(pub, digest, sig.R, sig.S)
+
+	case *dsa.PublicKey:
+		var sig dsaSignature
+		if err := sig.unmarshalDER(signature); err != nil {
+			return &signatureInvalidError{err}
+		}
+		valid = dsa.Verify(pub, digest, sig.R, sig.S)
+
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(pub, digest, signature)
+
+	default:
+		return fmt.Errorf("unsupported public key type: %T", pub)
+	}
+
+	if !valid {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
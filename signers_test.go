@@ -0,0 +1,128 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests pass software keys through the helpers, which must accept any crypto.Signer.
+
+func TestIdentifySoftwareSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	identity, err := IdentifySigner(key)
+	require.NoError(t, err)
+	assert.False(t, identity.OnToken)
+	assert.Nil(t, identity.ID)
+	assert.Nil(t, identity.Label)
+	assert.Equal(t, key.Public(), identity.Public)
+}
+
+func TestVerifySignatureSoftwareECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("software"))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+
+	require.NoError(t, VerifySignature(key, digest[:], sig, crypto.SHA256))
+
+	digest[0] ^= 1
+	err = VerifySignature(key, digest[:], sig, crypto.SHA256)
+	assert.True(t, errors.Is(err, ErrSignatureInvalid))
+
+	err = VerifySignature(key, digest[:], []byte("not DER"), crypto.SHA256)
+	assert.True(t, errors.Is(err, ErrSignatureInvalid))
+}
+
+func TestVerifySignatureSoftwareRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, rsaSize)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("software"))
+	for _, opts := range []crypto.SignerOpts{
+		crypto.SHA256,
+		&rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthEqualsHash},
+	} {
+		sig, err := key.Sign(rand.Reader, digest[:], opts)
+		require.NoError(t, err)
+		require.NoError(t, VerifySignature(key, digest[:], sig, opts))
+
+		sig[0] ^= 1
+		assert.True(t, errors.Is(VerifySignature(key, digest[:], sig, opts), ErrSignatureInvalid))
+	}
+}
+
+func TestVerifySignatureSoftwareEd25519(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	message := []byte("software")
+	sig, err := key.Sign(rand.Reader, message, crypto.Hash(0))
+	require.NoError(t, err)
+	require.NoError(t, VerifySignature(key, message, sig, crypto.Hash(0)))
+
+	message[0] ^= 1
+	assert.True(t, errors.Is(VerifySignature(key, message, sig, crypto.Hash(0)), ErrSignatureInvalid))
+}
+
+func TestSignerHelpersWithTokenKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		label := randomBytes()
+		key, err := ctx.GenerateECDSAKeyPairWithLabel(id, label, elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		identity, err := IdentifySigner(key)
+		require.NoError(t, err)
+		assert.True(t, identity.OnToken)
+		assert.Equal(t, id, identity.ID)
+		assert.Equal(t, label, identity.Label)
+		assert.Equal(t, key.Public(), identity.Public)
+
+		digest := sha256.Sum256([]byte("token"))
+		sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+		require.NoError(t, VerifySignature(key, digest[:], sig, crypto.SHA256))
+
+		digest[0] ^= 1
+		err = VerifySignature(key, digest[:], sig, crypto.SHA256)
+		assert.True(t, errors.Is(err, ErrSignatureInvalid))
+		assert.True(t, isPKCS11Error(err, pkcs11.CKR_SIGNATURE_INVALID), "%v", err)
+	})
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrMechanismNotSupported is wrapped by the errors returned when the token does not advertise a mechanism an
+// operation needs. For SignMessage, the caller may fall back to hashing in software and calling Sign.
+var ErrMechanismNotSupported = errors.New("mechanism not supported by the token")
+
+// SignMessage signs message, which is hashed on the token with opts.HashFunc() by a combined mechanism such as
+// CKM_SHA256_RSA_PKCS, so that the message is never hashed outside the token. If opts is *rsa.PSSOptions, a
+// mechanism such as CKM_SHA256_RSA_PKCS_PSS makes a PSS signature. The signature is the one Sign would return for
+// the digest of message; PKCS#1 v1.5 signatures are byte-identical.
+//
+// If the token does not advertise the combined mechanism, an error wrapping ErrMechanismNotSupported is returned.
+func (priv *pkcs11PrivateKeyRSA) SignMessage(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte,
+	error) {
+
+	mech, err := priv.messageMechanism(opts)
+	if err != nil {
+		return nil, err
+	}
+	return priv.signMessage(mech, message)
+}
+
+// messageMechanism returns the mechanism that hashes a message with opts.HashFunc() and signs it as opts requires.
+func (priv *pkcs11PrivateKeyRSA) messageMechanism(opts crypto.SignerOpts) ([]*pkcs11.Mechanism, error) {
+	if opts == nil || isNilPointer(opts) {
+		return nil, errUnsupportedRSAOptions
+	}
+	hash := opts.HashFunc()
+
+	pssOpts, ok := opts.(*rsa.PSSOptions)
+	if !ok {
+		mechanism, err := lookupSignMechanism(pkcs11.CKK_RSA, hash, false)
+		if err != nil {
+			return nil, err
+		}
+		return []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, nil
+	}
+
+	mechanism, err := lookupSignMechanism(pkcs11.CKK_RSA, hash, true)
+	if err != nil {
+		return nil, err
+	}
+	modulusBits, err := pssModulusBits(pssOpts, priv.Public())
+	if err != nil {
+		return nil, err
+	}
+	mech, err := pssMechanism(pssOpts, modulusBits)
+	if err != nil {
+		return nil, err
+	}
+	mech[0].Mechanism = mechanism
+	return mech, nil
+}
+
+// SignMessage signs message, which is hashed on the token with opts.HashFunc() by a combined mechanism such as
+// CKM_ECDSA_SHA256, so that the message is never hashed outside the token. The signature is DER-encoded, as
+// returned by Sign. Unlike Sign, the full digest is used, since the token truncates it to the curve order itself.
+//
+// If the token does not advertise the combined mechanism, an error wrapping ErrMechanismNotSupported is returned.
+func (signer *pkcs11PrivateKeyECDSA) SignMessage(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte,
+	error) {
+
+	mech, err := ecdsaMessageMechanism(opts)
+	if err != nil {
+		return nil, err
+	}
+	sigBytes, err := signer.signMessage(mech, message)
+	if err != nil {
+		return nil, err
+	}
+	return dsaSignatureDER(sigBytes)
+}
+
+// ecdsaMessageMechanism returns the mechanism that hashes a message with opts.HashFunc() and makes an ECDSA signature.
+func ecdsaMessageMechanism(opts crypto.SignerOpts) ([]*pkcs11.Mechanism, error) {
+	if opts == nil || isNilPointer(opts) {
+		return nil, unsupportedHash(0)
+	}
+	hash := opts.HashFunc()
+	mechanism, err := lookupSignMechanism(pkcs11.CKK_ECDSA, hash, false)
+	if err != nil {
+		return nil, err
+	}
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, nil
+}
+
+// signMessage signs message with a mechanism that hashes on the token, passing it in pieces if it is larger than
+// Config.MaxSingleCallSize.
+func (k *pkcs11PrivateKey) signMessage(mech []*pkcs11.Mechanism, message []byte) (signature []byte, err error) {
+	mechanism := mech[0].Mechanism
+	if err = k.checkUsage("signing", pkcs11.CKA_SIGN, mechanism); err != nil {
+		return nil, err
+	}
+	if !k.context.tokenCanSign(mechanism) {
+		return nil, withMessagef(ErrMechanismNotSupported, "signing with mechanism 0x%X", mechanism)
+	}
+	chunk := k.context.maxSingleCallSize()
+
+	err = k.withSession(func(session *pkcs11Session) error {
+		if err = session.signInit(mech, k.handle); err != nil {
+			return err
+		}
+		if chunk > 0 && len(message) > chunk {
+			signature, err = session.signParts(message, chunk)
+		} else {
+			signature, err = session.sign(mechanism, message)
+		}
+		if err != nil {
+			return err
+		}
+		return k.checkSignatureLength(signature)
+	})
+	return signature, err
+}
+
+// signParts continues a signature started with C_SignInit, passing input to the token in pieces of at most chunk
+// bytes and finishing the operation.
+func (s *pkcs11Session) signParts(input []byte, chunk int) ([]byte, error) {
+	for len(input) > 0 {
+		n := min(chunk, len(input))
+		if err := s.signUpdate(input[:n]); err != nil {
+			return nil, err
+		}
+		input = input[n:]
+	}
+	return s.signFinal()
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// skipIfNotSupported skips the test if err says the token lacks the combined mechanism.
+func skipIfNotSupported(t *testing.T, err error) {
+	if errors.Is(err, ErrMechanismNotSupported) {
+		t.Skip(err)
+	}
+}
+
+func TestRsaSignMessage(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeSigning)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		pub := key.Public().(*rsa.PublicKey)
+
+		message := []byte("hashed inside the HSM boundary")
+		digest := sha256.Sum256(message)
+
+		t.Run("PKCS1v15", func(t *testing.T) {
+			signature, err := key.(MessageSigner).SignMessage(nil, message, crypto.SHA256)
+			skipIfNotSupported(t, err)
+			require.NoError(t, err)
+
+			expected, err := key.Sign(nil, digest[:], crypto.SHA256)
+			require.NoError(t, err)
+			assert.Equal(t, expected, signature)
+		})
+
+		t.Run("PSS", func(t *testing.T) {
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			signature, err := key.(MessageSigner).SignMessage(nil, message, opts)
+			skipIfNotSupported(t, err)
+			require.NoError(t, err)
+			assert.NoError(t, rsa.VerifyPSS(pub, crypto.SHA256, digest[:], signature, opts))
+		})
+
+		t.Run("Errors", func(t *testing.T) {
+			_, err := key.(MessageSigner).SignMessage(nil, message, nil)
+			assert.Equal(t, errUnsupportedRSAOptions, err)
+
+			_, err = key.(MessageSigner).SignMessage(nil, message, crypto.MD5)
+			assert.True(t, errors.Is(err, ErrUnsupportedHash), "%v", err)
+
+			ctx.mechanismFlags.Store(uint(pkcs11.CKM_SHA384_RSA_PKCS), uint(0))
+			_, err = key.(MessageSigner).SignMessage(nil, message, crypto.SHA384)
+			assert.True(t, errors.Is(err, ErrMechanismNotSupported), "%v", err)
+		})
+	})
+}
+
+func TestEcdsaSignMessage(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		pub := key.Public().(*ecdsa.PublicKey)
+
+		message := []byte("hashed inside the HSM boundary")
+		sha256Digest := sha256.Sum256(message)
+		sha512Digest := sha512.Sum512(message)
+
+		for hash, digest := range map[crypto.Hash][]byte{
+			crypto.SHA256: sha256Digest[:],
+			crypto.SHA512: sha512Digest[:],
+		} {
+			t.Run(hash.String(), func(t *testing.T) {
+				signature, err := key.(MessageSigner).SignMessage(nil, message, hash)
+				skipIfNotSupported(t, err)
+				require.NoError(t, err)
+				assert.True(t, ecdsa.VerifyASN1(pub, digest, signature))
+			})
+		}
+
+		_, err = key.(MessageSigner).SignMessage(nil, message, nil)
+		assert.True(t, errors.Is(err, ErrUnsupportedHash), "%v", err)
+	})
+}
+
+func TestSignMessageInParts(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.MaxSingleCallSize = 64
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeSigning)
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	message := make([]byte, 1000)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	signature, err := key.(MessageSigner).SignMessage(nil, message, crypto.SHA256)
+	skipIfNotSupported(t, err)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256(message)
+	expected, err := key.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	assert.Equal(t, expected, signature)
+}
@@ -0,0 +1,217 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"errors"
+	"sync/atomic"
+
+	"github.com/miekg/pkcs11"
+)
+
+// errStreamBusy is returned if a StreamSigner is used by more than one goroutine at once.
+var errStreamBusy = errors.New("StreamSigner used concurrently")
+
+// errStreamFinished is returned if a StreamSigner is used after Sign or Close.
+var errStreamFinished = errors.New("StreamSigner already finished")
+
+// errStreamAbandoned is passed to putSession when a StreamSigner is closed without signing, so that the session,
+// which still has a signing operation active, is discarded.
+var errStreamAbandoned = errors.New("StreamSigner closed before Sign")
+
+// StreamSigner signs a message that is passed to it in pieces with Write, using C_SignUpdate with a mechanism that
+// hashes on the token, so that neither the caller nor crypto11 need to hold the whole message. It is returned by
+// the NewStreamSigner methods of RSA and ECDSA key pairs.
+//
+// A StreamSigner holds a session from the pool from the time it is created until Sign or Close is called, so Close
+// should be deferred as soon as it has been created. Close after Sign has no effect. A StreamSigner must not be
+// used by more than one goroutine at once; a call made while another is in progress fails.
+type StreamSigner struct {
+	key     *pkcs11PrivateKey
+	session *pkcs11Session
+
+	// chunk is the largest input passed to one C_SignUpdate call, or zero for no limit.
+	chunk int
+
+	// updated records whether C_SignUpdate has been called.
+	updated bool
+
+	// finish converts the signature returned by the token to the form returned by Sign.
+	finish func(sig []byte) ([]byte, error)
+
+	// busy is 1 while a method is running.
+	busy int32
+
+	// err is returned by calls made after the session has been released.
+	err error
+}
+
+// NewStreamSigner returns a StreamSigner that makes the same signature as SignMessage, hashing the data written to
+// it on the token with opts.HashFunc().
+//
+// If the token does not advertise the combined mechanism, an error wrapping ErrMechanismNotSupported is returned.
+func (priv *pkcs11PrivateKeyRSA) NewStreamSigner(opts crypto.SignerOpts) (*StreamSigner, error) {
+	mech, err := priv.messageMechanism(opts)
+	if err != nil {
+		return nil, err
+	}
+	return priv.newStreamSigner(mech, func(sig []byte) ([]byte, error) { return sig, nil })
+}
+
+// NewStreamSigner returns a StreamSigner that makes the same DER-encoded signature as SignMessage, hashing the data
+// written to it on the token with opts.HashFunc().
+//
+// If the token does not advertise the combined mechanism, an error wrapping ErrMechanismNotSupported is returned.
+func (signer *pkcs11PrivateKeyECDSA) NewStreamSigner(opts crypto.SignerOpts) (*StreamSigner, error) {
+	mech, err := ecdsaMessageMechanism(opts)
+	if err != nil {
+		return nil, err
+	}
+	return signer.newStreamSigner(mech, dsaSignatureDER)
+}
+
+// newStreamSigner checks out a session and starts a signing operation with mech on it.
+func (k *pkcs11PrivateKey) newStreamSigner(mech []*pkcs11.Mechanism,
+	finish func(sig []byte) ([]byte, error)) (*StreamSigner, error) {
+
+	mechanism := mech[0].Mechanism
+	if err := k.checkUsage("signing", pkcs11.CKA_SIGN, mechanism); err != nil {
+		return nil, err
+	}
+	if !k.context.tokenCanSign(mechanism) {
+		return nil, withMessagef(ErrMechanismNotSupported, "signing with mechanism 0x%X", mechanism)
+	}
+
+	session, err := k.getSession()
+	if err != nil {
+		return nil, err
+	}
+	if err = session.signInit(mech, k.handle); err != nil {
+		k.context.putSession(session, err)
+		return nil, err
+	}
+
+	return &StreamSigner{
+		key:     k,
+		session: session,
+		chunk:   k.context.maxSingleCallSize(),
+		finish:  finish,
+	}, nil
+}
+
+// Write passes p to the token. If it fails, the signing operation is over and the StreamSigner cannot be used
+// further.
+func (s *StreamSigner) Write(p []byte) (n int, err error) {
+	if err = s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.unlock()
+
+	for len(p) > 0 {
+		part := len(p)
+		if s.chunk > 0 && part > s.chunk {
+			part = s.chunk
+		}
+		if err = s.session.signUpdate(p[:part]); err != nil {
+			s.release(err)
+			return n, err
+		}
+		s.updated = true
+		n += part
+		p = p[part:]
+	}
+	return n, nil
+}
+
+// Sign finishes the signing operation and returns the signature of everything written. The session is returned
+// to the pool whether or not it succeeds.
+func (s *StreamSigner) Sign() ([]byte, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.unlock()
+
+	if !s.updated {
+		// C_SignFinal is only valid after at least one C_SignUpdate, so an empty message must be passed explicitly.
+		if err := s.session.signUpdate([]byte{}); err != nil {
+			s.release(err)
+			return nil, err
+		}
+	}
+	sig, err := s.session.signFinal()
+	if err == nil {
+		err = s.key.checkSignatureLength(sig)
+	}
+	s.release(err)
+	if err != nil {
+		return nil, err
+	}
+	return s.finish(sig)
+}
+
+// Close abandons the signing operation, if Sign has not been called, and returns the session to the pool. Since
+// PKCS#11 v2.40 has no way to cancel an operation, the session is closed and the pool opens a replacement.
+func (s *StreamSigner) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.busy, 0, 1) {
+		return errStreamBusy
+	}
+	defer s.unlock()
+
+	if s.session != nil {
+		s.release(errStreamAbandoned)
+		s.err = errStreamFinished
+	}
+	return nil
+}
+
+// acquire marks s as in use, failing if it already is or its session has been released.
+func (s *StreamSigner) acquire() error {
+	if !atomic.CompareAndSwapInt32(&s.busy, 0, 1) {
+		return errStreamBusy
+	}
+	if s.session == nil {
+		s.unlock()
+		return s.err
+	}
+	if err := checkSession(s.session); err != nil {
+		s.unlock()
+		return err
+	}
+	return nil
+}
+
+// unlock marks s as no longer in use.
+func (s *StreamSigner) unlock() {
+	atomic.StoreInt32(&s.busy, 0)
+}
+
+// release returns the session to the pool. err is the error that finished the operation, if any, and is returned by
+// later calls.
+func (s *StreamSigner) release(err error) {
+	s.key.context.putSession(s.session, err)
+	s.session = nil
+	s.err = errStreamFinished
+	if err != nil {
+		s.err = err
+	}
+}
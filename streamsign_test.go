@@ -0,0 +1,186 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeInPieces writes message to s in uneven pieces.
+func writeInPieces(t *testing.T, s *StreamSigner, message []byte) {
+	for i, size := 0, 1; i < len(message); i, size = i+size, size*3 {
+		end := min(i+size, len(message))
+		n, err := s.Write(message[i:end])
+		require.NoError(t, err)
+		require.Equal(t, end-i, n)
+	}
+}
+
+func TestRsaStreamSigner(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPairForPurpose(randomBytes(), nil, rsaSize, KeyPurposeSigning)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		pub := key.Public().(*rsa.PublicKey)
+
+		message := make([]byte, 5000)
+		for i := range message {
+			message[i] = byte(i)
+		}
+		digest := sha256.Sum256(message)
+
+		t.Run("PKCS1v15", func(t *testing.T) {
+			stream, err := key.(StreamingSigner).NewStreamSigner(crypto.SHA256)
+			skipIfNotSupported(t, err)
+			require.NoError(t, err)
+			defer func() { assert.NoError(t, stream.Close()) }()
+
+			writeInPieces(t, stream, message)
+			signature, err := stream.Sign()
+			require.NoError(t, err)
+			assert.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature))
+
+			_, err = stream.Sign()
+			assert.Equal(t, errStreamFinished, err)
+			_, err = stream.Write(message)
+			assert.Equal(t, errStreamFinished, err)
+		})
+
+		t.Run("PSS", func(t *testing.T) {
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			stream, err := key.(StreamingSigner).NewStreamSigner(opts)
+			skipIfNotSupported(t, err)
+			require.NoError(t, err)
+			defer func() { assert.NoError(t, stream.Close()) }()
+
+			writeInPieces(t, stream, message)
+			signature, err := stream.Sign()
+			require.NoError(t, err)
+			assert.NoError(t, rsa.VerifyPSS(pub, crypto.SHA256, digest[:], signature, opts))
+		})
+
+		t.Run("Empty", func(t *testing.T) {
+			stream, err := key.(StreamingSigner).NewStreamSigner(crypto.SHA256)
+			skipIfNotSupported(t, err)
+			require.NoError(t, err)
+			defer func() { assert.NoError(t, stream.Close()) }()
+
+			signature, err := stream.Sign()
+			require.NoError(t, err)
+			expected, err := key.(MessageSigner).SignMessage(nil, nil, crypto.SHA256)
+			require.NoError(t, err)
+			assert.Equal(t, expected, signature)
+		})
+
+		t.Run("Errors", func(t *testing.T) {
+			_, err := key.(StreamingSigner).NewStreamSigner(nil)
+			assert.Equal(t, errUnsupportedRSAOptions, err)
+		})
+	})
+}
+
+func TestEcdsaStreamSigner(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		message := []byte("streamed through the HSM in pieces")
+		digest := sha256.Sum256(message)
+
+		stream, err := key.(StreamingSigner).NewStreamSigner(crypto.SHA256)
+		skipIfNotSupported(t, err)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, stream.Close()) }()
+
+		writeInPieces(t, stream, message)
+		signature, err := stream.Sign()
+		require.NoError(t, err)
+		assert.True(t, ecdsa.VerifyASN1(key.Public().(*ecdsa.PublicKey), digest[:], signature))
+	})
+}
+
+func TestStreamSignerReleasesSession(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.MaxSessions = 2
+	config.PoolWaitTimeout = PoolNoWait
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	for _, finish := range []func(s *StreamSigner) error{
+		func(s *StreamSigner) error { _, err := s.Sign(); return err },
+		func(s *StreamSigner) error { return s.Close() },
+	} {
+		// Each stream needs the session released by the previous one.
+		stream, err := key.(StreamingSigner).NewStreamSigner(crypto.SHA256)
+		skipIfNotSupported(t, err)
+		require.NoError(t, err)
+
+		// The stream holds the only free session until it is finished.
+		assert.Equal(t, ErrPoolExhausted, ctx.withSession(func(*pkcs11Session) error { return nil }))
+
+		_, err = stream.Write([]byte("firmware image"))
+		require.NoError(t, err)
+		require.NoError(t, finish(stream))
+		assert.NoError(t, stream.Close())
+
+		_, err = stream.Write([]byte("too late"))
+		assert.Equal(t, errStreamFinished, err)
+	}
+}
+
+func TestStreamSignerRejectsConcurrentUse(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		stream, err := key.(StreamingSigner).NewStreamSigner(crypto.SHA256)
+		skipIfNotSupported(t, err)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, stream.Close()) }()
+
+		// Simulate another goroutine part-way through Write.
+		stream.busy = 1
+		_, err = stream.Write([]byte("interleaved"))
+		assert.Equal(t, errStreamBusy, err)
+		_, err = stream.Sign()
+		assert.Equal(t, errStreamBusy, err)
+		assert.Equal(t, errStreamBusy, stream.Close())
+		stream.busy = 0
+	})
+}
@@ -0,0 +1,256 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/thales-e-security/pool"
+)
+
+// ErrPoolCapacity is returned by WithPool if the Context does not have enough sessions left to give the new pool.
+var ErrPoolCapacity = errors.New("not enough sessions left for the pool")
+
+// A SessionPool is a named share of the sessions of a Context, made by Context.WithPool. Operations on keys bound to
+// a SessionPool check out their sessions from it rather than from the Context's own pool, so that a workload which
+// exhausts one pool cannot delay operations using another. Login state and loaded keys are shared with the Context.
+//
+// Config.PoolWaitTimeout applies to each pool. The sessions of a SessionPool are taken from the Context's own pool,
+// so the sessions of all pools together stay within Config.MaxSessions and the limit of the token.
+type SessionPool struct {
+	name    string
+	size    int
+	context *Context
+
+	// resources holds the sessions of the pool. It is replaced by Resume, like Context.pool.
+	resources *pool.ResourcePool
+}
+
+// sessionPools records the pools made by WithPool.
+type sessionPools struct {
+	mutex  sync.Mutex
+	byName map[string]*SessionPool
+
+	// reserved is the number of sessions taken from the Context's own pool.
+	reserved int
+}
+
+// WithPool returns the session pool called name, creating it with room for maxSessions sessions if it does not
+// exist. Keys found through the returned SessionPool use its sessions for their operations.
+//
+// The sessions are taken from the Context's own pool, which keeps at least one. An error wrapping ErrPoolCapacity is
+// returned if there are not maxSessions to spare. If sessions of the Context's own pool are in use, WithPool waits
+// for them to be returned as needed. It is an error to ask for an existing pool with a different size.
+func (c *Context) WithPool(name string, maxSessions int) (*SessionPool, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+	if name == "" {
+		return nil, errors.New("session pool name cannot be empty")
+	}
+	if maxSessions < 1 {
+		return nil, errors.New("session pool must have at least one session")
+	}
+
+	// Prevent Suspend and Resume from replacing the Context's pool meanwhile.
+	c.suspension.transition.Lock()
+	defer c.suspension.transition.Unlock()
+	if c.suspension.isSuspended() {
+		return nil, ErrSuspended
+	}
+
+	c.sessionPools.mutex.Lock()
+	defer c.sessionPools.mutex.Unlock()
+
+	if sp, ok := c.sessionPools.byName[name]; ok {
+		if sp.size != maxSessions {
+			return nil, fmt.Errorf("session pool %q already exists with %d sessions", name, sp.size)
+		}
+		return sp, nil
+	}
+
+	capacity := int(c.pool.Capacity())
+	if spare := capacity - 1; maxSessions > spare {
+		return nil, withMessagef(ErrPoolCapacity, "session pool %q needs %d sessions but %d are left", name,
+			maxSessions, spare)
+	}
+	if err := c.pool.SetCapacity(capacity - maxSessions); err != nil {
+		return nil, withMessage(err, "failed to shrink the session pool")
+	}
+
+	sp := &SessionPool{name: name, size: maxSessions, context: c}
+	sp.resources = pool.NewResourcePool(c.resourcePoolFactoryFunc, maxSessions, maxSessions, 0, 0)
+	if c.sessionPools.byName == nil {
+		c.sessionPools.byName = map[string]*SessionPool{}
+	}
+	c.sessionPools.byName[name] = sp
+	c.sessionPools.reserved += maxSessions
+	return sp, nil
+}
+
+// reservedSessions returns the number of sessions taken from the Context's own pool by WithPool.
+func (p *sessionPools) reservedSessions() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.reserved
+}
+
+// close closes every pool made by WithPool, waiting for their sessions to be returned.
+func (p *sessionPools) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, sp := range p.byName {
+		sp.resources.Close()
+	}
+}
+
+// reopen replaces the pools closed by close, after Resume.
+func (p *sessionPools) reopen(c *Context) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, sp := range p.byName {
+		sp.resources = pool.NewResourcePool(c.resourcePoolFactoryFunc, sp.size, sp.size, 0, 0)
+	}
+}
+
+// Name returns the name the pool was made with.
+func (sp *SessionPool) Name() string {
+	return sp.name
+}
+
+// MaxSessions returns the number of sessions the pool may open.
+func (sp *SessionPool) MaxSessions() int {
+	return sp.size
+}
+
+// InUse returns the number of sessions of the pool that are checked out.
+func (sp *SessionPool) InUse() int {
+	return int(sp.resources.InUse())
+}
+
+// FindKeyPair is Context.FindKeyPair, returning a key pair bound to this pool. The search itself uses the Context's
+// own pool.
+func (sp *SessionPool) FindKeyPair(id []byte, label []byte) (Signer, error) {
+	signer, err := sp.context.FindKeyPair(id, label)
+	if err != nil || signer == nil {
+		return signer, err
+	}
+	tokenKeyOf(signer).sessionPool = sp
+	return signer, nil
+}
+
+// FindKeyPairs is Context.FindKeyPairs, returning key pairs bound to this pool. The search itself uses the Context's
+// own pool.
+func (sp *SessionPool) FindKeyPairs(id []byte, label []byte) ([]Signer, error) {
+	signers, err := sp.context.FindKeyPairs(id, label)
+	if err != nil {
+		return nil, err
+	}
+	for _, signer := range signers {
+		tokenKeyOf(signer).sessionPool = sp
+	}
+	return signers, nil
+}
+
+// FindKey is Context.FindKey, returning a key bound to this pool. The search itself uses the Context's own pool.
+func (sp *SessionPool) FindKey(id []byte, label []byte) (*SecretKey, error) {
+	key, err := sp.context.FindKey(id, label)
+	if err != nil || key == nil {
+		return key, err
+	}
+	key.sessionPool = sp
+	return key, nil
+}
+
+// FindKeys is Context.FindKeys, returning keys bound to this pool. The search itself uses the Context's own pool.
+func (sp *SessionPool) FindKeys(id []byte, label []byte) ([]*SecretKey, error) {
+	keys, err := sp.context.FindKeys(id, label)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		key.sessionPool = sp
+	}
+	return keys, nil
+}
+
+// BindKeyPair returns a copy of signer, a key pair of the same Context, whose operations use this pool. The copy
+// refers to the same token objects, and signer continues to use its own pool, so that the pool can be chosen for
+// each operation by picking the copy to use. Archive and Unarchive only affect the copy they are called on.
+func (sp *SessionPool) BindKeyPair(signer Signer) (Signer, error) {
+	if k := tokenKeyOf(signer); k == nil || k.context != sp.context {
+		return nil, errors.New("not a key pair of the pool's Context")
+	}
+
+	switch k := signer.(type) {
+	case *pkcs11PrivateKeyRSA:
+		bound := *k
+		bound.sessionPool = sp
+		return &bound, nil
+	case *pkcs11PrivateKeyECDSA:
+		bound := *k
+		bound.sessionPool = sp
+		return &bound, nil
+	case *pkcs11PrivateKeyDSA:
+		bound := *k
+		bound.sessionPool = sp
+		return &bound, nil
+	case *pkcs11PrivateKeyEd25519:
+		bound := *k
+		bound.sessionPool = sp
+		return &bound, nil
+	case *pkcs11PrivateKeyEd448:
+		bound := *k
+		bound.sessionPool = sp
+		return &bound, nil
+	case *pkcs11PrivateKeyX25519:
+		bound := *k
+		bound.sessionPool = sp
+		return &bound, nil
+	default:
+		return nil, fmt.Errorf("unsupported key pair type %T", signer)
+	}
+}
+
+// BindSecretKey returns a copy of key, a key of the same Context, whose operations use this pool. See BindKeyPair.
+func (sp *SessionPool) BindSecretKey(key *SecretKey) (*SecretKey, error) {
+	if key == nil || key.context != sp.context {
+		return nil, errors.New("not a key of the pool's Context")
+	}
+	bound := *key
+	bound.sessionPool = sp
+	return &bound, nil
+}
+
+// withSession runs f with a session from the pool the object is bound to, see SessionPool.
+func (o *pkcs11Object) withSession(f func(session *pkcs11Session) error) error {
+	return o.context.withPoolSession(context.Background(), o.sessionPool, f)
+}
+
+// getSession checks out a session from the pool the object is bound to. Callers are responsible for returning it
+// with Context.putSession.
+func (o *pkcs11Object) getSession() (*pkcs11Session, error) {
+	return o.context.getPoolSession(context.Background(), o.sessionPool)
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithPool(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.MaxSessions = 5
+	config.PoolWaitTimeout = PoolNoWait
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	_, err = ctx.WithPool("", 1)
+	assert.Error(t, err)
+	_, err = ctx.WithPool("interactive", 0)
+	assert.Error(t, err)
+
+	interactive, err := ctx.WithPool("interactive", 2)
+	require.NoError(t, err)
+	assert.Equal(t, "interactive", interactive.Name())
+	assert.Equal(t, 2, interactive.MaxSessions())
+	assert.EqualValues(t, 2, ctx.pool.Capacity())
+
+	again, err := ctx.WithPool("interactive", 2)
+	require.NoError(t, err)
+	assert.True(t, again == interactive)
+	_, err = ctx.WithPool("interactive", 1)
+	assert.Error(t, err)
+
+	// The Context keeps one session of its own.
+	_, err = ctx.WithPool("batch", 2)
+	assert.True(t, errors.Is(err, ErrPoolCapacity), "%v", err)
+
+	id := randomBytes()
+	key, err := ctx.GenerateECDSAKeyPair(id, elliptic.P256())
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	bound, err := interactive.FindKeyPair(id, nil)
+	require.NoError(t, err)
+	copied, err := interactive.BindKeyPair(key)
+	require.NoError(t, err)
+	digest := sha256.Sum256(randomBytes())
+
+	// Exhaust the Context's own pool; keys bound to the interactive pool are unaffected.
+	var parked []*pkcs11Session
+	for i := 0; i < 2; i++ {
+		session, err := ctx.getSession()
+		require.NoError(t, err)
+		parked = append(parked, session)
+	}
+
+	_, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Equal(t, ErrPoolExhausted, err)
+
+	for _, signer := range []Signer{bound, copied} {
+		sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+		assert.NoError(t, VerifySignature(signer, digest[:], sig, crypto.SHA256))
+	}
+	assert.Equal(t, 0, interactive.InUse())
+
+	for _, session := range parked {
+		ctx.putSession(session, nil)
+	}
+	_, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+}
+
+func TestBindKeyPairRejectsOtherKeys(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		sp, err := ctx.WithPool("other", 1)
+		require.NoError(t, err)
+
+		_, err = sp.BindKeyPair(nil)
+		assert.Error(t, err)
+		_, err = sp.BindSecretKey(nil)
+		assert.Error(t, err)
+	})
+}
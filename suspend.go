@@ -0,0 +1,289 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrSuspended is returned by operations attempted while a Context is suspended, if Config.FailWhileSuspended is set
+// or Config.PoolWaitTimeout expires before the Context is resumed.
+var ErrSuspended = errors.New("context is suspended")
+
+// ErrHandlesChanged is returned by Context.Resume if the token did not preserve object handles while the Context was
+// suspended. The Context is usable, but keys and other objects found before Suspend must be found again.
+var ErrHandlesChanged = errors.New("object handles changed while suspended")
+
+// errNotSuspended is returned by Resume if the Context is not suspended.
+var errNotSuspended = errors.New("context is not suspended")
+
+// errAlreadySuspended is returned by Suspend if the Context is already suspended.
+var errAlreadySuspended = errors.New("context is already suspended")
+
+// suspension tracks the sessions checked out from a Context, so that Suspend can wait for them to be returned.
+type suspension struct {
+	// transition serialises Suspend and Resume.
+	transition sync.Mutex
+
+	mutex sync.Mutex
+
+	// inFlight is the number of sessions checked out of the pool.
+	inFlight int
+
+	// idle is closed when inFlight drops to zero while Suspend is waiting. It is nil otherwise.
+	idle chan struct{}
+
+	// resumed is closed when the Context is resumed. It is nil unless the Context is suspended.
+	resumed chan struct{}
+
+	// objects identifies the token objects visible when the Context was suspended, by handle.
+	objects map[pkcs11.ObjectHandle]objectIdentity
+}
+
+// objectIdentity holds the attributes used to check that a handle refers to the same object after Resume.
+type objectIdentity struct {
+	class uint
+	id    []byte
+	label []byte
+}
+
+// enter records that a session is being checked out. If the Context is suspended, enter waits for it to be
+// resumed, unless failFast is set or ctx expires, in which case ErrSuspended is returned.
+func (s *suspension) enter(ctx context.Context, failFast bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.resumed != nil {
+		if failFast {
+			return ErrSuspended
+		}
+
+		resumed := s.resumed
+		s.mutex.Unlock()
+		select {
+		case <-resumed:
+			s.mutex.Lock()
+		case <-ctx.Done():
+			s.mutex.Lock()
+			return withMessage(ErrSuspended, "timed out waiting for resume")
+		}
+	}
+
+	s.inFlight++
+	return nil
+}
+
+// leave records that a session has been returned.
+func (s *suspension) leave() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.inFlight--
+	if s.inFlight == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// begin marks the Context as suspended and waits until no sessions are checked out. If ctx expires first, the
+// Context is left running and the context error is returned.
+func (s *suspension) begin(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.resumed != nil {
+		s.mutex.Unlock()
+		return errAlreadySuspended
+	}
+	s.resumed = make(chan struct{})
+
+	var idle chan struct{}
+	if s.inFlight > 0 {
+		s.idle = make(chan struct{})
+		idle = s.idle
+	}
+	s.mutex.Unlock()
+
+	if idle == nil {
+		return nil
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		s.mutex.Lock()
+		s.idle = nil
+		s.mutex.Unlock()
+		s.end()
+		return ctx.Err()
+	}
+}
+
+// end wakes any operations waiting for the Context to be resumed. It does nothing if the Context is not suspended.
+func (s *suspension) end() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.resumed != nil {
+		close(s.resumed)
+		s.resumed = nil
+	}
+}
+
+// isSuspended returns true if the Context is suspended.
+func (s *suspension) isSuspended() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.resumed != nil
+}
+
+// Suspend stops the Context from handing out sessions, waits for operations in progress to finish and closes all
+// sessions, for instance to allow maintenance of the token. While the Context is suspended, operations wait until
+// Resume is called. If Config.FailWhileSuspended is set, they fail immediately with ErrSuspended instead.
+//
+// Suspend waits for every session to be returned, including those held by open block modes, HMACs and
+// similar objects. If ctx expires first, the context error is returned and the Context continues to run normally.
+//
+// Keys and other objects found before Suspend may be used again after Resume. If the token might be replaced while
+// the Context is suspended, see Config.RepinKeysAfterResume.
+func (c *Context) Suspend(ctx context.Context) error {
+	if c.closed.Get() {
+		return errClosed
+	}
+
+	c.suspension.transition.Lock()
+	defer c.suspension.transition.Unlock()
+
+	if err := c.suspension.begin(ctx); err != nil {
+		return err
+	}
+
+	// Nothing else is using the persistent session now that the pool is drained.
+	persistent := &pkcs11Session{ctx: c.ctx, handle: c.persistentSession, timings: c.timings,
+		findBatchSize: c.cfg.FindObjectsBatchSize}
+	objects, err := snapshotObjects(persistent)
+	if err != nil {
+		c.suspension.end()
+		return withMessage(err, "failed to record token objects")
+	}
+	c.suspension.objects = objects
+
+	c.pool.Close()
+	c.sessionPools.close()
+	_ = c.ctx.CloseSession(c.persistentSession)
+	return nil
+}
+
+// Resume reopens the sessions closed by Suspend, logs in again and allows operations to continue.
+//
+// If the token no longer uses the same handles for the objects that existed when the Context was suspended, the
+// Context is resumed but ErrHandlesChanged is returned. In that case, keys found before Suspend must be found again.
+// If the token cannot be used, an error is returned and the Context remains suspended.
+func (c *Context) Resume() error {
+	if c.closed.Get() {
+		return errClosed
+	}
+
+	c.suspension.transition.Lock()
+	defer c.suspension.transition.Unlock()
+
+	if !c.suspension.isSuspended() {
+		return errNotSuspended
+	}
+
+	login, err := shouldLogin(c.cfg, c.token)
+	if err != nil {
+		return err
+	}
+
+	if err = c.openPersistentSession(login); err != nil {
+		_ = c.ctx.CloseSession(c.persistentSession)
+		return err
+	}
+
+	persistent := &pkcs11Session{ctx: c.ctx, handle: c.persistentSession, timings: c.timings,
+		findBatchSize: c.cfg.FindObjectsBatchSize}
+	unchanged := verifyObjects(persistent, c.suspension.objects)
+	c.suspension.objects = nil
+
+	c.pool = c.newSessionPool()
+	c.sessionPools.reopen(c)
+	atomic.AddUint64(&c.handleEpoch, 1)
+	c.suspension.end()
+
+	if !unchanged {
+		return ErrHandlesChanged
+	}
+	return nil
+}
+
+// snapshotObjects records the identity of every token object visible to the session.
+func snapshotObjects(session *pkcs11Session) (map[pkcs11.ObjectHandle]objectIdentity, error) {
+	handles, err := findKeysWithAttributes(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true)})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[pkcs11.ObjectHandle]objectIdentity, len(handles))
+	for _, handle := range handles {
+		identity, err := readObjectIdentity(session, handle)
+		if err != nil {
+			// The object cannot be checked after Resume, but it doesn't stop us suspending.
+			continue
+		}
+		objects[handle] = identity
+	}
+	return objects, nil
+}
+
+// verifyObjects returns true if every handle in objects still refers to the same object.
+func verifyObjects(session *pkcs11Session, objects map[pkcs11.ObjectHandle]objectIdentity) bool {
+	for handle, want := range objects {
+		got, err := readObjectIdentity(session, handle)
+		if err != nil || got.class != want.class || !bytes.Equal(got.id, want.id) || !bytes.Equal(got.label, want.label) {
+			return false
+		}
+	}
+	return true
+}
+
+func readObjectIdentity(session *pkcs11Session, handle pkcs11.ObjectHandle) (objectIdentity, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+	}
+	attributes, err := session.ctx.GetAttributeValue(session.handle, handle, template)
+	if err != nil {
+		return objectIdentity{}, err
+	}
+	return objectIdentity{
+		class: bytesToUlong(attributes[0].Value),
+		id:    attributes[1].Value,
+		label: attributes[2].Value,
+	}, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuspensionFailFast(t *testing.T) {
+	var s suspension
+	require.NoError(t, s.begin(context.Background()))
+	assert.Equal(t, ErrSuspended, s.enter(context.Background(), true))
+
+	s.end()
+	require.NoError(t, s.enter(context.Background(), true))
+	s.leave()
+}
+
+func TestSuspensionWaitsForResume(t *testing.T) {
+	var s suspension
+	require.NoError(t, s.begin(context.Background()))
+
+	entered := make(chan error)
+	go func() { entered <- s.enter(context.Background(), false) }()
+
+	select {
+	case <-entered:
+		t.Fatal("enter returned while suspended")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.end()
+	require.NoError(t, <-entered)
+	s.leave()
+}
+
+func TestSuspensionWaitTimeout(t *testing.T) {
+	var s suspension
+	require.NoError(t, s.begin(context.Background()))
+	defer s.end()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(s.enter(ctx, false), ErrSuspended))
+}
+
+func TestSuspensionDrains(t *testing.T) {
+	var s suspension
+	require.NoError(t, s.enter(context.Background(), false))
+
+	// An in-flight session prevents the suspension completing before the deadline...
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.begin(ctx))
+	assert.False(t, s.isSuspended())
+
+	// ...but completes it once returned.
+	done := make(chan error)
+	go func() { done <- s.begin(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	s.leave()
+	require.NoError(t, <-done)
+	assert.True(t, s.isSuspended())
+	assert.Equal(t, errAlreadySuspended, s.begin(context.Background()))
+}
+
+func TestSuspendResume(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.FailWhileSuspended = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	key, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	require.Equal(t, errNotSuspended, ctx.Resume())
+	require.NoError(t, ctx.Suspend(context.Background()))
+
+	digest := sha256.Sum256([]byte("suspended"))
+	_, err = key.Sign(nil, digest[:], crypto.SHA256)
+	assert.True(t, errors.Is(err, ErrSuspended))
+
+	require.NoError(t, ctx.Resume())
+
+	// Keys found before Suspend survive
+	_, err = key.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+}
+
+func TestSuspendDeadline(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateSecretKey(randomBytes(), 128, Ciphers[pkcs11.CKK_AES])
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		// The block mode holds a session until closed
+		iv := make([]byte, key.Cipher.BlockSize)
+		mode, err := key.NewCBCEncrypterCloser(iv)
+		require.NoError(t, err)
+
+		deadline, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, ctx.Suspend(deadline))
+
+		// The Context still works
+		mode.Close()
+		_, err = ctx.FindKey(nil, []byte("no such key"))
+		require.NoError(t, err)
+	})
+}
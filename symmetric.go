@@ -23,6 +23,7 @@ package crypto11
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/miekg/pkcs11"
 )
@@ -51,6 +52,9 @@ type SymmetricCipher struct {
 	// True if MAC supported
 	MAC bool
 
+	// True if key derivation supported
+	Derive bool
+
 	// ECB mechanism (CKM_..._ECB)
 	ECBMech uint
 
@@ -116,6 +120,7 @@ var CipherGeneric = &SymmetricCipher{
 	BlockSize: 64,
 	Encrypt:   false,
 	MAC:       true,
+	Derive:    true,
 	ECBMech:   0,
 	CBCMech:   0,
 	GCMMech:   0,
@@ -250,6 +255,9 @@ type SecretKey struct {
 
 	// Symmetric cipher information
 	Cipher *SymmetricCipher
+
+	// usage caches the attributes checked by the cipher constructors
+	usage *secretKeyUsageCache
 }
 
 // GenerateSecretKey creates an secret key of given length and type. The id parameter is used to
@@ -289,35 +297,40 @@ func (c *Context) GenerateSecretKeyWithAttributes(template AttributeSet, bits in
 		return nil, errClosed
 	}
 
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
+	if bits%8 != 0 {
+		return nil, errors.New("key length must be a whole number of bytes")
+	}
+
 	err = c.withSession(func(session *pkcs11Session) error {
 
 		// CKK_*_HMAC exists but there is no specific corresponding CKM_*_KEY_GEN
 		// mechanism. Therefore we attempt both CKM_GENERIC_SECRET_KEY_GEN and
 		// vendor-specific mechanisms.
 
-		template.AddIfNotPresent([]*pkcs11.Attribute{
-			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
-			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
-			pkcs11.NewAttribute(pkcs11.CKA_SIGN, cipher.MAC),
-			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, cipher.MAC),
-			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, cipher.Encrypt), // Not supported on CloudHSM
-			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, cipher.Encrypt), // Not supported on CloudHSM
-			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
-			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
-		})
+		addSecretKeyDefaults(template, cipher)
 		if bits > 0 {
 			_ = template.Set(pkcs11.CKA_VALUE_LEN, bits/8) // safe for an int
 		}
 
 		for n, genMech := range cipher.GenParams {
 
+			if bits > 0 {
+				if err := c.checkSecretKeyLength(genMech.GenMech, bits); err != nil {
+					return err
+				}
+			}
+
 			_ = template.Set(CkaKeyType, genMech.KeyType)
 
 			mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(genMech.GenMech, nil)}
 
 			privHandle, err := session.ctx.GenerateKey(session.handle, mech, template.ToSlice())
 			if err == nil {
-				k = &SecretKey{pkcs11Object{privHandle, c}, cipher}
+				k = newSecretKey(c, privHandle, cipher)
 				return nil
 			}
 
@@ -333,7 +346,7 @@ func (c *Context) GenerateSecretKeyWithAttributes(template AttributeSet, bits in
 					// Store the actual attributes
 					template.cloneFrom(adjustedTemplate)
 
-					k = &SecretKey{pkcs11Object{privHandle, c}, cipher}
+					k = newSecretKey(c, privHandle, cipher)
 					return nil
 				}
 			}
@@ -360,6 +373,118 @@ func (c *Context) GenerateSecretKeyWithAttributes(template AttributeSet, bits in
 	return
 }
 
+// addSecretKeyDefaults adds the default attributes for a secret key of the given cipher, unless already present.
+func addSecretKeyDefaults(template AttributeSet, cipher *SymmetricCipher) {
+	template.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, cipher.MAC),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, cipher.MAC),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, cipher.Encrypt), // Not supported on CloudHSM
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, cipher.Encrypt), // Not supported on CloudHSM
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	})
+	if cipher.Derive {
+		template.AddIfNotPresent([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true),
+		})
+	}
+}
+
+// keySizeUnits maps key generation mechanisms to the unit, in bits, of the key sizes reported in CK_MECHANISM_INFO.
+// The PKCS#11 specification is not consistent about this, so mechanisms not listed here are not checked.
+var keySizeUnits = map[uint]int{
+	pkcs11.CKM_AES_KEY_GEN:            8,
+	pkcs11.CKM_GENERIC_SECRET_KEY_GEN: 1,
+}
+
+// checkSecretKeyLength checks the requested key length against the key sizes the token reports for the given key
+// generation mechanism. If the token cannot report any information for the mechanism, no error is returned.
+func (c *Context) checkSecretKeyLength(genMech uint, bits int) error {
+	unit, ok := keySizeUnits[genMech]
+	if !ok {
+		return nil
+	}
+
+	info, err := c.ctx.GetMechanismInfo(c.slot, []*pkcs11.Mechanism{pkcs11.NewMechanism(genMech, nil)})
+	if err != nil {
+		return nil
+	}
+
+	min, max := int(info.MinKeySize)*unit, int(info.MaxKeySize)*unit
+	if (min > 0 && bits < min) || (max > 0 && bits > max) {
+		return fmt.Errorf("key length %d bits is outside the range %d-%d bits supported by the token", bits, min, max)
+	}
+	return nil
+}
+
+// ImportSecretKey imports a secret key value onto the token. The id parameter is used to set CKA_ID and must be
+// non-nil. Keys of any whole number of bytes may be imported, subject to the limits reported by the token.
+func (c *Context) ImportSecretKey(id []byte, value []byte, cipher *SymmetricCipher) (*SecretKey, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	template, err := NewAttributeSetWithID(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.ImportSecretKeyWithAttributes(template, value, cipher)
+}
+
+// ImportSecretKeyWithAttributes imports a secret key value onto the token. After this function returns, template
+// will contain the attributes applied to the key. If required attributes are missing, they will be set to a default
+// value.
+func (c *Context) ImportSecretKeyWithAttributes(template AttributeSet, value []byte, cipher *SymmetricCipher) (k *SecretKey, err error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
+	if err = c.addSecretKeyImportAttributes(template, value, cipher); err != nil {
+		return nil, err
+	}
+
+	err = c.withSession(func(session *pkcs11Session) error {
+		handle, err := session.ctx.CreateObject(session.handle, template.ToSlice())
+		if err != nil {
+			return err
+		}
+		k = newSecretKey(c, handle, cipher)
+		return nil
+	})
+
+	// Don't keep a copy of the key material in the caller's template
+	template.Unset(CkaValue)
+	return k, err
+}
+
+// addSecretKeyImportAttributes checks that value can be imported as a key for cipher, and adds it to template with
+// defaults for any other required attributes that are not present.
+func (c *Context) addSecretKeyImportAttributes(template AttributeSet, value []byte, cipher *SymmetricCipher) error {
+	if len(value) == 0 {
+		return errors.New("key value cannot be empty")
+	}
+	if len(cipher.GenParams) == 0 {
+		return errors.New("cipher must have GenParams")
+	}
+
+	if err := c.checkSecretKeyLength(cipher.GenParams[0].GenMech, len(value)*8); err != nil {
+		return err
+	}
+
+	addSecretKeyDefaults(template, cipher)
+	template.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, cipher.GenParams[0].KeyType),
+	})
+	_ = template.Set(CkaValue, value) // error not possible for []byte
+	return nil
+}
+
 // Delete deletes the secret key from the token.
 func (key *SecretKey) Delete() error {
 	return key.pkcs11Object.Delete()
@@ -0,0 +1,203 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Function names reported in CallTiming.
+const (
+	CallSign        = "C_Sign"
+	CallDecrypt     = "C_Decrypt"
+	CallOpenSession = "C_OpenSession"
+	CallFindObjects = "C_FindObjects"
+
+	// CallPoolWait is the time spent waiting for a session from the pool. It is not a PKCS#11 call.
+	CallPoolWait = "PoolWait"
+)
+
+// CallTimingBounds are the upper bounds of the CallTiming histogram buckets. A final bucket with an upper bound
+// of math.MaxInt64 counts any longer calls.
+var CallTimingBounds = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// CallTiming is a histogram of the durations of calls to one function with one mechanism.
+type CallTiming struct {
+	// Function is the name of the function, e.g. CallSign.
+	Function string
+
+	// Mechanism is the CKM_... mechanism, or zero for functions that do not take a mechanism.
+	Mechanism uint
+
+	// Buckets hold the number of calls in each duration bucket. Buckets are not cumulative: a call is counted
+	// only in the first bucket whose upper bound is not less than its duration.
+	Buckets []CallTimingBucket
+}
+
+// CallTimingBucket is a single histogram bucket.
+type CallTimingBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// Count returns the total number of calls recorded in the histogram.
+func (t CallTiming) Count() (n uint64) {
+	for _, b := range t.Buckets {
+		n += b.Count
+	}
+	return n
+}
+
+type callKey struct {
+	function  string
+	mechanism uint
+}
+
+type callHistogram struct {
+	buckets []uint64
+}
+
+// callTimings collects call durations. A nil *callTimings records nothing.
+type callTimings struct {
+	histograms sync.Map // callKey -> *callHistogram
+}
+
+func newCallTimings(enabled bool) *callTimings {
+	if !enabled {
+		return nil
+	}
+	return &callTimings{}
+}
+
+// start returns the time at which a call starts, or the zero time if timings are disabled.
+func (t *callTimings) start() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// record adds the duration of a call that began at start.
+func (t *callTimings) record(function string, mechanism uint, start time.Time) {
+	if t == nil {
+		return
+	}
+
+	d := time.Since(start)
+	bucket := sort.Search(len(CallTimingBounds), func(i int) bool { return d <= CallTimingBounds[i] })
+
+	key := callKey{function, mechanism}
+	h, ok := t.histograms.Load(key)
+	if !ok {
+		h, _ = t.histograms.LoadOrStore(key, &callHistogram{buckets: make([]uint64, len(CallTimingBounds)+1)})
+	}
+	atomic.AddUint64(&h.(*callHistogram).buckets[bucket], 1)
+}
+
+// snapshot returns the histograms ordered by function and mechanism.
+func (t *callTimings) snapshot() []CallTiming {
+	if t == nil {
+		return nil
+	}
+
+	var result []CallTiming
+	t.histograms.Range(func(k, v interface{}) bool {
+		key := k.(callKey)
+		h := v.(*callHistogram)
+
+		timing := CallTiming{Function: key.function, Mechanism: key.mechanism}
+		for i := range h.buckets {
+			bound := time.Duration(math.MaxInt64)
+			if i < len(CallTimingBounds) {
+				bound = CallTimingBounds[i]
+			}
+			timing.Buckets = append(timing.Buckets, CallTimingBucket{
+				UpperBound: bound,
+				Count:      atomic.LoadUint64(&h.buckets[i]),
+			})
+		}
+		result = append(result, timing)
+		return true
+	})
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Function != result[j].Function {
+			return result[i].Function < result[j].Function
+		}
+		return result[i].Mechanism < result[j].Mechanism
+	})
+	return result
+}
+
+// CallTimings returns histograms of the durations of PKCS#11 calls made by the Context, or nil if
+// Config.CollectCallTimings was not set.
+func (c *Context) CallTimings() []CallTiming {
+	return c.timings.snapshot()
+}
+
+// sign calls C_Sign, recording its duration.
+func (s *pkcs11Session) sign(mechanism uint, data []byte) ([]byte, error) {
+	start := s.timings.start()
+	signature, err := s.ctx.Sign(s.handle, data)
+	s.timings.record(CallSign, mechanism, start)
+	return signature, s.finishOperation(err)
+}
+
+// decrypt calls C_Decrypt, recording its duration.
+func (s *pkcs11Session) decrypt(mechanism uint, ciphertext []byte) ([]byte, error) {
+	start := s.timings.start()
+	plaintext, err := s.ctx.Decrypt(s.handle, ciphertext)
+	s.timings.record(CallDecrypt, mechanism, start)
+	return plaintext, s.finishOperation(err)
+}
+
+// findObjects calls C_FindObjects, recording its duration.
+func (s *pkcs11Session) findObjects(max int) ([]pkcs11.ObjectHandle, error) {
+	if s.findObjectsLimit > 0 && max > s.findObjectsLimit {
+		max = s.findObjectsLimit
+	}
+	start := s.timings.start()
+	handles, _, err := s.ctx.FindObjects(s.handle, max)
+	s.timings.record(CallFindObjects, 0, start)
+	return handles, err
+}
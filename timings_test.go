@@ -0,0 +1,106 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallTimingsNil(t *testing.T) {
+	var timings *callTimings
+	assert.True(t, timings.start().IsZero())
+	timings.record(CallSign, pkcs11.CKM_ECDSA, time.Now())
+	assert.Nil(t, timings.snapshot())
+}
+
+func TestCallTimingsBuckets(t *testing.T) {
+	timings := newCallTimings(true)
+
+	now := time.Now()
+	timings.record(CallSign, pkcs11.CKM_ECDSA, now)
+	timings.record(CallSign, pkcs11.CKM_ECDSA, now.Add(-time.Hour))
+	timings.record(CallDecrypt, pkcs11.CKM_RSA_PKCS, now)
+
+	snapshot := timings.snapshot()
+	require.Len(t, snapshot, 2)
+
+	assert.Equal(t, CallDecrypt, snapshot[0].Function)
+	assert.Equal(t, uint64(1), snapshot[0].Count())
+
+	sign := snapshot[1]
+	assert.Equal(t, CallSign, sign.Function)
+	assert.Equal(t, uint(pkcs11.CKM_ECDSA), sign.Mechanism)
+	require.Len(t, sign.Buckets, len(CallTimingBounds)+1)
+	assert.Equal(t, uint64(2), sign.Count())
+
+	// The hour-long call lands in the overflow bucket
+	last := sign.Buckets[len(sign.Buckets)-1]
+	assert.Equal(t, time.Duration(math.MaxInt64), last.UpperBound)
+	assert.Equal(t, uint64(1), last.Count)
+}
+
+func TestContextCallTimings(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+	config.CollectCallTimings = true
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ctx.Close()) }()
+
+	key, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+	require.NoError(t, err)
+	defer func() { _ = key.Delete() }()
+
+	digest := sha256.Sum256([]byte("call timings"))
+	_, err = key.Sign(nil, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+
+	_, err = ctx.FindKeyPair(nil, []byte("no such key"))
+	require.NoError(t, err)
+
+	functions := map[string]bool{}
+	for _, timing := range ctx.CallTimings() {
+		functions[timing.Function] = true
+		if timing.Function == CallSign {
+			assert.Equal(t, uint(pkcs11.CKM_RSA_PKCS), timing.Mechanism)
+		}
+	}
+	assert.True(t, functions[CallSign])
+	assert.True(t, functions[CallFindObjects])
+	assert.True(t, functions[CallOpenSession])
+	assert.True(t, functions[CallPoolWait])
+}
+
+func TestCallTimingsDisabled(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		assert.Nil(t, ctx.CallTimings())
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// tokenTimeLayout is the layout of the first 14 characters of CK_TOKEN_INFO utcTime. The remaining two characters
+// are reserved and ignored.
+const tokenTimeLayout = "20060102150405"
+
+// TokenTime returns the current time according to the token clock. The boolean result is false if the token has
+// no clock (CKF_CLOCK_ON_TOKEN is not set) or reports a time that cannot be parsed.
+func (c *Context) TokenTime() (time.Time, bool, error) {
+	if c.closed.Get() {
+		return time.Time{}, false, errClosed
+	}
+
+	info, err := c.ctx.GetTokenInfo(c.slot)
+	if err != nil {
+		return time.Time{}, false, withMessage(err, "failed to read token info")
+	}
+	if info.Flags&pkcs11.CKF_CLOCK_ON_TOKEN == 0 {
+		return time.Time{}, false, nil
+	}
+
+	t, ok := parseTokenTime(info.UTCTime)
+	return t, ok, nil
+}
+
+// ClockDrift returns how far the token clock is ahead of the host clock; a negative value means the token clock is
+// behind. The boolean result is false if the token has no usable clock, see TokenTime.
+func (c *Context) ClockDrift() (time.Duration, bool, error) {
+	tokenTime, ok, err := c.TokenTime()
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	return tokenTime.Sub(time.Now()), true, nil
+}
+
+// referenceTime returns the time used for validity-sensitive operations. This is the token clock if
+// Config.UseTokenClock is set and the token has a usable clock, and the host clock otherwise.
+func (c *Context) referenceTime() time.Time {
+	if c.cfg.UseTokenClock {
+		if t, ok, err := c.TokenTime(); err == nil && ok {
+			return t
+		}
+	}
+	return time.Now().UTC()
+}
+
+// parseTokenTime parses a CK_TOKEN_INFO utcTime value, nominally "YYYYMMDDhhmmss00". Tokens are inconsistent about
+// padding and the reserved characters, so only the first 14 characters are used, and anything that is not a plausible
+// UTC time is rejected.
+func parseTokenTime(s string) (time.Time, bool) {
+	s = strings.TrimRight(s, " \x00")
+	if len(s) < len(tokenTimeLayout) || len(s) > 16 {
+		return time.Time{}, false
+	}
+	digits := s[:len(tokenTimeLayout)]
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return time.Time{}, false
+		}
+	}
+
+	t, err := time.ParseInLocation(tokenTimeLayout, digits, time.UTC)
+	if err != nil || t.Year() < 1970 {
+		return time.Time{}, false
+	}
+	return t, true
+}
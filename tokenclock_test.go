@@ -0,0 +1,63 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTokenTime(t *testing.T) {
+	expected := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	for _, s := range []string{"2021030405060700", "20210304050607", "20210304050607  ", "20210304050607\x00\x00"} {
+		parsed, ok := parseTokenTime(s)
+		require.True(t, ok, "%q", s)
+		assert.True(t, expected.Equal(parsed), "%q", s)
+	}
+
+	for _, s := range []string{"", "                ", "2021-03-04 05:06", "2021130405060700", "202103040506", "00000000000000", "20210304050607000"} {
+		_, ok := parseTokenTime(s)
+		assert.False(t, ok, "%q", s)
+	}
+}
+
+func TestTokenTime(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		tokenTime, ok, err := ctx.TokenTime()
+		require.NoError(t, err)
+
+		drift, driftOK, err := ctx.ClockDrift()
+		require.NoError(t, err)
+		assert.Equal(t, ok, driftOK)
+
+		if !ok {
+			t.Skip("token has no clock")
+		}
+		assert.False(t, tokenTime.IsZero())
+		assert.Equal(t, time.UTC, tokenTime.Location())
+		assert.True(t, drift > -24*time.Hour && drift < 24*time.Hour)
+	})
+}
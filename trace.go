@@ -0,0 +1,71 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"context"
+	"errors"
+)
+
+// traceIDKey is the context key for trace IDs. It has no fields, so using it as a key does not allocate.
+type traceIDKey struct{}
+
+// WithTraceID returns a copy of ctx carrying a trace ID. Operations given the returned context, such as
+// PreloadKeys, annotate their errors with the trace ID using a *TraceError and report it in the SessionEvent raised
+// when a failed operation causes its session to be recycled.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceIDFromContext returns the trace ID attached to ctx by WithTraceID, if any.
+func TraceIDFromContext(ctx context.Context) (string, bool) {
+	traceID, ok := ctx.Value(traceIDKey{}).(string)
+	return traceID, ok
+}
+
+// TraceError annotates an error returned by an operation with the trace ID of its context. Use errors.As to
+// retrieve the trace ID; errors.Is and errors.As see the underlying error as usual.
+type TraceError struct {
+	TraceID string
+	Err     error
+}
+
+func (e *TraceError) Error() string {
+	return "trace " + e.TraceID + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *TraceError) Unwrap() error {
+	return e.Err
+}
+
+// withTraceID annotates err with traceID, unless err is nil, traceID is empty or err already carries a trace ID.
+func withTraceID(err error, traceID string) error {
+	if err == nil || traceID == "" {
+		return err
+	}
+	var traced *TraceError
+	if errors.As(err, &traced) {
+		return err
+	}
+	return &TraceError{TraceID: traceID, Err: err}
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceIDFromContext(t *testing.T) {
+	_, ok := TraceIDFromContext(context.Background())
+	assert.False(t, ok)
+
+	traceID, ok := TraceIDFromContext(WithTraceID(context.Background(), "abc123"))
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", traceID)
+
+	ctx := context.WithValue(context.Background(), struct{ name string }{"other"}, "value")
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = TraceIDFromContext(ctx)
+		_ = withTraceID(nil, "")
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func TestWithTraceID(t *testing.T) {
+	assert.NoError(t, withTraceID(nil, "abc123"))
+	assert.Equal(t, errInjected, withTraceID(errInjected, ""))
+
+	err := withTraceID(errInjected, "abc123")
+	assert.EqualError(t, err, "trace abc123: injected fault")
+	assert.True(t, errors.Is(err, errInjected))
+
+	var traced *TraceError
+	require.True(t, errors.As(err, &traced))
+	assert.Equal(t, "abc123", traced.TraceID)
+
+	// An error is only annotated once, by the innermost operation.
+	assert.Equal(t, err, withTraceID(withMessage(err, "outer"), "other").(interface{ Unwrap() error }).Unwrap())
+}
+
+func TestTraceIDPropagation(t *testing.T) {
+	config, err := loadConfigFromFile("config")
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	var recycled []string
+	config.SessionEventFunc = func(event SessionEvent) {
+		if event.Type == SessionRecycled {
+			mutex.Lock()
+			recycled = append(recycled, event.TraceID)
+			mutex.Unlock()
+		}
+	}
+
+	ctx, err := Configure(config)
+	require.NoError(t, err)
+
+	traced := WithTraceID(context.Background(), "abc123")
+	failure := pkcs11.Error(pkcs11.CKR_SESSION_CLOSED)
+
+	// A retry after its session was recycled carries the same trace ID.
+	for i := 0; i < 2; i++ {
+		err = ctx.withSessionContext(traced, func(session *pkcs11Session) error { return failure })
+		assert.EqualError(t, err, "trace abc123: "+failure.Error())
+		assert.True(t, isPKCS11Error(err, pkcs11.CKR_SESSION_CLOSED))
+	}
+
+	err = ctx.withSessionContext(context.Background(), func(session *pkcs11Session) error { return failure })
+	assert.Equal(t, failure, err)
+
+	cancelled, cancel := context.WithCancel(traced)
+	cancel()
+	_, err = ctx.PreloadKeys(cancelled, nil, 1)
+	var traceErr *TraceError
+	require.True(t, errors.As(err, &traceErr), "unexpected error: %v", err)
+	assert.Equal(t, "abc123", traceErr.TraceID)
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	// Close waits for queued events to be delivered
+	require.NoError(t, ctx.Close())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"abc123", "abc123", ""}, recycled)
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+/*
+#include <stdlib.h>
+
+// ckRSAPKCSOAEPParams is CK_RSA_PKCS_OAEP_PARAMS and ckRSAAESKeyWrapParams is CK_RSA_AES_KEY_WRAP_PARAMS, laid out
+// as described for ckHKDFParams.
+#ifdef _WIN32
+#pragma pack(push, 1)
+#endif
+typedef struct {
+	unsigned long hashAlg;
+	unsigned long mgf;
+	unsigned long source;
+	void *pSourceData;
+	unsigned long ulSourceDataLen;
+} ckRSAPKCSOAEPParams;
+
+typedef struct {
+	unsigned long ulAESKeyBits;
+	ckRSAPKCSOAEPParams *pOAEPParams;
+} ckRSAAESKeyWrapParams;
+#ifdef _WIN32
+#pragma pack(pop)
+#endif
+*/
+import "C"
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// rsaAESTransportKeyBits is the ulAESKeyBits passed to CKM_RSA_AES_KEY_WRAP. When unwrapping, the transport key
+// length follows from the wrapped key, but the field must still hold a valid AES key length.
+const rsaAESTransportKeyBits = 256
+
+// errUnsupportedUnwrapMechanism is returned by UnwrapPrivateKey for mechanisms other than CKM_RSA_AES_KEY_WRAP and
+// CKM_RSA_PKCS_OAEP.
+var errUnsupportedUnwrapMechanism = errors.New("unsupported private key unwrapping mechanism")
+
+// UnwrapPrivateKey unwraps a PKCS#8 private key blob, wrapped under the public half of the RSA key pair wrappingKey,
+// into the token and returns the resulting key pair.
+//
+// mech is either CKM_RSA_AES_KEY_WRAP, for a blob holding an RSA-OAEP wrapped AES key followed by the private key
+// wrapped with that AES key using CKM_AES_KEY_WRAP_PAD, or CKM_RSA_PKCS_OAEP, for a private key wrapped directly
+// with RSA-OAEP. oaep selects the OAEP hash and label; if nil, SHA-1 and an empty label are used.
+//
+// CKM_RSA_AES_KEY_WRAP blobs are unwrapped in a single operation if the token supports unwrapping with
+// CKM_RSA_AES_KEY_WRAP. Otherwise they are unwrapped in two steps, with the same result: the AES key is unwrapped
+// into a temporary session object with CKM_RSA_PKCS_OAEP, and the private key is unwrapped under it with
+// CKM_AES_KEY_WRAP_PAD.
+//
+// The template must give the CKA_KEY_TYPE and a non-empty CKA_ID of the private key, and any usage attributes
+// such as CKA_SIGN. CKA_CLASS is set to CKO_PRIVATE_KEY and CKA_TOKEN defaults to true. RSA public keys are read
+// from the unwrapped key; for other key types a public key object or certificate with the same CKA_ID must already
+// be on the token, for instance imported with ImportCertificate. If no public key can be found, the unwrapped
+// private key is left on the token and an error is returned.
+func (c *Context) UnwrapPrivateKey(wrappingKey Signer, wrapped []byte, mech uint, oaep *rsa.OAEPOptions,
+	template AttributeSet) (Signer, error) {
+
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
+	unwrapper, ok := wrappingKey.(*pkcs11PrivateKeyRSA)
+	if !ok || unwrapper.context != c {
+		return nil, errors.New("wrapping key must be an RSA key pair belonging to this context")
+	}
+	if err := unwrapper.checkUsage("unwrapping", pkcs11.CKA_UNWRAP, pkcs11.CKM_RSA_PKCS_OAEP); err != nil {
+		return nil, err
+	}
+
+	if mech != pkcs11.CKM_RSA_PKCS_OAEP && mech != pkcs11.CKM_RSA_AES_KEY_WRAP {
+		return nil, errUnsupportedUnwrapMechanism
+	}
+
+	// Without a CKA_ID, the public half cannot be found and the unwrapped key could not be found again.
+	if id, ok := template[CkaId]; !ok || len(id.Value) == 0 {
+		return nil, errors.New("template must set a non-empty CKA_ID")
+	}
+
+	// Read before a session is taken, since Public may need one of its own, see Config.ReleasePublicKeys.
+	var wrappingPub *rsa.PublicKey
+	if mech == pkcs11.CKM_RSA_AES_KEY_WRAP {
+		if wrappingPub, ok = unwrapper.Public().(*rsa.PublicKey); !ok {
+			return nil, errors.New("cannot read public half of wrapping key")
+		}
+		if len(wrapped) <= wrappingPub.Size() {
+			return nil, errors.New("wrapped key is too short")
+		}
+	}
+
+	if oaep == nil {
+		oaep = &rsa.OAEPOptions{Hash: crypto.SHA1}
+	}
+	params, err := oaepParams(oaep)
+	if err != nil {
+		return nil, err
+	}
+	oaepMech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}
+
+	template = template.Copy()
+	if err = template.Set(CkaClass, pkcs11.CKO_PRIVATE_KEY); err != nil {
+		return nil, err
+	}
+	template.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+	})
+
+	var signer Signer
+	err = c.withSession(func(session *pkcs11Session) error {
+		var handle pkcs11.ObjectHandle
+
+		switch mech {
+		case pkcs11.CKM_RSA_PKCS_OAEP:
+			handle, err = session.ctx.UnwrapKey(session.handle, oaepMech, unwrapper.handle, wrapped, template.ToSlice())
+			if err != nil {
+				return withMessage(err, "unwrapping private key")
+			}
+
+		case pkcs11.CKM_RSA_AES_KEY_WRAP:
+			if c.mechanismHasFlag(pkcs11.CKM_RSA_AES_KEY_WRAP, pkcs11.CKF_UNWRAP) {
+				handle, err = unwrapRSAAESKeyWrap(session, params, unwrapper.handle, wrapped, template)
+			} else if c.mechanismHasFlag(pkcs11.CKM_AES_KEY_WRAP_PAD, pkcs11.CKF_UNWRAP) {
+				handle, err = unwrapRSAAES(session, oaepMech, unwrapper.handle, wrapped[:wrappingPub.Size()],
+					wrapped[wrappingPub.Size():], template)
+			} else {
+				err = errors.New("token does not support unwrapping with CKM_AES_KEY_WRAP_PAD")
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		signer, _, err = c.makeKeyPair(session, &handle)
+		return withMessage(err, "loading unwrapped key")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// unwrapRSAAESKeyWrap unwraps wrapped in a single CKM_RSA_AES_KEY_WRAP operation with the RSA key unwrapper.
+func unwrapRSAAESKeyWrap(session *pkcs11Session, oaep *pkcs11.OAEPParams, unwrapper pkcs11.ObjectHandle,
+	wrapped []byte, template AttributeSet) (pkcs11.ObjectHandle, error) {
+
+	params, free := rsaAESKeyWrapParams(oaep)
+	defer free()
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_AES_KEY_WRAP, params)}
+	handle, err := session.ctx.UnwrapKey(session.handle, mech, unwrapper, wrapped, template.ToSlice())
+	return handle, withMessage(err, "unwrapping private key")
+}
+
+// unwrapRSAAES unwraps wrappedAES into a temporary AES key using the RSA key unwrapper, then unwraps wrappedKey
+// under it with CKM_AES_KEY_WRAP_PAD. The temporary key is destroyed before returning.
+func unwrapRSAAES(session *pkcs11Session, oaepMech []*pkcs11.Mechanism, unwrapper pkcs11.ObjectHandle,
+	wrappedAES, wrappedKey []byte, template AttributeSet) (handle pkcs11.ObjectHandle, err error) {
+
+	transportTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	}
+	transport, err := session.ctx.UnwrapKey(session.handle, oaepMech, unwrapper, wrappedAES, transportTemplate)
+	if err != nil {
+		return 0, withMessage(err, "unwrapping AES transport key")
+	}
+	session.trackObject(transport, "AES transport key")
+	defer func() {
+		destroyErr := session.destroyObject(transport)
+		if err == nil {
+			err = withMessage(destroyErr, "destroying AES transport key")
+		}
+	}()
+
+	kwpMech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)}
+	handle, err = session.ctx.UnwrapKey(session.handle, kwpMech, transport, wrappedKey, template.ToSlice())
+	return handle, withMessage(err, "unwrapping private key")
+}
+
+// rsaAESKeyWrapParams marshals a CK_RSA_AES_KEY_WRAP_PARAMS structure for the given OAEP parameters. The structure
+// points to the OAEP parameters, which in turn point to the label, so both are copied into C memory, which must be
+// released by calling the returned function once the mechanism has been used.
+func rsaAESKeyWrapParams(oaep *pkcs11.OAEPParams) (params []byte, free func()) {
+	pOAEP := (*C.ckRSAPKCSOAEPParams)(C.calloc(1, C.size_t(unsafe.Sizeof(C.ckRSAPKCSOAEPParams{}))))
+	pOAEP.hashAlg = C.ulong(oaep.HashAlg)
+	pOAEP.mgf = C.ulong(oaep.MGF)
+	pOAEP.source = C.ulong(oaep.SourceType)
+	if len(oaep.SourceData) > 0 {
+		pOAEP.pSourceData = C.CBytes(oaep.SourceData)
+		pOAEP.ulSourceDataLen = C.ulong(len(oaep.SourceData))
+	}
+
+	p := C.ckRSAAESKeyWrapParams{
+		ulAESKeyBits: rsaAESTransportKeyBits,
+		pOAEPParams:  pOAEP,
+	}
+	return C.GoBytes(unsafe.Pointer(&p), C.int(unsafe.Sizeof(p))), func() {
+		C.free(pOAEP.pSourceData)
+		C.free(unsafe.Pointer(pOAEP))
+	}
+}
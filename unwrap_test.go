@@ -0,0 +1,204 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// aesKeyWrapPad implements RFC 5649 AES key wrap with padding in software, to create test blobs.
+func aesKeyWrapPad(t *testing.T, kek, plaintext []byte) []byte {
+	block, err := aes.NewCipher(kek)
+	require.NoError(t, err)
+
+	aiv := make([]byte, 8)
+	copy(aiv, []byte{0xa6, 0x59, 0x59, 0xa6})
+	binary.BigEndian.PutUint32(aiv[4:], uint32(len(plaintext)))
+
+	padded := make([]byte, (len(plaintext)+7)/8*8)
+	copy(padded, plaintext)
+
+	if len(padded) == 8 {
+		out := make([]byte, 16)
+		block.Encrypt(out, append(aiv, padded...))
+		return out
+	}
+
+	n := len(padded) / 8
+	a := aiv
+	r := padded
+	b := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(b, a)
+			copy(b[8:], r[i*8:(i+1)*8])
+			block.Encrypt(b, b)
+			tv := binary.BigEndian.Uint64(b[:8]) ^ uint64(n*j+i+1)
+			a = make([]byte, 8)
+			binary.BigEndian.PutUint64(a, tv)
+			copy(r[i*8:], b[8:])
+		}
+	}
+	return append(a, r...)
+}
+
+func TestAESKeyWrapPadVectors(t *testing.T) {
+	// RFC 5649 section 6
+	kek, _ := hex.DecodeString("5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+
+	key, _ := hex.DecodeString("c37b7e6492584340bed12207808941155068f738")
+	assert.Equal(t, "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a",
+		hex.EncodeToString(aesKeyWrapPad(t, kek, key)))
+
+	key, _ = hex.DecodeString("466f7250617369")
+	assert.Equal(t, "afbeb0f07dfbf5419200f2ccb50bb24f", hex.EncodeToString(aesKeyWrapPad(t, kek, key)))
+}
+
+func TestUnwrapPrivateKey(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_RSA_PKCS_OAEP)
+		skipIfMechUnsupported(t, ctx, pkcs11.CKM_AES_KEY_WRAP_PAD)
+
+		public, err := NewAttributeSetWithID(randomBytes())
+		require.NoError(t, err)
+		private := public.Copy()
+		require.NoError(t, private.Set(CkaUnwrap, true))
+		wrappingKey, err := ctx.GenerateRSAKeyPairWithAttributes(public, private, rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = wrappingKey.Delete() }()
+		wrappingPub := wrappingKey.Public().(*rsa.PublicKey)
+
+		// The key to transport, with a certificate so the token can provide its public half
+		soft, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(soft)
+		require.NoError(t, err)
+
+		aesKey := make([]byte, 32)
+		_, err = rand.Read(aesKey)
+		require.NoError(t, err)
+		wrappedAES, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, wrappingPub, aesKey, nil)
+		require.NoError(t, err)
+		wrapped := append(wrappedAES, aesKeyWrapPad(t, aesKey, pkcs8)...)
+
+		id := randomBytes()
+		require.NoError(t, ctx.ImportCertificate(id, generateCertForSigner(t, soft, id)))
+		defer func() { _ = ctx.DeleteCertificate(id, nil, nil) }()
+
+		template, err := NewAttributeSetWithID(id)
+		require.NoError(t, err)
+		require.NoError(t, template.Set(CkaKeyType, pkcs11.CKK_EC))
+		require.NoError(t, template.Set(CkaSign, true))
+		require.NoError(t, template.Set(CkaSensitive, true))
+
+		key, err := ctx.UnwrapPrivateKey(wrappingKey, wrapped, pkcs11.CKM_RSA_AES_KEY_WRAP, nil, template)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		assert.True(t, publicKeysEqual(&soft.PublicKey, key.Public()))
+		testEcdsaSigning(t, key, crypto.SHA256, "P-256", "SHA-256")
+	})
+}
+
+func TestUnwrapPrivateKeyErrors(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		_, err = ctx.UnwrapPrivateKey(key, []byte{1}, pkcs11.CKM_RSA_AES_KEY_WRAP, nil, NewAttributeSet())
+		assert.Error(t, err)
+
+		rsaKey, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = rsaKey.Delete() }()
+
+		_, err = ctx.UnwrapPrivateKey(rsaKey, []byte{1}, pkcs11.CKM_AES_KEY_WRAP_PAD, nil, NewAttributeSet())
+		assert.Equal(t, errUnsupportedUnwrapMechanism, err)
+
+		_, err = ctx.UnwrapPrivateKey(rsaKey, []byte{1}, pkcs11.CKM_RSA_AES_KEY_WRAP, nil, NewAttributeSet())
+		assert.Contains(t, err.Error(), "CKA_ID")
+
+		template, err := NewAttributeSetWithID([]byte{})
+		require.NoError(t, err)
+		_, err = ctx.UnwrapPrivateKey(rsaKey, []byte{1}, pkcs11.CKM_RSA_AES_KEY_WRAP, nil, template)
+		assert.Contains(t, err.Error(), "CKA_ID")
+
+		template, err = NewAttributeSetWithID(randomBytes())
+		require.NoError(t, err)
+		_, err = ctx.UnwrapPrivateKey(rsaKey, []byte{1}, pkcs11.CKM_RSA_AES_KEY_WRAP, nil, template)
+		assert.Contains(t, err.Error(), "too short")
+	})
+}
+
+func TestRSAAESKeyWrapParamsLayout(t *testing.T) {
+	ulong := len(ulongToBytes(0))
+	pointer := int(unsafe.Sizeof(uintptr(0)))
+	align := func(offset, size int) int {
+		if runtime.GOOS == "windows" {
+			// Cryptoki structures are packed on Windows
+			return offset
+		}
+		return (offset + size - 1) / size * size
+	}
+
+	// Offsets of the CK_RSA_AES_KEY_WRAP_PARAMS and CK_RSA_PKCS_OAEP_PARAMS fields
+	pOAEPParams := align(ulong, pointer)
+	pSourceData := align(3*ulong, pointer)
+	ulSourceDataLen := pSourceData + pointer
+	oaepSize := align(ulSourceDataLen+ulong, pointer)
+
+	label := []byte("label")
+	params, free := rsaAESKeyWrapParams(pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256,
+		pkcs11.CKZ_DATA_SPECIFIED, label))
+	defer free()
+
+	require.Len(t, params, pOAEPParams+pointer)
+	assert.Equal(t, uint(rsaAESTransportKeyBits), bytesToUlong(params[:ulong]))
+
+	pOAEP := *(*unsafe.Pointer)(unsafe.Pointer(&params[pOAEPParams]))
+	require.NotNil(t, pOAEP)
+	oaep := (*[1 << 10]byte)(pOAEP)[:oaepSize:oaepSize]
+	assert.Equal(t, uint(pkcs11.CKM_SHA256), bytesToUlong(oaep[:ulong]))
+	assert.Equal(t, uint(pkcs11.CKG_MGF1_SHA256), bytesToUlong(oaep[ulong:2*ulong]))
+	assert.Equal(t, uint(pkcs11.CKZ_DATA_SPECIFIED), bytesToUlong(oaep[2*ulong:3*ulong]))
+	assert.Equal(t, uint(len(label)), bytesToUlong(oaep[ulSourceDataLen:ulSourceDataLen+ulong]))
+
+	pLabel := *(*unsafe.Pointer)(unsafe.Pointer(&oaep[pSourceData]))
+	assert.Equal(t, label, (*[1 << 10]byte)(pLabel)[:len(label):len(label)])
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// VendorUtimaco is the VendorProfile for Utimaco CryptoServer tokens, which assign keys to key groups. Objects
+// outside the key group the session is authorized for are not visible to C_FindObjects. The session is authorized for
+// a key group by logging in as the group's user, so with this profile Config.UserType is passed to C_Login unchanged
+// and may be a vendor-defined user type.
+const VendorUtimaco = "utimaco"
+
+// VendorZeroizeDataObjects is the VendorProfile for tokens whose erasure policy requires the CKA_VALUE of a data
+// object to be overwritten with zeros before the object is destroyed. ShredObject does so, and counts the objects in
+// ShredResult.Zeroized.
+const VendorZeroizeDataObjects = "zeroize-data-objects"
+
+// VendorAssuredDestroy is the VendorProfile for tokens whose vendor documents C_DestroyObject as an assured erasure
+// of the key material. ShredObject reports ShredVendorAssured once it has verified that an object is gone.
+const VendorAssuredDestroy = "assured-destroy"
+
+// ErrKeyNotFound is wrapped by the errors reporting that a key or other object could not be found. On tokens whose
+// VendorProfile may hide objects from the session, the Find functions return an error wrapping ErrKeyNotFound, with a
+// hint about key group authorization, instead of a nil result when nothing matches.
+var ErrKeyNotFound = errors.New("key not found")
+
+// vendorProfile describes vendor-specific token behaviour.
+type vendorProfile struct {
+	// keyGroups is true if objects may be hidden from sessions not authorized for their key group.
+	keyGroups bool
+
+	// vendorUserTypes is true if a Config.UserType other than CKU_USER is passed to C_Login unchanged, rather than
+	// selecting CryptoUser.
+	vendorUserTypes bool
+
+	// zeroizeDataObjects is true if data objects must have CKA_VALUE overwritten with zeros before destruction for
+	// it to count as erasure, see ShredObject.
+	zeroizeDataObjects bool
+
+	// assuredDestroy is true if the vendor documents C_DestroyObject as erasing the key material, see ShredObject.
+	assuredDestroy bool
+}
+
+var vendorProfiles = map[string]vendorProfile{
+	"":            {},
+	VendorUtimaco: {keyGroups: true, vendorUserTypes: true},
+
+	VendorZeroizeDataObjects: {zeroizeDataObjects: true},
+	VendorAssuredDestroy:     {assuredDestroy: true},
+}
+
+// keyGroupHint is appended to not-found errors on tokens that use key groups.
+const keyGroupHint = "; the token uses key groups and objects outside the group the session is " +
+	"authorized for are not visible, check the configured UserType and Pin grant access to the key's group"
+
+// lookupVendorProfile returns the named profile.
+func lookupVendorProfile(name string) (vendorProfile, error) {
+	profile, ok := vendorProfiles[name]
+	if !ok {
+		return vendorProfile{}, fmt.Errorf("unknown vendor profile %q", name)
+	}
+	return profile, nil
+}
+
+// loginUserType returns the user type passed to C_Login for the configured Config.UserType.
+func (c *Context) loginUserType() uint {
+	switch {
+	case c.cfg.UserType == pkcs11.CKU_USER:
+		return pkcs11.CKU_USER
+	case c.profile.vendorUserTypes:
+		return uint(c.cfg.UserType)
+	default:
+		return CryptoUser
+	}
+}
+
+// objectNotFoundError reports that an object could not be found. It matches ErrKeyNotFound with errors.Is.
+type objectNotFoundError struct {
+	message string
+}
+
+func (e *objectNotFoundError) Error() string {
+	return e.message
+}
+
+// Is reports whether target is ErrKeyNotFound.
+func (e *objectNotFoundError) Is(target error) bool {
+	return target == ErrKeyNotFound
+}
+
+// notFoundError returns an error reporting that an object could not be found. If the token may hide objects from
+// the session, the error says so.
+func (c *Context) notFoundError(format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	if c.profile.keyGroups {
+		message += keyGroupHint
+	}
+	return &objectNotFoundError{message: message}
+}
+
+// missingKeyError returns the error a Find function reports when no key matches: nil, so that the function returns a
+// nil result, unless the token may hide keys from the session.
+func (c *Context) missingKeyError() error {
+	if !c.profile.keyGroups {
+		return nil
+	}
+	return c.notFoundError("no matching key found")
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownVendorProfile(t *testing.T) {
+	_, err := Configure(&Config{TokenLabel: "token", VendorProfile: "no such vendor"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown vendor profile")
+}
+
+func TestNotFoundErrorHint(t *testing.T) {
+	plain := &Context{}
+	err := plain.notFoundError("key %q not found", "k")
+	assert.Equal(t, `key "k" not found`, err.Error())
+	assert.True(t, errors.Is(err, ErrKeyNotFound))
+
+	profile, err := lookupVendorProfile(VendorUtimaco)
+	require.NoError(t, err)
+
+	grouped := &Context{profile: profile}
+	err = grouped.notFoundError("key %q not found", "k")
+	assert.True(t, strings.HasPrefix(err.Error(), `key "k" not found`))
+	assert.Contains(t, err.Error(), "key groups")
+}
+
+func TestFindWithKeyGroupProfile(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+
+		key, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		assert.Nil(t, key)
+
+		ctx.profile = vendorProfile{keyGroups: true}
+		defer func() { ctx.profile = vendorProfile{} }()
+
+		key, err = ctx.FindKeyPair(id, nil)
+		assert.True(t, errors.Is(err, ErrKeyNotFound))
+		assert.Contains(t, err.Error(), "key groups")
+		assert.Nil(t, key)
+
+		secret, err := ctx.FindKey(id, nil)
+		assert.True(t, errors.Is(err, ErrKeyNotFound))
+		assert.Nil(t, secret)
+
+		attributes := NewAttributeSet()
+		require.NoError(t, attributes.Set(CkaId, id))
+		secrets, err := ctx.FindKeysWithAttributes(attributes)
+		assert.True(t, errors.Is(err, ErrKeyNotFound))
+		assert.Empty(t, secrets)
+
+		generated, err := ctx.GenerateSecretKey(id, 128, CipherAES)
+		require.NoError(t, err)
+		defer func() { _ = generated.Delete() }()
+
+		secret, err = ctx.FindKey(id, nil)
+		require.NoError(t, err)
+		assert.NotNil(t, secret)
+	})
+}
+
+func TestLoginUserType(t *testing.T) {
+	const groupUser = 0x83
+
+	plain := &Context{cfg: &Config{UserType: DefaultUserType}}
+	assert.Equal(t, uint(pkcs11.CKU_USER), plain.loginUserType())
+	plain.cfg.UserType = groupUser
+	assert.Equal(t, uint(CryptoUser), plain.loginUserType())
+
+	profile, err := lookupVendorProfile(VendorUtimaco)
+	require.NoError(t, err)
+
+	grouped := &Context{cfg: &Config{UserType: groupUser}, profile: profile}
+	assert.Equal(t, uint(groupUser), grouped.loginUserType())
+}
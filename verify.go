@@ -0,0 +1,94 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+
+	"github.com/miekg/pkcs11"
+)
+
+// errNoPublicKeyObject is returned when a key pair operation needs the public key object, but the key pair was
+// loaded without one.
+var errNoPublicKeyObject = errors.New("key pair has no public key object on the token")
+
+// VerifyPKCS1v15 checks an RSA PKCS#1 v1.5 signature over digest, which is the hash of the message made with hash,
+// on the token with the public key object of the key pair, so that the signature is never checked in software.
+//
+// If the signature is invalid, the returned error wraps ErrSignatureInvalid. Any other error means the
+// signature could not be checked.
+func (priv *pkcs11PrivateKeyRSA) VerifyPKCS1v15(hash crypto.Hash, digest, signature []byte) error {
+	return priv.verify(priv.Public(), digest, signature, hash)
+}
+
+// VerifyPSS checks an RSA-PSS signature over digest, which is the hash of the message made with hash, on the token
+// with the public key object of the key pair. opts may be nil, which is equivalent to rsa.PSSSaltLengthAuto; as
+// for PublicKey.Verify, the token cannot detect the salt length, so the longest salt the modulus allows is expected.
+// opts.Hash is ignored in favour of hash.
+//
+// If the signature is invalid, the returned error wraps ErrSignatureInvalid. Any other error means the
+// signature could not be checked.
+func (priv *pkcs11PrivateKeyRSA) VerifyPSS(hash crypto.Hash, digest, signature []byte,
+	opts *rsa.PSSOptions) error {
+
+	pssOpts := rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}
+	if opts != nil {
+		pssOpts = *opts
+	}
+	pssOpts.Hash = hash
+	return priv.verify(priv.Public(), digest, signature, &pssOpts)
+}
+
+// VerifyECDSA checks a DER-encoded ECDSA signature over digest on the token with the public key object of the key
+// pair. Signatures that are not minimal DER, or whose components are out of range, are reported as invalid.
+//
+// If the signature is invalid, the returned error wraps ErrSignatureInvalid. Any other error means the
+// signature could not be checked.
+func (signer *pkcs11PrivateKeyECDSA) VerifyECDSA(digest, signature []byte) error {
+	return signer.verify(signer.Public(), digest, signature, nil)
+}
+
+// verify checks signature over digest on the token with the public key object of the key pair, as PublicKey.Verify,
+// returning an error wrapping ErrSignatureInvalid if the signature is malformed or the token reports it invalid.
+func (k *pkcs11PrivateKey) verify(pub crypto.PublicKey, digest, signature []byte, opts crypto.SignerOpts) error {
+	mech, digest, signature, err := verifyMechanism(pub, 0, digest, signature, opts)
+	if errors.Is(err, ErrInvalidECDSASignature) {
+		return &signatureInvalidError{err}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = k.withSession(func(session *pkcs11Session) error {
+		// Read the handle in the session, in case the key pair was re-pinned after Resume.
+		if k.pubKeyHandle == 0 {
+			return errNoPublicKeyObject
+		}
+		return verifyOnToken(session, k.pubKeyHandle, mech, digest, signature)
+	})
+	if isPKCS11Error(err, pkcs11.CKR_SIGNATURE_INVALID, pkcs11.CKR_SIGNATURE_LEN_RANGE) {
+		return &signatureInvalidError{err}
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRsaVerifyOnToken(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		verifier := key.(RSAVerifier)
+
+		digest := sha256.Sum256([]byte("verified inside the HSM boundary"))
+		otherDigest := sha256.Sum256([]byte("something else"))
+
+		t.Run("PKCS1v15", func(t *testing.T) {
+			signature, err := key.Sign(nil, digest[:], crypto.SHA256)
+			require.NoError(t, err)
+
+			assert.NoError(t, verifier.VerifyPKCS1v15(crypto.SHA256, digest[:], signature))
+
+			corrupted := append([]byte{}, signature...)
+			corrupted[len(corrupted)/2] ^= 1
+			err = verifier.VerifyPKCS1v15(crypto.SHA256, digest[:], corrupted)
+			assert.True(t, errors.Is(err, ErrSignatureInvalid), "%v", err)
+
+			err = verifier.VerifyPKCS1v15(crypto.Hash(99), digest[:], signature)
+			assert.Error(t, err)
+			assert.False(t, errors.Is(err, ErrSignatureInvalid), "%v", err)
+		})
+
+		t.Run("PSS", func(t *testing.T) {
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			signature, err := key.Sign(nil, digest[:], opts)
+			require.NoError(t, err)
+
+			assert.NoError(t, verifier.VerifyPSS(crypto.SHA256, digest[:], signature, opts))
+
+			err = verifier.VerifyPSS(crypto.SHA256, otherDigest[:], signature, opts)
+			assert.True(t, errors.Is(err, ErrSignatureInvalid), "%v", err)
+		})
+	})
+}
+
+func TestEcdsaVerifyOnToken(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P256())
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+		verifier := key.(ECDSAVerifier)
+
+		digest := sha256.Sum256([]byte("verified inside the HSM boundary"))
+		otherDigest := sha256.Sum256([]byte("something else"))
+		signature, err := key.Sign(nil, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+
+		assert.NoError(t, verifier.VerifyECDSA(digest[:], signature))
+
+		err = verifier.VerifyECDSA(otherDigest[:], signature)
+		assert.True(t, errors.Is(err, ErrSignatureInvalid), "%v", err)
+		assert.True(t, isPKCS11Error(err, pkcs11.CKR_SIGNATURE_INVALID), "%v", err)
+
+		// Malformed signatures are invalid, not operational failures.
+		err = verifier.VerifyECDSA(digest[:], signature[:len(signature)-1])
+		assert.True(t, errors.Is(err, ErrSignatureInvalid), "%v", err)
+
+		// Without a public key object the signature cannot be checked, which is not the same as invalid.
+		detached := *key.(*pkcs11PrivateKeyECDSA)
+		detached.pubKeyHandle = 0
+		err = detached.VerifyECDSA(digest[:], signature)
+		assert.Equal(t, errNoPublicKeyObject, err)
+	})
+}
@@ -0,0 +1,184 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/pkcs11"
+)
+
+// keyWarningQueueLength is the number of warnings that may be waiting for delivery to a KeyWarningFunc. Warnings
+// raised while the queue is full are dropped and counted, see Context.DroppedEvents.
+const keyWarningQueueLength = 256
+
+// KeyWarningType identifies the kind of warning reported to a KeyWarningFunc.
+type KeyWarningType int
+
+const (
+	// DualUseKeyGenerated is reported when an RSA key pair is generated permitting both signing and decryption,
+	// because the private key template set neither CKA_SIGN nor CKA_DECRYPT. Use GenerateRSAKeyPairForPurpose to
+	// restrict key usage.
+	DualUseKeyGenerated KeyWarningType = iota
+
+	// SessionObjectReaped is reported when a session object that crypto11 created for its own use outlives the
+	// operation that created it, and is destroyed as its session returns to the pool or discarded with its session.
+	// The warning Description field describes the object, and Err is set if it could not be destroyed.
+	SessionObjectReaped
+
+	// AllowedMechanismsRejected is reported when GenerateRSAKeyPairWithOptions generates a key pair without
+	// CKA_ALLOWED_MECHANISMS, because the token rejected the attribute. The warning identifies the generated key,
+	// and its Err field holds the token's error.
+	AllowedMechanismsRejected
+
+	// RSAExponentAssumed is reported when an RSA key pair is loaded with its public exponent assumed to be 65537,
+	// because CKA_PUBLIC_EXPONENT could not be read. See Config.StrictRSAPublicExponent.
+	RSAExponentAssumed
+)
+
+// KeyWarning describes a key that crypto11 created or used with weaker guarantees than a careful caller would want.
+type KeyWarning struct {
+	// Type identifies the warning.
+	Type KeyWarningType
+
+	// Slot is the slot containing the token.
+	Slot uint
+
+	// Handle is the object handle of the affected key.
+	Handle pkcs11.ObjectHandle
+
+	// ID and Label are the CKA_ID and CKA_LABEL of the affected key, if known.
+	ID, Label []byte
+
+	// Description describes the session object of a SessionObjectReaped warning.
+	Description string
+
+	// Err is the error associated with the warning, if any.
+	Err error
+}
+
+// KeyWarningFunc is called with key warnings. See Config.KeyWarningFunc.
+type KeyWarningFunc func(warning KeyWarning)
+
+// keyWarnings delivers key warnings to a KeyWarningFunc from a dedicated goroutine, in the same way as
+// sessionEvents. A nil *keyWarnings silently discards all warnings.
+type keyWarnings struct {
+	slot   uint
+	queue  chan KeyWarning
+	done   chan struct{}
+	mutex  sync.RWMutex
+	closed bool
+
+	// dropped counts warnings discarded because the queue was full. Accessed with sync/atomic.
+	dropped uint64
+}
+
+// newKeyWarnings starts delivering warnings to f. If f is nil, nil is returned.
+func newKeyWarnings(f KeyWarningFunc) *keyWarnings {
+	if f == nil {
+		return nil
+	}
+
+	w := &keyWarnings{
+		queue: make(chan KeyWarning, keyWarningQueueLength),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+		for warning := range w.queue {
+			f(warning)
+		}
+	}()
+
+	return w
+}
+
+// warn queues a warning about the key with the given handle, CKA_ID and CKA_LABEL for delivery.
+func (w *keyWarnings) warn(warningType KeyWarningType, handle pkcs11.ObjectHandle, id, label []byte, err error) {
+	w.deliver(KeyWarning{Type: warningType, Handle: handle, ID: id, Label: label, Err: err})
+}
+
+// warnObject queues a SessionObjectReaped warning for the session object with the given handle and description.
+func (w *keyWarnings) warnObject(handle pkcs11.ObjectHandle, description string, err error) {
+	w.deliver(KeyWarning{Type: SessionObjectReaped, Handle: handle, Description: description, Err: err})
+}
+
+// deliver queues warning for delivery, setting its slot. The warning is dropped and counted if the queue is full.
+func (w *keyWarnings) deliver(warning KeyWarning) {
+	if w == nil {
+		return
+	}
+
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	if w.closed {
+		return
+	}
+
+	warning.Slot = w.slot
+	select {
+	case w.queue <- warning:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// droppedCount returns the number of warnings dropped so far.
+func (w *keyWarnings) droppedCount() uint64 {
+	if w == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// close stops warning delivery, after waiting for queued warnings to be delivered.
+func (w *keyWarnings) close() {
+	if w == nil {
+		return
+	}
+
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+
+	<-w.done
+}
+
+// attributeValue returns the value of attribute t in set, or nil if set does not contain it.
+func attributeValue(set AttributeSet, t AttributeType) []byte {
+	if a, ok := set[t]; ok {
+		return a.Value
+	}
+	return nil
+}
+
+// DroppedEvents returns the number of session events and key warnings discarded so far because the
+// SessionEventFunc or KeyWarningFunc could not keep up with them.
+func (c *Context) DroppedEvents() uint64 {
+	return c.events.droppedCount() + c.warnings.droppedCount()
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyWarningsNil(t *testing.T) {
+	var w *keyWarnings
+	assert.Nil(t, newKeyWarnings(nil))
+
+	// Must not panic
+	w.warn(DualUseKeyGenerated, 1, nil, nil, nil)
+	assert.Zero(t, w.droppedCount())
+	w.close()
+}
+
+func TestKeyWarningsCountDrops(t *testing.T) {
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var received []KeyWarning
+
+	w := newKeyWarnings(func(warning KeyWarning) {
+		<-release
+		mutex.Lock()
+		received = append(received, warning)
+		mutex.Unlock()
+	})
+	w.slot = 7
+
+	failure := errors.New("failure")
+
+	// The consumer is stalled, so warnings beyond the queue length are dropped without blocking, and counted.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*keyWarningQueueLength; i++ {
+			w.warn(DualUseKeyGenerated, pkcs11.ObjectHandle(i), []byte("id"), []byte("label"), failure)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("raising warnings blocked")
+	}
+
+	close(release)
+	w.close()
+
+	require.NotEmpty(t, received)
+	assert.Equal(t, uint64(2*keyWarningQueueLength-len(received)), w.droppedCount())
+	assert.Equal(t, KeyWarning{Type: DualUseKeyGenerated, Slot: 7, Handle: 0, ID: []byte("id"),
+		Label: []byte("label"), Err: failure}, received[0])
+
+	// Warnings after close are ignored
+	w.warn(DualUseKeyGenerated, 1, nil, nil, nil)
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+)
+
+// oidPublicKeyECDSA is the algorithm OID of elliptic curve public keys (RFC 5480).
+var oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+
+// weierstrassCurve implements elliptic.Curve for a prime curve y² = x³ + ax + b that crypto/elliptic does not
+// provide, such as secp256k1, the Brainpool curves and curves given by explicit parameters. The arithmetic of
+// elliptic.CurveParams assumes a = -3, which does not hold for these curves in general, so it cannot be used.
+//
+// The arithmetic uses affine coordinates and is not constant time. crypto11 never gives it private keys: it is used
+// to check and encode public keys read from the token, and to verify signatures in software.
+type weierstrassCurve struct {
+	params *elliptic.CurveParams
+	a      *big.Int
+
+	// oid names the curve in CKA_EC_PARAMS and in SubjectPublicKeyInfo.
+	oid asn1.ObjectIdentifier
+
+	// explicit is the DER-encoded ECParameters that replace oid for a curve without a name, see NewExplicitCurve.
+	explicit []byte
+}
+
+// newWeierstrassCurve returns the named curve with the given parameters, which are hexadecimal.
+func newWeierstrassCurve(name string, oid asn1.ObjectIdentifier, bits int, p, a, b, gx, gy, n string) *weierstrassCurve {
+	hex := func(s string) *big.Int {
+		i, ok := new(big.Int).SetString(s, 16)
+		if !ok {
+			panic("invalid curve parameter for " + name)
+		}
+		return i
+	}
+	return &weierstrassCurve{
+		params: &elliptic.CurveParams{P: hex(p), N: hex(n), B: hex(b), Gx: hex(gx), Gy: hex(gy), BitSize: bits,
+			Name: name},
+		a:   hex(a),
+		oid: oid,
+	}
+}
+
+func (curve *weierstrassCurve) Params() *elliptic.CurveParams {
+	return curve.params
+}
+
+// ecParams returns the CKA_EC_PARAMS value of the curve: its explicit parameters if it has them, and otherwise its
+// OID.
+func (curve *weierstrassCurve) ecParams() ([]byte, error) {
+	if curve.explicit != nil {
+		return curve.explicit, nil
+	}
+	return asn1.Marshal(curve.oid)
+}
+
+// IsOnCurve reports whether (x, y) satisfies y² = x³ + ax + b mod P.
+func (curve *weierstrassCurve) IsOnCurve(x, y *big.Int) bool {
+	p := curve.params.P
+	if x.Sign() < 0 || x.Cmp(p) >= 0 || y.Sign() < 0 || y.Cmp(p) >= 0 {
+		return false
+	}
+	y2 := new(big.Int).Mul(y, y)
+	y2.Mod(y2, p)
+
+	rhs := new(big.Int).Mul(x, x)
+	rhs.Add(rhs, curve.a)
+	rhs.Mul(rhs, x)
+	rhs.Add(rhs, curve.params.B)
+	rhs.Mod(rhs, p)
+
+	return rhs.Cmp(y2) == 0
+}
+
+// Add returns the sum of (x1, y1) and (x2, y2). As for crypto/elliptic, (0, 0) is the point at infinity.
+func (curve *weierstrassCurve) Add(x1, y1, x2, y2 *big.Int) (*big.Int, *big.Int) {
+	if x1.Sign() == 0 && y1.Sign() == 0 {
+		return new(big.Int).Set(x2), new(big.Int).Set(y2)
+	}
+	if x2.Sign() == 0 && y2.Sign() == 0 {
+		return new(big.Int).Set(x1), new(big.Int).Set(y1)
+	}
+	p := curve.params.P
+	if x1.Cmp(x2) == 0 {
+		if y1.Cmp(y2) == 0 {
+			return curve.Double(x1, y1)
+		}
+		return new(big.Int), new(big.Int)
+	}
+
+	// λ = (y2 - y1) / (x2 - x1)
+	lambda := new(big.Int).Sub(x2, x1)
+	lambda.Mod(lambda, p)
+	lambda.ModInverse(lambda, p)
+	lambda.Mul(lambda, new(big.Int).Sub(y2, y1))
+	lambda.Mod(lambda, p)
+	return curve.chord(lambda, x1, y1, x2)
+}
+
+// Double returns 2 * (x1, y1).
+func (curve *weierstrassCurve) Double(x1, y1 *big.Int) (*big.Int, *big.Int) {
+	if y1.Sign() == 0 {
+		return new(big.Int), new(big.Int)
+	}
+	p := curve.params.P
+
+	// λ = (3x² + a) / 2y
+	lambda := new(big.Int).Lsh(y1, 1)
+	lambda.ModInverse(lambda, p)
+	numerator := new(big.Int).Mul(x1, x1)
+	numerator.Mul(numerator, big.NewInt(3))
+	numerator.Add(numerator, curve.a)
+	lambda.Mul(lambda, numerator)
+	lambda.Mod(lambda, p)
+	return curve.chord(lambda, x1, y1, x1)
+}
+
+// chord returns the third point on the line of slope lambda through (x1, y1) and a point with x coordinate x2,
+// reflected in the x axis.
+func (curve *weierstrassCurve) chord(lambda, x1, y1, x2 *big.Int) (*big.Int, *big.Int) {
+	p := curve.params.P
+
+	// x3 = λ² - x1 - x2
+	x3 := new(big.Int).Mul(lambda, lambda)
+	x3.Sub(x3, x1)
+	x3.Sub(x3, x2)
+	x3.Mod(x3, p)
+
+	// y3 = λ(x1 - x3) - y1
+	y3 := new(big.Int).Sub(x1, x3)
+	y3.Mul(y3, lambda)
+	y3.Sub(y3, y1)
+	y3.Mod(y3, p)
+	return x3, y3
+}
+
+// ScalarMult returns k * (x1, y1), where k is a big-endian integer.
+func (curve *weierstrassCurve) ScalarMult(x1, y1 *big.Int, k []byte) (*big.Int, *big.Int) {
+	x, y := new(big.Int), new(big.Int)
+	for _, b := range k {
+		for bit := 7; bit >= 0; bit-- {
+			x, y = curve.Double(x, y)
+			if b>>uint(bit)&1 == 1 {
+				x, y = curve.Add(x, y, x1, y1)
+			}
+		}
+	}
+	return x, y
+}
+
+// ScalarBaseMult returns k * G, where G is the base point and k is a big-endian integer.
+func (curve *weierstrassCurve) ScalarBaseMult(k []byte) (*big.Int, *big.Int) {
+	return curve.ScalarMult(curve.params.Gx, curve.params.Gy, k)
+}
+
+// marshalWeierstrassPublicKey returns the DER-encoded SubjectPublicKeyInfo of a public key on curve, which
+// x509.MarshalPKIXPublicKey refuses as the curve is unknown to it. The encoding is that of RFC 5480 for other named
+// curves, with the specifiedCurve parameters of RFC 3279 for curves given by explicit parameters.
+func marshalWeierstrassPublicKey(pub *ecdsa.PublicKey, curve *weierstrassCurve) ([]byte, error) {
+	params, err := curve.ecParams()
+	if err != nil {
+		return nil, err
+	}
+	point := elliptic.Marshal(curve, pub.X, pub.Y)
+	return asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyECDSA, Parameters: asn1.RawValue{FullBytes: params}},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+}
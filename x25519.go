@@ -0,0 +1,310 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ckkECMontgomery is the PKCS#11 3.0 key type of Montgomery curve keys, which github.com/miekg/pkcs11 does not
+// define. See also ckmECMontgomeryKeyPairGen.
+const ckkECMontgomery = 0x00000041
+
+const (
+	// X25519PublicKeySize is the size, in bytes, of X25519 public keys.
+	X25519PublicKeySize = 32
+
+	// X25519SharedSecretSize is the size, in bytes, of X25519 shared secrets.
+	X25519SharedSecretSize = 32
+)
+
+// X25519PublicKey is an X25519 public key (RFC 7748), the little-endian u-coordinate of a point on Curve25519. It is
+// returned by the Public method of X25519 key pairs.
+type X25519PublicKey []byte
+
+// x25519OID is the DER encoding of the OID of X25519 (RFC 8410), used as CKA_EC_PARAMS for generated keys.
+var x25519OID = mustMarshal(asn1.ObjectIdentifier{1, 3, 101, 110})
+
+// x25519CurveName is the DER encoding of the PrintableString "curve25519", which PKCS#11 3.0 also permits as the
+// CKA_EC_PARAMS of an X25519 key.
+var x25519CurveName = mustMarshal("curve25519")
+
+// ErrSharedSecretNotExtractable is wrapped by the error returned by Derive when the token will only keep the shared
+// secret as a non-extractable object. Use DeriveKey instead, which leaves the secret on the token.
+var ErrSharedSecretNotExtractable = errors.New("shared secret cannot be extracted from the token")
+
+var errX25519CannotSign = errors.New("X25519 keys agree shared secrets and cannot sign")
+
+var errUnsupportedMontgomeryCurve = withMessage(errUnsupportedEllipticCurve, "Montgomery curve is not X25519")
+
+// pkcs11PrivateKeyX25519 contains a reference to a loaded PKCS#11 X25519 private key object.
+type pkcs11PrivateKeyX25519 struct {
+	pkcs11PrivateKey
+}
+
+// isX25519Params returns true if params, a CKA_EC_PARAMS value, names the X25519 curve.
+func isX25519Params(params []byte) bool {
+	return bytes.Equal(params, x25519OID) || bytes.Equal(params, x25519CurveName)
+}
+
+// Export the public key corresponding to a private X25519 key. CKA_EC_POINT is encoded as for Edwards curve keys.
+func exportX25519PublicKey(session *pkcs11Session, pubHandle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	}
+	attributes, err := session.ctx.GetAttributeValue(session.handle, pubHandle, template)
+	if err != nil {
+		return nil, err
+	}
+	if !isX25519Params(attributes[0].Value) {
+		return nil, errUnsupportedMontgomeryCurve
+	}
+	point, err := unmarshalEdwardsPoint(attributes[1].Value, X25519PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return X25519PublicKey(point), nil
+}
+
+// GenerateX25519KeyPair creates an X25519 key pair on the token, for use with Derive. The id parameter is used to
+// set CKA_ID and must be non-nil. The token must support CKM_EC_MONTGOMERY_KEY_PAIR_GEN and CKM_ECDH1_DERIVE.
+func (c *Context) GenerateX25519KeyPair(id []byte) (KeyAgreer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	public, err := NewAttributeSetWithID(id)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the AttributeSet to allow modifications.
+	private := public.Copy()
+
+	return c.GenerateX25519KeyPairWithAttributes(public, private)
+}
+
+// GenerateX25519KeyPairWithLabel creates an X25519 key pair on the token. The id and label parameters are used to
+// set CKA_ID and CKA_LABEL respectively and must be non-nil.
+func (c *Context) GenerateX25519KeyPairWithLabel(id, label []byte) (KeyAgreer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	public, err := NewAttributeSetWithIDAndLabel(id, label)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the AttributeSet to allow modifications.
+	private := public.Copy()
+
+	return c.GenerateX25519KeyPairWithAttributes(public, private)
+}
+
+// GenerateX25519KeyPairWithAttributes generates an X25519 key pair on the token. After this function returns,
+// public and private will contain the attributes applied to the key pair. If required attributes are missing, they
+// will be set to a default value.
+//
+// An error wrapping ErrMechanismNotSupported is returned, without attempting generation, if the token does not
+// advertise CKM_EC_MONTGOMERY_KEY_PAIR_GEN. It is also returned if the token rejects the X25519 curve.
+func (c *Context) GenerateX25519KeyPairWithAttributes(public, private AttributeSet) (KeyAgreer, error) {
+	if c.closed.Get() {
+		return nil, errClosed
+	}
+
+	if c.cfg.PublicOnly {
+		return nil, ErrLoginRequired
+	}
+
+	if !c.tokenSupports(ckmECMontgomeryKeyPairGen, pkcs11.CKF_GENERATE_KEY_PAIR) {
+		return nil, withMessage(ErrMechanismNotSupported, "CKM_EC_MONTGOMERY_KEY_PAIR_GEN")
+	}
+
+	var k *pkcs11PrivateKeyX25519
+	err := c.withSession(func(session *pkcs11Session) error {
+		public.AddIfNotPresent([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkECMontgomery),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, x25519OID),
+		})
+		private.AddIfNotPresent([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		})
+
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmECMontgomeryKeyPairGen, nil)}
+		pubHandle, privHandle, err := session.ctx.GenerateKeyPair(session.handle,
+			mech,
+			public.ToSlice(),
+			private.ToSlice())
+		if isPKCS11Error(err, pkcs11.CKR_CURVE_NOT_SUPPORTED, pkcs11.CKR_DOMAIN_PARAMS_INVALID) {
+			return withMessage(ErrMechanismNotSupported, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+
+		pub, err := exportX25519PublicKey(session, pubHandle)
+		if err != nil {
+			return err
+		}
+		k = &pkcs11PrivateKeyX25519{pkcs11PrivateKey: pkcs11PrivateKey{
+			pkcs11Object: pkcs11Object{
+				handle:  privHandle,
+				context: c,
+			},
+			pubKeyHandle: pubHandle,
+		}}
+		c.retainPublicKey(&k.pkcs11PrivateKey, pub)
+		c.pinKey(session, &k.pkcs11PrivateKey, pub)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Sign always fails: X25519 keys cannot sign. It is present so that X25519 key pairs can be returned by FindKeyPair.
+func (k *pkcs11PrivateKeyX25519) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, errX25519CannotSign
+}
+
+// Derive computes the X25519 shared secret of this key and peerPublicKey, the 32-byte public key of the other party,
+// using CKM_ECDH1_DERIVE without a key derivation function. The 32-byte secret is returned; it is derived as a
+// temporary session object, which is destroyed once the secret has been read.
+//
+// Some tokens refuse to create an extractable secret, or to reveal its value. An error wrapping
+// ErrSharedSecretNotExtractable is then returned, and DeriveKey must be used instead.
+func (k *pkcs11PrivateKeyX25519) Derive(peerPublicKey []byte) ([]byte, error) {
+	if err := k.checkX25519Derive(peerPublicKey); err != nil {
+		return nil, err
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, X25519SharedSecretSize),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+
+	var secret []byte
+	err := k.withSession(func(session *pkcs11Session) error {
+		handle, err := session.ctx.DeriveKey(session.handle, x25519DeriveMechanism(peerPublicKey), k.handle, template)
+		if isPKCS11Error(err, pkcs11.CKR_TEMPLATE_INCONSISTENT, pkcs11.CKR_ATTRIBUTE_VALUE_INVALID) {
+			return withMessage(ErrSharedSecretNotExtractable, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		defer func() { _ = session.ctx.DestroyObject(session.handle, handle) }()
+
+		attributes, err := session.ctx.GetAttributeValue(session.handle, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if isPKCS11Error(err, pkcs11.CKR_ATTRIBUTE_SENSITIVE) {
+			return withMessage(ErrSharedSecretNotExtractable, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		secret = attributes[0].Value
+		return k.context.checkOutputLength("X25519 shared secret", "RFC 7748", X25519SharedSecretSize, secret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// DeriveKey computes the X25519 shared secret of this key and peerPublicKey, as Derive does, but leaves it on the
+// token as a secret key object of the given cipher. The key takes the leading bytes of the secret, 32 unless
+// CkaValueLen is set in template. This works on tokens whose derived secrets are never extractable.
+//
+// After this function returns, template will contain the attributes applied to the derived key. If required
+// attributes are missing, they will be set to a default value.
+func (k *pkcs11PrivateKeyX25519) DeriveKey(peerPublicKey []byte, template AttributeSet,
+	cipher *SymmetricCipher) (key *SecretKey, err error) {
+
+	if err = k.checkX25519Derive(peerPublicKey); err != nil {
+		return nil, err
+	}
+	if len(cipher.GenParams) == 0 {
+		return nil, errors.New("cipher must have GenParams")
+	}
+
+	addSecretKeyDefaults(template, cipher)
+	template.AddIfNotPresent([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, cipher.GenParams[0].KeyType),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, X25519SharedSecretSize),
+	})
+
+	err = k.withSession(func(session *pkcs11Session) error {
+		handle, err := session.ctx.DeriveKey(session.handle, x25519DeriveMechanism(peerPublicKey), k.handle,
+			template.ToSlice())
+		if err != nil {
+			return err
+		}
+		key = newSecretKey(k.context, handle, cipher)
+		return nil
+	})
+	return key, err
+}
+
+// checkX25519Derive checks that k can be used to agree a secret with peerPublicKey.
+func (k *pkcs11PrivateKeyX25519) checkX25519Derive(peerPublicKey []byte) error {
+	if k.context.closed.Get() {
+		return errClosed
+	}
+	if err := k.checkArchived("key agreement"); err != nil {
+		return err
+	}
+	if len(peerPublicKey) != X25519PublicKeySize {
+		return fmt.Errorf("X25519 public key is %d bytes, expected %d", len(peerPublicKey), X25519PublicKeySize)
+	}
+	return nil
+}
+
+// x25519DeriveMechanism returns CKM_ECDH1_DERIVE with CKD_NULL. For Montgomery curves, PKCS#11 3.0 passes the peer
+// public key as the raw u-coordinate rather than a DER-encoded OCTET STRING.
+func x25519DeriveMechanism(peerPublicKey []byte) []*pkcs11.Mechanism {
+	params := pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, peerPublicKey)
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE, params)}
+}
+
+// SupportedOperations reports the operations the key pair can perform, see KeyOperations. Only Derive can be
+// reported for X25519 keys. The permissions of the private key object are read from the token.
+func (k *pkcs11PrivateKeyX25519) SupportedOperations() (*KeyOperations, error) {
+	return k.supportedOperations(ckkECMontgomery)
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestX25519Params(t *testing.T) {
+	assert.True(t, isX25519Params(x25519OID))
+	assert.True(t, isX25519Params(x25519CurveName))
+	assert.False(t, isX25519Params(ed25519OID))
+}
+
+func TestHardX25519(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		id := randomBytes()
+		key, err := ctx.GenerateX25519KeyPair(id)
+		if errors.Is(err, ErrMechanismNotSupported) {
+			t.Skip("token does not support X25519")
+		}
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		peer, err := ctx.GenerateX25519KeyPair(randomBytes())
+		require.NoError(t, err)
+		defer func() { _ = peer.Delete() }()
+
+		pub, ok := key.Public().(X25519PublicKey)
+		require.True(t, ok, "%T", key.Public())
+		assert.Len(t, pub, X25519PublicKeySize)
+		peerPub := peer.Public().(X25519PublicKey)
+
+		_, err = key.Sign(rand.Reader, randomBytes(), crypto.Hash(0))
+		assert.Equal(t, errX25519CannotSign, err)
+
+		_, err = key.Derive(peerPub[1:])
+		assert.Error(t, err)
+
+		// Montgomery keys must not be mistaken for ECDSA keys.
+		found, err := ctx.FindKeyPair(id, nil)
+		require.NoError(t, err)
+		require.IsType(t, &pkcs11PrivateKeyX25519{}, found)
+		assert.Equal(t, pub, found.Public())
+
+		secret, err := key.Derive(peerPub)
+		if errors.Is(err, ErrSharedSecretNotExtractable) {
+			derived, err := key.DeriveKey(peerPub, NewAttributeSet(), CipherGeneric)
+			require.NoError(t, err)
+			_ = derived.Delete()
+			t.Skip("token does not extract shared secrets")
+		}
+		require.NoError(t, err)
+		assert.Len(t, secret, X25519SharedSecretSize)
+
+		peerSecret, err := peer.Derive(pub)
+		require.NoError(t, err)
+		assert.Equal(t, secret, peerSecret)
+	})
+}
@@ -0,0 +1,337 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// errNoSignatureAlgorithm is wrapped by the errors returned when no X.509 signature algorithm can be used with a key.
+var errNoSignatureAlgorithm = errors.New("no usable X.509 signature algorithm")
+
+var (
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidRSAPSS          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidDSAWithSHA256   = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 2}
+	oidOCSPBasic       = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+	oidHashes = map[crypto.Hash]asn1.ObjectIdentifier{
+		crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+		crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+		crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+	}
+)
+
+// x509SignatureScheme describes how an X.509 signature algorithm is implemented with a PKCS#11 mechanism.
+type x509SignatureScheme struct {
+	algorithm x509.SignatureAlgorithm
+	hash      crypto.Hash
+	mechanism uint
+	oid       asn1.ObjectIdentifier
+}
+
+// The signature schemes for each key type, most preferred first. SHA-1 is deliberately absent.
+var (
+	rsaSignatureSchemes = []x509SignatureScheme{
+		{x509.SHA256WithRSA, crypto.SHA256, pkcs11.CKM_RSA_PKCS, oidSHA256WithRSA},
+		{x509.SHA384WithRSA, crypto.SHA384, pkcs11.CKM_RSA_PKCS, oidSHA384WithRSA},
+		{x509.SHA512WithRSA, crypto.SHA512, pkcs11.CKM_RSA_PKCS, oidSHA512WithRSA},
+		{x509.SHA256WithRSAPSS, crypto.SHA256, pkcs11.CKM_RSA_PKCS_PSS, oidRSAPSS},
+		{x509.SHA384WithRSAPSS, crypto.SHA384, pkcs11.CKM_RSA_PKCS_PSS, oidRSAPSS},
+		{x509.SHA512WithRSAPSS, crypto.SHA512, pkcs11.CKM_RSA_PKCS_PSS, oidRSAPSS},
+	}
+	ecdsaSignatureSchemes = []x509SignatureScheme{
+		{x509.ECDSAWithSHA256, crypto.SHA256, pkcs11.CKM_ECDSA, oidECDSAWithSHA256},
+		{x509.ECDSAWithSHA384, crypto.SHA384, pkcs11.CKM_ECDSA, oidECDSAWithSHA384},
+		{x509.ECDSAWithSHA512, crypto.SHA512, pkcs11.CKM_ECDSA, oidECDSAWithSHA512},
+	}
+	dsaSignatureSchemes = []x509SignatureScheme{
+		{x509.DSAWithSHA256, crypto.SHA256, pkcs11.CKM_DSA, oidDSAWithSHA256},
+	}
+)
+
+// pss returns true if the scheme makes RSASSA-PSS signatures.
+func (s x509SignatureScheme) pss() bool {
+	return s.mechanism == pkcs11.CKM_RSA_PKCS_PSS
+}
+
+// signerOpts returns the options to pass to crypto.Signer.Sign.
+func (s x509SignatureScheme) signerOpts() crypto.SignerOpts {
+	if s.pss() {
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: s.hash}
+	}
+	return s.hash
+}
+
+// pssParameters is RSASSA-PSS-params from RFC 4055 section 3.1. The trailer field always has its default value.
+type pssParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+// algorithmIdentifier returns the AlgorithmIdentifier of the scheme, for the signatureAlgorithm field of a signed
+// structure.
+func (s x509SignatureScheme) algorithmIdentifier() (pkix.AlgorithmIdentifier, error) {
+	switch {
+	case s.pss():
+		hash := pkix.AlgorithmIdentifier{Algorithm: oidHashes[s.hash], Parameters: asn1.NullRawValue}
+		hashDER, err := asn1.Marshal(hash)
+		if err != nil {
+			return pkix.AlgorithmIdentifier{}, err
+		}
+		params, err := asn1.Marshal(pssParameters{
+			Hash:       hash,
+			MGF:        pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: hashDER}},
+			SaltLength: s.hash.Size(),
+		})
+		if err != nil {
+			return pkix.AlgorithmIdentifier{}, err
+		}
+		return pkix.AlgorithmIdentifier{Algorithm: s.oid, Parameters: asn1.RawValue{FullBytes: params}}, nil
+	case s.mechanism == pkcs11.CKM_RSA_PKCS:
+		return pkix.AlgorithmIdentifier{Algorithm: s.oid, Parameters: asn1.NullRawValue}, nil
+	default:
+		// ECDSA and DSA signature algorithms have absent parameters (RFC 5758 section 3).
+		return pkix.AlgorithmIdentifier{Algorithm: s.oid}, nil
+	}
+}
+
+// signatureSchemes returns the signature schemes for pub, most preferred first. ECDSA keys prefer the hash whose
+// size matches the curve.
+func signatureSchemes(pub crypto.PublicKey) ([]x509SignatureScheme, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsaSignatureSchemes, nil
+	case *ecdsa.PublicKey:
+		preferred := crypto.SHA256
+		switch bits := pub.Curve.Params().BitSize; {
+		case bits > 384:
+			preferred = crypto.SHA512
+		case bits > 256:
+			preferred = crypto.SHA384
+		}
+		schemes := make([]x509SignatureScheme, 0, len(ecdsaSignatureSchemes))
+		for _, s := range ecdsaSignatureSchemes {
+			if s.hash == preferred {
+				schemes = append([]x509SignatureScheme{s}, schemes...)
+			} else {
+				schemes = append(schemes, s)
+			}
+		}
+		return schemes, nil
+	case *dsa.PublicKey:
+		return dsaSignatureSchemes, nil
+	default:
+		return nil, fmt.Errorf("%w for %T keys", errNoSignatureAlgorithm, pub)
+	}
+}
+
+// X509SignatureAlgorithm returns the signature algorithm that SignCRL and SignOCSPResponse use with key when none is
+// requested. For key pairs on the token, the algorithm must use a mechanism permitted by the CKA_ALLOWED_MECHANISMS
+// of the private key (if the token reports it) and supported by the token for signing, so that an RSA key pair
+// restricted to CKM_RSA_PKCS_PSS gets a PSS algorithm. SHA-256 is preferred, except for ECDSA keys on larger
+// curves, which prefer the hash of matching size. Other signers get the first algorithm for their key type.
+func (c *Context) X509SignatureAlgorithm(key crypto.Signer) (x509.SignatureAlgorithm, error) {
+	scheme, err := c.x509SignatureScheme(key, x509.UnknownSignatureAlgorithm)
+	return scheme.algorithm, err
+}
+
+// x509SignatureScheme returns the signature scheme to use with key. If requested is not
+// x509.UnknownSignatureAlgorithm, it is the only candidate.
+func (c *Context) x509SignatureScheme(key crypto.Signer, requested x509.SignatureAlgorithm) (x509SignatureScheme,
+	error) {
+
+	schemes, err := signatureSchemes(key.Public())
+	if err != nil {
+		return x509SignatureScheme{}, err
+	}
+	if requested != x509.UnknownSignatureAlgorithm {
+		var found []x509SignatureScheme
+		for _, s := range schemes {
+			if s.algorithm == requested {
+				found = append(found, s)
+			}
+		}
+		if len(found) == 0 {
+			return x509SignatureScheme{}, fmt.Errorf("%w: %v cannot be used with %T keys", errNoSignatureAlgorithm,
+				requested, key.Public())
+		}
+		schemes = found
+	}
+
+	k := tokenKeyOf(key)
+	if k == nil {
+		return schemes[0], nil
+	}
+	if profile := k.profileFor(MechanismSign); profile != nil {
+		return x509SignatureScheme{}, fmt.Errorf("%w: key pair uses mechanism profile %q", errNoSignatureAlgorithm,
+			profile.name)
+	}
+
+	usage, err := c.usageAttributes(k, []AttributeType{CkaSign})
+	if err != nil {
+		return x509SignatureScheme{}, withMessage(err, "reading key usage")
+	}
+	if !attributeIsTrue(usage, CkaSign) {
+		return x509SignatureScheme{}, fmt.Errorf("%w: private key lacks CKA_SIGN", errNoSignatureAlgorithm)
+	}
+
+	allowed := c.allowedMechanisms(k)
+	var rejected []string
+	for _, s := range schemes {
+		mechanism := s.mechanism
+		if s.pss() && c.softwarePSS() {
+			mechanism = pkcs11.CKM_RSA_X_509
+		}
+		if mechanismAllowed(allowed, mechanism) && c.tokenCanSign(mechanism) {
+			return s, nil
+		}
+		rejected = append(rejected, s.algorithm.String())
+	}
+	return x509SignatureScheme{}, fmt.Errorf("%w: the key pair or token does not permit %s", errNoSignatureAlgorithm,
+		strings.Join(rejected, ", "))
+}
+
+// tokenCanSign returns false if the token reports that it cannot sign with mech, see tokenSupports.
+func (c *Context) tokenCanSign(mech uint) bool {
+	return c.tokenSupports(mech, pkcs11.CKF_SIGN)
+}
+
+// tokenSupports returns false if the token reports that it does not support mech with the CKF_ flag. If the token
+// cannot report mechanism information, mech is assumed to be supported. The flags of each mechanism are cached for
+// the lifetime of the Context.
+func (c *Context) tokenSupports(mech uint, flag uint) bool {
+	if flags, ok := c.mechanismFlags.Load(mech); ok {
+		return flags.(uint)&flag != 0
+	}
+
+	var flags uint
+	info, err := c.ctx.GetMechanismInfo(c.slot, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)})
+	if err != nil {
+		if !isPKCS11Error(err, pkcs11.CKR_MECHANISM_INVALID) {
+			// Perhaps a transient failure, so the answer is not cached.
+			return true
+		}
+	} else {
+		flags = info.Flags
+	}
+	c.mechanismFlags.Store(mech, flags)
+	return flags&flag != 0
+}
+
+// signX509 signs tbs, the DER encoding of a to-be-signed structure, with key using scheme. It returns the
+// AlgorithmIdentifier and signature to place alongside tbs.
+func (c *Context) signX509(key crypto.Signer, scheme x509SignatureScheme, tbs []byte) (pkix.AlgorithmIdentifier,
+	asn1.BitString, error) {
+
+	algorithm, err := scheme.algorithmIdentifier()
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, asn1.BitString{}, err
+	}
+
+	h := scheme.hash.New()
+	h.Write(tbs)
+	signature, err := key.Sign(c.randReader(), h.Sum(nil), scheme.signerOpts())
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, asn1.BitString{}, err
+	}
+	return algorithm, asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)}, nil
+}
+
+// basicOCSPResponse is BasicOCSPResponse from RFC 6960 section 4.2.1.
+type basicOCSPResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspResponse is OCSPResponse from RFC 6960 section 4.2.1, for a successful response.
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes ocspResponseBytes `asn1:"explicit,tag:0"`
+}
+
+// ocspResponseBytes is ResponseBytes from RFC 6960 section 4.2.1.
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+// SignOCSPResponse signs tbsResponseData, the DER encoding of an OCSP ResponseData structure (RFC 6960 section
+// 4.2.1), with key and returns the DER encoding of a successful OCSPResponse carrying the BasicOCSPResponse.
+//
+// The signature algorithm is chosen as by X509SignatureAlgorithm. If responder is non-nil, its public key must be
+// that of key, and it is included in the response, as is needed when the CA has delegated OCSP signing to it.
+func (c *Context) SignOCSPResponse(tbsResponseData []byte, responder *x509.Certificate, key crypto.Signer) ([]byte,
+	error) {
+
+	var tbs asn1.RawValue
+	if rest, err := asn1.Unmarshal(tbsResponseData, &tbs); err != nil {
+		return nil, withMessage(err, "parsing tbsResponseData")
+	} else if len(rest) > 0 || tbs.Class != asn1.ClassUniversal || tbs.Tag != asn1.TagSequence {
+		return nil, errors.New("tbsResponseData is not a single DER SEQUENCE")
+	}
+
+	response := basicOCSPResponse{TBSResponseData: tbs}
+	if responder != nil {
+		if !publicKeysEqual(responder.PublicKey, key.Public()) {
+			return nil, errors.New("responder certificate does not match the signing key")
+		}
+		response.Certificates = []asn1.RawValue{{FullBytes: responder.Raw}}
+	}
+
+	scheme, err := c.x509SignatureScheme(key, x509.UnknownSignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if response.SignatureAlgorithm, response.Signature, err = c.signX509(key, scheme, tbsResponseData); err != nil {
+		return nil, withMessage(err, "signing OCSP response")
+	}
+
+	basic, err := asn1.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspResponse{
+		Status:        0, // successful
+		ResponseBytes: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basic},
+	})
+}
@@ -0,0 +1,288 @@
+// Copyright 2021 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signedStructure is the outer layer shared by certificates, CRLs and BasicOCSPResponse.
+type signedStructure struct {
+	TBS                asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+// selfSignedCertificate returns a CA certificate for key, signed with key using algorithm.
+func selfSignedCertificate(t *testing.T, key crypto.Signer, algorithm x509.SignatureAlgorithm) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "crypto11 test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+		SignatureAlgorithm:    algorithm,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return certificate
+}
+
+func TestSignatureSchemes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	schemes, err := signatureSchemes(rsaKey.Public())
+	require.NoError(t, err)
+	assert.Equal(t, x509.SHA256WithRSA, schemes[0].algorithm)
+
+	for curve, expected := range map[elliptic.Curve]x509.SignatureAlgorithm{
+		elliptic.P256(): x509.ECDSAWithSHA256,
+		elliptic.P384(): x509.ECDSAWithSHA384,
+		elliptic.P521(): x509.ECDSAWithSHA512,
+	} {
+		ecKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		require.NoError(t, err)
+		schemes, err = signatureSchemes(ecKey.Public())
+		require.NoError(t, err)
+		assert.Equal(t, expected, schemes[0].algorithm)
+		assert.Len(t, schemes, len(ecdsaSignatureSchemes))
+	}
+
+	_, err = signatureSchemes("not a key")
+	assert.True(t, errors.Is(err, errNoSignatureAlgorithm), "%v", err)
+}
+
+func TestAlgorithmIdentifierMatchesX509(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	check := func(key crypto.Signer, scheme x509SignatureScheme) {
+		certificate := selfSignedCertificate(t, key, scheme.algorithm)
+		var outer signedStructure
+		_, err := asn1.Unmarshal(certificate.Raw, &outer)
+		require.NoError(t, err)
+
+		algorithm, err := scheme.algorithmIdentifier()
+		require.NoError(t, err)
+		expected, err := asn1.Marshal(outer.SignatureAlgorithm)
+		require.NoError(t, err)
+		actual, err := asn1.Marshal(algorithm)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual, "%v", scheme.algorithm)
+	}
+	for _, scheme := range rsaSignatureSchemes {
+		check(rsaKey, scheme)
+	}
+	for _, scheme := range ecdsaSignatureSchemes {
+		check(ecKey, scheme)
+	}
+}
+
+// testResponseData returns a DER ResponseData reporting serial as good.
+func testResponseData(t *testing.T, responder *x509.Certificate, serial *big.Int) []byte {
+	type certID struct {
+		HashAlgorithm  pkix.AlgorithmIdentifier
+		IssuerNameHash []byte
+		IssuerKeyHash  []byte
+		SerialNumber   *big.Int
+	}
+	type singleResponse struct {
+		CertID     certID
+		Good       asn1.Flag `asn1:"tag:0,optional"`
+		ThisUpdate time.Time `asn1:"generalized"`
+	}
+	type responseData struct {
+		ResponderKeyHash []byte    `asn1:"explicit,tag:2"`
+		ProducedAt       time.Time `asn1:"generalized"`
+		Responses        []singleResponse
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	keyHash := sha256.Sum256(responder.RawSubjectPublicKeyInfo)
+	nameHash := sha256.Sum256(responder.RawSubject)
+	der, err := asn1.Marshal(responseData{
+		ResponderKeyHash: keyHash[:20],
+		ProducedAt:       now,
+		Responses: []singleResponse{{
+			CertID: certID{
+				HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidHashes[crypto.SHA256]},
+				IssuerNameHash: nameHash[:],
+				IssuerKeyHash:  keyHash[:],
+				SerialNumber:   serial,
+			},
+			Good:       true,
+			ThisUpdate: now,
+		}},
+	})
+	require.NoError(t, err)
+	return der
+}
+
+// parseOCSPResponse returns the BasicOCSPResponse carried by a successful OCSPResponse.
+func parseOCSPResponse(t *testing.T, der []byte) basicOCSPResponse {
+	var response ocspResponse
+	rest, err := asn1.Unmarshal(der, &response)
+	require.NoError(t, err)
+	require.Empty(t, rest)
+	require.Equal(t, asn1.Enumerated(0), response.Status)
+	require.True(t, response.ResponseBytes.ResponseType.Equal(oidOCSPBasic))
+
+	var basic basicOCSPResponse
+	rest, err = asn1.Unmarshal(response.ResponseBytes.Response, &basic)
+	require.NoError(t, err)
+	require.Empty(t, rest)
+	return basic
+}
+
+func TestSignOCSPResponse(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		rsaKey, err := ctx.GenerateRSAKeyPair(randomBytes(), rsaSize)
+		require.NoError(t, err)
+		defer func() { _ = rsaKey.Delete() }()
+
+		ecKey, err := ctx.GenerateECDSAKeyPair(randomBytes(), elliptic.P384())
+		require.NoError(t, err)
+		defer func() { _ = ecKey.Delete() }()
+
+		for name, key := range map[string]Signer{"RSA": rsaKey, "ECDSA": ecKey} {
+			t.Run(name, func(t *testing.T) {
+				algorithm, err := ctx.X509SignatureAlgorithm(key)
+				require.NoError(t, err)
+				responder := selfSignedCertificate(t, key, algorithm)
+				tbs := testResponseData(t, responder, big.NewInt(42))
+
+				der, err := ctx.SignOCSPResponse(tbs, responder, key)
+				require.NoError(t, err)
+				basic := parseOCSPResponse(t, der)
+				assert.Equal(t, tbs, basic.TBSResponseData.FullBytes)
+				require.Len(t, basic.Certificates, 1)
+				assert.Equal(t, responder.Raw, basic.Certificates[0].FullBytes)
+
+				// The algorithm identifier must be the one crypto/x509 uses for the same algorithm.
+				var outer signedStructure
+				_, err = asn1.Unmarshal(responder.Raw, &outer)
+				require.NoError(t, err)
+				assert.Equal(t, outer.SignatureAlgorithm, basic.SignatureAlgorithm)
+
+				err = responder.CheckSignature(algorithm, tbs, basic.Signature.RightAlign())
+				assert.NoError(t, err)
+
+				other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				require.NoError(t, err)
+				_, err = ctx.SignOCSPResponse(tbs, selfSignedCertificate(t, other, x509.ECDSAWithSHA256), key)
+				assert.Error(t, err)
+
+				_, err = ctx.SignOCSPResponse(append(tbs, 0), responder, key)
+				assert.Error(t, err)
+			})
+		}
+	})
+}
+
+func TestSignOCSPResponseDSA(t *testing.T) {
+	skipTest(t, skipTestDSA)
+
+	withContext(t, func(ctx *Context) {
+		key, err := ctx.GenerateDSAKeyPair(randomBytes(), dsaSizes[dsa.L2048N256])
+		require.NoError(t, err)
+		defer func() { _ = key.Delete() }()
+
+		tbs, err := asn1.Marshal(struct{ Serial int }{42})
+		require.NoError(t, err)
+		der, err := ctx.SignOCSPResponse(tbs, nil, key)
+		require.NoError(t, err)
+		basic := parseOCSPResponse(t, der)
+		assert.Empty(t, basic.Certificates)
+		assert.True(t, basic.SignatureAlgorithm.Algorithm.Equal(oidDSAWithSHA256))
+
+		var signature dsaSignature
+		require.NoError(t, signature.unmarshalDER(basic.Signature.RightAlign()))
+		digest := sha256.Sum256(tbs)
+		assert.True(t, dsa.Verify(key.Public().(*dsa.PublicKey), digest[:], signature.R, signature.S))
+	})
+}
+
+func TestX509SignatureAlgorithmPSSOnly(t *testing.T) {
+	withContext(t, func(ctx *Context) {
+		if !ctx.tokenCanSign(pkcs11.CKM_RSA_PKCS_PSS) {
+			t.Skip("token does not support CKM_RSA_PKCS_PSS")
+		}
+
+		public, err := NewAttributeSetWithID(randomBytes())
+		require.NoError(t, err)
+		private := public.Copy()
+		require.NoError(t, private.Set(CkaAllowedMechanisms, ulongToBytes(pkcs11.CKM_RSA_PKCS_PSS)))
+
+		key, err := ctx.GenerateRSAKeyPairWithAttributes(public, private, rsaSize)
+		if err != nil {
+			t.Skipf("token cannot restrict allowed mechanisms: %v", err)
+		}
+		defer func() { _ = key.Delete() }()
+		if len(ctx.allowedMechanisms(tokenKeyOf(key))) == 0 {
+			t.Skip("token does not report CKA_ALLOWED_MECHANISMS")
+		}
+
+		algorithm, err := ctx.X509SignatureAlgorithm(key)
+		require.NoError(t, err)
+		assert.Equal(t, x509.SHA256WithRSAPSS, algorithm)
+
+		_, err = ctx.x509SignatureScheme(key, x509.SHA256WithRSA)
+		assert.True(t, errors.Is(err, errNoSignatureAlgorithm), "%v", err)
+		_, err = ctx.x509SignatureScheme(key, x509.ECDSAWithSHA256)
+		assert.True(t, errors.Is(err, errNoSignatureAlgorithm), "%v", err)
+
+		// The probe must be signable with the chosen algorithm.
+		tbs, err := asn1.Marshal(struct{ Serial int }{42})
+		require.NoError(t, err)
+		der, err := ctx.SignOCSPResponse(tbs, nil, key)
+		require.NoError(t, err)
+		basic := parseOCSPResponse(t, der)
+		digest := sha256.Sum256(tbs)
+		err = rsa.VerifyPSS(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], basic.Signature.RightAlign(),
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		assert.NoError(t, err)
+	})
+}